@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const adminStatsTTL = 60 * time.Second
+
+type adminStats struct {
+	GeneratedAt          time.Time          `json:"generated_at"`
+	TotalListings        int64              `json:"total_listings"`
+	ActiveListings       int64              `json:"active_listings"`
+	TotalProperties      int64              `json:"total_properties"`
+	UsersRegistered      int64              `json:"users_registered"`
+	UsersSince           time.Time          `json:"users_since"`
+	Inquiries            int64              `json:"inquiries"`
+	InquiriesSince       time.Time          `json:"inquiries_since"`
+	UpcomingAppointments int64              `json:"upcoming_appointments"`
+	AveragePriceByType   map[string]float64 `json:"average_price_by_listing_type"`
+}
+
+type cachedAdminStats struct {
+	stats     *adminStats
+	expiresAt time.Time
+}
+
+var (
+	adminStatsMu    sync.Mutex
+	adminStatsCache = map[string]cachedAdminStats{}
+)
+
+// getAdminStats returns dashboard numbers, cached in-process for a minute per distinct query.
+// ?users_since= and ?inquiries_since= (RFC3339 or YYYY-MM-DD) override the default
+// windows of the current month and the current week (Monday start) in Bangkok time.
+// Archived inquiries and appointments are not counted.
+func getAdminStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	setArchivesIncluded(w, false)
+
+	now := time.Now().In(bangkok)
+	usersSince := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, bangkok)
+	weekday := (int(now.Weekday()) + 6) % 7 // days since Monday
+	inquiriesSince := time.Date(now.Year(), now.Month(), now.Day()-weekday, 0, 0, 0, 0, bangkok)
+
+	q := r.URL.Query()
+	var err error
+	if raw := q.Get("users_since"); raw != "" {
+		if usersSince, err = parseDateOrTime(raw); err != nil {
+			http.Error(w, "users_since must be RFC3339 or YYYY-MM-DD", http.StatusBadRequest)
+			return
+		}
+	}
+	if raw := q.Get("inquiries_since"); raw != "" {
+		if inquiriesSince, err = parseDateOrTime(raw); err != nil {
+			http.Error(w, "inquiries_since must be RFC3339 or YYYY-MM-DD", http.StatusBadRequest)
+			return
+		}
+	}
+
+	cacheKey := usersSince.UTC().Format(time.RFC3339) + "|" + inquiriesSince.UTC().Format(time.RFC3339)
+	adminStatsMu.Lock()
+	cached, ok := adminStatsCache[cacheKey]
+	adminStatsMu.Unlock()
+	if ok && time.Now().Before(cached.expiresAt) {
+		json.NewEncoder(w).Encode(cached.stats)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	stats, err := computeAdminStats(ctx, usersSince, inquiriesSince)
+	if err != nil {
+		serverError(w, r, "Failed to compute statistics", err)
+		return
+	}
+
+	adminStatsMu.Lock()
+	for key, c := range adminStatsCache {
+		if time.Now().After(c.expiresAt) {
+			delete(adminStatsCache, key)
+		}
+	}
+	adminStatsCache[cacheKey] = cachedAdminStats{stats: stats, expiresAt: time.Now().Add(adminStatsTTL)}
+	adminStatsMu.Unlock()
+
+	json.NewEncoder(w).Encode(stats)
+}
+
+func computeAdminStats(ctx context.Context, usersSince, inquiriesSince time.Time) (*adminStats, error) {
+	db := client.Database("MVDB")
+	stats := &adminStats{
+		GeneratedAt:    time.Now().UTC(),
+		UsersSince:     usersSince,
+		InquiriesSince: inquiriesSince,
+	}
+
+	counts := []struct {
+		target     *int64
+		collection string
+		filter     bson.M
+	}{
+		{&stats.TotalListings, "listings", notDeleted(bson.M{})},
+		{&stats.ActiveListings, "listings", activeListingsFilter(bson.M{})},
+		{&stats.TotalProperties, "properties", notDeleted(bson.M{})},
+		{&stats.UsersRegistered, "users", notDeleted(bson.M{"created_at": bson.M{"$gte": usersSince}})},
+		{&stats.Inquiries, "inquiries", bson.M{"created_at": bson.M{"$gte": inquiriesSince}}},
+		{&stats.UpcomingAppointments, "appointments", bson.M{"status": bson.M{"$in": openAppointmentStatuses}, "appointment_date": bson.M{"$gte": time.Now()}}},
+	}
+	for _, c := range counts {
+		n, err := db.Collection(c.collection).CountDocuments(ctx, c.filter)
+		if err != nil {
+			return nil, err
+		}
+		*c.target = n
+	}
+
+	pipeline := []bson.M{
+		{"$match": activeListingsFilter(bson.M{})},
+		{"$group": bson.M{"_id": "$listing_type", "average": bson.M{"$avg": "$price"}}},
+	}
+	cur, err := db.Collection("listings").Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	var rows []struct {
+		ListingType string  `bson:"_id"`
+		Average     float64 `bson:"average"`
+	}
+	if err := cur.All(ctx, &rows); err != nil {
+		return nil, err
+	}
+	stats.AveragePriceByType = map[string]float64{}
+	for _, row := range rows {
+		stats.AveragePriceByType[row.ListingType] = row.Average
+	}
+	return stats, nil
+}
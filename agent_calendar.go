@@ -0,0 +1,412 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Viewings last viewingSlotLength and are held within the working hours of the listing's agent,
+// outside their blackouts. Working hours are wall-clock times in Bangkok per weekday; blackouts are
+// instants, so one from an evening to the next morning blocks across midnight like any other.
+// Listings without an active agent, and agents who never set their hours, use the global hours
+// of VIEWING_HOURS (default 09:00-18:00) on every day.
+const (
+	viewingSlotLength   = time.Hour
+	maxSlotDays         = 31
+	maxAgentBlackouts   = 100
+	defaultViewingHours = "09:00-18:00"
+)
+
+var weekdays = []string{"sunday", "monday", "tuesday", "wednesday", "thursday", "friday", "saturday"}
+
+// workingHours is one period of a weekday, "HH:MM" to "HH:MM" with end up to "24:00". A day may
+// have several; a day without any is off.
+type workingHours struct {
+	Day   string `bson:"day" json:"day"`
+	Start string `bson:"start" json:"start"`
+	End   string `bson:"end" json:"end"`
+}
+
+type agentBlackout struct {
+	From time.Time `bson:"from" json:"from"`
+	To   time.Time `bson:"to" json:"to"`
+}
+
+// agentAvailability is Agent.Availability, managed with GET and PUT /agents/{id}/availability
+type agentAvailability struct {
+	Weekly    []workingHours  `bson:"weekly" json:"weekly"`
+	Blackouts []agentBlackout `bson:"blackouts" json:"blackouts"`
+}
+
+var globalViewingHours = viewingHoursFromEnv()
+
+func viewingHoursFromEnv() *agentAvailability {
+	raw := os.Getenv("VIEWING_HOURS")
+	if raw == "" {
+		raw = defaultViewingHours
+	}
+	start, end, _ := strings.Cut(raw, "-")
+	s, okStart := clockMinutes(start)
+	e, okEnd := clockMinutes(end)
+	if !okStart || !okEnd || s >= e {
+		log.Println("Ignoring invalid VIEWING_HOURS:", raw)
+		start, end, _ = strings.Cut(defaultViewingHours, "-")
+	}
+	hours := &agentAvailability{Blackouts: []agentBlackout{}}
+	for _, day := range weekdays {
+		hours.Weekly = append(hours.Weekly, workingHours{Day: day, Start: start, End: end})
+	}
+	return hours
+}
+
+// clockMinutes parses "HH:MM" into minutes after midnight, allowing "24:00" as the end of the day
+func clockMinutes(clock string) (int, bool) {
+	h, m, ok := strings.Cut(clock, ":")
+	if !ok || len(h) != 2 || len(m) != 2 {
+		return 0, false
+	}
+	hours, err1 := strconv.Atoi(h)
+	minutes, err2 := strconv.Atoi(m)
+	if err1 != nil || err2 != nil || hours < 0 || minutes < 0 || minutes > 59 || hours > 24 || (hours == 24 && minutes > 0) {
+		return 0, false
+	}
+	return hours*60 + minutes, true
+}
+
+// calendarConflict is why a time can't be booked; answered with 422
+type calendarConflict struct {
+	Reason string
+}
+
+func (e *calendarConflict) Error() string { return e.Reason }
+
+// check returns a *calendarConflict unless a viewing can start at t
+func (a *agentAvailability) check(t time.Time) error {
+	local := t.In(bangkok)
+	day := weekdays[local.Weekday()]
+	start := time.Duration(local.Hour())*time.Hour + time.Duration(local.Minute())*time.Minute + time.Duration(local.Second())*time.Second
+	inHours := false
+	for _, h := range a.Weekly {
+		s, _ := clockMinutes(h.Start)
+		e, _ := clockMinutes(h.End)
+		if h.Day == day && time.Duration(s)*time.Minute <= start && start+viewingSlotLength <= time.Duration(e)*time.Minute {
+			inHours = true
+			break
+		}
+	}
+	if !inHours {
+		return &calendarConflict{Reason: local.Format("Monday 15:04") + " is outside the viewing hours"}
+	}
+	for _, b := range a.Blackouts {
+		if t.Before(b.To) && t.Add(viewingSlotLength).After(b.From) {
+			return &calendarConflict{Reason: fmt.Sprintf("The agent is unavailable from %s to %s",
+				b.From.In(bangkok).Format("2 Jan 15:04"), b.To.In(bangkok).Format("2 Jan 15:04"))}
+		}
+	}
+	return nil
+}
+
+// listingCalendar returns the availability of the listing's agent, the global hours when the
+// listing has no active agent or the agent never set theirs, and the agent's id if any
+func listingCalendar(ctx context.Context, listingID string) (*agentAvailability, string, error) {
+	oid, err := primitive.ObjectIDFromHex(listingID)
+	if err != nil {
+		return globalViewingHours, "", nil
+	}
+	db := client.Database("MVDB")
+	var listing Listing
+	err = db.Collection("listings").FindOne(ctx, bson.M{"_id": oid}, options.FindOne().SetProjection(bson.M{"agent_id": 1})).Decode(&listing)
+	if err == mongo.ErrNoDocuments {
+		return globalViewingHours, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	agentID, err := primitive.ObjectIDFromHex(listing.AgentID)
+	if err != nil {
+		return globalViewingHours, "", nil
+	}
+	var agent Agent
+	err = db.Collection("agents").FindOne(ctx, notDeleted(bson.M{"_id": agentID, "active": true}),
+		options.FindOne().SetProjection(bson.M{"availability": 1})).Decode(&agent)
+	if err == mongo.ErrNoDocuments {
+		return globalViewingHours, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if agent.Availability == nil {
+		return globalViewingHours, listing.AgentID, nil
+	}
+	return agent.Availability, listing.AgentID, nil
+}
+
+var errCalendarCheck = errors.New("Failed to check the agent's calendar")
+
+// checkViewingTime returns a *calendarConflict when no viewing of the listing can start at t
+func checkViewingTime(ctx context.Context, listingID string, t time.Time) error {
+	calendar, _, err := listingCalendar(ctx, listingID)
+	if err != nil {
+		log.Println("Failed to load the calendar of listing", listingID, ":", err)
+		return errCalendarCheck
+	}
+	return calendar.check(t)
+}
+
+// getListingSlots answers GET /listings/{id}/available-slots with the start times a viewing can be
+// booked at: within the agent's hours, outside blackouts and clear of open appointments, from ?from=
+// (YYYY-MM-DD, default today) for ?days= days (1-31, default 7). Times are rendered in ?tz=.
+func getListingSlots(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	id, ok := pathObjectID(w, r, "Listing")
+	if !ok {
+		return
+	}
+	loc, ok := responseLocation(w, r)
+	if !ok {
+		return
+	}
+	q := r.URL.Query()
+	now := time.Now()
+	first := truncatePeriod(now, "day", bangkok)
+	if raw := q.Get("from"); raw != "" {
+		t, err := time.ParseInLocation("2006-01-02", raw, bangkok)
+		if err != nil {
+			http.Error(w, "from must be YYYY-MM-DD", http.StatusBadRequest)
+			return
+		}
+		first = t
+	}
+	days := 7
+	if raw := q.Get("days"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > maxSlotDays {
+			http.Error(w, "days must be between 1 and 31", http.StatusBadRequest)
+			return
+		}
+		days = n
+	}
+	last := first.AddDate(0, 0, days)
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	if err := client.Database("MVDB").Collection("listings").FindOne(ctx, notDeleted(bson.M{"_id": id})).Err(); err == mongo.ErrNoDocuments {
+		http.Error(w, "Listing not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		serverError(w, r, "Failed to retrieve Listing", err)
+		return
+	}
+	calendar, agentID, err := listingCalendar(ctx, id.Hex())
+	if err != nil {
+		serverError(w, r, errCalendarCheck.Error(), err)
+		return
+	}
+	booked, err := findAllWith[Appointment](ctx, "appointments", bson.M{
+		"listing_id":       id.Hex(),
+		"status":           bson.M{"$in": openAppointmentStatuses},
+		"appointment_date": bson.M{"$gt": first.Add(-viewingSlotLength), "$lt": last},
+	}, options.Find().SetProjection(bson.M{"appointment_date": 1}))
+	if err != nil {
+		serverError(w, r, "Failed to retrieve Appointments", err)
+		return
+	}
+
+	slots := []time.Time{}
+	for day := first; day.Before(last); day = day.AddDate(0, 0, 1) {
+		for _, h := range calendar.Weekly {
+			if h.Day != weekdays[day.Weekday()] {
+				continue
+			}
+			s, _ := clockMinutes(h.Start)
+			e, _ := clockMinutes(h.End)
+			for m := s; m+int(viewingSlotLength/time.Minute) <= e; m += int(viewingSlotLength / time.Minute) {
+				t := day.Add(time.Duration(m) * time.Minute)
+				if !t.After(now) || calendar.check(t) != nil || overlapsBooking(t, booked) {
+					continue
+				}
+				slots = append(slots, t.In(loc))
+			}
+		}
+	}
+	json.NewEncoder(w).Encode(bson.M{
+		"listing_id":   id.Hex(),
+		"agent_id":     agentID,
+		"slot_minutes": int(viewingSlotLength / time.Minute),
+		"slots":        slots,
+	})
+}
+
+func overlapsBooking(t time.Time, booked []Appointment) bool {
+	for _, a := range booked {
+		if t.Before(a.AppointmentDate.Add(viewingSlotLength)) && a.AppointmentDate.Before(t.Add(viewingSlotLength)) {
+			return true
+		}
+	}
+	return false
+}
+
+// availabilityBody is the body of PUT /agents/{id}/availability. Blackout bounds are RFC3339 or
+// YYYY-MM-DD in Bangkok; a date as to includes that whole day.
+type availabilityBody struct {
+	Weekly    []workingHours `json:"weekly"`
+	Blackouts []struct {
+		From string `json:"from"`
+		To   string `json:"to"`
+	} `json:"blackouts"`
+}
+
+func (b availabilityBody) availability() (*agentAvailability, []string) {
+	var problems []string
+	a := &agentAvailability{Weekly: []workingHours{}, Blackouts: []agentBlackout{}}
+	for i, h := range b.Weekly {
+		h.Day = strings.ToLower(strings.TrimSpace(h.Day))
+		s, okStart := clockMinutes(h.Start)
+		e, okEnd := clockMinutes(h.End)
+		switch {
+		case !isOneOf(h.Day, weekdays):
+			problems = append(problems, fmt.Sprintf("weekly[%d].day must be a weekday name such as monday", i))
+		case !okStart || !okEnd:
+			problems = append(problems, fmt.Sprintf("weekly[%d] start and end must be HH:MM", i))
+		case s >= e:
+			problems = append(problems, fmt.Sprintf("weekly[%d].start must be before end", i))
+		}
+		a.Weekly = append(a.Weekly, h)
+	}
+	if len(b.Blackouts) > maxAgentBlackouts {
+		problems = append(problems, "at most 100 blackouts")
+	}
+	for i, raw := range b.Blackouts {
+		from, errFrom := parseDateOrTime(raw.From)
+		to, errTo := parseDateOrTime(raw.To)
+		if errFrom != nil || errTo != nil {
+			problems = append(problems, fmt.Sprintf("blackouts[%d] from and to must be RFC3339 or YYYY-MM-DD", i))
+			continue
+		}
+		if len(raw.To) == len("2006-01-02") {
+			to = to.AddDate(0, 0, 1)
+		}
+		if !from.Before(to) {
+			problems = append(problems, fmt.Sprintf("blackouts[%d].from must be before to", i))
+			continue
+		}
+		a.Blackouts = append(a.Blackouts, agentBlackout{From: from.UTC(), To: to.UTC()})
+	}
+	return a, problems
+}
+
+// requireAgentOrAPIKey lets the agent {id} in with their token from POST /agents/{id}/token as an
+// Authorization: Bearer header, and everyone else with the API key
+func requireAgentOrAPIKey(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") {
+			requireAPIKey(next).ServeHTTP(w, r)
+			return
+		}
+		agentID, err := verifyAgentToken(strings.TrimPrefix(auth, "Bearer "))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if agentID != mux.Vars(r)["id"] {
+			http.Error(w, "The agent token is for another agent", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// getAgentAvailability answers GET /agents/{id}/availability with the agent's hours and
+// blackouts; default is true when the agent uses the global hours
+func getAgentAvailability(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	id, ok := pathObjectID(w, r, "Agent")
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	var agent Agent
+	err := client.Database("MVDB").Collection("agents").FindOne(ctx, notDeleted(bson.M{"_id": id})).Decode(&agent)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Agent not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		serverError(w, r, "Failed to retrieve Agent", err)
+		return
+	}
+	availability, isDefault := agent.Availability, agent.Availability == nil
+	if isDefault {
+		availability = globalViewingHours
+	}
+	json.NewEncoder(w).Encode(struct {
+		*agentAvailability
+		Default bool `json:"default"`
+	}{availability, isDefault})
+}
+
+// setAgentAvailability answers PUT /agents/{id}/availability, replacing the agent's hours and
+// blackouts. Appointments already booked outside them are kept.
+func setAgentAvailability(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	id, ok := pathObjectID(w, r, "Agent")
+	if !ok {
+		return
+	}
+	var body availabilityBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Failed to parse request body", http.StatusBadRequest)
+		return
+	}
+	availability, problems := body.availability()
+	if len(problems) > 0 {
+		http.Error(w, (&validationError{Problems: problems}).Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	collection := client.Database("MVDB").Collection("agents")
+	before := auditSnapshot(ctx, "agents", id)
+	var agent Agent
+	err := collection.FindOneAndUpdate(ctx, notDeleted(bson.M{"_id": id}),
+		bson.M{"$set": bson.M{"availability": availability, "updated_at": time.Now()}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&agent)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Agent not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		serverError(w, r, "Failed to update Agent", err)
+		return
+	}
+	meta := auditFromRequest(r)
+	if strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+		meta.Actor = "agent:" + id.Hex()
+	}
+	recordAudit(meta, "update", "agents", id.Hex(), before, agent, nil)
+	json.NewEncoder(w).Encode(agent.Availability)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+type agentStats struct {
+	AgentID               string   `json:"agent_id"`
+	Name                  string   `json:"name"`
+	ListingsCreated       int      `json:"listings_created"`
+	InquiriesAssigned     int      `json:"inquiries_assigned"`
+	InquiriesAnswered     int      `json:"inquiries_answered"`
+	AvgFirstReplyMinutes  *float64 `json:"avg_first_reply_minutes"` // null when none were answered
+	AppointmentsCompleted int      `json:"appointments_completed"`
+	AppointmentsCancelled int      `json:"appointments_cancelled"`
+	ListingsSold          int      `json:"listings_sold"`
+	ListingsRented        int      `json:"listings_rented"`
+}
+
+// agentStatsRow is the shape every pipeline below groups into
+type agentStatsRow struct {
+	AgentID  string   `bson:"_id"`
+	Key      string   `bson:"key"` // appointment status or deactivation reason
+	Count    int      `bson:"count"`
+	Answered int      `bson:"answered"`
+	AvgReply *float64 `bson:"avg_reply_ms"`
+}
+
+// listingAgentLookup joins agent_id from the listing onto documents that only have a listing_id
+var listingAgentLookup = []bson.M{
+	{"$lookup": bson.M{
+		"from":     "listings",
+		"let":      bson.M{"lid": bson.M{"$convert": bson.M{"input": "$listing_id", "to": "objectId", "onError": nil, "onNull": nil}}},
+		"pipeline": []bson.M{{"$match": bson.M{"$expr": bson.M{"$eq": bson.A{"$_id", "$$lid"}}}}, {"$project": bson.M{"agent_id": 1}}},
+		"as":       "_listing",
+	}},
+	{"$addFields": bson.M{"agent_id": bson.M{"$first": "$_listing.agent_id"}}},
+}
+
+// getAgentStats aggregates per-agent activity over ?from= and ?to= (dates in Bangkok time, to inclusive):
+// listings created, inquiries assigned and answered with the average first reply latency, appointments
+// in the window by outcome, and listings deactivated as sold or rented. Sorted by completed appointments.
+// Inquiries and appointments moved to the archive count with ?include_archived=true only.
+func getAgentStats(w http.ResponseWriter, r *http.Request) {
+	from, to, err := parseDateRange(r.URL.Query())
+	if err != nil {
+		http.Error(w, "from and to must be RFC3339 or YYYY-MM-DD", http.StatusBadRequest)
+		return
+	}
+	window := func(field string, match bson.M) bson.M {
+		if rng := timeRangeFilter(from, to); rng != nil {
+			match[field] = rng
+		}
+		return match
+	}
+	hasAgent := bson.M{"$nin": bson.A{nil, ""}}
+	archived := includeArchived(r)
+	// withArchive adds the archive of collectionName after the leading $match of pipeline
+	withArchive := func(collectionName string, pipeline []bson.M) []bson.M {
+		if !archived {
+			return pipeline
+		}
+		union := archiveUnion(collectionName, pipeline[0]["$match"].(bson.M))
+		return append([]bson.M{pipeline[0], union}, pipeline[1:]...)
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 15*time.Second)
+	defer cancel()
+
+	// Appointments are credited to the agent of their listing
+	appointments := []bson.M{{"$match": window("appointment_date", bson.M{"status": bson.M{"$in": bson.A{"completed", "cancelled"}}})}}
+	appointments = append(appointments, listingAgentLookup...)
+	appointments = append(appointments,
+		bson.M{"$match": bson.M{"agent_id": hasAgent}},
+		bson.M{"$group": bson.M{"_id": bson.M{"agent": "$agent_id", "key": "$status"}, "count": bson.M{"$sum": 1}}},
+		bson.M{"$project": bson.M{"_id": "$_id.agent", "key": "$_id.key", "count": 1}},
+	)
+
+	rows := map[string]*agentStats{}
+	row := func(agentID string) *agentStats {
+		if rows[agentID] == nil {
+			rows[agentID] = &agentStats{AgentID: agentID}
+		}
+		return rows[agentID]
+	}
+	sources := []struct {
+		collection string
+		pipeline   []bson.M
+		add        func(agentStatsRow)
+	}{
+		{"listings", []bson.M{
+			{"$match": window("created_at", bson.M{"agent_id": hasAgent})},
+			{"$group": bson.M{"_id": "$agent_id", "count": bson.M{"$sum": 1}}},
+		}, func(c agentStatsRow) { row(c.AgentID).ListingsCreated += c.Count }},
+		{"inquiries", withArchive("inquiries", []bson.M{
+			{"$match": window("assigned_at", bson.M{"assigned_agent_id": hasAgent})},
+			{"$group": bson.M{
+				"_id":          "$assigned_agent_id",
+				"count":        bson.M{"$sum": 1},
+				"answered":     bson.M{"$sum": bson.M{"$cond": bson.A{bson.M{"$ifNull": bson.A{"$first_reply_at", false}}, 1, 0}}},
+				"avg_reply_ms": bson.M{"$avg": bson.M{"$subtract": bson.A{"$first_reply_at", "$created_at"}}},
+			}},
+		}), func(c agentStatsRow) {
+			s := row(c.AgentID)
+			s.InquiriesAssigned += c.Count
+			s.InquiriesAnswered += c.Answered
+			if c.AvgReply != nil {
+				minutes := roundMoney(*c.AvgReply / float64(time.Minute/time.Millisecond))
+				s.AvgFirstReplyMinutes = &minutes
+			}
+		}},
+		{"appointments", withArchive("appointments", appointments), func(c agentStatsRow) {
+			if c.Key == "completed" {
+				row(c.AgentID).AppointmentsCompleted += c.Count
+			} else {
+				row(c.AgentID).AppointmentsCancelled += c.Count
+			}
+		}},
+		{"listings", []bson.M{
+			{"$match": window("deactivated_at", bson.M{"agent_id": hasAgent, "deactivation_reason": bson.M{"$in": bson.A{"sold", "rented"}}})},
+			{"$group": bson.M{"_id": bson.M{"agent": "$agent_id", "key": "$deactivation_reason"}, "count": bson.M{"$sum": 1}}},
+			{"$project": bson.M{"_id": "$_id.agent", "key": "$_id.key", "count": 1}},
+		}, func(c agentStatsRow) {
+			if c.Key == "sold" {
+				row(c.AgentID).ListingsSold += c.Count
+			} else {
+				row(c.AgentID).ListingsRented += c.Count
+			}
+		}},
+	}
+	for _, src := range sources {
+		if err := aggregateAgentStats(ctx, src.collection, src.pipeline, src.add); err != nil {
+			serverError(w, r, "Failed to aggregate agent statistics", err)
+			return
+		}
+	}
+
+	// Agents without activity are listed too, with zeros
+	agents, err := findAll[Agent](ctx, "agents", notDeleted(bson.M{}))
+	if err != nil {
+		serverError(w, r, "Failed to retrieve Agents", err)
+		return
+	}
+	for _, a := range agents {
+		row(a.ID.Hex()).Name = a.Name
+	}
+
+	result := make([]agentStats, 0, len(rows))
+	for _, s := range rows {
+		result = append(result, *s)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].AppointmentsCompleted != result[j].AppointmentsCompleted {
+			return result[i].AppointmentsCompleted > result[j].AppointmentsCompleted
+		}
+		return result[i].AgentID < result[j].AgentID
+	})
+
+	setArchivesIncluded(w, archived)
+	if wantsCSV(r) {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="agent-stats.csv"`)
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"agent_id", "name", "listings_created", "inquiries_assigned", "inquiries_answered", "avg_first_reply_minutes",
+			"appointments_completed", "appointments_cancelled", "listings_sold", "listings_rented"})
+		for _, s := range result {
+			avg := ""
+			if s.AvgFirstReplyMinutes != nil {
+				avg = strconv.FormatFloat(*s.AvgFirstReplyMinutes, 'f', -1, 64)
+			}
+			cw.Write([]string{s.AgentID, s.Name, strconv.Itoa(s.ListingsCreated), strconv.Itoa(s.InquiriesAssigned), strconv.Itoa(s.InquiriesAnswered), avg,
+				strconv.Itoa(s.AppointmentsCompleted), strconv.Itoa(s.AppointmentsCancelled), strconv.Itoa(s.ListingsSold), strconv.Itoa(s.ListingsRented)})
+		}
+		cw.Flush()
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+func aggregateAgentStats(ctx context.Context, collectionName string, pipeline []bson.M, add func(agentStatsRow)) error {
+	cur, err := client.Database("MVDB").Collection(collectionName).Aggregate(ctx, pipeline)
+	if err != nil {
+		return err
+	}
+	var counts []agentStatsRow
+	if err := cur.All(ctx, &counts); err != nil {
+		return err
+	}
+	for _, c := range counts {
+		add(c)
+	}
+	return nil
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// GET /ws is a WebSocket on which an agent gets their leads as they happen: inquiry.assigned,
+// appointment.booked and appointment.cancelled, each as {"id", "type", "data"}. The events go through
+// the hub of /events/stream with the agent's id on them, and the writes of this instance are the
+// ones published. The agent signs in with a JWT (HS256 over AGENT_JWT_SECRET, the agent id in sub)
+// from POST /agents/{id}/token, in an Authorization: Bearer header or ?token= since browsers can't
+// set headers on a WebSocket.
+const (
+	agentSocketWriteWait = 10 * time.Second
+	agentSocketPongWait  = 60 * time.Second
+	agentSocketPing      = 50 * time.Second // below agentSocketPongWait, so a live client always answers in time
+	agentSocketBuffer    = 32               // messages queued per socket before it is dropped
+	agentTokenLifetime   = 12 * time.Hour
+)
+
+// Event types on GET /ws
+const (
+	agentEventInquiryAssigned      = "inquiry.assigned"
+	agentEventAppointmentBooked    = "appointment.booked"
+	agentEventAppointmentCancelled = "appointment.cancelled"
+	agentEventVerificationRejected = "listing.verification_rejected"
+)
+
+var (
+	errInvalidAgentToken = errors.New("Invalid agent token")
+	errAgentTokenExpired = errors.New("Agent token has expired")
+)
+
+var agentJWTSecret []byte
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	// Sockets are signed in with a token, not a cookie, so any origin may open one like CORS allows
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+func setupAgentSockets() {
+	if secret := os.Getenv("AGENT_JWT_SECRET"); secret != "" {
+		agentJWTSecret = []byte(secret)
+	} else {
+		agentJWTSecret = make([]byte, 32)
+		if _, err := rand.Read(agentJWTSecret); err != nil {
+			log.Fatal("Failed to generate an agent token secret: ", err)
+		}
+		log.Println("AGENT_JWT_SECRET is not set, agent tokens only work on this instance until it restarts")
+	}
+	go agentSockets.run()
+}
+
+// tokenKind is a kind of Bearer token signed with AGENT_JWT_SECRET: the agent tokens of GET /ws and
+// the user tokens of user_auth.go. The kind, empty for agents, is a claim, so one kind's token is
+// never accepted as the other's.
+type tokenKind struct {
+	name             string
+	invalid, expired error
+}
+
+var agentTokens = tokenKind{invalid: errInvalidAgentToken, expired: errAgentTokenExpired}
+
+func (k tokenKind) sign(subject string, expiry time.Time) string {
+	segment := func(v interface{}) string {
+		b, _ := json.Marshal(v)
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	claims := map[string]interface{}{
+		"sub": subject,
+		"iat": time.Now().Unix(),
+		"exp": expiry.Unix(),
+	}
+	if k.name != "" {
+		claims["kind"] = k.name
+	}
+	unsigned := segment(map[string]string{"alg": "HS256", "typ": "JWT"}) + "." + segment(claims)
+	mac := hmac.New(sha256.New, agentJWTSecret)
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verify checks the signature, kind and expiry of a token and returns its subject
+func (k tokenKind) verify(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", k.invalid
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", k.invalid
+	}
+	mac := hmac.New(sha256.New, agentJWTSecret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return "", k.invalid
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	var claims struct {
+		Sub  string `json:"sub"`
+		Exp  int64  `json:"exp"`
+		Kind string `json:"kind"`
+	}
+	rawHeader, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(rawHeader, &header) != nil || header.Alg != "HS256" {
+		return "", k.invalid
+	}
+	rawClaims, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || json.Unmarshal(rawClaims, &claims) != nil || claims.Sub == "" || claims.Kind != k.name {
+		return "", k.invalid
+	}
+	if time.Now().Unix() >= claims.Exp {
+		return "", k.expired
+	}
+	return claims.Sub, nil
+}
+
+func signAgentToken(agentID string, expiry time.Time) string {
+	return agentTokens.sign(agentID, expiry)
+}
+
+// verifyAgentToken checks the signature and expiry of a token and returns its agent id
+func verifyAgentToken(token string) (string, error) {
+	return agentTokens.verify(token)
+}
+
+// createAgentToken answers POST /agents/{id}/token with a token for GET /ws, valid for 12 hours
+func createAgentToken(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	oid, ok := pathObjectID(w, r, "Agent")
+	if !ok {
+		return
+	}
+	id := oid.Hex()
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	agent, err := listingAgent(ctx, id)
+	if err != nil {
+		serverError(w, r, "Failed to retrieve Agent", err)
+		return
+	}
+	if agent == nil {
+		http.Error(w, "Agent not found or inactive", http.StatusNotFound)
+		return
+	}
+	expiry := time.Now().Add(agentTokenLifetime)
+	recordAudit(auditFromRequest(r), "token", "agents", id, nil, nil, nil)
+	json.NewEncoder(w).Encode(map[string]interface{}{"token": signAgentToken(id, expiry), "expires_at": expiry})
+}
+
+// agentSocket is one open connection. The hub is the only one to close send, once it has dropped
+// the socket; closeCode then tells the client why.
+type agentSocket struct {
+	agentID   string
+	conn      *websocket.Conn
+	send      chan []byte
+	closeCode int
+}
+
+// agentSocketHub routes the agent events of the hub to the sockets of their agent
+type agentSocketHub struct {
+	mu      sync.Mutex
+	sockets map[string]map[*agentSocket]struct{}
+}
+
+var agentSockets = &agentSocketHub{sockets: map[string]map[*agentSocket]struct{}{}}
+
+func (h *agentSocketHub) add(s *agentSocket) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.sockets[s.agentID] == nil {
+		h.sockets[s.agentID] = map[*agentSocket]struct{}{}
+	}
+	h.sockets[s.agentID][s] = struct{}{}
+}
+
+// drop forgets a socket and closes its send channel, unless that already happened. Callers hold h.mu.
+func (h *agentSocketHub) drop(s *agentSocket, closeCode int) {
+	sockets := h.sockets[s.agentID]
+	if _, ok := sockets[s]; !ok {
+		return
+	}
+	delete(sockets, s)
+	if len(sockets) == 0 {
+		delete(h.sockets, s.agentID)
+	}
+	s.closeCode = closeCode
+	close(s.send)
+}
+
+func (h *agentSocketHub) remove(s *agentSocket) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.drop(s, websocket.CloseNormalClosure)
+}
+
+// deliver queues an event on the agent's sockets without waiting; a socket whose queue is full is
+// dropped, the client reconnects when it has caught up
+func (h *agentSocketHub) deliver(e streamEvent) {
+	msg, err := json.Marshal(map[string]interface{}{"id": e.ID, "type": e.Type, "data": json.RawMessage(e.Data)})
+	if err != nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for s := range h.sockets[e.AgentID] {
+		select {
+		case s.send <- msg:
+		default:
+			h.drop(s, websocket.CloseTryAgainLater)
+		}
+	}
+}
+
+// closeAll drops every socket, for shutdown: http.Server.Shutdown doesn't wait for hijacked connections
+func (h *agentSocketHub) closeAll() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, sockets := range h.sockets {
+		for s := range sockets {
+			h.drop(s, websocket.CloseGoingAway)
+		}
+	}
+}
+
+// run reads the event hub for good. deliver never waits, but should the hub still drop this
+// subscriber, it subscribes again from the last event seen and so replays what it missed.
+func (h *agentSocketHub) run() {
+	var lastID uint64
+	for {
+		missed, ch, cancel := events.subscribe(lastID)
+		for _, e := range missed {
+			lastID = e.ID
+			if e.AgentID != "" {
+				h.deliver(e)
+			}
+		}
+		for e := range ch {
+			lastID = e.ID
+			if e.AgentID != "" {
+				h.deliver(e)
+			}
+		}
+		cancel()
+		log.Println("Agent sockets fell behind the event hub, resubscribing")
+	}
+}
+
+// writePump writes the queued messages and the pings. It is the only writer of the connection.
+func (s *agentSocket) writePump() {
+	ping := time.NewTicker(agentSocketPing)
+	defer func() {
+		ping.Stop()
+		s.conn.Close()
+	}()
+	for {
+		select {
+		case msg, ok := <-s.send:
+			s.conn.SetWriteDeadline(time.Now().Add(agentSocketWriteWait))
+			if !ok {
+				s.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(s.closeCode, ""))
+				return
+			}
+			if err := s.conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+				return
+			}
+		case <-ping.C:
+			s.conn.SetWriteDeadline(time.Now().Add(agentSocketWriteWait))
+			if err := s.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// readPump discards what the client sends and keeps the read deadline moving with its pongs. It
+// returns once the connection fails or is closed, from either side.
+func (s *agentSocket) readPump() {
+	s.conn.SetReadLimit(512)
+	s.conn.SetReadDeadline(time.Now().Add(agentSocketPongWait))
+	s.conn.SetPongHandler(func(string) error {
+		return s.conn.SetReadDeadline(time.Now().Add(agentSocketPongWait))
+	})
+	for {
+		if _, _, err := s.conn.ReadMessage(); err != nil {
+			return
+		}
+	}
+}
+
+// serveAgentSocket answers GET /ws
+func serveAgentSocket(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+	if token == "" {
+		http.Error(w, "An agent token is required", http.StatusUnauthorized)
+		return
+	}
+	agentID, err := verifyAgentToken(token)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	agent, err := listingAgent(ctx, agentID)
+	cancel()
+	if err != nil {
+		serverError(w, r, "Failed to retrieve Agent", err)
+		return
+	}
+	if agent == nil {
+		http.Error(w, "Agent not found or inactive", http.StatusForbidden)
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return // the upgrader has answered the request
+	}
+	runAgentSocket(conn, agentID)
+}
+
+// runAgentSocket serves the events of agentID on conn until the connection ends
+func runAgentSocket(conn *websocket.Conn, agentID string) {
+	s := &agentSocket{agentID: agentID, conn: conn, send: make(chan []byte, agentSocketBuffer)}
+	agentSockets.add(s)
+	go s.writePump()
+	s.readPump()
+	agentSockets.remove(s)
+}
+
+// publishAgentEvent sends an event to the sockets of one agent; nothing happens without an agent
+func publishAgentEvent(agentID, eventType string, payload map[string]interface{}) {
+	if agentID == "" {
+		return
+	}
+	payload["at"] = time.Now()
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return
+	}
+	events.publishTo(agentID, eventType, data)
+}
+
+func publishInquiryAssigned(inquiryID string, inquiry *Inquiry) {
+	publishAgentEvent(inquiry.AgentID, agentEventInquiryAssigned, map[string]interface{}{
+		"inquiry_id":  inquiryID,
+		"property_id": inquiry.Property_id,
+		"message":     inquiry.Message,
+	})
+}
+
+// notifyAgentOfAppointment publishes an appointment event to the agent of the appointment's listing. Like createNotification it has its own timeout and only logs on failure.
+func notifyAgentOfAppointment(a Appointment, eventType string) {
+	listingID, err := primitive.ObjectIDFromHex(a.ListingID)
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var listing Listing
+	err = client.Database("MVDB").Collection("listings").FindOne(ctx, bson.M{"_id": listingID},
+		options.FindOne().SetProjection(bson.M{"agent_id": 1})).Decode(&listing)
+	if err != nil {
+		if err != mongo.ErrNoDocuments {
+			log.Println("Failed to find the agent of listing", a.ListingID, ":", err)
+		}
+		return
+	}
+	publishAgentEvent(listing.AgentID, eventType, map[string]interface{}{
+		"appointment_id":   a.ID.Hex(),
+		"listing_id":       a.ListingID,
+		"property_id":      a.PropertyID,
+		"appointment_date": a.AppointmentDate,
+		"status":           a.Status,
+		"reason":           a.CancellationReason,
+	})
+}
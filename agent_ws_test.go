@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func useTestTokenSecret(t *testing.T) {
+	prev := agentJWTSecret
+	agentJWTSecret = []byte("test-agent-secret")
+	t.Cleanup(func() { agentJWTSecret = prev })
+}
+
+func TestAgentTokens(t *testing.T) {
+	useTestTokenSecret(t)
+	token := signAgentToken("agent-1", time.Now().Add(time.Hour))
+	if id, err := verifyAgentToken(token); err != nil || id != "agent-1" {
+		t.Errorf("a valid token: %q %v", id, err)
+	}
+	if _, err := verifyAgentToken(signAgentToken("agent-1", time.Now().Add(-time.Second))); err != errAgentTokenExpired {
+		t.Errorf("an expired token: %v", err)
+	}
+	parts := strings.Split(token, ".")
+	otherAgent := strings.Split(signAgentToken("agent-2", time.Now().Add(time.Hour)), ".")
+	for name, bad := range map[string]string{
+		"a user token":        userTokens.sign("agent-1", time.Now().Add(time.Hour)),
+		"another agent's sub": parts[0] + "." + otherAgent[1] + "." + parts[2],
+		"two segments":        parts[0] + "." + parts[1],
+		"a signature of junk": parts[0] + "." + parts[1] + ".!!",
+	} {
+		if _, err := verifyAgentToken(bad); err != errInvalidAgentToken {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+	agentJWTSecret = []byte("rotated-secret")
+	if _, err := verifyAgentToken(token); err != errInvalidAgentToken {
+		t.Errorf("after the secret changed: %v", err)
+	}
+}
+
+func TestAgentSocketHubDropsSlowConsumer(t *testing.T) {
+	h := &agentSocketHub{sockets: map[string]map[*agentSocket]struct{}{}}
+	slow := &agentSocket{agentID: "a1", send: make(chan []byte, agentSocketBuffer)}
+	other := &agentSocket{agentID: "a2", send: make(chan []byte, agentSocketBuffer)}
+	h.add(slow)
+	h.add(other)
+	for i := 0; i <= agentSocketBuffer; i++ {
+		h.deliver(streamEvent{ID: uint64(i), Type: agentEventInquiryAssigned, Data: []byte(`{"inquiry_id":"i1"}`), AgentID: "a1"})
+	}
+	n := 0
+	for msg := range slow.send {
+		if n == 0 && string(msg) != `{"data":{"inquiry_id":"i1"},"id":0,"type":"inquiry.assigned"}` {
+			t.Errorf("message %s", msg)
+		}
+		n++
+	}
+	if n != agentSocketBuffer || slow.closeCode != websocket.CloseTryAgainLater || h.sockets["a1"] != nil {
+		t.Errorf("%d messages, close code %d, sockets %v", n, slow.closeCode, h.sockets)
+	}
+	if len(other.send) != 0 {
+		t.Error("another agent got the events")
+	}
+	h.remove(slow) // after the drop is harmless
+	h.closeAll()
+	if _, ok := <-other.send; ok || other.closeCode != websocket.CloseGoingAway || len(h.sockets) != 0 {
+		t.Errorf("after closeAll: close code %d, sockets %v", other.closeCode, h.sockets)
+	}
+}
+
+// agentSocketServer serves runAgentSocket for the agent in ?agent=, without sign-in, and returns its ws:// URL
+func agentSocketServer(t *testing.T) string {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		runAgentSocket(conn, r.URL.Query().Get("agent"))
+	}))
+	t.Cleanup(srv.Close)
+	return "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+func agentSocketCount(agentIDs ...string) int {
+	agentSockets.mu.Lock()
+	defer agentSockets.mu.Unlock()
+	n := 0
+	for _, id := range agentIDs {
+		n += len(agentSockets.sockets[id])
+	}
+	return n
+}
+
+// TestAgentSocketsPublishAndDisconnect publishes to agents while their sockets connect, read a few
+// events and go away, some with a close frame and some by dropping the connection. Run it with
+// -race; afterwards no socket is left in the hub.
+func TestAgentSocketsPublishAndDisconnect(t *testing.T) {
+	url := agentSocketServer(t)
+	agentIDs := []string{"race-0", "race-1", "race-2", "race-3"}
+
+	stop := make(chan struct{})
+	var publishers sync.WaitGroup
+	for p := 0; p < 4; p++ {
+		publishers.Add(1)
+		go func(p int) {
+			defer publishers.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				agentSockets.deliver(streamEvent{ID: uint64(i), Type: agentEventAppointmentBooked, Data: []byte(`{}`), AgentID: agentIDs[(p+i)%len(agentIDs)]})
+			}
+		}(p)
+	}
+
+	var clients sync.WaitGroup
+	errs := make(chan error, 100)
+	for c := 0; c < 100; c++ {
+		clients.Add(1)
+		go func(c int) {
+			defer clients.Done()
+			conn, _, err := websocket.DefaultDialer.Dial(url+"?agent="+agentIDs[c%len(agentIDs)], nil)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer conn.Close()
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			for i := 0; i < c%4; i++ {
+				var msg struct {
+					Type string `json:"type"`
+				}
+				if err := conn.ReadJSON(&msg); err != nil {
+					if !websocket.IsCloseError(err, websocket.CloseTryAgainLater) {
+						errs <- fmt.Errorf("client %d: %v", c, err)
+					}
+					return
+				}
+				if msg.Type != agentEventAppointmentBooked {
+					errs <- fmt.Errorf("client %d got %q", c, msg.Type)
+				}
+			}
+			if c%2 == 0 {
+				conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+			}
+		}(c)
+	}
+	clients.Wait()
+	close(stop)
+	publishers.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for agentSocketCount(agentIDs...) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d sockets still in the hub", agentSocketCount(agentIDs...))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServeAgentSocket(t *testing.T) {
+	useTestMongo(t, "agents")
+	useTestTokenSecret(t)
+	active, inactive := primitive.NewObjectID(), primitive.NewObjectID()
+	if _, err := client.Database("MVDB").Collection("agents").InsertMany(context.Background(), []interface{}{
+		Agent{ID: active, Name: "Ploy", Active: true}, Agent{ID: inactive, Name: "Left", Active: false},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(serveAgentSocket))
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	for name, tt := range map[string]struct {
+		query string
+		want  int
+	}{
+		"no token":       {"", http.StatusUnauthorized},
+		"a bad token":    {"?token=abc.def.ghi", http.StatusUnauthorized},
+		"inactive agent": {"?token=" + signAgentToken(inactive.Hex(), time.Now().Add(time.Hour)), http.StatusForbidden},
+	} {
+		if _, resp, err := websocket.DefaultDialer.Dial(url+tt.query, nil); err == nil || resp == nil || resp.StatusCode != tt.want {
+			t.Errorf("%s: %v, want %d", name, err, tt.want)
+		}
+	}
+
+	header := http.Header{"Authorization": {"Bearer " + signAgentToken(active.Hex(), time.Now().Add(time.Hour))}}
+	conn, _, err := websocket.DefaultDialer.Dial(url, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for agentSocketCount(active.Hex()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	agentSockets.deliver(streamEvent{ID: 7, Type: agentEventInquiryAssigned, Data: []byte(`{"inquiry_id":"i1"}`), AgentID: active.Hex()})
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var msg struct {
+		ID   uint64          `json:"id"`
+		Type string          `json:"type"`
+		Data json.RawMessage `json:"data"`
+	}
+	if err := conn.ReadJSON(&msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.ID != 7 || msg.Type != agentEventInquiryAssigned || string(msg.Data) != `{"inquiry_id":"i1"}` {
+		t.Errorf("message %+v", msg)
+	}
+}
+
+// TestAgentSocketThroughRoutes opens GET /ws with a Bearer token through the whole middleware chain,
+// the login throttle included, and receives an event
+func TestAgentSocketThroughRoutes(t *testing.T) {
+	useTestMongo(t, "agents")
+	useTestTokenSecret(t)
+	useTestKeys(t)
+	skipMaintenanceLookup(t)
+	cacheTestLoginAttempts(t, loginAttempts{Key: "ip:127.0.0.1"})
+	agentID := primitive.NewObjectID()
+	insertDocs(t, "agents", Agent{ID: agentID, Name: "Ploy", Active: true})
+	srv := httptest.NewServer(routes())
+	defer srv.Close()
+
+	header := http.Header{"Authorization": {"Bearer " + signAgentToken(agentID.Hex(), time.Now().Add(time.Hour))}}
+	conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws", header)
+	if err != nil {
+		t.Fatalf("dial: %v (%v)", err, resp)
+	}
+	defer conn.Close()
+	for agentSocketCount(agentID.Hex()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	agentSockets.deliver(streamEvent{ID: 8, Type: agentEventAppointmentBooked, Data: []byte(`{}`), AgentID: agentID.Hex()})
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var msg struct {
+		ID   uint64 `json:"id"`
+		Type string `json:"type"`
+	}
+	if err := conn.ReadJSON(&msg); err != nil || msg.ID != 8 || msg.Type != agentEventAppointmentBooked {
+		t.Errorf("message %+v %v", msg, err)
+	}
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const maxAgentNameLength = 100 // characters
+
+// Agent is the person responsible for a listing. Deactivating an agent leaves their listings in
+// place; they show up in GET /admin/reports/orphaned-listings until they are reassigned.
+type Agent struct {
+	ID     primitive.ObjectID `bson:"_id,omitempty" json:"agent_id,omitempty"`
+	Name   string             `bson:"name" json:"name"`
+	Email  string             `bson:"email" json:"email"`
+	Phone  string             `bson:"phone,omitempty" json:"phone,omitempty"`
+	Photo  string             `bson:"photo,omitempty" json:"photo,omitempty"` // https URL
+	LineID string             `bson:"line_id,omitempty" json:"line_id,omitempty"`
+	Active bool               `bson:"active" json:"active"`
+	// Availability is nil until the agent sets their hours, see agent_calendar.go
+	Availability *agentAvailability `bson:"availability,omitempty" json:"availability,omitempty"`
+	CreatedAt    time.Time          `bson:"created_at" json:"created_at"`
+	UpdatedAt    time.Time          `bson:"updated_at" json:"updated_at"`
+	DeletedAt    *time.Time         `bson:"deleted_at,omitempty" json:"deleted_at,omitempty"`
+}
+
+// agentContact is the part of an agent shown on listing detail
+type agentContact struct {
+	ID     primitive.ObjectID `json:"agent_id"`
+	Name   string             `json:"name"`
+	Email  string             `json:"email"`
+	Phone  string             `json:"phone,omitempty"`
+	Photo  string             `json:"photo,omitempty"`
+	LineID string             `json:"line_id,omitempty"`
+}
+
+// agentUpdate is the body of POST /agents and PUT /agents/{id}; absent fields are left unchanged
+type agentUpdate struct {
+	Name   *string `json:"name"`
+	Email  *string `json:"email"`
+	Phone  *string `json:"phone"`
+	Photo  *string `json:"photo"`
+	LineID *string `json:"line_id"`
+	Active *bool   `json:"active"`
+}
+
+var (
+	errInvalidAgentID   = errors.New("Invalid agent_id format")
+	errAgentUnavailable = errors.New("agent_id does not exist or the agent is inactive")
+	errAgentCheck       = errors.New("Failed to check agent_id")
+
+	agentPhone  = regexp.MustCompile(`^\+?[0-9][0-9 -]{7,18}$`)
+	agentLineID = regexp.MustCompile(`^@?[a-z0-9._-]{4,20}$`)
+)
+
+// apply copies the given fields onto agent and returns them as a $set document
+func (u agentUpdate) apply(agent *Agent) bson.M {
+	set := bson.M{}
+	if u.Name != nil {
+		agent.Name = strings.TrimSpace(*u.Name)
+		set["name"] = agent.Name
+	}
+	if u.Email != nil {
+		agent.Email = strings.ToLower(strings.TrimSpace(*u.Email))
+		set["email"] = agent.Email
+	}
+	if u.Phone != nil {
+		agent.Phone = strings.TrimSpace(*u.Phone)
+		set["phone"] = agent.Phone
+	}
+	if u.Photo != nil {
+		agent.Photo = strings.TrimSpace(*u.Photo)
+		set["photo"] = agent.Photo
+	}
+	if u.LineID != nil {
+		agent.LineID = strings.ToLower(strings.TrimSpace(*u.LineID))
+		set["line_id"] = agent.LineID
+	}
+	if u.Active != nil {
+		agent.Active = *u.Active
+		set["active"] = *u.Active
+	}
+	return set
+}
+
+func validateAgent(agent *Agent) []string {
+	var problems []string
+	if agent.Name == "" || utf8.RuneCountInString(agent.Name) > maxAgentNameLength {
+		problems = append(problems, "name is required and must be at most 100 characters")
+	}
+	if addr, err := mail.ParseAddress(agent.Email); err != nil || addr.Address != agent.Email {
+		problems = append(problems, "email must be a valid email address")
+	}
+	if agent.Phone != "" && !agentPhone.MatchString(agent.Phone) {
+		problems = append(problems, "phone must be digits, optionally with a leading + and spaces or dashes")
+	}
+	if agent.Photo != "" {
+		if u, err := url.Parse(agent.Photo); err != nil || u.Scheme != "https" || u.Host == "" {
+			problems = append(problems, "photo must be an https URL")
+		}
+	}
+	if agent.LineID != "" && !agentLineID.MatchString(agent.LineID) {
+		problems = append(problems, "line_id must be 4-20 letters, digits, dots, dashes or underscores")
+	}
+	return problems
+}
+
+// agentEmailTaken reports whether another agent that isn't deleted uses email
+func agentEmailTaken(ctx context.Context, email string, except primitive.ObjectID) (bool, error) {
+	n, err := client.Database("MVDB").Collection("agents").CountDocuments(ctx, notDeleted(bson.M{"email": email, "_id": bson.M{"$ne": except}}))
+	return n > 0, err
+}
+
+// agentReference checks a listing's agent_id during insertWithReferences; only active agents take listings
+func agentReference(agentID string) reference {
+	return reference{
+		Collection: "agents",
+		ID:         agentID,
+		Invalid:    errInvalidAgentID,
+		Missing:    errAgentUnavailable,
+		Check:      errAgentCheck,
+		Match:      bson.M{"active": true},
+	}
+}
+
+// checkAgentAssignable is agentReference for updates, which don't go through insertWithReferences
+func checkAgentAssignable(ctx context.Context, agentID string) error {
+	ref := agentReference(agentID)
+	oid, err := primitive.ObjectIDFromHex(agentID)
+	if err != nil {
+		return ref.Invalid
+	}
+	return checkReferences(ctx, []reference{ref}, []primitive.ObjectID{oid})
+}
+
+// listingAgent returns the contact details of the listing's agent, nil when there is none or
+// the agent is no longer active
+func listingAgent(ctx context.Context, agentID string) (*agentContact, error) {
+	oid, err := primitive.ObjectIDFromHex(agentID)
+	if err != nil {
+		return nil, nil
+	}
+	var agent Agent
+	err = client.Database("MVDB").Collection("agents").FindOne(ctx, notDeleted(bson.M{"_id": oid, "active": true})).Decode(&agent)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &agentContact{ID: agent.ID, Name: agent.Name, Email: agent.Email, Phone: agent.Phone, Photo: agent.Photo, LineID: agent.LineID}, nil
+}
+
+func createAgent(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var body agentUpdate
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Failed to parse request body", http.StatusBadRequest)
+		return
+	}
+	agent := Agent{Active: true}
+	body.apply(&agent)
+	if problems := validateAgent(&agent); len(problems) > 0 {
+		http.Error(w, (&validationError{Problems: problems}).Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	if taken, err := agentEmailTaken(ctx, agent.Email, primitive.NilObjectID); err != nil {
+		serverError(w, r, "Failed to create Agent", err)
+		return
+	} else if taken {
+		http.Error(w, "An agent with this email already exists", http.StatusConflict)
+		return
+	}
+	agent.CreatedAt = time.Now()
+	agent.UpdatedAt = agent.CreatedAt
+	result, err := client.Database("MVDB").Collection("agents").InsertOne(ctx, agent)
+	if err != nil {
+		serverError(w, r, "Failed to create Agent", err)
+		return
+	}
+	agent.ID = result.InsertedID.(primitive.ObjectID)
+	auditCreated(auditFromRequest(r), "agents", agent.ID, agent)
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(agent)
+}
+
+// getAgents lists active agents; ?include_inactive=true adds the others
+func getAgents(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	filter := bson.M{}
+	if !applyDeletedFilter(w, r, filter) {
+		return
+	}
+	if r.URL.Query().Get("include_inactive") != "true" {
+		filter["active"] = true
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	agents, err := findAllWith[Agent](ctx, "agents", filter, options.Find().SetSort(bson.D{{Key: "name", Value: 1}}))
+	if err != nil {
+		serverError(w, r, "Failed to retrieve Agents", err)
+		return
+	}
+	json.NewEncoder(w).Encode(agents)
+}
+
+func getAgent(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	id, ok := pathObjectID(w, r, "Agent")
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	var agent Agent
+	err := client.Database("MVDB").Collection("agents").FindOne(ctx, notDeleted(bson.M{"_id": id})).Decode(&agent)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Agent not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		serverError(w, r, "Failed to retrieve Agent", err)
+		return
+	}
+	json.NewEncoder(w).Encode(agent)
+}
+
+// updateAgent applies a partial update. Setting active to false keeps the agent's listings; they are
+// reported by GET /admin/reports/orphaned-listings for reassignment.
+func updateAgent(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	id, ok := pathObjectID(w, r, "Agent")
+	if !ok {
+		return
+	}
+	var body agentUpdate
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Failed to parse request body", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	collection := client.Database("MVDB").Collection("agents")
+	var agent Agent
+	err := collection.FindOne(ctx, notDeleted(bson.M{"_id": id})).Decode(&agent)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Agent not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		serverError(w, r, "Failed to retrieve Agent", err)
+		return
+	}
+
+	before := agent
+	set := body.apply(&agent)
+	if problems := validateAgent(&agent); len(problems) > 0 {
+		http.Error(w, (&validationError{Problems: problems}).Error(), http.StatusBadRequest)
+		return
+	}
+	if len(set) == 0 {
+		json.NewEncoder(w).Encode(agent)
+		return
+	}
+	if agent.Email != before.Email {
+		if taken, err := agentEmailTaken(ctx, agent.Email, id); err != nil {
+			serverError(w, r, "Failed to update Agent", err)
+			return
+		} else if taken {
+			http.Error(w, "An agent with this email already exists", http.StatusConflict)
+			return
+		}
+	}
+
+	agent.UpdatedAt = time.Now()
+	set["updated_at"] = agent.UpdatedAt
+	res, err := collection.UpdateOne(ctx, notDeleted(bson.M{"_id": id}), bson.M{"$set": set})
+	if err != nil {
+		serverError(w, r, "Failed to update Agent", err)
+		return
+	}
+	if res.MatchedCount == 0 {
+		http.Error(w, "Agent not found", http.StatusNotFound)
+		return
+	}
+	recordAudit(auditFromRequest(r), "update", "agents", id.Hex(), before, agent, nil)
+	json.NewEncoder(w).Encode(agent)
+}
+
+// deleteAgent soft-deletes an agent. Like deactivation it leaves their listings untouched.
+func deleteAgent(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	id, ok := pathObjectID(w, r, "Agent")
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	before := auditSnapshot(ctx, "agents", id)
+	res, err := softDelete(ctx, "agents", bson.M{"_id": id}, time.Now())
+	if err != nil {
+		serverError(w, r, "Failed to delete Agent", err)
+		return
+	}
+	if res.MatchedCount == 0 {
+		http.Error(w, "Agent not found", http.StatusNotFound)
+		return
+	}
+	recordAudit(auditFromRequest(r), "delete", "agents", id.Hex(), before, auditSnapshot(ctx, "agents", id), nil)
+	json.NewEncoder(w).Encode(bson.M{"message": "Agent deleted"})
+}
+
+// getAgentListings returns the agent's listings; published ones only, unless the API key is given
+func getAgentListings(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	id, ok := pathObjectID(w, r, "Agent")
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	if err := client.Database("MVDB").Collection("agents").FindOne(ctx, notDeleted(bson.M{"_id": id})).Err(); err == mongo.ErrNoDocuments {
+		http.Error(w, "Agent not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		serverError(w, r, "Failed to retrieve Agent", err)
+		return
+	}
+
+	filter := bson.M{"agent_id": id.Hex()}
+	if hasAPIKey(r) {
+		filter = notDeleted(filter)
+	} else {
+		filter = publishedListingsFilter(filter)
+	}
+	listings, err := findAllWith[Listing](ctx, "listings", filter, options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}))
+	if err != nil {
+		serverError(w, r, "Failed to retrieve Listings", err)
+		return
+	}
+	json.NewEncoder(w).Encode(listings)
+}
+
+// getOrphanedListings lists active listings whose agent was deactivated or deleted, to be reassigned
+// with PUT /listings/{id}. Listings that never had an agent aren't included.
+func getOrphanedListings(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	active, err := findAllWith[Agent](ctx, "agents", notDeleted(bson.M{"active": true}), options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		serverError(w, r, "Failed to retrieve Agents", err)
+		return
+	}
+	ids := make([]string, len(active))
+	for i, a := range active {
+		ids[i] = a.ID.Hex()
+	}
+	filter := activeListingsFilter(bson.M{"agent_id": bson.M{"$exists": true, "$nin": append(ids, "")}})
+	listings, err := findAllWith[Listing](ctx, "listings", filter, options.Find().SetSort(bson.D{{Key: "agent_id", Value: 1}, {Key: "created_at", Value: -1}}))
+	if err != nil {
+		serverError(w, r, "Failed to retrieve Listings", err)
+		return
+	}
+	json.NewEncoder(w).Encode(listings)
+}
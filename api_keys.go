@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	apiKeyPrefix           = "mvk_"
+	defaultAPIKeyCacheTTL  = time.Minute      // a revoked key keeps working on other instances for at most this long
+	unknownAPIKeyCacheTTL  = 10 * time.Second // unknown keys are remembered briefly so guessing doesn't hit Mongo
+	maxCachedAPIKeys       = 10000
+	apiKeyUsageFlushPeriod = time.Minute
+)
+
+// APIKey is a partner's key. Only the SHA-256 of the key is stored; the key itself is shown once,
+// when it is created.
+type APIKey struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"api_key_id"`
+	Name      string             `bson:"name" json:"name"`
+	Hash      string             `bson:"hash" json:"-"`
+	Prefix    string             `bson:"prefix" json:"prefix"` // first characters of the key, to tell keys apart
+	Scopes    []string           `bson:"scopes" json:"scopes"`
+	Active    bool               `bson:"active" json:"active"`
+	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+	RevokedAt *time.Time         `bson:"revoked_at,omitempty" json:"revoked_at,omitempty"`
+}
+
+// apiKeyUsageDay is the request count of a key on one UTC day
+type apiKeyUsageDay struct {
+	KeyID string `bson:"key_id" json:"-"`
+	Date  string `bson:"date" json:"date"` // 2006-01-02
+	Count int64  `bson:"count" json:"count"`
+}
+
+var apiKeyCacheTTL = defaultAPIKeyCacheTTL
+
+type cachedAPIKey struct {
+	identity  *apiKeyIdentity // nil for a key that doesn't exist or was revoked
+	expiresAt time.Time
+}
+
+var apiKeyCache = struct {
+	sync.Mutex
+	entries map[string]cachedAPIKey // by key hash
+}{entries: map[string]cachedAPIKey{}}
+
+// apiKeyUsage counts requests per key id in memory; flushAPIKeyUsage adds them to api_key_usage
+var apiKeyUsage = struct {
+	sync.Mutex
+	counts map[string]int64
+}{counts: map[string]int64{}}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// lookupAPIKey returns the identity of an active stored key, read at most once per apiKeyCacheTTL
+func lookupAPIKey(ctx context.Context, key string) *apiKeyIdentity {
+	hash := hashAPIKey(key)
+	apiKeyCache.Lock()
+	cached, ok := apiKeyCache.entries[hash]
+	apiKeyCache.Unlock()
+	if ok && time.Now().Before(cached.expiresAt) {
+		return cached.identity
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	var stored APIKey
+	err := client.Database("MVDB").Collection("api_keys").FindOne(ctx, bson.M{"hash": hash, "active": true}).Decode(&stored)
+	entry := cachedAPIKey{expiresAt: time.Now().Add(unknownAPIKeyCacheTTL)}
+	switch {
+	case err == nil:
+		entry = cachedAPIKey{
+			identity:  &apiKeyIdentity{ID: stored.ID.Hex(), Name: stored.Name, Scopes: stored.Scopes},
+			expiresAt: time.Now().Add(apiKeyCacheTTL),
+		}
+	case err != mongo.ErrNoDocuments:
+		log.Println("Failed to look up API key:", err)
+		return nil // not cached, the next request tries again
+	}
+
+	apiKeyCache.Lock()
+	if len(apiKeyCache.entries) >= maxCachedAPIKeys {
+		apiKeyCache.entries = map[string]cachedAPIKey{}
+	}
+	apiKeyCache.entries[hash] = entry
+	apiKeyCache.Unlock()
+	return entry.identity
+}
+
+func countAPIKeyUse(identity *apiKeyIdentity) {
+	id := identity.ID
+	if id == "" {
+		id = identity.Name
+	}
+	apiKeyUsage.Lock()
+	apiKeyUsage.counts[id]++
+	apiKeyUsage.Unlock()
+}
+
+// flushAPIKeyUsage adds the counts gathered since the last flush to today's api_key_usage documents.
+// Counts that fail to write are kept for the next flush.
+func flushAPIKeyUsage() {
+	apiKeyUsage.Lock()
+	counts := apiKeyUsage.counts
+	apiKeyUsage.counts = map[string]int64{}
+	apiKeyUsage.Unlock()
+	if len(counts) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	date := time.Now().UTC().Format("2006-01-02")
+	collection := client.Database("MVDB").Collection("api_key_usage")
+	for id, n := range counts {
+		_, err := collection.UpdateOne(ctx,
+			bson.M{"_id": id + ":" + date},
+			bson.M{"$inc": bson.M{"count": n}, "$setOnInsert": bson.M{"key_id": id, "date": date}},
+			options.Update().SetUpsert(true))
+		if err != nil {
+			log.Println("Failed to record API key usage:", err)
+			apiKeyUsage.Lock()
+			apiKeyUsage.counts[id] += n
+			apiKeyUsage.Unlock()
+		}
+	}
+}
+
+// setupAPIKeys reads API_KEY_CACHE_TTL, how long a key lookup is trusted and so how long a revoked
+// key can still be used, and starts the usage flush
+func setupAPIKeys() {
+	apiKeyCacheTTL = parseAPIKeyCacheTTL(os.Getenv("API_KEY_CACHE_TTL"))
+	go func() {
+		for range time.Tick(apiKeyUsageFlushPeriod) {
+			flushAPIKeyUsage()
+		}
+	}()
+}
+
+// parseAPIKeyCacheTTL reads a duration such as 30s; 0 looks every key up on each request. Unset or
+// invalid values give defaultAPIKeyCacheTTL.
+func parseAPIKeyCacheTTL(raw string) time.Duration {
+	if raw == "" {
+		return defaultAPIKeyCacheTTL
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil || d < 0 {
+		log.Println("Ignoring invalid API_KEY_CACHE_TTL, using", defaultAPIKeyCacheTTL, ":", raw)
+		return defaultAPIKeyCacheTTL
+	}
+	return d
+}
+
+func validateAPIKey(key *APIKey) []string {
+	var problems []string
+	if key.Name == "" {
+		problems = append(problems, "name is required")
+	}
+	if len(key.Scopes) == 0 {
+		problems = append(problems, "scopes must hold at least one of read, write, upload, admin")
+	}
+	for _, s := range key.Scopes {
+		if !isOneOf(s, apiKeyScopes) {
+			problems = append(problems, "unknown scope "+s)
+		}
+	}
+	return problems
+}
+
+// createAPIKey answers POST /admin/api-keys. The response is the only place the key appears.
+func createAPIKey(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var body struct {
+		Name   string   `json:"name"`
+		Scopes []string `json:"scopes"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Failed to parse request body", http.StatusBadRequest)
+		return
+	}
+	key := APIKey{Name: body.Name, Scopes: body.Scopes, Active: true}
+	if problems := validateAPIKey(&key); len(problems) > 0 {
+		http.Error(w, (&validationError{Problems: problems}).Error(), http.StatusBadRequest)
+		return
+	}
+	secret := make([]byte, 24)
+	if _, err := rand.Read(secret); err != nil {
+		serverError(w, r, "Failed to create API key", err)
+		return
+	}
+	plaintext := apiKeyPrefix + hex.EncodeToString(secret)
+	key.Hash = hashAPIKey(plaintext)
+	key.Prefix = plaintext[:len(apiKeyPrefix)+6]
+	key.CreatedAt = time.Now()
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	result, err := client.Database("MVDB").Collection("api_keys").InsertOne(ctx, key)
+	if err != nil {
+		serverError(w, r, "Failed to create API key", err)
+		return
+	}
+	key.ID = result.InsertedID.(primitive.ObjectID)
+	logged := key
+	logged.Hash = "" // the audit log is readable with any admin key, keep even the hash out of it
+	auditCreated(auditFromRequest(r), "api_keys", key.ID, logged)
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(struct {
+		APIKey
+		Key string `json:"key"`
+	}{key, plaintext})
+}
+
+// getAPIKeys lists every key, revoked ones included, newest first
+func getAPIKeys(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	keys, err := findAllWith[APIKey](ctx, "api_keys", bson.M{}, options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}))
+	if err != nil {
+		serverError(w, r, "Failed to retrieve API keys", err)
+		return
+	}
+	json.NewEncoder(w).Encode(keys)
+}
+
+// getAPIKeyUsage returns the daily request counts of a key for the last 30 days, newest first.
+// Counts reach Mongo once a minute.
+func getAPIKeyUsage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	id, ok := pathObjectID(w, r, "API key")
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	since := time.Now().UTC().AddDate(0, 0, -29).Format("2006-01-02")
+	days, err := findAllWith[apiKeyUsageDay](ctx, "api_key_usage",
+		bson.M{"key_id": id.Hex(), "date": bson.M{"$gte": since}},
+		options.Find().SetSort(bson.D{{Key: "date", Value: -1}}))
+	if err != nil {
+		serverError(w, r, "Failed to retrieve API key usage", err)
+		return
+	}
+	json.NewEncoder(w).Encode(bson.M{"api_key_id": id.Hex(), "days": days})
+}
+
+// revokeAPIKey answers DELETE /admin/api-keys/{id}. The key stops working here at once and on other
+// instances within API_KEY_CACHE_TTL.
+func revokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	id, ok := pathObjectID(w, r, "API key")
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	var before APIKey
+	err := client.Database("MVDB").Collection("api_keys").FindOneAndUpdate(ctx,
+		bson.M{"_id": id, "active": true},
+		bson.M{"$set": bson.M{"active": false, "revoked_at": now}}).Decode(&before)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Active API key not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		serverError(w, r, "Failed to revoke API key", err)
+		return
+	}
+	apiKeyCache.Lock()
+	delete(apiKeyCache.entries, before.Hash)
+	apiKeyCache.Unlock()
+
+	before.Hash = ""
+	after := before
+	after.Active, after.RevokedAt = false, &now
+	recordAudit(auditFromRequest(r), "update", "api_keys", id.Hex(), before, after, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestParseAPIKeyCacheTTL(t *testing.T) {
+	for raw, want := range map[string]time.Duration{
+		"":     defaultAPIKeyCacheTTL,
+		"15s":  15 * time.Second,
+		"2m":   2 * time.Minute,
+		"0":    0,
+		"-5s":  defaultAPIKeyCacheTTL,
+		"soon": defaultAPIKeyCacheTTL,
+	} {
+		if got := parseAPIKeyCacheTTL(raw); got != want {
+			t.Errorf("API_KEY_CACHE_TTL=%q: %s, want %s", raw, got, want)
+		}
+	}
+}
+
+func TestValidateAPIKey(t *testing.T) {
+	if problems := validateAPIKey(&APIKey{Name: "Agency", Scopes: []string{"read", "upload"}}); len(problems) != 0 {
+		t.Errorf("valid key: %v", problems)
+	}
+	problems := validateAPIKey(&APIKey{Scopes: []string{"read", "delete"}})
+	if strings.Join(problems, "; ") != "name is required; unknown scope delete" {
+		t.Errorf("problems %q", problems)
+	}
+	if problems := validateAPIKey(&APIKey{Name: "Agency"}); len(problems) != 1 {
+		t.Errorf("no scopes: %v", problems)
+	}
+}
+
+// TestAPIKeyCacheExpires: a lookup is trusted until it expires, then the key is read again, and a
+// failed read isn't cached
+func TestAPIKeyCacheExpires(t *testing.T) {
+	hash := hashAPIKey("partner-key")
+	setEntry := func(expiresAt time.Time) {
+		apiKeyCache.Lock()
+		apiKeyCache.entries[hash] = cachedAPIKey{identity: &apiKeyIdentity{Name: "Partner"}, expiresAt: expiresAt}
+		apiKeyCache.Unlock()
+	}
+	t.Cleanup(func() {
+		apiKeyCache.Lock()
+		delete(apiKeyCache.entries, hash)
+		apiKeyCache.Unlock()
+	})
+
+	setEntry(time.Now().Add(time.Minute))
+	if identity := lookupAPIKey(context.Background(), "partner-key"); identity == nil || identity.Name != "Partner" {
+		t.Fatalf("within the TTL: %+v", identity)
+	}
+
+	unreachableMongo(t)
+	setEntry(time.Now().Add(-time.Millisecond))
+	if identity := lookupAPIKey(context.Background(), "partner-key"); identity != nil {
+		t.Errorf("past the TTL the cached identity was still used: %+v", identity)
+	}
+	apiKeyCache.Lock()
+	entry := apiKeyCache.entries[hash]
+	apiKeyCache.Unlock()
+	if time.Now().Before(entry.expiresAt) {
+		t.Error("the failed lookup was cached, the next request won't try again")
+	}
+}
+
+func createTestAPIKey(t *testing.T, scopes ...string) (APIKey, string) {
+	t.Helper()
+	body, _ := json.Marshal(map[string]interface{}{"name": "Partner", "scopes": scopes})
+	rec := httptest.NewRecorder()
+	createAPIKey(rec, httptest.NewRequest(http.MethodPost, "/admin/api-keys", strings.NewReader(string(body))))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create: %d %s", rec.Code, rec.Body)
+	}
+	var created struct {
+		APIKey
+		Key string `json:"key"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(created.Key, apiKeyPrefix) || !strings.HasPrefix(created.Key, created.Prefix) {
+		t.Fatalf("key %q with prefix %q", created.Key, created.Prefix)
+	}
+	return created.APIKey, created.Key
+}
+
+// TestRevokedKeyStopsWithinTTL revokes a key the way another instance would, straight in Mongo:
+// the cached lookup keeps working until API_KEY_CACHE_TTL runs out, and no longer
+func TestRevokedKeyStopsWithinTTL(t *testing.T) {
+	useTestMongo(t, "api_keys", "audit_logs")
+	prevTTL := apiKeyCacheTTL
+	apiKeyCacheTTL = 500 * time.Millisecond
+	t.Cleanup(func() { apiKeyCacheTTL = prevTTL })
+	ctx := context.Background()
+
+	key, plaintext := createTestAPIKey(t, "read")
+	t.Cleanup(func() {
+		apiKeyCache.Lock()
+		delete(apiKeyCache.entries, hashAPIKey(plaintext))
+		apiKeyCache.Unlock()
+	})
+	identity := lookupAPIKey(ctx, plaintext)
+	if identity == nil || identity.ID != key.ID.Hex() || len(identity.Scopes) != 1 || identity.Scopes[0] != "read" {
+		t.Fatalf("identity %+v", identity)
+	}
+
+	if _, err := client.Database("MVDB").Collection("api_keys").UpdateByID(ctx, key.ID,
+		bson.M{"$set": bson.M{"active": false}}); err != nil {
+		t.Fatal(err)
+	}
+	revokedAt := time.Now()
+	if lookupAPIKey(ctx, plaintext) == nil {
+		t.Error("the cached key stopped before its TTL")
+	}
+	time.Sleep(apiKeyCacheTTL - time.Since(revokedAt) + 10*time.Millisecond)
+	if identity := lookupAPIKey(ctx, plaintext); identity != nil {
+		t.Errorf("%s after revocation the key still works: %+v", time.Since(revokedAt), identity)
+	}
+}
+
+// TestRevokeAPIKeyHere: revoking through the endpoint stops the key on this instance at once, and the
+// listing shows it revoked without the key or its hash
+func TestRevokeAPIKeyHere(t *testing.T) {
+	useTestMongo(t, "api_keys", "audit_logs")
+	ctx := context.Background()
+	key, plaintext := createTestAPIKey(t, "read", "write")
+	if lookupAPIKey(ctx, plaintext) == nil {
+		t.Fatal("the new key doesn't work")
+	}
+
+	req := mux.SetURLVars(httptest.NewRequest(http.MethodDelete, "/admin/api-keys/"+key.ID.Hex(), nil), map[string]string{"id": key.ID.Hex()})
+	rec := httptest.NewRecorder()
+	revokeAPIKey(rec, req)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("revoke: %d %s", rec.Code, rec.Body)
+	}
+	if identity := lookupAPIKey(ctx, plaintext); identity != nil {
+		t.Errorf("the revoked key still works here: %+v", identity)
+	}
+	rec = httptest.NewRecorder()
+	revokeAPIKey(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("revoking twice: %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	getAPIKeys(rec, httptest.NewRequest(http.MethodGet, "/admin/api-keys", nil))
+	if strings.Contains(rec.Body.String(), plaintext) || strings.Contains(rec.Body.String(), hashAPIKey(plaintext)) {
+		t.Errorf("the listing shows the key: %s", rec.Body)
+	}
+	var keys []APIKey
+	if err := json.NewDecoder(rec.Body).Decode(&keys); err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0].Active || keys[0].RevokedAt == nil {
+		t.Errorf("listing %+v, want the key revoked", keys)
+	}
+}
+
+func TestFlushAPIKeyUsage(t *testing.T) {
+	useTestMongo(t, "api_key_usage")
+	keyID := primitive.NewObjectID().Hex()
+	for i := 0; i < 3; i++ {
+		countAPIKeyUse(&apiKeyIdentity{ID: keyID})
+	}
+	flushAPIKeyUsage()
+	countAPIKeyUse(&apiKeyIdentity{ID: keyID})
+	flushAPIKeyUsage()
+
+	var day apiKeyUsageDay
+	today := time.Now().UTC().Format("2006-01-02")
+	if err := client.Database("MVDB").Collection("api_key_usage").FindOne(context.Background(), bson.M{"key_id": keyID}).Decode(&day); err != nil {
+		t.Fatal(err)
+	}
+	if day.Date != today || day.Count != 4 {
+		t.Errorf("usage %+v, want 4 on %s", day, today)
+	}
+}
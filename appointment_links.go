@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Appointment links let the user confirm or cancel a viewing from the booking email without signing
+// in. The token is "<appointment id>.<action>.<expiry>.<signature>", the signature an HMAC-SHA256
+// over the rest with APPOINTMENT_LINK_SECRET. The expiry is the appointment date, so a link stops
+// working once the viewing has passed and a reschedule, which moves the date, voids the old links.
+const (
+	appointmentLinkConfirm = "confirm"
+	appointmentLinkCancel  = "cancel"
+)
+
+// appointmentLinkFrom are the statuses each action applies to
+var appointmentLinkFrom = map[string][]string{
+	appointmentLinkConfirm: {"scheduled"},
+	appointmentLinkCancel:  openAppointmentStatuses,
+}
+
+var appointmentLinkSecret []byte
+
+func setupAppointmentLinks() {
+	if secret := os.Getenv("APPOINTMENT_LINK_SECRET"); secret != "" {
+		appointmentLinkSecret = []byte(secret)
+		return
+	}
+	appointmentLinkSecret = make([]byte, 32)
+	if _, err := rand.Read(appointmentLinkSecret); err != nil {
+		log.Fatal("Failed to generate an appointment link secret: ", err)
+	}
+	log.Println("APPOINTMENT_LINK_SECRET is not set, appointment links only work until this instance restarts")
+}
+
+func signAppointmentLink(payload string) string {
+	mac := hmac.New(sha256.New, appointmentLinkSecret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func appointmentLinkToken(a *Appointment, action string) string {
+	payload := a.ID.Hex() + "." + action + "." + strconv.FormatInt(a.AppointmentDate.Unix(), 10)
+	return payload + "." + signAppointmentLink(payload)
+}
+
+var (
+	errAppointmentLinkInvalid = errors.New("This link is invalid")
+	errAppointmentLinkExpired = errors.New("This link has expired")
+	errAppointmentLinkUsed    = errors.New("This link has already been used or the appointment can no longer be changed")
+)
+
+type appointmentLink struct {
+	ID        primitive.ObjectID
+	Action    string
+	Expiry    int64
+	Signature string
+}
+
+// parseAppointmentLink checks the signature and expiry of token for action
+func parseAppointmentLink(token, action string) (*appointmentLink, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 4 || parts[1] != action {
+		return nil, errAppointmentLinkInvalid
+	}
+	payload := strings.Join(parts[:3], ".")
+	if !hmac.Equal([]byte(parts[3]), []byte(signAppointmentLink(payload))) {
+		return nil, errAppointmentLinkInvalid
+	}
+	id, err := primitive.ObjectIDFromHex(parts[0])
+	if err != nil {
+		return nil, errAppointmentLinkInvalid
+	}
+	expiry, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return nil, errAppointmentLinkInvalid
+	}
+	if time.Now().Unix() > expiry {
+		return nil, errAppointmentLinkExpired
+	}
+	return &appointmentLink{ID: id, Action: action, Expiry: expiry, Signature: parts[3]}, nil
+}
+
+func appointmentLinkStatus(err error) int {
+	switch err {
+	case errAppointmentLinkInvalid:
+		return http.StatusBadRequest
+	case errAppointmentLinkExpired:
+		return http.StatusGone
+	case errAppointmentLinkUsed:
+		return http.StatusConflict
+	}
+	return http.StatusNotFound
+}
+
+var appointmentLinkPage = template.Must(template.New("appointment").Parse(`<!DOCTYPE html>
+<html>
+<body style="font-family: sans-serif">
+{{if .Error}}<p>{{.Error}}.</p>
+{{else if .Done}}<p>Your viewing on {{.When}} is {{.Appointment.Status}}.</p>
+{{else}}<p>{{if eq .Action "confirm"}}Confirm{{else}}Cancel{{end}} your viewing on {{.When}}?</p>
+<form method="POST"><input type="hidden" name="token" value="{{.Token}}"><button type="submit">{{if eq .Action "confirm"}}Confirm{{else}}Cancel{{end}} the viewing</button></form>
+{{end}}</body>
+</html>
+`))
+
+// appointmentLinkHandler answers GET and POST /appointments/confirm and /appointments/cancel. Like
+// the saved search unsubscribe link, GET only shows a confirmation form, since mail scanners follow
+// links, and POST does the change. A used token is remembered on the appointment so it can't be
+// replayed. The answer is JSON for callers asking for application/json or with format=json.
+func appointmentLinkHandler(action string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := r.FormValue("token")
+		wantJSON := r.FormValue("format") == "json" || strings.Contains(r.Header.Get("Accept"), "application/json")
+		loc, ok := responseLocation(w, r)
+		if !ok {
+			return
+		}
+		respond := func(status int, appointment *Appointment, done bool, err error) {
+			if appointment != nil {
+				localizeAppointment(appointment, loc)
+			}
+			if wantJSON {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(status)
+				if err != nil {
+					json.NewEncoder(w).Encode(bson.M{"error": err.Error()})
+					return
+				}
+				json.NewEncoder(w).Encode(bson.M{"action": action, "done": done, "appointment": appointment})
+				return
+			}
+			data := struct {
+				Action      string
+				Token       string
+				Done        bool
+				Error       string
+				When        string
+				Appointment *Appointment
+			}{Action: action, Token: token, Done: done, Appointment: appointment}
+			if err != nil {
+				data.Error = err.Error()
+			}
+			if appointment != nil {
+				data.When = appointment.AppointmentDate.Format("Mon 2 Jan 15:04")
+			}
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.WriteHeader(status)
+			appointmentLinkPage.Execute(w, data)
+		}
+
+		link, err := parseAppointmentLink(token, action)
+		if err != nil {
+			respond(appointmentLinkStatus(err), nil, false, err)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+		defer cancel()
+
+		collection := client.Database("MVDB").Collection("appointments")
+		var appointment Appointment
+		err = collection.FindOne(ctx, bson.M{"_id": link.ID}).Decode(&appointment)
+		if err == mongo.ErrNoDocuments {
+			respond(http.StatusNotFound, nil, false, errors.New("Appointment not found"))
+			return
+		}
+		if err != nil {
+			serverError(w, r, "Failed to retrieve Appointment", err)
+			return
+		}
+		// A reschedule moves the date away from the expiry the link was signed with
+		if appointment.AppointmentDate.Unix() != link.Expiry {
+			respond(http.StatusGone, &appointment, false, errAppointmentLinkExpired)
+			return
+		}
+		if !isOneOf(appointment.Status, appointmentLinkFrom[action]) || isOneOf(link.Signature, appointment.UsedLinkTokens) {
+			respond(http.StatusConflict, &appointment, false, errAppointmentLinkUsed)
+			return
+		}
+		if r.Method != http.MethodPost {
+			respond(http.StatusOK, &appointment, false, nil)
+			return
+		}
+
+		set := bson.M{"status": "confirmed"}
+		if action == appointmentLinkCancel {
+			set = bson.M{"status": "cancelled", "cancellation_reason": "cancelled_by_user"}
+		}
+		before := appointment
+		err = collection.FindOneAndUpdate(ctx, bson.M{
+			"_id":              link.ID,
+			"appointment_date": appointment.AppointmentDate,
+			"status":           bson.M{"$in": appointmentLinkFrom[action]},
+			"used_link_tokens": bson.M{"$ne": link.Signature},
+		}, bson.M{"$set": set, "$addToSet": bson.M{"used_link_tokens": link.Signature}},
+			options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&appointment)
+		if err == mongo.ErrNoDocuments {
+			// Another request used the link or changed the appointment in between
+			respond(http.StatusConflict, &before, false, errAppointmentLinkUsed)
+			return
+		}
+		if err != nil {
+			serverError(w, r, "Failed to update Appointment", err)
+			return
+		}
+		recordAudit(auditFromRequest(r), "update", "appointments", link.ID.Hex(), before, appointment, nil)
+		if action == appointmentLinkCancel {
+			go notifyAgentOfAppointment(appointment, agentEventAppointmentCancelled)
+			go releaseAppointmentSlot(appointment.ListingID, appointment.AppointmentDate, appointment.ID)
+		}
+		respond(http.StatusOK, &appointment, true, nil)
+	}
+}
+
+var appointmentLinksEmail = template.Must(template.New("appointment").Parse(`<!DOCTYPE html>
+<html>
+<body style="font-family: sans-serif">
+<p>Your viewing is booked for {{.When}}.</p>
+<p><a href="{{.ConfirmURL}}">Confirm the viewing</a></p>
+<p style="font-size: small; color: #666">Can't make it? <a href="{{.CancelURL}}">Cancel the viewing</a></p>
+</body>
+</html>
+`))
+
+// emailAppointmentLinks sends the user the confirm and cancel links of a newly booked or rescheduled
+// appointment. Like createNotification it only logs failures.
+func emailAppointmentLinks(a Appointment) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	userID, err := primitive.ObjectIDFromHex(a.UserID)
+	if err != nil {
+		return
+	}
+	var user User
+	if err := client.Database("MVDB").Collection("users").FindOne(ctx, bson.M{"_id": userID}).Decode(&user); err != nil {
+		log.Println("Failed to find the user to email appointment", a.ID.Hex(), ":", err)
+		return
+	}
+	if user.Email == "" {
+		return
+	}
+
+	base := publicBaseURL()
+	var buf bytes.Buffer
+	if err := appointmentLinksEmail.Execute(&buf, struct {
+		When       string
+		ConfirmURL string
+		CancelURL  string
+	}{
+		When:       a.AppointmentDate.In(bangkok).Format("Mon 2 Jan 15:04"),
+		ConfirmURL: base + "/appointments/confirm?token=" + url.QueryEscape(appointmentLinkToken(&a, appointmentLinkConfirm)),
+		CancelURL:  base + "/appointments/cancel?token=" + url.QueryEscape(appointmentLinkToken(&a, appointmentLinkCancel)),
+	}); err != nil {
+		log.Println("Failed to render the email of appointment", a.ID.Hex(), ":", err)
+		return
+	}
+	if err := mailer.Send(ctx, user.Email, "Please confirm your viewing", buf.String()); err != nil {
+		log.Println("Failed to email appointment", a.ID.Hex(), ":", err)
+	}
+}
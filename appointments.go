@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	errInvalidUserID    = errors.New("Invalid User_id format")
+	errUserNotFound     = errors.New("User_id does not exist")
+	errUserCheck        = errors.New("Failed to check User_id")
+	errInvalidListingID = errors.New("Invalid Listing_id format")
+	errListingNotFound  = errors.New("Listing_id does not exist")
+	errListingCheck     = errors.New("Failed to check Listing_id")
+	errListingClosed    = errors.New("Listing_id is not open for viewings")
+	errAppointmentDate  = errors.New("Appointment_date must be in the future")
+)
+
+// listingPropertyMismatch is returned when an appointment names a listing of a different property
+type listingPropertyMismatch struct {
+	ListingID, ListingPropertyID, PropertyID string
+}
+
+func (e *listingPropertyMismatch) Error() string {
+	return fmt.Sprintf("Listing %s belongs to property %s, not %s", e.ListingID, e.ListingPropertyID, e.PropertyID)
+}
+
+// verifyAppointmentListing checks that the listing belongs to the property and takes appointments,
+// which only active and published listings do; deactivating a listing cancels them, see setListingStatus.
+// Anything that sets or changes an appointment's Listing_id or Property_id must call it.
+func verifyAppointmentListing(ctx context.Context, listingID, propertyID string) error {
+	oid, err := primitive.ObjectIDFromHex(listingID)
+	if err != nil {
+		return errInvalidListingID
+	}
+	var listing Listing
+	err = client.Database("MVDB").Collection("listings").FindOne(ctx, notDeleted(bson.M{"_id": oid})).Decode(&listing)
+	if err == mongo.ErrNoDocuments {
+		return errListingNotFound
+	}
+	if err != nil {
+		return errListingCheck
+	}
+	if listing.PropertyID != propertyID {
+		return &listingPropertyMismatch{ListingID: listingID, ListingPropertyID: listing.PropertyID, PropertyID: propertyID}
+	}
+	if listing.ListingStatus != "active" || listing.Publication == publicationDraft {
+		return errListingClosed
+	}
+	return nil
+}
+
+// insertAppointment validates the appointment, claims its slot and stores it as scheduled, with the
+// date in UTC. It returns a *calendarConflict outside the agent's hours and errSlotTaken when the
+// listing is already booked at that date.
+func insertAppointment(ctx context.Context, appointment *Appointment) (interface{}, error) {
+	appointment.AppointmentDate = appointment.AppointmentDate.UTC()
+	if !appointment.AppointmentDate.After(time.Now()) {
+		return nil, errAppointmentDate
+	}
+	if err := verifyAppointmentListing(ctx, appointment.ListingID, appointment.PropertyID); err != nil {
+		return nil, err
+	}
+	if err := checkViewingTime(ctx, appointment.ListingID, appointment.AppointmentDate); err != nil {
+		return nil, err
+	}
+
+	if appointment.ID.IsZero() {
+		appointment.ID = primitive.NewObjectID()
+	}
+	if err := claimAppointmentSlot(ctx, appointment); err != nil {
+		return nil, err
+	}
+
+	appointment.Status = "scheduled"
+	appointment.CancellationReason = ""
+	appointment.CreatedAt = time.Now()
+
+	id, err := insertWithReferences(ctx, "appointments", appointment,
+		reference{Collection: "users", ID: appointment.UserID, Invalid: errInvalidUserID, Missing: errUserNotFound, Check: errUserCheck},
+		// the listing may have been deactivated since verifyAppointmentListing, after its cascade ran
+		reference{Collection: "listings", ID: appointment.ListingID, Invalid: errInvalidListingID, Missing: errListingClosed, Check: errListingCheck,
+			Match: activeListingsFilter(bson.M{})},
+		reference{Collection: "properties", ID: appointment.PropertyID, Invalid: errInvalidPropertyID, Missing: errPropertyNotFound, Check: errPropertyCheck},
+	)
+	if err != nil {
+		freeAppointmentSlot(ctx, appointment.ListingID, appointment.AppointmentDate, appointment.ID)
+	}
+	return id, err
+}
+
+// createAppointment books a viewing. A slot that is already taken answers 409, or with
+// ?waitlist=true 202 and a waitlist entry, see joinWaitlist.
+func createAppointment(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var appointment Appointment
+	if err := json.NewDecoder(r.Body).Decode(&appointment); err != nil {
+		http.Error(w, appointmentDecodeError(err), http.StatusBadRequest)
+		return
+	}
+	loc, ok := responseLocation(w, r)
+	if !ok {
+		return
+	}
+	waitlist := r.URL.Query().Get("waitlist") == "true"
+	var windowFrom, windowTo time.Time
+	if waitlist {
+		var err error
+		if windowFrom, windowTo, err = parseWaitlistWindow(r, appointment.AppointmentDate); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	id, err := insertAppointment(ctx, &appointment)
+	var mismatch *listingPropertyMismatch
+	var outside *calendarConflict
+	switch {
+	case err == nil:
+	case err == errSlotTaken && waitlist:
+		joinWaitlist(ctx, w, r, appointment, windowFrom, windowTo)
+		return
+	case err == errSlotTaken:
+		http.Error(w, errSlotTaken.Error()+"; book with ?waitlist=true to join the waitlist", http.StatusConflict)
+		return
+	case errors.As(err, &mismatch):
+		http.Error(w, mismatch.Error(), http.StatusUnprocessableEntity)
+		return
+	case err == errListingClosed:
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	case errors.As(err, &outside):
+		http.Error(w, outside.Error(), http.StatusUnprocessableEntity)
+		return
+	case err == errAppointmentDate,
+		err == errInvalidUserID, err == errUserNotFound,
+		err == errInvalidListingID, err == errListingNotFound,
+		err == errInvalidPropertyID, err == errPropertyNotFound:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case err == errUserCheck, err == errListingCheck, err == errPropertyCheck, err == errCalendarCheck:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	default:
+		http.Error(w, "Failed to create Appointment", http.StatusInternalServerError)
+		return
+	}
+	auditCreated(auditFromRequest(r), "appointments", id, appointment)
+	appointment.ID, _ = id.(primitive.ObjectID)
+	go emailAppointmentLinks(appointment)
+	go notifyAgentOfAppointment(appointment, agentEventAppointmentBooked)
+	var extra map[string]interface{}
+	if warning := appointmentAvailabilityWarning(ctx, appointment.ListingID); warning != "" {
+		extra = map[string]interface{}{"warning": warning}
+	}
+	localizeAppointment(&appointment, loc)
+	writeCreated(w, "/appointments/"+appointment.ID.Hex(), appointment, extra)
+}
+
+// setAppointmentStatus confirms, completes or cancels an open appointment; the user is notified of a cancellation
+func setAppointmentStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	id, ok := pathObjectID(w, r, "Appointment")
+	if !ok {
+		return
+	}
+	var body struct {
+		Status string `json:"status"`
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Failed to parse request body", http.StatusBadRequest)
+		return
+	}
+	if body.Status != "confirmed" && body.Status != "completed" && body.Status != "cancelled" {
+		http.Error(w, "status must be confirmed, completed or cancelled", http.StatusBadRequest)
+		return
+	}
+	set := bson.M{"status": body.Status}
+	if body.Status == "cancelled" {
+		set["cancellation_reason"] = body.Reason
+	}
+	updateScheduledAppointment(w, r, id, set, notificationAppointmentCancelled)
+}
+
+// rescheduleAppointment moves an open appointment to a new future Appointment_date. It is scheduled
+// again until the user confirms the new time with the link in the new email.
+func rescheduleAppointment(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	id, ok := pathObjectID(w, r, "Appointment")
+	if !ok {
+		return
+	}
+	var body struct {
+		AppointmentDate time.Time `json:"Appointment_date"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, appointmentDecodeError(err), http.StatusBadRequest)
+		return
+	}
+	if !body.AppointmentDate.After(time.Now()) {
+		http.Error(w, errAppointmentDate.Error(), http.StatusBadRequest)
+		return
+	}
+	updateScheduledAppointment(w, r, id, bson.M{"appointment_date": body.AppointmentDate.UTC(), "status": "scheduled"}, notificationAppointmentRescheduled)
+}
+
+// updateScheduledAppointment applies set to a scheduled or confirmed appointment and notifies the user.
+// For status changes the notification only goes out for cancellations. A new appointment_date must
+// be free and within the agent's hours; the slot the appointment leaves goes to the waitlist.
+func updateScheduledAppointment(w http.ResponseWriter, r *http.Request, id primitive.ObjectID, set bson.M, notificationType string) {
+	loc, ok := responseLocation(w, r)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	collection := client.Database("MVDB").Collection("appointments")
+	var current Appointment
+	newDate, moving := set["appointment_date"].(time.Time)
+	if moving {
+		err := collection.FindOne(ctx, bson.M{"_id": id, "status": bson.M{"$in": openAppointmentStatuses}}).Decode(&current)
+		moving = err == nil && !current.AppointmentDate.Equal(newDate)
+		if moving {
+			if err = checkViewingTime(ctx, current.ListingID, newDate); err == nil {
+				claim := current
+				claim.AppointmentDate = newDate
+				err = claimAppointmentSlot(ctx, &claim)
+			}
+		}
+		var outside *calendarConflict
+		if errors.As(err, &outside) {
+			http.Error(w, outside.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		if err == errSlotTaken {
+			http.Error(w, errSlotTaken.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil && err != mongo.ErrNoDocuments {
+			serverError(w, r, "Failed to check the new Appointment_date", err)
+			return
+		}
+	}
+
+	before := auditSnapshot(ctx, "appointments", id)
+	var appointment Appointment
+	err := collection.FindOneAndUpdate(ctx, bson.M{"_id": id, "status": bson.M{"$in": openAppointmentStatuses}}, bson.M{"$set": set},
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&appointment)
+	if err != nil && moving {
+		freeAppointmentSlot(ctx, current.ListingID, newDate, id)
+	}
+	if err == mongo.ErrNoDocuments {
+		if n, err := collection.CountDocuments(ctx, bson.M{"_id": id}); err == nil && n > 0 {
+			http.Error(w, "Only scheduled or confirmed appointments can be changed", http.StatusConflict)
+			return
+		}
+		http.Error(w, "Appointment not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		serverError(w, r, "Failed to update Appointment", err)
+		return
+	}
+	recordAudit(auditFromRequest(r), "update", "appointments", id.Hex(), before, appointment, nil)
+	switch {
+	case moving:
+		go releaseAppointmentSlot(current.ListingID, current.AppointmentDate, id)
+	case !isOneOf(appointment.Status, openAppointmentStatuses):
+		go releaseAppointmentSlot(appointment.ListingID, appointment.AppointmentDate, id)
+	}
+	switch {
+	case notificationType == notificationAppointmentRescheduled:
+		go notifyAppointmentChange(appointment, notificationType)
+		go emailAppointmentLinks(appointment)
+	case appointment.Status == "cancelled":
+		go notifyAppointmentChange(appointment, notificationType)
+		go notifyAgentOfAppointment(appointment, agentEventAppointmentCancelled)
+	}
+	localizeAppointment(&appointment, loc)
+	json.NewEncoder(w).Encode(appointment)
+}
+
+// getListingBookedTimes answers GET /listings/{id}/booked-times with the dates of the listing's
+// scheduled or confirmed viewings from now on, so the booking form can grey them out. It is the
+// public side of GET /appointments, which needs the API key: only the times are returned, never who
+// booked them. Like appointments they are rendered in ?tz=, Asia/Bangkok by default.
+func getListingBookedTimes(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	id, ok := pathObjectID(w, r, "Listing")
+	if !ok {
+		return
+	}
+	loc, ok := responseLocation(w, r)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	appointments, err := findAllWith[Appointment](ctx, "appointments", bson.M{
+		"listing_id":       id.Hex(),
+		"status":           bson.M{"$in": openAppointmentStatuses},
+		"appointment_date": bson.M{"$gte": time.Now()},
+	}, options.Find().SetSort(bson.D{{Key: "appointment_date", Value: 1}}).SetProjection(bson.M{"appointment_date": 1}))
+	if err != nil {
+		serverError(w, r, "Failed to retrieve Appointments", err)
+		return
+	}
+	times := make([]time.Time, len(appointments))
+	for i, a := range appointments {
+		times[i] = a.AppointmentDate.In(loc)
+	}
+	json.NewEncoder(w).Encode(bson.M{"listing_id": id.Hex(), "booked": times})
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var appointmentCollections = []string{"users", "properties", "listings", "appointments", "appointment_slots"}
+
+// seedBookableListing stores a user and an active listing of a property, returning an appointment for them
+func seedBookableListing(t *testing.T, listing Listing) (Appointment, primitive.ObjectID) {
+	t.Helper()
+	ctx := context.Background()
+	db := client.Database("MVDB")
+	userID, propertyID, listingID := primitive.NewObjectID(), primitive.NewObjectID(), primitive.NewObjectID()
+	listing.ID, listing.PropertyID = listingID, propertyID.Hex()
+	for collectionName, doc := range map[string]interface{}{
+		"users":      User{ID: userID, Email: "buyer@example.com"},
+		"properties": Property{ID: propertyID, Title: "Test"},
+		"listings":   listing,
+	} {
+		if _, err := db.Collection(collectionName).InsertOne(ctx, doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return Appointment{UserID: userID.Hex(), PropertyID: propertyID.Hex(), ListingID: listingID.Hex()}, listingID
+}
+
+// viewingDay is 10:00 in Bangkok days days from now, within the default viewing hours
+func viewingDay(days int) time.Time {
+	now := time.Now().In(bangkok)
+	return time.Date(now.Year(), now.Month(), now.Day()+days, 10, 0, 0, 0, bangkok)
+}
+
+func TestInsertAppointmentNeedsBookableListing(t *testing.T) {
+	useTestMongo(t, appointmentCollections...)
+	tests := []struct {
+		name    string
+		listing Listing
+		want    error
+	}{
+		{"active", Listing{ListingStatus: "active"}, nil},
+		{"published", Listing{ListingStatus: "active", Publication: publicationPublished}, nil},
+		{"inactive", Listing{ListingStatus: "inactive"}, errListingClosed},
+		{"draft", Listing{ListingStatus: "active", Publication: publicationDraft}, errListingClosed},
+	}
+	for _, tt := range tests {
+		appointment, _ := seedBookableListing(t, tt.listing)
+		appointment.AppointmentDate = viewingDay(1)
+		if _, err := insertAppointment(context.Background(), &appointment); err != tt.want {
+			t.Errorf("%s listing: %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+// TestBookingRacesDeactivation books viewings while the listing is deactivated: whichever way each
+// booking interleaves with the deactivation, no scheduled appointment may survive on it
+func TestBookingRacesDeactivation(t *testing.T) {
+	useTestMongo(t, appointmentCollections...)
+	ctx := context.Background()
+	appointment, listingID := seedBookableListing(t, Listing{ListingStatus: "active"})
+
+	const bookings = 20
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for i := 0; i < bookings; i++ {
+		wg.Add(1)
+		go func(a Appointment) {
+			defer wg.Done()
+			<-start
+			if _, err := insertAppointment(ctx, &a); err != nil && err != errListingClosed {
+				t.Errorf("booking: %v", err)
+			}
+		}(Appointment{UserID: appointment.UserID, PropertyID: appointment.PropertyID, ListingID: appointment.ListingID,
+			AppointmentDate: viewingDay(i + 1)})
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		<-start
+		time.Sleep(5 * time.Millisecond) // let some bookings in first
+		if _, err := setListingStatus(ctx, listingID, false, "sold"); err != nil {
+			t.Errorf("deactivating: %v", err)
+		}
+	}()
+	close(start)
+	wg.Wait()
+
+	n, err := client.Database("MVDB").Collection("appointments").CountDocuments(ctx,
+		bson.M{"listing_id": listingID.Hex(), "status": "scheduled"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("%d scheduled appointments on the deactivated listing", n)
+	}
+}
+
+// TestCreateAppointmentListingMismatch: a listing of another property answers 422 naming the listing
+// and both properties, and nothing is booked
+func TestCreateAppointmentListingMismatch(t *testing.T) {
+	useTestMongo(t, appointmentCollections...)
+	appointment, listingID := seedBookableListing(t, Listing{ListingStatus: "active"})
+	otherProperty := primitive.NewObjectID()
+	insertDocs(t, "properties", Property{ID: otherProperty, Title: "Other"})
+	appointment.PropertyID, appointment.AppointmentDate = otherProperty.Hex(), viewingDay(1)
+
+	body, _ := json.Marshal(appointment)
+	rec := httptest.NewRecorder()
+	createAppointment(rec, httptest.NewRequest(http.MethodPost, "/add/appointment", bytes.NewReader(body)))
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("%d %s", rec.Code, rec.Body)
+	}
+	var listing Listing
+	if err := client.Database("MVDB").Collection("listings").FindOne(context.Background(), bson.M{"_id": listingID}).Decode(&listing); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{listingID.Hex(), listing.PropertyID, otherProperty.Hex()} {
+		if !strings.Contains(rec.Body.String(), id) {
+			t.Errorf("%q doesn't name %s", rec.Body, id)
+		}
+	}
+	if n, _ := client.Database("MVDB").Collection("appointments").CountDocuments(context.Background(), bson.M{}); n != 0 {
+		t.Errorf("%d appointments booked", n)
+	}
+}
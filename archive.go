@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Settled inquiries and appointments move to inquiries_archive and appointments_archive once they
+// are older than ARCHIVE_AFTER_DAYS (default 365), so the lists the admins work from stay small.
+// Inquiries have no status: one is settled once it was answered (first_reply_at) or archived with its
+// property (archived_at). Appointments are settled once completed or cancelled, and their age is that
+// of the appointment date. The nightly archive task and POST /admin/archive move them in batches:
+// each batch is copied, the copy counted, and only then deleted from the hot collection.
+const (
+	archiveBatchSize        = 500
+	archiveTimeout          = 10 * time.Minute
+	defaultArchiveAfterDays = 365
+)
+
+var archiveAfter = archiveAfterFromEnv()
+
+func archiveAfterFromEnv() time.Duration {
+	if raw := os.Getenv("ARCHIVE_AFTER_DAYS"); raw != "" {
+		if days, err := strconv.Atoi(raw); err == nil && days > 0 {
+			return time.Duration(days) * 24 * time.Hour
+		}
+		log.Println("Ignoring invalid ARCHIVE_AFTER_DAYS:", raw)
+	}
+	return defaultArchiveAfterDays * 24 * time.Hour
+}
+
+// archiveFilters match the settled documents older than cutoff, per collection
+func archiveFilters(cutoff time.Time) map[string]bson.M {
+	return map[string]bson.M{
+		"inquiries": {
+			"created_at": bson.M{"$lt": cutoff},
+			"$or": bson.A{
+				bson.M{"first_reply_at": bson.M{"$ne": nil}},
+				bson.M{"archived_at": bson.M{"$ne": nil}},
+			},
+		},
+		"appointments": {
+			"appointment_date": bson.M{"$lt": cutoff},
+			"status":           bson.M{"$in": bson.A{"completed", "cancelled"}},
+		},
+	}
+}
+
+// archiveResult is what one archive run moved
+type archiveResult struct {
+	Cutoff       time.Time `json:"cutoff"`
+	Inquiries    int       `json:"inquiries"`
+	Appointments int       `json:"appointments"`
+}
+
+// archiveSettled moves the settled inquiries and appointments older than cutoff. Runs may overlap:
+// a document already copied by another run is not copied twice, and each run only deletes what it
+// found in the archive.
+func archiveSettled(ctx context.Context, cutoff time.Time) (archiveResult, error) {
+	result := archiveResult{Cutoff: cutoff}
+	filters := archiveFilters(cutoff)
+	var err error
+	if result.Inquiries, err = archiveCollection(ctx, "inquiries", filters["inquiries"]); err != nil {
+		return result, err
+	}
+	result.Appointments, err = archiveCollection(ctx, "appointments", filters["appointments"])
+	return result, err
+}
+
+// archiveCollection moves the documents matching filter to the archive of collectionName, one
+// batch at a time, and returns how many it moved
+func archiveCollection(ctx context.Context, collectionName string, filter bson.M) (int, error) {
+	db := client.Database("MVDB")
+	hot, cold := db.Collection(collectionName), db.Collection(collectionName+"_archive")
+	moved := 0
+	defer func() {
+		if moved > 0 {
+			invalidateResponses(collectionName)
+		}
+	}()
+	for {
+		var docs []bson.Raw
+		cur, err := hot.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetLimit(archiveBatchSize))
+		if err != nil {
+			return moved, err
+		}
+		if err := cur.All(ctx, &docs); err != nil {
+			return moved, err
+		}
+		if len(docs) == 0 {
+			return moved, nil
+		}
+
+		ids := make([]primitive.ObjectID, 0, len(docs))
+		batch := make([]interface{}, 0, len(docs))
+		for _, doc := range docs {
+			id, ok := doc.Lookup("_id").ObjectIDOK()
+			if !ok {
+				return moved, fmt.Errorf("%s document without an ObjectID _id", collectionName)
+			}
+			ids = append(ids, id)
+			batch = append(batch, doc)
+		}
+		// Unordered, so the documents a crashed run already copied only fail on their own _id
+		_, err = cold.InsertMany(ctx, batch, options.InsertMany().SetOrdered(false))
+		var bulkErr mongo.BulkWriteException
+		if err != nil && !(errors.As(err, &bulkErr) && onlyDuplicateKeys(bulkErr)) {
+			return moved, err
+		}
+		copied, err := cold.CountDocuments(ctx, bson.M{"_id": bson.M{"$in": ids}})
+		if err != nil {
+			return moved, err
+		}
+		if copied != int64(len(ids)) {
+			return moved, fmt.Errorf("only %d of %d %s were found in the archive, nothing of the batch was deleted", copied, len(ids), collectionName)
+		}
+		res, err := hot.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}})
+		if err != nil {
+			return moved, err
+		}
+		moved += int(res.DeletedCount)
+		if len(docs) < archiveBatchSize {
+			return moved, nil
+		}
+	}
+}
+
+func onlyDuplicateKeys(e mongo.BulkWriteException) bool {
+	if e.WriteConcernError != nil {
+		return false
+	}
+	for _, we := range e.WriteErrors {
+		if we.Code != 11000 {
+			return false
+		}
+	}
+	return true
+}
+
+// scheduleArchive moves settled documents every night at 03:30, SCHEDULE_ARCHIVE
+func scheduleArchive() {
+	registerTask(scheduledTask{
+		Name:    "archive",
+		Spec:    "30 3 * * *",
+		Env:     "SCHEDULE_ARCHIVE",
+		Timeout: archiveTimeout,
+		Run: func(ctx context.Context) (string, error) {
+			res, err := archiveSettled(ctx, time.Now().Add(-archiveAfter))
+			return fmt.Sprintf("archived %d inquiries and %d appointments", res.Inquiries, res.Appointments), err
+		},
+	})
+}
+
+// runArchive answers POST /admin/archive, archiving now. ?cutoff= (RFC3339 or YYYY-MM-DD) sets the
+// age instead of ARCHIVE_AFTER_DAYS; it must lie in the past.
+func runArchive(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	cutoff := time.Now().Add(-archiveAfter)
+	if raw := r.URL.Query().Get("cutoff"); raw != "" {
+		t, err := parseDateOrTime(raw)
+		if err != nil {
+			http.Error(w, "cutoff must be RFC3339 or YYYY-MM-DD", http.StatusBadRequest)
+			return
+		}
+		if !t.Before(time.Now()) {
+			http.Error(w, "cutoff must be in the past", http.StatusBadRequest)
+			return
+		}
+		cutoff = t
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), archiveTimeout)
+	defer cancel()
+
+	res, err := archiveSettled(ctx, cutoff)
+	if res.Inquiries > 0 || res.Appointments > 0 {
+		recordAudit(auditFromRequest(r), "archive", "inquiries", "", nil, nil, bson.M{"cutoff": cutoff, "moved": res.Inquiries})
+		recordAudit(auditFromRequest(r), "archive", "appointments", "", nil, nil, bson.M{"cutoff": cutoff, "moved": res.Appointments})
+	}
+	if err != nil {
+		// What moved before the failure stays moved, the next run picks up the rest
+		serverError(w, r, fmt.Sprintf("Archived %d inquiries and %d appointments, then failed", res.Inquiries, res.Appointments), err)
+		return
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+var includeArchivedParam = apiParam{Name: "include_archived", Description: "true adds the documents moved to the archive; X-Archives-Included tells whether they were"}
+
+// includeArchived reports ?include_archived=true
+func includeArchived(r *http.Request) bool {
+	return r.URL.Query().Get("include_archived") == "true"
+}
+
+// setArchivesIncluded states on a count or stats response whether the archives were counted
+func setArchivesIncluded(w http.ResponseWriter, included bool) {
+	w.Header().Set("X-Archives-Included", strconv.FormatBool(included))
+}
+
+// archiveUnion is the pipeline stage adding the archive's documents matching match
+func archiveUnion(collectionName string, match bson.M) bson.M {
+	return bson.M{"$unionWith": bson.M{"coll": collectionName + "_archive", "pipeline": []bson.M{{"$match": match}}}}
+}
+
+// findWithArchive pages filter over a collection, and with ?include_archived=true over its
+// archive too, sorted by _id across both like any page
+func findWithArchive(ctx context.Context, r *http.Request, collectionName string, filter bson.M, page listPage) (*mongo.Cursor, error) {
+	collection := client.Database("MVDB").Collection(collectionName)
+	if !includeArchived(r) {
+		return collection.Find(ctx, filter, page.findOptions())
+	}
+	pipeline := []bson.M{{"$match": filter}, archiveUnion(collectionName, filter)}
+	return collection.Aggregate(ctx, append(pipeline, page.stages(false)...))
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// AuditEntry records one write: who did it, to which document, and which fields changed
+type AuditEntry struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty" json:"audit_id,omitempty"`
+	Actor      string             `bson:"actor" json:"actor"`
+	IP         string             `bson:"ip" json:"ip"`
+	Action     string             `bson:"action" json:"action"` // create, update, delete, restore, import, purge
+	Collection string             `bson:"collection" json:"collection"`
+	DocumentID string             `bson:"document_id,omitempty" json:"document_id,omitempty"`
+	Changes    []fieldChange      `bson:"changes" json:"changes"`
+	Details    interface{}        `bson:"details,omitempty" json:"details,omitempty"`
+	CreatedAt  time.Time          `bson:"created_at" json:"created_at"`
+}
+
+// fieldChange is one changed field; nested fields use dotted paths such as "address.city"
+type fieldChange struct {
+	Field  string      `bson:"field" json:"field"`
+	Before interface{} `bson:"before" json:"before"`
+	After  interface{} `bson:"after" json:"after"`
+}
+
+// auditMeta identifies who made a request
+type auditMeta struct {
+	Actor string
+	IP    string
+}
+
+type auditMetaKey struct{}
+
+// auditFromRequest names the caller. There are no user accounts yet, so the actor is
+// "api_key" for requests carrying the shared key, "api_key:<name>" for a partner key and
+// "anonymous" otherwise.
+func auditFromRequest(r *http.Request) auditMeta {
+	actor := "anonymous"
+	if identity := callerKey(r); identity == sharedKeyIdentity {
+		actor = "api_key"
+	} else if identity != nil {
+		actor = "api_key:" + identity.Name
+	}
+	return auditMeta{Actor: actor, IP: clientIP(r)}
+}
+
+// withAuditMeta stores the caller in the request context for handlers that only see a context (GraphQL resolvers)
+func withAuditMeta(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), auditMetaKey{}, auditFromRequest(r))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func auditFromContext(ctx context.Context) auditMeta {
+	if meta, ok := ctx.Value(auditMetaKey{}).(auditMeta); ok {
+		return meta
+	}
+	return auditMeta{Actor: "anonymous"}
+}
+
+// recordAudit writes an audit entry. before and after may be structs, bson.M or nil (create/purge).
+// It runs on its own timeout and only logs on failure, so auditing never fails the write itself.
+func recordAudit(meta auditMeta, action, collectionName, documentID string, before, after, details interface{}) {
+	invalidateResponses(collectionName)
+	if report, ok := details.(*deletionReport); ok {
+		for _, t := range report.Touched {
+			invalidateResponses(t.Collection)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	changes, err := auditDiff(before, after)
+	if err != nil {
+		log.Println("Failed to diff audit entry for", collectionName, documentID, ":", err)
+		changes = []fieldChange{}
+	}
+	_, err = client.Database("MVDB").Collection("audit_logs").InsertOne(ctx, AuditEntry{
+		Actor:      meta.Actor,
+		IP:         meta.IP,
+		Action:     action,
+		Collection: collectionName,
+		DocumentID: documentID,
+		Changes:    changes,
+		Details:    details,
+		CreatedAt:  time.Now(),
+	})
+	if err != nil {
+		log.Println("Failed to write audit entry for", collectionName, documentID, ":", err)
+	}
+	enqueueWebhooks(ctx, meta, action, collectionName, documentID, before, after)
+	publishAuditEvent(action, collectionName, documentID)
+}
+
+// auditSnapshot reads a document as stored, for the before/after of an update. Nil when it can't be read.
+func auditSnapshot(ctx context.Context, collectionName string, id primitive.ObjectID) bson.M {
+	var doc bson.M
+	if err := client.Database("MVDB").Collection(collectionName).FindOne(ctx, bson.M{"_id": id}).Decode(&doc); err != nil {
+		return nil
+	}
+	return doc
+}
+
+// auditDiff compares two documents through their BSON form, so field names match what is stored
+func auditDiff(before, after interface{}) ([]fieldChange, error) {
+	b, err := toBSONDoc(before)
+	if err != nil {
+		return nil, err
+	}
+	a, err := toBSONDoc(after)
+	if err != nil {
+		return nil, err
+	}
+	delete(b, "_id")
+	delete(a, "_id")
+
+	changes := []fieldChange{}
+	diffDocs("", b, a, &changes)
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Field < changes[j].Field })
+	return changes, nil
+}
+
+func toBSONDoc(v interface{}) (bson.M, error) {
+	if v == nil || reflect.ValueOf(v).Kind() == reflect.Ptr && reflect.ValueOf(v).IsNil() {
+		return bson.M{}, nil
+	}
+	if doc, ok := v.(bson.M); ok {
+		return doc, nil
+	}
+	raw, err := bson.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	doc := bson.M{}
+	return doc, bson.Unmarshal(raw, &doc)
+}
+
+// diffDocs recurses into embedded documents; arrays such as Images are compared as a whole
+func diffDocs(prefix string, before, after bson.M, changes *[]fieldChange) {
+	for key, bv := range before {
+		av, ok := after[key]
+		if !ok {
+			*changes = append(*changes, fieldChange{Field: prefix + key, Before: bv})
+			continue
+		}
+		bDoc, bIsDoc := bv.(bson.M)
+		aDoc, aIsDoc := av.(bson.M)
+		if bIsDoc && aIsDoc {
+			diffDocs(prefix+key+".", bDoc, aDoc, changes)
+			continue
+		}
+		if !reflect.DeepEqual(bv, av) {
+			*changes = append(*changes, fieldChange{Field: prefix + key, Before: bv, After: av})
+		}
+	}
+	for key, av := range after {
+		if _, ok := before[key]; !ok {
+			*changes = append(*changes, fieldChange{Field: prefix + key, After: av})
+		}
+	}
+}
+
+// getAuditLog pages through audit entries, newest first. Filters: collection, document_id; page from 1, limit up to 200 (default 50).
+func getAuditLog(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	q := r.URL.Query()
+	page, limit := 1, 50
+	if raw := q.Get("page"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 {
+			http.Error(w, "page must be a positive whole number", http.StatusBadRequest)
+			return
+		}
+		page = n
+	}
+	if raw := q.Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > 200 {
+			http.Error(w, "limit must be between 1 and 200", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	filter := bson.M{}
+	if c := q.Get("collection"); c != "" {
+		filter["collection"] = c
+	}
+	if id := q.Get("document_id"); id != "" {
+		filter["document_id"] = id
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	collection := client.Database("MVDB").Collection("audit_logs")
+	total, err := collection.CountDocuments(ctx, filter)
+	if err != nil {
+		serverError(w, r, "Failed to count audit entries", err)
+		return
+	}
+	opts := options.Find().
+		SetSort(bson.D{{Key: "created_at", Value: -1}, {Key: "_id", Value: -1}}).
+		SetSkip(int64((page - 1) * limit)).
+		SetLimit(int64(limit))
+	entries, err := findAllWith[AuditEntry](ctx, collection.Name(), filter, opts)
+	if err != nil {
+		serverError(w, r, "Failed to retrieve audit entries", err)
+		return
+	}
+	json.NewEncoder(w).Encode(bson.M{"entries": entries, "page": page, "limit": limit, "total": total})
+}
+
+// auditCreated records a create; id is the InsertedID returned by Mongo
+func auditCreated(meta auditMeta, collectionName string, id interface{}, doc interface{}) {
+	documentID := ""
+	if oid, ok := id.(primitive.ObjectID); ok {
+		documentID = oid.Hex()
+	}
+	recordAudit(meta, "create", collectionName, documentID, nil, doc, nil)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/LynnT-2003/mv-realty-backend/imagemeta"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func changedFields(changes []fieldChange) []string {
+	fields := make([]string, len(changes))
+	for i, c := range changes {
+		fields[i] = c.Field
+	}
+	return fields
+}
+
+// TestAuditDiffImages: Images is an array, so any change to it is one change holding both the old
+// and the new array rather than a path per image
+func TestAuditDiffImages(t *testing.T) {
+	cover := imagemeta.Image{URL: "https://cdn.example.com/cover.jpg", Caption: "Pool"}
+	lobby := imagemeta.Image{URL: "https://cdn.example.com/lobby.jpg", Caption: "Lobby"}
+	before := Property{ID: primitive.NewObjectID(), Title: "Noble", Images: []imagemeta.Image{cover, lobby}}
+
+	recaptioned := before
+	recaptioned.Images = []imagemeta.Image{cover, {URL: lobby.URL, Caption: "Entrance"}}
+	changes, err := auditDiff(before, recaptioned)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || changes[0].Field != "images" {
+		t.Fatalf("changes %v, want only images", changedFields(changes))
+	}
+	b, a := changes[0].Before.(bson.A), changes[0].After.(bson.A)
+	if len(b) != 2 || len(a) != 2 {
+		t.Fatalf("images before %v, after %v, want both whole arrays", b, a)
+	}
+	if caption := a[1].(bson.M)["caption"]; caption != "Entrance" {
+		t.Errorf("new caption %v", caption)
+	}
+	if caption := b[1].(bson.M)["caption"]; caption != "Lobby" {
+		t.Errorf("old caption %v", caption)
+	}
+
+	reordered := before
+	reordered.Images = []imagemeta.Image{lobby, cover}
+	if changes, _ := auditDiff(before, reordered); !reflect.DeepEqual(changedFields(changes), []string{"images"}) {
+		t.Errorf("reordering: %v", changedFields(changes))
+	}
+	added := before
+	added.Images = append([]imagemeta.Image{}, cover, lobby, cover)
+	if changes, _ := auditDiff(before, added); !reflect.DeepEqual(changedFields(changes), []string{"images"}) {
+		t.Errorf("adding an image: %v", changedFields(changes))
+	}
+
+	// the _id never counts, and unchanged documents give an empty, non-nil list
+	same := before
+	same.ID = primitive.NewObjectID()
+	if changes, err := auditDiff(before, same); err != nil || changes == nil || len(changes) != 0 {
+		t.Errorf("no change: %v (%v)", changes, err)
+	}
+}
+
+func TestAuditDiffNestedDocuments(t *testing.T) {
+	before := Inquiry{Message: "Hi", Source: &inquirySource{UTMSource: "facebook", UTMCampaign: "spring"}}
+	after := Inquiry{Message: "Hi", Source: &inquirySource{UTMSource: "facebook", UTMCampaign: "summer", Referrer: "https://example.com"}}
+	changes, err := auditDiff(before, after)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []fieldChange{
+		{Field: "source.referrer", After: "https://example.com"},
+		{Field: "source.utm_campaign", Before: "spring", After: "summer"},
+	}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("changes %+v, want %+v", changes, want)
+	}
+
+	// a stored snapshot against a map, several levels deep
+	changes, err = auditDiff(
+		bson.M{"address": bson.M{"city": "Bangkok", "geo": bson.M{"lat": 13.7, "lng": 100.5}}, "floor": 3},
+		bson.M{"address": bson.M{"city": "Bangkok", "geo": bson.M{"lat": 13.8, "lng": 100.5}}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []fieldChange{
+		{Field: "address.geo.lat", Before: 13.7, After: 13.8},
+		{Field: "floor", Before: 3},
+	}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("changes %+v, want %+v", changes, want)
+	}
+
+	// a document replacing a scalar is one change, not a recursion
+	changes, _ = auditDiff(bson.M{"source": "walk-in"}, bson.M{"source": bson.M{"utm_source": "line"}})
+	if !reflect.DeepEqual(changedFields(changes), []string{"source"}) {
+		t.Errorf("scalar to document: %v", changedFields(changes))
+	}
+}
+
+func TestAuditDiffCreateAndPurge(t *testing.T) {
+	listing := Listing{ID: primitive.NewObjectID(), Price: 25000, ListingType: "rent"}
+	var none *Listing
+	created, err := auditDiff(none, listing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	purged, err := auditDiff(listing, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(created) == 0 || len(created) != len(purged) {
+		t.Fatalf("%d fields on create, %d on purge", len(created), len(purged))
+	}
+	for i := range created {
+		if created[i].Before != nil || purged[i].After != nil || created[i].Field != purged[i].Field {
+			t.Errorf("create %+v, purge %+v", created[i], purged[i])
+		}
+		if created[i].Field == "_id" {
+			t.Error("the _id was recorded as a change")
+		}
+	}
+}
+
+func TestAuditFromRequest(t *testing.T) {
+	useTestKeys(t)
+	cacheTestAPIKey(t, "partner-key")
+	for key, want := range map[string]string{"": "anonymous", "test-shared-key": "api_key", "partner-key": "api_key:partner-key"} {
+		var got auditMeta
+		handler := withAPIKeyIdentity(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { got = auditFromRequest(r) }))
+		req := httptest.NewRequest(http.MethodPost, "/listings", nil)
+		if key != "" {
+			req.Header.Set("X-API-Key", key)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		if got.Actor != want || got.IP != testClientIP {
+			t.Errorf("key %q: %+v, want actor %q from %s", key, got, want, testClientIP)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// apiKey is the shared secret expected in the X-API-Key header.
+// When it is empty (API_KEY not set) only the stored keys are accepted, so a missing variable
+// locks the API down rather than opening it. Partners get their own keys from the api_keys
+// collection, see api_keys.go.
+var apiKey string
+
+// Scopes of an API key. The scope a request needs follows from it, see requiredScope.
+const (
+	scopeRead   = "read"
+	scopeWrite  = "write"
+	scopeUpload = "upload"
+	scopeAdmin  = "admin"
+)
+
+var apiKeyScopes = []string{scopeRead, scopeWrite, scopeUpload, scopeAdmin}
+
+// apiKeyIdentity is who an X-API-Key belongs to
+type apiKeyIdentity struct {
+	ID     string // "" for the shared API_KEY
+	Name   string
+	Scopes []string
+}
+
+// sharedKeyIdentity is the shared API_KEY, which has every scope
+var sharedKeyIdentity = &apiKeyIdentity{Name: "API_KEY", Scopes: apiKeyScopes}
+
+type apiKeyIdentityKey struct{}
+
+// withAPIKeyIdentity resolves the X-API-Key once per request and keeps the identity in the context
+// for requireAPIKey, hasAPIKey and the audit log. Invalid keys are treated as no key; only
+// requireAPIKey turns them away.
+func withAPIKeyIdentity(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity := resolveAPIKey(r)
+		if identity == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		countAPIKeyUse(identity)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiKeyIdentityKey{}, identity)))
+	})
+}
+
+// callerKey is the identity of the request's X-API-Key, nil when it has none or it isn't valid
+func callerKey(r *http.Request) *apiKeyIdentity {
+	if identity := apiKeyFrom(r.Context()); identity != nil {
+		return identity
+	}
+	return resolveAPIKey(r)
+}
+
+// apiKeyFrom is the identity withAPIKeyIdentity stored in ctx, nil when it stored none. The GraphQL
+// resolvers, which only have the context, check scopes with it.
+func apiKeyFrom(ctx context.Context) *apiKeyIdentity {
+	identity, _ := ctx.Value(apiKeyIdentityKey{}).(*apiKeyIdentity)
+	return identity
+}
+
+func resolveAPIKey(r *http.Request) *apiKeyIdentity {
+	key := r.Header.Get("X-API-Key")
+	if key == "" {
+		return nil
+	}
+	if apiKey != "" && subtle.ConstantTimeCompare([]byte(key), []byte(apiKey)) == 1 {
+		return sharedKeyIdentity
+	}
+	return lookupAPIKey(r.Context(), key)
+}
+
+// hasAPIKey reports whether the request carries the shared key or an active stored one
+func hasAPIKey(r *http.Request) bool {
+	return callerKey(r) != nil
+}
+
+// adminRoutes need the admin scope outside /admin/: the user directory, inquiries and appointments
+// (which carry the users' contact details), the metrics and minting tokens, keyed by
+// "METHOD /path/template" as registered on the router
+var adminRoutes = map[string]bool{
+	"GET /users":                 true,
+	"GET /users/{id}":            true,
+	"GET /users/getUserByEmail":  true,
+	"GET /check/user":            true,
+	"GET /inquiries":             true,
+	"GET /inquiries/{id}":        true,
+	"GET /agents/{id}/inquiries": true,
+	"GET /appointments":          true,
+	"GET /appointments/{id}":     true,
+	"GET /metrics":               true,
+	"POST /agents/{id}/token":    true,
+	"POST /users/{id}/token":     true,
+}
+
+// requiredScope is admin under /admin/ and for adminRoutes, read for GET and HEAD, upload for
+// multipart bodies (images, floor plans, documents, CSV imports) and write for anything else
+func requiredScope(r *http.Request) string {
+	var route string
+	if current := mux.CurrentRoute(r); current != nil {
+		route, _ = current.GetPathTemplate()
+	}
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/admin/") || adminRoutes[r.Method+" "+route]:
+		return scopeAdmin
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		return scopeRead
+	case strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data"):
+		return scopeUpload
+	}
+	return scopeWrite
+}
+
+// requireAPIKey rejects requests that don't carry a valid X-API-Key (401, code unauthorized) or whose
+// key lacks the scope of the request (403, code forbidden)
+func requireAPIKey(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity := callerKey(r)
+		if identity == nil {
+			jsonError(w, http.StatusUnauthorized, "unauthorized", "Invalid or missing API key")
+			return
+		}
+		if scope := requiredScope(r); !isOneOf(scope, identity.Scopes) {
+			jsonError(w, http.StatusForbidden, "forbidden", "This API key lacks the "+scope+" scope")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// publicRoutes answer without an API key or token. Every other route must turn anonymous requests
+// away before its handler runs, so a route added without auth fails TestAnonymousRequestsRefused
+// until it is listed here.
+var publicRoutes = map[string]bool{
+	// the public site
+	"GET /agents":                          true,
+	"GET /agents/{id}":                     true,
+	"GET /agents/{id}/listings":            true,
+	"GET /developers":                      true,
+	"GET /developers/{id}":                 true,
+	"GET /developers/{id}/properties":      true,
+	"GET /l/{code}":                        true,
+	"GET /listings":                        true,
+	"GET /listings/batch":                  true,
+	"GET /listings/featured":               true,
+	"GET /listings/filter-bounds":          true,
+	"GET /listings/new":                    true,
+	"GET /listings/tags":                   true,
+	"GET /listings/{idOrSlug}":             true,
+	"GET /listings/{id}/available-slots":   true,
+	"GET /listings/{id}/booked-times":      true,
+	"GET /listings/{id}/brochure.pdf":      true,
+	"GET /listings/{id}/price-history":     true,
+	"GET /listings/{id}/qr.png":            true,
+	"GET /listings/{id}/similar":           true,
+	"GET /properties":                      true,
+	"GET /properties/batch":                true,
+	"GET /properties/popular":              true,
+	"GET /properties/{idOrSlug}":           true,
+	"GET /properties/{id}/activity":        true,
+	"GET /properties/{id}/full":            true,
+	"GET /properties/{id}/map.png":         true,
+	"GET /properties/{id}/stack":           true,
+	"GET /stats/listings/price-by-bedroom": true,
+	"GET /stats/listings/price-histogram":  true,
+	"GET /stats/properties/engagement":     true,
+	"GET /stats/timeseries":                true,
+	"GET /sync/listings":                   true,
+	"GET /sync/properties":                 true,
+	"GET /transit/stations":                true,
+	"POST /properties/search/polygon":      true,
+	"POST /properties/{id}/view":           true,
+
+	// forms and sign-up
+	"POST /add/appointment":        true,
+	"POST /add/inquiry":            true,
+	"POST /add/listing":            true,
+	"POST /add/properties":         true,
+	"POST /add/property":           true,
+	"POST /add/user":               true,
+	"POST /contact":                true,
+	"PUT /users":                   true,
+	"POST /properties/{id}/images": true,
+
+	// signed links from emails
+	"GET /appointments/cancel":         true,
+	"POST /appointments/cancel":        true,
+	"GET /appointments/confirm":        true,
+	"POST /appointments/confirm":       true,
+	"GET /saved-searches/unsubscribe":  true,
+	"POST /saved-searches/unsubscribe": true,
+
+	// the listing's agent token or the API key, checked by the handler once it has the listing
+	"GET /listings/{id}/verification":          true,
+	"POST /listings/{id}/request-verification": true,
+
+	"GET /docs":         true,
+	"GET /healthz":      true,
+	"GET /openapi.json": true,
+}
+
+// routeVar matches the {name} and {name:pattern} variables of a path template
+var routeVar = regexp.MustCompile(`\{[^}]+\}`)
+
+// registeredRoutes are the "METHOD /template" of the router, sorted
+func registeredRoutes(t *testing.T, r *mux.Router) []string {
+	t.Helper()
+	var routes []string
+	r.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		tmpl, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		methods, _ := route.GetMethods()
+		for _, method := range methods {
+			routes = append(routes, method+" "+tmpl)
+		}
+		return nil
+	})
+	sort.Strings(routes)
+	return routes
+}
+
+// serveRoute sends a request with header to route, an id in every path variable, and returns the
+// status, or 0 when the request reached a handler that needs Mongo
+func serveRoute(handler http.Handler, route string, header http.Header) (status int) {
+	method, tmpl, _ := strings.Cut(route, " ")
+	// a handler let through by mistake may stream, like GET /events/stream, until its context ends
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	req := httptest.NewRequest(method, routeVar.ReplaceAllString(tmpl, "0123456789abcdef01234567"), nil).WithContext(ctx)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	rec := httptest.NewRecorder()
+	defer func() {
+		if recover() != nil {
+			status = 0
+		}
+	}()
+	handler.ServeHTTP(rec, req)
+	return rec.Code
+}
+
+// TestAnonymousRequestsRefused walks every route, with and without a shared API_KEY configured
+func TestAnonymousRequestsRefused(t *testing.T) {
+	skipMaintenanceLookup(t)
+	for _, shared := range []string{"test-shared-key", ""} {
+		t.Run(fmt.Sprintf("API_KEY=%q", shared), func(t *testing.T) {
+			useTestKeys(t)
+			apiKey = shared
+			r := router()
+			for _, route := range registeredRoutes(t, r) {
+				if publicRoutes[route] {
+					continue
+				}
+				if status := serveRoute(r, route, nil); status != http.StatusUnauthorized {
+					t.Errorf("anonymous %s: status %d, want 401", route, status)
+				}
+			}
+		})
+	}
+}
+
+// TestAdminRoutesNeedAdminScope sends every admin route a key with all the other scopes
+func TestAdminRoutesNeedAdminScope(t *testing.T) {
+	skipMaintenanceLookup(t)
+	skipLoginThrottle(t)
+	useTestKeys(t)
+	cacheTestAPIKey(t, "partner-all-but-admin", scopeRead, scopeWrite, scopeUpload)
+	r := router()
+	header := http.Header{"X-Api-Key": {"partner-all-but-admin"}}
+	checked := 0
+	for _, route := range registeredRoutes(t, r) {
+		_, tmpl, _ := strings.Cut(route, " ")
+		if !strings.HasPrefix(tmpl, "/admin/") && !adminRoutes[route] {
+			continue
+		}
+		checked++
+		if status := serveRoute(r, route, header); status != http.StatusForbidden {
+			t.Errorf("%s without the admin scope: status %d, want 403", route, status)
+		}
+	}
+	for route := range adminRoutes {
+		if !slices.Contains(registeredRoutes(t, r), route) {
+			t.Errorf("adminRoutes lists %s, which isn't routed", route)
+		}
+	}
+	if checked < len(adminRoutes) {
+		t.Errorf("checked %d admin routes", checked)
+	}
+}
+
+func TestRequireAPIKeyScopes(t *testing.T) {
+	useTestKeys(t)
+	cacheTestAPIKey(t, "partner-read", scopeRead)
+	cacheTestAPIKey(t, "partner-admin", scopeAdmin)
+	cacheAPIKeyLookup(t, "not-a-key", nil)
+	handler := stubRouter(requireAPIKey,
+		"GET /users",
+		"GET /users/{id}",
+		"GET /inquiries",
+		"GET /inquiries/{id}",
+		"GET /agents/{id}/inquiries",
+		"GET /appointments",
+		"GET /appointments/{id}",
+		"GET /metrics",
+		"POST /agents/{id}/token",
+		"GET /listings/{id}/waitlist",
+		"PUT /listings/{id}",
+	)
+	tests := []struct {
+		route, key string
+		want       int
+	}{
+		{"GET /users", "", http.StatusUnauthorized},
+		{"GET /users", "not-a-key", http.StatusUnauthorized},
+		{"GET /users", "partner-read", http.StatusForbidden},
+		{"GET /users", "partner-admin", http.StatusOK},
+		{"GET /users", "test-shared-key", http.StatusOK},
+		{"GET /users/{id}", "partner-read", http.StatusForbidden},
+		{"GET /users/{id}", "partner-admin", http.StatusOK},
+		{"GET /inquiries", "partner-read", http.StatusForbidden},
+		{"GET /inquiries", "partner-admin", http.StatusOK},
+		{"GET /inquiries/{id}", "partner-read", http.StatusForbidden},
+		{"GET /inquiries/{id}", "partner-admin", http.StatusOK},
+		{"GET /agents/{id}/inquiries", "partner-read", http.StatusForbidden},
+		{"GET /agents/{id}/inquiries", "partner-admin", http.StatusOK},
+		{"GET /appointments", "", http.StatusUnauthorized},
+		{"GET /appointments", "partner-read", http.StatusForbidden},
+		{"GET /appointments", "partner-admin", http.StatusOK},
+		{"GET /appointments/{id}", "partner-read", http.StatusForbidden},
+		{"GET /appointments/{id}", "test-shared-key", http.StatusOK},
+		{"GET /metrics", "partner-read", http.StatusForbidden},
+		{"POST /agents/{id}/token", "partner-read", http.StatusForbidden},
+		{"POST /agents/{id}/token", "partner-admin", http.StatusOK},
+		{"GET /listings/{id}/waitlist", "partner-read", http.StatusOK},
+		{"PUT /listings/{id}", "partner-read", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		var header http.Header
+		if tt.key != "" {
+			header = http.Header{"X-Api-Key": {tt.key}}
+		}
+		if status := serveRoute(handler, tt.route, header); status != tt.want {
+			t.Errorf("%s with key %q: status %d, want %d", tt.route, tt.key, status, tt.want)
+		}
+	}
+}
+
+// TestRequireAPIKeyErrorBodies: the 401 and 403 are JSON with a code, like the other middleware errors
+func TestRequireAPIKeyErrorBodies(t *testing.T) {
+	useTestKeys(t)
+	cacheTestAPIKey(t, "partner-read", scopeRead)
+	handler := stubRouter(requireAPIKey, "GET /users/{id}")
+	for _, tt := range []struct {
+		key, code, message string
+		status             int
+	}{
+		{"", "unauthorized", "Invalid or missing API key", http.StatusUnauthorized},
+		{"partner-read", "forbidden", "This API key lacks the admin scope", http.StatusForbidden},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/users/0123456789abcdef01234567", nil)
+		if tt.key != "" {
+			req.Header.Set("X-API-Key", tt.key)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		var body struct{ Error, Code string }
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatalf("key %q: %v in %q", tt.key, err, rec.Body)
+		}
+		if rec.Code != tt.status || rec.Header().Get("Content-Type") != "application/json" || body.Code != tt.code || body.Error != tt.message {
+			t.Errorf("key %q: %d %s %+v", tt.key, rec.Code, rec.Header().Get("Content-Type"), body)
+		}
+	}
+}
+
+// TestRequireAPIKeyWithoutSharedKey checks an unset API_KEY refuses requests instead of letting
+// them all through, while the stored keys keep working
+func TestRequireAPIKeyWithoutSharedKey(t *testing.T) {
+	useTestKeys(t)
+	apiKey = ""
+	cacheTestAPIKey(t, "partner-write", scopeRead, scopeWrite)
+	handler := stubRouter(requireAPIKey, "PUT /listings/{id}")
+	if status := serveRoute(handler, "PUT /listings/{id}", nil); status != http.StatusUnauthorized {
+		t.Errorf("anonymous: status %d, want 401", status)
+	}
+	if status := serveRoute(handler, "PUT /listings/{id}", http.Header{"X-Api-Key": {""}}); status != http.StatusUnauthorized {
+		t.Errorf("empty key: status %d, want 401", status)
+	}
+	if status := serveRoute(handler, "PUT /listings/{id}", http.Header{"X-Api-Key": {"partner-write"}}); status != http.StatusOK {
+		t.Errorf("stored key: status %d, want 200", status)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// backfillDefault is a value written to documents where the field is missing or null
+type backfillDefault struct {
+	collection string
+	field      string
+	value      interface{}
+}
+
+// backfillDefaults are the fields newer code expects on every document
+var backfillDefaults = []backfillDefault{
+	{"listings", "listing_status", "active"},
+	{"listings", "photos", bson.A{}},
+	{"listings", "featured", false},
+	{"listings", "currency", defaultCurrency},
+	{"listings", "publication_state", publicationPublished},
+	// an expression, evaluated per document by the update pipeline
+	{"listings", "expires_at", bson.M{"$add": bson.A{"$created_at", listingLifetime.Milliseconds()}}},
+	{"properties", "images", bson.A{}},
+	{"properties", "facilities", bson.A{}},
+	{"properties", "views", 0},
+	{"appointments", "status", "scheduled"},
+}
+
+// backfillMissingFields is `migrate backfill [--dry-run]`. It fills each default with an update pipeline
+// ($ifNull, so a value written concurrently is never overwritten) and logs the count per collection
+// and field; --dry-run only counts the documents that would change.
+func backfillMissingFields(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("backfill", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "only count the documents that would be updated")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	db := client.Database("MVDB")
+	totals := map[string]int64{}
+	var order []string
+	for _, d := range backfillDefaults {
+		filter := bson.M{d.field: nil}
+		var n int64
+		if *dryRun {
+			count, err := db.Collection(d.collection).CountDocuments(ctx, filter)
+			if err != nil {
+				return fmt.Errorf("%s.%s: %w", d.collection, d.field, err)
+			}
+			n = count
+		} else {
+			res, err := db.Collection(d.collection).UpdateMany(ctx, filter, bson.A{
+				bson.M{"$set": bson.M{d.field: bson.M{"$ifNull": bson.A{"$" + d.field, d.value}}}},
+			})
+			if err != nil {
+				return fmt.Errorf("%s.%s: %w", d.collection, d.field, err)
+			}
+			n = res.ModifiedCount
+		}
+		log.Printf("%s.%s: %d documents", d.collection, d.field, n)
+		if _, seen := totals[d.collection]; !seen {
+			order = append(order, d.collection)
+		}
+		totals[d.collection] += n
+	}
+
+	verb := "updated"
+	if *dryRun {
+		verb = "would update"
+	}
+	for _, c := range order {
+		log.Printf("%s: %s %d field values", c, verb, totals[c])
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func findRaw(t *testing.T, collectionName string, id primitive.ObjectID) bson.M {
+	t.Helper()
+	var doc bson.M
+	if err := client.Database("MVDB").Collection(collectionName).FindOne(context.Background(), bson.M{"_id": id}).Decode(&doc); err != nil {
+		t.Fatalf("%s %s: %v", collectionName, id.Hex(), err)
+	}
+	return doc
+}
+
+// TestBackfillMissingFields seeds documents written before the fields existed: --dry-run leaves them
+// alone, the backfill fills the defaults without touching values that are set, and a second run changes nothing
+func TestBackfillMissingFields(t *testing.T) {
+	useTestMongo(t, "listings", "properties", "appointments")
+	ctx := context.Background()
+	created := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	oldListing, soldListing := primitive.NewObjectID(), primitive.NewObjectID()
+	oldProperty, nullImages := primitive.NewObjectID(), primitive.NewObjectID()
+	oldAppointment := primitive.NewObjectID()
+	insertDocs(t, "listings",
+		bson.M{"_id": oldListing, "property_id": "p1", "price": 25000, "created_at": created},
+		bson.M{"_id": soldListing, "property_id": "p1", "listing_status": "sold", "currency": "USD", "photos": bson.A{"a.jpg"}, "created_at": created},
+	)
+	insertDocs(t, "properties",
+		bson.M{"_id": oldProperty, "title": "Old"},
+		bson.M{"_id": nullImages, "title": "Null images", "images": nil, "views": 12},
+	)
+	insertDocs(t, "appointments", bson.M{"_id": oldAppointment, "user_id": "u1", "appointment_date": created})
+
+	if err := backfillMissingFields(ctx, []string{"--dry-run"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := findRaw(t, "listings", oldListing)["listing_status"]; ok {
+		t.Fatal("--dry-run wrote listing_status")
+	}
+
+	if err := backfillMissingFields(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	l := findRaw(t, "listings", oldListing)
+	if l["listing_status"] != "active" || l["currency"] != defaultCurrency || l["featured"] != false ||
+		l["publication_state"] != publicationPublished || len(l["photos"].(bson.A)) != 0 {
+		t.Errorf("old listing: %v", l)
+	}
+	if expires, ok := l["expires_at"].(primitive.DateTime); !ok || !expires.Time().Equal(created.Add(listingLifetime)) {
+		t.Errorf("old listing expires_at %v, want %v", l["expires_at"], created.Add(listingLifetime))
+	}
+	if s := findRaw(t, "listings", soldListing); s["listing_status"] != "sold" || s["currency"] != "USD" || len(s["photos"].(bson.A)) != 1 {
+		t.Errorf("set values were overwritten: %v", s)
+	}
+	for _, id := range []primitive.ObjectID{oldProperty, nullImages} {
+		p := findRaw(t, "properties", id)
+		if images, ok := p["images"].(bson.A); !ok || len(images) != 0 {
+			t.Errorf("property %v: images %v", p["title"], p["images"])
+		}
+		if facilities, ok := p["facilities"].(bson.A); !ok || len(facilities) != 0 {
+			t.Errorf("property %v: facilities %v", p["title"], p["facilities"])
+		}
+	}
+	if views := findRaw(t, "properties", nullImages)["views"]; views != int32(12) {
+		t.Errorf("views overwritten: %v", views)
+	}
+	var p Property
+	if err := client.Database("MVDB").Collection("properties").FindOne(ctx, bson.M{"_id": oldProperty}).Decode(&p); err != nil || p.Images == nil {
+		t.Errorf("decoded property: images %v, %v", p.Images, err)
+	}
+	if a := findAppointment(t, oldAppointment); a.Status != "scheduled" {
+		t.Errorf("appointment status %q", a.Status)
+	}
+
+	before := findRaw(t, "listings", oldListing)
+	if err := backfillMissingFields(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	if after := findRaw(t, "listings", oldListing); after["expires_at"] != before["expires_at"] || after["listing_status"] != before["listing_status"] {
+		t.Errorf("a second run changed %v to %v", before, after)
+	}
+}
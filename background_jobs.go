@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/LynnT-2003/mv-realty-backend/jobs"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	jobInquiryEmail = "inquiry_email" // job types, each with its handler registered in setupJobs
+
+	defaultJobWorkers = 2
+	doneJobTTL        = 7 * 24 * time.Hour
+)
+
+var jobQueue *jobs.Queue
+
+// setupJobs registers the job handlers and starts JOB_WORKERS (default 2) workers on the jobs
+// collection. With 0 jobs are still queued, for other instances to run.
+func setupJobs() {
+	jobQueue = jobs.New(client.Database("MVDB").Collection("jobs"))
+	jobQueue.Register(jobInquiryEmail, sendInquiryEmail)
+	jobQueue.Register(jobConsistencyReport, runConsistencyReport)
+
+	workers := defaultJobWorkers
+	if raw := os.Getenv("JOB_WORKERS"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			log.Fatal("JOB_WORKERS must be a whole number")
+		}
+		workers = n
+	}
+	jobQueue.Start(workers)
+}
+
+// drainJobs lets running jobs finish on shutdown, for as long as in-flight requests get
+func drainJobs() {
+	if jobQueue == nil {
+		return // shut down before startup was done
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := jobQueue.Drain(ctx); err != nil {
+		log.Println("Jobs still running at shutdown are left to other workers:", err)
+	}
+}
+
+// enqueueJob queues a job to run now. Like recordAudit it only logs on failure, the write that
+// asked for it has already happened.
+func enqueueJob(ctx context.Context, jobType string, payload interface{}) {
+	if jobQueue == nil {
+		return // commands other than serve
+	}
+	if _, err := jobQueue.Enqueue(ctx, jobType, payload, time.Time{}); err != nil {
+		log.Println("Failed to queue", jobType, "job:", err)
+	}
+}
+
+// inquiryEmailJob is the payload of an inquiry_email job
+type inquiryEmailJob struct {
+	InquiryID string `json:"inquiry_id"`
+}
+
+var inquiryEmail = template.Must(template.New("inquiry").Parse(`<!DOCTYPE html>
+<html>
+<body style="font-family: sans-serif">
+<p>You have a new inquiry about <strong>{{.Property}}</strong>.</p>
+<blockquote style="border-left: 3px solid #ccc; margin: 0; padding-left: 1em">{{.Message}}</blockquote>
+<p>From {{.Name}}{{if .Email}}, <a href="mailto:{{.Email}}">{{.Email}}</a>{{end}}{{if .Phone}}, {{.Phone}}{{end}}</p>
+</body>
+</html>
+`))
+
+// sendInquiryEmail tells the agent an inquiry was assigned to them. An inquiry, agent or user that is
+// gone by the time the job runs ends the job; only failures to read or send are retried.
+func sendInquiryEmail(ctx context.Context, payload json.RawMessage) error {
+	var p inquiryEmailJob
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return err
+	}
+	id, err := primitive.ObjectIDFromHex(p.InquiryID)
+	if err != nil {
+		return err
+	}
+	var inquiry Inquiry
+	err = client.Database("MVDB").Collection("inquiries").FindOne(ctx, notDeleted(bson.M{"_id": id})).Decode(&inquiry)
+	if err == mongo.ErrNoDocuments {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	agent, err := listingAgent(ctx, inquiry.AgentID)
+	if err != nil || agent == nil || agent.Email == "" {
+		return err
+	}
+
+	var property Property
+	if propertyID, err := primitive.ObjectIDFromHex(inquiry.Property_id); err == nil {
+		err = client.Database("MVDB").Collection("properties").FindOne(ctx, bson.M{"_id": propertyID},
+			options.FindOne().SetProjection(bson.M{"title": 1})).Decode(&property)
+		if err != nil && err != mongo.ErrNoDocuments {
+			return err
+		}
+	}
+	var user User
+	if userID, err := primitive.ObjectIDFromHex(inquiry.User_id); err == nil {
+		err = client.Database("MVDB").Collection("users").FindOne(ctx, bson.M{"_id": userID}).Decode(&user)
+		if err != nil && err != mongo.ErrNoDocuments {
+			return err
+		}
+	}
+	if user.Name == "" {
+		user.Name = "a visitor"
+	}
+
+	var buf bytes.Buffer
+	if err := inquiryEmail.Execute(&buf, struct {
+		Property, Message, Name, Email, Phone string
+	}{property.Title, inquiry.Message, user.Name, user.Email, user.Phone}); err != nil {
+		return err
+	}
+	return mailer.Send(ctx, agent.Email, "New inquiry: "+property.Title, buf.String())
+}
+
+// getJobs answers GET /admin/jobs, newest first, optionally of one status and type
+func getJobs(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	page, ok := parseListPage(w, r)
+	if !ok {
+		return
+	}
+	status := r.URL.Query().Get("status")
+	if status != "" && !isOneOf(status, jobs.Statuses) {
+		http.Error(w, "status must be one of queued, running, done, dead", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	list, err := jobQueue.List(ctx, status, r.URL.Query().Get("type"), page.Skip, page.Limit)
+	if err != nil {
+		serverError(w, r, "Failed to retrieve jobs", err)
+		return
+	}
+	json.NewEncoder(w).Encode(list)
+}
+
+// retryJob answers POST /admin/jobs/{id}/retry, queueing a dead job to run again now
+func retryJob(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	id, ok := pathObjectID(w, r, "job")
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	job, err := jobQueue.Retry(ctx, id)
+	if errors.Is(err, jobs.ErrNotFound) {
+		http.Error(w, "Dead job not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		serverError(w, r, "Failed to retry job", err)
+		return
+	}
+	recordAudit(auditFromRequest(r), "retry", "jobs", id.Hex(), nil, nil, bson.M{"type": job.Type})
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job)
+}
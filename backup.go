@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// A backup is one <collection>.ndjson file per collection, each line a document in canonical
+// extended JSON so ObjectIDs, dates and number types come back exactly, plus backup_manifest.json
+// listing the collections and their counts. It goes to a directory (-dir) or to S3-compatible
+// storage (-s3 bucket/prefix, see s3Client). With a single collection and no target, export writes
+// to stdout and import reads stdin.
+const (
+	backupManifestName   = "backup_manifest.json"
+	backupProgressEvery  = 10000
+	backupImportBatch    = 500
+	backupCommandTimeout = 6 * time.Hour
+)
+
+type backupManifest struct {
+	ExportedAt  time.Time        `json:"exported_at"`
+	Collections map[string]int64 `json:"collections"` // documents per collection
+}
+
+// backupTarget is where backup files are written to and read from
+type backupTarget interface {
+	create(ctx context.Context, name string) (io.WriteCloser, error)
+	open(ctx context.Context, name string) (io.ReadCloser, error)
+}
+
+type dirTarget string
+
+func (d dirTarget) create(ctx context.Context, name string) (io.WriteCloser, error) {
+	if err := os.MkdirAll(string(d), 0o755); err != nil {
+		return nil, err
+	}
+	return os.Create(filepath.Join(string(d), name))
+}
+
+func (d dirTarget) open(ctx context.Context, name string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(string(d), name))
+}
+
+type s3Target struct {
+	client *s3Client
+	bucket string
+	prefix string
+}
+
+func (t *s3Target) key(name string) string {
+	if t.prefix == "" {
+		return name
+	}
+	return t.prefix + "/" + name
+}
+
+// create spools to a temporary file, since the upload needs the length and hash up front
+func (t *s3Target) create(ctx context.Context, name string) (io.WriteCloser, error) {
+	f, err := os.CreateTemp("", "mvdb-export-*.ndjson")
+	if err != nil {
+		return nil, err
+	}
+	return &s3Upload{ctx: ctx, target: t, name: name, file: f, hash: sha256.New()}, nil
+}
+
+func (t *s3Target) open(ctx context.Context, name string) (io.ReadCloser, error) {
+	return t.client.get(ctx, t.bucket, t.key(name))
+}
+
+type s3Upload struct {
+	ctx    context.Context
+	target *s3Target
+	name   string
+	file   *os.File
+	hash   hash.Hash
+	size   int64
+}
+
+func (u *s3Upload) Write(p []byte) (int, error) {
+	u.hash.Write(p)
+	n, err := u.file.Write(p)
+	u.size += int64(n)
+	return n, err
+}
+
+// Close uploads the spooled file and removes it
+func (u *s3Upload) Close() error {
+	defer os.Remove(u.file.Name())
+	defer u.file.Close()
+	if _, err := u.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return u.target.client.put(u.ctx, u.target.bucket, u.target.key(u.name), u.file, u.size, hex.EncodeToString(u.hash.Sum(nil)))
+}
+
+// backupFlags adds -dir and -s3 to a command's flags; the returned func gives the chosen target, nil
+// for stdin/stdout
+func backupFlags(flags *flag.FlagSet) func() (backupTarget, error) {
+	dir := flags.String("dir", "", "directory holding the backup files")
+	s3 := flags.String("s3", "", "bucket/prefix on S3-compatible storage, see S3_ENDPOINT")
+	return func() (backupTarget, error) {
+		switch {
+		case *dir != "" && *s3 != "":
+			return nil, usageError("use either -dir or -s3")
+		case *dir != "":
+			return dirTarget(*dir), nil
+		case *s3 != "":
+			client, err := newS3ClientFromEnv()
+			if err != nil {
+				return nil, usageError(err.Error())
+			}
+			bucket, prefix, _ := strings.Cut(*s3, "/")
+			return &s3Target{client: client, bucket: bucket, prefix: strings.Trim(prefix, "/")}, nil
+		}
+		return nil, nil
+	}
+}
+
+// runExport is `export [-dir path | -s3 bucket/prefix] [-limit n] [collection]`. Without a
+// collection every collection is exported, which needs a target.
+func runExport(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	target := backupFlags(flags)
+	limit := flags.Int64("limit", 0, "export at most this many documents per collection, 0 for all")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	to, err := target()
+	if err != nil {
+		return err
+	}
+	if flags.NArg() > 1 || flags.NArg() == 0 && to == nil {
+		return usageError(fmt.Sprintf("usage: %s export [-dir path | -s3 bucket/prefix] [-limit n] [collection]\n"+
+			"a collection is required when writing to stdout", os.Args[0]))
+	}
+
+	connectMongoDB()
+	ctx, cancel := context.WithTimeout(context.Background(), backupCommandTimeout)
+	defer cancel()
+	db := client.Database("MVDB")
+
+	names, err := db.ListCollectionNames(ctx, bson.M{"name": bson.M{"$not": bson.M{"$regex": "^system\\."}}})
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+	if flags.NArg() == 1 {
+		name := flags.Arg(0)
+		if !isOneOf(name, names) {
+			return fmt.Errorf("no collection named %q", name)
+		}
+		names = []string{name}
+	}
+
+	if to == nil {
+		w := bufio.NewWriter(os.Stdout)
+		n, err := exportCollection(ctx, db.Collection(names[0]), w, *limit)
+		if err == nil {
+			err = w.Flush()
+		}
+		log.Println("Exported", n, "documents from", names[0])
+		return err
+	}
+
+	manifest := backupManifest{ExportedAt: time.Now().UTC(), Collections: map[string]int64{}}
+	for _, name := range names {
+		f, err := to.create(ctx, name+".ndjson")
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		w := bufio.NewWriter(f)
+		n, err := exportCollection(ctx, db.Collection(name), w, *limit)
+		if err == nil {
+			err = w.Flush()
+		}
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		log.Println("Exported", n, "documents from", name)
+		manifest.Collections[name] = n
+	}
+	// A single collection leaves the manifest alone, so it still describes the last full export
+	if flags.NArg() == 1 {
+		return nil
+	}
+	f, err := to.create(ctx, backupManifestName)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(manifest); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// exportCollection writes the collection in _id order, one canonical extended JSON document per line
+func exportCollection(ctx context.Context, collection *mongo.Collection, w io.Writer, limit int64) (int64, error) {
+	cur, err := collection.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetLimit(limit))
+	if err != nil {
+		return 0, err
+	}
+	defer cur.Close(ctx)
+
+	var n int64
+	for cur.Next(ctx) {
+		doc, err := bson.MarshalExtJSON(cur.Current, true, false)
+		if err != nil {
+			return n, fmt.Errorf("document %d: %w", n, err)
+		}
+		if _, err := w.Write(append(doc, '\n')); err != nil {
+			return n, err
+		}
+		if n++; n%backupProgressEvery == 0 {
+			log.Println(collection.Name()+":", n, "documents exported")
+		}
+	}
+	return n, cur.Err()
+}
+
+// runImport is `import [-dir path | -s3 bucket/prefix] [collection]`. Documents are upserted by _id,
+// so importing twice changes nothing and documents missing from the backup are kept. Without a
+// collection every collection in the manifest is imported.
+func runImport(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	target := backupFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	from, err := target()
+	if err != nil {
+		return err
+	}
+	if flags.NArg() > 1 || flags.NArg() == 0 && from == nil {
+		return usageError(fmt.Sprintf("usage: %s import [-dir path | -s3 bucket/prefix] [collection]\n"+
+			"a collection is required when reading stdin", os.Args[0]))
+	}
+
+	connectMongoDB()
+	ctx, cancel := context.WithTimeout(context.Background(), backupCommandTimeout)
+	defer cancel()
+	db := client.Database("MVDB")
+
+	if from == nil {
+		n, err := importCollection(ctx, db.Collection(flags.Arg(0)), os.Stdin)
+		log.Println("Imported", n, "documents into", flags.Arg(0))
+		return err
+	}
+
+	var names []string
+	expected := map[string]int64{}
+	if flags.NArg() == 1 {
+		names = []string{flags.Arg(0)}
+	} else {
+		f, err := from.open(ctx, backupManifestName)
+		if err != nil {
+			return fmt.Errorf("reading the manifest: %w", err)
+		}
+		var manifest backupManifest
+		err = json.NewDecoder(f).Decode(&manifest)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("reading the manifest: %w", err)
+		}
+		for name, n := range manifest.Collections {
+			names = append(names, name)
+			expected[name] = n
+		}
+		sort.Strings(names)
+		log.Println("Importing the export of", manifest.ExportedAt.Format(time.RFC3339))
+	}
+
+	for _, name := range names {
+		f, err := from.open(ctx, name+".ndjson")
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		n, err := importCollection(ctx, db.Collection(name), f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		log.Println("Imported", n, "documents into", name)
+		if want, ok := expected[name]; ok && want != n {
+			return fmt.Errorf("%s: the manifest lists %d documents but the file has %d", name, want, n)
+		}
+	}
+	return nil
+}
+
+// importCollection upserts the documents of an export in batches. Schema validation is bypassed,
+// a restore puts back documents as they were, including ones written before a validator existed.
+func importCollection(ctx context.Context, collection *mongo.Collection, r io.Reader) (int64, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024) // a BSON document is at most 16MB
+	opts := options.BulkWrite().SetOrdered(false).SetBypassDocumentValidation(true)
+
+	var n int64
+	var batch []mongo.WriteModel
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if _, err := collection.BulkWrite(ctx, batch, opts); err != nil {
+			return err
+		}
+		n += int64(len(batch))
+		if n/backupProgressEvery != (n-int64(len(batch)))/backupProgressEvery {
+			log.Println(collection.Name()+":", n, "documents imported")
+		}
+		batch = batch[:0]
+		return nil
+	}
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var doc bson.D
+		if err := bson.UnmarshalExtJSON(scanner.Bytes(), true, &doc); err != nil {
+			return n, fmt.Errorf("line %d: %w", line, err)
+		}
+		id, ok := docID(doc)
+		if !ok {
+			return n, fmt.Errorf("line %d: document has no _id", line)
+		}
+		batch = append(batch, mongo.NewReplaceOneModel().SetFilter(bson.M{"_id": id}).SetReplacement(doc).SetUpsert(true))
+		if len(batch) == backupImportBatch {
+			if err := flush(); err != nil {
+				return n, err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		if errors.Is(err, bufio.ErrTooLong) {
+			err = fmt.Errorf("a line is longer than 16MB")
+		}
+		return n, err
+	}
+	return n, flush()
+}
+
+func docID(doc bson.D) (interface{}, bool) {
+	for _, e := range doc {
+		if e.Key == "_id" {
+			return e.Value, true
+		}
+	}
+	return nil, false
+}
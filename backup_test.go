@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// fakeS3 stores PUT bodies by path after checking their declared hash, and serves them to GET
+func fakeS3(t *testing.T) *httptest.Server {
+	t.Helper()
+	var mu sync.Mutex
+	objects := map[string][]byte{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=test-access/") {
+			http.Error(w, "unsigned", http.StatusForbidden)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.Method {
+		case http.MethodPut:
+			body, _ := io.ReadAll(r.Body)
+			sum := sha256.Sum256(body)
+			if r.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(sum[:]) {
+				http.Error(w, "XAmzContentSHA256Mismatch", http.StatusBadRequest)
+				return
+			}
+			objects[r.URL.Path] = body
+		case http.MethodGet:
+			body, ok := objects[r.URL.Path]
+			if !ok {
+				http.Error(w, "NoSuchKey", http.StatusNotFound)
+				return
+			}
+			w.Write(body)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestS3TargetRoundTrip(t *testing.T) {
+	srv := fakeS3(t)
+	t.Setenv("S3_ENDPOINT", srv.URL)
+	t.Setenv("S3_ACCESS_KEY_ID", "test-access")
+	t.Setenv("S3_SECRET_ACCESS_KEY", "test-secret")
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	target := backupFlags(flags)
+	if err := flags.Parse([]string{"-s3", "backups/2024-03-01/"}); err != nil {
+		t.Fatal(err)
+	}
+	to, err := target()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key := to.(*s3Target).key("users.ndjson"); key != "2024-03-01/users.ndjson" {
+		t.Errorf("object key %q", key)
+	}
+
+	ctx := context.Background()
+	content := `{"_id":{"$oid":"0123456789abcdef01234567"},"email":"a@example.com"}` + "\n"
+	w, err := to.create(ctx, "users.ndjson")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, content)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := to.open(ctx, "users.ndjson")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := io.ReadAll(r)
+	r.Close()
+	if string(got) != content {
+		t.Errorf("read back %q", got)
+	}
+	if _, err := to.open(ctx, "listings.ndjson"); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("missing object: %v", err)
+	}
+}
+
+func TestBackupFlags(t *testing.T) {
+	t.Setenv("S3_ENDPOINT", "")
+	for _, args := range [][]string{
+		{"-dir", "/tmp/backup", "-s3", "bucket"},
+		{"-s3", "bucket"}, // no S3_ENDPOINT
+	} {
+		flags := flag.NewFlagSet("export", flag.ContinueOnError)
+		target := backupFlags(flags)
+		if err := flags.Parse(args); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := target(); err == nil {
+			t.Errorf("%v: no error", args)
+		}
+	}
+}
+
+// backupDocs are documents with every type a restore must bring back exactly
+func backupDocs() map[string][]bson.D {
+	created := primitive.NewDateTimeFromTime(time.Date(2024, 3, 1, 10, 30, 0, 123e6, time.UTC))
+	price, _ := primitive.ParseDecimal128("8500000.50")
+	docs := map[string][]bson.D{"properties": nil, "listings": nil}
+	for i := 0; i < backupImportBatch+3; i++ { // more than one import batch
+		docs["listings"] = append(docs["listings"], bson.D{
+			{Key: "_id", Value: primitive.NewObjectID()},
+			{Key: "price", Value: float64(25000 + i)},
+			{Key: "floor", Value: int32(i % 40)},
+			{Key: "views", Value: int64(1) << 40},
+			{Key: "created_at", Value: created},
+			{Key: "photos", Value: bson.A{bson.D{{Key: "url", Value: "https://cdn.example.com/a.jpg"}, {Key: "alt", Value: "ห้องนั่งเล่น"}}}},
+			{Key: "expires_at", Value: nil},
+		})
+	}
+	docs["properties"] = []bson.D{
+		{{Key: "_id", Value: primitive.NewObjectID()}, {Key: "title", Value: "Noble"}, {Key: "price", Value: price}, {Key: "coordinates", Value: bson.A{13.74, 100.55}}},
+		{{Key: "_id", Value: "legacy-string-id"}, {Key: "title", Value: "Old import"}},
+	}
+	return docs
+}
+
+// runBackupCommand runs export or import against the test database as the command line would
+func runBackupCommand(t *testing.T, run func([]string) error, args ...string) {
+	t.Helper()
+	testClient := client
+	t.Setenv("MONGODB_URI", os.Getenv("TEST_MONGODB_URI"))
+	err := run(args)
+	client.Disconnect(context.Background())
+	client = testClient
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestBackupRoundTrip exports seeded collections, drops them, imports the export and compares every
+// document byte for byte
+func TestBackupRoundTrip(t *testing.T) {
+	useTestMongo(t, "properties", "listings")
+	ctx := context.Background()
+	db := client.Database("MVDB")
+	seeded := backupDocs()
+	for name, docs := range seeded {
+		models := make([]interface{}, len(docs))
+		for i, d := range docs {
+			models[i] = d
+		}
+		if _, err := db.Collection(name).InsertMany(ctx, models); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dump := func() map[string][]bson.Raw {
+		out := map[string][]bson.Raw{}
+		for name := range seeded {
+			cur, err := db.Collection(name).Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for cur.Next(ctx) {
+				out[name] = append(out[name], append(bson.Raw{}, cur.Current...))
+			}
+			cur.Close(ctx)
+		}
+		return out
+	}
+	before := dump()
+
+	dir := t.TempDir()
+	runBackupCommand(t, runExport, "-dir", dir)
+	var manifest backupManifest
+	raw, err := os.ReadFile(filepath.Join(dir, backupManifestName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(raw, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	for name, docs := range seeded {
+		if manifest.Collections[name] != int64(len(docs)) {
+			t.Errorf("manifest lists %d %s, want %d", manifest.Collections[name], name, len(docs))
+		}
+	}
+	line, _ := os.ReadFile(filepath.Join(dir, "properties.ndjson"))
+	if !bytes.Contains(line, []byte(`"$oid"`)) || !bytes.Contains(line, []byte(`"$numberDecimal"`)) {
+		t.Errorf("the export isn't canonical extended JSON: %.200s", line)
+	}
+
+	for name := range seeded {
+		if err := db.Collection(name).Drop(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	runBackupCommand(t, runImport, "-dir", dir)
+	runBackupCommand(t, runImport, "-dir", dir) // upserts, so a second run changes nothing
+
+	after := dump()
+	for name := range seeded {
+		if len(after[name]) != len(before[name]) {
+			t.Errorf("%s: %d documents after the import, %d before", name, len(after[name]), len(before[name]))
+			continue
+		}
+		for i := range before[name] {
+			if !bytes.Equal(before[name][i], after[name][i]) {
+				t.Errorf("%s: document %d differs:\nbefore %s\nafter  %s", name, i, before[name][i], after[name][i])
+			}
+		}
+	}
+}
+
+// TestImportCollectionRejectsBadLines: a bad line stops the import before its batch is written
+func TestImportCollectionRejectsBadLines(t *testing.T) {
+	unreachableMongo(t)
+	collection := client.Database("MVDB").Collection("backup_test")
+	for input, want := range map[string]string{
+		`{"title":"no id"}`:                          "line 1: document has no _id",
+		"\n" + `{"_id":1}` + "\n" + `{"_id":2,"a":}`: "line 3:",
+	} {
+		_, err := importCollection(context.Background(), collection, strings.NewReader(input))
+		if err == nil || !strings.HasPrefix(err.Error(), want) {
+			t.Errorf("%q: %v, want %s", input, err, want)
+		}
+	}
+}
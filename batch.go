@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const maxBatchIDs = 100
+
+// batchIDsParam documents ?ids= on the batch endpoints
+var batchIDsParam = apiParam{Name: "ids", Description: "comma separated ObjectIDs, at most 100; the response has one entry per id, in order, null when not found"}
+
+// parseBatchIDs reads ?ids=; it answers 400 and returns false when it is empty, too long or has an
+// id that isn't an ObjectID
+func parseBatchIDs(w http.ResponseWriter, r *http.Request) ([]primitive.ObjectID, bool) {
+	raw := r.URL.Query().Get("ids")
+	if raw == "" {
+		http.Error(w, "ids is required", http.StatusBadRequest)
+		return nil, false
+	}
+	parts := strings.Split(raw, ",")
+	if len(parts) > maxBatchIDs {
+		http.Error(w, fmt.Sprintf("at most %d ids can be fetched at once", maxBatchIDs), http.StatusBadRequest)
+		return nil, false
+	}
+	var problems []string
+	ids := make([]primitive.ObjectID, len(parts))
+	for i, part := range parts {
+		id, err := primitive.ObjectIDFromHex(strings.TrimSpace(part))
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("ids[%d]: %q is not a valid ObjectID", i, part))
+			continue
+		}
+		ids[i] = id
+	}
+	if len(problems) > 0 {
+		http.Error(w, (&validationError{Problems: problems}).Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	return ids, true
+}
+
+// findInOrder fetches the documents with the given ids in one $in query and returns them in the
+// order of ids, nil where a document doesn't exist or doesn't match filter. Repeated ids repeat the
+// document.
+func findInOrder[T any](ctx context.Context, collectionName string, ids []primitive.ObjectID, filter bson.M, id func(*T) primitive.ObjectID, opts ...*options.FindOptions) ([]*T, error) {
+	filter["_id"] = bson.M{"$in": ids}
+	docs, err := findAllWith[T](ctx, collectionName, filter, opts...)
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[primitive.ObjectID]*T, len(docs))
+	for i := range docs {
+		byID[id(&docs[i])] = &docs[i]
+	}
+	results := make([]*T, len(ids))
+	for i, oid := range ids {
+		results[i] = byID[oid]
+	}
+	return results, nil
+}
+
+// getListingsBatch answers GET /listings/batch?ids=, for pages showing a known set of listings
+// (favorites, comparisons). Drafts and deleted listings come back as null, like missing ones,
+// unless the caller has the API key.
+func getListingsBatch(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	ids, ok := parseBatchIDs(w, r)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	filter := publishedListingsFilter(bson.M{})
+	if hasAPIKey(r) {
+		filter = notDeleted(bson.M{})
+	}
+	results, err := findInOrder(ctx, "listings", ids, filter, func(l *Listing) primitive.ObjectID { return l.ID })
+	if err != nil {
+		serverError(w, r, "Failed to retrieve Listings", err)
+		return
+	}
+	// The computed fields are filled on the found listings and copied back into place
+	var found []Listing
+	for _, l := range results {
+		if l != nil {
+			found = append(found, *l)
+		}
+	}
+	if err := applyFeeEstimates(ctx, found); err != nil {
+		serverError(w, r, "Failed to retrieve Property fees", err)
+		return
+	}
+	if !applyDisplayCurrency(w, r, found) || !applyUnits(w, r, found) {
+		return
+	}
+	if loc, ok := priceLocale(w, r); ok {
+		formatListingPrices(found, loc)
+	}
+	n := 0
+	for i := range results {
+		if results[i] != nil {
+			results[i] = &found[n]
+			n++
+		}
+	}
+	json.NewEncoder(w).Encode(results)
+}
+
+// getPropertiesBatch answers GET /properties/batch?ids=; deleted properties come back as null
+func getPropertiesBatch(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	ids, ok := parseBatchIDs(w, r)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	opts := options.Find()
+	if !includesPart(r, "documents") {
+		opts.SetProjection(bson.M{"documents": 0})
+	}
+	results, err := findInOrder(ctx, "properties", ids, notDeleted(bson.M{}), func(p *Property) primitive.ObjectID { return p.ID }, opts)
+	if err != nil {
+		serverError(w, r, "Failed to retrieve Properties", err)
+		return
+	}
+	if loc, ok := priceLocale(w, r); ok {
+		for _, p := range results {
+			if p != nil {
+				formatPropertyPrices(p, loc)
+			}
+		}
+	}
+	json.NewEncoder(w).Encode(results)
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/jpeg"
+	_ "image/png" // cover photos may be PNGs outside Cloudinary
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jung-kurt/gofpdf"
+	"github.com/skip2/go-qrcode"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+)
+
+// GET /listings/{id}/brochure.pdf is a one-page A4 brochure agents hand to clients: the property title,
+// cover photo, key specs, description, agent contact and the QR code of the listing page. The core PDF
+// fonts only cover Latin-1, so Thai text needs a TrueType font in BROCHURE_FONT_FILE. Brochures are
+// cached by the updated_at of the listing and its property, so an edit renders a new one.
+const (
+	brochureTimeout      = 20 * time.Second
+	brochureCacheSize    = 50
+	brochureCacheTTL     = 24 * time.Hour
+	brochureCacheCtl     = "public, max-age=300"
+	maxBrochurePhotoSize = 1200 // px wide; a JPEG this size keeps the PDF well under 2MB
+	maxBrochurePhotoDown = 15 << 20
+	brochureFontFamily   = "brochure"
+)
+
+var (
+	brochureCache  = newLRUCache(brochureCacheSize)
+	brochureClient = &http.Client{Timeout: 10 * time.Second}
+	brochurePrice  = message.NewPrinter(language.English)
+)
+
+// getListingBrochure answers GET /listings/{id}/brochure.pdf for published listings
+func getListingBrochure(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathObjectID(w, r, "Listing")
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), brochureTimeout)
+	defer cancel()
+
+	db := client.Database("MVDB")
+	var listing Listing
+	err := db.Collection("listings").FindOne(ctx, publishedListingsFilter(bson.M{"_id": id})).Decode(&listing)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Listing not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		serverError(w, r, "Failed to retrieve Listing", err)
+		return
+	}
+	var property Property
+	if propertyID, err := primitive.ObjectIDFromHex(listing.PropertyID); err == nil {
+		err = db.Collection("properties").FindOne(ctx, bson.M{"_id": propertyID}).Decode(&property)
+		if err != nil && err != mongo.ErrNoDocuments {
+			serverError(w, r, "Failed to retrieve Property", err)
+			return
+		}
+	}
+
+	filename := listing.Slug
+	if filename == "" {
+		filename = listing.ID.Hex()
+	}
+	key := fmt.Sprintf("%s:%d:%d", listing.ID.Hex(), listing.UpdatedAt.UnixNano(), property.UpdatedAt.UnixNano())
+	if cached, ok := brochureCache.Get(ctx, key); ok {
+		writeBrochure(w, filename, cached.Body)
+		return
+	}
+
+	agent, err := listingAgent(ctx, listing.AgentID)
+	if err != nil {
+		serverError(w, r, "Failed to retrieve Agent", err)
+		return
+	}
+	body, err := renderBrochure(ctx, &listing, &property, agent)
+	if err != nil {
+		serverError(w, r, "Failed to generate brochure", err)
+		return
+	}
+	brochureCache.Set(ctx, key, &cachedResponse{ContentType: "application/pdf", Body: body}, nil, brochureCacheTTL)
+	writeBrochure(w, filename, body)
+}
+
+func writeBrochure(w http.ResponseWriter, filename string, body []byte) {
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`inline; filename="%s.pdf"`, filename))
+	w.Header().Set("Cache-Control", brochureCacheCtl)
+	w.Write(body)
+}
+
+// brochurePDF wraps the document with the text handling of its font
+type brochurePDF struct {
+	*gofpdf.Fpdf
+	utf8      bool
+	translate func(string) string
+}
+
+func newBrochurePDF() *brochurePDF {
+	pdf := &brochurePDF{Fpdf: gofpdf.New("P", "mm", "A4", "")}
+	if path := os.Getenv("BROCHURE_FONT_FILE"); path != "" {
+		pdf.AddUTF8Font(brochureFontFamily, "", path)
+		pdf.AddUTF8Font(brochureFontFamily, "B", path)
+		if pdf.Ok() {
+			pdf.utf8 = true
+			return pdf
+		}
+		log.Println("Brochures use Helvetica, failed to load BROCHURE_FONT_FILE:", pdf.Error())
+		pdf.ClearError()
+	}
+	pdf.translate = pdf.UnicodeTranslatorFromDescriptor("")
+	return pdf
+}
+
+func (pdf *brochurePDF) font(style string, size float64) {
+	if pdf.utf8 {
+		pdf.SetFont(brochureFontFamily, style, size)
+		return
+	}
+	pdf.SetFont("Helvetica", style, size)
+}
+
+// latin1 replaces what Helvetica can't show; SplitText also indexes the font widths by rune
+func (pdf *brochurePDF) latin1(s string) string {
+	if pdf.utf8 {
+		return s
+	}
+	return strings.Map(func(r rune) rune {
+		if r > 0xff {
+			return '?'
+		}
+		return r
+	}, s)
+}
+
+func (pdf *brochurePDF) text(s string) string {
+	if pdf.utf8 {
+		return s
+	}
+	return pdf.translate(pdf.latin1(s))
+}
+
+// lines wraps s to width and keeps at most max lines, ending a cut text with "..."
+func (pdf *brochurePDF) lines(s string, width float64, max int) []string {
+	var lines []string
+	for _, paragraph := range strings.Split(pdf.latin1(strings.TrimSpace(s)), "\n") {
+		lines = append(lines, pdf.SplitText(paragraph, width)...)
+	}
+	if len(lines) > max {
+		lines = lines[:max]
+		lines[max-1] = strings.TrimRight(lines[max-1], " .,") + "..."
+	}
+	for i := range lines {
+		lines[i] = pdf.text(lines[i])
+	}
+	return lines
+}
+
+func renderBrochure(ctx context.Context, listing *Listing, property *Property, agent *agentContact) ([]byte, error) {
+	pdf := newBrochurePDF()
+	title := property.Title
+	if title == "" {
+		title = "Listing " + listing.ID.Hex()
+	}
+	pdf.SetTitle(title, true)
+	pdf.SetMargins(15, 15, 15)
+	pdf.SetAutoPageBreak(false, 0) // one page, the description is cut to fit
+	pdf.AddPage()
+	const left, width = 15.0, 180.0
+
+	pdf.font("B", 20)
+	pdf.SetXY(left, 15)
+	pdf.CellFormat(width, 10, pdf.text(title), "", 1, "L", false, 0, "")
+	pdf.font("", 12)
+	pdf.SetTextColor(90, 90, 90)
+	subtitle := "For sale"
+	if listing.ListingType == "rent" {
+		subtitle = "For rent"
+	}
+	if property.Developer != "" {
+		subtitle += " - " + property.Developer
+	}
+	pdf.CellFormat(width, 7, pdf.text(subtitle), "", 1, "L", false, 0, "")
+	pdf.SetTextColor(0, 0, 0)
+
+	y := 36.0
+	if photo := brochureCoverPhoto(listing, property); photo != "" {
+		if img, err := fetchBrochurePhoto(ctx, photo); err != nil {
+			log.Printf("Brochure of listing %s has no cover photo (request %s): %v", listing.ID.Hex(), requestID(ctx), err)
+		} else {
+			info := pdf.RegisterImageOptionsReader("cover", gofpdf.ImageOptions{ImageType: "JPG"}, bytes.NewReader(img))
+			if pdf.Ok() {
+				h := min(width*info.Height()/info.Width(), 110)
+				w := h * info.Width() / info.Height()
+				pdf.ImageOptions("cover", left+(width-w)/2, y, w, h, false, gofpdf.ImageOptions{ImageType: "JPG"}, 0, "")
+				y += h + 6
+			} else {
+				log.Printf("Brochure of listing %s has no cover photo (request %s): %v", listing.ID.Hex(), requestID(ctx), pdf.Error())
+				pdf.ClearError()
+			}
+		}
+	}
+
+	// Key specs, two columns of label and value
+	price := brochurePrice.Sprintf("%.0f %s", listing.Price, listingCurrency(listing))
+	if listing.ListingType == "rent" {
+		price += " / month"
+	}
+	specs := [][2]string{
+		{"Price", price},
+		{"Size", fmt.Sprintf("%g sqm (%g sqft)", listing.Size, sqftFromSqm(listing.Size))},
+		{"Floor", fmt.Sprint(listing.Floor)},
+		{"Bedrooms", fmt.Sprint(listing.Bedroom)},
+		{"Bathrooms", fmt.Sprint(listing.Bathroom)},
+		{"Facing", listing.FacingDirection},
+	}
+	pdf.SetFillColor(245, 245, 245)
+	for i, spec := range specs {
+		x := left + float64(i%2)*width/2
+		if i%2 == 0 && i > 0 {
+			y += 8
+		}
+		pdf.SetXY(x, y)
+		pdf.font("", 10)
+		pdf.CellFormat(28, 8, pdf.text(spec[0]), "", 0, "L", true, 0, "")
+		pdf.font("B", 10)
+		pdf.CellFormat(width/2-30, 8, pdf.text(spec[1]), "", 0, "L", true, 0, "")
+	}
+	y += 14
+
+	// The contact block and QR code take the bottom 45mm, the description what is left above them
+	const footer = 297 - 15 - 40
+	pdf.font("", 10)
+	lineHeight := 5.0
+	if maxLines := int((footer - 6 - y) / lineHeight); maxLines > 0 {
+		for _, line := range pdf.lines(listing.Description, width, maxLines) {
+			pdf.SetXY(left, y)
+			pdf.CellFormat(width, lineHeight, line, "", 0, "L", false, 0, "")
+			y += lineHeight
+		}
+	}
+
+	pdf.SetDrawColor(200, 200, 200)
+	pdf.Line(left, footer, left+width, footer)
+	pdf.SetXY(left, footer+4)
+	pdf.font("B", 12)
+	if agent != nil {
+		pdf.CellFormat(130, 7, pdf.text(agent.Name), "", 2, "L", false, 0, "")
+		pdf.font("", 10)
+		for _, contact := range []string{agent.Phone, agent.Email, lineContact(agent.LineID)} {
+			if contact != "" {
+				pdf.CellFormat(130, 6, pdf.text(contact), "", 2, "L", false, 0, "")
+			}
+		}
+	} else {
+		pdf.CellFormat(130, 7, "MV Realty", "", 2, "L", false, 0, "")
+	}
+
+	if base := siteBaseURL(); base != "" {
+		url := listingPageURL(base, listing)
+		if code, err := qrcode.Encode(url, qrcode.Medium, 300); err == nil {
+			pdf.RegisterImageOptionsReader("qr", gofpdf.ImageOptions{ImageType: "PNG"}, bytes.NewReader(code))
+			pdf.ImageOptions("qr", left+width-34, footer+3, 34, 34, false, gofpdf.ImageOptions{ImageType: "PNG"}, 0, url)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := pdf.Output(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func lineContact(id string) string {
+	if id == "" {
+		return ""
+	}
+	return "LINE " + id
+}
+
+// brochureCoverPhoto is the first listing photo, or the first property image for listings without one
+func brochureCoverPhoto(listing *Listing, property *Property) string {
+	if len(listing.Photos) > 0 {
+		return listing.Photos[0].URL
+	}
+	if len(property.Images) > 0 {
+		return property.Images[0].URL
+	}
+	return ""
+}
+
+// fetchBrochurePhoto downloads the photo as a JPEG at most maxBrochurePhotoSize wide. Cloudinary
+// scales it on delivery; other hosts get scaled here.
+func fetchBrochurePhoto(ctx context.Context, photoURL string) ([]byte, error) {
+	if i := strings.Index(photoURL, "/image/upload/"); i >= 0 && strings.Contains(photoURL, "res.cloudinary.com") {
+		i += len("/image/upload/")
+		photoURL = photoURL[:i] + fmt.Sprintf("c_limit,w_%d,q_80,f_jpg/", maxBrochurePhotoSize) + photoURL[i:]
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, photoURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := brochureClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("photo host answered %s", resp.Status)
+	}
+	img, _, err := image.Decode(io.LimitReader(resp.Body, maxBrochurePhotoDown))
+	if err != nil {
+		return nil, err
+	}
+	if img.Bounds().Dx() > maxBrochurePhotoSize {
+		img = downscale(img, maxBrochurePhotoSize)
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 80}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// downscale shrinks img to width by averaging the source pixels under each target pixel
+func downscale(img image.Image, width int) image.Image {
+	b := img.Bounds()
+	height := max(1, b.Dy()*width/b.Dx())
+	out := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0, y1 := b.Min.Y+y*b.Dy()/height, b.Min.Y+(y+1)*b.Dy()/height
+		for x := 0; x < width; x++ {
+			x0, x1 := b.Min.X+x*b.Dx()/width, b.Min.X+(x+1)*b.Dx()/width
+			var r, g, bl, a, n uint32
+			for sy := y0; sy < max(y1, y0+1); sy++ {
+				for sx := x0; sx < max(x1, x0+1); sx++ {
+					pr, pg, pb, pa := img.At(sx, sy).RGBA()
+					r, g, bl, a, n = r+pr, g+pg, bl+pb, a+pa, n+1
+				}
+			}
+			i := out.PixOffset(x, y)
+			out.Pix[i], out.Pix[i+1], out.Pix[i+2], out.Pix[i+3] = uint8(r/n>>8), uint8(g/n>>8), uint8(bl/n>>8), uint8(a/n>>8)
+		}
+	}
+	return out
+}
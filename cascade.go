@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Cancellation reasons set on appointments whose listing or property is removed
+const (
+	cancelReasonListingRemoved  = "listing_removed"
+	cancelReasonPropertyRemoved = "property_removed"
+)
+
+var errDocumentNotFound = errors.New("document not found")
+
+// touchedDocument is one document changed by a cascading delete
+type touchedDocument struct {
+	Collection string `json:"collection"`
+	ID         string `json:"id"`
+	Action     string `json:"action"` // deleted (soft), cancelled, archived, activated or deactivated
+}
+
+// deletionReport lists every document a cascading delete touched
+type deletionReport struct {
+	Transactional bool              `json:"transactional"`
+	Touched       []touchedDocument `json:"touched"`
+}
+
+func (rep *deletionReport) add(collectionName, action string, ids ...primitive.ObjectID) {
+	for _, id := range ids {
+		rep.Touched = append(rep.Touched, touchedDocument{Collection: collectionName, ID: id.Hex(), Action: action})
+	}
+}
+
+var (
+	transactionsOnce      sync.Once
+	transactionsSupported bool
+)
+
+// supportsTransactions reports whether the deployment is a replica set or sharded cluster; checked once
+func supportsTransactions(ctx context.Context) bool {
+	transactionsOnce.Do(func() {
+		var hello struct {
+			SetName string `bson:"setName"`
+			Msg     string `bson:"msg"`
+		}
+		err := client.Database("admin").RunCommand(ctx, bson.D{{Key: "hello", Value: 1}}).Decode(&hello)
+		transactionsSupported = err == nil && (hello.SetName != "" || hello.Msg == "isdbgrid")
+	})
+	return transactionsSupported
+}
+
+// runCascade runs fn in a transaction when the deployment supports one. Otherwise fn runs directly;
+// the cascade steps are written so the parent document goes last and a failed run can simply be retried.
+func runCascade(ctx context.Context, fn func(ctx context.Context, rep *deletionReport) error) (*deletionReport, error) {
+	if !supportsTransactions(ctx) {
+		rep := &deletionReport{Touched: []touchedDocument{}}
+		return rep, fn(ctx, rep)
+	}
+
+	session, err := client.StartSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.EndSession(ctx)
+
+	var rep *deletionReport
+	_, err = session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		// WithTransaction may retry, so each attempt starts a fresh report
+		rep = &deletionReport{Transactional: true, Touched: []touchedDocument{}}
+		return nil, fn(sc, rep)
+	})
+	return rep, err
+}
+
+// findIDs returns the _id of every document matching filter
+func findIDs(ctx context.Context, collectionName string, filter bson.M) ([]primitive.ObjectID, error) {
+	cur, err := client.Database("MVDB").Collection(collectionName).Find(ctx, filter, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, err
+	}
+	var docs []struct {
+		ID primitive.ObjectID `bson:"_id"`
+	}
+	if err := cur.All(ctx, &docs); err != nil {
+		return nil, err
+	}
+	ids := make([]primitive.ObjectID, len(docs))
+	for i, d := range docs {
+		ids[i] = d.ID
+	}
+	return ids, nil
+}
+
+// cancelAppointments cancels the open appointments matching filter with the given reason
+func cancelAppointments(ctx context.Context, rep *deletionReport, filter bson.M, reason string) error {
+	filter["status"] = bson.M{"$in": openAppointmentStatuses}
+	ids, err := findIDs(ctx, "appointments", filter)
+	if err != nil || len(ids) == 0 {
+		return err
+	}
+	_, err = client.Database("MVDB").Collection("appointments").UpdateMany(ctx,
+		bson.M{"_id": bson.M{"$in": ids}},
+		bson.M{"$set": bson.M{"status": "cancelled", "cancellation_reason": reason}})
+	if err != nil {
+		return err
+	}
+	rep.add("appointments", "cancelled", ids...)
+	return nil
+}
+
+// deleteListingCascade soft-deletes a listing and cancels its scheduled appointments
+func deleteListingCascade(ctx context.Context, listingID primitive.ObjectID) (*deletionReport, error) {
+	rep, err := runCascade(ctx, func(ctx context.Context, rep *deletionReport) error {
+		db := client.Database("MVDB")
+		if err := db.Collection("listings").FindOne(ctx, notDeleted(bson.M{"_id": listingID})).Err(); err != nil {
+			if err == mongo.ErrNoDocuments {
+				return errDocumentNotFound
+			}
+			return err
+		}
+		if err := cancelAppointments(ctx, rep, bson.M{"listing_id": listingID.Hex()}, cancelReasonListingRemoved); err != nil {
+			log.Println("Failed to cancel appointments of listing", listingID.Hex(), ":", err)
+			return err
+		}
+		if _, err := softDelete(ctx, "listings", bson.M{"_id": listingID}, time.Now()); err != nil {
+			log.Println("Failed to delete listing", listingID.Hex(), ":", err)
+			return err
+		}
+		rep.add("listings", "deleted", listingID)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	recordDeletion(ctx, "listings", listingID)
+	return rep, nil
+}
+
+// deletePropertyCascade soft-deletes a property with its listings, stamping them all with the same
+// deleted_at so a restore can bring the listings back too. Scheduled appointments are cancelled and
+// inquiries are kept for history but archived, so they drop out of the agent's open queue.
+func deletePropertyCascade(ctx context.Context, propertyID primitive.ObjectID) (*deletionReport, error) {
+	var listingIDs []primitive.ObjectID
+	rep, err := runCascade(ctx, func(ctx context.Context, rep *deletionReport) error {
+		db := client.Database("MVDB")
+		pid := propertyID.Hex()
+		if err := db.Collection("properties").FindOne(ctx, notDeleted(bson.M{"_id": propertyID})).Err(); err != nil {
+			if err == mongo.ErrNoDocuments {
+				return errDocumentNotFound
+			}
+			return err
+		}
+
+		deletedAt := time.Now()
+		var err error
+		if listingIDs, err = findIDs(ctx, "listings", notDeleted(bson.M{"property_id": pid})); err != nil {
+			return err
+		}
+		listingHexes := make([]string, len(listingIDs))
+		for i, id := range listingIDs {
+			listingHexes[i] = id.Hex()
+		}
+
+		steps := []struct {
+			name string
+			run  func() error
+		}{
+			{"cancel listing appointments", func() error {
+				return cancelAppointments(ctx, rep, bson.M{"listing_id": bson.M{"$in": listingHexes}}, cancelReasonListingRemoved)
+			}},
+			{"cancel property appointments", func() error {
+				return cancelAppointments(ctx, rep, bson.M{"property_id": pid}, cancelReasonPropertyRemoved)
+			}},
+			{"archive inquiries", func() error {
+				ids, err := findIDs(ctx, "inquiries", bson.M{"property_id": pid, "archived_at": bson.M{"$exists": false}})
+				if err != nil || len(ids) == 0 {
+					return err
+				}
+				_, err = db.Collection("inquiries").UpdateMany(ctx, bson.M{"_id": bson.M{"$in": ids}},
+					bson.M{"$set": bson.M{"archived_at": time.Now(), "archived_reason": cancelReasonPropertyRemoved}})
+				if err == nil {
+					rep.add("inquiries", "archived", ids...)
+				}
+				return err
+			}},
+			{"delete listings", func() error {
+				if len(listingIDs) == 0 {
+					return nil
+				}
+				_, err := softDelete(ctx, "listings", bson.M{"_id": bson.M{"$in": listingIDs}}, deletedAt)
+				if err == nil {
+					rep.add("listings", "deleted", listingIDs...)
+				}
+				return err
+			}},
+			{"delete property", func() error {
+				_, err := softDelete(ctx, "properties", bson.M{"_id": propertyID}, deletedAt)
+				if err == nil {
+					rep.add("properties", "deleted", propertyID)
+				}
+				return err
+			}},
+		}
+		for _, step := range steps {
+			if err := step.run(); err != nil {
+				log.Println("Property", pid, "cascade failed at", step.name, ":", err)
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range listingIDs {
+		recordDeletion(ctx, "listings", id)
+	}
+	recordDeletion(ctx, "properties", propertyID)
+	return rep, nil
+}
+
+// deleteUserCascade soft-deletes a user; their inquiries and appointments are left as history
+func deleteUserCascade(ctx context.Context, userID primitive.ObjectID) (*deletionReport, error) {
+	rep, err := runCascade(ctx, func(ctx context.Context, rep *deletionReport) error {
+		res, err := softDelete(ctx, "users", bson.M{"_id": userID}, time.Now())
+		if err != nil {
+			return err
+		}
+		if res.MatchedCount == 0 {
+			return errDocumentNotFound
+		}
+		rep.add("users", "deleted", userID)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	recordDeletion(ctx, "users", userID)
+	return rep, nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var cascadeCollections = []string{"properties", "listings", "appointments", "inquiries", "deletions"}
+
+func insertDocs(t testing.TB, collectionName string, docs ...interface{}) {
+	t.Helper()
+	if _, err := client.Database("MVDB").Collection(collectionName).InsertMany(context.Background(), docs); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func findAppointment(t *testing.T, id primitive.ObjectID) Appointment {
+	t.Helper()
+	var a Appointment
+	if err := client.Database("MVDB").Collection("appointments").FindOne(context.Background(), bson.M{"_id": id}).Decode(&a); err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+// touchedIDs is the report as "collection action id" lines, sorted
+func touchedIDs(rep *deletionReport) []string {
+	lines := make([]string, len(rep.Touched))
+	for i, d := range rep.Touched {
+		lines[i] = d.Collection + " " + d.Action + " " + d.ID
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+func assertTouched(t *testing.T, rep *deletionReport, want ...string) {
+	t.Helper()
+	sort.Strings(want)
+	got := touchedIDs(rep)
+	if len(got) != len(want) {
+		t.Fatalf("touched %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("touched %v, want %v", got, want)
+			return
+		}
+	}
+}
+
+// TestDeleteListingCascade cancels the open appointments of the listing, leaves the closed ones and
+// those of other listings alone, and reports every document it changed
+func TestDeleteListingCascade(t *testing.T) {
+	useTestMongo(t, cascadeCollections...)
+	ctx := context.Background()
+	listingID, otherListing := primitive.NewObjectID(), primitive.NewObjectID()
+	scheduled, confirmed, completed, elsewhere := primitive.NewObjectID(), primitive.NewObjectID(), primitive.NewObjectID(), primitive.NewObjectID()
+	insertDocs(t, "listings", Listing{ID: listingID, ListingStatus: "active"}, Listing{ID: otherListing, ListingStatus: "active"})
+	insertDocs(t, "appointments",
+		Appointment{ID: scheduled, ListingID: listingID.Hex(), Status: "scheduled"},
+		Appointment{ID: confirmed, ListingID: listingID.Hex(), Status: "confirmed"},
+		Appointment{ID: completed, ListingID: listingID.Hex(), Status: "completed"},
+		Appointment{ID: elsewhere, ListingID: otherListing.Hex(), Status: "scheduled"},
+	)
+
+	rep, err := deleteListingCascade(ctx, listingID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertTouched(t, rep,
+		"appointments cancelled "+scheduled.Hex(),
+		"appointments cancelled "+confirmed.Hex(),
+		"listings deleted "+listingID.Hex(),
+	)
+	for _, id := range []primitive.ObjectID{scheduled, confirmed} {
+		if a := findAppointment(t, id); a.Status != "cancelled" || a.CancellationReason != cancelReasonListingRemoved {
+			t.Errorf("open appointment: status %q, reason %q", a.Status, a.CancellationReason)
+		}
+	}
+	if a := findAppointment(t, completed); a.Status != "completed" || a.CancellationReason != "" {
+		t.Errorf("completed appointment became %q (%q)", a.Status, a.CancellationReason)
+	}
+	if a := findAppointment(t, elsewhere); a.Status != "scheduled" {
+		t.Errorf("appointment of another listing became %q", a.Status)
+	}
+	n, err := client.Database("MVDB").Collection("appointments").CountDocuments(ctx, bson.M{})
+	if err != nil || n != 4 {
+		t.Errorf("%d appointments left (%v), cancelling must not delete any", n, err)
+	}
+	if n, _ := client.Database("MVDB").Collection("listings").CountDocuments(ctx, notDeleted(bson.M{"_id": listingID})); n != 0 {
+		t.Error("the listing is still live")
+	}
+	if n, _ := client.Database("MVDB").Collection("deletions").CountDocuments(ctx, bson.M{"document_id": listingID.Hex()}); n != 1 {
+		t.Errorf("%d deletion records for the listing, want 1", n)
+	}
+
+	if _, err := deleteListingCascade(ctx, listingID); err != errDocumentNotFound {
+		t.Errorf("deleting it again: %v, want errDocumentNotFound", err)
+	}
+}
+
+// TestDeletePropertyCascade removes the property with its listings, cancels the appointments of both
+// and archives its inquiries instead of deleting them
+func TestDeletePropertyCascade(t *testing.T) {
+	useTestMongo(t, cascadeCollections...)
+	ctx := context.Background()
+	propertyID, otherProperty := primitive.NewObjectID(), primitive.NewObjectID()
+	pid := propertyID.Hex()
+	listingID, deletedListing := primitive.NewObjectID(), primitive.NewObjectID()
+	earlier := time.Now().Add(-time.Hour)
+	onListing, onProperty := primitive.NewObjectID(), primitive.NewObjectID()
+	inquiry, archived, otherInquiry := primitive.NewObjectID(), primitive.NewObjectID(), primitive.NewObjectID()
+
+	insertDocs(t, "properties", Property{ID: propertyID, Title: "Gone"}, Property{ID: otherProperty, Title: "Kept"})
+	insertDocs(t, "listings",
+		Listing{ID: listingID, PropertyID: pid, ListingStatus: "active"},
+		bson.M{"_id": deletedListing, "property_id": pid, "deleted_at": earlier},
+	)
+	insertDocs(t, "appointments",
+		Appointment{ID: onListing, PropertyID: pid, ListingID: listingID.Hex(), Status: "scheduled"},
+		Appointment{ID: onProperty, PropertyID: pid, Status: "confirmed"},
+	)
+	insertDocs(t, "inquiries",
+		Inquiry{ID: inquiry, Property_id: pid},
+		bson.M{"_id": archived, "property_id": pid, "archived_at": earlier},
+		Inquiry{ID: otherInquiry, Property_id: otherProperty.Hex()},
+	)
+
+	rep, err := deletePropertyCascade(ctx, propertyID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertTouched(t, rep,
+		"appointments cancelled "+onListing.Hex(),
+		"appointments cancelled "+onProperty.Hex(),
+		"inquiries archived "+inquiry.Hex(),
+		"listings deleted "+listingID.Hex(),
+		"properties deleted "+pid,
+	)
+	if a := findAppointment(t, onListing); a.Status != "cancelled" || a.CancellationReason != cancelReasonListingRemoved {
+		t.Errorf("appointment on the listing: %q, reason %q", a.Status, a.CancellationReason)
+	}
+	if a := findAppointment(t, onProperty); a.Status != "cancelled" || a.CancellationReason != cancelReasonPropertyRemoved {
+		t.Errorf("appointment on the property: %q, reason %q", a.Status, a.CancellationReason)
+	}
+
+	db := client.Database("MVDB")
+	var inq struct {
+		ArchivedAt     *time.Time `bson:"archived_at"`
+		ArchivedReason string     `bson:"archived_reason"`
+	}
+	if err := db.Collection("inquiries").FindOne(ctx, bson.M{"_id": inquiry}).Decode(&inq); err != nil {
+		t.Fatal("the inquiry was deleted:", err)
+	}
+	if inq.ArchivedAt == nil || inq.ArchivedReason != cancelReasonPropertyRemoved {
+		t.Errorf("inquiry archived at %v, reason %q", inq.ArchivedAt, inq.ArchivedReason)
+	}
+	if n, _ := db.Collection("inquiries").CountDocuments(ctx, bson.M{"_id": otherInquiry, "archived_at": bson.M{"$exists": true}}); n != 0 {
+		t.Error("the inquiry of another property was archived")
+	}
+
+	// the property and its listing share deleted_at so a restore brings both back
+	var property, listing struct {
+		DeletedAt time.Time `bson:"deleted_at"`
+	}
+	if err := db.Collection("properties").FindOne(ctx, bson.M{"_id": propertyID}).Decode(&property); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Collection("listings").FindOne(ctx, bson.M{"_id": listingID}).Decode(&listing); err != nil {
+		t.Fatal(err)
+	}
+	if property.DeletedAt.IsZero() || !property.DeletedAt.Equal(listing.DeletedAt) {
+		t.Errorf("property deleted at %v, listing at %v", property.DeletedAt, listing.DeletedAt)
+	}
+	if n, _ := db.Collection("properties").CountDocuments(ctx, notDeleted(bson.M{"_id": otherProperty})); n != 1 {
+		t.Error("the other property was deleted")
+	}
+
+	if _, err := deletePropertyCascade(ctx, primitive.NewObjectID()); err != errDocumentNotFound {
+		t.Errorf("unknown property: %v, want errDocumentNotFound", err)
+	}
+}
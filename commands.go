@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+// commands are the subcommands of the binary besides `serve`, which main runs itself (and also
+// without any subcommand). Each parses its own arguments before connecting to Mongo. export and
+// import are in backup.go.
+var commands = map[string]func(args []string) error{
+	"migrate": runMigrate,
+	"seed":    runSeed,
+	"export":  runExport,
+	"import":  runImport,
+}
+
+// usageError is returned by a command for bad arguments; runCommand prints it and exits with 2
+type usageError string
+
+func (e usageError) Error() string { return string(e) }
+
+// runCommand runs a subcommand instead of the server. It exits 2 on bad usage and 1 when the
+// command fails, so CI/CD can stop a deploy on a failed migration.
+func runCommand(args []string) {
+	run := commands[args[0]]
+	if run == nil {
+		names := []string{"serve"}
+		for name := range commands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		fmt.Fprintf(os.Stderr, "usage: %s [%s]\n", os.Args[0], strings.Join(names, "|"))
+		os.Exit(2)
+	}
+
+	err := run(args[1:])
+	var usage usageError
+	switch {
+	case errors.As(err, &usage):
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	case errors.Is(err, flag.ErrHelp):
+		os.Exit(2)
+	case err != nil:
+		log.Fatal(args[0], " failed: ", err)
+	}
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// GET /admin/consistency looks for references that no longer hold, the safety net around data
+// migrations. Each check is independent and answers with how many documents are affected and a few
+// examples. The reference checks are single aggregations; the image check HEADs a sample of the
+// Cloudinary URLs, so with ?background=true the checks run as a job instead, writing their results
+// to a consistency_reports document as each one finishes.
+const (
+	jobConsistencyReport      = "consistency_report"
+	consistencyReports        = "consistency_reports"
+	consistencyTimeout        = time.Minute
+	consistencyExamples       = 10
+	defaultImageSample        = 50
+	maxImageSample            = 500
+	imageCheckConcurrency     = 8
+	consistencyReportTTL      = 30 * 24 * time.Hour
+	consistencyReportRunning  = "running"
+	consistencyReportFinished = "done"
+)
+
+// consistencyCheck is one problem class. Run is given the options of the request.
+type consistencyCheck struct {
+	Name        string
+	Description string
+	Run         func(ctx context.Context, opts consistencyOptions) (consistencyResult, error)
+}
+
+type consistencyOptions struct {
+	ImageSample int `bson:"image_sample" json:"image_sample"`
+}
+
+// consistencyResult is what one check found. Sampled is set by checks that only look at a sample,
+// and Error when the check itself failed.
+type consistencyResult struct {
+	Check       string               `bson:"check" json:"check"`
+	Description string               `bson:"description" json:"description"`
+	Count       int64                `bson:"count" json:"count"`
+	Examples    []consistencyExample `bson:"examples" json:"examples"`
+	Sampled     int                  `bson:"sampled,omitempty" json:"sampled,omitempty"`
+	Unreachable int                  `bson:"unreachable,omitempty" json:"unreachable,omitempty"` // image HEADs that failed without an answer
+	DurationMs  int64                `bson:"duration_ms" json:"duration_ms"`
+	Error       string               `bson:"error,omitempty" json:"error,omitempty"`
+}
+
+type consistencyExample struct {
+	ID     string `bson:"id" json:"id"`
+	Detail string `bson:"detail,omitempty" json:"detail,omitempty"`
+}
+
+// consistencyReport is a background run, see runConsistencyReport
+type consistencyReport struct {
+	ID         primitive.ObjectID  `bson:"_id" json:"report_id"`
+	Status     string              `bson:"status" json:"status"` // running or done
+	Checks     []string            `bson:"checks" json:"checks"`
+	Options    consistencyOptions  `bson:"options" json:"options"`
+	Results    []consistencyResult `bson:"results" json:"results"`
+	CreatedAt  time.Time           `bson:"created_at" json:"created_at"`
+	FinishedAt *time.Time          `bson:"finished_at,omitempty" json:"finished_at,omitempty"`
+}
+
+var consistencyChecks = []consistencyCheck{
+	{"listing_property_missing", "Listings whose property_id doesn't resolve to a property, or to a deleted one", checkListingProperties},
+	{"inquiry_user_missing", "Inquiries from a user that doesn't exist or was deleted", checkInquiryUsers},
+	{"appointment_property_mismatch", "Appointments whose listing belongs to another property than the appointment's", checkAppointmentProperties},
+	{"image_asset_missing", "Property images whose URL answers 404 or 410, over a sample of ?image_sample= images", checkImageAssets},
+}
+
+// referenceLookup matches the documents of a collection with field set and looks the document it
+// references up in from, as _ref: empty when the reference doesn't resolve to a document that
+// isn't deleted
+func referenceLookup(field, from string) []bson.M {
+	return []bson.M{
+		{"$match": notDeleted(bson.M{field: bson.M{"$nin": bson.A{"", nil}}})},
+		{"$lookup": bson.M{
+			"from": from,
+			"let":  bson.M{"ref": bson.M{"$convert": bson.M{"input": "$" + field, "to": "objectId", "onError": nil, "onNull": nil}}},
+			"pipeline": []bson.M{
+				{"$match": bson.M{"$expr": bson.M{"$eq": bson.A{"$_id", "$$ref"}}, "deleted_at": nil}},
+				{"$project": bson.M{"property_id": 1}},
+			},
+			"as": "_ref",
+		}},
+	}
+}
+
+// countProblems runs pipeline over collectionName, counting what it matches and keeping the first
+// consistencyExamples with detail as the example's detail
+func countProblems(ctx context.Context, collectionName string, pipeline []bson.M, detail string) (consistencyResult, error) {
+	examples := []bson.M{{"$sort": bson.M{"_id": 1}}, {"$limit": consistencyExamples}, {"$project": bson.M{"_id": 0, "id": bson.M{"$toString": "$_id"}, "detail": detail}}}
+	pipeline = append(pipeline, bson.M{"$facet": bson.M{"count": []bson.M{{"$count": "n"}}, "examples": examples}})
+	cur, err := client.Database("MVDB").Collection(collectionName).Aggregate(ctx, pipeline)
+	if err != nil {
+		return consistencyResult{}, err
+	}
+	var facets []struct {
+		Count    []struct{ N int64 }  `bson:"count"`
+		Examples []consistencyExample `bson:"examples"`
+	}
+	if err := cur.All(ctx, &facets); err != nil {
+		return consistencyResult{}, err
+	}
+	result := consistencyResult{Examples: []consistencyExample{}}
+	if len(facets) > 0 {
+		if len(facets[0].Count) > 0 {
+			result.Count = facets[0].Count[0].N
+		}
+		result.Examples = append(result.Examples, facets[0].Examples...)
+	}
+	return result, nil
+}
+
+func checkListingProperties(ctx context.Context, _ consistencyOptions) (consistencyResult, error) {
+	pipeline := append(referenceLookup("property_id", "properties"), bson.M{"$match": bson.M{"_ref": bson.M{"$size": 0}}})
+	return countProblems(ctx, "listings", pipeline, "$property_id")
+}
+
+func checkInquiryUsers(ctx context.Context, _ consistencyOptions) (consistencyResult, error) {
+	pipeline := append(referenceLookup("user_id", "users"), bson.M{"$match": bson.M{"_ref": bson.M{"$size": 0}}})
+	return countProblems(ctx, "inquiries", pipeline, "$user_id")
+}
+
+// checkAppointmentProperties leaves appointments of a missing listing out, they aren't a mismatch
+func checkAppointmentProperties(ctx context.Context, _ consistencyOptions) (consistencyResult, error) {
+	pipeline := append(referenceLookup("listing_id", "listings"),
+		bson.M{"$addFields": bson.M{"_listing_property": bson.M{"$first": "$_ref.property_id"}}},
+		bson.M{"$match": bson.M{"_ref": bson.M{"$size": 1}, "$expr": bson.M{"$ne": bson.A{"$_listing_property", "$property_id"}}}},
+	)
+	return countProblems(ctx, "appointments", pipeline, "$_listing_property")
+}
+
+var imageCheckClient = &http.Client{Timeout: 5 * time.Second}
+
+// checkImageAssets HEADs opts.ImageSample images picked at random among those of the properties
+// that aren't deleted. An image that fails to answer at all counts as unreachable, not missing.
+func checkImageAssets(ctx context.Context, opts consistencyOptions) (consistencyResult, error) {
+	cur, err := client.Database("MVDB").Collection("properties").Aggregate(ctx, []bson.M{
+		{"$match": notDeleted(bson.M{"images.0": bson.M{"$exists": true}})},
+		{"$unwind": "$images"},
+		{"$sample": bson.M{"size": opts.ImageSample}},
+		{"$project": bson.M{"_id": 0, "id": bson.M{"$toString": "$_id"}, "detail": "$images.url"}},
+	})
+	if err != nil {
+		return consistencyResult{}, err
+	}
+	var images []consistencyExample
+	if err := cur.All(ctx, &images); err != nil {
+		return consistencyResult{}, err
+	}
+
+	result := consistencyResult{Examples: []consistencyExample{}, Sampled: len(images)}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, imageCheckConcurrency)
+	for _, image := range images {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(image consistencyExample) {
+			defer func() { <-sem; wg.Done() }()
+			status, err := headStatus(ctx, image.Detail)
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err != nil:
+				result.Unreachable++
+			case status == http.StatusNotFound || status == http.StatusGone:
+				result.Count++
+				if len(result.Examples) < consistencyExamples {
+					result.Examples = append(result.Examples, image)
+				}
+			}
+		}(image)
+	}
+	wg.Wait()
+	return result, ctx.Err()
+}
+
+func headStatus(ctx context.Context, url string) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+	if err != nil {
+		return 0, err
+	}
+	res, err := imageCheckClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	res.Body.Close()
+	return res.StatusCode, nil
+}
+
+// runConsistencyChecks runs checks one after the other, handing each result to done as it
+// finishes. A failing check is marked failed in its result, with the error in the log; the others
+// still run.
+func runConsistencyChecks(ctx context.Context, checks []consistencyCheck, opts consistencyOptions, done func(consistencyResult) error) error {
+	for _, check := range checks {
+		started := time.Now()
+		result, err := check.Run(ctx, opts)
+		result.Check, result.Description = check.Name, check.Description
+		result.DurationMs = time.Since(started).Milliseconds()
+		if result.Examples == nil {
+			result.Examples = []consistencyExample{}
+		}
+		if err != nil {
+			log.Println("Consistency check", check.Name, "failed:", err)
+			result.Error = "The check failed"
+		}
+		if err := done(result); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseConsistencyRequest reads ?check= (one of the check names, all of them when empty) and
+// ?image_sample= (1 to maxImageSample); it answers 400 and returns false when they are invalid
+func parseConsistencyRequest(w http.ResponseWriter, r *http.Request) ([]consistencyCheck, consistencyOptions, bool) {
+	opts := consistencyOptions{ImageSample: defaultImageSample}
+	if raw := r.URL.Query().Get("image_sample"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > maxImageSample {
+			http.Error(w, fmt.Sprintf("image_sample must be a number from 1 to %d", maxImageSample), http.StatusBadRequest)
+			return nil, opts, false
+		}
+		opts.ImageSample = n
+	}
+	name := r.URL.Query().Get("check")
+	if name == "" {
+		return consistencyChecks, opts, true
+	}
+	names := make([]string, 0, len(consistencyChecks))
+	for _, check := range consistencyChecks {
+		if check.Name == name {
+			return []consistencyCheck{check}, opts, true
+		}
+		names = append(names, check.Name)
+	}
+	http.Error(w, "check must be one of "+strings.Join(names, ", "), http.StatusBadRequest)
+	return nil, opts, false
+}
+
+// getConsistency answers GET /admin/consistency, running the checks now, or with ?background=true
+// queueing them and answering 202 with the report to poll
+func getConsistency(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+
+	checks, opts, ok := parseConsistencyRequest(w, r)
+	if !ok {
+		return
+	}
+	if r.URL.Query().Get("background") == "true" {
+		queueConsistencyReport(w, r, checks, opts)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), consistencyTimeout)
+	defer cancel()
+
+	results := []consistencyResult{}
+	runConsistencyChecks(ctx, checks, opts, func(result consistencyResult) error {
+		results = append(results, result)
+		return nil
+	})
+	json.NewEncoder(w).Encode(bson.M{"results": results})
+}
+
+func queueConsistencyReport(w http.ResponseWriter, r *http.Request, checks []consistencyCheck, opts consistencyOptions) {
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	report := consistencyReport{ID: primitive.NewObjectID(), Status: consistencyReportRunning, Options: opts,
+		Results: []consistencyResult{}, CreatedAt: time.Now()}
+	for _, check := range checks {
+		report.Checks = append(report.Checks, check.Name)
+	}
+	if _, err := client.Database("MVDB").Collection(consistencyReports).InsertOne(ctx, report); err != nil {
+		serverError(w, r, "Failed to create the consistency report", err)
+		return
+	}
+	if _, err := jobQueue.Enqueue(ctx, jobConsistencyReport, consistencyReportJob{ReportID: report.ID.Hex()}, time.Time{}); err != nil {
+		serverError(w, r, "Failed to queue the consistency report", err)
+		return
+	}
+	w.Header().Set("Location", "/admin/consistency/reports/"+report.ID.Hex())
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(report)
+}
+
+// consistencyReportJob is the payload of a consistency_report job
+type consistencyReportJob struct {
+	ReportID string `json:"report_id"`
+}
+
+// runConsistencyReport runs the checks of a report, pushing each result as it finishes so the
+// report shows the progress. The job's lease bounds the run; a retried job starts over from the
+// first check.
+func runConsistencyReport(ctx context.Context, payload json.RawMessage) error {
+	var p consistencyReportJob
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return err
+	}
+	id, err := primitive.ObjectIDFromHex(p.ReportID)
+	if err != nil {
+		return err
+	}
+	reports := client.Database("MVDB").Collection(consistencyReports)
+	var report consistencyReport
+	err = reports.FindOneAndUpdate(ctx, bson.M{"_id": id},
+		bson.M{"$set": bson.M{"status": consistencyReportRunning, "results": bson.A{}}}).Decode(&report)
+	if err == mongo.ErrNoDocuments {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var checks []consistencyCheck
+	for _, check := range consistencyChecks {
+		if isOneOf(check.Name, report.Checks) {
+			checks = append(checks, check)
+		}
+	}
+
+	err = runConsistencyChecks(ctx, checks, report.Options, func(result consistencyResult) error {
+		_, err := reports.UpdateByID(ctx, id, bson.M{"$push": bson.M{"results": result}})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	_, err = reports.UpdateByID(ctx, id, bson.M{"$set": bson.M{"status": consistencyReportFinished, "finished_at": time.Now()}})
+	return err
+}
+
+// getConsistencyReport answers GET /admin/consistency/reports/{id}
+func getConsistencyReport(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+
+	id, ok := pathObjectID(w, r, "report")
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	var report consistencyReport
+	err := client.Database("MVDB").Collection(consistencyReports).FindOne(ctx, bson.M{"_id": id}).Decode(&report)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Consistency report not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		serverError(w, r, "Failed to retrieve the consistency report", err)
+		return
+	}
+	json.NewEncoder(w).Encode(report)
+}
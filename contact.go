@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	maxContactNameLength    = 100
+	maxContactMessageLength = 2000
+)
+
+// emailCollation compares emails case-insensitively. The unique email index on users uses it, and so
+// must every query that wants that index.
+var emailCollation = &options.Collation{Locale: "en", Strength: 2}
+
+// contactRequest is the body of POST /contact, the "Contact us about this unit" form
+type contactRequest struct {
+	Name       string         `json:"name"`
+	Email      string         `json:"email"`
+	Phone      string         `json:"phone"`
+	PropertyID string         `json:"property_id"`
+	ListingID  string         `json:"listing_id"` // optional, routes the inquiry to the listing's agent
+	Message    string         `json:"message"`
+	Source     *inquirySource `json:"source"` // optional campaign attribution
+}
+
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+func validateContact(c *contactRequest) []string {
+	var problems []string
+	if strings.TrimSpace(c.Name) == "" || utf8.RuneCountInString(c.Name) > maxContactNameLength {
+		problems = append(problems, "name is required and must be at most 100 characters")
+	}
+	if addr, err := mail.ParseAddress(c.Email); err != nil || addr.Address != c.Email {
+		problems = append(problems, "email must be a valid email address")
+	}
+	if c.Phone != "" && !agentPhone.MatchString(c.Phone) {
+		problems = append(problems, "phone must be digits, optionally with a leading + and spaces or dashes")
+	}
+	if !primitive.IsValidObjectID(c.PropertyID) {
+		problems = append(problems, errInvalidPropertyID.Error())
+	}
+	if c.ListingID != "" && !primitive.IsValidObjectID(c.ListingID) {
+		problems = append(problems, errInvalidListingID.Error())
+	}
+	if strings.TrimSpace(c.Message) == "" || utf8.RuneCountInString(c.Message) > maxContactMessageLength {
+		problems = append(problems, "message is required and must be at most 2000 characters")
+	}
+	return append(problems, validateInquirySource(&c.Source)...)
+}
+
+// upsertContactUser returns the id of the live user with the email, creating the user when there is
+// none; soft-deleted users don't count. Two submissions racing to create the same user both insert;
+// the unique email index rejects one, which then reads the winner's id.
+func upsertContactUser(ctx context.Context, c *contactRequest) (primitive.ObjectID, bool, error) {
+	collection := client.Database("MVDB").Collection("users")
+	findExisting := func() (primitive.ObjectID, error) {
+		var existing User
+		err := collection.FindOne(ctx, notDeleted(bson.M{"email": c.Email}), options.FindOne().SetCollation(emailCollation)).Decode(&existing)
+		return existing.ID, err
+	}
+
+	id, err := findExisting()
+	if err != mongo.ErrNoDocuments {
+		return id, false, err
+	}
+	user := User{Name: strings.TrimSpace(c.Name), Email: c.Email, Phone: c.Phone}
+	inserted, err := insertUser(ctx, &user)
+	if err == nil {
+		return inserted.(primitive.ObjectID), true, nil
+	}
+	if !mongo.IsDuplicateKeyError(err) {
+		return primitive.NilObjectID, false, err
+	}
+	id, err = findExisting()
+	return id, false, err
+}
+
+// submitContact answers POST /contact: it finds or creates the user by email and stores the inquiry,
+// so the form needs one request instead of checkUser, createUser and createInquiry
+func submitContact(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var c contactRequest
+	var vErr *validationError
+	if err := json.NewDecoder(r.Body).Decode(&c); errors.As(err, &vErr) {
+		http.Error(w, vErr.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to parse request body", http.StatusBadRequest)
+		return
+	}
+	c.Email = normalizeEmail(c.Email)
+	c.Phone = strings.TrimSpace(c.Phone)
+	if problems := validateContact(&c); len(problems) > 0 {
+		http.Error(w, (&validationError{Problems: problems}).Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	// The property is checked first so a bad property_id doesn't leave a user behind
+	propertyID, _ := primitive.ObjectIDFromHex(c.PropertyID)
+	err := checkReferences(ctx, []reference{{
+		Collection: "properties",
+		ID:         c.PropertyID,
+		Invalid:    errInvalidPropertyID,
+		Missing:    errPropertyNotFound,
+		Check:      errPropertyCheck,
+	}}, []primitive.ObjectID{propertyID})
+	switch {
+	case err == errPropertyNotFound:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		serverError(w, r, "Failed to check PropertyID", err)
+		return
+	}
+
+	userID, created, err := upsertContactUser(ctx, &c)
+	if err != nil {
+		serverError(w, r, "Failed to create User", err)
+		return
+	}
+	meta := auditFromRequest(r)
+	if created {
+		auditCreated(meta, "users", userID, User{Name: strings.TrimSpace(c.Name), Email: c.Email, Phone: c.Phone})
+	}
+
+	inquiry := Inquiry{User_id: userID.Hex(), Property_id: c.PropertyID, ListingID: c.ListingID, Message: strings.TrimSpace(c.Message), Source: c.Source}
+	inquiryID, err := insertInquiry(ctx, &inquiry)
+	if err != nil {
+		serverError(w, r, "Failed to create Inquiry", err)
+		return
+	}
+	auditCreated(meta, "inquiries", inquiryID, inquiry)
+	json.NewEncoder(w).Encode(bson.M{"user_id": userID, "inquiry_id": inquiryID, "user_created": created})
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// defaultCurrency is the currency of every listing created before the field existed
+const defaultCurrency = "THB"
+
+var currencies = []string{"THB", "USD", "EUR", "GBP", "JPY", "CNY", "SGD", "HKD", "AUD"}
+
+const (
+	ratesRefreshAge = 24 * time.Hour // fetch again once the stored rates are this old
+	ratesMaxAge     = 48 * time.Hour // older rates aren't used for conversion
+)
+
+// exchangeRates is the single document in the rates collection, keyed by its base currency
+type exchangeRates struct {
+	Base      string             `bson:"_id" json:"base"`
+	Rates     map[string]float64 `bson:"rates" json:"rates"` // units of each currency per 1 unit of Base
+	FetchedAt time.Time          `bson:"fetched_at" json:"fetched_at"`
+}
+
+// convert changes amount from one currency to another through the base; false when either rate is missing
+func (x *exchangeRates) convert(amount float64, from, to string) (float64, bool) {
+	rate := func(c string) float64 {
+		if c == x.Base {
+			return 1
+		}
+		return x.Rates[c]
+	}
+	fromRate, toRate := rate(from), rate(to)
+	if fromRate <= 0 || toRate <= 0 {
+		return 0, false
+	}
+	return amount / fromRate * toRate, true
+}
+
+// currentRates is the last rates document read by the rates_refresh task; nil until the first load
+var currentRates atomic.Pointer[exchangeRates]
+
+// usableRates returns the current rates, or nil when there are none or they are older than ratesMaxAge
+func usableRates() *exchangeRates {
+	rates := currentRates.Load()
+	if rates == nil || time.Since(rates.FetchedAt) > ratesMaxAge {
+		return nil
+	}
+	return rates
+}
+
+// listingCurrency treats listings without a currency as THB
+func listingCurrency(listing *Listing) string {
+	if listing.Currency == "" {
+		return defaultCurrency
+	}
+	return listing.Currency
+}
+
+var displayCurrencyParam = apiParam{Name: "display_currency", Description: "adds display_price converted to this currency, with rates_as_of"}
+
+// warnStaleRates adds a Warning header so clients know prices were left in their original currency
+// and price filters only matched listings in the requested one
+func warnStaleRates(w http.ResponseWriter) {
+	w.Header().Set("Warning", `199 - "Exchange rates are unavailable or stale, prices were not converted"`)
+}
+
+// applyDisplayCurrency handles ?display_currency= for listing responses: it fills display_price next to
+// the original price and currency. Listings in a currency without a rate are left unconverted.
+// It answers 400 and returns false when the currency isn't supported.
+func applyDisplayCurrency(w http.ResponseWriter, r *http.Request, listings []Listing) bool {
+	target := strings.ToUpper(r.URL.Query().Get("display_currency"))
+	if target == "" {
+		return true
+	}
+	if !isOneOf(target, currencies) {
+		http.Error(w, "display_currency must be one of "+strings.Join(currencies, ", "), http.StatusBadRequest)
+		return false
+	}
+	rates := usableRates()
+	if rates == nil {
+		warnStaleRates(w)
+		return true
+	}
+	for i := range listings {
+		converted, ok := rates.convert(listings[i].Price, listingCurrency(&listings[i]), target)
+		if !ok {
+			continue
+		}
+		converted = math.Round(converted*100) / 100
+		listings[i].DisplayPrice = &converted
+		listings[i].DisplayCurrency = target
+		listings[i].RatesAsOf = &rates.FetchedAt
+	}
+	return true
+}
+
+// priceFilter matches listings whose price falls in [min, max] given in currency. The bounds are
+// converted into each listing currency, rather than converting every document's price, so the
+// price indexes still apply. Without usable rates only listings in currency itself can match.
+func priceFilter(min, max *float64, currency string) bson.A {
+	rates := usableRates()
+	var clauses bson.A
+	for _, c := range currencies {
+		lo, hi := min, max
+		if c != currency {
+			if rates == nil {
+				continue
+			}
+			var ok bool
+			if lo, ok = convertBound(rates, lo, currency, c); !ok {
+				continue
+			}
+			if hi, ok = convertBound(rates, hi, currency, c); !ok {
+				continue
+			}
+		}
+		var match interface{} = c
+		if c == defaultCurrency {
+			match = bson.M{"$in": bson.A{c, nil}}
+		}
+		clauses = append(clauses, bson.M{"currency": match, "price": numericRange(lo, hi)})
+	}
+	return clauses
+}
+
+func convertBound(rates *exchangeRates, bound *float64, from, to string) (*float64, bool) {
+	if bound == nil {
+		return nil, true
+	}
+	v, ok := rates.convert(*bound, from, to)
+	return &v, ok
+}
+
+// fetchRates asks RATES_PROVIDER_URL for the rates of every supported currency against THB.
+// The provider gets ?base=&symbols= and the RATES_API_KEY in an apikey header, and must answer
+// with a JSON object holding a "rates" map.
+func fetchRates(ctx context.Context, providerURL, apiKey string) (*exchangeRates, error) {
+	u, err := url.Parse(providerURL)
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	q.Set("base", defaultCurrency)
+	q.Set("symbols", strings.Join(currencies, ","))
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if apiKey != "" {
+		req.Header.Set("apikey", apiKey)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("rates provider answered %s", resp.Status)
+	}
+	var body struct {
+		Rates map[string]float64 `json:"rates"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	if len(body.Rates) == 0 {
+		return nil, fmt.Errorf("rates provider returned no rates")
+	}
+	return &exchangeRates{Base: defaultCurrency, Rates: body.Rates, FetchedAt: time.Now()}, nil
+}
+
+// refreshRates loads the stored rates and, when they are older than ratesRefreshAge, fetches and
+// stores new ones. Every instance runs it; whichever fetches first saves the others the request.
+func refreshRates(ctx context.Context, providerURL, apiKey string) error {
+	collection := client.Database("MVDB").Collection("rates")
+	var stored exchangeRates
+	err := collection.FindOne(ctx, bson.M{"_id": defaultCurrency}).Decode(&stored)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return err
+	}
+	if err == nil {
+		currentRates.Store(&stored)
+		if time.Since(stored.FetchedAt) < ratesRefreshAge {
+			return nil
+		}
+	}
+	if providerURL == "" {
+		return nil
+	}
+
+	fetched, err := fetchRates(ctx, providerURL, apiKey)
+	if err != nil {
+		return err
+	}
+	_, err = collection.ReplaceOne(ctx, bson.M{"_id": fetched.Base}, fetched, options.Replace().SetUpsert(true))
+	if err != nil {
+		return err
+	}
+	currentRates.Store(fetched)
+	return nil
+}
+
+// scheduleRatesRefresh keeps currentRates up to date, refreshing at start and then every hour
+// (SCHEDULE_RATES_REFRESH) on every instance
+func scheduleRatesRefresh() {
+	providerURL, apiKey := os.Getenv("RATES_PROVIDER_URL"), os.Getenv("RATES_API_KEY")
+	if providerURL == "" {
+		log.Println("RATES_PROVIDER_URL is not set, display_currency uses the stored rates only")
+	}
+	registerTask(scheduledTask{
+		Name:       "rates_refresh",
+		Spec:       "0 * * * *",
+		Env:        "SCHEDULE_RATES_REFRESH",
+		Timeout:    30 * time.Second,
+		Local:      true,
+		RunAtStart: true,
+		Run: func(ctx context.Context) (string, error) {
+			if err := refreshRates(ctx, providerURL, apiKey); err != nil {
+				return "", err
+			}
+			if rates := currentRates.Load(); rates != nil {
+				return "rates fetched at " + rates.FetchedAt.Format(time.RFC3339), nil
+			}
+			return "no rates", nil
+		},
+	})
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/event"
+)
+
+// dbHealthTimeout bounds GET /admin/db-health as a whole, so a struggling database shows up as
+// errors in the report rather than as a dashboard that hangs
+const dbHealthTimeout = 800 * time.Millisecond
+
+// poolStats follows the driver's connection pools through the pool monitor attached in
+// connectMongoDB. The counters go to /metrics; the gauges derive from them.
+type poolStats struct {
+	checkouts        *metricCounter
+	checkoutFailures *metricCounter
+	created          *metricCounter
+	closed           *metricCounter
+	cleared          *metricCounter
+	wait             *metricHistogram
+
+	inUse       atomic.Int64
+	open        atomic.Int64
+	maxPoolSize atomic.Uint64
+}
+
+var mongoPool = newPoolStats()
+
+func newPoolStats() *poolStats {
+	p := &poolStats{
+		checkouts:        metrics.counter("mongo_pool_checkouts_total", "Connections checked out of the Mongo pool."),
+		checkoutFailures: metrics.counter("mongo_pool_checkout_failures_total", "Checkouts that failed, a timeout waiting for a free connection among them."),
+		created:          metrics.counter("mongo_pool_connections_created_total", "Connections the Mongo pool opened."),
+		closed:           metrics.counter("mongo_pool_connections_closed_total", "Connections the Mongo pool closed."),
+		cleared:          metrics.counter("mongo_pool_cleared_total", "Times a pool was cleared after a server error."),
+		wait: metrics.histogram("mongo_pool_checkout_wait_seconds", "Time spent waiting for a connection, failed checkouts included.",
+			[]float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}),
+	}
+	metrics.gauge("mongo_pool_connections_in_use", "Connections checked out right now.", func() float64 { return float64(p.inUse.Load()) })
+	metrics.gauge("mongo_pool_connections_open", "Connections open right now, idle or in use.", func() float64 { return float64(p.open.Load()) })
+	metrics.gauge("mongo_pool_max_size", "Largest number of connections a pool may open per server.", func() float64 { return float64(p.maxPoolSize.Load()) })
+	return p
+}
+
+func (p *poolStats) monitor() *event.PoolMonitor {
+	return &event.PoolMonitor{Event: func(e *event.PoolEvent) {
+		switch e.Type {
+		case event.PoolCreated:
+			if e.PoolOptions != nil {
+				p.maxPoolSize.Store(e.PoolOptions.MaxPoolSize)
+			}
+		case event.GetSucceeded:
+			p.checkouts.Inc()
+			p.inUse.Add(1)
+			p.wait.Observe(e.Duration.Seconds())
+		case event.GetFailed:
+			p.checkoutFailures.Inc()
+			p.wait.Observe(e.Duration.Seconds())
+		case event.ConnectionReturned:
+			p.inUse.Add(-1)
+		case event.ConnectionCreated:
+			p.created.Inc()
+			p.open.Add(1)
+		case event.ConnectionClosed:
+			p.closed.Inc()
+			p.open.Add(-1)
+		case event.PoolCleared:
+			p.cleared.Inc()
+		}
+	}}
+}
+
+// poolSnapshot is the pool part of GET /admin/db-health
+type poolSnapshot struct {
+	InUse            int64   `json:"in_use"`
+	Open             int64   `json:"open"`
+	MaxPoolSize      uint64  `json:"max_pool_size"`
+	Checkouts        uint64  `json:"checkouts"`
+	CheckoutFailures uint64  `json:"checkout_failures"`
+	Created          uint64  `json:"connections_created"`
+	Closed           uint64  `json:"connections_closed"`
+	Cleared          uint64  `json:"cleared"`
+	AvgWaitMs        float64 `json:"avg_wait_ms"`
+}
+
+func (p *poolStats) snapshot() poolSnapshot {
+	s := poolSnapshot{
+		InUse:            p.inUse.Load(),
+		Open:             p.open.Load(),
+		MaxPoolSize:      p.maxPoolSize.Load(),
+		Checkouts:        p.checkouts.n.Load(),
+		CheckoutFailures: p.checkoutFailures.n.Load(),
+		Created:          p.created.n.Load(),
+		Closed:           p.closed.n.Load(),
+		Cleared:          p.cleared.n.Load(),
+	}
+	p.wait.mu.Lock()
+	if p.wait.count > 0 {
+		s.AvgWaitMs = p.wait.sum / float64(p.wait.count) * 1000
+	}
+	p.wait.mu.Unlock()
+	return s
+}
+
+// collectionHealth is one collection in GET /admin/db-health. Documents is the count from the
+// collection metadata, which is cheap but may be slightly off after an unclean shutdown.
+type collectionHealth struct {
+	Name      string   `json:"name"`
+	Documents int64    `json:"documents"`
+	Indexes   []string `json:"indexes"`
+	Error     string   `json:"error,omitempty"`
+}
+
+// getDBHealth answers GET /admin/db-health with the pool, the ping latency and every collection of
+// MVDB with its document count and index names. Whatever doesn't answer within dbHealthTimeout is
+// reported as failed and the status is degraded; the driver error goes to the log with the request
+// id, since it names hosts. The response itself is always 200.
+func getDBHealth(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+
+	ctx, cancel := context.WithTimeout(r.Context(), dbHealthTimeout)
+	defer cancel()
+
+	report := struct {
+		Status      string             `json:"status"`
+		Pool        poolSnapshot       `json:"pool"`
+		PingMs      *float64           `json:"ping_ms,omitempty"`
+		PingError   string             `json:"ping_error,omitempty"`
+		Collections []collectionHealth `json:"collections"`
+		Error       string             `json:"error,omitempty"`
+	}{Status: "ok", Pool: mongoPool.snapshot(), Collections: []collectionHealth{}}
+
+	started := time.Now()
+	if err := client.Ping(ctx, nil); err != nil {
+		log.Printf("db-health ping failed (request %s): %v", requestID(r.Context()), err)
+		report.Status, report.PingError = "degraded", "Ping failed"
+	} else {
+		ms := float64(time.Since(started).Microseconds()) / 1000
+		report.PingMs = &ms
+	}
+
+	db := client.Database("MVDB")
+	names, err := db.ListCollectionNames(ctx, bson.M{})
+	if err != nil {
+		log.Printf("db-health failed to list collections (request %s): %v", requestID(r.Context()), err)
+		report.Status, report.Error = "degraded", "Failed to list collections"
+		json.NewEncoder(w).Encode(report)
+		return
+	}
+	sort.Strings(names)
+	report.Collections = make([]collectionHealth, len(names))
+	var wg sync.WaitGroup
+	for i, name := range names {
+		wg.Add(1)
+		go func(c *collectionHealth, name string) {
+			defer wg.Done()
+			c.Name, c.Indexes = name, []string{}
+			coll := db.Collection(name)
+			n, err := coll.EstimatedDocumentCount(ctx)
+			if err != nil {
+				log.Printf("db-health failed to count %s (request %s): %v", name, requestID(r.Context()), err)
+				c.Error = "Failed to count documents"
+				return
+			}
+			c.Documents = n
+			specs, err := coll.Indexes().ListSpecifications(ctx)
+			if err != nil {
+				log.Printf("db-health failed to list the indexes of %s (request %s): %v", name, requestID(r.Context()), err)
+				c.Error = "Failed to list indexes"
+				return
+			}
+			for _, spec := range specs {
+				c.Indexes = append(c.Indexes, spec.Name)
+			}
+		}(&report.Collections[i], name)
+	}
+	wg.Wait()
+	for _, c := range report.Collections {
+		if c.Error != "" {
+			report.Status = "degraded"
+		}
+	}
+	json.NewEncoder(w).Encode(report)
+}
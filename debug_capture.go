@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Debug capture keeps what a request sent and, when it failed, what it got back, so a report of a
+// failed request can be replayed from its X-Request-ID with GET /admin/requests/{request_id}. It is
+// off unless DEBUG_CAPTURE=true, which is ignored with ENV=production; there an admin opts a single
+// request in with X-Debug-Capture: true. Captures go to the capped request_captures collection, so
+// the oldest are dropped once it holds captureCollectionBytes.
+const (
+	captureCollection      = "request_captures"
+	captureCollectionBytes = 16 << 20
+	maxCapturedBodyBytes   = 16 << 10
+	captureHeader          = "X-Debug-Capture"
+	redactedValue          = "[redacted]"
+)
+
+var captureAll bool
+
+// requestCapture is one captured request. A body that isn't JSON or was cut at maxCapturedBodyBytes
+// can't be redacted field by field, so it is left out and RequestBodyOmitted or ResponseBodyOmitted
+// says why.
+type requestCapture struct {
+	ID                  primitive.ObjectID `json:"_id" bson:"_id"`
+	RequestID           string             `json:"request_id" bson:"request_id"`
+	Method              string             `json:"method" bson:"method"`
+	Path                string             `json:"path" bson:"path"`
+	Query               url.Values         `json:"query,omitempty" bson:"query,omitempty"`
+	Status              int                `json:"status" bson:"status"`
+	DurationMs          int64              `json:"duration_ms" bson:"duration_ms"`
+	RequestContentType  string             `json:"request_content_type,omitempty" bson:"request_content_type,omitempty"`
+	RequestBytes        int                `json:"request_bytes" bson:"request_bytes"`
+	RequestBody         interface{}        `json:"request_body,omitempty" bson:"request_body,omitempty"`
+	RequestBodyOmitted  string             `json:"request_body_omitted,omitempty" bson:"request_body_omitted,omitempty"`
+	ResponseContentType string             `json:"response_content_type,omitempty" bson:"response_content_type,omitempty"`
+	ResponseBody        interface{}        `json:"response_body,omitempty" bson:"response_body,omitempty"`
+	ResponseBodyOmitted string             `json:"response_body_omitted,omitempty" bson:"response_body_omitted,omitempty"`
+	At                  time.Time          `json:"at" bson:"at"`
+}
+
+// setupDebugCapture reads DEBUG_CAPTURE and creates the capped collection
+func setupDebugCapture() {
+	if os.Getenv("DEBUG_CAPTURE") == "true" {
+		if os.Getenv("ENV") == "production" {
+			log.Println("Ignoring DEBUG_CAPTURE=true with ENV=production, use the X-Debug-Capture header")
+		} else {
+			captureAll = true
+			log.Println("Debug capture is on for every request")
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err := client.Database("MVDB").CreateCollection(ctx, captureCollection,
+		options.CreateCollection().SetCapped(true).SetSizeInBytes(captureCollectionBytes))
+	var cmdErr mongo.CommandError
+	if err != nil && !(errors.As(err, &cmdErr) && cmdErr.Code == codeNamespaceExists) {
+		log.Println("Warning: could not create the", captureCollection, "collection:", err)
+	}
+}
+
+// wantsCapture reports whether r is captured: every request with DEBUG_CAPTURE, otherwise only
+// those of an admin asking for it. WebSocket upgrades are never captured, they take over the
+// connection.
+func wantsCapture(r *http.Request) bool {
+	if r.Header.Get("Upgrade") != "" {
+		return false
+	}
+	if captureAll {
+		return true
+	}
+	if r.Header.Get(captureHeader) != "true" {
+		return false
+	}
+	identity := callerKey(r)
+	return identity != nil && isOneOf(scopeAdmin, identity.Scopes)
+}
+
+// captureBodies is the debug capture middleware. It runs after withRequestID and
+// withAPIKeyIdentity, and reads at most maxCapturedBodyBytes of the request body ahead of the
+// handler, which still gets all of it.
+func captureBodies(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !wantsCapture(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		started := time.Now()
+		c := &requestCapture{
+			ID:                 primitive.NewObjectID(),
+			RequestID:          requestID(r.Context()),
+			Method:             r.Method,
+			Path:               r.URL.Path,
+			Query:              redactValues(r.URL.Query()),
+			RequestContentType: r.Header.Get("Content-Type"),
+			At:                 started,
+		}
+		if r.Body != nil && r.Body != http.NoBody {
+			head, err := io.ReadAll(io.LimitReader(r.Body, maxCapturedBodyBytes+1))
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(head), r.Body), r.Body}
+			c.RequestBytes = len(head)
+			switch {
+			case err != nil:
+				c.RequestBodyOmitted = "read failed"
+			case len(head) > maxCapturedBodyBytes:
+				c.RequestBodyOmitted = "larger than 16KB"
+			default:
+				c.RequestBody, c.RequestBodyOmitted = redactedBody(c.RequestContentType, head)
+			}
+		}
+
+		rec := &captureRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		c.Status = rec.status
+		c.DurationMs = time.Since(started).Milliseconds()
+		if rec.status < 200 || rec.status > 299 {
+			c.ResponseContentType = w.Header().Get("Content-Type")
+			if rec.overflow {
+				c.ResponseBodyOmitted = "larger than 16KB"
+			} else {
+				c.ResponseBody, c.ResponseBodyOmitted = redactedBody(c.ResponseContentType, rec.body.Bytes())
+			}
+		}
+		go storeCapture(c)
+	})
+}
+
+func storeCapture(c *requestCapture) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := client.Database("MVDB").Collection(captureCollection).InsertOne(ctx, c); err != nil {
+		log.Printf("Failed to store the debug capture of request %s: %v", c.RequestID, err)
+	}
+}
+
+// redactedBody is body as stored in a capture: JSON with its sensitive fields redacted, plain text
+// as it is, anything else left out with the reason
+func redactedBody(contentType string, body []byte) (interface{}, string) {
+	if len(body) == 0 {
+		return nil, ""
+	}
+	switch {
+	case strings.HasPrefix(contentType, "application/json"):
+		var v interface{}
+		if err := json.Unmarshal(body, &v); err != nil {
+			return nil, "invalid JSON"
+		}
+		return redactJSON(v), ""
+	case strings.HasPrefix(contentType, "text/plain"):
+		return string(body), ""
+	}
+	return nil, "not JSON"
+}
+
+// redactJSON walks a decoded JSON value and replaces the value of every sensitive key, at any
+// depth, with redactedValue
+func redactJSON(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, field := range v {
+			if sensitiveCaptureKey(k) {
+				out[k] = redactedValue
+			} else {
+				out[k] = redactJSON(field)
+			}
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, item := range v {
+			out[i] = redactJSON(item)
+		}
+		return out
+	}
+	return v
+}
+
+// redactValues redacts the sensitive keys of a query string like those of a JSON body
+func redactValues(values url.Values) url.Values {
+	if len(values) == 0 {
+		return nil
+	}
+	out := make(url.Values, len(values))
+	for k, vs := range values {
+		if sensitiveCaptureKey(k) {
+			vs = []string{redactedValue}
+		}
+		out[k] = vs
+	}
+	return out
+}
+
+// sensitiveCaptureKey matches Email, contact_email, phoneNumber, Phone_number, password and the like
+func sensitiveCaptureKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, word := range []string{"email", "phone", "password"} {
+		if strings.Contains(key, word) {
+			return true
+		}
+	}
+	return false
+}
+
+// captureRecorder passes the response through and keeps up to maxCapturedBodyBytes of its body
+type captureRecorder struct {
+	http.ResponseWriter
+	status   int
+	body     bytes.Buffer
+	overflow bool
+}
+
+func (c *captureRecorder) WriteHeader(status int) {
+	c.status = status
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *captureRecorder) Write(b []byte) (int, error) {
+	if !c.overflow {
+		if c.body.Len()+len(b) > maxCapturedBodyBytes {
+			c.overflow = true
+			c.body = bytes.Buffer{}
+		} else {
+			c.body.Write(b)
+		}
+	}
+	return c.ResponseWriter.Write(b)
+}
+
+func (c *captureRecorder) Flush() {
+	if f, ok := c.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// getRequestCapture answers GET /admin/requests/{request_id} with the captures of that request,
+// newest first; 404 when there are none
+func getRequestCapture(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	captures, err := findAllWith[requestCapture](ctx, captureCollection, bson.M{"request_id": mux.Vars(r)["request_id"]},
+		options.Find().SetSort(bson.D{{Key: "_id", Value: -1}}).SetLimit(20))
+	if err != nil {
+		serverError(w, r, "Failed to retrieve the request captures", err)
+		return
+	}
+	if len(captures) == 0 {
+		http.Error(w, "No capture of this request", http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(captures)
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestSensitiveCaptureKey(t *testing.T) {
+	for _, key := range []string{"email", "Email", "contact_email", "phoneNumber", "Phone_number", "password", "new_password", "EMAILS"} {
+		if !sensitiveCaptureKey(key) {
+			t.Errorf("%s isn't redacted", key)
+		}
+	}
+	for _, key := range []string{"name", "message", "Property_id", "price", "mail", "telegram"} {
+		if sensitiveCaptureKey(key) {
+			t.Errorf("%s is redacted", key)
+		}
+	}
+}
+
+// TestRedactJSON: keys are matched at any depth and inside arrays, and the whole value of a matched
+// key goes, whatever it holds; the decoded input is left as it was
+func TestRedactJSON(t *testing.T) {
+	var body interface{}
+	if err := json.Unmarshal([]byte(`{
+		"name": "Somchai",
+		"Email": "somchai@example.com",
+		"price": 25000,
+		"contacts": [
+			{"type": "owner", "phoneNumber": "081-234-5678"},
+			{"type": "agent", "contact_email": "agent@example.com", "tags": ["a", "b"]}
+		],
+		"profile": {"phone": {"mobile": "0812345678", "home": "021234567"}, "password": "hunter2", "verified": true},
+		"message": "reach me on 0812345678"
+	}`), &body); err != nil {
+		t.Fatal(err)
+	}
+	var want interface{}
+	json.Unmarshal([]byte(`{
+		"name": "Somchai",
+		"Email": "[redacted]",
+		"price": 25000,
+		"contacts": [
+			{"type": "owner", "phoneNumber": "[redacted]"},
+			{"type": "agent", "contact_email": "[redacted]", "tags": ["a", "b"]}
+		],
+		"profile": {"phone": "[redacted]", "password": "[redacted]", "verified": true},
+		"message": "reach me on 0812345678"
+	}`), &want)
+	if got := redactJSON(body); !reflect.DeepEqual(got, want) {
+		t.Errorf("redacted:\n%v\nwant\n%v", got, want)
+	}
+	if body.(map[string]interface{})["Email"] != "somchai@example.com" {
+		t.Error("the input was changed")
+	}
+	for _, v := range []interface{}{"a string", 3.5, nil, true, []interface{}{}} {
+		if got := redactJSON(v); !reflect.DeepEqual(got, v) {
+			t.Errorf("redactJSON(%v) = %v", v, got)
+		}
+	}
+}
+
+func TestRedactedBody(t *testing.T) {
+	tests := []struct {
+		contentType, body string
+		want              interface{}
+		omitted           string
+	}{
+		{"application/json; charset=utf-8", `{"email":"a@b.co","name":"A"}`, map[string]interface{}{"email": redactedValue, "name": "A"}, ""},
+		{"application/json", `[{"password":"x"}]`, []interface{}{map[string]interface{}{"password": redactedValue}}, ""},
+		{"application/json", `{"email":`, nil, "invalid JSON"},
+		{"text/plain; charset=utf-8", "Listing not found\n", "Listing not found\n", ""},
+		{"application/x-www-form-urlencoded", "email=a%40b.co", nil, "not JSON"},
+		{"multipart/form-data; boundary=x", "--x", nil, "not JSON"},
+		{"application/json", "", nil, ""},
+	}
+	for _, tt := range tests {
+		got, omitted := redactedBody(tt.contentType, []byte(tt.body))
+		if !reflect.DeepEqual(got, tt.want) || omitted != tt.omitted {
+			t.Errorf("%s %q: %v %q, want %v %q", tt.contentType, tt.body, got, omitted, tt.want, tt.omitted)
+		}
+	}
+}
+
+func TestRedactValues(t *testing.T) {
+	got := redactValues(url.Values{"email": {"a@b.co", "c@d.co"}, "q": {"condo"}, "Phone": {"081"}})
+	want := url.Values{"email": {redactedValue}, "q": {"condo"}, "Phone": {redactedValue}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("redacted %v, want %v", got, want)
+	}
+	if redactValues(url.Values{}) != nil {
+		t.Error("an empty query isn't left out")
+	}
+}
+
+func useCaptureAll(t *testing.T, on bool) {
+	prev := captureAll
+	captureAll = on
+	t.Cleanup(func() { captureAll = prev })
+}
+
+func TestWantsCapture(t *testing.T) {
+	useTestKeys(t)
+	cacheTestAPIKey(t, "partner-key", "read", "write")
+	useCaptureAll(t, false)
+	request := func(key, capture string) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/listings", nil)
+		if key != "" {
+			r.Header.Set("X-API-Key", key)
+		}
+		if capture != "" {
+			r.Header.Set(captureHeader, capture)
+		}
+		return r
+	}
+	for _, tt := range []struct {
+		key, capture string
+		want         bool
+	}{
+		{"", "", false},
+		{"", "true", false}, // anyone can send the header
+		{"partner-key", "true", false},
+		{"test-shared-key", "", false},
+		{"test-shared-key", "1", false},
+		{"test-shared-key", "true", true},
+	} {
+		if got := wantsCapture(request(tt.key, tt.capture)); got != tt.want {
+			t.Errorf("key %q, %s %q: %v", tt.key, captureHeader, tt.capture, got)
+		}
+	}
+
+	useCaptureAll(t, true)
+	if !wantsCapture(request("", "")) {
+		t.Error("DEBUG_CAPTURE=true doesn't capture every request")
+	}
+	upgrade := request("test-shared-key", "true")
+	upgrade.Header.Set("Upgrade", "websocket")
+	if wantsCapture(upgrade) {
+		t.Error("a WebSocket upgrade is captured")
+	}
+}
+
+// TestDebugCaptureOffInProduction: DEBUG_CAPTURE is ignored with ENV=production
+func TestDebugCaptureOffInProduction(t *testing.T) {
+	unreachableMongo(t)
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	for env, want := range map[string]bool{"production": false, "staging": true, "": true} {
+		useCaptureAll(t, false)
+		t.Setenv("DEBUG_CAPTURE", "true")
+		t.Setenv("ENV", env)
+		setupDebugCapture()
+		if captureAll != want {
+			t.Errorf("ENV=%q: capturing every request is %v", env, captureAll)
+		}
+	}
+	useCaptureAll(t, false)
+	t.Setenv("DEBUG_CAPTURE", "")
+	t.Setenv("ENV", "")
+	setupDebugCapture()
+	if captureAll {
+		t.Error("capture is on by default")
+	}
+}
+
+func TestCaptureRecorder(t *testing.T) {
+	rec := &captureRecorder{ResponseWriter: httptest.NewRecorder(), status: http.StatusOK}
+	rec.Write([]byte(strings.Repeat("a", maxCapturedBodyBytes)))
+	if rec.overflow || rec.body.Len() != maxCapturedBodyBytes {
+		t.Fatalf("at the limit: overflow %v, %d bytes", rec.overflow, rec.body.Len())
+	}
+	rec.Write([]byte("b"))
+	rec.Write([]byte("c"))
+	if !rec.overflow || rec.body.Len() != 0 {
+		t.Errorf("past the limit: overflow %v, %d bytes kept", rec.overflow, rec.body.Len())
+	}
+	if n := rec.ResponseWriter.(*httptest.ResponseRecorder).Body.Len(); n != maxCapturedBodyBytes+2 {
+		t.Errorf("the client got %d bytes", n)
+	}
+}
+
+// TestCaptureBodies sends a failing JSON request and a large one through the middleware: the handler
+// reads both bodies whole, and the stored captures are redacted and retrievable by request id
+func TestCaptureBodies(t *testing.T) {
+	useTestMongo(t, captureCollection)
+	useCaptureAll(t, true)
+	var handlerGot []string
+	handler := withRequestID(captureBodies(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		handlerGot = append(handlerGot, string(body))
+		if r.URL.Path == "/add/inquiry" {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			w.Write([]byte(`{"error":"Property not found","email":"buyer@example.com"}`))
+		}
+	})))
+
+	failing := `{"property_id":"abc","message":"Hi","email":"buyer@example.com","phone":"0812345678"}`
+	large := `{"description":"` + strings.Repeat("x", maxCapturedBodyBytes) + `"}`
+	ids := map[string]string{}
+	for path, body := range map[string]string{"/add/inquiry?email=buyer%40example.com": failing, "/listings": large} {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		ids[strings.Split(path, "?")[0]] = rec.Header().Get("X-Request-ID")
+	}
+	if len(handlerGot) != 2 || (handlerGot[0] != failing && handlerGot[1] != failing) || (len(handlerGot[0]) != len(large) && len(handlerGot[1]) != len(large)) {
+		t.Fatalf("the handler didn't get the whole bodies")
+	}
+
+	fetch := func(requestID string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/admin/requests/"+requestID, nil)
+		rec := httptest.NewRecorder()
+		getRequestCapture(rec, mux.SetURLVars(req, map[string]string{"request_id": requestID}))
+		return rec
+	}
+	var captures []requestCapture
+	deadline := time.Now().Add(5 * time.Second)
+	for { // stored in the background
+		if rec := fetch(ids["/add/inquiry"]); rec.Code == http.StatusOK {
+			if err := json.NewDecoder(rec.Body).Decode(&captures); err != nil {
+				t.Fatal(err)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the capture wasn't stored")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	c := captures[0]
+	wantRequest := map[string]interface{}{"property_id": "abc", "message": "Hi", "email": redactedValue, "phone": redactedValue}
+	wantResponse := map[string]interface{}{"error": "Property not found", "email": redactedValue}
+	if c.Status != http.StatusUnprocessableEntity || !reflect.DeepEqual(c.RequestBody, wantRequest) || !reflect.DeepEqual(c.ResponseBody, wantResponse) ||
+		c.Query.Get("email") != redactedValue || c.Method != http.MethodPost || c.Path != "/add/inquiry" {
+		t.Errorf("capture %+v", c)
+	}
+
+	var stored requestCapture
+	for time.Now().Before(deadline) {
+		if err := client.Database("MVDB").Collection(captureCollection).FindOne(context.Background(), bson.M{"request_id": ids["/listings"]}).Decode(&stored); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if stored.RequestBodyOmitted != "larger than 16KB" || stored.RequestBody != nil || stored.ResponseBody != nil || stored.Status != http.StatusOK {
+		t.Errorf("large request %+v", stored)
+	}
+	if rec := fetch("no-such-request"); rec.Code != http.StatusNotFound {
+		t.Errorf("an unknown request id: %d", rec.Code)
+	}
+}
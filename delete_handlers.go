@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// deleteListing soft-deletes a listing and cancels its scheduled appointments; responds with the deletion report
+func deleteListing(w http.ResponseWriter, r *http.Request) {
+	deleteWithCascade(w, r, "listings", "Listing", deleteListingCascade)
+}
+
+// deleteProperty soft-deletes a property, its listings and their appointments, and archives its inquiries
+func deleteProperty(w http.ResponseWriter, r *http.Request) {
+	deleteWithCascade(w, r, "properties", "Property", deletePropertyCascade)
+}
+
+// deleteUser soft-deletes a user
+func deleteUser(w http.ResponseWriter, r *http.Request) {
+	deleteWithCascade(w, r, "users", "User", deleteUserCascade)
+}
+
+func deleteWithCascade(w http.ResponseWriter, r *http.Request, collectionName, entity string, cascade func(context.Context, primitive.ObjectID) (*deletionReport, error)) {
+	w.Header().Set("Content-Type", "application/json")
+
+	id, ok := pathObjectID(w, r, entity)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 15*time.Second)
+	defer cancel()
+
+	before := auditSnapshot(ctx, collectionName, id)
+	report, err := cascade(ctx, id)
+	if err == errDocumentNotFound {
+		http.Error(w, entity+" not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to delete "+entity, http.StatusInternalServerError)
+		return
+	}
+	// The report lists the appointments, inquiries and listings touched along with the document
+	recordAudit(auditFromRequest(r), "delete", collectionName, id.Hex(), before, auditSnapshot(ctx, collectionName, id), report)
+	go notifyCancelledAppointments(report)
+	json.NewEncoder(w).Encode(report)
+}
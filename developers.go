@@ -0,0 +1,523 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	maxDeveloperNameLength        = 100  // characters
+	maxDeveloperDescriptionLength = 2000 // characters
+	minDeveloperFoundedYear       = 1800
+)
+
+// Developer is the company behind a property. Properties reference it by developer_id and keep the
+// name in their legacy developer string, the one listings and brochures display; renaming or
+// merging a developer rewrites that string too.
+type Developer struct {
+	ID          primitive.ObjectID `bson:"_id,omitempty" json:"developer_id,omitempty"`
+	Name        string             `bson:"name" json:"name"`
+	Logo        string             `bson:"logo,omitempty" json:"logo,omitempty"`       // https URL
+	Website     string             `bson:"website,omitempty" json:"website,omitempty"` // http or https URL
+	Description string             `bson:"description,omitempty" json:"description,omitempty"`
+	FoundedYear int                `bson:"founded_year,omitempty" json:"founded_year,omitempty"`
+	CreatedAt   time.Time          `bson:"created_at" json:"created_at"`
+	UpdatedAt   time.Time          `bson:"updated_at" json:"updated_at"`
+	DeletedAt   *time.Time         `bson:"deleted_at,omitempty" json:"deleted_at,omitempty"`
+}
+
+// developerUpdate is the body of POST /developers and PUT /developers/{id}; absent fields are left unchanged
+type developerUpdate struct {
+	Name        *string `json:"name"`
+	Logo        *string `json:"logo"`
+	Website     *string `json:"website"`
+	Description *string `json:"description"`
+	FoundedYear *int    `json:"founded_year"`
+}
+
+var (
+	errInvalidDeveloperID = errors.New("Invalid DeveloperID format")
+	errDeveloperNotFound  = errors.New("DeveloperID does not exist")
+)
+
+// apply copies the given fields onto developer and returns them as a $set document
+func (u developerUpdate) apply(developer *Developer) bson.M {
+	set := bson.M{}
+	if u.Name != nil {
+		developer.Name = strings.Join(strings.Fields(*u.Name), " ")
+		set["name"] = developer.Name
+	}
+	if u.Logo != nil {
+		developer.Logo = strings.TrimSpace(*u.Logo)
+		set["logo"] = developer.Logo
+	}
+	if u.Website != nil {
+		developer.Website = strings.TrimSpace(*u.Website)
+		set["website"] = developer.Website
+	}
+	if u.Description != nil {
+		developer.Description = strings.TrimSpace(*u.Description)
+		set["description"] = developer.Description
+	}
+	if u.FoundedYear != nil {
+		developer.FoundedYear = *u.FoundedYear
+		set["founded_year"] = developer.FoundedYear
+	}
+	return set
+}
+
+func validateDeveloper(developer *Developer) []string {
+	var problems []string
+	if developer.Name == "" || utf8.RuneCountInString(developer.Name) > maxDeveloperNameLength {
+		problems = append(problems, "name is required and must be at most 100 characters")
+	}
+	if developer.Logo != "" {
+		if u, err := url.Parse(developer.Logo); err != nil || u.Scheme != "https" || u.Host == "" {
+			problems = append(problems, "logo must be an https URL")
+		}
+	}
+	if developer.Website != "" {
+		if u, err := url.Parse(developer.Website); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems = append(problems, "website must be an http or https URL")
+		}
+	}
+	if utf8.RuneCountInString(developer.Description) > maxDeveloperDescriptionLength {
+		problems = append(problems, "description must be at most 2000 characters")
+	}
+	if developer.FoundedYear != 0 && (developer.FoundedYear < minDeveloperFoundedYear || developer.FoundedYear > time.Now().Year()) {
+		problems = append(problems, fmt.Sprintf("founded_year must be between %d and this year", minDeveloperFoundedYear))
+	}
+	return problems
+}
+
+// developerNameTaken reports whether another developer that isn't deleted has name, ignoring case
+func developerNameTaken(ctx context.Context, name string, except primitive.ObjectID) (bool, error) {
+	n, err := client.Database("MVDB").Collection("developers").CountDocuments(ctx, notDeleted(bson.M{"name": name, "_id": bson.M{"$ne": except}}),
+		options.Count().SetCollation(emailCollation))
+	return n > 0, err
+}
+
+// linkDeveloper checks the DeveloperID of a property being written and copies the developer's name
+// to its Developer string. An unknown or malformed id is returned as a problem, like the other
+// validation failures; only a failed lookup is an error.
+func linkDeveloper(ctx context.Context, property *Property) ([]string, error) {
+	if property.DeveloperID == "" {
+		return nil, nil
+	}
+	id, err := primitive.ObjectIDFromHex(property.DeveloperID)
+	if err != nil {
+		return []string{errInvalidDeveloperID.Error()}, nil
+	}
+	var developer Developer
+	err = client.Database("MVDB").Collection("developers").FindOne(ctx, notDeleted(bson.M{"_id": id}),
+		options.FindOne().SetProjection(bson.M{"name": 1})).Decode(&developer)
+	if err == mongo.ErrNoDocuments {
+		return []string{errDeveloperNotFound.Error()}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	property.Developer = developer.Name
+	return nil, nil
+}
+
+// findDeveloper answers 404 or 500 and returns false when the developer of the {id} path isn't there
+func findDeveloper(w http.ResponseWriter, r *http.Request, ctx context.Context, id primitive.ObjectID) (Developer, bool) {
+	var developer Developer
+	err := client.Database("MVDB").Collection("developers").FindOne(ctx, notDeleted(bson.M{"_id": id})).Decode(&developer)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Developer not found", http.StatusNotFound)
+		return developer, false
+	}
+	if err != nil {
+		serverError(w, r, "Failed to retrieve Developer", err)
+		return developer, false
+	}
+	return developer, true
+}
+
+// getDevelopers lists the developers by name. Until the first developer record exists, which the
+// developers migration creates, it answers the distinct developer strings of the properties instead,
+// without ids, and X-Developers-Source tells which of the two it is.
+func getDevelopers(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	collection := client.Database("MVDB").Collection("developers")
+	populated, err := collection.CountDocuments(ctx, bson.M{}, options.Count().SetLimit(1))
+	if err != nil {
+		serverError(w, r, "Failed to retrieve Developers", err)
+		return
+	}
+	if populated == 0 {
+		names, err := client.Database("MVDB").Collection("properties").Distinct(ctx, "developer", notDeleted(bson.M{"developer": bson.M{"$nin": bson.A{"", nil}}}))
+		if err != nil {
+			serverError(w, r, "Failed to retrieve Developers", err)
+			return
+		}
+		developers := make([]Developer, 0, len(names))
+		for _, name := range names {
+			if s, ok := name.(string); ok {
+				developers = append(developers, Developer{Name: s})
+			}
+		}
+		sort.Slice(developers, func(i, j int) bool { return developers[i].Name < developers[j].Name })
+		w.Header().Set("X-Developers-Source", "properties")
+		json.NewEncoder(w).Encode(developers)
+		return
+	}
+
+	developers, err := findAllWith[Developer](ctx, "developers", notDeleted(bson.M{}),
+		options.Find().SetSort(bson.D{{Key: "name", Value: 1}}).SetCollation(emailCollation))
+	if err != nil {
+		serverError(w, r, "Failed to retrieve Developers", err)
+		return
+	}
+	w.Header().Set("X-Developers-Source", "developers")
+	json.NewEncoder(w).Encode(developers)
+}
+
+func getDeveloper(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	id, ok := pathObjectID(w, r, "Developer")
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	developer, ok := findDeveloper(w, r, ctx, id)
+	if !ok {
+		return
+	}
+	json.NewEncoder(w).Encode(developer)
+}
+
+func createDeveloper(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var body developerUpdate
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Failed to parse request body", http.StatusBadRequest)
+		return
+	}
+	var developer Developer
+	body.apply(&developer)
+	if problems := validateDeveloper(&developer); len(problems) > 0 {
+		http.Error(w, (&validationError{Problems: problems}).Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	if taken, err := developerNameTaken(ctx, developer.Name, primitive.NilObjectID); err != nil {
+		serverError(w, r, "Failed to create Developer", err)
+		return
+	} else if taken {
+		http.Error(w, "A developer with this name already exists", http.StatusConflict)
+		return
+	}
+	developer.CreatedAt = time.Now()
+	developer.UpdatedAt = developer.CreatedAt
+	result, err := client.Database("MVDB").Collection("developers").InsertOne(ctx, developer)
+	if err != nil {
+		serverError(w, r, "Failed to create Developer", err)
+		return
+	}
+	developer.ID = result.InsertedID.(primitive.ObjectID)
+	auditCreated(auditFromRequest(r), "developers", developer.ID, developer)
+	writeCreated(w, "/developers/"+developer.ID.Hex(), developer, nil)
+}
+
+// updateDeveloper applies a partial update; a new name is copied to the developer string of its
+// properties
+func updateDeveloper(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	id, ok := pathObjectID(w, r, "Developer")
+	if !ok {
+		return
+	}
+	var body developerUpdate
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Failed to parse request body", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	developer, ok := findDeveloper(w, r, ctx, id)
+	if !ok {
+		return
+	}
+	before := developer
+	set := body.apply(&developer)
+	if problems := validateDeveloper(&developer); len(problems) > 0 {
+		http.Error(w, (&validationError{Problems: problems}).Error(), http.StatusBadRequest)
+		return
+	}
+	if len(set) == 0 {
+		json.NewEncoder(w).Encode(developer)
+		return
+	}
+	if !strings.EqualFold(developer.Name, before.Name) {
+		if taken, err := developerNameTaken(ctx, developer.Name, id); err != nil {
+			serverError(w, r, "Failed to update Developer", err)
+			return
+		} else if taken {
+			http.Error(w, "A developer with this name already exists", http.StatusConflict)
+			return
+		}
+	}
+
+	developer.UpdatedAt = time.Now()
+	set["updated_at"] = developer.UpdatedAt
+	db := client.Database("MVDB")
+	res, err := db.Collection("developers").UpdateOne(ctx, notDeleted(bson.M{"_id": id}), bson.M{"$set": set})
+	if err != nil {
+		serverError(w, r, "Failed to update Developer", err)
+		return
+	}
+	if res.MatchedCount == 0 {
+		http.Error(w, "Developer not found", http.StatusNotFound)
+		return
+	}
+	recordAudit(auditFromRequest(r), "update", "developers", id.Hex(), before, developer, nil)
+	if developer.Name != before.Name {
+		_, err := db.Collection("properties").UpdateMany(ctx, bson.M{"developer_id": id.Hex()},
+			bson.M{"$set": bson.M{"developer": developer.Name, "updated_at": developer.UpdatedAt}})
+		if err != nil {
+			serverError(w, r, "Renamed the Developer, then failed to rename it on its Properties", err)
+			return
+		}
+		invalidateResponses("properties")
+	}
+	json.NewEncoder(w).Encode(developer)
+}
+
+// deleteDeveloper soft-deletes a developer without properties; one with properties is merged into
+// another developer instead
+func deleteDeveloper(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	id, ok := pathObjectID(w, r, "Developer")
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	linked, err := client.Database("MVDB").Collection("properties").CountDocuments(ctx, notDeleted(bson.M{"developer_id": id.Hex()}))
+	if err != nil {
+		serverError(w, r, "Failed to check the Developer's Properties", err)
+		return
+	}
+	if linked > 0 {
+		http.Error(w, fmt.Sprintf("The developer has %d properties, merge it into another developer with POST /admin/developers/{id}/merge", linked), http.StatusConflict)
+		return
+	}
+	before := auditSnapshot(ctx, "developers", id)
+	res, err := softDelete(ctx, "developers", bson.M{"_id": id}, time.Now())
+	if err != nil {
+		serverError(w, r, "Failed to delete Developer", err)
+		return
+	}
+	if res.MatchedCount == 0 {
+		http.Error(w, "Developer not found", http.StatusNotFound)
+		return
+	}
+	recordAudit(auditFromRequest(r), "delete", "developers", id.Hex(), before, auditSnapshot(ctx, "developers", id), nil)
+	json.NewEncoder(w).Encode(bson.M{"message": "Developer deleted"})
+}
+
+// getDeveloperProperties answers GET /developers/{id}/properties, sorted by title
+func getDeveloperProperties(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	id, ok := pathObjectID(w, r, "Developer")
+	if !ok {
+		return
+	}
+	page, ok := parseListPage(w, r)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	if _, ok := findDeveloper(w, r, ctx, id); !ok {
+		return
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "title", Value: 1}, {Key: "_id", Value: 1}})
+	if page.Limit > 0 {
+		opts.SetSkip(page.Skip).SetLimit(page.Limit)
+	}
+	properties, err := findAllWith[Property](ctx, "properties", notDeleted(bson.M{"developer_id": id.Hex()}), opts)
+	if err != nil {
+		serverError(w, r, "Failed to retrieve Properties", err)
+		return
+	}
+	json.NewEncoder(w).Encode(properties)
+}
+
+// mergeDevelopers answers POST /admin/developers/{id}/merge with {"into": "<developer_id>"}: the
+// properties of {id} move to the other developer, taking its name, and {id} is soft-deleted. It is
+// how duplicates like "AP Thai" and "AP (Thailand)" are cleaned up.
+func mergeDevelopers(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	id, ok := pathObjectID(w, r, "Developer")
+	if !ok {
+		return
+	}
+	var body struct {
+		Into string `json:"into"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Failed to parse request body", http.StatusBadRequest)
+		return
+	}
+	into, err := primitive.ObjectIDFromHex(body.Into)
+	if err != nil {
+		http.Error(w, "into must be a developer_id", http.StatusBadRequest)
+		return
+	}
+	if into == id {
+		http.Error(w, "A developer can't be merged into itself", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	from, ok := findDeveloper(w, r, ctx, id)
+	if !ok {
+		return
+	}
+	var target Developer
+	err = client.Database("MVDB").Collection("developers").FindOne(ctx, notDeleted(bson.M{"_id": into})).Decode(&target)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "The developer to merge into was not found", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		serverError(w, r, "Failed to retrieve Developer", err)
+		return
+	}
+
+	now := time.Now()
+	res, err := client.Database("MVDB").Collection("properties").UpdateMany(ctx, bson.M{"developer_id": id.Hex()},
+		bson.M{"$set": bson.M{"developer_id": into.Hex(), "developer": target.Name, "updated_at": now}})
+	if err != nil {
+		serverError(w, r, "Failed to move the Developer's Properties", err)
+		return
+	}
+	invalidateResponses("properties")
+	meta := auditFromRequest(r)
+	recordAudit(meta, "merge", "developers", id.Hex(), nil, nil, bson.M{"into": into.Hex(), "moved": res.ModifiedCount})
+	if _, err := softDelete(ctx, "developers", bson.M{"_id": id}, now); err != nil {
+		serverError(w, r, fmt.Sprintf("Moved %d Properties, then failed to delete the merged Developer", res.ModifiedCount), err)
+		return
+	}
+	recordAudit(meta, "delete", "developers", id.Hex(), from, auditSnapshot(ctx, "developers", id), bson.M{"merged_into": into.Hex()})
+	json.NewEncoder(w).Encode(bson.M{"moved": res.ModifiedCount, "into": target})
+}
+
+// developerKey is what the developers migration takes to be the same company: the name without case,
+// punctuation or repeated spaces. "AP (Thailand)" and "AP Thai" stay apart, they are merged by hand.
+func developerKey(name string) string {
+	return strings.Join(strings.Fields(strings.Map(func(r rune) rune {
+		if strings.ContainsRune(".,()'\"-&", r) {
+			return ' '
+		}
+		return r
+	}, strings.ToLower(name))), " ")
+}
+
+// backfillDevelopers is `migrate developers`: one developer record per distinct developer string,
+// named after its most common spelling, and developer_id set on the properties that have none. A
+// record that already has the name is reused, so the migration can run again.
+func backfillDevelopers(ctx context.Context, args []string) error {
+	db := client.Database("MVDB")
+	cur, err := db.Collection("properties").Aggregate(ctx, []bson.M{
+		{"$match": bson.M{"developer": bson.M{"$nin": bson.A{"", nil}}, "developer_id": bson.M{"$in": bson.A{"", nil}}}},
+		{"$group": bson.M{"_id": "$developer", "count": bson.M{"$sum": 1}}},
+	})
+	if err != nil {
+		return fmt.Errorf("properties: %w", err)
+	}
+	var spellings []struct {
+		Name  string `bson:"_id"`
+		Count int    `bson:"count"`
+	}
+	if err := cur.All(ctx, &spellings); err != nil {
+		return fmt.Errorf("properties: %w", err)
+	}
+
+	groups := map[string][]string{} // developerKey to its spellings, most common first
+	counts := map[string]int{}
+	for _, s := range spellings {
+		key := developerKey(s.Name)
+		if key == "" {
+			continue
+		}
+		groups[key] = append(groups[key], s.Name)
+		counts[s.Name] = s.Count
+	}
+	created, linked := 0, int64(0)
+	for _, names := range groups {
+		sort.Slice(names, func(i, j int) bool {
+			if counts[names[i]] != counts[names[j]] {
+				return counts[names[i]] > counts[names[j]]
+			}
+			return names[i] < names[j]
+		})
+		name := strings.Join(strings.Fields(names[0]), " ")
+
+		var developer Developer
+		err := db.Collection("developers").FindOne(ctx, notDeleted(bson.M{"name": name}), options.FindOne().SetCollation(emailCollation)).Decode(&developer)
+		if err == mongo.ErrNoDocuments {
+			developer = Developer{Name: name, CreatedAt: time.Now()}
+			developer.UpdatedAt = developer.CreatedAt
+			res, err := db.Collection("developers").InsertOne(ctx, developer)
+			if err != nil {
+				return fmt.Errorf("developers %q: %w", name, err)
+			}
+			developer.ID = res.InsertedID.(primitive.ObjectID)
+			created++
+		} else if err != nil {
+			return fmt.Errorf("developers %q: %w", name, err)
+		}
+		res, err := db.Collection("properties").UpdateMany(ctx,
+			bson.M{"developer": bson.M{"$in": names}, "developer_id": bson.M{"$in": bson.A{"", nil}}},
+			bson.M{"$set": bson.M{"developer_id": developer.ID.Hex()}})
+		if err != nil {
+			return fmt.Errorf("properties of %q: %w", name, err)
+		}
+		linked += res.ModifiedCount
+	}
+	log.Printf("developers: %d created from %d spellings, %d properties linked", created, len(spellings), linked)
+	return nil
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// defaultDigestCron sends the digest at 07:00 Bangkok time
+const defaultDigestCron = "0 7 * * *"
+
+var digestTemplate = template.Must(template.New("digest").Funcs(template.FuncMap{
+	"clock": func(t time.Time) string { return t.In(bangkok).Format("15:04") },
+	"day":   func(t time.Time) string { return t.In(bangkok).Format("Mon 2 Jan 15:04") },
+}).Parse(`<!DOCTYPE html>
+<html>
+<body style="font-family: sans-serif">
+<h2>Good morning {{.Agent.Name}}</h2>
+<p>Your summary for {{.Date.Format "Monday 2 January 2006"}}.</p>
+
+<h3>New inquiries ({{len .Inquiries}})</h3>
+{{if .Inquiries}}<ul>
+{{range .Inquiries}}<li><b>{{.Property}}</b>, {{day .CreatedAt}}<br>{{.Message}}</li>
+{{end}}</ul>{{else}}<p>No new inquiries in the last 24 hours.</p>{{end}}
+
+<h3>Appointments today ({{len .Appointments}})</h3>
+{{if .Appointments}}<ul>
+{{range .Appointments}}<li>{{clock .At}} <b>{{.Property}}</b></li>
+{{end}}</ul>{{else}}<p>No appointments today.</p>{{end}}
+</body>
+</html>
+`))
+
+type digestInquiry struct {
+	Property  string
+	Message   string
+	CreatedAt time.Time
+}
+
+type digestAppointment struct {
+	Property string
+	At       time.Time
+}
+
+type digest struct {
+	Agent        Agent
+	Date         time.Time
+	Inquiries    []digestInquiry
+	Appointments []digestAppointment
+}
+
+func (d *digest) empty() bool {
+	return len(d.Inquiries) == 0 && len(d.Appointments) == 0
+}
+
+// buildDigest gathers the inquiries assigned to the agent in the 24 hours before now and the
+// appointments on the agent's listings on now's day, in Bangkok time
+func buildDigest(ctx context.Context, agent Agent, now time.Time) (*digest, error) {
+	today := truncatePeriod(now, "day", bangkok)
+	d := &digest{Agent: agent, Date: today}
+
+	inquiries, err := findAll[Inquiry](ctx, "inquiries", bson.M{
+		"assigned_agent_id": agent.ID.Hex(),
+		"assigned_at":       bson.M{"$gte": now.Add(-24 * time.Hour), "$lt": now},
+		"archived_at":       bson.M{"$exists": false},
+	})
+	if err != nil {
+		return nil, err
+	}
+	listings, err := findAll[Listing](ctx, "listings", notDeleted(bson.M{"agent_id": agent.ID.Hex()}))
+	if err != nil {
+		return nil, err
+	}
+	listingIDs := make([]string, len(listings))
+	for i, l := range listings {
+		listingIDs[i] = l.ID.Hex()
+	}
+	appointments, err := findAll[Appointment](ctx, "appointments", bson.M{
+		"listing_id":       bson.M{"$in": listingIDs},
+		"status":           bson.M{"$in": openAppointmentStatuses},
+		"appointment_date": bson.M{"$gte": today, "$lt": today.AddDate(0, 0, 1)},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var propertyIDs []primitive.ObjectID
+	for _, hex := range append(propertyIDsOf(inquiries, func(i Inquiry) string { return i.Property_id }),
+		propertyIDsOf(appointments, func(a Appointment) string { return a.PropertyID })...) {
+		if oid, err := primitive.ObjectIDFromHex(hex); err == nil {
+			propertyIDs = append(propertyIDs, oid)
+		}
+	}
+	titles := map[string]string{}
+	if len(propertyIDs) > 0 {
+		properties, err := findAll[Property](ctx, "properties", bson.M{"_id": bson.M{"$in": propertyIDs}})
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range properties {
+			titles[p.ID.Hex()] = p.Title
+		}
+	}
+
+	for _, i := range inquiries {
+		d.Inquiries = append(d.Inquiries, digestInquiry{Property: titles[i.Property_id], Message: i.Message, CreatedAt: i.CreatedAt})
+	}
+	for _, a := range appointments {
+		d.Appointments = append(d.Appointments, digestAppointment{Property: titles[a.PropertyID], At: a.AppointmentDate})
+	}
+	return d, nil
+}
+
+func propertyIDsOf[T any](docs []T, id func(T) string) []string {
+	ids := make([]string, len(docs))
+	for i, d := range docs {
+		ids[i] = id(d)
+	}
+	return ids
+}
+
+func renderDigest(d *digest) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := digestTemplate.Execute(&buf, d); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// sendDigests emails every active agent their digest. Each agent is claimed by moving digest_sent_at
+// into today before sending, so a rerun, or a second instance running the same job, skips them. The
+// marker is put back when sending fails so the next run retries.
+func sendDigests(ctx context.Context, now time.Time) (sent int, err error) {
+	today := truncatePeriod(now, "day", bangkok)
+	agents, err := findAll[Agent](ctx, "agents", notDeleted(bson.M{"active": true}))
+	if err != nil {
+		return 0, err
+	}
+	collection := client.Database("MVDB").Collection("agents")
+	for _, agent := range agents {
+		d, err := buildDigest(ctx, agent, now)
+		if err != nil {
+			log.Println("Failed to build digest for agent", agent.ID.Hex(), ":", err)
+			continue
+		}
+		if d.empty() {
+			continue
+		}
+		html, err := renderDigest(d)
+		if err != nil {
+			log.Println("Failed to render digest for agent", agent.ID.Hex(), ":", err)
+			continue
+		}
+
+		var previous struct {
+			SentAt *time.Time `bson:"digest_sent_at"`
+		}
+		err = collection.FindOneAndUpdate(ctx,
+			bson.M{"_id": agent.ID, "$or": bson.A{
+				bson.M{"digest_sent_at": bson.M{"$exists": false}},
+				bson.M{"digest_sent_at": bson.M{"$lt": today}},
+			}},
+			bson.M{"$set": bson.M{"digest_sent_at": now}},
+		).Decode(&previous)
+		if err == mongo.ErrNoDocuments {
+			continue // already sent today
+		}
+		if err != nil {
+			log.Println("Failed to claim digest for agent", agent.ID.Hex(), ":", err)
+			continue
+		}
+
+		if err := mailer.Send(ctx, agent.Email, "Your daily summary", string(html)); err != nil {
+			log.Println("Failed to send digest to agent", agent.ID.Hex(), ":", err)
+			restore := bson.M{"$unset": bson.M{"digest_sent_at": ""}}
+			if previous.SentAt != nil {
+				restore = bson.M{"$set": bson.M{"digest_sent_at": *previous.SentAt}}
+			}
+			if _, err := collection.UpdateOne(ctx, bson.M{"_id": agent.ID}, restore); err != nil {
+				log.Println("Failed to reset digest_sent_at of agent", agent.ID.Hex(), ":", err)
+			}
+			continue
+		}
+		sent++
+	}
+	return sent, nil
+}
+
+// scheduleDigests schedules sendDigests on DIGEST_CRON (standard 5-field cron, Bangkok time,
+// default 0 7 * * *). DIGEST_CRON=off disables the job.
+func scheduleDigests() {
+	registerTask(scheduledTask{
+		Name:    "digests",
+		Spec:    defaultDigestCron,
+		Env:     "DIGEST_CRON",
+		Timeout: 10 * time.Minute,
+		Run: func(ctx context.Context) (string, error) {
+			n, err := sendDigests(ctx, time.Now())
+			return fmt.Sprintf("sent %d agent digests", n), err
+		},
+	})
+}
+
+// previewDigest renders ?agent_id='s digest as it would be sent now, without sending it or
+// touching digest_sent_at
+func previewDigest(w http.ResponseWriter, r *http.Request) {
+	id, err := primitive.ObjectIDFromHex(r.URL.Query().Get("agent_id"))
+	if err != nil {
+		http.Error(w, "Invalid Agent ID format", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	var agent Agent
+	err = client.Database("MVDB").Collection("agents").FindOne(ctx, notDeleted(bson.M{"_id": id})).Decode(&agent)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Agent not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		serverError(w, r, "Failed to retrieve Agent", err)
+		return
+	}
+	d, err := buildDigest(ctx, agent, time.Now())
+	if err != nil {
+		serverError(w, r, "Failed to build digest", err)
+		return
+	}
+	html, err := renderDigest(d)
+	if err != nil {
+		serverError(w, r, "Failed to render digest", err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(html)
+}
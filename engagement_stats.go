@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type propertyEngagement struct {
+	PropertyID   string `json:"property_id"`
+	Title        string `json:"Title"`
+	Inquiries    int    `json:"inquiries"`
+	Appointments int    `json:"appointments"`
+	Total        int    `json:"total"`
+}
+
+// parseDateRange reads ?from= and ?to= (RFC3339 or YYYY-MM-DD in Bangkok time).
+// A date-only "to" covers that whole day, so the returned upper bound is exclusive.
+func parseDateRange(q url.Values) (from, to time.Time, err error) {
+	if raw := q.Get("from"); raw != "" {
+		if from, err = parseDateOrTime(raw); err != nil {
+			return from, to, err
+		}
+	}
+	if raw := q.Get("to"); raw != "" {
+		if to, err = parseDateOrTime(raw); err != nil {
+			return from, to, err
+		}
+		if len(raw) == len("2006-01-02") {
+			to = to.AddDate(0, 0, 1)
+		}
+	}
+	return from, to, nil
+}
+
+// timeRangeFilter builds a $gte/$lt filter, skipping unset bounds; nil when both are unset
+func timeRangeFilter(from, to time.Time) bson.M {
+	if from.IsZero() && to.IsZero() {
+		return nil
+	}
+	r := bson.M{}
+	if !from.IsZero() {
+		r["$gte"] = from
+	}
+	if !to.IsZero() {
+		r["$lt"] = to
+	}
+	return r
+}
+
+// wantsCSV is true for ?format=csv or an Accept header asking for text/csv
+func wantsCSV(r *http.Request) bool {
+	return r.URL.Query().Get("format") == "csv" || strings.Contains(r.Header.Get("Accept"), "text/csv")
+}
+
+// getPropertyEngagement ranks properties by inquiries plus appointments created in the range
+func getPropertyEngagement(w http.ResponseWriter, r *http.Request) {
+	from, to, err := parseDateRange(r.URL.Query())
+	if err != nil {
+		http.Error(w, "from and to must be RFC3339 or YYYY-MM-DD", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	rows := map[string]*propertyEngagement{}
+	sources := []struct {
+		collection, propertyField string
+		add                       func(*propertyEngagement, int)
+	}{
+		{"inquiries", "property_id", func(e *propertyEngagement, n int) { e.Inquiries += n }},
+		{"appointments", "property_id", func(e *propertyEngagement, n int) { e.Appointments += n }},
+	}
+	for _, src := range sources {
+		match := bson.M{}
+		if created := timeRangeFilter(from, to); created != nil {
+			match["created_at"] = created
+		}
+		cur, err := client.Database("MVDB").Collection(src.collection).Aggregate(ctx, []bson.M{
+			{"$match": match},
+			{"$group": bson.M{"_id": "$" + src.propertyField, "count": bson.M{"$sum": 1}}},
+		})
+		if err != nil {
+			serverError(w, r, "Failed to aggregate engagement", err)
+			return
+		}
+		var counts []struct {
+			PropertyID string `bson:"_id"`
+			Count      int    `bson:"count"`
+		}
+		if err := cur.All(ctx, &counts); err != nil {
+			serverError(w, r, "Failed to decode engagement", err)
+			return
+		}
+		for _, c := range counts {
+			if rows[c.PropertyID] == nil {
+				rows[c.PropertyID] = &propertyEngagement{PropertyID: c.PropertyID}
+			}
+			src.add(rows[c.PropertyID], c.Count)
+		}
+	}
+
+	// Join the titles with one query
+	var ids []primitive.ObjectID
+	for id := range rows {
+		if oid, err := primitive.ObjectIDFromHex(id); err == nil {
+			ids = append(ids, oid)
+		}
+	}
+	if len(ids) > 0 {
+		properties, err := findAll[Property](ctx, "properties", bson.M{"_id": bson.M{"$in": ids}})
+		if err != nil {
+			serverError(w, r, "Failed to retrieve Properties", err)
+			return
+		}
+		for _, p := range properties {
+			rows[p.ID.Hex()].Title = p.Title
+		}
+	}
+
+	result := make([]propertyEngagement, 0, len(rows))
+	for _, row := range rows {
+		row.Total = row.Inquiries + row.Appointments
+		result = append(result, *row)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Total != result[j].Total {
+			return result[i].Total > result[j].Total
+		}
+		return result[i].PropertyID < result[j].PropertyID
+	})
+
+	if wantsCSV(r) {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="property-engagement.csv"`)
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"property_id", "title", "inquiries", "appointments", "total"})
+		for _, row := range result {
+			cw.Write([]string{row.PropertyID, row.Title, strconv.Itoa(row.Inquiries), strconv.Itoa(row.Appointments), strconv.Itoa(row.Total)})
+		}
+		cw.Flush()
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
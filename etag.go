@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const defaultCacheControl = "no-cache" // clients may keep responses but revalidate them with If-None-Match
+
+// cacheControlRoutes is the Cache-Control of each route template, from CACHE_CONTROL, e.g.
+// "/properties=public, max-age=60;/listings/featured=public, max-age=300". Other routes get
+// defaultCacheControl.
+var cacheControlRoutes = map[string]string{}
+
+func setupCacheControl() {
+	raw := os.Getenv("CACHE_CONTROL")
+	if raw == "" {
+		return
+	}
+	for _, entry := range strings.Split(raw, ";") {
+		route, value, ok := strings.Cut(entry, "=")
+		route, value = strings.TrimSpace(route), strings.TrimSpace(value)
+		if !ok || route == "" || value == "" {
+			log.Println("Ignoring invalid CACHE_CONTROL entry:", entry)
+			continue
+		}
+		cacheControlRoutes[route] = value
+	}
+}
+
+// cacheControl is the Cache-Control of the matched route. Responses to callers sending an API key
+// may hold drafts or deleted documents, so shared caches must not keep them.
+func cacheControl(r *http.Request) string {
+	if r.Header.Get("X-API-Key") != "" {
+		return "private, no-cache"
+	}
+	if route := mux.CurrentRoute(r); route != nil {
+		if tmpl, err := route.GetPathTemplate(); err == nil {
+			if value, ok := cacheControlRoutes[tmpl]; ok {
+				return value
+			}
+		}
+	}
+	return defaultCacheControl
+}
+
+// listFingerprint summarizes the documents behind a list response: any insert, update or delete
+// of a matching document changes it, provided the write sets updated_at
+type listFingerprint struct {
+	Latest time.Time `bson:"latest"`
+	Count  int64     `bson:"count"`
+}
+
+// fingerprint groups the documents matching filter into their newest updated_at and count
+func fingerprint(ctx context.Context, collectionName string, filter bson.M) (listFingerprint, error) {
+	cur, err := client.Database("MVDB").Collection(collectionName).Aggregate(ctx, []bson.M{
+		{"$match": filter},
+		{"$group": bson.M{"_id": nil, "latest": bson.M{"$max": "$updated_at"}, "count": bson.M{"$sum": 1}}},
+	})
+	if err != nil {
+		return listFingerprint{}, err
+	}
+	defer cur.Close(ctx)
+	var fp listFingerprint
+	if cur.Next(ctx) {
+		if err := cur.Decode(&fp); err != nil {
+			return listFingerprint{}, err
+		}
+	}
+	return fp, cur.Err()
+}
+
+// ratesVersion changes whenever new exchange rates are loaded, since converted prices and price
+// filters depend on them
+func ratesVersion() time.Time {
+	if rates := usableRates(); rates != nil {
+		return rates.FetchedAt
+	}
+	return time.Time{}
+}
+
+// strongETag is for a single document: parts are its id and updated_at, or the encoded body when the
+// response embeds other documents. The query, whether the caller has the API key and the locale of
+// formatted prices are hashed in too, since they all change the response.
+func strongETag(r *http.Request, parts ...interface{}) string {
+	h := sha1.New()
+	fmt.Fprint(h, r.URL.Query().Encode(), hasAPIKey(r), formattedLocaleKey(r))
+	for _, p := range parts {
+		fmt.Fprintf(h, "|%v", p)
+	}
+	return `"` + hex.EncodeToString(h.Sum(nil)[:12]) + `"`
+}
+
+// weakETag is for list responses, which are only equivalent for the same fingerprint: computed
+// fields such as fee estimates aren't part of it
+func weakETag(r *http.Request, parts ...interface{}) string {
+	return "W/" + strongETag(r, parts...)
+}
+
+// notModified sets ETag and Cache-Control and answers 304 when If-None-Match names etag. Tags are
+// compared weakly, as RFC 9110 requires for If-None-Match.
+func notModified(w http.ResponseWriter, r *http.Request, etag string) bool {
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", cacheControl(r))
+	if !etagMatches(r.Header.Get("If-None-Match"), etag) {
+		return false
+	}
+	w.Header().Del("Content-Type")
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+func etagMatches(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" || etag == "" {
+		return false
+	}
+	if strings.TrimSpace(ifNoneMatch) == "*" {
+		return true
+	}
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(candidate), "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestETagMatches(t *testing.T) {
+	tests := []struct {
+		ifNoneMatch, etag string
+		want              bool
+	}{
+		{`"abc"`, `"abc"`, true},
+		{`W/"abc"`, `"abc"`, true},
+		{`"abc"`, `W/"abc"`, true},
+		{`"old", W/"abc"`, `W/"abc"`, true},
+		{`*`, `"abc"`, true},
+		{`"abd"`, `"abc"`, false},
+		{``, `"abc"`, false},
+		{`*`, ``, false},
+	}
+	for _, tt := range tests {
+		if got := etagMatches(tt.ifNoneMatch, tt.etag); got != tt.want {
+			t.Errorf("If-None-Match %s against %s: %v", tt.ifNoneMatch, tt.etag, got)
+		}
+	}
+}
+
+func TestStrongETagVaries(t *testing.T) {
+	useTestKeys(t)
+	base := httptest.NewRequest(http.MethodGet, "/properties/abc", nil)
+	etag := strongETag(base, "abc", 1)
+	if etag != strongETag(httptest.NewRequest(http.MethodGet, "/properties/abc", nil), "abc", 1) {
+		t.Error("the same document and request gave two tags")
+	}
+	if etag == strongETag(base, "abc", 2) {
+		t.Error("a new updated_at kept the tag")
+	}
+	if etag == strongETag(httptest.NewRequest(http.MethodGet, "/properties/abc?include=documents", nil), "abc", 1) {
+		t.Error("another query kept the tag")
+	}
+	admin := httptest.NewRequest(http.MethodGet, "/properties/abc", nil)
+	admin.Header.Set("X-API-Key", "test-shared-key")
+	if etag == strongETag(admin, "abc", 1) {
+		t.Error("the admin view shares the public tag")
+	}
+	if weak := weakETag(base, "abc", 1); weak != "W/"+etag {
+		t.Errorf("weak tag %s for %s", weak, etag)
+	}
+}
+
+func TestNotModified(t *testing.T) {
+	prev := cacheControlRoutes
+	cacheControlRoutes = map[string]string{"/properties": "public, max-age=60"}
+	t.Cleanup(func() { cacheControlRoutes = prev })
+	r := mux.NewRouter()
+	r.HandleFunc("/properties", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if notModified(w, r, `W/"v1"`) {
+			return
+		}
+		w.Write([]byte("[]"))
+	})
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/properties", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("ETag") != `W/"v1"` || rec.Header().Get("Cache-Control") != "public, max-age=60" {
+		t.Errorf("first fetch: %d, ETag %q, Cache-Control %q", rec.Code, rec.Header().Get("ETag"), rec.Header().Get("Cache-Control"))
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/properties", nil)
+	req.Header.Set("If-None-Match", `W/"v1"`)
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotModified || rec.Body.Len() != 0 || rec.Header().Get("Content-Type") != "" {
+		t.Errorf("revalidation: %d, body %q, Content-Type %q", rec.Code, rec.Body, rec.Header().Get("Content-Type"))
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/properties", nil)
+	req.Header.Set("X-API-Key", "any")
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if cc := rec.Header().Get("Cache-Control"); cc != "private, no-cache" {
+		t.Errorf("with an API key: Cache-Control %q", cc)
+	}
+}
+
+// etagRouter serves the property list and detail handlers without the rest of the middleware
+func etagRouter() *mux.Router {
+	r := mux.NewRouter()
+	r.HandleFunc("/properties", getProperties).Methods("GET")
+	r.HandleFunc("/properties/{idOrSlug}", getProperty).Methods("GET")
+	return r
+}
+
+// fetchETag GETs path and returns the ETag, checking a revalidation with it answers 304
+func fetchETag(t *testing.T, r http.Handler, path string) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	etag := rec.Header().Get("ETag")
+	if rec.Code != http.StatusOK || etag == "" {
+		t.Fatalf("GET %s: %d, ETag %q", path, rec.Code, etag)
+	}
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.Header.Set("If-None-Match", etag)
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+		t.Errorf("GET %s with If-None-Match: %d, body %q", path, rec.Code, rec.Body)
+	}
+	return etag
+}
+
+// TestETagFollowsModifications: updating or adding a property changes the tags of the property
+// responses, a write to an unrelated collection doesn't
+func TestETagFollowsModifications(t *testing.T) {
+	useTestMongo(t, "properties", "listings", "inquiries")
+	ctx := context.Background()
+	db := client.Database("MVDB")
+	r := etagRouter()
+	id := primitive.NewObjectID()
+	updated := time.Now().Add(-time.Hour).Truncate(time.Millisecond)
+	if _, err := db.Collection("properties").InsertOne(ctx, Property{ID: id, Title: "Noble", UpdatedAt: updated}); err != nil {
+		t.Fatal(err)
+	}
+	detail := "/properties/" + id.Hex()
+	list, one := fetchETag(t, r, "/properties"), fetchETag(t, r, detail)
+	if list[:2] != "W/" || one[:2] == "W/" {
+		t.Errorf("list tag %s should be weak, detail tag %s strong", list, one)
+	}
+
+	if _, err := db.Collection("inquiries").InsertOne(ctx, Inquiry{Property_id: id.Hex(), Message: "Hi"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Collection("listings").InsertOne(ctx, Listing{PropertyID: id.Hex(), ListingStatus: "active"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := fetchETag(t, r, "/properties"); got != list {
+		t.Errorf("an unrelated write changed the list tag from %s to %s", list, got)
+	}
+	if got := fetchETag(t, r, detail); got != one {
+		t.Errorf("an unrelated write changed the detail tag from %s to %s", one, got)
+	}
+
+	if _, err := db.Collection("properties").UpdateByID(ctx, id,
+		bson.M{"$set": bson.M{"title": "Noble Ploenchit", "updated_at": time.Now()}}); err != nil {
+		t.Fatal(err)
+	}
+	changedList, changedOne := fetchETag(t, r, "/properties"), fetchETag(t, r, detail)
+	if changedList == list {
+		t.Error("updating a property kept the list tag")
+	}
+	if changedOne == one {
+		t.Error("updating the property kept its tag")
+	}
+
+	// an older document added to the list changes the count, not the newest updated_at
+	if _, err := db.Collection("properties").InsertOne(ctx, Property{Title: "Old", UpdatedAt: updated}); err != nil {
+		t.Fatal(err)
+	}
+	if got := fetchETag(t, r, "/properties"); got == changedList {
+		t.Error("adding a property kept the list tag")
+	}
+	if got := fetchETag(t, r, detail); got != changedOne {
+		t.Error("adding another property changed the detail tag")
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// GET /events/stream pushes listing.created, listing.updated and inquiry.created as Server-Sent
+// Events. On a replica set the events come from a change stream and so cover writes made through
+// every instance; on a standalone server, where change streams don't exist, recordAudit publishes the
+// writes of this instance only. Each event carries {id, collection, action, at}; clients fetch the
+// document itself when they need it.
+const (
+	eventStreamHeartbeat  = 25 * time.Second // proxies tend to close connections idle for 30s or more
+	eventStreamRingSize   = 256              // events kept for Last-Event-ID
+	eventStreamSubscriber = 64               // events buffered per connection before it is dropped
+)
+
+// streamEvent is one SSE message. IDs start from the boot time so they keep growing across restarts.
+// Events with an AgentID are for that agent's sockets on GET /ws only, see agent_ws.go.
+type streamEvent struct {
+	ID      uint64
+	Type    string
+	Data    []byte
+	AgentID string
+}
+
+// eventHub fans events out to the open streams and keeps the last eventStreamRingSize of them
+type eventHub struct {
+	mu          sync.Mutex
+	lastID      uint64
+	ring        []streamEvent
+	subscribers map[chan streamEvent]struct{}
+}
+
+var events = &eventHub{
+	lastID:      uint64(time.Now().UnixMilli()) * 1000,
+	subscribers: map[chan streamEvent]struct{}{},
+}
+
+// changeStreamEvents is set while a change stream feeds the hub; recordAudit doesn't publish then
+var changeStreamEvents atomic.Bool
+
+// publish sends to every subscriber without waiting. A subscriber whose buffer is full is dropped
+// and its channel closed, the client reconnects with Last-Event-ID and catches up from the ring.
+func (h *eventHub) publish(eventType string, data []byte) {
+	h.send(streamEvent{Type: eventType, Data: data})
+}
+
+// publishTo sends an event meant for one agent only
+func (h *eventHub) publishTo(agentID, eventType string, data []byte) {
+	h.send(streamEvent{Type: eventType, Data: data, AgentID: agentID})
+}
+
+func (h *eventHub) send(e streamEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastID++
+	e.ID = h.lastID
+	if len(h.ring) == eventStreamRingSize {
+		copy(h.ring, h.ring[1:])
+		h.ring = h.ring[:eventStreamRingSize-1]
+	}
+	h.ring = append(h.ring, e)
+	for ch := range h.subscribers {
+		select {
+		case ch <- e:
+		default:
+			delete(h.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// subscribe returns the ring's events after lastID and a channel for the next ones. cancel must be
+// called when the client goes away.
+func (h *eventHub) subscribe(lastID uint64) ([]streamEvent, <-chan streamEvent, func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var missed []streamEvent
+	if lastID > 0 {
+		for _, e := range h.ring {
+			if e.ID > lastID {
+				missed = append(missed, e)
+			}
+		}
+	}
+	ch := make(chan streamEvent, eventStreamSubscriber)
+	h.subscribers[ch] = struct{}{}
+	cancel := func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if _, ok := h.subscribers[ch]; ok {
+			delete(h.subscribers, ch)
+			close(ch)
+		}
+	}
+	return missed, ch, cancel
+}
+
+// streamEventType names the event of a write, "" for writes that aren't streamed
+func streamEventType(collectionName, action string) string {
+	switch {
+	case collectionName == "listings" && action == "create":
+		return "listing.created"
+	case collectionName == "listings" && (action == "update" || action == "replace" || action == "publish"):
+		return "listing.updated"
+	case collectionName == "inquiries" && action == "create":
+		return "inquiry.created"
+	}
+	return ""
+}
+
+func publishStreamEvent(collectionName, action, documentID string, at time.Time) {
+	eventType := streamEventType(collectionName, action)
+	if eventType == "" || documentID == "" {
+		return
+	}
+	data, err := json.Marshal(map[string]interface{}{"id": documentID, "collection": collectionName, "action": action, "at": at})
+	if err != nil {
+		return
+	}
+	events.publish(eventType, data)
+}
+
+// publishAuditEvent is recordAudit's feed of the hub, used unless a change stream is
+func publishAuditEvent(action, collectionName, documentID string) {
+	if !changeStreamEvents.Load() {
+		publishStreamEvent(collectionName, action, documentID, time.Now())
+	}
+}
+
+// setupEventStream watches listings and inquiries with a change stream when the server supports it
+func setupEventStream() {
+	pipeline := mongo.Pipeline{{{Key: "$match", Value: bson.M{
+		"ns.coll":       bson.M{"$in": bson.A{"listings", "inquiries"}},
+		"operationType": bson.M{"$in": bson.A{"insert", "update", "replace"}},
+	}}}}
+	stream, err := client.Database("MVDB").Watch(context.Background(), pipeline)
+	if err != nil {
+		log.Println("Change streams are unavailable, /events/stream only sees writes made through this instance:", err)
+		return
+	}
+	changeStreamEvents.Store(true)
+	go func() {
+		defer stream.Close(context.Background())
+		for stream.Next(context.Background()) {
+			var change struct {
+				OperationType string `bson:"operationType"`
+				Namespace     struct {
+					Coll string `bson:"coll"`
+				} `bson:"ns"`
+				DocumentKey struct {
+					ID primitive.ObjectID `bson:"_id"`
+				} `bson:"documentKey"`
+				ClusterTime primitive.Timestamp `bson:"clusterTime"`
+			}
+			if err := stream.Decode(&change); err != nil {
+				log.Println("Failed to decode change event:", err)
+				continue
+			}
+			action := "update"
+			if change.OperationType == "insert" {
+				action = "create"
+			}
+			publishStreamEvent(change.Namespace.Coll, action, change.DocumentKey.ID.Hex(), time.Unix(int64(change.ClusterTime.T), 0))
+		}
+		// Events of this instance keep flowing through recordAudit
+		changeStreamEvents.Store(false)
+		log.Println("Change stream ended, /events/stream falls back to writes made through this instance:", stream.Err())
+	}()
+}
+
+// getEventStream answers GET /events/stream. A Last-Event-ID header (or ?last_event_id= for
+// clients that can't set headers) first replays the missed events still in the ring.
+func getEventStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	raw := r.Header.Get("Last-Event-ID")
+	if raw == "" {
+		raw = r.URL.Query().Get("last_event_id")
+	}
+	var lastID uint64
+	if raw != "" {
+		n, err := strconv.ParseUint(raw, 10, 64)
+		if err != nil {
+			http.Error(w, "Last-Event-ID must be an event id", http.StatusBadRequest)
+			return
+		}
+		lastID = n
+	}
+
+	missed, ch, cancel := events.subscribe(lastID)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Accel-Buffering", "no") // nginx would otherwise buffer the stream
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "retry: 3000\n\n")
+	for _, e := range missed {
+		if e.AgentID == "" {
+			writeStreamEvent(w, e)
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(eventStreamHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e, ok := <-ch:
+			if !ok {
+				return // dropped for falling behind
+			}
+			if e.AgentID != "" {
+				continue
+			}
+			writeStreamEvent(w, e)
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": ping\n\n")
+		}
+		flusher.Flush()
+	}
+}
+
+func writeStreamEvent(w http.ResponseWriter, e streamEvent) {
+	fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, e.Data)
+}
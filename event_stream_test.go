@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStreamEventType(t *testing.T) {
+	for write, want := range map[[2]string]string{
+		{"listings", "create"}:   "listing.created",
+		{"listings", "update"}:   "listing.updated",
+		{"listings", "replace"}:  "listing.updated",
+		{"listings", "publish"}:  "listing.updated",
+		{"listings", "delete"}:   "",
+		{"inquiries", "create"}:  "inquiry.created",
+		{"inquiries", "update"}:  "",
+		{"properties", "create"}: "",
+	} {
+		if got := streamEventType(write[0], write[1]); got != want {
+			t.Errorf("%s %s: %q, want %q", write[0], write[1], got, want)
+		}
+	}
+}
+
+func newTestHub() *eventHub {
+	return &eventHub{lastID: 1000, subscribers: map[chan streamEvent]struct{}{}}
+}
+
+func TestEventHubRing(t *testing.T) {
+	h := newTestHub()
+	for i := 0; i < eventStreamRingSize+44; i++ {
+		h.publish("listing.updated", []byte(strconv.Itoa(i)))
+	}
+	if len(h.ring) != eventStreamRingSize || h.ring[0].ID != 1045 || h.lastID != 1300 {
+		t.Fatalf("ring of %d from %d, last id %d", len(h.ring), h.ring[0].ID, h.lastID)
+	}
+	missed, _, cancel := h.subscribe(1290)
+	cancel()
+	if len(missed) != 10 || missed[0].ID != 1291 || string(missed[9].Data) != "299" {
+		t.Errorf("after 1290: %d events from %+v", len(missed), missed[0])
+	}
+	if missed, _, cancel := h.subscribe(1); len(missed) != eventStreamRingSize {
+		t.Errorf("from before the ring: %d events, want the whole ring", len(missed))
+	} else {
+		cancel()
+	}
+	if missed, _, cancel := h.subscribe(0); len(missed) != 0 {
+		t.Errorf("a new client got %d old events", len(missed))
+	} else {
+		cancel()
+	}
+}
+
+func TestEventHubDropsSlowSubscriber(t *testing.T) {
+	h := newTestHub()
+	_, ch, cancel := h.subscribe(0)
+	for i := 0; i < eventStreamSubscriber+1; i++ {
+		h.publish("inquiry.created", nil)
+	}
+	n := 0
+	for range ch {
+		n++
+	}
+	if n != eventStreamSubscriber || len(h.subscribers) != 0 {
+		t.Errorf("%d events before the channel closed, %d subscribers left", n, len(h.subscribers))
+	}
+	cancel() // after the drop, and twice, is harmless
+	cancel()
+}
+
+// readStream reads SSE lines from the response until it has n events
+func readStream(t *testing.T, resp *http.Response, n int) []string {
+	t.Helper()
+	var events []string
+	lines := bufio.NewScanner(resp.Body)
+	var event []string
+	for len(events) < n && lines.Scan() {
+		if lines.Text() != "" {
+			event = append(event, lines.Text())
+			continue
+		}
+		if len(event) > 0 && strings.HasPrefix(event[0], "id: ") {
+			events = append(events, strings.Join(event, "|"))
+		}
+		event = nil
+	}
+	if len(events) < n {
+		t.Fatalf("stream ended after %v: %v", events, lines.Err())
+	}
+	return events
+}
+
+func TestEventStreamResume(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(getEventStream))
+	defer srv.Close()
+
+	publishStreamEvent("listings", "create", "l1", time.Now())
+	mark := events.lastID
+	publishStreamEvent("inquiries", "create", "i1", time.Now())
+	events.publishTo("agent-1", "appointment.created", []byte(`{}`)) // not for the admin stream
+	publishStreamEvent("listings", "update", "l1", time.Now())
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+	req.Header.Set("Last-Event-ID", strconv.FormatUint(mark, 10))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "text/event-stream" || resp.Header.Get("Cache-Control") != "no-store" {
+		t.Errorf("headers %v", resp.Header)
+	}
+	replayed := readStream(t, resp, 2)
+	if !strings.Contains(replayed[0], "event: inquiry.created|data: {") || !strings.Contains(replayed[0], `"id":"i1"`) ||
+		!strings.Contains(replayed[1], "event: listing.updated") {
+		t.Errorf("replayed %v", replayed)
+	}
+	if !strings.HasPrefix(replayed[0], "id: "+strconv.FormatUint(mark+1, 10)+"|") {
+		t.Errorf("first replayed id isn't %d: %s", mark+1, replayed[0])
+	}
+
+	publishStreamEvent("listings", "delete", "l1", time.Now()) // not streamed
+	publishStreamEvent("listings", "create", "l2", time.Now())
+	if live := readStream(t, resp, 1); !strings.Contains(live[0], `"id":"l2"`) {
+		t.Errorf("live event %v", live)
+	}
+
+	rec := httptest.NewRecorder()
+	bad := httptest.NewRequest(http.MethodGet, "/events/stream?last_event_id=yesterday", nil)
+	getEventStream(rec, bad)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("a bad Last-Event-ID: %d", rec.Code)
+	}
+}
+
+func streamSubscribers() int {
+	events.mu.Lock()
+	defer events.mu.Unlock()
+	return len(events.subscribers)
+}
+
+// TestEventStreamDisconnects connects and drops many clients: every subscription and handler
+// goroutine must be gone afterwards
+func TestEventStreamDisconnects(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(getEventStream))
+	defer srv.Close()
+	transport := &http.Transport{}
+	httpClient := &http.Client{Transport: transport}
+	subscribers, goroutines := streamSubscribers(), runtime.NumGoroutine()
+
+	for i := 0; i < 200; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL, nil)
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		line, _ := bufio.NewReader(resp.Body).ReadString('\n')
+		if line != "retry: 3000\n" {
+			t.Fatalf("connection %d: %q", i, line)
+		}
+		if i%2 == 0 {
+			publishStreamEvent("inquiries", "create", "i"+strconv.Itoa(i), time.Now())
+		}
+		cancel()
+		resp.Body.Close()
+	}
+	transport.CloseIdleConnections()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for streamSubscribers() > subscribers || runtime.NumGoroutine() > goroutines+2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("after 200 disconnects: %d subscribers (was %d), %d goroutines (was %d)",
+				streamSubscribers(), subscribers, runtime.NumGoroutine(), goroutines)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/rwcarlsen/goexif/exif"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Photos taken on site carry the GPS position of the unit. uploadImage reads it to suggest
+// coordinates for properties that have none yet; the property only changes through
+// POST /properties/{id}/suggested-coordinates/confirm.
+
+var errNoEXIF = errors.New("no EXIF data")
+
+// photoCoordinates returns the [latitude, longitude] in the EXIF of a JPEG or HEIC file, nil for other
+// files and photos without a usable GPS position
+func photoCoordinates(data []byte) *[2]float64 {
+	var x *exif.Exif
+	var err error
+	switch {
+	case len(data) > 2 && data[0] == 0xff && data[1] == 0xd8:
+		x, err = exif.Decode(bytes.NewReader(data))
+	case isHEIC(data):
+		var tiff []byte
+		if tiff, err = heicEXIF(data); err == nil {
+			x, err = exif.Decode(bytes.NewReader(tiff))
+		}
+	default:
+		return nil
+	}
+	if err != nil {
+		return nil
+	}
+	lat, lng, err := x.LatLong()
+	if err != nil || math.IsNaN(lat) || math.IsNaN(lng) {
+		return nil
+	}
+	c := [2]float64{lat, lng}
+	if propertyLocation(c) == nil {
+		return nil
+	}
+	return &c
+}
+
+// heicBrands are the ftyp major brands of HEIF stills
+var heicBrands = []string{"heic", "heix", "heim", "heis", "mif1"}
+
+func isHEIC(data []byte) bool {
+	return len(data) >= 12 && string(data[4:8]) == "ftyp" && isOneOf(string(data[8:12]), heicBrands)
+}
+
+// isoBox is one box of an ISO base media file: its type and its payload
+type isoBox struct {
+	Type string
+	Data []byte
+}
+
+// isoBoxes splits data into its boxes; a truncated last box ends the list
+func isoBoxes(data []byte) []isoBox {
+	var boxes []isoBox
+	for len(data) >= 8 {
+		size, header := uint64(binary.BigEndian.Uint32(data)), uint64(8)
+		switch size {
+		case 0:
+			size = uint64(len(data))
+		case 1:
+			if len(data) < 16 {
+				return boxes
+			}
+			size, header = binary.BigEndian.Uint64(data[8:]), 16
+		}
+		if size < header || size > uint64(len(data)) {
+			return boxes
+		}
+		boxes = append(boxes, isoBox{Type: string(data[4:8]), Data: data[header:size]})
+		data = data[size:]
+	}
+	return boxes
+}
+
+// beUint reads a big-endian unsigned integer of n (0, 2, 4 or 8) bytes at *pos and advances it
+func beUint(data []byte, pos *int, n int) (uint64, bool) {
+	if *pos+n > len(data) {
+		return 0, false
+	}
+	var v uint64
+	for _, b := range data[*pos : *pos+n] {
+		v = v<<8 | uint64(b)
+	}
+	*pos += n
+	return v, true
+}
+
+var errBadHEIC = errors.New("malformed HEIC metadata")
+
+// heicEXIF finds the Exif item of a HEIC file through the meta box: iinf names the item types,
+// iloc where each item's bytes are. It returns the TIFF data that follows the item's header offset.
+func heicEXIF(data []byte) ([]byte, error) {
+	var meta []byte
+	for _, box := range isoBoxes(data) {
+		if box.Type == "meta" && len(box.Data) >= 4 {
+			meta = box.Data[4:] // version and flags
+		}
+	}
+	if meta == nil {
+		return nil, errNoEXIF
+	}
+
+	var exifItem uint64
+	var iloc []byte
+	for _, box := range isoBoxes(meta) {
+		switch box.Type {
+		case "iinf":
+			if len(box.Data) < 4 {
+				return nil, errBadHEIC
+			}
+			pos, countSize := 4, 2
+			if box.Data[0] > 0 {
+				countSize = 4
+			}
+			if _, ok := beUint(box.Data, &pos, countSize); !ok {
+				return nil, errBadHEIC
+			}
+			for _, infe := range isoBoxes(box.Data[pos:]) {
+				d := infe.Data
+				// Item types are only in infe version 2 and later
+				if infe.Type != "infe" || len(d) < 4 || d[0] < 2 {
+					continue
+				}
+				p, idSize := 4, 2
+				if d[0] > 2 {
+					idSize = 4
+				}
+				id, ok := beUint(d, &p, idSize)
+				if !ok || p+6 > len(d) {
+					continue
+				}
+				if string(d[p+2:p+6]) == "Exif" {
+					exifItem = id
+				}
+			}
+		case "iloc":
+			iloc = box.Data
+		}
+	}
+	if exifItem == 0 || iloc == nil {
+		return nil, errNoEXIF
+	}
+
+	offset, length, ok := ilocExtent(iloc, exifItem)
+	if !ok || offset+length > uint64(len(data)) || length < 4 {
+		return nil, errBadHEIC
+	}
+	item := data[offset : offset+length]
+	// The item starts with the offset of the TIFF header, past an optional "Exif\0\0"
+	tiffStart := 4 + uint64(binary.BigEndian.Uint32(item))
+	if tiffStart >= uint64(len(item)) {
+		return nil, errBadHEIC
+	}
+	return item[tiffStart:], nil
+}
+
+// ilocExtent returns the file offset and length of the first extent of item
+func ilocExtent(iloc []byte, item uint64) (uint64, uint64, bool) {
+	if len(iloc) < 6 {
+		return 0, 0, false
+	}
+	version := iloc[0]
+	offsetSize, lengthSize := int(iloc[4]>>4), int(iloc[4]&0xf)
+	baseOffsetSize, indexSize := int(iloc[5]>>4), 0
+	if version == 1 || version == 2 {
+		indexSize = int(iloc[5] & 0xf)
+	}
+	pos, idSize := 6, 2
+	if version == 2 {
+		idSize = 4
+	}
+	count, ok := beUint(iloc, &pos, idSize)
+	if !ok {
+		return 0, 0, false
+	}
+	for i := uint64(0); i < count; i++ {
+		id, ok := beUint(iloc, &pos, idSize)
+		if !ok {
+			return 0, 0, false
+		}
+		if version == 1 || version == 2 {
+			method, ok := beUint(iloc, &pos, 2)
+			// Only items stored in the file itself (construction method 0) can be read
+			if !ok || (id == item && method&0xf != 0) {
+				return 0, 0, false
+			}
+		}
+		pos += 2 // data_reference_index
+		base, ok := beUint(iloc, &pos, baseOffsetSize)
+		if !ok {
+			return 0, 0, false
+		}
+		extents, ok := beUint(iloc, &pos, 2)
+		if !ok {
+			return 0, 0, false
+		}
+		for e := uint64(0); e < extents; e++ {
+			pos += indexSize
+			offset, ok1 := beUint(iloc, &pos, offsetSize)
+			length, ok2 := beUint(iloc, &pos, lengthSize)
+			if !ok1 || !ok2 {
+				return 0, 0, false
+			}
+			if id == item && e == 0 {
+				return base + offset, length, true
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+// confirmSuggestedCoordinates answers POST /properties/{id}/suggested-coordinates/confirm, moving the
+// suggestion from a photo into Coordinates along with the location and nearby transit derived from them.
+// A property that got coordinates in the meantime keeps them, 409.
+func confirmSuggestedCoordinates(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	id, ok := pathObjectID(w, r, "Property")
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	collection := client.Database("MVDB").Collection("properties")
+	var before Property
+	err := collection.FindOne(ctx, notDeleted(bson.M{"_id": id})).Decode(&before)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Property not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		serverError(w, r, "Failed to retrieve Property", err)
+		return
+	}
+	if before.Suggested == nil {
+		http.Error(w, "Property has no suggested coordinates", http.StatusNotFound)
+		return
+	}
+	if hasCoordinates(before.Coordinates) {
+		http.Error(w, "Property already has coordinates, update them with PUT /properties/{id}", http.StatusConflict)
+		return
+	}
+
+	coordinates := *before.Suggested
+	var after Property
+	err = collection.FindOneAndUpdate(ctx,
+		bson.M{"_id": id, "coordinates": before.Coordinates, "suggested_coordinates": coordinates},
+		bson.M{
+			"$set": bson.M{
+				"coordinates": coordinates,
+				"location":    propertyLocation(coordinates),
+				"transit":     nearbyTransit(coordinates),
+				"updated_at":  time.Now(),
+			},
+			"$unset": bson.M{"suggested_coordinates": ""},
+		},
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&after)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Property changed while confirming, retry", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		serverError(w, r, "Failed to update Property", err)
+		return
+	}
+	recordAudit(auditFromRequest(r), "update", "properties", id.Hex(), before, after, nil)
+	json.NewEncoder(w).Encode(after)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const fcmScope = "https://www.googleapis.com/auth/firebase.messaging"
+
+// fcmNotifier sends through the FCM HTTP v1 API, authenticating as a service account with a
+// self-signed JWT exchanged for an access token, which is cached until shortly before it expires
+type fcmNotifier struct {
+	projectID string
+	email     string
+	key       *rsa.PrivateKey
+	tokenURI  string
+	http      *http.Client
+
+	mu          sync.Mutex
+	accessToken string
+	expiresAt   time.Time
+}
+
+func newFCMNotifier(credentialsPath string) (*fcmNotifier, error) {
+	raw, err := os.ReadFile(credentialsPath)
+	if err != nil {
+		return nil, err
+	}
+	var creds struct {
+		ProjectID   string `json:"project_id"`
+		ClientEmail string `json:"client_email"`
+		PrivateKey  string `json:"private_key"`
+		TokenURI    string `json:"token_uri"`
+	}
+	if err := json.Unmarshal(raw, &creds); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", credentialsPath, err)
+	}
+	if creds.ProjectID == "" || creds.ClientEmail == "" {
+		return nil, fmt.Errorf("%s has no project_id or client_email", credentialsPath)
+	}
+	block, _ := pem.Decode([]byte(creds.PrivateKey))
+	if block == nil {
+		return nil, fmt.Errorf("%s has no PEM private_key", credentialsPath)
+	}
+	var key *rsa.PrivateKey
+	if parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		var ok bool
+		if key, ok = parsed.(*rsa.PrivateKey); !ok {
+			return nil, errors.New("private_key is not an RSA key")
+		}
+	} else if key, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+		return nil, fmt.Errorf("parsing private_key: %w", err)
+	}
+	if creds.TokenURI == "" {
+		creds.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+	return &fcmNotifier{
+		projectID: creds.ProjectID,
+		email:     creds.ClientEmail,
+		key:       key,
+		tokenURI:  creds.TokenURI,
+		http:      &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+func (f *fcmNotifier) token(ctx context.Context) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.accessToken != "" && time.Now().Before(f.expiresAt) {
+		return f.accessToken, nil
+	}
+
+	now := time.Now()
+	segment := func(v interface{}) string {
+		b, _ := json.Marshal(v)
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	unsigned := segment(map[string]string{"alg": "RS256", "typ": "JWT"}) + "." + segment(map[string]interface{}{
+		"iss":   f.email,
+		"scope": fcmScope,
+		"aud":   f.tokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	digest := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, f.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	assertion := unsigned + "." + base64.RawURLEncoding.EncodeToString(sig)
+
+	form := url.Values{"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"}, "assertion": {assertion}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, f.tokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := f.http.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var body struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("fcm token exchange: %s", resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil || body.AccessToken == "" {
+		return "", errors.New("fcm token exchange: no access_token in response")
+	}
+	f.accessToken = body.AccessToken
+	f.expiresAt = now.Add(time.Duration(body.ExpiresIn)*time.Second - time.Minute)
+	return f.accessToken, nil
+}
+
+func (f *fcmNotifier) Send(ctx context.Context, deviceToken string, msg pushMessage) error {
+	accessToken, err := f.token(ctx)
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(map[string]interface{}{"message": map[string]interface{}{
+		"token":        deviceToken,
+		"notification": map[string]string{"title": msg.Title, "body": msg.Body},
+		"data":         msg.Data,
+	}})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		"https://fcm.googleapis.com/v1/projects/"+url.PathEscape(f.projectID)+"/messages:send", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	resp, err := f.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	var body struct {
+		Error struct {
+			Message string `json:"message"`
+			Details []struct {
+				ErrorCode string `json:"errorCode"`
+			} `json:"details"`
+		} `json:"error"`
+	}
+	json.NewDecoder(resp.Body).Decode(&body)
+	// UNREGISTERED: the app was uninstalled or the token rotated; INVALID_ARGUMENT on the token
+	// itself: it was never valid
+	for _, d := range body.Error.Details {
+		if d.ErrorCode == "UNREGISTERED" ||
+			(d.ErrorCode == "INVALID_ARGUMENT" && strings.Contains(body.Error.Message, "registration token")) {
+			return errInvalidPushToken
+		}
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return errInvalidPushToken
+	}
+	return fmt.Errorf("fcm: %s: %s", resp.Status, body.Error.Message)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// maxRailListings caps the home page rails
+const maxRailListings = 24
+
+// listingSummaryProjection is the lightweight listing shape for cards: everything but the full
+// description and the photos after the first
+var listingSummaryProjection = bson.M{"description": 0, "photos": bson.M{"$slice": 1}}
+
+// findListingRail runs a capped, newest-first listing query with the summary projection
+func findListingRail(w http.ResponseWriter, r *http.Request, filter bson.M) {
+	w.Header().Set("Content-Type", "application/json")
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	opts := options.Find().
+		SetProjection(listingSummaryProjection).
+		SetSort(bson.M{"created_at": -1}).
+		SetLimit(maxRailListings)
+	cur, err := client.Database("MVDB").Collection("listings").Find(ctx, filter, opts)
+	if err != nil {
+		serverError(w, r, "Failed to retrieve Listings from MongoDB", err)
+		return
+	}
+	defer cur.Close(ctx)
+
+	listings := []Listing{}
+	if err := cur.All(ctx, &listings); err != nil {
+		serverError(w, r, "Failed to decode retrieved Listings", err)
+		return
+	}
+	if !applyDisplayCurrency(w, r, listings) || !applyUnits(w, r, listings) {
+		return
+	}
+	if loc, ok := priceLocale(w, r); ok {
+		formatListingPrices(listings, loc)
+	}
+	json.NewEncoder(w).Encode(listings)
+}
+
+// getFeaturedListings returns active featured listings, newest first
+func getFeaturedListings(w http.ResponseWriter, r *http.Request) {
+	findListingRail(w, r, activeListingsFilter(bson.M{"featured": true}))
+}
+
+// getNewListings returns active listings created within the last ?days= (default 14)
+func getNewListings(w http.ResponseWriter, r *http.Request) {
+	days := 14
+	if raw := r.URL.Query().Get("days"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > 365 {
+			http.Error(w, "days must be between 1 and 365", http.StatusBadRequest)
+			return
+		}
+		days = n
+	}
+	since := time.Now().AddDate(0, 0, -days)
+	findListingRail(w, r, activeListingsFilter(bson.M{"created_at": bson.M{"$gte": since}}))
+}
+
+// setListingFeatured toggles the featured flag. Body: {"featured": true}
+func setListingFeatured(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	id, ok := pathObjectID(w, r, "Listing")
+	if !ok {
+		return
+	}
+	var body struct {
+		Featured *bool `json:"featured"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Featured == nil {
+		http.Error(w, "Body must be {\"featured\": true|false}", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	before := auditSnapshot(ctx, "listings", id)
+	result, err := client.Database("MVDB").Collection("listings").UpdateByID(ctx, id, bson.M{
+		"$set": bson.M{"featured": *body.Featured, "updated_at": time.Now()},
+	})
+	if err != nil {
+		serverError(w, r, "Failed to update Listing", err)
+		return
+	}
+	if result.MatchedCount == 0 {
+		http.Error(w, "Listing not found", http.StatusNotFound)
+		return
+	}
+	recordAudit(auditFromRequest(r), "update", "listings", id.Hex(), before, auditSnapshot(ctx, "listings", id), nil)
+	json.NewEncoder(w).Encode(bson.M{"listing_id": id.Hex(), "featured": *body.Featured})
+}
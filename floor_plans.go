@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"time"
+	"unicode/utf8"
+
+	"github.com/LynnT-2003/mv-realty-backend/imagemeta"
+	"github.com/cloudinary/cloudinary-go/v2/api/uploader"
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	floorPlanFolder      = "floor_plans"
+	maxFloorPlanLabelLen = 100 // characters
+)
+
+// uploadPropertyFloorPlan uploads a floor plan for a property
+func uploadPropertyFloorPlan(w http.ResponseWriter, r *http.Request) {
+	uploadFloorPlan(w, r, "properties", "Property")
+}
+
+// uploadListingFloorPlan uploads a floor plan for a listing
+func uploadListingFloorPlan(w http.ResponseWriter, r *http.Request) {
+	uploadFloorPlan(w, r, "listings", "Listing")
+}
+
+// deletePropertyFloorPlan removes a floor plan from a property
+func deletePropertyFloorPlan(w http.ResponseWriter, r *http.Request) {
+	deleteFloorPlan(w, r, "properties", "Property")
+}
+
+// deleteListingFloorPlan removes a floor plan from a listing
+func deleteListingFloorPlan(w http.ResponseWriter, r *http.Request) {
+	deleteFloorPlan(w, r, "listings", "Listing")
+}
+
+// uploadFloorPlan takes a multipart "floor_plan" file (an image or a PDF, sniffed from its content)
+// and a "label", uploads the file to the floor plan folder and adds it to floor_plans
+func uploadFloorPlan(w http.ResponseWriter, r *http.Request, collectionName, entity string) {
+	w.Header().Set("Content-Type", "application/json")
+
+	id, ok := pathObjectID(w, r, entity)
+	if !ok {
+		return
+	}
+	if err := r.ParseMultipartForm(10 << 20); err != nil { // Max file size: 10 MB
+		http.Error(w, "Unable to parse form data", http.StatusBadRequest)
+		return
+	}
+	label := imagemeta.CleanText(r.FormValue("label"))
+	if label == "" {
+		http.Error(w, "label is required", http.StatusBadRequest)
+		return
+	}
+	if utf8.RuneCountInString(label) > maxFloorPlanLabelLen {
+		http.Error(w, "label must be at most 100 characters", http.StatusBadRequest)
+		return
+	}
+	file, _, err := r.FormFile("floor_plan")
+	if err != nil {
+		http.Error(w, "Unable to get the file from form data", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(file, head)
+	resourceType, ok := imagemeta.PlanResourceType(http.DetectContentType(head[:n]))
+	if !ok {
+		http.Error(w, "floor_plan must be a JPEG, PNG, WebP or GIF image or a PDF", http.StatusUnsupportedMediaType)
+		return
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		serverError(w, r, "Unable to read the file", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+
+	// Checked before uploading so a bad id doesn't leave an orphaned file in Cloudinary
+	collection := client.Database("MVDB").Collection(collectionName)
+	if err := collection.FindOne(ctx, notDeleted(bson.M{"_id": id})).Err(); err == mongo.ErrNoDocuments {
+		http.Error(w, entity+" not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to retrieve "+entity, http.StatusInternalServerError)
+		return
+	}
+
+	cld, err := newCloudinary()
+	if err != nil {
+		serverError(w, r, "Failed to initialize Cloudinary", err)
+		return
+	}
+	// PDFs are uploaded as the image resource type too, so Cloudinary can render page previews
+	uploadResult, err := cld.Upload.Upload(ctx, file, uploader.UploadParams{Folder: floorPlanFolder, ResourceType: "image"})
+	if err != nil {
+		serverError(w, r, "Failed to upload floor plan to Cloudinary", err)
+		return
+	}
+	if uploadResult.SecureURL == "" {
+		http.Error(w, "Empty SecureURL returned from Cloudinary", http.StatusInternalServerError)
+		return
+	}
+
+	plan := imagemeta.Plan{URL: uploadResult.SecureURL, PublicID: uploadResult.PublicID, Label: label, ResourceType: resourceType}
+	before := auditSnapshot(ctx, collectionName, id)
+	_, err = collection.UpdateOne(ctx, notDeleted(bson.M{"_id": id}), bson.M{
+		"$push": bson.M{"floor_plans": plan},
+		"$set":  bson.M{"updated_at": time.Now()},
+	})
+	if err != nil {
+		http.Error(w, "Failed to update "+entity+" with floor plan", http.StatusInternalServerError)
+		return
+	}
+	recordAudit(auditFromRequest(r), "update", collectionName, id.Hex(), before, auditSnapshot(ctx, collectionName, id), nil)
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(plan)
+}
+
+// deleteFloorPlan removes the floor plan from the document, then deletes the file from Cloudinary.
+// A failed Cloudinary delete is only logged; the floor plan is already gone from the API.
+func deleteFloorPlan(w http.ResponseWriter, r *http.Request, collectionName, entity string) {
+	w.Header().Set("Content-Type", "application/json")
+
+	id, ok := pathObjectID(w, r, entity)
+	if !ok {
+		return
+	}
+	params := mux.Vars(r)
+	publicID := params["public_id"]
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	collection := client.Database("MVDB").Collection(collectionName)
+	before := auditSnapshot(ctx, collectionName, id)
+	res, err := collection.UpdateOne(ctx, notDeleted(bson.M{"_id": id, "floor_plans.public_id": publicID}), bson.M{
+		"$pull": bson.M{"floor_plans": bson.M{"public_id": publicID}},
+		"$set":  bson.M{"updated_at": time.Now()},
+	})
+	if err != nil {
+		serverError(w, r, "Failed to delete floor plan", err)
+		return
+	}
+	if res.MatchedCount == 0 {
+		http.Error(w, "Floor plan not found", http.StatusNotFound)
+		return
+	}
+	recordAudit(auditFromRequest(r), "update", collectionName, id.Hex(), before, auditSnapshot(ctx, collectionName, id), nil)
+
+	if cld, err := newCloudinary(); err != nil {
+		log.Println("Failed to initialize Cloudinary to delete floor plan", publicID+":", err)
+	} else if _, err := cld.Upload.Destroy(ctx, uploader.DestroyParams{PublicID: publicID}); err != nil {
+		log.Println("Failed to delete floor plan", publicID, "from Cloudinary:", err)
+	}
+
+	json.NewEncoder(w).Encode(bson.M{"message": "Floor plan deleted"})
+}
@@ -0,0 +1,34 @@
+package main
+
+import "math"
+
+const earthRadiusM = 6371000.0
+
+// haversineMeters is the great-circle distance between two [latitude, longitude] points
+func haversineMeters(a, b [2]float64) float64 {
+	lat1, lat2 := a[0]*math.Pi/180, b[0]*math.Pi/180
+	dLat := lat2 - lat1
+	dLng := (b[1] - a[1]) * math.Pi / 180
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadiusM * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// hasCoordinates is false for the [0, 0] placeholder stored on properties without a location
+func hasCoordinates(c [2]float64) bool {
+	return c[0] != 0 || c[1] != 0
+}
+
+// geoPoint is a GeoJSON point, [longitude, latitude] unlike Property.Coordinates
+type geoPoint struct {
+	Type        string     `bson:"type" json:"type"`
+	Coordinates [2]float64 `bson:"coordinates" json:"coordinates"`
+}
+
+// propertyLocation is the GeoJSON copy of a property's coordinates kept for the 2dsphere index; nil
+// for the [0, 0] placeholder and for coordinates out of range, which the index would refuse
+func propertyLocation(c [2]float64) *geoPoint {
+	if !hasCoordinates(c) || c[0] < -90 || c[0] > 90 || c[1] < -180 || c[1] > 180 {
+		return nil
+	}
+	return &geoPoint{Type: "Point", Coordinates: [2]float64{c[1], c[0]}}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// getUser answers GET /users/{id}, the Location of POST /add/user
+func getUser(w http.ResponseWriter, r *http.Request) {
+	getByID[User](w, r, "users", "User", nil)
+}
+
+// getInquiry answers GET /inquiries/{id}, the Location of POST /add/inquiry
+func getInquiry(w http.ResponseWriter, r *http.Request) {
+	getByID[Inquiry](w, r, "inquiries", "Inquiry", nil)
+}
+
+// getAppointment answers GET /appointments/{id}, the Location of POST /add/appointment
+func getAppointment(w http.ResponseWriter, r *http.Request) {
+	loc, ok := responseLocation(w, r)
+	if !ok {
+		return
+	}
+	getByID(w, r, "appointments", "Appointment", func(a *Appointment) { localizeAppointment(a, loc) })
+}
+
+// getByID writes the document of the collection with the id in the path. Soft-deleted documents are
+// hidden unless ?include_deleted=true. prepare, when set, fills in computed fields before writing.
+func getByID[T any](w http.ResponseWriter, r *http.Request, collectionName, entity string, prepare func(*T)) {
+	w.Header().Set("Content-Type", "application/json")
+
+	id, ok := pathObjectID(w, r, entity)
+	if !ok {
+		return
+	}
+	filter := bson.M{"_id": id}
+	if _, ok := softDeletable[collectionName]; ok && !applyDeletedFilter(w, r, filter) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	var doc T
+	err := client.Database("MVDB").Collection(collectionName).FindOne(ctx, filter).Decode(&doc)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, entity+" not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		serverError(w, r, "Failed to retrieve "+entity, err)
+		return
+	}
+	if prepare != nil {
+		prepare(&doc)
+	}
+	json.NewEncoder(w).Encode(doc)
+}
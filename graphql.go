@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/99designs/gqlgen/graphql"
+	"github.com/99designs/gqlgen/graphql/handler"
+	"github.com/99designs/gqlgen/graphql/handler/extension"
+	"github.com/99designs/gqlgen/graphql/handler/lru"
+	"github.com/99designs/gqlgen/graphql/handler/transport"
+	"github.com/99designs/gqlgen/graphql/playground"
+	"github.com/gorilla/mux"
+	"github.com/vektah/gqlparser/v2/ast"
+	"github.com/vektah/gqlparser/v2/gqlerror"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+//go:generate go run github.com/99designs/gqlgen generate
+
+// registerGraphQL mounts /graphql behind the API key middleware.
+// The playground (and introspection) are only enabled when ENV=dev.
+func registerGraphQL(r *mux.Router) {
+	dev := os.Getenv("ENV") == "dev"
+
+	srv := handler.New(NewExecutableSchema(Config{Resolvers: &Resolver{}}))
+	srv.AddTransport(transport.GET{})
+	srv.AddTransport(transport.POST{})
+	srv.SetQueryCache(lru.New[*ast.QueryDocument](1000))
+	srv.SetErrorPresenter(presentGraphQLError)
+	srv.AroundOperations(refuseMutationsInMaintenance)
+	if dev {
+		srv.Use(extension.Introspection{})
+	}
+
+	r.Handle("/graphql", requireAPIKey(withAuditMeta(withLoaders(srv)))).Methods("GET", "POST")
+	if dev {
+		r.Handle("/playground", playground.Handler("MV Realty GraphQL", "/graphql")).Methods("GET")
+	}
+}
+
+// withLoaders gives every request its own set of dataloaders, which query with its context
+func withLoaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), loadersKey{}, newLoaders(r.Context()))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// requireAdminScope refuses the fields that expose users, inquiries and appointments, the documents
+// adminRoutes keep from read scope keys, unless the caller's key has the admin scope. The error is
+// new every time, the presenter sets its path.
+func requireAdminScope(ctx context.Context) error {
+	if identity := apiKeyFrom(ctx); identity == nil || !isOneOf(scopeAdmin, identity.Scopes) {
+		return &gqlerror.Error{
+			Message:    "This API key lacks the " + scopeAdmin + " scope",
+			Extensions: map[string]interface{}{"code": "FORBIDDEN"},
+		}
+	}
+	return nil
+}
+
+// presentGraphQLError keeps the messages resolvers wrote themselves and replaces driver errors, which
+// the loaders return as they are, with a generic one; the original is logged with the request id
+func presentGraphQLError(ctx context.Context, err error) *gqlerror.Error {
+	var serverErr mongo.ServerError
+	if errors.As(err, &serverErr) || mongo.IsTimeout(err) || mongo.IsNetworkError(err) || errors.Is(err, context.DeadlineExceeded) {
+		log.Printf("GraphQL resolver failed (request %s): %v", requestID(ctx), err)
+		err = errors.New("Internal server error")
+	}
+	return graphql.DefaultErrorPresenter(ctx, err)
+}
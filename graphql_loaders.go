@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// loaderWait is how long a loader collects keys before running its batch query.
+// gqlgen resolves list items concurrently, so sibling fields land in the same batch.
+const loaderWait = 2 * time.Millisecond
+
+type loaderBatch[V any] struct {
+	keys    []string
+	done    chan struct{}
+	results map[string]V
+	err     error
+}
+
+// loader merges Load calls made within loaderWait into a single fetch,
+// turning N related-object lookups into one $in query. The fetch runs with the context of the
+// request, so it keeps its deadline and request id.
+type loader[V any] struct {
+	ctx   context.Context
+	fetch func(ctx context.Context, keys []string) (map[string]V, error)
+
+	mu    sync.Mutex
+	batch *loaderBatch[V]
+	cache map[string]*loaderBatch[V]
+}
+
+func newLoader[V any](ctx context.Context, fetch func(ctx context.Context, keys []string) (map[string]V, error)) *loader[V] {
+	return &loader[V]{ctx: ctx, fetch: fetch, cache: map[string]*loaderBatch[V]{}}
+}
+
+func (l *loader[V]) Load(key string) (V, error) {
+	l.mu.Lock()
+	b, ok := l.cache[key]
+	if !ok {
+		if l.batch == nil {
+			l.batch = &loaderBatch[V]{done: make(chan struct{})}
+			time.AfterFunc(loaderWait, l.dispatch)
+		}
+		b = l.batch
+		b.keys = append(b.keys, key)
+		l.cache[key] = b
+	}
+	l.mu.Unlock()
+
+	<-b.done
+	return b.results[key], b.err
+}
+
+func (l *loader[V]) dispatch() {
+	l.mu.Lock()
+	b := l.batch
+	l.batch = nil
+	l.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(l.ctx, 5*time.Second)
+	defer cancel()
+
+	b.results, b.err = l.fetch(ctx, b.keys)
+	close(b.done)
+}
+
+// loaders holds the per-request dataloaders; a fresh set is created for every GraphQL request, with
+// its context
+type loaders struct {
+	propertyByID            *loader[*Property]
+	listingByID             *loader[*Listing]
+	userByID                *loader[*User]
+	listingsByProperty      *loader[[]Listing]
+	inquiriesByProperty     *loader[[]Inquiry]
+	inquiryCountsByProperty *loader[int]
+	inquiriesByUser         *loader[[]Inquiry]
+	appointmentsByUser      *loader[[]Appointment]
+}
+
+func newLoaders(ctx context.Context) *loaders {
+	return &loaders{
+		propertyByID: newLoader(ctx, func(ctx context.Context, keys []string) (map[string]*Property, error) {
+			return findByIDs(ctx, "properties", keys, notDeleted(bson.M{}), func(p *Property) primitive.ObjectID { return p.ID })
+		}),
+		listingByID: newLoader(ctx, func(ctx context.Context, keys []string) (map[string]*Listing, error) {
+			return findByIDs(ctx, "listings", keys, publishedListingsFilter(bson.M{}), func(l *Listing) primitive.ObjectID { return l.ID })
+		}),
+		userByID: newLoader(ctx, func(ctx context.Context, keys []string) (map[string]*User, error) {
+			return findByIDs(ctx, "users", keys, notDeleted(bson.M{}), func(u *User) primitive.ObjectID { return u.ID })
+		}),
+		listingsByProperty: newLoader(ctx, func(ctx context.Context, keys []string) (map[string][]Listing, error) {
+			return findGrouped(ctx, "listings", "property_id", keys, publishedListingsFilter(bson.M{}), func(l Listing) string { return l.PropertyID })
+		}),
+		inquiriesByProperty: newLoader(ctx, func(ctx context.Context, keys []string) (map[string][]Inquiry, error) {
+			return findGrouped(ctx, "inquiries", "property_id", keys, notDeleted(bson.M{}), func(i Inquiry) string { return i.Property_id })
+		}),
+		inquiryCountsByProperty: newLoader(ctx, countInquiriesByProperty),
+		inquiriesByUser: newLoader(ctx, func(ctx context.Context, keys []string) (map[string][]Inquiry, error) {
+			return findGrouped(ctx, "inquiries", "user_id", keys, notDeleted(bson.M{}), func(i Inquiry) string { return i.User_id })
+		}),
+		appointmentsByUser: newLoader(ctx, func(ctx context.Context, keys []string) (map[string][]Appointment, error) {
+			return findGrouped(ctx, "appointments", "user_id", keys, notDeleted(bson.M{}), func(a Appointment) string { return a.UserID })
+		}),
+	}
+}
+
+type loadersKey struct{}
+
+func loadersFor(ctx context.Context) *loaders {
+	return ctx.Value(loadersKey{}).(*loaders)
+}
+
+// findAll decodes every document matching filter
+func findAll[T any](ctx context.Context, collectionName string, filter interface{}) ([]T, error) {
+	return findAllWith[T](ctx, collectionName, filter)
+}
+
+// findAllWith is findAll with find options (sort, paging)
+func findAllWith[T any](ctx context.Context, collectionName string, filter interface{}, opts ...*options.FindOptions) ([]T, error) {
+	cur, err := client.Database("MVDB").Collection(collectionName).Find(ctx, filter, opts...)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	docs := []T{}
+	if err := cur.All(ctx, &docs); err != nil {
+		return nil, err
+	}
+	return docs, nil
+}
+
+// findByIDs fetches the documents matching filter by hex ObjectID, keyed by the same hex string.
+// Malformed ids are skipped, and so are the documents filter leaves out, as REST answers 404 for them.
+func findByIDs[T any](ctx context.Context, collectionName string, keys []string, filter bson.M, id func(*T) primitive.ObjectID) (map[string]*T, error) {
+	var ids []primitive.ObjectID
+	for _, k := range keys {
+		if oid, err := primitive.ObjectIDFromHex(k); err == nil {
+			ids = append(ids, oid)
+		}
+	}
+
+	filter["_id"] = bson.M{"$in": ids}
+	docs, err := findAll[T](ctx, collectionName, filter)
+	if err != nil {
+		return nil, err
+	}
+	results := make(map[string]*T, len(docs))
+	for i := range docs {
+		results[id(&docs[i]).Hex()] = &docs[i]
+	}
+	return results, nil
+}
+
+// findGrouped fetches documents matching filter whose field is one of keys, grouped by that field
+func findGrouped[T any](ctx context.Context, collectionName, field string, keys []string, filter bson.M, group func(T) string) (map[string][]T, error) {
+	filter[field] = bson.M{"$in": keys}
+	docs, err := findAll[T](ctx, collectionName, filter)
+	if err != nil {
+		return nil, err
+	}
+	results := make(map[string][]T, len(keys))
+	for _, k := range keys {
+		results[k] = []T{} // GraphQL lists are non-null, so missing groups are empty rather than nil
+	}
+	for _, doc := range docs {
+		results[group(doc)] = append(results[group(doc)], doc)
+	}
+	return results, nil
+}
+
+func countInquiriesByProperty(ctx context.Context, keys []string) (map[string]int, error) {
+	pipeline := []bson.M{
+		{"$match": bson.M{"property_id": bson.M{"$in": keys}}},
+		{"$group": bson.M{"_id": "$property_id", "count": bson.M{"$sum": 1}}},
+	}
+	cur, err := client.Database("MVDB").Collection("inquiries").Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	var rows []struct {
+		PropertyID string `bson:"_id"`
+		Count      int    `bson:"count"`
+	}
+	if err := cur.All(ctx, &rows); err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int, len(rows))
+	for _, row := range rows {
+		counts[row.PropertyID] = row.Count
+	}
+	return counts, nil
+}
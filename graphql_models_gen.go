@@ -0,0 +1,48 @@
+// Code generated by github.com/99designs/gqlgen, DO NOT EDIT.
+
+package main
+
+type Mutation struct {
+}
+
+type NewInquiry struct {
+	UserID     string `json:"userId"`
+	PropertyID string `json:"propertyId"`
+	Message    string `json:"message"`
+}
+
+type NewListing struct {
+	PropertyID      string  `json:"propertyId"`
+	Description     string  `json:"description"`
+	Price           float64 `json:"price"`
+	MinimumContract string  `json:"minimumContract"`
+	Floor           int     `json:"floor"`
+	Size            float64 `json:"size"`
+	Bedroom         int     `json:"bedroom"`
+	Bathroom        int     `json:"bathroom"`
+	Furniture       string  `json:"furniture"`
+	Status          string  `json:"status"`
+	ListingType     string  `json:"listingType"`
+	FacingDirection string  `json:"facingDirection"`
+	ListingStatus   string  `json:"listingStatus"`
+}
+
+type NewProperty struct {
+	Title       string    `json:"title"`
+	Developer   string    `json:"developer"`
+	Description string    `json:"description"`
+	Coordinates []float64 `json:"coordinates"`
+	MinPrice    int       `json:"minPrice"`
+	MaxPrice    int       `json:"maxPrice"`
+	Facilities  []string  `json:"facilities"`
+	Built       int       `json:"built"`
+}
+
+type NewUser struct {
+	Name  string `json:"name"`
+	Email string `json:"email"`
+	Phone string `json:"phone"`
+}
+
+type Query struct {
+}
@@ -0,0 +1,281 @@
+package main
+
+// THIS CODE WILL BE UPDATED WITH SCHEMA CHANGES. PREVIOUS IMPLEMENTATION FOR SCHEMA CHANGES WILL BE KEPT IN THE COMMENT SECTION. IMPLEMENTATION FOR UNCHANGED SCHEMA WILL BE KEPT.
+
+import (
+	"context"
+	"errors"
+
+	"github.com/LynnT-2003/mv-realty-backend/imagemeta"
+	"github.com/vektah/gqlparser/v2/gqlerror"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type Resolver struct{}
+
+// User is the resolver for the user field.
+func (r *appointmentResolver) User(ctx context.Context, obj *Appointment) (*User, error) {
+	if err := requireAdminScope(ctx); err != nil {
+		return nil, err
+	}
+	return loadersFor(ctx).userByID.Load(obj.UserID)
+}
+
+// Property is the resolver for the property field.
+func (r *appointmentResolver) Property(ctx context.Context, obj *Appointment) (*Property, error) {
+	return loadersFor(ctx).propertyByID.Load(obj.PropertyID)
+}
+
+// Listing is the resolver for the listing field.
+func (r *appointmentResolver) Listing(ctx context.Context, obj *Appointment) (*Listing, error) {
+	return loadersFor(ctx).listingByID.Load(obj.ListingID)
+}
+
+// User is the resolver for the user field.
+func (r *inquiryResolver) User(ctx context.Context, obj *Inquiry) (*User, error) {
+	if err := requireAdminScope(ctx); err != nil {
+		return nil, err
+	}
+	return loadersFor(ctx).userByID.Load(obj.User_id)
+}
+
+// Property is the resolver for the property field.
+func (r *inquiryResolver) Property(ctx context.Context, obj *Inquiry) (*Property, error) {
+	return loadersFor(ctx).propertyByID.Load(obj.Property_id)
+}
+
+// Property is the resolver for the property field.
+func (r *listingResolver) Property(ctx context.Context, obj *Listing) (*Property, error) {
+	return loadersFor(ctx).propertyByID.Load(obj.PropertyID)
+}
+
+// Photos is the resolver for the photos field.
+func (r *listingResolver) Photos(ctx context.Context, obj *Listing) ([]string, error) {
+	return imagemeta.URLs(obj.Photos), nil
+}
+
+// CreateProperty is the resolver for the createProperty field.
+func (r *mutationResolver) CreateProperty(ctx context.Context, input NewProperty, allowDuplicate *bool) (*Property, error) {
+	if len(input.Coordinates) != 2 {
+		return nil, errors.New("Coordinates must contain exactly two values")
+	}
+	property := Property{
+		Title:       input.Title,
+		Developer:   input.Developer,
+		Description: input.Description,
+		Coordinates: [2]float64{input.Coordinates[0], input.Coordinates[1]},
+		MinPrice:    input.MinPrice,
+		MaxPrice:    input.MaxPrice,
+		Facilities:  input.Facilities,
+		Built:       input.Built,
+	}
+	// Likely duplicates are refused as by POST /add/property, unless allowDuplicate confirms it is a
+	// different property; a driver error is made generic by presentGraphQLError
+	if allowDuplicate == nil || !*allowDuplicate {
+		duplicate, err := findDuplicateProperty(ctx, &property)
+		if err != nil {
+			return nil, err
+		}
+		if duplicate != nil {
+			return nil, &gqlerror.Error{
+				Message:    "A similar Property already exists; repeat with allowDuplicate: true to create it anyway",
+				Extensions: map[string]interface{}{"code": "DUPLICATE", "duplicatePropertyId": duplicate.ID.Hex(), "duplicateTitle": duplicate.Title},
+			}
+		}
+	}
+	id, err := insertProperty(ctx, &property)
+	if err != nil {
+		var vErr *validationError
+		if errors.As(err, &vErr) {
+			return nil, vErr
+		}
+		return nil, errors.New("Failed to create Property")
+	}
+	property.ID = id.(primitive.ObjectID)
+	auditCreated(auditFromContext(ctx), "properties", id, property)
+	return &property, nil
+}
+
+// CreateListing is the resolver for the createListing field.
+func (r *mutationResolver) CreateListing(ctx context.Context, input NewListing) (*Listing, error) {
+	listing := Listing{
+		PropertyID:      input.PropertyID,
+		Description:     input.Description,
+		Price:           input.Price,
+		MinimumContract: input.MinimumContract,
+		Floor:           input.Floor,
+		Size:            input.Size,
+		Bedroom:         input.Bedroom,
+		Bathroom:        input.Bathroom,
+		Furniture:       input.Furniture,
+		Status:          input.Status,
+		ListingType:     input.ListingType,
+		FacingDirection: input.FacingDirection,
+		ListingStatus:   input.ListingStatus,
+	}
+	id, err := insertListing(ctx, &listing)
+	var vErr *validationError
+	switch {
+	case err == nil:
+	case errors.As(err, &vErr), err == errInvalidPropertyID, err == errPropertyNotFound, err == errPropertyCheck:
+		return nil, err
+	default:
+		return nil, errors.New("Failed to create Listing")
+	}
+	listing.ID = id.(primitive.ObjectID)
+	auditCreated(auditFromContext(ctx), "listings", id, listing)
+	go matchSavedSearches(listing)
+	return &listing, nil
+}
+
+// CreateInquiry is the resolver for the createInquiry field.
+func (r *mutationResolver) CreateInquiry(ctx context.Context, input NewInquiry) (*Inquiry, error) {
+	inquiry := Inquiry{
+		User_id:     input.UserID,
+		Property_id: input.PropertyID,
+		Message:     input.Message,
+	}
+	id, err := insertInquiry(ctx, &inquiry)
+	if err != nil {
+		return nil, errors.New("Failed to create Inquiry")
+	}
+	inquiry.ID = id.(primitive.ObjectID)
+	auditCreated(auditFromContext(ctx), "inquiries", id, inquiry)
+	return &inquiry, nil
+}
+
+// CreateUser is the resolver for the createUser field.
+func (r *mutationResolver) CreateUser(ctx context.Context, input NewUser) (*User, error) {
+	user := User{
+		Name:  input.Name,
+		Email: input.Email,
+		Phone: input.Phone,
+	}
+	id, err := insertUser(ctx, &user)
+	if err != nil {
+		return nil, errors.New("Failed to create User")
+	}
+	user.ID = id.(primitive.ObjectID)
+	auditCreated(auditFromContext(ctx), "users", id, user)
+	return &user, nil
+}
+
+// Coordinates is the resolver for the coordinates field.
+func (r *propertyResolver) Coordinates(ctx context.Context, obj *Property) ([]float64, error) {
+	return obj.Coordinates[:], nil
+}
+
+// Images is the resolver for the images field.
+func (r *propertyResolver) Images(ctx context.Context, obj *Property) ([]string, error) {
+	return imagemeta.URLs(obj.Images), nil
+}
+
+// Listings is the resolver for the listings field.
+func (r *propertyResolver) Listings(ctx context.Context, obj *Property) ([]Listing, error) {
+	return loadersFor(ctx).listingsByProperty.Load(obj.ID.Hex())
+}
+
+// Inquiries is the resolver for the inquiries field.
+func (r *propertyResolver) Inquiries(ctx context.Context, obj *Property) ([]Inquiry, error) {
+	if err := requireAdminScope(ctx); err != nil {
+		return nil, err
+	}
+	return loadersFor(ctx).inquiriesByProperty.Load(obj.ID.Hex())
+}
+
+// InquiryCount is the resolver for the inquiryCount field.
+func (r *propertyResolver) InquiryCount(ctx context.Context, obj *Property) (int, error) {
+	return loadersFor(ctx).inquiryCountsByProperty.Load(obj.ID.Hex())
+}
+
+// Properties is the resolver for the properties field.
+func (r *queryResolver) Properties(ctx context.Context) ([]Property, error) {
+	return findAll[Property](ctx, "properties", notDeleted(bson.M{}))
+}
+
+// Property is the resolver for the property field.
+func (r *queryResolver) Property(ctx context.Context, id primitive.ObjectID) (*Property, error) {
+	return loadersFor(ctx).propertyByID.Load(id.Hex())
+}
+
+// Listings is the resolver for the listings field.
+func (r *queryResolver) Listings(ctx context.Context) ([]Listing, error) {
+	return findAll[Listing](ctx, "listings", publishedListingsFilter(bson.M{}))
+}
+
+// Listing is the resolver for the listing field.
+func (r *queryResolver) Listing(ctx context.Context, id primitive.ObjectID) (*Listing, error) {
+	return loadersFor(ctx).listingByID.Load(id.Hex())
+}
+
+// Users is the resolver for the users field.
+func (r *queryResolver) Users(ctx context.Context) ([]User, error) {
+	if err := requireAdminScope(ctx); err != nil {
+		return nil, err
+	}
+	return findAll[User](ctx, "users", notDeleted(bson.M{}))
+}
+
+// User is the resolver for the user field.
+func (r *queryResolver) User(ctx context.Context, id primitive.ObjectID) (*User, error) {
+	if err := requireAdminScope(ctx); err != nil {
+		return nil, err
+	}
+	return loadersFor(ctx).userByID.Load(id.Hex())
+}
+
+// Appointments is the resolver for the appointments field.
+func (r *queryResolver) Appointments(ctx context.Context) ([]Appointment, error) {
+	if err := requireAdminScope(ctx); err != nil {
+		return nil, err
+	}
+	return findAll[Appointment](ctx, "appointments", bson.M{})
+}
+
+// Inquiries is the resolver for the inquiries field.
+func (r *queryResolver) Inquiries(ctx context.Context) ([]Inquiry, error) {
+	if err := requireAdminScope(ctx); err != nil {
+		return nil, err
+	}
+	return findAll[Inquiry](ctx, "inquiries", bson.M{})
+}
+
+// Inquiries is the resolver for the inquiries field.
+func (r *userResolver) Inquiries(ctx context.Context, obj *User) ([]Inquiry, error) {
+	return loadersFor(ctx).inquiriesByUser.Load(obj.ID.Hex())
+}
+
+// Appointments is the resolver for the appointments field.
+func (r *userResolver) Appointments(ctx context.Context, obj *User) ([]Appointment, error) {
+	return loadersFor(ctx).appointmentsByUser.Load(obj.ID.Hex())
+}
+
+// Appointment returns AppointmentResolver implementation.
+func (r *Resolver) Appointment() AppointmentResolver { return &appointmentResolver{r} }
+
+// Inquiry returns InquiryResolver implementation.
+func (r *Resolver) Inquiry() InquiryResolver { return &inquiryResolver{r} }
+
+// Listing returns ListingResolver implementation.
+func (r *Resolver) Listing() ListingResolver { return &listingResolver{r} }
+
+// Mutation returns MutationResolver implementation.
+func (r *Resolver) Mutation() MutationResolver { return &mutationResolver{r} }
+
+// Property returns PropertyResolver implementation.
+func (r *Resolver) Property() PropertyResolver { return &propertyResolver{r} }
+
+// Query returns QueryResolver implementation.
+func (r *Resolver) Query() QueryResolver { return &queryResolver{r} }
+
+// User returns UserResolver implementation.
+func (r *Resolver) User() UserResolver { return &userResolver{r} }
+
+type appointmentResolver struct{ *Resolver }
+type inquiryResolver struct{ *Resolver }
+type listingResolver struct{ *Resolver }
+type mutationResolver struct{ *Resolver }
+type propertyResolver struct{ *Resolver }
+type queryResolver struct{ *Resolver }
+type userResolver struct{ *Resolver }
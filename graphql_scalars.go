@@ -0,0 +1,25 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/99designs/gqlgen/graphql"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// MarshalObjectID / UnmarshalObjectID bind the GraphQL ObjectID scalar to primitive.ObjectID
+func MarshalObjectID(id primitive.ObjectID) graphql.Marshaler {
+	return graphql.WriterFunc(func(w io.Writer) {
+		io.WriteString(w, strconv.Quote(id.Hex()))
+	})
+}
+
+func UnmarshalObjectID(v interface{}) (primitive.ObjectID, error) {
+	s, ok := v.(string)
+	if !ok {
+		return primitive.NilObjectID, fmt.Errorf("ObjectID must be a string")
+	}
+	return primitive.ObjectIDFromHex(s)
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type graphQLResponse struct {
+	Data   map[string]json.RawMessage `json:"data"`
+	Errors []struct {
+		Message    string                 `json:"message"`
+		Path       []interface{}          `json:"path"`
+		Extensions map[string]interface{} `json:"extensions"`
+	} `json:"errors"`
+}
+
+// graphQLRouter mounts /graphql the way routes does, after withAPIKeyIdentity
+func graphQLRouter() http.Handler {
+	r := mux.NewRouter()
+	r.Use(withAPIKeyIdentity)
+	registerGraphQL(r)
+	return r
+}
+
+func queryGraphQL(t *testing.T, handler http.Handler, key, query string) graphQLResponse {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/graphql?query="+url.QueryEscape(query), nil)
+	req.Header.Set("X-API-Key", key)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK && rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("%s: %d %s", query, rec.Code, rec.Body)
+	}
+	var resp graphQLResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+// TestGraphQLAdminFields: a read scope key can't list users, inquiries or appointments, which the REST
+// routes keep to admin keys too
+func TestGraphQLAdminFields(t *testing.T) {
+	useTestKeys(t)
+	cacheTestAPIKey(t, "read-key", scopeRead)
+	cacheTestAPIKey(t, "partner-key", scopeRead, scopeWrite, scopeUpload)
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	unreachableMongo(t)
+	handler := graphQLRouter()
+
+	queries := map[string]string{
+		"users":        "{ users { name email phone } }",
+		"user":         `{ user(id: "0123456789abcdef01234567") { email } }`,
+		"inquiries":    "{ inquiries { message } }",
+		"appointments": "{ appointments { appointmentDate } }",
+	}
+	for _, key := range []string{"read-key", "partner-key"} {
+		for field, query := range queries {
+			resp := queryGraphQL(t, handler, key, query)
+			if len(resp.Errors) != 1 || resp.Errors[0].Extensions["code"] != "FORBIDDEN" || resp.Errors[0].Message != "This API key lacks the admin scope" ||
+				len(resp.Errors[0].Path) != 1 || resp.Errors[0].Path[0] != field {
+				t.Errorf("%s, %s: %+v", key, field, resp.Errors)
+			}
+			if raw := resp.Data[field]; len(raw) != 0 && string(raw) != "null" {
+				t.Errorf("%s, %s: data %s", key, field, raw)
+			}
+		}
+	}
+
+	// The admin key gets past the check to the database, which can't be reached here
+	for field, query := range queries {
+		resp := queryGraphQL(t, handler, "test-shared-key", query)
+		for _, e := range resp.Errors {
+			if e.Extensions["code"] == "FORBIDDEN" {
+				t.Errorf("the admin key is refused %s", field)
+			}
+		}
+	}
+}
+
+func TestRequireAdminScope(t *testing.T) {
+	useTestKeys(t)
+	cacheTestAPIKey(t, "read-key", scopeRead)
+	for key, allowed := range map[string]bool{"": false, "read-key": false, "test-shared-key": true} {
+		req := httptest.NewRequest(http.MethodPost, "/graphql", nil)
+		req.Header.Set("X-API-Key", key)
+		ctx := req.Context()
+		withAPIKeyIdentity(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { ctx = r.Context() })).ServeHTTP(httptest.NewRecorder(), req)
+		if err := requireAdminScope(ctx); (err == nil) != allowed {
+			t.Errorf("key %q: %v", key, err)
+		}
+	}
+}
+
+// TestGraphQLLoadersHideDeleted: by id, the loaders leave out what REST answers 404 for, deleted
+// documents and draft listings
+func TestGraphQLLoadersHideDeleted(t *testing.T) {
+	useTestMongo(t, "properties", "listings", "users")
+	deleted := time.Now()
+	live, gone := primitive.NewObjectID(), primitive.NewObjectID()
+	published, draft, removed := primitive.NewObjectID(), primitive.NewObjectID(), primitive.NewObjectID()
+	user, deletedUser := primitive.NewObjectID(), primitive.NewObjectID()
+	insertDocs(t, "properties", Property{ID: live, Title: "Live"}, Property{ID: gone, Title: "Gone", DeletedAt: &deleted})
+	insertDocs(t, "listings", Listing{ID: published, PropertyID: live.Hex()}, Listing{ID: draft, PropertyID: live.Hex(), Publication: publicationDraft},
+		Listing{ID: removed, PropertyID: live.Hex(), DeletedAt: &deleted})
+	insertDocs(t, "users", User{ID: user, Name: "Somchai"}, User{ID: deletedUser, Name: "Left", DeletedAt: &deleted})
+
+	l := newLoaders(context.Background())
+	for id, want := range map[primitive.ObjectID]bool{live: true, gone: false} {
+		if p, err := l.propertyByID.Load(id.Hex()); err != nil || (p != nil) != want {
+			t.Errorf("property %s: %v %v", id.Hex(), p, err)
+		}
+	}
+	for id, want := range map[primitive.ObjectID]bool{published: true, draft: false, removed: false} {
+		if listing, err := l.listingByID.Load(id.Hex()); err != nil || (listing != nil) != want {
+			t.Errorf("listing %s: %v %v", id.Hex(), listing, err)
+		}
+	}
+	for id, want := range map[primitive.ObjectID]bool{user: true, deletedUser: false} {
+		if u, err := l.userByID.Load(id.Hex()); err != nil || (u != nil) != want {
+			t.Errorf("user %s: %v %v", id.Hex(), u, err)
+		}
+	}
+}
+
+// TestLoaderKeepsRequestContext: a batch runs with the request's id and deadline, and stops with it
+func TestLoaderKeepsRequestContext(t *testing.T) {
+	deadline := time.Now().Add(time.Second)
+	ctx, cancel := context.WithDeadline(context.WithValue(context.Background(), requestIDKey{}, "req-7"), deadline)
+	defer cancel()
+	var batchCtx context.Context
+	l := newLoader(ctx, func(ctx context.Context, keys []string) (map[string]int, error) {
+		batchCtx = ctx
+		return map[string]int{"a": len(keys)}, ctx.Err()
+	})
+	if n, err := l.Load("a"); err != nil || n != 1 {
+		t.Fatalf("Load: %d %v", n, err)
+	}
+	if got, ok := batchCtx.Deadline(); requestID(batchCtx) != "req-7" || !ok || got.After(deadline) {
+		t.Errorf("batch context: request %q, deadline %v", requestID(batchCtx), got)
+	}
+
+	cancel()
+	if _, err := l.Load("b"); err != context.Canceled {
+		t.Errorf("after the request ended: %v", err)
+	}
+}
+
+func mutateGraphQL(t *testing.T, handler http.Handler, query string) graphQLResponse {
+	t.Helper()
+	body, _ := json.Marshal(map[string]string{"query": query})
+	req := httptest.NewRequest(http.MethodPost, "/graphql", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-API-Key", "test-shared-key")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	var resp graphQLResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("%d %s: %v", rec.Code, rec.Body, err)
+	}
+	return resp
+}
+
+// TestGraphQLCreatePropertyDuplicate: createProperty runs the duplicate check of POST /add/property,
+// and allowDuplicate skips it like ?allow_duplicate=true
+func TestGraphQLCreatePropertyDuplicate(t *testing.T) {
+	useTestMongo(t, "properties", "developers")
+	useTestKeys(t)
+	skipMaintenanceLookup(t)
+	existing := primitive.NewObjectID()
+	insertDocs(t, "properties", Property{ID: existing, Title: "Noble Ploenchit", Coordinates: [2]float64{13.7437, 100.5486}})
+	handler := graphQLRouter()
+
+	const input = `input: {title: "Noble  ploenchit", developer: "Noble", description: "Condo on Ploenchit Road",
+		coordinates: [13.70, 100.60], minPrice: 5000000, maxPrice: 9000000, facilities: ["Pool"], built: 2016}`
+	resp := mutateGraphQL(t, handler, `mutation { createProperty(`+input+`) { id } }`)
+	if len(resp.Errors) != 1 || resp.Errors[0].Extensions["code"] != "DUPLICATE" || resp.Errors[0].Extensions["duplicatePropertyId"] != existing.Hex() {
+		t.Fatalf("a similar title: %+v", resp.Errors)
+	}
+	if n, _ := client.Database("MVDB").Collection("properties").CountDocuments(context.Background(), bson.M{}); n != 1 {
+		t.Errorf("%d properties after the refused create", n)
+	}
+
+	resp = mutateGraphQL(t, handler, `mutation { createProperty(`+input+`, allowDuplicate: true) { id title } }`)
+	if len(resp.Errors) != 0 || !strings.Contains(string(resp.Data["createProperty"]), `"title":"Noble  ploenchit"`) {
+		t.Errorf("with allowDuplicate: %s %+v", resp.Data["createProperty"], resp.Errors)
+	}
+}
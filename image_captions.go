@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/LynnT-2003/mv-realty-backend/imagemeta"
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// imageTextUpdate is the body of the image PATCH endpoints; absent fields are left unchanged
+type imageTextUpdate struct {
+	Caption *string `json:"caption"`
+	Alt     *string `json:"alt"`
+}
+
+// updatePropertyImage sets the caption and alt text of one property image
+func updatePropertyImage(w http.ResponseWriter, r *http.Request) {
+	updateImageText(w, r, "properties", "images", "Property", func(p *Property) ([]imagemeta.Image, time.Time) {
+		return p.Images, p.UpdatedAt
+	})
+}
+
+// updateListingPhoto sets the caption and alt text of one listing photo
+func updateListingPhoto(w http.ResponseWriter, r *http.Request) {
+	updateImageText(w, r, "listings", "photos", "Listing", func(l *Listing) ([]imagemeta.Image, time.Time) {
+		return l.Photos, l.UpdatedAt
+	})
+}
+
+// updateImageText finds the image by public_id in the document's field and replaces it there. A
+// legacy URL string is stored as an image object from then on. The update is pinned to updated_at,
+// so an image list changed in the meantime answers 409 rather than overwriting the wrong entry.
+func updateImageText[T any](w http.ResponseWriter, r *http.Request, coll, field, entity string, images func(*T) ([]imagemeta.Image, time.Time)) {
+	w.Header().Set("Content-Type", "application/json")
+
+	id, ok := pathObjectID(w, r, entity)
+	if !ok {
+		return
+	}
+	params := mux.Vars(r)
+	var body imageTextUpdate
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Failed to parse request body", http.StatusBadRequest)
+		return
+	}
+	if body.Caption == nil && body.Alt == nil {
+		http.Error(w, "caption or alt is required", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	collection := client.Database("MVDB").Collection(coll)
+	var doc T
+	err := collection.FindOne(ctx, notDeleted(bson.M{"_id": id})).Decode(&doc)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, entity+" not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to retrieve "+entity, http.StatusInternalServerError)
+		return
+	}
+	list, updatedAt := images(&doc)
+	i := imagemeta.Index(list, params["public_id"])
+	if i < 0 {
+		http.Error(w, "Image not found", http.StatusNotFound)
+		return
+	}
+
+	img := list[i]
+	if img.PublicID == "" {
+		img.PublicID = params["public_id"]
+	}
+	if body.Caption != nil {
+		img.Caption = imagemeta.CleanText(*body.Caption)
+	}
+	if body.Alt != nil {
+		img.Alt = imagemeta.CleanText(*body.Alt)
+	}
+	if problems := imagemeta.TextProblems(img.Caption, img.Alt); len(problems) > 0 {
+		http.Error(w, (&validationError{Problems: problems}).Error(), http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	res, err := collection.UpdateOne(ctx, notDeleted(bson.M{"_id": id, "updated_at": updatedAt}), bson.M{"$set": bson.M{
+		fmt.Sprintf("%s.%d", field, i): img,
+		"updated_at":                   now,
+	}})
+	if err != nil {
+		serverError(w, r, "Failed to update image", err)
+		return
+	}
+	if res.MatchedCount == 0 {
+		http.Error(w, entity+" was modified concurrently, try again", http.StatusConflict)
+		return
+	}
+	recordAudit(auditFromRequest(r), "update", coll, id.Hex(), bson.M{field: list}, bson.M{field: replaceImage(list, i, img)}, nil)
+	json.NewEncoder(w).Encode(img)
+}
+
+func replaceImage(list []imagemeta.Image, i int, img imagemeta.Image) []imagemeta.Image {
+	updated := append([]imagemeta.Image(nil), list...)
+	updated[i] = img
+	return updated
+}
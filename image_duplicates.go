@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	_ "image/gif" // with jpeg and png, the formats photoHash can read
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/LynnT-2003/mv-realty-backend/imagemeta"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// maxDuplicatePairs caps the report; a single stock photo on many properties makes many pairs
+const maxDuplicatePairs = 500
+
+// photoHash is the DHash of an uploaded file, "" for formats Go can't decode (HEIC, WebP)
+func photoHash(data []byte) string {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return ""
+	}
+	return imagemeta.DHash(img)
+}
+
+type duplicateImage struct {
+	PropertyID    string `json:"property_id"`
+	PropertyTitle string `json:"property_title"`
+	PublicID      string `json:"public_id"`
+	URL           string `json:"url"`
+	Hash          string `json:"hash"`
+}
+
+type duplicatePair struct {
+	A        duplicateImage `json:"a"`
+	B        duplicateImage `json:"b"`
+	Distance int            `json:"distance"`
+}
+
+// getDuplicateImages answers GET /admin/reports/duplicate-images: pairs of images on different
+// properties whose hashes are within imagemeta.DuplicateDistance, closest first. Images uploaded before
+// hashing have no hash and aren't compared.
+func getDuplicateImages(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+
+	properties, err := findAllWith[Property](ctx, "properties", notDeleted(bson.M{"images.hash": bson.M{"$exists": true}}),
+		options.Find().SetProjection(bson.M{"title": 1, "images": 1}))
+	if err != nil {
+		serverError(w, r, "Failed to retrieve Properties", err)
+		return
+	}
+	var images []duplicateImage
+	for _, p := range properties {
+		for _, img := range p.Images {
+			if img.Hash != "" {
+				images = append(images, duplicateImage{PropertyID: p.ID.Hex(), PropertyTitle: p.Title, PublicID: img.PublicID, URL: img.URL, Hash: img.Hash})
+			}
+		}
+	}
+
+	pairs := []duplicatePair{}
+	for i := range images {
+		for j := i + 1; j < len(images); j++ {
+			if images[i].PropertyID == images[j].PropertyID {
+				continue
+			}
+			if d, ok := imagemeta.HashDistance(images[i].Hash, images[j].Hash); ok && d <= imagemeta.DuplicateDistance {
+				pairs = append(pairs, duplicatePair{A: images[i], B: images[j], Distance: d})
+			}
+		}
+	}
+	sort.SliceStable(pairs, func(i, j int) bool { return pairs[i].Distance < pairs[j].Distance })
+	truncated := len(pairs) > maxDuplicatePairs
+	if truncated {
+		pairs = pairs[:maxDuplicatePairs]
+	}
+	json.NewEncoder(w).Encode(bson.M{"pairs": pairs, "truncated": truncated, "images_compared": len(images)})
+}
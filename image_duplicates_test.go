@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/LynnT-2003/mv-realty-backend/imagemeta"
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func readFixture(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile("imagemeta/testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestPhotoHash(t *testing.T) {
+	png, jpeg := photoHash(readFixture(t, "living_room.png")), photoHash(readFixture(t, "living_room_small.jpg"))
+	if d, ok := imagemeta.HashDistance(png, jpeg); !ok || d > imagemeta.DuplicateDistance {
+		t.Errorf("the PNG (%s) and the JPEG (%s) of one photo are %d bits apart", png, jpeg, d)
+	}
+	for _, data := range [][]byte{nil, []byte("\x00\x00\x00\x18ftypheic"), []byte("RIFF\x00\x00\x00\x00WEBPVP8 ")} {
+		if h := photoHash(data); h != "" {
+			t.Errorf("%q hashed to %s", data, h)
+		}
+	}
+}
+
+// TestUploadRejectsDuplicateWhenStrict: with ?strict=true an upload the property already has is
+// refused before it reaches Cloudinary
+func TestUploadRejectsDuplicateWhenStrict(t *testing.T) {
+	useTestMongo(t, "properties")
+	id := primitive.NewObjectID()
+	stored := imagemeta.Image{URL: "https://cdn.example.com/room.png", PublicID: "properties/room", Hash: photoHash(readFixture(t, "living_room.png"))}
+	if _, err := client.Database("MVDB").Collection("properties").InsertOne(context.Background(),
+		Property{ID: id, Title: "Noble", Images: []imagemeta.Image{stored}}); err != nil {
+		t.Fatal(err)
+	}
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, _ := form.CreateFormFile("image", "room-small.jpg")
+	part.Write(readFixture(t, "living_room_small.jpg"))
+	form.Close()
+	req := httptest.NewRequest(http.MethodPost, "/properties/"+id.Hex()+"/images?strict=true", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	rec := httptest.NewRecorder()
+	uploadImage(rec, mux.SetURLVars(req, map[string]string{"id": id.Hex()}))
+	if rec.Code != http.StatusConflict || !strings.Contains(rec.Body.String(), "public_id properties/room") {
+		t.Errorf("%d %q, want 409 naming the stored image", rec.Code, rec.Body)
+	}
+}
+
+func TestDuplicateImagesReport(t *testing.T) {
+	useTestMongo(t, "properties")
+	room := photoHash(readFixture(t, "living_room.png"))
+	cropped := photoHash(readFixture(t, "living_room_cropped.jpg"))
+	bedroom := photoHash(readFixture(t, "bedroom.jpg"))
+	noble, ashton, third := primitive.NewObjectID(), primitive.NewObjectID(), primitive.NewObjectID()
+	if _, err := client.Database("MVDB").Collection("properties").InsertMany(context.Background(), []interface{}{
+		// the same photo twice on one property isn't a cross-property pair
+		Property{ID: noble, Title: "Noble", Images: []imagemeta.Image{{PublicID: "n1", Hash: room}, {PublicID: "n2", Hash: cropped}}},
+		Property{ID: ashton, Title: "Ashton", Images: []imagemeta.Image{{PublicID: "a1", Hash: room}, {PublicID: "a2", Hash: bedroom}}},
+		Property{ID: third, Title: "Old", Images: []imagemeta.Image{{PublicID: "o1", URL: "https://cdn.example.com/o1.jpg"}}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	getDuplicateImages(rec, httptest.NewRequest(http.MethodGet, "/admin/reports/duplicate-images", nil))
+	var report struct {
+		Pairs          []duplicatePair `json:"pairs"`
+		Truncated      bool            `json:"truncated"`
+		ImagesCompared int             `json:"images_compared"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	if report.ImagesCompared != 4 || report.Truncated || len(report.Pairs) != 2 {
+		t.Fatalf("report %+v, want n1-a1 and n2-a1 out of 4 images", report)
+	}
+	if first := report.Pairs[0]; first.Distance != 0 || first.A.PublicID != "n1" || first.B.PublicID != "a1" || first.B.PropertyTitle != "Ashton" {
+		t.Errorf("closest pair %+v", first)
+	}
+	if second := report.Pairs[1]; second.A.PublicID != "n2" || second.B.PublicID != "a1" || second.Distance > imagemeta.DuplicateDistance {
+		t.Errorf("second pair %+v", second)
+	}
+}
@@ -0,0 +1,74 @@
+package imagemeta
+
+import (
+	"fmt"
+	stdimage "image" // the package has its own image type, see imagemeta.go
+	"math/bits"
+	"strconv"
+)
+
+// DuplicateDistance is the largest Hamming distance between two hashes of the same picture. Resizing,
+// recompression and small crops stay well under it; different photos of one room are usually above 15.
+const DuplicateDistance = 6
+
+// DHash is the 64-bit difference hash of img: the picture shrunk to 9x8 grey pixels, one bit per pair
+// of horizontal neighbours telling whether brightness falls from left to right. It is returned as 16
+// hex digits.
+func DHash(img stdimage.Image) string {
+	const w, h = 9, 8
+	b := img.Bounds()
+	if b.Dx() == 0 || b.Dy() == 0 {
+		return fmt.Sprintf("%016x", 0)
+	}
+	var grey [h][w]float64
+	for y := 0; y < h; y++ {
+		y0, y1 := b.Min.Y+y*b.Dy()/h, b.Min.Y+(y+1)*b.Dy()/h
+		y1 = max(y1, y0+1)
+		for x := 0; x < w; x++ {
+			x0, x1 := b.Min.X+x*b.Dx()/w, b.Min.X+(x+1)*b.Dx()/w
+			x1 = max(x1, x0+1)
+			var sum float64
+			// Every pixel is sampled for small cells, large ones are sampled on a grid of at most 16x16
+			stepX, stepY := max(1, (x1-x0)/16), max(1, (y1-y0)/16)
+			n := 0
+			for sy := y0; sy < y1; sy += stepY {
+				for sx := x0; sx < x1; sx += stepX {
+					r, g, bl, _ := img.At(sx, sy).RGBA()
+					sum += 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(bl)
+					n++
+				}
+			}
+			grey[y][x] = sum / float64(n)
+		}
+	}
+	var hash uint64
+	for y := 0; y < h; y++ {
+		for x := 0; x < w-1; x++ {
+			hash <<= 1
+			if grey[y][x] > grey[y][x+1] {
+				hash |= 1
+			}
+		}
+	}
+	return fmt.Sprintf("%016x", hash)
+}
+
+// HashDistance is the number of differing bits of two DHash values, false when either isn't one
+func HashDistance(a, b string) (int, bool) {
+	x, err1 := strconv.ParseUint(a, 16, 64)
+	y, err2 := strconv.ParseUint(b, 16, 64)
+	if err1 != nil || err2 != nil || len(a) != 16 || len(b) != 16 {
+		return 0, false
+	}
+	return bits.OnesCount64(x ^ y), true
+}
+
+// NearDuplicate returns the first image of images whose hash is within DuplicateDistance of hash
+func NearDuplicate(images []Image, hash string) (*Image, int) {
+	for i := range images {
+		if d, ok := HashDistance(images[i].Hash, hash); ok && d <= DuplicateDistance {
+			return &images[i], d
+		}
+	}
+	return nil, 0
+}
@@ -0,0 +1,113 @@
+package imagemeta
+
+import (
+	stdimage "image"
+	"image/color"
+	_ "image/jpeg"
+	_ "image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// The fixtures are one living room as uploaded three ways, a PNG, a smaller recompressed JPEG and a
+// JPEG with the edges cropped, and a bedroom that is a different photo
+func fixtureHash(t *testing.T, name string) string {
+	t.Helper()
+	f, err := os.Open(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	img, _, err := stdimage.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := DHash(img)
+	if len(hash) != 16 {
+		t.Fatalf("%s: hash %q isn't 16 hex digits", name, hash)
+	}
+	return hash
+}
+
+func TestDHashFixtures(t *testing.T) {
+	original := fixtureHash(t, "living_room.png")
+	for _, name := range []string{"living_room_small.jpg", "living_room_cropped.jpg"} {
+		d, ok := HashDistance(original, fixtureHash(t, name))
+		if !ok || d > DuplicateDistance {
+			t.Errorf("%s is %d bits from the original, want at most %d", name, d, DuplicateDistance)
+		}
+	}
+	if d, _ := HashDistance(original, fixtureHash(t, "bedroom.jpg")); d <= DuplicateDistance {
+		t.Errorf("another room is only %d bits away", d)
+	}
+	if again := fixtureHash(t, "living_room.png"); again != original {
+		t.Errorf("the same image hashed to %s and %s", original, again)
+	}
+}
+
+func TestDHashEdgeCases(t *testing.T) {
+	if h := DHash(stdimage.NewGray(stdimage.Rect(0, 0, 0, 0))); h != "0000000000000000" {
+		t.Errorf("empty image: %s", h)
+	}
+	// smaller than the 9x8 grid; each cell still samples a pixel
+	tiny := stdimage.NewGray(stdimage.Rect(0, 0, 3, 2))
+	tiny.SetGray(0, 0, color.Gray{Y: 255})
+	if h := DHash(tiny); h == "0000000000000000" {
+		t.Errorf("a tiny image with a bright corner hashed to %s", h)
+	}
+	// brightness falling left to right sets every bit, a flat image none
+	falling := stdimage.NewGray(stdimage.Rect(0, 0, 90, 80))
+	for x := 0; x < 90; x++ {
+		for y := 0; y < 80; y++ {
+			falling.SetGray(x, y, color.Gray{Y: uint8(255 - x*2)})
+		}
+	}
+	if h := DHash(falling); h != "ffffffffffffffff" {
+		t.Errorf("falling gradient: %s", h)
+	}
+	if h := DHash(stdimage.NewGray(stdimage.Rect(0, 0, 50, 50))); h != "0000000000000000" {
+		t.Errorf("flat image: %s", h)
+	}
+}
+
+func TestHashDistance(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+		ok   bool
+	}{
+		{"0000000000000000", "0000000000000000", 0, true},
+		{"0000000000000000", "ffffffffffffffff", 64, true},
+		{"00000000000000ff", "000000000000000f", 4, true},
+		{"", "0000000000000000", 0, false},
+		{"fff", "0000000000000fff", 0, false}, // too short, though it parses
+		{"zzzzzzzzzzzzzzzz", "0000000000000000", 0, false},
+	}
+	for _, tt := range tests {
+		if d, ok := HashDistance(tt.a, tt.b); d != tt.want || ok != tt.ok {
+			t.Errorf("HashDistance(%q, %q) = %d, %v", tt.a, tt.b, d, ok)
+		}
+	}
+}
+
+func TestNearDuplicate(t *testing.T) {
+	images := []Image{
+		{PublicID: "old", URL: "https://cdn.example.com/old.jpg"}, // uploaded before hashing
+		{PublicID: "far", Hash: "ffffffffffffffff"},
+		{PublicID: "close", Hash: "000000000000003f"},
+		{PublicID: "closer", Hash: "0000000000000001"},
+	}
+	if img, d := NearDuplicate(images, "0000000000000000"); img == nil || img.PublicID != "close" || d != 6 {
+		t.Errorf("got %+v at %d, want the first image within the distance", img, d)
+	}
+	if img, _ := NearDuplicate(images, "00000000000000ff"); img == nil || img.PublicID != "close" {
+		t.Errorf("got %+v", img)
+	}
+	if img, _ := NearDuplicate(images, "ffffffff00000000"); img != nil {
+		t.Errorf("got %+v for a hash far from all", img)
+	}
+	if img, _ := NearDuplicate(images, ""); img != nil {
+		t.Errorf("an unhashed upload matched %+v", img)
+	}
+}
@@ -0,0 +1,205 @@
+// Package imagemeta is the image object shared by property images and listing photos: the URL,
+// the Cloudinary public_id and the caption and alt text shown with it.
+//
+// Images used to be stored as bare URL strings. Those still decode, from BSON and from JSON
+// request bodies, as an Image with that URL, the public_id taken from the URL and empty text.
+package imagemeta
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+)
+
+const (
+	MaxCaptionLength = 300 // characters
+	MaxAltLength     = 250 // characters
+)
+
+type Image struct {
+	URL      string `bson:"url" json:"url"`
+	PublicID string `bson:"public_id,omitempty" json:"public_id,omitempty"`
+	Caption  string `bson:"caption" json:"caption"`
+	Alt      string `bson:"alt" json:"alt"`
+	// OriginalURL is the delivery URL without the watermark, set while URL has one; see Watermark
+	OriginalURL string `bson:"original_url,omitempty" json:"original_url,omitempty"`
+	// Hash is the perceptual hash of the uploaded file, see DHash
+	Hash string `bson:"hash,omitempty" json:"hash,omitempty"`
+}
+
+// image has Image's fields without its decoders
+type image Image
+
+// UnmarshalBSONValue accepts both image documents and legacy URL strings
+func (img *Image) UnmarshalBSONValue(t bsontype.Type, data []byte) error {
+	raw := bson.RawValue{Type: t, Value: data}
+	if t == bsontype.String {
+		*img = FromURL(raw.StringValue())
+		return nil
+	}
+	var decoded image
+	if err := raw.Unmarshal(&decoded); err != nil {
+		return err
+	}
+	*img = Image(decoded)
+	return nil
+}
+
+// UnmarshalJSON accepts both image objects and bare URL strings
+func (img *Image) UnmarshalJSON(data []byte) error {
+	var u string
+	if err := json.Unmarshal(data, &u); err == nil {
+		*img = FromURL(u)
+		return nil
+	}
+	var decoded image
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+	*img = Image(decoded)
+	return nil
+}
+
+// FromURL is an image with no caption or alt text
+func FromURL(u string) Image {
+	return Image{URL: u, PublicID: PublicIDFromURL(u)}
+}
+
+var cloudinaryVersion = regexp.MustCompile(`^v\d+$`)
+
+// PublicIDFromURL extracts the public_id from a Cloudinary delivery URL
+// (https://res.cloudinary.com/<cloud>/image/upload/[transformations/][v123/]<public_id>.<ext>),
+// "" for other URLs
+func PublicIDFromURL(u string) string {
+	parsed, err := url.Parse(u)
+	if err != nil || !strings.HasSuffix(parsed.Host, "cloudinary.com") {
+		return ""
+	}
+	_, rest, ok := strings.Cut(parsed.Path, "/upload/")
+	if !ok {
+		return ""
+	}
+	segments := strings.Split(rest, "/")
+	// Transformations come before the version; without a version only the last segment is kept
+	start := len(segments) - 1
+	for i, s := range segments {
+		if cloudinaryVersion.MatchString(s) {
+			start = i + 1
+			break
+		}
+	}
+	if start >= len(segments) {
+		return ""
+	}
+	id := strings.Join(segments[start:], "/")
+	return strings.TrimSuffix(id, path.Ext(id))
+}
+
+// Index returns the position of the image with the public_id, -1 when there is none
+func Index(images []Image, publicID string) int {
+	for i, img := range images {
+		id := img.PublicID
+		if id == "" {
+			id = PublicIDFromURL(img.URL)
+		}
+		if id != "" && id == publicID {
+			return i
+		}
+	}
+	return -1
+}
+
+// URLs returns just the image URLs, in order
+func URLs(images []Image) []string {
+	urls := make([]string, len(images))
+	for i, img := range images {
+		urls[i] = img.URL
+	}
+	return urls
+}
+
+var htmlTag = regexp.MustCompile(`<[^>]*>`)
+
+// CleanText strips HTML tags, decodes entities and collapses whitespace
+func CleanText(s string) string {
+	s = html.UnescapeString(htmlTag.ReplaceAllString(s, " "))
+	// Entities can decode into tags, e.g. &lt;b&gt;
+	s = htmlTag.ReplaceAllString(s, " ")
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// Normalize cleans the caption and alt text of each image in place and fills in missing public_ids
+func Normalize(images []Image) {
+	for i := range images {
+		images[i].Caption = CleanText(images[i].Caption)
+		images[i].Alt = CleanText(images[i].Alt)
+		if images[i].PublicID == "" {
+			images[i].PublicID = PublicIDFromURL(images[i].URL)
+		}
+	}
+}
+
+// Problems checks every image of a list; field names the list in the messages, e.g. "photos"
+func Problems(field string, images []Image) []string {
+	var problems []string
+	for i, img := range images {
+		if strings.TrimSpace(img.URL) == "" {
+			problems = append(problems, fmt.Sprintf("%s[%d].url is required", field, i))
+		}
+		for _, p := range TextProblems(img.Caption, img.Alt) {
+			problems = append(problems, fmt.Sprintf("%s[%d].%s", field, i, p))
+		}
+	}
+	return problems
+}
+
+// TextProblems checks a cleaned caption and alt text against the length limits
+func TextProblems(caption, alt string) []string {
+	var problems []string
+	if n := utf8.RuneCountInString(caption); n > MaxCaptionLength {
+		problems = append(problems, fmt.Sprintf("caption must be at most %d characters, got %d", MaxCaptionLength, n))
+	}
+	if n := utf8.RuneCountInString(alt); n > MaxAltLength {
+		problems = append(problems, fmt.Sprintf("alt must be at most %d characters, got %d", MaxAltLength, n))
+	}
+	return problems
+}
+
+// Resource types of a floor plan file
+const (
+	ResourceImage = "image"
+	ResourcePDF   = "pdf"
+)
+
+// Plan is a floor plan file, kept apart from the photos. ResourceType tells the frontend whether to
+// show it in an img tag or a PDF viewer.
+type Plan struct {
+	URL          string `bson:"url" json:"url"`
+	PublicID     string `bson:"public_id" json:"public_id"`
+	Label        string `bson:"label" json:"label"` // e.g. "2BR Type A"
+	ResourceType string `bson:"resource_type" json:"resource_type"`
+}
+
+// planContentTypes maps the accepted upload content types to their resource type
+var planContentTypes = map[string]string{
+	"image/jpeg":      ResourceImage,
+	"image/png":       ResourceImage,
+	"image/webp":      ResourceImage,
+	"image/gif":       ResourceImage,
+	"application/pdf": ResourcePDF,
+}
+
+// PlanResourceType returns the resource type for a sniffed content type, false when floor plans
+// can't be that type
+func PlanResourceType(contentType string) (string, bool) {
+	t, ok := planContentTypes[contentType]
+	return t, ok
+}
@@ -0,0 +1,106 @@
+package imagemeta
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Gravities a watermark can be placed at, Cloudinary's names
+var Gravities = []string{"north_west", "north", "north_east", "west", "center", "east", "south_west", "south", "south_east"}
+
+// Watermark is a logo overlaid on delivery. The stored asset stays as uploaded; only the URL carries
+// the overlay, so the original is always one URL rewrite away.
+type Watermark struct {
+	LogoPublicID string  // public_id of the logo in the same Cloudinary account
+	Opacity      int     // 1-100
+	Gravity      string  // one of Gravities
+	Width        float64 // logo width as a fraction of the image width
+}
+
+// Problems checks the watermark settings
+func (wm Watermark) Problems() []string {
+	var problems []string
+	if wm.LogoPublicID == "" {
+		problems = append(problems, "the logo public_id is required")
+	}
+	if wm.Opacity < 1 || wm.Opacity > 100 {
+		problems = append(problems, fmt.Sprintf("opacity must be from 1 to 100, got %d", wm.Opacity))
+	}
+	valid := false
+	for _, g := range Gravities {
+		valid = valid || g == wm.Gravity
+	}
+	if !valid {
+		problems = append(problems, "gravity must be one of "+strings.Join(Gravities, ", "))
+	}
+	if wm.Width <= 0 || wm.Width > 1 {
+		problems = append(problems, fmt.Sprintf("width must be a fraction from 0 to 1, got %g", wm.Width))
+	}
+	return problems
+}
+
+// Transformation is the Cloudinary transformation that overlays the logo, e.g.
+// l_brand:logo,o_50,g_south_east,x_20,y_20,w_0.2,fl_relative. Folders in an overlay public_id are
+// separated by colons.
+func (wm Watermark) Transformation() string {
+	offset := 20
+	if wm.Gravity == "center" {
+		offset = 0
+	}
+	return fmt.Sprintf("l_%s,o_%d,g_%s,x_%d,y_%d,w_%g,fl_relative",
+		strings.ReplaceAll(wm.LogoPublicID, "/", ":"), wm.Opacity, wm.Gravity, offset, offset, wm.Width)
+}
+
+// withTransformation puts transformation right after /image/upload/ of a Cloudinary delivery URL;
+// other URLs come back unchanged and false
+func withTransformation(u, transformation string) (string, bool) {
+	if !strings.Contains(u, "cloudinary.com/") {
+		return u, false
+	}
+	const marker = "/image/upload/"
+	i := strings.Index(u, marker)
+	if i < 0 {
+		return u, false
+	}
+	i += len(marker)
+	return u[:i] + transformation + "/" + u[i:], true
+}
+
+// Apply returns img delivered with the watermark. The watermark is always built from the original
+// URL, so applying new settings replaces the old overlay rather than stacking one more. Images not
+// hosted on Cloudinary are returned unchanged.
+func (wm Watermark) Apply(img Image) Image {
+	original := img.URL
+	if img.OriginalURL != "" {
+		original = img.OriginalURL
+	}
+	u, ok := withTransformation(original, wm.Transformation())
+	if !ok {
+		return img
+	}
+	if img.PublicID == "" {
+		img.PublicID = PublicIDFromURL(original)
+	}
+	img.URL, img.OriginalURL = u, original
+	return img
+}
+
+// RemoveWatermark returns img delivered without its watermark
+func RemoveWatermark(img Image) Image {
+	if img.OriginalURL != "" {
+		img.URL, img.OriginalURL = img.OriginalURL, ""
+	}
+	return img
+}
+
+// stripMetadata is the flag that drops EXIF, IPTC and XMP, GPS positions included, from delivered images
+const stripMetadata = "fl_strip_profile"
+
+// StripMetadata returns img delivered without the metadata of the uploaded file
+func StripMetadata(img Image) Image {
+	if strings.Contains(img.URL, "/"+stripMetadata+"/") {
+		return img
+	}
+	img.URL, _ = withTransformation(img.URL, stripMetadata)
+	return img
+}
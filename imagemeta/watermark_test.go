@@ -0,0 +1,94 @@
+package imagemeta
+
+import "testing"
+
+const uploaded = "https://res.cloudinary.com/mvrealty/image/upload/v1712345678/properties/noble/living.jpg"
+
+func TestWatermarkTransformation(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		wm   Watermark
+		want string
+	}{
+		{"defaults", Watermark{"logo", 50, "south_east", 0.2}, "l_logo,o_50,g_south_east,x_20,y_20,w_0.2,fl_relative"},
+		{"folders become colons", Watermark{"brand/mv/logo", 50, "south_east", 0.2}, "l_brand:mv:logo,o_50,g_south_east,x_20,y_20,w_0.2,fl_relative"},
+		{"fully opaque", Watermark{"logo", 100, "north_west", 0.2}, "l_logo,o_100,g_north_west,x_20,y_20,w_0.2,fl_relative"},
+		{"faint", Watermark{"logo", 1, "south", 0.2}, "l_logo,o_1,g_south,x_20,y_20,w_0.2,fl_relative"},
+		{"centered without an offset", Watermark{"logo", 30, "center", 0.5}, "l_logo,o_30,g_center,x_0,y_0,w_0.5,fl_relative"},
+		{"full width", Watermark{"logo", 50, "east", 1}, "l_logo,o_50,g_east,x_20,y_20,w_1,fl_relative"},
+		{"fine width", Watermark{"logo", 50, "north", 0.125}, "l_logo,o_50,g_north,x_20,y_20,w_0.125,fl_relative"},
+	} {
+		if got := tt.wm.Transformation(); got != tt.want {
+			t.Errorf("%s: %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestWatermarkProblems(t *testing.T) {
+	for _, tt := range []struct {
+		wm       Watermark
+		problems int
+	}{
+		{Watermark{"logo", 50, "south_east", 0.2}, 0},
+		{Watermark{"logo", 1, "center", 1}, 0},
+		{Watermark{"", 50, "south_east", 0.2}, 1},
+		{Watermark{"logo", 0, "south_east", 0.2}, 1},
+		{Watermark{"logo", 101, "south_east", 0.2}, 1},
+		{Watermark{"logo", 50, "bottom_right", 0.2}, 1},
+		{Watermark{"logo", 50, "south_east", 0}, 1},
+		{Watermark{"logo", 50, "south_east", 1.5}, 1},
+		{Watermark{}, 4},
+	} {
+		if got := tt.wm.Problems(); len(got) != tt.problems {
+			t.Errorf("%+v: %q, want %d problems", tt.wm, got, tt.problems)
+		}
+	}
+}
+
+func TestWatermarkApply(t *testing.T) {
+	const transformation = "l_logo,o_50,g_south_east,x_20,y_20,w_0.2,fl_relative"
+	wm := Watermark{"logo", 50, "south_east", 0.2}
+	for _, tt := range []struct {
+		name    string
+		img     Image
+		wantURL string
+	}{
+		{"uploaded", Image{URL: uploaded},
+			"https://res.cloudinary.com/mvrealty/image/upload/" + transformation + "/v1712345678/properties/noble/living.jpg"},
+		{"new settings replace the old overlay", Image{URL: "https://res.cloudinary.com/mvrealty/image/upload/l_old,o_90,g_north,x_20,y_20,w_0.5,fl_relative/v1712345678/properties/noble/living.jpg", OriginalURL: uploaded},
+			"https://res.cloudinary.com/mvrealty/image/upload/" + transformation + "/v1712345678/properties/noble/living.jpg"},
+		{"metadata stripped", Image{URL: "https://res.cloudinary.com/mvrealty/image/upload/fl_strip_profile/v1/a.jpg"},
+			"https://res.cloudinary.com/mvrealty/image/upload/" + transformation + "/fl_strip_profile/v1/a.jpg"},
+		{"not on Cloudinary", Image{URL: "https://example.com/image/upload/a.jpg"}, "https://example.com/image/upload/a.jpg"},
+		{"not an upload", Image{URL: "https://res.cloudinary.com/mvrealty/video/upload/v1/a.mp4"}, "https://res.cloudinary.com/mvrealty/video/upload/v1/a.mp4"},
+	} {
+		got := wm.Apply(tt.img)
+		if got.URL != tt.wantURL {
+			t.Errorf("%s: %q, want %q", tt.name, got.URL, tt.wantURL)
+		}
+		if got.URL != tt.img.URL && (got.OriginalURL == "" || RemoveWatermark(got).URL != got.OriginalURL) {
+			t.Errorf("%s: the original %q isn't kept", tt.name, got.OriginalURL)
+		}
+	}
+
+	img := wm.Apply(Image{URL: uploaded})
+	if img.PublicID != "properties/noble/living" || img.OriginalURL != uploaded {
+		t.Errorf("public_id %q, original %q", img.PublicID, img.OriginalURL)
+	}
+	if removed := RemoveWatermark(img); removed.URL != uploaded || removed.OriginalURL != "" {
+		t.Errorf("removed: %+v", removed)
+	}
+}
+
+func TestStripMetadata(t *testing.T) {
+	stripped := "https://res.cloudinary.com/mvrealty/image/upload/fl_strip_profile/v1712345678/properties/noble/living.jpg"
+	for in, want := range map[string]string{
+		uploaded:                    stripped,
+		stripped:                    stripped,
+		"https://example.com/a.jpg": "https://example.com/a.jpg",
+	} {
+		if got := StripMetadata(Image{URL: in}).URL; got != want {
+			t.Errorf("%s: %q, want %q", in, got, want)
+		}
+	}
+}
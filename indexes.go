@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/LynnT-2003/mv-realty-backend/jobs"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// collectionIndexes lists the indexes the queries in this service rely on
+var collectionIndexes = map[string][]mongo.IndexModel{
+	"listings": {
+		// per-property lookups ($lookup from properties, property detail, listing filters)
+		{Keys: bson.D{{Key: "property_id", Value: 1}, {Key: "listing_status", Value: 1}}},
+		// stats and search over active listings by type
+		{Keys: bson.D{{Key: "listing_status", Value: 1}, {Key: "listing_type", Value: 1}, {Key: "price", Value: 1}}},
+		// ?tags= and GET /listings/tags
+		{Keys: bson.D{{Key: "tags", Value: 1}, {Key: "listing_status", Value: 1}}},
+		// min_price/max_price, one $or branch per currency
+		{Keys: bson.D{{Key: "currency", Value: 1}, {Key: "price", Value: 1}}},
+		// home page rails: featured and recently added
+		{Keys: bson.D{{Key: "featured", Value: 1}, {Key: "listing_status", Value: 1}, {Key: "created_at", Value: -1}}},
+		{Keys: bson.D{{Key: "created_at", Value: -1}}},
+		// expiry job and ?expiring_within_days=
+		{Keys: bson.D{{Key: "listing_status", Value: 1}, {Key: "expires_at", Value: 1}}},
+		// GET /listings/{idOrSlug}; partial so listings created before slugs existed don't collide
+		{Keys: bson.D{{Key: "slug", Value: 1}}, Options: uniqueSlugIndex()},
+		// GET /admin/listings/verification-queue
+		{Keys: bson.D{{Key: "verification.state", Value: 1}, {Key: "verification.requested_at", Value: 1}}},
+		// GET /agents/{id}/listings and the orphaned listings report
+		{Keys: bson.D{{Key: "agent_id", Value: 1}, {Key: "listing_status", Value: 1}}},
+		// GET /listings?q=; a collection can only have one text index
+		{Keys: bson.D{{Key: "description", Value: "text"}, {Key: "tags", Value: "text"}}},
+	},
+	"inquiries": {
+		// GET /agents/{id}/inquiries
+		{Keys: bson.D{{Key: "assigned_agent_id", Value: 1}, {Key: "created_at", Value: -1}}},
+		// the archive task, see archiveFilters
+		{Keys: bson.D{{Key: "created_at", Value: 1}}},
+	},
+	"inquiries_archive": {
+		{Keys: bson.D{{Key: "assigned_agent_id", Value: 1}, {Key: "created_at", Value: -1}}},
+	},
+	"appointments": {
+		// the archive task, see archiveFilters
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "appointment_date", Value: 1}}},
+		// slots booked before appointment_slots, see claimAppointmentSlot
+		{Keys: bson.D{{Key: "listing_id", Value: 1}, {Key: "appointment_date", Value: 1}}},
+		// conversions of GET /admin/analytics/inquiry-sources, see conversionLookup
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "property_id", Value: 1}, {Key: "created_at", Value: 1}}},
+	},
+	"appointment_slots": {
+		// a slot is of no use once its date passed
+		{Keys: bson.D{{Key: "appointment_date", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	},
+	"waitlist": {
+		// promoteWaitlist and GET /listings/{id}/waitlist
+		{Keys: bson.D{{Key: "listing_id", Value: 1}, {Key: "status", Value: 1}, {Key: "created_at", Value: 1}}},
+	},
+	consistencyReports: {
+		// background reports are kept for consistencyReportTTL
+		{Keys: bson.D{{Key: "created_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(int32(consistencyReportTTL.Seconds()))},
+	},
+	captureCollection: {
+		// GET /admin/requests/{request_id}
+		{Keys: bson.D{{Key: "request_id", Value: 1}}},
+	},
+	"notifications": {
+		// GET /users/{id}/notifications and the unread count
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "read", Value: 1}, {Key: "created_at", Value: -1}}},
+		// only read notifications have read_at, so unread ones never expire
+		{Keys: bson.D{{Key: "read_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(int32(readNotificationTTL.Seconds()))},
+	},
+	"saved_searches": {
+		{Keys: bson.D{{Key: "user_id", Value: 1}}},
+		// matchSavedSearches loads the searches with alerts on for the new listing's type
+		{Keys: bson.D{{Key: "alerts", Value: 1}, {Key: "filter.listing_type", Value: 1}}},
+		{Keys: bson.D{{Key: "unsubscribe_token", Value: 1}}, Options: options.Index().SetUnique(true)},
+	},
+	"api_keys": {
+		{Keys: bson.D{{Key: "hash", Value: 1}}, Options: options.Index().SetUnique(true)},
+	},
+	"shortlinks": {
+		// GET /l/{code}, and the collision check when minting
+		{Keys: bson.D{{Key: "code", Value: 1}}, Options: options.Index().SetUnique(true)},
+	},
+	"pending_images": {
+		// Moderation results arrive by public_id, admins count what is pending per property
+		{Keys: bson.D{{Key: "image.public_id", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "property_id", Value: 1}, {Key: "status", Value: 1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "created_at", Value: 1}}},
+	},
+	"webhook_subscriptions": {
+		{Keys: bson.D{{Key: "active", Value: 1}, {Key: "events", Value: 1}}},
+	},
+	"webhook_deliveries": {
+		// The claim of the next due delivery, the FIFO check per subscriber and the dead letters
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "next_attempt_at", Value: 1}, {Key: "_id", Value: 1}}},
+		{Keys: bson.D{{Key: "subscription_id", Value: 1}, {Key: "status", Value: 1}, {Key: "_id", Value: 1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "dead_at", Value: -1}}},
+		// Only delivered deliveries have delivered_at, dead letters are kept
+		{Keys: bson.D{{Key: "delivered_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(int32(deliveredWebhookTTL.Seconds()))},
+	},
+	"jobs": {
+		// The claim of due and abandoned jobs, and GET /admin/jobs?status=
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "run_at", Value: 1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "locked_until", Value: 1}}},
+		// Dead jobs are kept until retried
+		{Keys: bson.D{{Key: "finished_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(int32(doneJobTTL.Seconds())).
+			SetPartialFilterExpression(bson.M{"status": jobs.Done})},
+	},
+	"api_key_usage": {
+		{Keys: bson.D{{Key: "key_id", Value: 1}, {Key: "date", Value: -1}}},
+	},
+	"users": {
+		// case-insensitive, see emailCollation; POST /contact and POST /add/user rely on it to never create
+		// a user twice. Live users all index deleted_at as null, so only they collide and an email of a
+		// soft-deleted user can sign up again. `migrate dedup-users` clears duplicates that predate it.
+		{Keys: bson.D{{Key: "email", Value: 1}, {Key: "deleted_at", Value: 1}}, Options: options.Index().SetUnique(true).
+			SetCollation(emailCollation).SetPartialFilterExpression(bson.M{"email": bson.M{"$type": "string"}})},
+	},
+	"login_attempts": {
+		// failure counters go away once expires_at passes, see recordLoginFailure
+		{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	},
+	"devices": {
+		// a push token belongs to one user, see registerDevice
+		{Keys: bson.D{{Key: "token", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "user_id", Value: 1}}},
+	},
+	"agents": {
+		// email uniqueness is checked by the handlers, soft-deleted agents may share one
+		{Keys: bson.D{{Key: "email", Value: 1}}},
+		{Keys: bson.D{{Key: "active", Value: 1}, {Key: "name", Value: 1}}},
+	},
+	"properties": {
+		// GET /properties/{idOrSlug}, including former slugs after a title change
+		{Keys: bson.D{{Key: "slug", Value: 1}}, Options: uniqueSlugIndex()},
+		{Keys: bson.D{{Key: "slug_history", Value: 1}}},
+		// ?completion_status= and ?completed_by= on GET /properties
+		{Keys: bson.D{{Key: "completion_status", Value: 1}, {Key: "expected_completion", Value: 1}}},
+		// ?near_station= on GET /properties
+		{Keys: bson.D{{Key: "transit.station", Value: 1}, {Key: "transit.distance_m", Value: 1}}},
+		// POST /properties/search/polygon; properties without a location aren't indexed
+		{Keys: bson.D{{Key: "location", Value: "2dsphere"}}},
+		// GET /developers/{id}/properties, and renaming or merging a developer
+		{Keys: bson.D{{Key: "developer_id", Value: 1}}},
+	},
+	"developers": {
+		// name uniqueness is checked by the handlers, ignoring case like agent emails
+		{Keys: bson.D{{Key: "name", Value: 1}}, Options: options.Index().SetCollation(emailCollation)},
+	},
+	"property_view_sessions": {
+		{Keys: bson.D{{Key: "property_id", Value: 1}, {Key: "session_id", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "created_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(int32(viewDedupWindow.Seconds()))},
+	},
+	"audit_logs": {
+		{Keys: bson.D{{Key: "collection", Value: 1}, {Key: "document_id", Value: 1}, {Key: "created_at", Value: -1}}},
+		{Keys: bson.D{{Key: "created_at", Value: -1}}},
+	},
+	"search_events": {
+		{Keys: bson.D{{Key: "at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(int32(searchEventTTL.Seconds()))},
+	},
+	"property_views": {
+		{Keys: bson.D{{Key: "property_id", Value: 1}, {Key: "day", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "day", Value: 1}}},
+	},
+}
+
+func uniqueSlugIndex() *options.IndexOptions {
+	return options.Index().SetUnique(true).SetPartialFilterExpression(bson.M{"slug": bson.M{"$type": "string"}})
+}
+
+// ensureIndexes creates missing indexes. CreateMany is a no-op for existing ones,
+// so this is safe to run on every start; failures are logged and don't stop the server.
+func ensureIndexes() {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := createIndexes(ctx, nil); err != nil {
+		log.Println("Warning: indexes not created:", err)
+	}
+}
+
+// createIndexes is also available as `migrate indexes`
+func createIndexes(ctx context.Context, args []string) error {
+	db := client.Database("MVDB")
+	var failed []string
+	for collectionName, models := range collectionIndexes {
+		if _, err := db.Collection(collectionName).Indexes().CreateMany(ctx, models); err != nil {
+			log.Println("Failed to create indexes on", collectionName, ":", err)
+			if collectionName == "users" && mongo.IsDuplicateKeyError(err) {
+				log.Println("users has live duplicates of an email, run `migrate dedup-users` to merge them")
+			}
+			failed = append(failed, collectionName)
+		}
+	}
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		return fmt.Errorf("failed on %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
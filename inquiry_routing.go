@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// inquiryRotationID is the document in "counters" holding the round-robin position
+const inquiryRotationID = "inquiry_routing"
+
+// routeInquiry picks the agent for a new inquiry: the agent of the inquiry's listing, else the agent
+// of the property's newest active listing, else the next active agent in the rotation. It returns ""
+// when there are no active agents.
+func routeInquiry(ctx context.Context, inquiry *Inquiry) (string, error) {
+	agents, err := findAllWith[Agent](ctx, "agents", notDeleted(bson.M{"active": true}),
+		options.Find().SetProjection(bson.M{"_id": 1}).SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil || len(agents) == 0 {
+		return "", err
+	}
+	active := make(map[string]bool, len(agents))
+	for _, a := range agents {
+		active[a.ID.Hex()] = true
+	}
+
+	filter := activeListingsFilter(bson.M{"property_id": inquiry.Property_id, "agent_id": bson.M{"$nin": bson.A{nil, ""}}})
+	listings, err := findAllWith[Listing](ctx, "listings", filter,
+		options.Find().SetProjection(bson.M{"agent_id": 1, "created_at": 1}).SetSort(bson.D{{Key: "created_at", Value: -1}}))
+	if err != nil {
+		return "", err
+	}
+	for _, l := range listings {
+		if l.ID.Hex() == inquiry.ListingID && active[l.AgentID] {
+			return l.AgentID, nil
+		}
+	}
+	for _, l := range listings {
+		if active[l.AgentID] {
+			return l.AgentID, nil
+		}
+	}
+
+	seq, err := nextInRotation(ctx)
+	if err != nil {
+		return "", err
+	}
+	return agents[seq%int64(len(agents))].ID.Hex(), nil
+}
+
+// nextInRotation atomically advances the rotation and returns its previous position. Keeping it in
+// Mongo lets it survive restarts and be shared by every instance of the service.
+func nextInRotation(ctx context.Context) (int64, error) {
+	var counter struct {
+		Seq int64 `bson:"seq"`
+	}
+	err := client.Database("MVDB").Collection("counters").FindOneAndUpdate(ctx,
+		bson.M{"_id": inquiryRotationID},
+		bson.M{"$inc": bson.M{"seq": 1}},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&counter)
+	if err != nil {
+		return 0, err
+	}
+	return counter.Seq - 1, nil
+}
+
+// getAgentInquiries returns the inquiries assigned to an agent, newest first. Archived inquiries,
+// both those archived with their property and those moved to inquiries_archive, are left out unless
+// ?include_archived=true.
+func getAgentInquiries(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	id, ok := pathObjectID(w, r, "Agent")
+	if !ok {
+		return
+	}
+	filter := bson.M{"assigned_agent_id": id.Hex()}
+	archived := includeArchived(r)
+	if !archived {
+		filter["archived_at"] = bson.M{"$exists": false}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	newestFirst := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}})
+	inquiries, err := findAllWith[Inquiry](ctx, "inquiries", filter, newestFirst)
+	if err != nil {
+		serverError(w, r, "Failed to retrieve Inquiries", err)
+		return
+	}
+	if archived {
+		cold, err := findAllWith[Inquiry](ctx, "inquiries_archive", filter, newestFirst)
+		if err != nil {
+			serverError(w, r, "Failed to retrieve archived Inquiries", err)
+			return
+		}
+		inquiries = append(inquiries, cold...)
+		sort.SliceStable(inquiries, func(i, j int) bool { return inquiries[i].CreatedAt.After(inquiries[j].CreatedAt) })
+	}
+	json.NewEncoder(w).Encode(inquiries)
+}
+
+// assignInquiry hands an inquiry to another active agent
+func assignInquiry(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	id, ok := pathObjectID(w, r, "Inquiry")
+	if !ok {
+		return
+	}
+	var body struct {
+		AgentID string `json:"agent_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Failed to parse request body", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	switch err := checkAgentAssignable(ctx, body.AgentID); err {
+	case nil:
+	case errAgentCheck:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	default:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	before := auditSnapshot(ctx, "inquiries", id)
+	var inquiry Inquiry
+	err := client.Database("MVDB").Collection("inquiries").FindOneAndUpdate(ctx,
+		bson.M{"_id": id},
+		bson.M{"$set": bson.M{"assigned_agent_id": body.AgentID, "assigned_at": now}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&inquiry)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Inquiry not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		serverError(w, r, "Failed to assign Inquiry", err)
+		return
+	}
+	recordAudit(auditFromRequest(r), "update", "inquiries", id.Hex(), before, inquiry, nil)
+	enqueueJob(ctx, jobInquiryEmail, inquiryEmailJob{InquiryID: id.Hex()})
+	publishInquiryAssigned(id.Hex(), &inquiry)
+	json.NewEncoder(w).Encode(inquiry)
+}
+
+// markInquiryReplied records when the assigned agent first answered the inquiry, for the reply
+// latency in GET /admin/agents/stats. Only the first call counts.
+func markInquiryReplied(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	id, ok := pathObjectID(w, r, "Inquiry")
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	collection := client.Database("MVDB").Collection("inquiries")
+	before := auditSnapshot(ctx, "inquiries", id)
+	var inquiry Inquiry
+	err := collection.FindOneAndUpdate(ctx,
+		bson.M{"_id": id, "first_reply_at": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"first_reply_at": time.Now()}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&inquiry)
+	if err == mongo.ErrNoDocuments {
+		if n, err := collection.CountDocuments(ctx, bson.M{"_id": id}); err == nil && n > 0 {
+			http.Error(w, "Inquiry was already answered", http.StatusConflict)
+			return
+		}
+		http.Error(w, "Inquiry not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		serverError(w, r, "Failed to update Inquiry", err)
+		return
+	}
+	recordAudit(auditFromRequest(r), "update", "inquiries", id.Hex(), before, inquiry, nil)
+	json.NewEncoder(w).Encode(inquiry)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// TestRouteInquiryRoundRobinConcurrent routes inquiries in parallel to a property without listings:
+// the shared rotation must hand every active agent the same number, and skip inactive agents
+func TestRouteInquiryRoundRobinConcurrent(t *testing.T) {
+	useTestMongo(t, "agents", "listings", "counters")
+	ctx := context.Background()
+	const agents, perAgent = 4, 25
+	docs := []interface{}{Agent{ID: primitive.NewObjectID(), Name: "Away"}} // inactive
+	for i := 0; i < agents; i++ {
+		docs = append(docs, Agent{ID: primitive.NewObjectID(), Name: "Agent", Active: true})
+	}
+	if _, err := client.Database("MVDB").Collection("agents").InsertMany(ctx, docs); err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	assigned := map[string]int{}
+	var wg sync.WaitGroup
+	for i := 0; i < agents*perAgent; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			agentID, err := routeInquiry(ctx, &Inquiry{Property_id: primitive.NewObjectID().Hex()})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			assigned[agentID]++
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if len(assigned) != agents {
+		t.Errorf("inquiries went to %d agents, want the %d active ones: %v", len(assigned), agents, assigned)
+	}
+	for agentID, n := range assigned {
+		if n != perAgent {
+			t.Errorf("agent %s got %d inquiries, want %d", agentID, n, perAgent)
+		}
+	}
+	if assigned[docs[0].(Agent).ID.Hex()] != 0 {
+		t.Error("the inactive agent was assigned inquiries")
+	}
+
+	// the position is in Mongo, so a restarted instance carries on where the rotation stopped
+	var counter struct {
+		Seq int64 `bson:"seq"`
+	}
+	if err := client.Database("MVDB").Collection("counters").FindOne(ctx, bson.M{"_id": inquiryRotationID}).Decode(&counter); err != nil {
+		t.Fatal(err)
+	}
+	if counter.Seq != agents*perAgent {
+		t.Errorf("rotation at %d, want %d", counter.Seq, agents*perAgent)
+	}
+}
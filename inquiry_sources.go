@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	maxUTMLength       = 200
+	maxSourceURLLength = 2000
+)
+
+// inquirySource is where a lead came from, as the site saw it on the landing page: the utm_
+// parameters of the campaign link, document.referrer and the landing page URL. utm_source and
+// utm_medium are stored lowercased so "Facebook" and "facebook" count as one.
+type inquirySource struct {
+	UTMSource   string `bson:"utm_source,omitempty" json:"utm_source,omitempty"`
+	UTMMedium   string `bson:"utm_medium,omitempty" json:"utm_medium,omitempty"`
+	UTMCampaign string `bson:"utm_campaign,omitempty" json:"utm_campaign,omitempty"`
+	Referrer    string `bson:"referrer,omitempty" json:"referrer,omitempty"`
+	LandingPage string `bson:"landing_page,omitempty" json:"landing_page,omitempty"`
+}
+
+// UnmarshalJSON rejects the keys inquirySource doesn't have, so a typo like utm_campain is an
+// error rather than a lead counted as unattributed
+func (s *inquirySource) UnmarshalJSON(data []byte) error {
+	type plain inquirySource
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode((*plain)(s)); err != nil {
+		return &validationError{Problems: []string{"source: " + strings.TrimPrefix(err.Error(), "json: ")}}
+	}
+	return nil
+}
+
+// validateInquirySource normalizes a submitted source and returns every problem found. A source
+// without any value is dropped.
+func validateInquirySource(source **inquirySource) []string {
+	s := *source
+	if s == nil {
+		return nil
+	}
+	s.UTMSource = strings.ToLower(strings.TrimSpace(s.UTMSource))
+	s.UTMMedium = strings.ToLower(strings.TrimSpace(s.UTMMedium))
+	s.UTMCampaign = strings.TrimSpace(s.UTMCampaign)
+	s.Referrer = strings.TrimSpace(s.Referrer)
+	s.LandingPage = strings.TrimSpace(s.LandingPage)
+	if *s == (inquirySource{}) {
+		*source = nil
+		return nil
+	}
+
+	var problems []string
+	for _, f := range []struct{ name, value string }{{"utm_source", s.UTMSource}, {"utm_medium", s.UTMMedium}, {"utm_campaign", s.UTMCampaign}} {
+		if utf8.RuneCountInString(f.value) > maxUTMLength {
+			problems = append(problems, "source."+f.name+" must be at most 200 characters")
+		}
+	}
+	for _, f := range []struct{ name, value string }{{"referrer", s.Referrer}, {"landing_page", s.LandingPage}} {
+		if f.value == "" {
+			continue
+		}
+		u, err := url.Parse(f.value)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || len(f.value) > maxSourceURLLength {
+			problems = append(problems, "source."+f.name+" must be an http or https URL of at most 2000 characters")
+		}
+	}
+	return problems
+}
+
+// inquirySourceStats is one campaign of GET /admin/analytics/inquiry-sources. Inquiries without a
+// source are the row with every utm_ value empty.
+type inquirySourceStats struct {
+	UTMSource      string  `bson:"utm_source" json:"utm_source"`
+	UTMMedium      string  `bson:"utm_medium" json:"utm_medium"`
+	UTMCampaign    string  `bson:"utm_campaign" json:"utm_campaign"`
+	Inquiries      int     `bson:"inquiries" json:"inquiries"`
+	Converted      int     `bson:"converted" json:"converted"`
+	ConversionRate float64 `bson:"-" json:"conversion_rate"`
+}
+
+// conversionLookup finds, as field, an appointment in collectionName the user of the inquiry booked
+// for the same property once they had sent it. That is what counts as a conversion; appointments
+// don't record the inquiry they came from.
+func conversionLookup(collectionName, field string) bson.M {
+	return bson.M{"$lookup": bson.M{
+		"from": collectionName,
+		"let":  bson.M{"user": "$user_id", "property": "$property_id", "at": "$created_at"},
+		"pipeline": []bson.M{
+			{"$match": bson.M{"$expr": bson.M{"$and": bson.A{
+				bson.M{"$eq": bson.A{"$user_id", "$$user"}},
+				bson.M{"$eq": bson.A{"$property_id", "$$property"}},
+				bson.M{"$gte": bson.A{"$created_at", "$$at"}},
+			}}}},
+			{"$limit": 1},
+			{"$project": bson.M{"_id": 1}},
+		},
+		"as": field,
+	}}
+}
+
+// getInquirySources answers GET /admin/analytics/inquiry-sources: the inquiries created in the
+// range per campaign and how many of them led to an appointment, most inquiries first
+func getInquirySources(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	from, to, err := parseDateRange(r.URL.Query())
+	if err != nil {
+		http.Error(w, "from and to must be RFC3339 or YYYY-MM-DD", http.StatusBadRequest)
+		return
+	}
+	match := bson.M{}
+	if created := timeRangeFilter(from, to); created != nil {
+		match["created_at"] = created
+	}
+	archived := includeArchived(r)
+
+	pipeline := []bson.M{{"$match": match}}
+	converted := bson.A{bson.M{"$size": "$_appointment"}}
+	if archived {
+		pipeline = append(pipeline, archiveUnion("inquiries", match))
+	}
+	pipeline = append(pipeline, conversionLookup("appointments", "_appointment"))
+	if archived {
+		pipeline = append(pipeline, conversionLookup("appointments_archive", "_archived_appointment"))
+		converted = append(converted, bson.M{"$size": "$_archived_appointment"})
+	}
+	pipeline = append(pipeline,
+		bson.M{"$group": bson.M{
+			"_id": bson.M{
+				"utm_source":   bson.M{"$ifNull": bson.A{"$source.utm_source", ""}},
+				"utm_medium":   bson.M{"$ifNull": bson.A{"$source.utm_medium", ""}},
+				"utm_campaign": bson.M{"$ifNull": bson.A{"$source.utm_campaign", ""}},
+			},
+			"inquiries": bson.M{"$sum": 1},
+			"converted": bson.M{"$sum": bson.M{"$cond": bson.A{bson.M{"$gt": bson.A{bson.M{"$add": converted}, 0}}, 1, 0}}},
+		}},
+		bson.M{"$replaceWith": bson.M{"$mergeObjects": bson.A{"$_id", bson.M{"inquiries": "$inquiries", "converted": "$converted"}}}},
+		bson.M{"$sort": bson.D{{Key: "inquiries", Value: -1}, {Key: "utm_source", Value: 1}, {Key: "utm_medium", Value: 1}, {Key: "utm_campaign", Value: 1}}},
+	)
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	cur, err := client.Database("MVDB").Collection("inquiries").Aggregate(ctx, pipeline)
+	if err != nil {
+		serverError(w, r, "Failed to aggregate inquiry sources", err)
+		return
+	}
+	rows := []inquirySourceStats{}
+	if err := cur.All(ctx, &rows); err != nil {
+		serverError(w, r, "Failed to decode inquiry sources", err)
+		return
+	}
+	for i := range rows {
+		rows[i].ConversionRate = math.Round(float64(rows[i].Converted)/float64(rows[i].Inquiries)*1000) / 1000
+	}
+	setArchivesIncluded(w, archived)
+	json.NewEncoder(w).Encode(rows)
+}
@@ -0,0 +1,283 @@
+// Package jobs is a small job queue kept in a Mongo collection, for work that shouldn't hold up a
+// request or be lost with the process: emails, digests, image post-processing.
+//
+// A job is claimed by setting locked_by and locked_until with findAndModify, so any number of
+// workers in any number of processes share one queue. A worker that dies leaves its job locked
+// until locked_until passes, then another worker runs it again; handlers must therefore be safe
+// to run twice. A failed job is retried with exponential backoff and ends up dead after
+// MaxAttempts runs, where it stays until it is retried by hand.
+package jobs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Statuses of a job
+const (
+	Queued  = "queued"
+	Running = "running"
+	Done    = "done"
+	Dead    = "dead"
+)
+
+var Statuses = []string{Queued, Running, Done, Dead}
+
+const (
+	defaultMaxAttempts = 5
+	defaultLease       = 5 * time.Minute // a handler gets this long before the job is run elsewhere
+	idlePoll           = 2 * time.Second
+	retryBase          = 30 * time.Second
+	retryMax           = 6 * time.Hour
+)
+
+var ErrNotFound = errors.New("job not found")
+
+// Job is one unit of work. Payload is the JSON given to Enqueue.
+type Job struct {
+	ID          primitive.ObjectID `bson:"_id,omitempty" json:"job_id"`
+	Type        string             `bson:"type" json:"type"`
+	Payload     json.RawMessage    `bson:"payload" json:"payload"`
+	Status      string             `bson:"status" json:"status"`
+	RunAt       time.Time          `bson:"run_at" json:"run_at"`
+	Attempts    int                `bson:"attempts" json:"attempts"`
+	LockedBy    string             `bson:"locked_by,omitempty" json:"locked_by,omitempty"`
+	LockedUntil *time.Time         `bson:"locked_until,omitempty" json:"locked_until,omitempty"`
+	LastError   string             `bson:"last_error,omitempty" json:"last_error,omitempty"`
+	CreatedAt   time.Time          `bson:"created_at" json:"created_at"`
+	FinishedAt  *time.Time         `bson:"finished_at,omitempty" json:"finished_at,omitempty"` // when it was done or died
+}
+
+// Handler runs a job of one type. A returned error schedules a retry.
+type Handler func(ctx context.Context, payload json.RawMessage) error
+
+// Queue runs the jobs of one collection
+type Queue struct {
+	MaxAttempts int
+	Lease       time.Duration
+
+	coll     *mongo.Collection
+	worker   string // locked_by of the jobs claimed here, host and a random suffix
+	handlers map[string]Handler
+
+	stop    chan struct{}
+	stopped sync.Once
+	running sync.WaitGroup
+}
+
+// New returns a queue on coll. Handlers are registered before Start.
+func New(coll *mongo.Collection) *Queue {
+	host, _ := os.Hostname()
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return &Queue{
+		MaxAttempts: defaultMaxAttempts,
+		Lease:       defaultLease,
+		coll:        coll,
+		worker:      host + "-" + hex.EncodeToString(suffix),
+		handlers:    map[string]Handler{},
+		stop:        make(chan struct{}),
+	}
+}
+
+// Register sets the handler of jobType
+func (q *Queue) Register(jobType string, h Handler) {
+	q.handlers[jobType] = h
+}
+
+// Enqueue stores a job of jobType to run at runAt, or right away for the zero time. payload is
+// encoded as JSON.
+func (q *Queue) Enqueue(ctx context.Context, jobType string, payload interface{}, runAt time.Time) (primitive.ObjectID, error) {
+	if _, ok := q.handlers[jobType]; !ok {
+		return primitive.NilObjectID, fmt.Errorf("no handler for job type %q", jobType)
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+	now := time.Now()
+	if runAt.IsZero() {
+		runAt = now
+	}
+	res, err := q.coll.InsertOne(ctx, Job{Type: jobType, Payload: data, Status: Queued, RunAt: runAt, CreatedAt: now})
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+	return res.InsertedID.(primitive.ObjectID), nil
+}
+
+// Start runs n workers until Drain
+func (q *Queue) Start(n int) {
+	for i := 0; i < n; i++ {
+		q.running.Add(1)
+		go func() {
+			defer q.running.Done()
+			for {
+				select {
+				case <-q.stop:
+					return
+				default:
+				}
+				if !q.runNext() {
+					select {
+					case <-q.stop:
+						return
+					case <-time.After(idlePoll):
+					}
+				}
+			}
+		}()
+	}
+}
+
+// Drain stops claiming jobs and waits for the running ones, until ctx is done. Jobs still running
+// then are taken over by another worker once their lock expires.
+func (q *Queue) Drain(ctx context.Context) error {
+	q.stopped.Do(func() { close(q.stop) })
+	done := make(chan struct{})
+	go func() {
+		q.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// claimFilter matches the jobs due to run: queued ones whose time has come and running ones whose
+// worker stopped renewing the lock
+func claimFilter(now time.Time, types []string) bson.M {
+	return bson.M{
+		"type": bson.M{"$in": types},
+		"$or": bson.A{
+			bson.M{"status": Queued, "run_at": bson.M{"$lte": now}},
+			bson.M{"status": Running, "locked_until": bson.M{"$lt": now}},
+		},
+	}
+}
+
+// runNext claims and runs one job; false when none was due or the queue could not be read
+func (q *Queue) runNext() bool {
+	types := make([]string, 0, len(q.handlers))
+	for t := range q.handlers {
+		types = append(types, t)
+	}
+	now := time.Now()
+	var job Job
+	err := q.coll.FindOneAndUpdate(context.Background(), claimFilter(now, types),
+		bson.M{
+			"$set": bson.M{"status": Running, "locked_by": q.worker, "locked_until": now.Add(q.Lease)},
+			"$inc": bson.M{"attempts": 1},
+		},
+		options.FindOneAndUpdate().SetSort(bson.D{{Key: "run_at", Value: 1}}).SetReturnDocument(options.After)).Decode(&job)
+	if err == mongo.ErrNoDocuments {
+		return false
+	}
+	if err != nil {
+		log.Println("Failed to claim a job:", err)
+		return false
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), q.Lease)
+	err = q.run(ctx, job)
+	cancel()
+
+	now = time.Now()
+	set := bson.M{}
+	switch {
+	case err == nil:
+		set["status"], set["finished_at"] = Done, now
+	case job.Attempts >= q.MaxAttempts:
+		set["status"], set["finished_at"], set["last_error"] = Dead, now, err.Error()
+		log.Println("Job", job.ID.Hex(), "of type", job.Type, "failed for good:", err)
+	default:
+		set["status"], set["run_at"], set["last_error"] = Queued, now.Add(Backoff(job.Attempts)), err.Error()
+	}
+	// Only the worker holding the lock records the outcome; one that lost it to a slow run stays quiet
+	_, uerr := q.coll.UpdateOne(context.Background(), bson.M{"_id": job.ID, "locked_by": q.worker},
+		bson.M{"$set": set, "$unset": bson.M{"locked_by": "", "locked_until": ""}})
+	if uerr != nil {
+		log.Println("Failed to record the outcome of job", job.ID.Hex(), ":", uerr)
+	}
+	return true
+}
+
+// run calls the handler, turning a panic into an error so one bad job doesn't stop the worker
+func (q *Queue) run(ctx context.Context, job Job) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("panic: %v", p)
+		}
+	}()
+	return q.handlers[job.Type](ctx, job.Payload)
+}
+
+// Backoff is the wait before the run after the attempts-th failure: 30s doubling up to 6h
+func Backoff(attempts int) time.Duration {
+	wait := retryBase
+	for i := 1; i < attempts && wait < retryMax; i++ {
+		wait *= 2
+	}
+	if wait > retryMax {
+		wait = retryMax
+	}
+	return wait
+}
+
+// List returns jobs newest first, of one status and type when not empty
+func (q *Queue) List(ctx context.Context, status, jobType string, skip, limit int64) ([]Job, error) {
+	filter := bson.M{}
+	if status != "" {
+		filter["status"] = status
+	}
+	if jobType != "" {
+		filter["type"] = jobType
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: -1}}).SetSkip(skip)
+	if limit > 0 {
+		opts.SetLimit(limit)
+	}
+	cursor, err := q.coll.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	jobs := []Job{}
+	if err := cursor.All(ctx, &jobs); err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+// Retry queues a dead job again to run now, with its attempts reset
+func (q *Queue) Retry(ctx context.Context, id primitive.ObjectID) (*Job, error) {
+	var job Job
+	err := q.coll.FindOneAndUpdate(ctx, bson.M{"_id": id, "status": Dead},
+		bson.M{
+			"$set":   bson.M{"status": Queued, "run_at": time.Now(), "attempts": 0},
+			"$unset": bson.M{"finished_at": ""},
+		},
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&job)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// listViewParam documents ?view= on the list endpoints
+var listViewParam = apiParam{Name: "view", Description: "summary (default) or full; summary leaves out the heavy fields, see propertySummaryFields and listingSummaryStages"}
+
+// parseListView reads ?view=; it answers 400 and returns false for anything but summary or full
+func parseListView(w http.ResponseWriter, r *http.Request) (full bool, ok bool) {
+	switch r.URL.Query().Get("view") {
+	case "", "summary":
+		return false, true
+	case "full":
+		return true, true
+	}
+	http.Error(w, "view must be summary or full", http.StatusBadRequest)
+	return false, false
+}
+
+// propertySummaryFields is what the browse grid needs from a property: the cover image (the first
+// one) instead of every image, and no description, transit, videos or documents. Legacy field
+// names are projected too, so documents not yet renamed by normalize-fields still decode.
+func propertySummaryFields() bson.M {
+	fields := bson.M{
+		"title":       1,
+		"slug":        1,
+		"developer":   1,
+		"images":      bson.M{"$slice": 1},
+		"min_price":   1,
+		"max_price":   1,
+		"coordinates": 1,
+		"built":       1,
+		"deleted_at":  1,
+	}
+	for old, renamed := range legacyFieldNames["properties"] {
+		if v, ok := fields[renamed]; ok {
+			fields[old] = v
+		}
+	}
+	return fields
+}
+
+// propertySummaryStage is propertySummaryFields for an aggregation, where $slice takes the array
+func propertySummaryStage(extra ...string) bson.M {
+	fields := propertySummaryFields()
+	for name, v := range fields {
+		if _, ok := v.(bson.M); ok {
+			fields[name] = bson.M{"$slice": bson.A{"$" + name, 1}}
+		}
+	}
+	for _, name := range extra {
+		fields[name] = 1
+	}
+	return bson.M{"$project": fields}
+}
+
+// listingSummaryStages is listingSummaryProjection for a listings aggregation. They go after any
+// ranking, since rankingStages scores the photo count.
+var listingSummaryStages = []bson.M{
+	{"$addFields": bson.M{"photos": bson.M{"$slice": bson.A{bson.M{"$ifNull": bson.A{"$photos", bson.A{}}}, 1}}}},
+	{"$project": bson.M{"description": 0}},
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/LynnT-2003/mv-realty-backend/imagemeta"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// listView serves target with handler and returns the body and its documents decoded as maps
+func listView(t *testing.T, handler http.HandlerFunc, target string) (string, []map[string]interface{}) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, target, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("%s: %d %s", target, rec.Code, rec.Body)
+	}
+	body := rec.Body.String()
+	var docs []map[string]interface{}
+	if err := json.Unmarshal([]byte(body), &docs); err != nil {
+		t.Fatalf("%s: %v", target, err)
+	}
+	if len(docs) != 1 {
+		t.Fatalf("%s: %d documents", target, len(docs))
+	}
+	return body, docs
+}
+
+// TestSummaryView: the default list view drops the description and keeps only the first photo, so it
+// is smaller than ?view=full, which has everything
+func TestSummaryView(t *testing.T) {
+	useTestMongo(t, "properties", "listings")
+	skipMaintenanceLookup(t)
+	description := strings.Repeat("Corner unit with an unblocked view of Lumphini Park. ", 40)
+	var images []imagemeta.Image
+	for _, name := range []string{"cover", "lobby", "pool", "gym", "garden"} {
+		images = append(images, imagemeta.Image{URL: "https://example.com/" + name + ".jpg", Caption: name})
+	}
+	propertyID := primitive.NewObjectID()
+	insertDocs(t, "properties", Property{ID: propertyID, Title: "Noble Ploenchit", Description: description, Images: images, Facilities: []string{"Pool"}})
+	insertDocs(t, "listings", Listing{ID: primitive.NewObjectID(), PropertyID: propertyID.Hex(), Description: description, Photos: images,
+		Price: 45000, Currency: defaultCurrency, Size: 80, ListingType: "rent", ListingStatus: "active", CreatedAt: time.Now()})
+
+	for _, tt := range []struct {
+		name                                  string
+		handler                               http.HandlerFunc
+		target, imagesField, descriptionField string
+	}{
+		{"properties", getProperties, "/properties", "Images", "Description"},
+		{"listings", getListings, "/listings", "photos", "description"},
+	} {
+		summaryBody, summary := listView(t, tt.handler, tt.target)
+		fullBody, full := listView(t, tt.handler, tt.target+"?view=full")
+		if len(summaryBody) >= len(fullBody)/2 {
+			t.Errorf("%s: summary %d bytes, full %d", tt.name, len(summaryBody), len(fullBody))
+		}
+		if d, _ := summary[0][tt.descriptionField].(string); d != "" {
+			t.Errorf("%s: the summary has the %s", tt.name, tt.descriptionField)
+		}
+		if d, _ := full[0][tt.descriptionField].(string); d != description {
+			t.Errorf("%s: the full view lacks the %s", tt.name, tt.descriptionField)
+		}
+		summaryPhotos, _ := summary[0][tt.imagesField].([]interface{})
+		if len(summaryPhotos) != 1 || summaryPhotos[0].(map[string]interface{})["url"] != images[0].URL {
+			t.Errorf("%s: summary %s %v, want the cover only", tt.name, tt.imagesField, summaryPhotos)
+		}
+		if fullPhotos, _ := full[0][tt.imagesField].([]interface{}); len(fullPhotos) != len(images) {
+			t.Errorf("%s: full view has %d %s, want %d", tt.name, len(fullPhotos), tt.imagesField, len(images))
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// maxAvailableFromAhead is how far in the future available_from may be set
+const maxAvailableFromAhead = 2 // years
+
+// availabilityLabel is "Available now" when available_from is unset or has passed, otherwise the date in Bangkok time
+func availabilityLabel(availableFrom *time.Time, now time.Time) string {
+	if availableFrom == nil || !availableFrom.After(now) {
+		return "Available now"
+	}
+	return "Available from " + availableFrom.In(bangkok).Format("2 Jan 2006")
+}
+
+// availableByFilter matches listings available on or before the given day; listings without
+// available_from are available now and always match
+func availableByFilter(before time.Time) bson.M {
+	return bson.M{"$or": bson.A{
+		bson.M{"available_from": nil},
+		bson.M{"available_from": bson.M{"$lt": before}},
+	}}
+}
+
+// appointmentAvailabilityWarning returns a warning for the booking response when the listing's
+// available_from has passed, since the unit may have been taken in the meantime
+func appointmentAvailabilityWarning(ctx context.Context, listingID string) string {
+	oid, err := primitive.ObjectIDFromHex(listingID)
+	if err != nil {
+		return ""
+	}
+	var listing Listing
+	err = client.Database("MVDB").Collection("listings").FindOne(ctx, bson.M{"_id": oid},
+		options.FindOne().SetProjection(bson.M{"available_from": 1})).Decode(&listing)
+	if err != nil || listing.AvailableFrom == nil || listing.AvailableFrom.After(time.Now()) {
+		return ""
+	}
+	return fmt.Sprintf("The listing has been available since %s, confirm it is still on offer before the viewing",
+		listing.AvailableFrom.In(bangkok).Format("2006-01-02"))
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"time"
+)
+
+// pricePerSqm is price / size rounded to 2 decimals; nil when the size is missing, zero or negative
+func pricePerSqm(price, size float64) *float64 {
+	if size <= 0 || math.IsNaN(size) || math.IsInf(size, 0) {
+		return nil
+	}
+	v := math.Round(price/size*100) / 100
+	return &v
+}
+
+// MarshalJSON fills in the computed, never-stored fields of a listing and converts the size for
+// ?units=imperial
+func (l Listing) MarshalJSON() ([]byte, error) {
+	type plain Listing // drops the method set so this doesn't recurse
+	l.SizeUnit = "sqm"
+	if l.Units == unitsImperial {
+		l.PricePerSqft = pricePerSqft(l.Price, l.Size)
+		l.Size, l.SizeUnit = sqftFromSqm(l.Size), "sqft"
+	} else {
+		l.PricePerSqm = pricePerSqm(l.Price, l.Size)
+	}
+	l.Availability = availabilityLabel(l.AvailableFrom, time.Now())
+	return json.Marshal(plain(l))
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestPricePerSqm(t *testing.T) {
+	tests := []struct {
+		name        string
+		price, size float64
+		want        *float64
+	}{
+		{"whole", 5000000, 50, floatPtr(100000.0)},
+		{"rounded", 10000, 3, floatPtr(3333.33)},
+		{"free", 0, 40, floatPtr(0.0)},
+		{"zero size", 5000000, 0, nil},
+		{"negative size", 5000000, -20, nil},
+		{"NaN size", 5000000, math.NaN(), nil},
+		{"infinite size", 5000000, math.Inf(1), nil},
+	}
+	for _, tt := range tests {
+		if got := pricePerSqm(tt.price, tt.size); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: %v, want %v", tt.name, deref(got), deref(tt.want))
+		}
+	}
+}
+
+func floatPtr(v float64) *float64 { return &v }
+
+func deref(v *float64) interface{} {
+	if v == nil {
+		return nil
+	}
+	return *v
+}
+
+func TestListingJSONPricePerSqm(t *testing.T) {
+	for size, want := range map[float64]interface{}{50: 100000.0, 0: nil} {
+		b, err := json.Marshal(Listing{Price: 5000000, Size: size})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var fields map[string]interface{}
+		if err := json.Unmarshal(b, &fields); err != nil {
+			t.Fatal(err)
+		}
+		got, present := fields["price_per_sqm"]
+		if got != want || present != (want != nil) {
+			t.Errorf("size %v: price_per_sqm %v (present %v), want %v", size, got, present, want)
+		}
+	}
+}
+
+// TestPPSMFilterGuardsSize checks the size test comes before the division in the $expr, so $and
+// short-circuits instead of dividing by zero
+func TestPPSMFilterGuardsSize(t *testing.T) {
+	f, err := parseListingFilter(url.Values{"min_ppsm": {"80000"}, "max_ppsm": {"120000"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expr, ok := f.toBSON()["$expr"].(bson.M)
+	if !ok {
+		t.Fatal("no $expr for the ppsm range")
+	}
+	clauses := expr["$and"].(bson.A)
+	if len(clauses) != 3 || !reflect.DeepEqual(clauses[0], bson.M{"$gt": bson.A{"$size", 0}}) {
+		t.Errorf("clauses %v, want the size guard first", clauses)
+	}
+	if _, err := parseListingFilter(url.Values{"min_ppsm": {"lots"}}); err == nil || err.Error() != "min_ppsm must be numeric" {
+		t.Errorf("min_ppsm=lots: %v", err)
+	}
+}
+
+// TestPPSMWithoutSize filters and averages listings whose size is zero, null or missing: they have
+// no price per sqm, so they must neither match nor fail the query
+func TestPPSMWithoutSize(t *testing.T) {
+	useTestMongo(t, "listings")
+	ctx := context.Background()
+	collection := client.Database("MVDB").Collection("listings")
+	propertyID := primitive.NewObjectID().Hex()
+	sized := primitive.NewObjectID()
+	if _, err := collection.InsertMany(ctx, []interface{}{
+		bson.M{"_id": sized, "property_id": propertyID, "listing_status": "active", "price": 5000000, "size": 50},
+		bson.M{"property_id": propertyID, "listing_status": "active", "price": 3000000, "size": 0},
+		bson.M{"property_id": propertyID, "listing_status": "active", "price": 3000000, "size": nil},
+		bson.M{"property_id": propertyID, "listing_status": "active", "price": 3000000},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, q := range []url.Values{{"min_ppsm": {"0"}}, {"max_ppsm": {"1000000000"}}} {
+		f, err := parseListingFilter(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids, err := findIDs(ctx, "listings", f.toBSON())
+		if err != nil {
+			t.Fatalf("%v: %v", q, err)
+		}
+		if len(ids) != 1 || ids[0] != sized {
+			t.Errorf("%v matched %v, want only the listing with a size", q, ids)
+		}
+	}
+
+	stats, err := activeListingPriceStats(ctx, propertyID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Count != 4 || stats.AveragePricePerSqm == nil || *stats.AveragePricePerSqm != 100000 {
+		t.Errorf("stats %+v (avg %v), want 4 listings averaging 100000 per sqm", stats, deref(stats.AveragePricePerSqm))
+	}
+
+	if _, err := collection.DeleteOne(ctx, bson.M{"_id": sized}); err != nil {
+		t.Fatal(err)
+	}
+	stats, err = activeListingPriceStats(ctx, propertyID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.AveragePricePerSqm != nil {
+		t.Errorf("without any size: avg %v, want null", *stats.AveragePricePerSqm)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const deactivationReasonExpired = "expired"
+
+// listingLifetime is how long a new or renewed listing stays active, LISTING_EXPIRY_DAYS (default 90)
+var listingLifetime = listingLifetimeFromEnv()
+
+func listingLifetimeFromEnv() time.Duration {
+	if raw := os.Getenv("LISTING_EXPIRY_DAYS"); raw != "" {
+		if days, err := strconv.Atoi(raw); err == nil && days > 0 {
+			return time.Duration(days) * 24 * time.Hour
+		}
+		log.Println("Ignoring invalid LISTING_EXPIRY_DAYS:", raw)
+	}
+	return 90 * 24 * time.Hour
+}
+
+// defaultExpiry sets expires_at from created_at unless the listing has its own
+func defaultExpiry(listing *Listing) {
+	if listing.ExpiresAt == nil {
+		expires := listing.CreatedAt.Add(listingLifetime)
+		listing.ExpiresAt = &expires
+	}
+}
+
+// expireListings deactivates active listings past their expires_at. It keeps no state and the filter
+// only matches listings that still need the change, so any number of instances can run it at once.
+func expireListings(ctx context.Context) (int64, error) {
+	now := time.Now()
+	res, err := client.Database("MVDB").Collection("listings").UpdateMany(ctx,
+		activeListingsFilter(bson.M{"expires_at": bson.M{"$lte": now}}),
+		bson.M{"$set": bson.M{
+			"listing_status":      "inactive",
+			"deactivated_at":      now,
+			"deactivation_reason": deactivationReasonExpired,
+			"updated_at":          now,
+		}})
+	if err != nil {
+		return 0, err
+	}
+	if res.ModifiedCount > 0 {
+		invalidateResponses("listings")
+	}
+	return res.ModifiedCount, nil
+}
+
+// scheduleListingExpiry runs expireListings at start and then every hour, SCHEDULE_LISTING_EXPIRY
+func scheduleListingExpiry() {
+	registerTask(scheduledTask{
+		Name:       "listing_expiry",
+		Spec:       "0 * * * *",
+		Env:        "SCHEDULE_LISTING_EXPIRY",
+		Timeout:    time.Minute,
+		RunAtStart: true,
+		Run: func(ctx context.Context) (string, error) {
+			n, err := expireListings(ctx)
+			return fmt.Sprintf("expired %d listings", n), err
+		},
+	})
+}
+
+// renewListing moves expires_at to now + ?days= (default LISTING_EXPIRY_DAYS) and reactivates the listing
+func renewListing(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	id, ok := pathObjectID(w, r, "Listing")
+	if !ok {
+		return
+	}
+	lifetime := listingLifetime
+	if raw := r.URL.Query().Get("days"); raw != "" {
+		days, err := strconv.Atoi(raw)
+		if err != nil || days < 1 || days > 365 {
+			http.Error(w, "days must be between 1 and 365", http.StatusBadRequest)
+			return
+		}
+		lifetime = time.Duration(days) * 24 * time.Hour
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	collection := client.Database("MVDB").Collection("listings")
+	before := auditSnapshot(ctx, "listings", id)
+	now := time.Now()
+	var listing Listing
+	err := collection.FindOneAndUpdate(ctx, notDeleted(bson.M{"_id": id}),
+		bson.M{
+			"$set":   bson.M{"expires_at": now.Add(lifetime), "listing_status": "active", "updated_at": now},
+			"$unset": bson.M{"deactivated_at": "", "deactivation_reason": ""},
+		},
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&listing)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Listing not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		serverError(w, r, "Failed to renew Listing", err)
+		return
+	}
+	recordAudit(auditFromRequest(r), "update", "listings", id.Hex(), before, listing, nil)
+	json.NewEncoder(w).Encode(listing)
+}
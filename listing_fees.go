@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"math"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// maxDepositMonths caps deposit_months and advance_months
+const maxDepositMonths = 12
+
+// feeProblems checks the fee fields of a listing; deposits and advance rent only exist for rentals
+func feeProblems(listing *Listing) []string {
+	var problems []string
+	if listing.DepositMonths < 0 || listing.AdvanceMonths < 0 {
+		problems = append(problems, "deposit_months and advance_months must not be negative")
+	}
+	if listing.DepositMonths > maxDepositMonths || listing.AdvanceMonths > maxDepositMonths {
+		problems = append(problems, "deposit_months and advance_months must be at most 12")
+	}
+	if listing.ListingType != "rent" && (listing.DepositMonths != 0 || listing.AdvanceMonths != 0) {
+		problems = append(problems, "deposit_months and advance_months only apply to rent listings")
+	}
+	return problems
+}
+
+// commonFeesByProperty returns the common fee per square meter of each property that has one
+func commonFeesByProperty(ctx context.Context, hexIDs []string) (map[string]float64, error) {
+	var ids []primitive.ObjectID
+	for _, h := range hexIDs {
+		if id, err := primitive.ObjectIDFromHex(h); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	properties, err := findAllWith[Property](ctx, "properties", bson.M{"_id": bson.M{"$in": ids}, "common_fee_per_sqm": bson.M{"$gt": 0}},
+		options.Find().SetProjection(bson.M{"common_fee_per_sqm": 1}))
+	if err != nil {
+		return nil, err
+	}
+	fees := make(map[string]float64, len(properties))
+	for _, p := range properties {
+		fees[p.ID.Hex()] = p.CommonFee
+	}
+	return fees, nil
+}
+
+// applyFeeEstimates fills monthly_total_estimate and move_in_cost on rental listings:
+//
+//	monthly_total_estimate = price + common fee × size
+//	move_in_cost           = (deposit_months + advance_months) × price + one month of common fee
+//
+// both in the listing's currency. Property fees are in THB, the currency building management bills
+// in, and are converted with the current rates. The common fee is left out when the property has none, and the
+// estimates are left out when the fee can't be converted to the listing's currency.
+func applyFeeEstimates(ctx context.Context, listings []Listing) error {
+	var propertyIDs []string
+	for _, l := range listings {
+		if l.ListingType == "rent" {
+			propertyIDs = append(propertyIDs, l.PropertyID)
+		}
+	}
+	if len(propertyIDs) == 0 {
+		return nil
+	}
+	fees, err := commonFeesByProperty(ctx, propertyIDs)
+	if err != nil {
+		return err
+	}
+	rates := usableRates()
+	for i := range listings {
+		l := &listings[i]
+		if l.ListingType != "rent" {
+			continue
+		}
+		fee := fees[l.PropertyID] * l.Size
+		if currency := listingCurrency(l); fee != 0 && currency != defaultCurrency {
+			if rates == nil {
+				continue
+			}
+			converted, ok := rates.convert(fee, defaultCurrency, currency)
+			if !ok {
+				continue
+			}
+			fee = converted
+		}
+		monthly := roundMoney(l.Price + fee)
+		moveIn := roundMoney(float64(l.DepositMonths+l.AdvanceMonths)*l.Price + fee)
+		l.MonthlyTotal, l.MoveInCost = &monthly, &moveIn
+	}
+	return nil
+}
+
+func roundMoney(v float64) float64 {
+	return math.Round(v*100) / 100
+}
+
+// monthlyTotalPipeline matches rental listings whose price plus common fee is at most max, given in
+// currency. The fee is joined from the property and converted into each listing currency with the
+// current rates, the same way priceFilter converts price bounds.
+func monthlyTotalPipeline(query bson.M, max float64, currency string) []bson.M {
+	rates := usableRates()
+	var clauses bson.A
+	for _, c := range currencies {
+		hi, factor := max, 1.0
+		var ok bool
+		if c != currency {
+			if rates == nil {
+				continue
+			}
+			if hi, ok = rates.convert(max, currency, c); !ok {
+				continue
+			}
+		}
+		if c != defaultCurrency {
+			if rates == nil {
+				continue
+			}
+			if factor, ok = rates.convert(1, defaultCurrency, c); !ok {
+				continue
+			}
+		}
+		var match interface{} = c
+		if c == defaultCurrency {
+			match = bson.M{"$in": bson.A{c, nil}}
+		}
+		clauses = append(clauses, bson.M{"currency": match, "$expr": bson.M{"$lte": bson.A{
+			bson.M{"$add": bson.A{"$price", bson.M{"$multiply": bson.A{"$_common_fee", factor, "$size"}}}},
+			hi,
+		}}})
+	}
+	if len(clauses) == 0 {
+		clauses = bson.A{bson.M{"_id": bson.M{"$exists": false}}}
+	}
+
+	query["listing_type"] = "rent"
+	return []bson.M{
+		{"$match": query},
+		{"$lookup": bson.M{
+			"from":     "properties",
+			"let":      bson.M{"pid": bson.M{"$convert": bson.M{"input": "$property_id", "to": "objectId", "onError": nil, "onNull": nil}}},
+			"pipeline": []bson.M{{"$match": bson.M{"$expr": bson.M{"$eq": bson.A{"$_id", "$$pid"}}}}, {"$project": bson.M{"common_fee_per_sqm": 1}}},
+			"as":       "_property",
+		}},
+		{"$addFields": bson.M{"_common_fee": bson.M{"$ifNull": bson.A{bson.M{"$first": "$_property.common_fee_per_sqm"}, 0}}}},
+		{"$match": bson.M{"$or": clauses}},
+		{"$project": bson.M{"_property": 0, "_common_fee": 0}},
+	}
+}
+
+// findListings runs the GET /listings query, through monthlyTotalPipeline when ?max_monthly_total=
+// is given since the total isn't stored. stages, which must leave the listings sorted like
+// rankingStages does, are appended to the pipeline, followed by the page. summary trims the
+// listings to their list view.
+func findListings(ctx context.Context, query bson.M, f ListingFilter, page listPage, summary bool, stages ...bson.M) (*mongo.Cursor, error) {
+	collection := client.Database("MVDB").Collection("listings")
+	if f.MaxMonthlyTotal == nil && len(stages) == 0 {
+		opts := page.findOptions()
+		if summary {
+			opts.SetProjection(listingSummaryProjection)
+		}
+		return collection.Find(ctx, query, opts)
+	}
+	pipeline := []bson.M{{"$match": query}}
+	if f.MaxMonthlyTotal != nil {
+		currency := f.DisplayCurrency
+		if currency == "" {
+			currency = defaultCurrency
+		}
+		pipeline = monthlyTotalPipeline(query, *f.MaxMonthlyTotal, currency)
+	}
+	pipeline = append(pipeline, stages...)
+	pipeline = append(pipeline, page.stages(len(stages) > 0)...)
+	if summary {
+		pipeline = append(pipeline, listingSummaryStages...)
+	}
+	return collection.Aggregate(ctx, pipeline)
+}
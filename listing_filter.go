@@ -0,0 +1,268 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// ListingFilter is the set of filters accepted by GET /listings and every endpoint that mirrors it.
+// Pointer fields are unset when the query parameter is absent.
+type ListingFilter struct {
+	PropertyID      string     `bson:"property_id,omitempty" json:"property_id,omitempty"`
+	ListingType     string     `bson:"listing_type,omitempty" json:"listing_type,omitempty"`
+	ListingStatus   string     `bson:"listing_status,omitempty" json:"listing_status,omitempty"` // empty means active, "all" disables the rule
+	MinPrice        *float64   `bson:"min_price,omitempty" json:"min_price,omitempty"`
+	MaxPrice        *float64   `bson:"max_price,omitempty" json:"max_price,omitempty"`
+	Bedroom         *int       `bson:"bedroom,omitempty" json:"bedroom,omitempty"`
+	MinSize         *float64   `bson:"min_size,omitempty" json:"min_size,omitempty"`
+	MaxSize         *float64   `bson:"max_size,omitempty" json:"max_size,omitempty"`
+	Furniture       string     `bson:"furniture,omitempty" json:"furniture,omitempty"`
+	FacingDirection string     `bson:"facing_direction,omitempty" json:"facing_direction,omitempty"`
+	MinPPSM         *float64   `bson:"min_ppsm,omitempty" json:"min_ppsm,omitempty"` // price per square meter
+	MaxPPSM         *float64   `bson:"max_ppsm,omitempty" json:"max_ppsm,omitempty"`
+	Featured        *bool      `bson:"featured,omitempty" json:"featured,omitempty"`
+	Verified        *bool      `bson:"verified,omitempty" json:"verified,omitempty"`
+	MaxMonthlyTotal *float64   `bson:"max_monthly_total,omitempty" json:"max_monthly_total,omitempty"`
+	ExpiringWithin  *int       `bson:"expiring_within_days,omitempty" json:"expiring_within_days,omitempty"` // days from now
+	DisplayCurrency string     `bson:"display_currency,omitempty" json:"display_currency,omitempty"`         // currency of min_price and max_price, THB when empty
+	Tags            []string   `bson:"tags,omitempty" json:"tags,omitempty"`
+	TagsMatch       string     `bson:"tags_match,omitempty" json:"tags_match,omitempty"`     // any (default) or all
+	AvailableBy     *time.Time `bson:"available_by,omitempty" json:"available_by,omitempty"` // exclusive: the day after a date-only ?available_by=
+	State           string     `bson:"state,omitempty" json:"state,omitempty"`               // publication state, published when empty; draft needs the API key
+}
+
+// listingFilterParams documents the query parameters parsed by parseListingFilter
+var listingFilterParams = []apiParam{
+	{Name: "property_id"},
+	{Name: "listing_type", Description: "sale or rent"},
+	{Name: "listing_status", Description: "active (default), inactive or all"},
+	{Name: "min_price", Description: "in display_currency"}, {Name: "max_price", Description: "in display_currency"},
+	{Name: "display_currency", Description: "convert prices and price filters to this currency, default THB"},
+	{Name: "bedroom"},
+	{Name: "min_size", Description: "square meters, or square feet with units=imperial"}, {Name: "max_size", Description: "square meters, or square feet with units=imperial"},
+	unitsParam,
+	{Name: "furniture"},
+	{Name: "facing_direction", Description: "N, S, E, W, NE, NW, SE, SW"},
+	{Name: "min_ppsm", Description: "price per square meter, in the listing's own currency"}, {Name: "max_ppsm", Description: "price per square meter, in the listing's own currency"},
+	{Name: "featured", Description: "true or false"},
+	{Name: "verified", Description: "true for listings whose ownership documents were checked, false for the others"},
+	{Name: "max_monthly_total", Description: "GET /listings only; rentals whose price plus the property's common fee is at most this, in display_currency"},
+	{Name: "expiring_within_days", Description: "listings whose expires_at falls in the next N days"},
+	{Name: "tags", Description: "comma separated, e.g. pet-friendly,ev-charger"},
+	{Name: "tags_match", Description: "any (default) or all of the tags"},
+	{Name: "state", Description: "published (default) or draft (requires the API key)"},
+	{Name: "available_by", Description: "RFC3339 or YYYY-MM-DD; listings available on or before then, including those available now"},
+}
+
+// parseListingFilter reads the listing filters from the query string
+func parseListingFilter(q url.Values) (ListingFilter, error) {
+	f := ListingFilter{
+		PropertyID:      q.Get("property_id"),
+		ListingType:     q.Get("listing_type"),
+		ListingStatus:   q.Get("listing_status"),
+		Furniture:       q.Get("furniture"),
+		FacingDirection: q.Get("facing_direction"),
+		DisplayCurrency: strings.ToUpper(q.Get("display_currency")),
+		Tags:            parseTagsParam(q.Get("tags")),
+		TagsMatch:       q.Get("tags_match"),
+		State:           q.Get("state"),
+	}
+	if f.ListingType != "" && !isOneOf(f.ListingType, listingTypes) {
+		return f, fmt.Errorf("listing_type must be sale or rent")
+	}
+	if f.ListingStatus != "" && f.ListingStatus != "all" && !isOneOf(f.ListingStatus, listingStatuses) {
+		return f, fmt.Errorf("listing_status must be active, inactive or all")
+	}
+	if f.FacingDirection != "" && !isOneOf(f.FacingDirection, facingDirections) {
+		return f, fmt.Errorf("facing_direction is not a valid direction")
+	}
+	if f.State != "" && !isOneOf(f.State, publicationStates) {
+		return f, fmt.Errorf("state must be published or draft")
+	}
+	if f.TagsMatch != "" && f.TagsMatch != "any" && f.TagsMatch != "all" {
+		return f, fmt.Errorf("tags_match must be any or all")
+	}
+	if f.DisplayCurrency != "" && !isOneOf(f.DisplayCurrency, currencies) {
+		return f, fmt.Errorf("display_currency must be one of %s", strings.Join(currencies, ", "))
+	}
+
+	floats := []struct {
+		name   string
+		target **float64
+	}{
+		{"min_price", &f.MinPrice}, {"max_price", &f.MaxPrice},
+		{"min_size", &f.MinSize}, {"max_size", &f.MaxSize},
+		{"min_ppsm", &f.MinPPSM}, {"max_ppsm", &f.MaxPPSM},
+		{"max_monthly_total", &f.MaxMonthlyTotal},
+	}
+	for _, p := range floats {
+		raw := q.Get(p.name)
+		if raw == "" {
+			continue
+		}
+		v, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return f, fmt.Errorf("%s must be numeric", p.name)
+		}
+		*p.target = &v
+	}
+	// Stored sizes are metric, so imperial thresholds are converted before querying
+	units, err := parseUnits(q.Get("units"))
+	if err != nil {
+		return f, err
+	}
+	if units == unitsImperial {
+		for _, size := range []*float64{f.MinSize, f.MaxSize} {
+			if size != nil {
+				*size = sqmFromSqft(*size)
+			}
+		}
+	}
+	if raw := q.Get("bedroom"); raw != "" {
+		v, err := strconv.Atoi(raw)
+		if err != nil {
+			return f, fmt.Errorf("bedroom must be a whole number")
+		}
+		f.Bedroom = &v
+	}
+	if raw := q.Get("featured"); raw != "" {
+		v, err := strconv.ParseBool(raw)
+		if err != nil {
+			return f, fmt.Errorf("featured must be true or false")
+		}
+		f.Featured = &v
+	}
+	if raw := q.Get("verified"); raw != "" {
+		v, err := strconv.ParseBool(raw)
+		if err != nil {
+			return f, fmt.Errorf("verified must be true or false")
+		}
+		f.Verified = &v
+	}
+	if raw := q.Get("available_by"); raw != "" {
+		v, err := parseDateOrTime(raw)
+		if err != nil {
+			return f, fmt.Errorf("available_by must be RFC3339 or YYYY-MM-DD")
+		}
+		if len(raw) == len("2006-01-02") {
+			v = v.AddDate(0, 0, 1)
+		}
+		f.AvailableBy = &v
+	}
+	if raw := q.Get("expiring_within_days"); raw != "" {
+		v, err := strconv.Atoi(raw)
+		if err != nil || v < 0 {
+			return f, fmt.Errorf("expiring_within_days must be a non-negative whole number")
+		}
+		f.ExpiringWithin = &v
+	}
+	return f, nil
+}
+
+// toBSON builds the Mongo filter; listings are active-only unless listing_status says otherwise,
+// published-only unless state says otherwise, and soft-deleted listings are always excluded
+func (f ListingFilter) toBSON() bson.M {
+	filter := publishedListingsFilter(bson.M{})
+	var and bson.A // conditions that each need their own $or
+	switch f.ListingStatus {
+	case "":
+		activeListingsFilter(filter)
+	case "all":
+	default:
+		filter["listing_status"] = f.ListingStatus
+	}
+	if f.State == publicationDraft {
+		filter["publication_state"] = publicationDraft
+	}
+	if f.PropertyID != "" {
+		filter["property_id"] = f.PropertyID
+	}
+	if f.ListingType != "" {
+		filter["listing_type"] = f.ListingType
+	}
+	if f.Furniture != "" {
+		filter["furniture"] = f.Furniture
+	}
+	if f.FacingDirection != "" {
+		filter["facing_direction"] = f.FacingDirection
+	}
+	if f.Bedroom != nil {
+		filter["bedroom"] = *f.Bedroom
+	}
+	if len(f.Tags) > 0 {
+		if f.TagsMatch == "all" {
+			filter["tags"] = bson.M{"$all": f.Tags}
+		} else {
+			filter["tags"] = bson.M{"$in": f.Tags}
+		}
+	}
+	if f.Featured != nil {
+		// Listings created before the flag existed have no field and count as not featured
+		if *f.Featured {
+			filter["featured"] = true
+		} else {
+			filter["featured"] = bson.M{"$ne": true}
+		}
+	}
+	if f.Verified != nil {
+		if *f.Verified {
+			filter["verified"] = true
+		} else {
+			filter["verified"] = bson.M{"$ne": true}
+		}
+	}
+	if f.ExpiringWithin != nil {
+		// Evaluated when the filter is built, so a saved filter always means "from now"
+		now := time.Now()
+		filter["expires_at"] = bson.M{"$gte": now, "$lte": now.AddDate(0, 0, *f.ExpiringWithin)}
+	}
+	if f.MinPrice != nil || f.MaxPrice != nil {
+		currency := f.DisplayCurrency
+		if currency == "" {
+			currency = defaultCurrency
+		}
+		and = append(and, bson.M{"$or": priceFilter(f.MinPrice, f.MaxPrice, currency)})
+	}
+	if f.AvailableBy != nil {
+		and = append(and, availableByFilter(*f.AvailableBy))
+	}
+	if len(and) > 0 {
+		filter["$and"] = and
+	}
+	if r := numericRange(f.MinSize, f.MaxSize); r != nil {
+		filter["size"] = r
+	}
+	if f.MinPPSM != nil || f.MaxPPSM != nil {
+		// Listings without a usable size have no price per sqm and never match
+		ppsm := bson.M{"$divide": bson.A{"$price", "$size"}}
+		clauses := bson.A{bson.M{"$gt": bson.A{"$size", 0}}}
+		if f.MinPPSM != nil {
+			clauses = append(clauses, bson.M{"$gte": bson.A{ppsm, *f.MinPPSM}})
+		}
+		if f.MaxPPSM != nil {
+			clauses = append(clauses, bson.M{"$lte": bson.A{ppsm, *f.MaxPPSM}})
+		}
+		// $and short-circuits, so the division never sees a zero size
+		filter["$expr"] = bson.M{"$and": clauses}
+	}
+	return filter
+}
+
+func numericRange(min, max *float64) bson.M {
+	if min == nil && max == nil {
+		return nil
+	}
+	r := bson.M{}
+	if min != nil {
+		r["$gte"] = *min
+	}
+	if max != nil {
+		r["$lte"] = *max
+	}
+	return r
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const filterBoundsTTL = 5 * time.Minute
+
+// filterBounds are the slider ranges and option lists for the search page, over active listings
+type filterBounds struct {
+	GeneratedAt time.Time `json:"generated_at"`
+	ListingType string    `json:"listing_type,omitempty"`
+	Currency    string    `json:"currency"` // of min_price and max_price
+	Listings    int       `json:"listings"`
+	MinPrice    float64   `json:"min_price"`
+	MaxPrice    float64   `json:"max_price"`
+	MinSize     float64   `json:"min_size"`
+	MaxSize     float64   `json:"max_size"`
+	SizeUnit    string    `json:"size_unit"` // sqm, or sqft with ?units=imperial
+	Bedrooms    []int     `json:"bedrooms"`
+	MinFloor    int       `json:"min_floor"`
+	MaxFloor    int       `json:"max_floor"`
+	Furniture   []string  `json:"furniture"`
+	StaleRates  bool      `json:"-"`
+}
+
+type cachedFilterBounds struct {
+	bounds    *filterBounds
+	expiresAt time.Time
+}
+
+var (
+	filterBoundsMu    sync.Mutex
+	filterBoundsCache = map[string]cachedFilterBounds{}
+)
+
+// getFilterBounds returns the ranges for the search sliders, cached in-process for five minutes per
+// listing_type and display_currency since they change slowly
+func getFilterBounds(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	q := r.URL.Query()
+	listingType := q.Get("listing_type")
+	if listingType != "" && !isOneOf(listingType, listingTypes) {
+		http.Error(w, "listing_type must be sale or rent", http.StatusBadRequest)
+		return
+	}
+	currency := strings.ToUpper(q.Get("display_currency"))
+	if currency == "" {
+		currency = defaultCurrency
+	}
+	if !isOneOf(currency, currencies) {
+		http.Error(w, "display_currency must be one of "+strings.Join(currencies, ", "), http.StatusBadRequest)
+		return
+	}
+	units, err := parseUnits(q.Get("units"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	cacheKey := listingType + "|" + currency
+	filterBoundsMu.Lock()
+	cached, ok := filterBoundsCache[cacheKey]
+	filterBoundsMu.Unlock()
+	if ok && time.Now().Before(cached.expiresAt) {
+		writeFilterBounds(w, cached.bounds, units)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	bounds, err := computeFilterBounds(ctx, listingType, currency)
+	if err != nil {
+		serverError(w, r, "Failed to compute filter bounds", err)
+		return
+	}
+
+	filterBoundsMu.Lock()
+	for key, c := range filterBoundsCache {
+		if time.Now().After(c.expiresAt) {
+			delete(filterBoundsCache, key)
+		}
+	}
+	filterBoundsCache[cacheKey] = cachedFilterBounds{bounds: bounds, expiresAt: time.Now().Add(filterBoundsTTL)}
+	filterBoundsMu.Unlock()
+
+	writeFilterBounds(w, bounds, units)
+}
+
+// writeFilterBounds writes a copy of the cached bounds with the sizes in units
+func writeFilterBounds(w http.ResponseWriter, bounds *filterBounds, units string) {
+	if bounds.StaleRates {
+		warnStaleRates(w)
+	}
+	out := *bounds
+	out.SizeUnit = "sqm"
+	if units == unitsImperial {
+		out.MinSize, out.MaxSize, out.SizeUnit = sqftFromSqm(out.MinSize), sqftFromSqm(out.MaxSize), "sqft"
+	}
+	json.NewEncoder(w).Encode(out)
+}
+
+// computeFilterBounds runs one $group per listing currency and merges the groups in Go, converting
+// each currency's price range into currency. Groups that can't be converted are left out of the
+// price range but still count for the other bounds.
+func computeFilterBounds(ctx context.Context, listingType, currency string) (*filterBounds, error) {
+	match := activeListingsFilter(bson.M{})
+	if listingType != "" {
+		match["listing_type"] = listingType
+	}
+	pipeline := []bson.M{
+		{"$match": match},
+		{"$group": bson.M{
+			"_id":       bson.M{"$ifNull": bson.A{"$currency", defaultCurrency}},
+			"count":     bson.M{"$sum": 1},
+			"min_price": bson.M{"$min": "$price"},
+			"max_price": bson.M{"$max": "$price"},
+			"min_size":  bson.M{"$min": "$size"},
+			"max_size":  bson.M{"$max": "$size"},
+			"min_floor": bson.M{"$min": "$floor"},
+			"max_floor": bson.M{"$max": "$floor"},
+			"bedrooms":  bson.M{"$addToSet": "$bedroom"},
+			"furniture": bson.M{"$addToSet": "$furniture"},
+		}},
+	}
+	cur, err := client.Database("MVDB").Collection("listings").Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	var groups []struct {
+		Currency  string   `bson:"_id"`
+		Count     int      `bson:"count"`
+		MinPrice  float64  `bson:"min_price"`
+		MaxPrice  float64  `bson:"max_price"`
+		MinSize   float64  `bson:"min_size"`
+		MaxSize   float64  `bson:"max_size"`
+		MinFloor  int      `bson:"min_floor"`
+		MaxFloor  int      `bson:"max_floor"`
+		Bedrooms  []int    `bson:"bedrooms"`
+		Furniture []string `bson:"furniture"`
+	}
+	if err := cur.All(ctx, &groups); err != nil {
+		return nil, err
+	}
+
+	bounds := &filterBounds{
+		GeneratedAt: time.Now().UTC(),
+		ListingType: listingType,
+		Currency:    currency,
+		Bedrooms:    []int{},
+		Furniture:   []string{},
+	}
+	rates := usableRates()
+	bedrooms, furniture := map[int]bool{}, map[string]bool{}
+	pricesSeen := false
+	for i, g := range groups {
+		bounds.Listings += g.Count
+		if i == 0 || g.MinSize < bounds.MinSize {
+			bounds.MinSize = g.MinSize
+		}
+		if i == 0 || g.MaxSize > bounds.MaxSize {
+			bounds.MaxSize = g.MaxSize
+		}
+		if i == 0 || g.MinFloor < bounds.MinFloor {
+			bounds.MinFloor = g.MinFloor
+		}
+		if i == 0 || g.MaxFloor > bounds.MaxFloor {
+			bounds.MaxFloor = g.MaxFloor
+		}
+		for _, b := range g.Bedrooms {
+			bedrooms[b] = true
+		}
+		for _, f := range g.Furniture {
+			if f != "" {
+				furniture[f] = true
+			}
+		}
+
+		minPrice, maxPrice := g.MinPrice, g.MaxPrice
+		if g.Currency != currency {
+			if rates == nil {
+				bounds.StaleRates = true
+				continue
+			}
+			var okMin, okMax bool
+			minPrice, okMin = rates.convert(minPrice, g.Currency, currency)
+			maxPrice, okMax = rates.convert(maxPrice, g.Currency, currency)
+			if !okMin || !okMax {
+				continue
+			}
+		}
+		// Whole units that still contain every listing
+		minPrice, maxPrice = math.Floor(minPrice), math.Ceil(maxPrice)
+		if !pricesSeen || minPrice < bounds.MinPrice {
+			bounds.MinPrice = minPrice
+		}
+		if !pricesSeen || maxPrice > bounds.MaxPrice {
+			bounds.MaxPrice = maxPrice
+		}
+		pricesSeen = true
+	}
+	for b := range bedrooms {
+		bounds.Bedrooms = append(bounds.Bedrooms, b)
+	}
+	sort.Ints(bounds.Bedrooms)
+	for f := range furniture {
+		bounds.Furniture = append(bounds.Furniture, f)
+	}
+	sort.Strings(bounds.Furniture)
+	return bounds, nil
+}
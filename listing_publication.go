@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	publicationDraft     = "draft"
+	publicationPublished = "published"
+)
+
+var publicationStates = []string{publicationDraft, publicationPublished}
+
+// publishedListingsFilter hides drafts and soft-deleted listings. Listings created before drafts
+// existed have no publication_state and count as published.
+func publishedListingsFilter(filter bson.M) bson.M {
+	filter["publication_state"] = bson.M{"$ne": publicationDraft}
+	return notDeleted(filter)
+}
+
+// publishProblems lists what a listing is missing before it can go live
+func publishProblems(listing *Listing) []string {
+	var missing []string
+	if len(listing.Photos) == 0 {
+		missing = append(missing, "at least one photo is required")
+	}
+	if strings.TrimSpace(listing.Description) == "" {
+		missing = append(missing, "description must not be empty")
+	}
+	if listing.Price <= 0 {
+		missing = append(missing, "price must be greater than 0")
+	}
+	return missing
+}
+
+// authorizeListingState rejects ?state=draft without the API key. Keys aren't issued per agent,
+// so an authenticated caller sees every draft.
+func authorizeListingState(w http.ResponseWriter, r *http.Request, f ListingFilter) bool {
+	if f.State == publicationDraft && !hasAPIKey(r) {
+		http.Error(w, "state=draft requires the API key", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// publishListing makes a draft public. It answers 422 with every missing field when the draft
+// isn't complete; expires_at restarts from the publication date.
+func publishListing(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	id, ok := pathObjectID(w, r, "Listing")
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	collection := client.Database("MVDB").Collection("listings")
+	var listing Listing
+	err := collection.FindOne(ctx, notDeleted(bson.M{"_id": id})).Decode(&listing)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Listing not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		serverError(w, r, "Failed to retrieve Listing", err)
+		return
+	}
+	if listing.Publication != publicationDraft {
+		http.Error(w, "Listing is already published", http.StatusConflict)
+		return
+	}
+	if missing := publishProblems(&listing); len(missing) > 0 {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(bson.M{"error": "Listing is not ready to publish", "missing": missing})
+		return
+	}
+
+	before := listing
+	now := time.Now()
+	expires := now.Add(listingLifetime)
+	// The filter pins the draft state so a concurrent publish can't record the change twice
+	res, err := collection.UpdateOne(ctx, notDeleted(bson.M{"_id": id, "publication_state": publicationDraft}), bson.M{"$set": bson.M{
+		"publication_state": publicationPublished,
+		"published_at":      now,
+		"expires_at":        expires,
+		"updated_at":        now,
+	}})
+	if err != nil {
+		serverError(w, r, "Failed to publish Listing", err)
+		return
+	}
+	if res.MatchedCount == 0 {
+		http.Error(w, "Listing is already published", http.StatusConflict)
+		return
+	}
+	listing.Publication = publicationPublished
+	listing.PublishedAt = &now
+	listing.ExpiresAt = &expires
+	listing.UpdatedAt = now
+
+	recordAudit(auditFromRequest(r), "publish", "listings", id.Hex(), before, listing, nil)
+	go matchSavedSearches(listing)
+	json.NewEncoder(w).Encode(listing)
+}
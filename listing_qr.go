@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/jpeg" // QR_LOGO_FILE may be a JPEG
+	"image/png"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/skip2/go-qrcode"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// GET /listings/{id}/qr.png encodes the public page of the listing, SITE_BASE_URL/listings/<slug>,
+// for print brochures. Listing slugs never change, so the image is cached as immutable. QR_LOGO_FILE
+// (PNG or JPEG) is drawn in the center; the code then uses the highest error correction, which
+// survives the covered modules.
+const (
+	defaultQRSize  = 512
+	minQRSize      = 64
+	maxQRSize      = 1024
+	qrLogoFraction = 5 // the logo is at most 1/5 of the code's width
+	qrCacheControl = "public, max-age=31536000, immutable"
+)
+
+var qrLogo struct {
+	once  sync.Once
+	image image.Image
+	raw   []byte // the file as is, embedded in SVGs
+	mime  string
+}
+
+func loadQRLogo() (image.Image, []byte, string) {
+	qrLogo.once.Do(func() {
+		path := os.Getenv("QR_LOGO_FILE")
+		if path == "" {
+			return
+		}
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			log.Println("QR codes are generated without a logo, failed to read QR_LOGO_FILE:", err)
+			return
+		}
+		img, format, err := image.Decode(bytes.NewReader(raw))
+		if err != nil {
+			log.Println("QR codes are generated without a logo, QR_LOGO_FILE is not a PNG or JPEG:", err)
+			return
+		}
+		qrLogo.image, qrLogo.raw, qrLogo.mime = img, raw, "image/"+format
+	})
+	return qrLogo.image, qrLogo.raw, qrLogo.mime
+}
+
+// siteBaseURL is the public website the listing pages live on, from SITE_BASE_URL
+func siteBaseURL() string {
+	return strings.TrimRight(os.Getenv("SITE_BASE_URL"), "/")
+}
+
+func listingPageURL(base string, listing *Listing) string {
+	if listing.Slug != "" {
+		return base + "/listings/" + url.PathEscape(listing.Slug)
+	}
+	return base + "/listings/" + listing.ID.Hex()
+}
+
+// getListingQR answers GET /listings/{id}/qr.png with ?size= (64-1024, default 512) and ?format=svg
+func getListingQR(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathObjectID(w, r, "Listing")
+	if !ok {
+		return
+	}
+	size := defaultQRSize
+	if raw := r.URL.Query().Get("size"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < minQRSize || n > maxQRSize {
+			http.Error(w, fmt.Sprintf("size must be a whole number from %d to %d", minQRSize, maxQRSize), http.StatusBadRequest)
+			return
+		}
+		size = n
+	}
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "png" && format != "svg" {
+		http.Error(w, "format must be png or svg", http.StatusBadRequest)
+		return
+	}
+	base := siteBaseURL()
+	if base == "" {
+		http.Error(w, "QR codes are not configured, SITE_BASE_URL is not set", http.StatusServiceUnavailable)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	var listing Listing
+	err := client.Database("MVDB").Collection("listings").FindOne(ctx, publishedListingsFilter(bson.M{"_id": id}),
+		options.FindOne().SetProjection(bson.M{"slug": 1})).Decode(&listing)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Listing not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		serverError(w, r, "Failed to retrieve Listing", err)
+		return
+	}
+
+	logo, logoRaw, logoMime := loadQRLogo()
+	level := qrcode.Medium
+	if logo != nil {
+		level = qrcode.Highest
+	}
+	code, err := qrcode.New(listingPageURL(base, &listing), level)
+	if err != nil {
+		serverError(w, r, "Failed to generate QR code", err)
+		return
+	}
+
+	var body []byte
+	contentType := "image/png"
+	if format == "svg" {
+		contentType = "image/svg+xml"
+		body = qrSVG(code.Bitmap(), size, logoRaw, logoMime)
+	} else {
+		img := code.Image(size)
+		if logo != nil {
+			img = overlayQRLogo(img, logo)
+		}
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, img); err != nil {
+			serverError(w, r, "Failed to encode QR code", err)
+			return
+		}
+		body = buf.Bytes()
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", qrCacheControl)
+	w.Write(body)
+}
+
+// overlayQRLogo draws logo, scaled to fit 1/qrLogoFraction of the code, on a white square in the center
+func overlayQRLogo(code image.Image, logo image.Image) image.Image {
+	bounds := code.Bounds()
+	out := image.NewRGBA(bounds)
+	draw.Draw(out, bounds, code, bounds.Min, draw.Src)
+
+	box := bounds.Dx() / qrLogoFraction
+	lb := logo.Bounds()
+	scale := float64(box) / float64(max(lb.Dx(), lb.Dy()))
+	lw, lh := int(float64(lb.Dx())*scale), int(float64(lb.Dy())*scale)
+	pad := box / 10
+	cx, cy := bounds.Min.X+bounds.Dx()/2, bounds.Min.Y+bounds.Dy()/2
+	draw.Draw(out, image.Rect(cx-lw/2-pad, cy-lh/2-pad, cx+(lw+1)/2+pad, cy+(lh+1)/2+pad), image.NewUniform(color.White), image.Point{}, draw.Src)
+
+	// Nearest-neighbour scaling, logos are small and flat
+	for y := 0; y < lh; y++ {
+		for x := 0; x < lw; x++ {
+			src := logo.At(lb.Min.X+int(float64(x)/scale), lb.Min.Y+int(float64(y)/scale))
+			dst := image.Rect(cx-lw/2+x, cy-lh/2+y, cx-lw/2+x+1, cy-lh/2+y+1)
+			draw.Draw(out, dst, image.NewUniform(src), image.Point{}, draw.Over)
+		}
+	}
+	return out
+}
+
+// qrSVG draws the modules of bitmap, one path segment per run of dark modules in a row. The logo,
+// when set, is embedded as a data URI.
+func qrSVG(bitmap [][]bool, size int, logo []byte, logoMime string) []byte {
+	n := len(bitmap)
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`, size, size, n, n)
+	fmt.Fprintf(&b, `<rect width="%d" height="%d" fill="#fff"/><path fill="#000" d="`, n, n)
+	for y, row := range bitmap {
+		for x := 0; x < len(row); x++ {
+			if !row[x] {
+				continue
+			}
+			start := x
+			for x < len(row) && row[x] {
+				x++
+			}
+			fmt.Fprintf(&b, "M%d %dh%dv1h-%dz", start, y, x-start, x-start)
+		}
+	}
+	b.WriteString(`"/>`)
+	if logo != nil {
+		box := float64(n) / qrLogoFraction
+		pad := box / 10
+		origin := (float64(n) - box) / 2
+		fmt.Fprintf(&b, `<rect x="%.2f" y="%.2f" width="%.2f" height="%.2f" fill="#fff"/>`, origin-pad, origin-pad, box+2*pad, box+2*pad)
+		fmt.Fprintf(&b, `<image x="%.2f" y="%.2f" width="%.2f" height="%.2f" href="data:%s;base64,%s"/>`,
+			origin, origin, box, box, logoMime, base64.StdEncoding.EncodeToString(logo))
+	}
+	b.WriteString(`</svg>`)
+	return []byte(b.String())
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/makiuchi-d/gozxing"
+	zxingqr "github.com/makiuchi-d/gozxing/qrcode"
+	"github.com/skip2/go-qrcode"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const testListingURL = "https://mvrealty.example/listings/noble-ploenchit-2br-%E0%B8%84"
+
+// decodeQR reads the QR code in img back the way a phone camera would
+func decodeQR(t *testing.T, img image.Image) string {
+	t.Helper()
+	bmp, err := gozxing.NewBinaryBitmapFromImage(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := zxingqr.NewQRCodeReader().Decode(bmp, nil)
+	if err != nil {
+		t.Fatalf("the QR code doesn't decode: %v", err)
+	}
+	return result.GetText()
+}
+
+// testLogo is a flat two-colour logo, dark enough to destroy the modules it covers
+func testLogo() image.Image {
+	logo := image.NewRGBA(image.Rect(0, 0, 60, 40))
+	draw.Draw(logo, logo.Bounds(), image.NewUniform(color.RGBA{R: 200, A: 255}), image.Point{}, draw.Src)
+	draw.Draw(logo, image.Rect(10, 10, 50, 30), image.NewUniform(color.Black), image.Point{}, draw.Src)
+	return logo
+}
+
+func TestQRRoundTrip(t *testing.T) {
+	code, err := qrcode.New(testListingURL, qrcode.Medium)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range []int{minQRSize * 2, defaultQRSize, maxQRSize} {
+		if got := decodeQR(t, code.Image(size)); got != testListingURL {
+			t.Errorf("size %d decodes to %q", size, got)
+		}
+	}
+
+	withLogo, err := qrcode.New(testListingURL, qrcode.Highest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := overlayQRLogo(withLogo.Image(defaultQRSize), testLogo())
+	if got := decodeQR(t, img); got != testListingURL {
+		t.Errorf("with the logo it decodes to %q", got)
+	}
+	center := img.At(defaultQRSize/2, defaultQRSize/2)
+	if r, g, b, _ := center.RGBA(); r != 0 || g != 0 || b != 0 {
+		t.Errorf("the logo isn't in the center, found %v", center)
+	}
+}
+
+var svgRun = regexp.MustCompile(`M(\d+) (\d+)h(\d+)v1h-\d+z`)
+
+// rasterizeQRSVG draws the module runs of an SVG from qrSVG, scale pixels per module
+func rasterizeQRSVG(t *testing.T, svg []byte, modules, scale int) image.Image {
+	t.Helper()
+	img := image.NewGray(image.Rect(0, 0, modules*scale, modules*scale))
+	draw.Draw(img, img.Bounds(), image.White, image.Point{}, draw.Src)
+	runs := svgRun.FindAllSubmatch(svg, -1)
+	if len(runs) == 0 {
+		t.Fatalf("no modules in %.200s", svg)
+	}
+	for _, run := range runs {
+		x, _ := strconv.Atoi(string(run[1]))
+		y, _ := strconv.Atoi(string(run[2]))
+		n, _ := strconv.Atoi(string(run[3]))
+		draw.Draw(img, image.Rect(x*scale, y*scale, (x+n)*scale, (y+1)*scale), image.Black, image.Point{}, draw.Src)
+	}
+	return img
+}
+
+func TestQRSVGRoundTrip(t *testing.T) {
+	code, err := qrcode.New(testListingURL, qrcode.Medium)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bitmap := code.Bitmap()
+	svg := qrSVG(bitmap, 300, nil, "")
+	if !bytes.HasPrefix(svg, []byte(`<svg xmlns="http://www.w3.org/2000/svg" width="300" height="300"`)) || bytes.Contains(svg, []byte("<image")) {
+		t.Errorf("svg %.200s", svg)
+	}
+	if got := decodeQR(t, rasterizeQRSVG(t, svg, len(bitmap), 8)); got != testListingURL {
+		t.Errorf("the SVG decodes to %q", got)
+	}
+
+	withLogo := qrSVG(bitmap, 300, []byte("\x89PNG"), "image/png")
+	if !bytes.Contains(withLogo, []byte(`href="data:image/png;base64,iVBORw=="`)) {
+		t.Errorf("the logo isn't embedded: %.200s", withLogo[len(withLogo)-300:])
+	}
+}
+
+func TestListingPageURL(t *testing.T) {
+	id := primitive.NewObjectID()
+	for listing, want := range map[*Listing]string{
+		{ID: id, Slug: "noble-ploenchit"}: "https://mvrealty.example/listings/noble-ploenchit",
+		{ID: id, Slug: "a b/c"}:           "https://mvrealty.example/listings/a%20b%2Fc",
+		{ID: id}:                          "https://mvrealty.example/listings/" + id.Hex(),
+	} {
+		if got := listingPageURL("https://mvrealty.example", listing); got != want {
+			t.Errorf("slug %q: %s, want %s", listing.Slug, got, want)
+		}
+	}
+	t.Setenv("SITE_BASE_URL", "https://mvrealty.example/")
+	if base := siteBaseURL(); base != "https://mvrealty.example" {
+		t.Errorf("base %q", base)
+	}
+}
+
+// serveListingQR calls getListingQR for the listing id with query
+func serveListingQR(id, query string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/listings/"+id+"/qr.png"+query, nil)
+	rec := httptest.NewRecorder()
+	getListingQR(rec, mux.SetURLVars(req, map[string]string{"id": id}))
+	return rec
+}
+
+func TestListingQRValidation(t *testing.T) {
+	t.Setenv("SITE_BASE_URL", "https://mvrealty.example")
+	id := primitive.NewObjectID().Hex()
+	for query, want := range map[string]string{
+		"?size=2000": "size must be a whole number from 64 to 1024",
+		"?size=32":   "size must be a whole number from 64 to 1024",
+		"?size=big":  "size must be a whole number from 64 to 1024",
+		"?format=js": "format must be png or svg",
+	} {
+		rec := serveListingQR(id, query)
+		if rec.Code != http.StatusBadRequest || strings.TrimSpace(rec.Body.String()) != want {
+			t.Errorf("%s: %d %q", query, rec.Code, rec.Body)
+		}
+	}
+	if rec := serveListingQR("not-an-id", ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("a bad id: %d", rec.Code)
+	}
+	t.Setenv("SITE_BASE_URL", "")
+	if rec := serveListingQR(id, ""); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("without SITE_BASE_URL: %d", rec.Code)
+	}
+}
+
+func TestListingQR(t *testing.T) {
+	useTestMongo(t, "listings")
+	t.Setenv("SITE_BASE_URL", "https://mvrealty.example")
+	id := primitive.NewObjectID()
+	if _, err := client.Database("MVDB").Collection("listings").InsertOne(context.Background(),
+		Listing{ID: id, Slug: "noble-ploenchit-2br", ListingStatus: "active"}); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := serveListingQR(id.Hex(), "?size=256")
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "image/png" || rec.Header().Get("Cache-Control") != qrCacheControl {
+		t.Fatalf("%d, Content-Type %q, Cache-Control %q", rec.Code, rec.Header().Get("Content-Type"), rec.Header().Get("Cache-Control"))
+	}
+	img, err := png.Decode(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds().Dx() != 256 {
+		t.Errorf("%d pixels wide, want 256", img.Bounds().Dx())
+	}
+	if got := decodeQR(t, img); got != "https://mvrealty.example/listings/noble-ploenchit-2br" {
+		t.Errorf("decodes to %q", got)
+	}
+
+	rec = serveListingQR(id.Hex(), "?format=svg")
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "image/svg+xml" || !strings.HasPrefix(rec.Body.String(), "<svg") {
+		t.Errorf("svg: %d %q %.40s", rec.Code, rec.Header().Get("Content-Type"), rec.Body)
+	}
+
+	if rec := serveListingQR(primitive.NewObjectID().Hex(), ""); rec.Code != http.StatusNotFound {
+		t.Errorf("an unknown listing: %d", rec.Code)
+	}
+}
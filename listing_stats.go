@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const defaultMinSampleSize = 5
+
+type bedroomPriceBucket struct {
+	Bedroom       int     `json:"bedroom"`
+	SampleSize    int     `json:"sample_size"`
+	AveragePrice  float64 `json:"average_price"`
+	MedianPrice   float64 `json:"median_price"`
+	MinPrice      float64 `json:"min_price"`
+	MaxPrice      float64 `json:"max_price"`
+	LowConfidence bool    `json:"low_confidence"`
+}
+
+// getPriceByBedroom groups active listings by bedroom count.
+// ?listing_type= narrows the match, ?min_sample= sets the low_confidence threshold.
+func getPriceByBedroom(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	q := r.URL.Query()
+	match := activeListingsFilter(bson.M{})
+	if listingType := q.Get("listing_type"); listingType != "" {
+		if !isOneOf(listingType, listingTypes) {
+			http.Error(w, "listing_type must be sale or rent", http.StatusBadRequest)
+			return
+		}
+		match["listing_type"] = listingType
+	}
+	minSample := defaultMinSampleSize
+	if raw := q.Get("min_sample"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 {
+			http.Error(w, "min_sample must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		minSample = n
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	// $match comes first so the listing_status / listing_type index narrows the scan
+	pipeline := []bson.M{
+		{"$match": match},
+		{"$group": bson.M{
+			"_id":     "$bedroom",
+			"count":   bson.M{"$sum": 1},
+			"average": bson.M{"$avg": "$price"},
+			"min":     bson.M{"$min": "$price"},
+			"max":     bson.M{"$max": "$price"},
+			"prices":  bson.M{"$push": "$price"},
+		}},
+		{"$sort": bson.M{"_id": 1}},
+	}
+	cur, err := client.Database("MVDB").Collection("listings").Aggregate(ctx, pipeline)
+	if err != nil {
+		serverError(w, r, "Failed to aggregate Listings", err)
+		return
+	}
+	defer cur.Close(ctx)
+
+	var rows []struct {
+		Bedroom int       `bson:"_id"`
+		Count   int       `bson:"count"`
+		Average float64   `bson:"average"`
+		Min     float64   `bson:"min"`
+		Max     float64   `bson:"max"`
+		Prices  []float64 `bson:"prices"`
+	}
+	if err := cur.All(ctx, &rows); err != nil {
+		serverError(w, r, "Failed to decode aggregated Listings", err)
+		return
+	}
+
+	buckets := make([]bedroomPriceBucket, 0, len(rows))
+	for _, row := range rows {
+		buckets = append(buckets, bedroomPriceBucket{
+			Bedroom:       row.Bedroom,
+			SampleSize:    row.Count,
+			AveragePrice:  row.Average,
+			MedianPrice:   median(row.Prices),
+			MinPrice:      row.Min,
+			MaxPrice:      row.Max,
+			LowConfidence: row.Count < minSample,
+		})
+	}
+	json.NewEncoder(w).Encode(buckets)
+}
+
+// median of values; the input is sorted in place
+func median(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sort.Float64s(values)
+	mid := len(values) / 2
+	if len(values)%2 == 1 {
+		return values[mid]
+	}
+	return (values[mid-1] + values[mid]) / 2
+}
+
+const (
+	defaultHistogramBuckets = 10
+	maxHistogramBuckets     = 100
+)
+
+type priceBucket struct {
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+	Count int     `json:"count"`
+}
+
+type priceHistogram struct {
+	Count   int           `json:"count"`
+	Buckets []priceBucket `json:"buckets"`
+}
+
+// histogramBoundaries splits [min, max] into n equal-width buckets and returns the n+1 edges.
+// Every bucket is upper-exclusive except the last, which includes max.
+func histogramBoundaries(min, max float64, n int) []float64 {
+	if n < 1 || max < min {
+		return nil
+	}
+	if max == min {
+		return []float64{min, max}
+	}
+	width := (max - min) / float64(n)
+	edges := make([]float64, n+1)
+	for i := 0; i < n; i++ {
+		edges[i] = min + float64(i)*width
+	}
+	edges[n] = max // avoid floating point drift on the last edge
+	return edges
+}
+
+// getPriceHistogram returns the price distribution of listings matching the GET /listings filters.
+// Fewer than two matches give an empty bucket list.
+func getPriceHistogram(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	filter, err := parseListingFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !authorizeListingState(w, r, filter) {
+		return
+	}
+	n := defaultHistogramBuckets
+	if raw := r.URL.Query().Get("buckets"); raw != "" {
+		n, err = strconv.Atoi(raw)
+		if err != nil || n < 1 || n > maxHistogramBuckets {
+			http.Error(w, "buckets must be between 1 and 100", http.StatusBadRequest)
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	collection := client.Database("MVDB").Collection("listings")
+	match := filter.toBSON()
+
+	// First pass: range and count of matching prices
+	cur, err := collection.Aggregate(ctx, []bson.M{
+		{"$match": match},
+		{"$group": bson.M{"_id": nil, "min": bson.M{"$min": "$price"}, "max": bson.M{"$max": "$price"}, "count": bson.M{"$sum": 1}}},
+	})
+	if err != nil {
+		serverError(w, r, "Failed to aggregate Listings", err)
+		return
+	}
+	var bounds []struct {
+		Min   float64 `bson:"min"`
+		Max   float64 `bson:"max"`
+		Count int     `bson:"count"`
+	}
+	err = cur.All(ctx, &bounds)
+	if err != nil {
+		serverError(w, r, "Failed to decode aggregated Listings", err)
+		return
+	}
+
+	result := priceHistogram{Buckets: []priceBucket{}}
+	if len(bounds) == 1 {
+		result.Count = bounds[0].Count
+	}
+	if result.Count < 2 {
+		json.NewEncoder(w).Encode(result)
+		return
+	}
+
+	edges := histogramBoundaries(bounds[0].Min, bounds[0].Max, n)
+	buckets := len(edges) - 1
+	width := (edges[buckets] - edges[0]) / float64(buckets)
+
+	// Second pass: bucket index = floor((price - min) / width), clamped so max lands in the last bucket
+	index := bson.M{"$literal": 0}
+	if width > 0 {
+		index = bson.M{"$min": bson.A{buckets - 1, bson.M{"$floor": bson.M{"$divide": bson.A{bson.M{"$subtract": bson.A{"$price", edges[0]}}, width}}}}}
+	}
+	cur, err = collection.Aggregate(ctx, []bson.M{
+		{"$match": match},
+		{"$group": bson.M{"_id": index, "count": bson.M{"$sum": 1}}},
+	})
+	if err != nil {
+		serverError(w, r, "Failed to aggregate Listings", err)
+		return
+	}
+	var counts []struct {
+		Index int `bson:"_id"`
+		Count int `bson:"count"`
+	}
+	if err := cur.All(ctx, &counts); err != nil {
+		serverError(w, r, "Failed to decode aggregated Listings", err)
+		return
+	}
+
+	result.Buckets = make([]priceBucket, buckets)
+	for i := range result.Buckets {
+		result.Buckets[i] = priceBucket{Min: edges[i], Max: edges[i+1]}
+	}
+	for _, c := range counts {
+		if c.Index >= 0 && c.Index < buckets {
+			result.Buckets[c.Index].Count += c.Count
+		}
+	}
+	json.NewEncoder(w).Encode(result)
+}
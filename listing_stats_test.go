@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestHistogramBoundaries(t *testing.T) {
+	tests := []struct {
+		name     string
+		min, max float64
+		n        int
+		want     []float64
+	}{
+		{"even split", 1000, 5000, 4, []float64{1000, 2000, 3000, 4000, 5000}},
+		{"one bucket", 1000, 5000, 1, []float64{1000, 5000}},
+		{"fractional width", 0, 1, 3, []float64{0, 1.0 / 3, 2.0 / 3, 1}},
+		{"single price", 2500, 2500, 10, []float64{2500, 2500}},
+		{"no buckets", 0, 100, 0, nil},
+		{"inverted range", 100, 0, 5, nil},
+	}
+	for _, tt := range tests {
+		if got := histogramBoundaries(tt.min, tt.max, tt.n); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: edges %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// 0.1 steps don't add up exactly, the last edge must still be max
+	edges := histogramBoundaries(0, 0.3, 3)
+	if edges[3] != 0.3 {
+		t.Errorf("last edge %v, want 0.3", edges[3])
+	}
+}
+
+func TestMedian(t *testing.T) {
+	for _, tt := range []struct {
+		values []float64
+		want   float64
+	}{
+		{nil, 0},
+		{[]float64{7}, 7},
+		{[]float64{30, 10, 20}, 20},
+		{[]float64{40, 10, 30, 20}, 25},
+	} {
+		if got := median(tt.values); got != tt.want {
+			t.Errorf("median %v = %v, want %v", tt.values, got, tt.want)
+		}
+	}
+}
+
+func TestPriceHistogramBuckets(t *testing.T) {
+	for _, raw := range []string{"0", "101", "many"} {
+		rec := httptest.NewRecorder()
+		getPriceHistogram(rec, httptest.NewRequest(http.MethodGet, "/stats/listings/price-histogram?buckets="+raw, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("buckets=%s: status %d, want 400", raw, rec.Code)
+		}
+	}
+}
+
+func getHistogram(t *testing.T, query string) priceHistogram {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	getPriceHistogram(rec, httptest.NewRequest(http.MethodGet, "/stats/listings/price-histogram"+query, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("%s: status %d: %s", query, rec.Code, rec.Body)
+	}
+	var result priceHistogram
+	if err := json.NewDecoder(rec.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+// TestPriceHistogramKnownPrices buckets a fixed set of prices: the lower edge of each bucket is
+// inclusive, and the highest price lands in the last bucket
+func TestPriceHistogramKnownPrices(t *testing.T) {
+	useTestMongo(t, "listings")
+	collection := client.Database("MVDB").Collection("listings")
+	insert := func(prices ...float64) {
+		for _, price := range prices {
+			if _, err := collection.InsertOne(context.Background(), Listing{Price: price, ListingStatus: "active"}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	insert(10000)
+	if got := getHistogram(t, "?buckets=4"); got.Count != 1 || got.Buckets == nil || len(got.Buckets) != 0 {
+		t.Errorf("one listing: %+v, want an empty bucket list", got)
+	}
+
+	insert(12000, 15000, 19999, 20000, 30000, 50000)
+	if _, err := collection.InsertOne(context.Background(), Listing{Price: 45000, ListingStatus: "inactive"}); err != nil {
+		t.Fatal(err)
+	}
+	got := getHistogram(t, "?buckets=4")
+	want := priceHistogram{Count: 7, Buckets: []priceBucket{
+		{Min: 10000, Max: 20000, Count: 4},
+		{Min: 20000, Max: 30000, Count: 1},
+		{Min: 30000, Max: 40000, Count: 1},
+		{Min: 40000, Max: 50000, Count: 1},
+	}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("histogram %+v, want %+v", got, want)
+	}
+	if got := getHistogram(t, ""); len(got.Buckets) != defaultHistogramBuckets {
+		t.Errorf("%d buckets by default, want %d", len(got.Buckets), defaultHistogramBuckets)
+	}
+}
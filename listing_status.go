@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// deactivationReasons are the accepted reasons for taking a listing off the market
+var deactivationReasons = []string{"sold", "rented", "withdrawn"}
+
+const cancelReasonListingDeactivated = "listing_deactivated"
+
+var errListingStatusUnchanged = errors.New("listing already has that status")
+
+// setListingStatus flips listing_status from the opposite value, so a listing that already has the
+// status is reported as errListingStatusUnchanged rather than updated twice.
+// Deactivating also cancels the listing's future scheduled appointments, in the same transaction when available.
+func setListingStatus(ctx context.Context, id primitive.ObjectID, active bool, reason string) (*deletionReport, error) {
+	return runCascade(ctx, func(ctx context.Context, rep *deletionReport) error {
+		db := client.Database("MVDB")
+		now := time.Now()
+		from, update := "active", bson.M{
+			"$set": bson.M{"listing_status": "inactive", "deactivated_at": now, "deactivation_reason": reason, "updated_at": now},
+		}
+		if active {
+			from, update = "inactive", bson.M{
+				"$set":   bson.M{"listing_status": "active", "updated_at": now},
+				"$unset": bson.M{"deactivated_at": "", "deactivation_reason": ""},
+			}
+		}
+
+		res, err := db.Collection("listings").UpdateOne(ctx, notDeleted(bson.M{"_id": id, "listing_status": from}), update)
+		if err != nil {
+			return err
+		}
+		if res.MatchedCount == 0 {
+			n, err := db.Collection("listings").CountDocuments(ctx, notDeleted(bson.M{"_id": id}))
+			if err != nil {
+				return err
+			}
+			if n == 0 {
+				return errDocumentNotFound
+			}
+			return errListingStatusUnchanged
+		}
+		if active {
+			rep.add("listings", "activated", id)
+			return nil
+		}
+		rep.add("listings", "deactivated", id)
+		return cancelAppointments(ctx, rep, bson.M{"listing_id": id.Hex(), "appointment_date": bson.M{"$gte": now}}, cancelReasonListingDeactivated)
+	})
+}
+
+// deactivateListing takes a listing off the market. Body (optional): {"reason": "sold"}
+func deactivateListing(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Reason string `json:"reason"`
+	}
+	json.NewDecoder(r.Body).Decode(&body)
+	if body.Reason != "" && !isOneOf(body.Reason, deactivationReasons) {
+		http.Error(w, fmt.Sprintf("reason must be one of %s", strings.Join(deactivationReasons, ", ")), http.StatusBadRequest)
+		return
+	}
+	changeListingStatus(w, r, false, body.Reason)
+}
+
+// activateListing puts an inactive listing back on the market
+func activateListing(w http.ResponseWriter, r *http.Request) {
+	changeListingStatus(w, r, true, "")
+}
+
+func changeListingStatus(w http.ResponseWriter, r *http.Request, active bool, reason string) {
+	w.Header().Set("Content-Type", "application/json")
+
+	id, ok := pathObjectID(w, r, "Listing")
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	before := auditSnapshot(ctx, "listings", id)
+	report, err := setListingStatus(ctx, id, active, reason)
+	switch {
+	case err == errDocumentNotFound:
+		http.Error(w, "Listing not found", http.StatusNotFound)
+		return
+	case err == errListingStatusUnchanged && active:
+		http.Error(w, "Listing is already active", http.StatusConflict)
+		return
+	case err == errListingStatusUnchanged:
+		http.Error(w, "Listing is already inactive", http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, "Failed to update Listing status", http.StatusInternalServerError)
+		return
+	}
+
+	cancelled := 0
+	for _, t := range report.Touched {
+		if t.Action == "cancelled" {
+			cancelled++
+		}
+	}
+	recordAudit(auditFromRequest(r), "update", "listings", id.Hex(), before, auditSnapshot(ctx, "listings", id), report)
+	go notifyCancelledAppointments(report)
+
+	status := "inactive"
+	if active {
+		status = "active"
+	}
+	json.NewEncoder(w).Encode(bson.M{"listing_id": id.Hex(), "listing_status": status, "cancelled_appointments": cancelled})
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// listingTagVocabulary is the curated set of unit-level amenities. Other tags are stored as given
+// (normalized) and reported back so admins can add or map them.
+var listingTagVocabulary = []string{
+	"bathtub", "balcony", "corner-unit", "high-floor", "city-view", "river-view", "pool-view",
+	"pet-friendly", "ev-charger", "washing-machine", "dishwasher", "walk-in-closet", "smart-home",
+	"renovated", "duplex", "private-pool", "garden", "near-bts", "near-mrt", "parking",
+}
+
+// listingTagAliases maps common spellings onto a vocabulary tag after normalizing
+var listingTagAliases = map[string]string{
+	"bath-tub":         "bathtub",
+	"pets-allowed":     "pet-friendly",
+	"pet-allowed":      "pet-friendly",
+	"ev-charging":      "ev-charger",
+	"electric-charger": "ev-charger",
+	"washer":           "washing-machine",
+	"walk-in-wardrobe": "walk-in-closet",
+	"bts":              "near-bts",
+	"mrt":              "near-mrt",
+}
+
+// normalizeTags lowercases and kebab-cases each tag, applies the aliases and drops empties and repeats
+func normalizeTags(tags []string) []string {
+	normalized := []string{}
+	seen := map[string]bool{}
+	for _, tag := range tags {
+		tag = slugify(tag)
+		if alias, ok := listingTagAliases[tag]; ok {
+			tag = alias
+		}
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		normalized = append(normalized, tag)
+	}
+	return normalized
+}
+
+// unknownTags returns the normalized tags that aren't in listingTagVocabulary
+func unknownTags(tags []string) []string {
+	unknown := []string{}
+	for _, tag := range tags {
+		if !isOneOf(tag, listingTagVocabulary) {
+			unknown = append(unknown, tag)
+		}
+	}
+	return unknown
+}
+
+type tagCount struct {
+	Tag        string `bson:"_id" json:"tag"`
+	Count      int    `bson:"count" json:"count"`
+	Vocabulary bool   `bson:"-" json:"vocabulary"` // false for free-text tags awaiting curation
+}
+
+// getListingTags returns every tag used on active listings with the number of listings carrying it
+func getListingTags(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	pipeline := []bson.M{
+		{"$match": activeListingsFilter(bson.M{"tags.0": bson.M{"$exists": true}})},
+		{"$unwind": "$tags"},
+		{"$group": bson.M{"_id": "$tags", "count": bson.M{"$sum": 1}}},
+		{"$sort": bson.D{{Key: "count", Value: -1}, {Key: "_id", Value: 1}}},
+	}
+	cur, err := client.Database("MVDB").Collection("listings").Aggregate(ctx, pipeline)
+	if err != nil {
+		serverError(w, r, "Failed to aggregate Listing tags", err)
+		return
+	}
+	tags := []tagCount{}
+	if err := cur.All(ctx, &tags); err != nil {
+		serverError(w, r, "Failed to decode Listing tags", err)
+		return
+	}
+	for i := range tags {
+		tags[i].Vocabulary = isOneOf(tags[i].Tag, listingTagVocabulary)
+	}
+	json.NewEncoder(w).Encode(tags)
+}
+
+// parseTagsParam splits ?tags= on commas and normalizes the result like stored tags
+func parseTagsParam(raw string) []string {
+	if raw == "" {
+		return nil
+	}
+	return normalizeTags(strings.Split(raw, ","))
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+)
+
+// Sizes are stored in square meters. ?units=imperial converts them to square feet in responses and
+// reads the min_size/max_size filters in square feet; size_unit always names the unit of size.
+const (
+	unitsMetric   = "metric"
+	unitsImperial = "imperial"
+	sqftPerSqm    = 10.763910416709722
+)
+
+var unitsParam = apiParam{Name: "units", Description: "metric (default) or imperial: size in sqft and price_per_sqft instead of price_per_sqm"}
+
+func parseUnits(value string) (string, error) {
+	switch value {
+	case "", unitsMetric:
+		return unitsMetric, nil
+	case unitsImperial:
+		return unitsImperial, nil
+	}
+	return "", fmt.Errorf("units must be metric or imperial")
+}
+
+// sqftFromSqm converts a size to square feet, rounded to one decimal
+func sqftFromSqm(size float64) float64 {
+	return roundConverted(size*sqftPerSqm, 1)
+}
+
+// roundConverted rounds a converted value to decimals, halves away from zero. The conversion can
+// land an exact half a few ulps short of it, 0.004645152 sqm is 0.04999... sqft, so the value is
+// first snapped to a millionth of the last decimal.
+func roundConverted(v float64, decimals int) float64 {
+	scale := math.Pow(10, float64(decimals))
+	return math.Round(math.Round(v*scale*1e6)/1e6) / scale
+}
+
+// sqmFromSqft converts a size filter given in square feet; it is not rounded, so a threshold taken
+// from a displayed size still matches that listing
+func sqmFromSqft(size float64) float64 {
+	return size / sqftPerSqm
+}
+
+// pricePerSqft is like pricePerSqm for a size in square meters, per square foot
+func pricePerSqft(price, size float64) *float64 {
+	if size <= 0 || math.IsNaN(size) || math.IsInf(size, 0) {
+		return nil
+	}
+	v := roundConverted(price/(size*sqftPerSqm), 2)
+	return &v
+}
+
+// applyUnits handles ?units= for listing responses; the conversion itself happens in MarshalJSON.
+// It answers 400 and returns false for an unknown unit system.
+func applyUnits(w http.ResponseWriter, r *http.Request, listings []Listing) bool {
+	units, err := parseUnits(r.URL.Query().Get("units"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	for i := range listings {
+		listings[i].Units = units
+	}
+	return true
+}
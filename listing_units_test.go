@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+)
+
+// sqmPerSqft is exact: a foot is 0.3048 m
+const sqmPerSqft = 0.09290304
+
+func TestSqftFromSqm(t *testing.T) {
+	for _, tt := range []struct {
+		sqm, want float64
+	}{
+		{0, 0},
+		{1, 10.8},
+		{35, 376.7},
+		{50, 538.2},
+		{120.5, 1297.1},
+		{sqmPerSqft * 50, 50},
+		// halfway between two tenths rounds up
+		{sqmPerSqft * 50.05, 50.1},
+		{sqmPerSqft * 50.25, 50.3},
+		{sqmPerSqft * 0.05, 0.1},
+		{sqmPerSqft * 1076.35, 1076.4},
+		// just under halfway rounds down
+		{sqmPerSqft * 50.049, 50},
+	} {
+		if got := sqftFromSqm(tt.sqm); got != tt.want {
+			t.Errorf("sqftFromSqm(%v) = %v, want %v", tt.sqm, got, tt.want)
+		}
+	}
+}
+
+// TestSqmFromSqft: a size filter in square feet is converted without rounding, so the displayed size
+// of a listing, used as min_size and max_size, still selects it
+func TestSqmFromSqft(t *testing.T) {
+	for _, tt := range []struct {
+		sqft, want float64
+	}{
+		{0, 0},
+		{10.763910416709722, 1},
+		{538.2, 50.0004},
+		{1000, 92.903},
+	} {
+		if got := sqmFromSqft(tt.sqft); math.Abs(got-tt.want) > 1e-4 {
+			t.Errorf("sqmFromSqft(%v) = %v, want %v", tt.sqft, got, tt.want)
+		}
+	}
+	for _, sqm := range []float64{28, 35.5, 50, 120.25} {
+		if got := sqmFromSqft(sqftFromSqm(sqm)); math.Abs(got-sqm) > 0.05*sqmPerSqft {
+			t.Errorf("%v sqm back from sqft: %v", sqm, got)
+		}
+	}
+}
+
+func TestPricePerSqft(t *testing.T) {
+	for _, tt := range []struct {
+		price, sqm float64
+		perSqm     *float64
+		perSqft    *float64
+	}{
+		{5000000, 50, floatPtr(100000), floatPtr(9290.3)},
+		{25000, 35, floatPtr(714.29), floatPtr(66.36)},
+		{1234.5, 1, floatPtr(1234.5), floatPtr(114.69)},
+		{25000, 0, nil, nil},
+		{25000, -1, nil, nil},
+		{25000, math.NaN(), nil, nil},
+	} {
+		if got := pricePerSqm(tt.price, tt.sqm); deref(got) != deref(tt.perSqm) {
+			t.Errorf("pricePerSqm(%v, %v) = %v, want %v", tt.price, tt.sqm, deref(got), deref(tt.perSqm))
+		}
+		if got := pricePerSqft(tt.price, tt.sqm); deref(got) != deref(tt.perSqft) {
+			t.Errorf("pricePerSqft(%v, %v) = %v, want %v", tt.price, tt.sqm, deref(got), deref(tt.perSqft))
+		}
+	}
+}
+
+func TestListingUnitsJSON(t *testing.T) {
+	for _, tt := range []struct {
+		units, sizeUnit string
+		size            float64
+		perSqm, perSqft interface{}
+	}{
+		{unitsMetric, "sqm", 50, 100000.0, nil},
+		{unitsImperial, "sqft", 538.2, nil, 9290.3},
+	} {
+		data, err := json.Marshal(Listing{Price: 5000000, Size: 50, Units: tt.units})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got map[string]interface{}
+		json.Unmarshal(data, &got)
+		if got["size"] != tt.size || got["size_unit"] != tt.sizeUnit || got["price_per_sqm"] != tt.perSqm || got["price_per_sqft"] != tt.perSqft {
+			t.Errorf("%s: size %v %v, price_per_sqm %v, price_per_sqft %v", tt.units, got["size"], got["size_unit"], got["price_per_sqm"], got["price_per_sqft"])
+		}
+	}
+	if _, err := parseUnits("us"); err == nil {
+		t.Error("parseUnits accepted us")
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/LynnT-2003/mv-realty-backend/imagemeta"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// listingUpdate is the body of PUT /listings/{id}; absent fields are left unchanged.
+// listing_status has its own endpoints and property_id can't be changed.
+type listingUpdate struct {
+	Description     *string            `json:"description"`
+	Price           *float64           `json:"price"`
+	Currency        *string            `json:"currency"`
+	MinimumContract *string            `json:"minimum_contract"`
+	Floor           *int               `json:"floor"`
+	Size            *float64           `json:"size"`
+	Bedroom         *int               `json:"bedroom"`
+	Bathroom        *int               `json:"bathroom"`
+	Furniture       *string            `json:"furniture"`
+	Status          *string            `json:"status"`
+	ListingType     *string            `json:"listing_type"`
+	FacingDirection *string            `json:"facing_direction"`
+	Photos          *[]imagemeta.Image `json:"photos"`
+	Tags            *[]string          `json:"tags"`
+	AvailableFrom   *time.Time         `json:"available_from"`
+	DepositMonths   *int               `json:"deposit_months"`
+	AdvanceMonths   *int               `json:"advance_months"`
+	AgentID         *string            `json:"agent_id"` // "" unassigns
+}
+
+// apply copies the given fields onto listing and returns them as a $set document
+func (u listingUpdate) apply(listing *Listing) bson.M {
+	set := bson.M{}
+	if u.Description != nil {
+		listing.Description = *u.Description
+		set["description"] = *u.Description
+	}
+	if u.Price != nil {
+		listing.Price = *u.Price
+		set["price"] = *u.Price
+	}
+	if u.Currency != nil {
+		listing.Currency = *u.Currency
+		set["currency"] = *u.Currency
+	}
+	if u.MinimumContract != nil {
+		listing.MinimumContract = *u.MinimumContract
+		set["minimum_contract"] = *u.MinimumContract
+	}
+	if u.Floor != nil {
+		listing.Floor = *u.Floor
+		set["floor"] = *u.Floor
+	}
+	if u.Size != nil {
+		listing.Size = *u.Size
+		set["size"] = *u.Size
+	}
+	if u.Bedroom != nil {
+		listing.Bedroom = *u.Bedroom
+		set["bedroom"] = *u.Bedroom
+	}
+	if u.Bathroom != nil {
+		listing.Bathroom = *u.Bathroom
+		set["bathroom"] = *u.Bathroom
+	}
+	if u.Furniture != nil {
+		listing.Furniture = *u.Furniture
+		set["furniture"] = *u.Furniture
+	}
+	if u.Status != nil {
+		listing.Status = *u.Status
+		set["status"] = *u.Status
+	}
+	if u.ListingType != nil {
+		listing.ListingType = *u.ListingType
+		set["listing_type"] = *u.ListingType
+	}
+	if u.FacingDirection != nil {
+		listing.FacingDirection = *u.FacingDirection
+		set["facing_direction"] = *u.FacingDirection
+	}
+	if u.Photos != nil {
+		imagemeta.Normalize(*u.Photos)
+		listing.Photos = *u.Photos
+		set["photos"] = *u.Photos
+	}
+	if u.DepositMonths != nil {
+		listing.DepositMonths = *u.DepositMonths
+		set["deposit_months"] = *u.DepositMonths
+	}
+	if u.AdvanceMonths != nil {
+		listing.AdvanceMonths = *u.AdvanceMonths
+		set["advance_months"] = *u.AdvanceMonths
+	}
+	if u.AvailableFrom != nil {
+		listing.AvailableFrom = u.AvailableFrom
+		set["available_from"] = *u.AvailableFrom
+	}
+	if u.Tags != nil {
+		listing.Tags = normalizeTags(*u.Tags)
+		set["tags"] = listing.Tags
+	}
+	if u.AgentID != nil {
+		listing.AgentID = *u.AgentID
+		set["agent_id"] = *u.AgentID
+	}
+	return set
+}
+
+// updateListing applies a partial update. A price change is appended to the listing's price history.
+func updateListing(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	id, ok := pathObjectID(w, r, "Listing")
+	if !ok {
+		return
+	}
+	var body listingUpdate
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Failed to parse request body", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	collection := client.Database("MVDB").Collection("listings")
+	var listing Listing
+	err := collection.FindOne(ctx, notDeleted(bson.M{"_id": id})).Decode(&listing)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Listing not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		serverError(w, r, "Failed to retrieve Listing", err)
+		return
+	}
+
+	before := listing
+	set := body.apply(&listing)
+	if problems := validateListingFields(&listing); len(problems) > 0 {
+		http.Error(w, (&validationError{Problems: problems}).Error(), http.StatusBadRequest)
+		return
+	}
+	if len(set) == 0 {
+		json.NewEncoder(w).Encode(listing)
+		return
+	}
+	// Reassigning to an inactive agent would orphan the listing straight away
+	if listing.AgentID != "" && listing.AgentID != before.AgentID {
+		switch err := checkAgentAssignable(ctx, listing.AgentID); err {
+		case nil:
+		case errAgentCheck:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		default:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	meta := auditFromRequest(r)
+	now := time.Now()
+	set["updated_at"] = now
+	update := bson.M{"$set": set}
+	// The filter pins the old price so two concurrent price changes can't both record the same previous price
+	filter := bson.M{"_id": id, "price": before.Price}
+	if listing.Price != before.Price {
+		change := priceChange{Price: listing.Price, PreviousPrice: before.Price, ChangedAt: now, ChangedBy: meta.Actor}
+		update["$push"] = pushPriceChange(change)
+		listing.PriceHistory = append(listing.PriceHistory, change)
+	}
+	res, err := collection.UpdateOne(ctx, notDeleted(filter), update)
+	if err != nil {
+		serverError(w, r, "Failed to update Listing", err)
+		return
+	}
+	if res.MatchedCount == 0 {
+		http.Error(w, "Listing was changed or deleted concurrently, retry the update", http.StatusConflict)
+		return
+	}
+	listing.UpdatedAt = now
+
+	recordAudit(meta, "update", "listings", id.Hex(), before, listing, nil)
+	if listing.Price < before.Price && listing.Currency == before.Currency {
+		go notifyPriceDrop(&listing, before.Price)
+	}
+	json.NewEncoder(w).Encode(listing)
+}
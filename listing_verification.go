@@ -0,0 +1,355 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Verification is how buyers tell a listing whose ownership was checked from a possible scam. The
+// agent uploads the ownership documents, such as the title deed, to the listing's property with
+// POST /properties/{id}/documents and asks for a review with POST /listings/{id}/request-verification;
+// an admin approves or rejects the request. A rejected listing can be submitted again, and a
+// verified one can still be rejected when it turns out to be fake. Only the verified badge is
+// public, the documents and the reasons are for the agent and the admins.
+const (
+	verificationUnverified = "unverified"
+	verificationPending    = "pending_review"
+	verificationVerified   = "verified"
+	verificationRejected   = "rejected"
+
+	maxVerificationDocuments    = 10
+	maxVerificationReasonLength = 500 // characters
+)
+
+var verificationStates = []string{verificationUnverified, verificationPending, verificationVerified, verificationRejected}
+
+// verificationTransitions are the states each state can be reached from
+var verificationTransitions = map[string][]string{
+	verificationPending:  {verificationUnverified, verificationRejected},
+	verificationVerified: {verificationPending},
+	verificationRejected: {verificationPending, verificationVerified},
+}
+
+// listingVerification is Listing.Verification, served by GET /listings/{id}/verification
+type listingVerification struct {
+	State       string     `bson:"state" json:"state"`
+	Documents   []Document `bson:"documents,omitempty" json:"documents,omitempty"` // copied from the property when requested
+	RequestedAt *time.Time `bson:"requested_at,omitempty" json:"requested_at,omitempty"`
+	RequestedBy string     `bson:"requested_by,omitempty" json:"requested_by,omitempty"`
+	DecidedAt   *time.Time `bson:"decided_at,omitempty" json:"decided_at,omitempty"`
+	DecidedBy   string     `bson:"decided_by,omitempty" json:"decided_by,omitempty"`
+	Reason      string     `bson:"reason,omitempty" json:"reason,omitempty"` // why it was rejected
+}
+
+// verificationState treats listings that never asked for verification as unverified
+func verificationState(listing *Listing) string {
+	if listing.Verification == nil || listing.Verification.State == "" {
+		return verificationUnverified
+	}
+	return listing.Verification.State
+}
+
+// canTransitionVerification reports whether a listing in state from may move to state to
+func canTransitionVerification(from, to string) bool {
+	return isOneOf(from, verificationTransitions[to])
+}
+
+// verificationStateFilter matches the listings in one of states; unverified also matches listings
+// without a verification
+func verificationStateFilter(states []string) bson.M {
+	in := bson.A{}
+	for _, s := range states {
+		in = append(in, s)
+		if s == verificationUnverified {
+			in = append(in, nil)
+		}
+	}
+	return bson.M{"$in": in}
+}
+
+// authorizeListingAgent lets in the listing's agent with their token from POST /agents/{id}/token
+// as an Authorization: Bearer header, and everyone else with the API key
+func authorizeListingAgent(w http.ResponseWriter, r *http.Request, listing *Listing) bool {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		if !hasAPIKey(r) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return false
+		}
+		return true
+	}
+	agentID, err := verifyAgentToken(strings.TrimPrefix(auth, "Bearer "))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return false
+	}
+	if agentID != listing.AgentID {
+		http.Error(w, "The agent token is for another agent than the listing's", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// findVerificationListing answers 400, 404 or 500 and returns false when the listing {id} isn't there
+func findVerificationListing(w http.ResponseWriter, r *http.Request, ctx context.Context) (*Listing, bool) {
+	id, ok := pathObjectID(w, r, "Listing")
+	if !ok {
+		return nil, false
+	}
+	var listing Listing
+	err := client.Database("MVDB").Collection("listings").FindOne(ctx, notDeleted(bson.M{"_id": id})).Decode(&listing)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Listing not found", http.StatusNotFound)
+		return nil, false
+	}
+	if err != nil {
+		serverError(w, r, "Failed to retrieve Listing", err)
+		return nil, false
+	}
+	return &listing, true
+}
+
+// transitionVerification moves the listing to state to with verification, answering 409 when its
+// current state doesn't allow it. The filter pins the state it was read in, so of two concurrent
+// decisions only one is applied and audited.
+func transitionVerification(w http.ResponseWriter, r *http.Request, ctx context.Context, listing *Listing, to string, verification listingVerification) bool {
+	from := verificationState(listing)
+	if !canTransitionVerification(from, to) {
+		http.Error(w, fmt.Sprintf("A listing that is %s can't become %s", from, to), http.StatusConflict)
+		return false
+	}
+	verification.State = to
+	now := time.Now()
+	res, err := client.Database("MVDB").Collection("listings").UpdateOne(ctx,
+		notDeleted(bson.M{"_id": listing.ID, "verification.state": verificationStateFilter([]string{from})}),
+		bson.M{"$set": bson.M{"verification": verification, "verified": to == verificationVerified, "updated_at": now}})
+	if err != nil {
+		serverError(w, r, "Failed to update Listing verification", err)
+		return false
+	}
+	if res.MatchedCount == 0 {
+		http.Error(w, "The listing's verification changed concurrently, retry", http.StatusConflict)
+		return false
+	}
+
+	before := *listing
+	listing.Verification = &verification
+	listing.Verified = to == verificationVerified
+	listing.UpdatedAt = now
+	recordAudit(auditFromRequest(r), "verification", "listings", listing.ID.Hex(), before, *listing,
+		bson.M{"from": from, "to": to, "reason": verification.Reason})
+	return true
+}
+
+// requestListingVerification answers POST /listings/{id}/request-verification with
+// {"documents": ["<public_id>", ...]}, the ownership documents among those of the listing's
+// property. The listing's agent may use their token instead of the API key.
+func requestListingVerification(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var body struct {
+		Documents []string `json:"documents"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Failed to parse request body", http.StatusBadRequest)
+		return
+	}
+	if len(body.Documents) == 0 || len(body.Documents) > maxVerificationDocuments {
+		http.Error(w, fmt.Sprintf("documents must name 1 to %d documents of the listing's property", maxVerificationDocuments), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	listing, ok := findVerificationListing(w, r, ctx)
+	if !ok || !authorizeListingAgent(w, r, listing) {
+		return
+	}
+	var property Property
+	propertyID, _ := primitive.ObjectIDFromHex(listing.PropertyID)
+	err := client.Database("MVDB").Collection("properties").FindOne(ctx, notDeleted(bson.M{"_id": propertyID}),
+		options.FindOne().SetProjection(bson.M{"documents": 1})).Decode(&property)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "The listing's property was not found", http.StatusUnprocessableEntity)
+		return
+	}
+	if err != nil {
+		serverError(w, r, "Failed to retrieve Property", err)
+		return
+	}
+	byPublicID := map[string]Document{}
+	for _, d := range property.Documents {
+		byPublicID[d.PublicID] = d
+	}
+	var documents []Document
+	var unknown []string
+	for _, publicID := range body.Documents {
+		d, ok := byPublicID[publicID]
+		if !ok {
+			unknown = append(unknown, publicID)
+			continue
+		}
+		documents = append(documents, d)
+	}
+	if len(unknown) > 0 {
+		http.Error(w, "Not documents of the listing's property, upload them with POST /properties/{id}/documents first: "+strings.Join(unknown, ", "), http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	if !transitionVerification(w, r, ctx, listing, verificationPending, listingVerification{
+		Documents:   documents,
+		RequestedAt: &now,
+		RequestedBy: auditFromRequest(r).Actor,
+	}) {
+		return
+	}
+	json.NewEncoder(w).Encode(listing.Verification)
+}
+
+// getListingVerification answers GET /listings/{id}/verification for the listing's agent and admins
+func getListingVerification(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	listing, ok := findVerificationListing(w, r, ctx)
+	if !ok || !authorizeListingAgent(w, r, listing) {
+		return
+	}
+	verification := listingVerification{State: verificationUnverified}
+	if listing.Verification != nil {
+		verification = *listing.Verification
+		verification.State = verificationState(listing)
+	}
+	json.NewEncoder(w).Encode(verification)
+}
+
+// approveListingVerification answers POST /admin/listings/{id}/verification/approve
+func approveListingVerification(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	listing, ok := findVerificationListing(w, r, ctx)
+	if !ok {
+		return
+	}
+	verification := listingVerification{}
+	if listing.Verification != nil {
+		verification = *listing.Verification
+	}
+	now := time.Now()
+	verification.DecidedAt, verification.DecidedBy, verification.Reason = &now, auditFromRequest(r).Actor, ""
+	if !transitionVerification(w, r, ctx, listing, verificationVerified, verification) {
+		return
+	}
+	json.NewEncoder(w).Encode(listing.Verification)
+}
+
+// rejectListingVerification answers POST /admin/listings/{id}/verification/reject with
+// {"reason": "..."}; the listing's agent is notified with the reason
+func rejectListingVerification(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var body struct {
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Failed to parse request body", http.StatusBadRequest)
+		return
+	}
+	body.Reason = strings.TrimSpace(body.Reason)
+	if body.Reason == "" || utf8.RuneCountInString(body.Reason) > maxVerificationReasonLength {
+		http.Error(w, "reason is required and must be at most 500 characters", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	listing, ok := findVerificationListing(w, r, ctx)
+	if !ok {
+		return
+	}
+	verification := listingVerification{}
+	if listing.Verification != nil {
+		verification = *listing.Verification
+	}
+	now := time.Now()
+	verification.DecidedAt, verification.DecidedBy, verification.Reason = &now, auditFromRequest(r).Actor, body.Reason
+	if !transitionVerification(w, r, ctx, listing, verificationRejected, verification) {
+		return
+	}
+	go notifyVerificationRejected(*listing)
+	json.NewEncoder(w).Encode(listing.Verification)
+}
+
+// notifyVerificationRejected tells the listing's agent why, in the notifications they read with
+// their agent id and on their socket
+func notifyVerificationRejected(listing Listing) {
+	if listing.AgentID == "" {
+		return
+	}
+	payload := map[string]interface{}{
+		"listing_id": listing.ID.Hex(),
+		"slug":       listing.Slug,
+		"reason":     listing.Verification.Reason,
+	}
+	createNotification(listing.AgentID, notificationVerificationRejected, payload)
+	publishAgentEvent(listing.AgentID, agentEventVerificationRejected, payload)
+}
+
+// getVerificationQueue answers GET /admin/listings/verification-queue: the listings in ?state=
+// (pending_review by default), those waiting longest first
+func getVerificationQueue(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	state := r.URL.Query().Get("state")
+	if state == "" {
+		state = verificationPending
+	}
+	if !isOneOf(state, verificationStates) {
+		http.Error(w, "state must be one of "+strings.Join(verificationStates, ", "), http.StatusBadRequest)
+		return
+	}
+	page, ok := parseListPage(w, r)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	opts := options.Find().SetSort(bson.D{{Key: "verification.requested_at", Value: 1}, {Key: "_id", Value: 1}})
+	if page.Limit > 0 {
+		opts.SetSkip(page.Skip).SetLimit(page.Limit)
+	}
+	listings, err := findAllWith[Listing](ctx, "listings", notDeleted(bson.M{"verification.state": verificationStateFilter([]string{state})}), opts)
+	if err != nil {
+		serverError(w, r, "Failed to retrieve Listings", err)
+		return
+	}
+	type queued struct {
+		Listing      Listing              `json:"listing"`
+		Verification *listingVerification `json:"verification"`
+	}
+	out := make([]queued, len(listings))
+	for i := range listings {
+		out[i] = queued{Listing: listings[i], Verification: listings[i].Verification}
+	}
+	json.NewEncoder(w).Encode(out)
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/LynnT-2003/mv-realty-backend/imagemeta"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// listingImportColumns is the documented header row for POST /admin/listings/import.
+// Columns may appear in any order. The optional columns are listing_status (default "active"), currency
+// (default THB), tags (comma separated within the cell) and available_from (RFC3339 or YYYY-MM-DD).
+var listingImportColumns = []string{
+	"property_id", "description", "price", "minimum_contract", "floor", "size",
+	"bedroom", "bathroom", "furniture", "status", "listing_type", "facing_direction", "listing_status", "currency", "tags", "available_from",
+}
+
+var optionalImportColumns = []string{"listing_status", "currency", "tags", "available_from"}
+
+const listingImportBatchSize = 100
+
+type importRowError struct {
+	Line   int      `json:"line"`
+	Errors []string `json:"errors"`
+}
+
+type importRow struct {
+	line    int
+	listing Listing
+}
+
+type listingImportResult struct {
+	DryRun   bool             `json:"dry_run"`
+	Rows     int              `json:"rows"`
+	Valid    int              `json:"valid"`
+	Inserted int              `json:"inserted"`
+	Skipped  int              `json:"skipped"`
+	Errors   []importRowError `json:"errors"`
+}
+
+// importListings handles a multipart CSV upload (form field "file").
+// Invalid rows are skipped and reported; valid rows are inserted in unordered batches,
+// so one failing row never aborts rows that were already validated.
+func importListings(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	dryRun := r.URL.Query().Get("dry_run") == "true"
+
+	err := r.ParseMultipartForm(10 << 20) // Max file size: 10 MB
+	if err != nil {
+		http.Error(w, "Unable to parse form data", http.StatusBadRequest)
+		return
+	}
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "Unable to get the file from form data", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	rows, rowErrors, err := parseListingCSV(file)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+
+	// Check every referenced property with a single query
+	missing, err := missingPropertyIDs(ctx, rows)
+	if err != nil {
+		serverError(w, r, "Failed to check PropertyID", err)
+		return
+	}
+	var valid []importRow
+	for _, row := range rows {
+		if missing[row.listing.PropertyID] {
+			rowErrors = append(rowErrors, importRowError{Line: row.line, Errors: []string{"property_id does not exist"}})
+			continue
+		}
+		valid = append(valid, row)
+	}
+	sortRowErrors(rowErrors)
+
+	result := listingImportResult{
+		DryRun: dryRun,
+		Rows:   len(valid) + len(rowErrors),
+		Valid:  len(valid),
+		Errors: rowErrors,
+	}
+	if result.Errors == nil {
+		result.Errors = []importRowError{}
+	}
+
+	if dryRun {
+		result.Skipped = len(rowErrors)
+		if len(rowErrors) > 0 {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+		}
+		json.NewEncoder(w).Encode(result)
+		return
+	}
+
+	propertyIDs := make([]string, len(valid))
+	for i := range valid {
+		propertyIDs[i] = valid[i].listing.PropertyID
+	}
+	slugs, err := propertySlugsByID(ctx, propertyIDs)
+	if err != nil {
+		serverError(w, r, "Failed to check PropertyID", err)
+		return
+	}
+	for i := range valid {
+		valid[i].listing.ID = primitive.NewObjectID()
+		valid[i].listing.Slug = listingSlug(slugs[valid[i].listing.PropertyID], &valid[i].listing)
+	}
+
+	collection := client.Database("MVDB").Collection("listings")
+	for start := 0; start < len(valid); start += listingImportBatchSize {
+		end := start + listingImportBatchSize
+		if end > len(valid) {
+			end = len(valid)
+		}
+		batch := valid[start:end]
+
+		docs := make([]interface{}, len(batch))
+		for i := range batch {
+			docs[i] = batch[i].listing
+		}
+		_, err := collection.InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
+		if err == nil {
+			result.Inserted += len(batch)
+			continue
+		}
+		// Report the rows Mongo rejected; the rest of the batch is still inserted
+		var bulkErr mongo.BulkWriteException
+		if errors.As(err, &bulkErr) {
+			result.Inserted += len(batch) - len(bulkErr.WriteErrors)
+			for _, we := range bulkErr.WriteErrors {
+				result.Errors = append(result.Errors, importRowError{Line: batch[we.Index].line, Errors: []string{"insert failed: " + we.Message}})
+			}
+			continue
+		}
+		for _, row := range batch {
+			result.Errors = append(result.Errors, importRowError{Line: row.line, Errors: []string{"insert failed"}})
+		}
+	}
+	result.Skipped = result.Rows - result.Inserted
+	sortRowErrors(result.Errors)
+	// One entry for the whole file rather than one per row
+	recordAudit(auditFromRequest(r), "import", "listings", "", nil, nil, bson.M{"rows": result.Rows, "inserted": result.Inserted, "skipped": result.Skipped})
+
+	json.NewEncoder(w).Encode(result)
+}
+
+// parseListingCSV reads the header and every row. Structural problems with the file are returned as err,
+// problems with individual rows are collected per line.
+func parseListingCSV(src io.Reader) ([]importRow, []importRowError, error) {
+	reader := csv.NewReader(src)
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, nil, errors.New("CSV file is empty or unreadable")
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		if !isOneOf(name, listingImportColumns) {
+			return nil, nil, fmt.Errorf("Unknown CSV column %q", name)
+		}
+		columns[name] = i
+	}
+	for _, name := range listingImportColumns {
+		if _, ok := columns[name]; !ok && !isOneOf(name, optionalImportColumns) {
+			return nil, nil, fmt.Errorf("Missing CSV column %q", name)
+		}
+	}
+
+	var rows []importRow
+	var rowErrors []importRowError
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			var parseErr *csv.ParseError
+			if !errors.As(err, &parseErr) {
+				return nil, nil, errors.New("Failed to read CSV file")
+			}
+			rowErrors = append(rowErrors, importRowError{Line: parseErr.Line, Errors: []string{parseErr.Err.Error()}})
+			continue
+		}
+		line, _ := reader.FieldPos(0)
+
+		listing, problems := listingFromCSV(record, columns)
+		if len(problems) > 0 {
+			rowErrors = append(rowErrors, importRowError{Line: line, Errors: problems})
+			continue
+		}
+		rows = append(rows, importRow{line: line, listing: listing})
+	}
+	return rows, rowErrors, nil
+}
+
+func listingFromCSV(record []string, columns map[string]int) (Listing, []string) {
+	var problems []string
+	get := func(name string) string {
+		i, ok := columns[name]
+		if !ok || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+	parseFloat := func(name string) float64 {
+		v, err := strconv.ParseFloat(get(name), 64)
+		if err != nil {
+			problems = append(problems, name+" must be numeric")
+		}
+		return v
+	}
+	parseInt := func(name string) int {
+		v, err := strconv.Atoi(get(name))
+		if err != nil {
+			problems = append(problems, name+" must be a whole number")
+		}
+		return v
+	}
+
+	listing := Listing{
+		PropertyID:      get("property_id"),
+		Description:     get("description"),
+		Price:           parseFloat("price"),
+		MinimumContract: get("minimum_contract"),
+		Floor:           parseInt("floor"),
+		Size:            parseFloat("size"),
+		Bedroom:         parseInt("bedroom"),
+		Bathroom:        parseInt("bathroom"),
+		Furniture:       get("furniture"),
+		Status:          get("status"),
+		ListingType:     get("listing_type"),
+		FacingDirection: get("facing_direction"),
+		ListingStatus:   get("listing_status"),
+		Currency:        strings.ToUpper(get("currency")),
+		CreatedAt:       time.Now(),
+		Photos:          []imagemeta.Image{},
+		Publication:     publicationPublished,
+		Tags:            normalizeTags(strings.Split(get("tags"), ",")),
+	}
+	listing.UpdatedAt = listing.CreatedAt
+	defaultExpiry(&listing)
+	if raw := get("available_from"); raw != "" {
+		if v, err := parseDateOrTime(raw); err != nil {
+			problems = append(problems, "available_from must be RFC3339 or YYYY-MM-DD")
+		} else {
+			listing.AvailableFrom = &v
+		}
+	}
+	if listing.ListingStatus == "" {
+		listing.ListingStatus = "active"
+	}
+	if listing.Currency == "" {
+		listing.Currency = defaultCurrency
+	}
+	if _, err := primitive.ObjectIDFromHex(listing.PropertyID); err != nil {
+		problems = append(problems, "property_id is not a valid id")
+	}
+	problems = append(problems, validateListingFields(&listing)...)
+	return listing, problems
+}
+
+// missingPropertyIDs returns the set of referenced property ids that don't exist
+func missingPropertyIDs(ctx context.Context, rows []importRow) (map[string]bool, error) {
+	missing := map[string]bool{}
+	var ids []primitive.ObjectID
+	for _, row := range rows {
+		if _, seen := missing[row.listing.PropertyID]; seen {
+			continue
+		}
+		id, _ := primitive.ObjectIDFromHex(row.listing.PropertyID)
+		ids = append(ids, id)
+		missing[row.listing.PropertyID] = true
+	}
+	if len(ids) == 0 {
+		return missing, nil
+	}
+
+	cur, err := client.Database("MVDB").Collection("properties").Find(ctx,
+		notDeleted(bson.M{"_id": bson.M{"$in": ids}}),
+		options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	for cur.Next(ctx) {
+		var doc struct {
+			ID primitive.ObjectID `bson:"_id"`
+		}
+		if err := cur.Decode(&doc); err != nil {
+			return nil, err
+		}
+		missing[doc.ID.Hex()] = false
+	}
+	return missing, cur.Err()
+}
+
+func sortRowErrors(rowErrors []importRowError) {
+	sort.SliceStable(rowErrors, func(i, j int) bool { return rowErrors[i].Line < rowErrors[j].Line })
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Failed logins are counted per email and per IP in login_attempts. After loginDelayAfter failures
+// every attempt is slowed down, after loginLockAfter the email or IP is locked for loginLockDuration.
+// A counter is forgotten loginAttemptWindow after its last failure (TTL index on expires_at).
+//
+// Until POST /auth/login exists, throttleCredentials applies this to the credentials the API takes,
+// API keys and Bearer tokens, counted per IP. The login handler is expected to call throttleLogin
+// before checking the credentials, recordLoginFailure or clearLoginFailures after, and to finish both
+// the unknown email and the wrong password paths through padLoginResponse.
+const (
+	loginDelayAfter    = 3
+	loginLockAfter     = 10
+	loginLockDuration  = 15 * time.Minute
+	loginAttemptWindow = time.Hour
+	loginStepDelay     = 500 * time.Millisecond // added per failure past loginDelayAfter
+	loginMaxDelay      = 5 * time.Second
+	loginMinDuration   = 300 * time.Millisecond // every login answer takes at least this long
+
+	// loginAttemptsCacheTTL is how long an instance trusts its copy of a counter, so credentialed
+	// requests don't each read login_attempts; failures seen by other instances count after at most this
+	loginAttemptsCacheTTL  = 10 * time.Second
+	maxCachedLoginAttempts = 10000
+)
+
+// sleepLogin is the progressive delay's sleep, replaced by the tests
+var sleepLogin = time.Sleep
+
+// loginAttempts is the counter of one email or IP; the _id is "email:<address>" or "ip:<address>"
+type loginAttempts struct {
+	Key         string     `bson:"_id"`
+	Failures    int        `bson:"failures"`
+	LockedUntil *time.Time `bson:"locked_until,omitempty"`
+	ExpiresAt   time.Time  `bson:"expires_at"`
+}
+
+// loginAttemptKeys are the counters of a login; an empty email, as with API keys, only counts the IP
+func loginAttemptKeys(email, ip string) []string {
+	keys := []string{"ip:" + ip}
+	if email = strings.ToLower(strings.TrimSpace(email)); email != "" {
+		keys = append(keys, "email:"+email)
+	}
+	return keys
+}
+
+var loginAttemptsCache = struct {
+	sync.Mutex
+	entries map[string]cachedLoginAttempts
+}{entries: map[string]cachedLoginAttempts{}}
+
+type cachedLoginAttempts struct {
+	attempts  loginAttempts // zero when there is no counter
+	expiresAt time.Time
+}
+
+func cacheLoginAttempts(a loginAttempts) {
+	loginAttemptsCache.Lock()
+	defer loginAttemptsCache.Unlock()
+	if len(loginAttemptsCache.entries) >= maxCachedLoginAttempts {
+		loginAttemptsCache.entries = map[string]cachedLoginAttempts{}
+	}
+	loginAttemptsCache.entries[a.Key] = cachedLoginAttempts{attempts: a, expiresAt: time.Now().Add(loginAttemptsCacheTTL)}
+}
+
+// findLoginAttempts returns the counters of keys, from loginAttemptsCache when it has them
+func findLoginAttempts(ctx context.Context, keys []string) ([]loginAttempts, error) {
+	var found []loginAttempts
+	var missing []string
+	now := time.Now()
+	loginAttemptsCache.Lock()
+	for _, key := range keys {
+		if cached, ok := loginAttemptsCache.entries[key]; ok && now.Before(cached.expiresAt) {
+			found = append(found, cached.attempts)
+		} else {
+			missing = append(missing, key)
+		}
+	}
+	loginAttemptsCache.Unlock()
+	if len(missing) == 0 {
+		return found, nil
+	}
+
+	stored, err := findAll[loginAttempts](ctx, "login_attempts", bson.M{"_id": bson.M{"$in": missing}})
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range missing {
+		a := loginAttempts{Key: key}
+		for _, s := range stored {
+			if s.Key == key {
+				a = s
+			}
+		}
+		cacheLoginAttempts(a)
+		found = append(found, a)
+	}
+	return found, nil
+}
+
+// throttleLogin answers 429 with Retry-After and returns false while the email or the caller's IP
+// is locked. Otherwise it sleeps the progressive delay earned by earlier failures and returns true.
+func throttleLogin(w http.ResponseWriter, r *http.Request, email string) bool {
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	attempts, err := findLoginAttempts(ctx, loginAttemptKeys(email, clientIP(r)))
+	if err != nil {
+		serverError(w, r, "Failed to check login attempts", err)
+		return false
+	}
+	now := time.Now()
+	failures := 0
+	var lockedUntil time.Time
+	for _, a := range attempts {
+		if a.LockedUntil != nil && a.LockedUntil.After(lockedUntil) {
+			lockedUntil = *a.LockedUntil
+		}
+		if a.Failures > failures {
+			failures = a.Failures
+		}
+	}
+	if lockedUntil.After(now) {
+		retry := int(lockedUntil.Sub(now).Seconds()) + 1
+		w.Header().Set("Retry-After", strconv.Itoa(retry))
+		http.Error(w, "Too many failed logins, try again later", http.StatusTooManyRequests)
+		return false
+	}
+	sleepLogin(loginDelay(failures))
+	return true
+}
+
+// throttleCredentials puts requests carrying an X-API-Key or a Bearer token through throttleLogin,
+// and counts a 401 answered to them as a failed login of the IP. Anonymous requests pass untouched.
+func throttleCredentials(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-API-Key") == "" && !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !throttleLogin(w, r, "") {
+			return
+		}
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		if rec.status != http.StatusUnauthorized {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), 5*time.Second)
+		defer cancel()
+		if err := recordLoginFailure(ctx, "", clientIP(r)); err != nil {
+			log.Println("Failed to count a failed login of", clientIP(r), ":", err)
+		}
+	})
+}
+
+// statusRecorder passes the response through and remembers its status
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (s *statusRecorder) Unwrap() http.ResponseWriter { return s.ResponseWriter }
+
+// Hijack hands the connection to the WebSocket upgrade of GET /ws, which agents open with a Bearer token
+func (s *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(s.ResponseWriter).Hijack()
+}
+
+// loginDelay is 0 up to loginDelayAfter failures, then grows by loginStepDelay per failure
+func loginDelay(failures int) time.Duration {
+	if failures < loginDelayAfter {
+		return 0
+	}
+	d := time.Duration(failures-loginDelayAfter+1) * loginStepDelay
+	if d > loginMaxDelay {
+		d = loginMaxDelay
+	}
+	return d
+}
+
+// recordLoginFailure counts a failed login against the email and the IP, locking either one that
+// reaches loginLockAfter
+func recordLoginFailure(ctx context.Context, email, ip string) error {
+	collection := client.Database("MVDB").Collection("login_attempts")
+	now := time.Now()
+	for _, key := range loginAttemptKeys(email, ip) {
+		var a loginAttempts
+		err := collection.FindOneAndUpdate(ctx, bson.M{"_id": key},
+			bson.M{"$inc": bson.M{"failures": 1}, "$set": bson.M{"expires_at": now.Add(loginAttemptWindow)}},
+			options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)).Decode(&a)
+		if err != nil {
+			return err
+		}
+		if a.Failures >= loginLockAfter {
+			// The counter restarts once the lock is over, so the next failure doesn't lock straight away
+			lockedUntil := now.Add(loginLockDuration)
+			a = loginAttempts{Key: key, LockedUntil: &lockedUntil, ExpiresAt: lockedUntil.Add(loginAttemptWindow)}
+			if _, err := collection.UpdateOne(ctx, bson.M{"_id": key}, bson.M{"$set": bson.M{
+				"failures":     0,
+				"locked_until": lockedUntil,
+				"expires_at":   a.ExpiresAt,
+			}}); err != nil {
+				return err
+			}
+		}
+		cacheLoginAttempts(a)
+	}
+	return nil
+}
+
+// clearLoginFailures forgets the counters after a successful login
+func clearLoginFailures(ctx context.Context, email, ip string) error {
+	keys := loginAttemptKeys(email, ip)
+	if _, err := client.Database("MVDB").Collection("login_attempts").DeleteMany(ctx, bson.M{"_id": bson.M{"$in": keys}}); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		cacheLoginAttempts(loginAttempts{Key: key})
+	}
+	return nil
+}
+
+// padLoginResponse sleeps until loginMinDuration has passed since start, so an unknown email, which
+// skips the password hash, answers as slowly as a wrong password
+func padLoginResponse(start time.Time) {
+	if d := loginMinDuration - time.Since(start); d > 0 {
+		time.Sleep(d)
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func useTrustedProxies(t *testing.T, raw string) {
+	t.Helper()
+	prev := trustedProxies
+	trustedProxies = parseTrustedProxies(raw)
+	t.Cleanup(func() { trustedProxies = prev })
+}
+
+func TestClientIP(t *testing.T) {
+	useTrustedProxies(t, "10.0.0.0/8, 203.0.113.7, not-an-ip")
+	tests := []struct {
+		name, remote, forwarded, want string
+	}{
+		{"direct", "198.51.100.4:5000", "", "198.51.100.4"},
+		{"spoofed without a proxy", "198.51.100.4:5000", "1.2.3.4", "198.51.100.4"},
+		{"behind the proxy", "10.1.2.3:5000", "198.51.100.4", "198.51.100.4"},
+		{"spoofed behind the proxy", "10.1.2.3:5000", "1.2.3.4, 198.51.100.4", "198.51.100.4"},
+		{"two proxies", "203.0.113.7:443", "198.51.100.4, 10.9.9.9", "198.51.100.4"},
+		{"garbage behind the proxy", "10.1.2.3:5000", "198.51.100.4, junk", "10.1.2.3"},
+		{"proxy without the header", "10.1.2.3:5000", "", "10.1.2.3"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = tt.remote
+		if tt.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", tt.forwarded)
+		}
+		if got := clientIP(r); got != tt.want {
+			t.Errorf("%s: clientIP %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLoginDelay(t *testing.T) {
+	for failures, want := range map[int]time.Duration{
+		0:                   0,
+		loginDelayAfter - 1: 0,
+		loginDelayAfter:     loginStepDelay,
+		loginDelayAfter + 2: 3 * loginStepDelay,
+		100:                 loginMaxDelay,
+	} {
+		if got := loginDelay(failures); got != want {
+			t.Errorf("%d failures: delay %s, want %s", failures, got, want)
+		}
+	}
+}
+
+// recordSleeps replaces the progressive delay with a record of it
+func recordSleeps(t *testing.T) *[]time.Duration {
+	t.Helper()
+	var sleeps []time.Duration
+	prev := sleepLogin
+	sleepLogin = func(d time.Duration) { sleeps = append(sleeps, d) }
+	t.Cleanup(func() { sleepLogin = prev })
+	return &sleeps
+}
+
+// unauthorizedHandler turns every credential away, like requireAPIKey with a wrong key
+var unauthorizedHandler = throttleCredentials(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	jsonError(w, http.StatusUnauthorized, "unauthorized", "Invalid or missing API key")
+}))
+
+func sendKey(handler http.Handler, key, forwardedFor string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "/users", nil)
+	if key != "" {
+		r.Header.Set("X-API-Key", key)
+	}
+	if forwardedFor != "" {
+		r.Header.Set("X-Forwarded-For", forwardedFor)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, r)
+	return rec
+}
+
+func TestThrottleCredentialsLock(t *testing.T) {
+	recordSleeps(t)
+	useTrustedProxies(t, "")
+	lockedUntil := time.Now().Add(time.Minute)
+	cacheTestLoginAttempts(t, loginAttempts{Key: "ip:" + testClientIP, LockedUntil: &lockedUntil})
+
+	rec := sendKey(unauthorizedHandler, "guess", "")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("locked IP: status %d, want 429", rec.Code)
+	}
+	if retry, _ := strconv.Atoi(rec.Header().Get("Retry-After")); retry < 55 || retry > 61 {
+		t.Errorf("Retry-After %q, want about 60", rec.Header().Get("Retry-After"))
+	}
+	if rec := sendKey(unauthorizedHandler, "guess", "198.51.100.99"); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("locked IP with a made up X-Forwarded-For: status %d, want 429", rec.Code)
+	}
+	if rec := sendKey(unauthorizedHandler, "", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("anonymous request from a locked IP: status %d, want it to reach the handler", rec.Code)
+	}
+
+	expired := time.Now().Add(-time.Second)
+	cacheTestLoginAttempts(t, loginAttempts{Key: "ip:" + testClientIP, LockedUntil: &expired, Failures: loginDelayAfter})
+	passed := false
+	handler := throttleCredentials(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { passed = true }))
+	if rec := sendKey(handler, "partner-key", ""); !passed || rec.Code != http.StatusOK {
+		t.Errorf("once the lock expired: status %d, handler reached %v", rec.Code, passed)
+	}
+}
+
+func TestThrottleCredentialsDelay(t *testing.T) {
+	sleeps := recordSleeps(t)
+	cacheTestLoginAttempts(t, loginAttempts{Key: "ip:" + testClientIP, Failures: loginDelayAfter + 1})
+	handler := throttleCredentials(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	sendKey(handler, "partner-key", "")
+	if len(*sleeps) != 1 || (*sleeps)[0] != loginDelay(loginDelayAfter+1) {
+		t.Errorf("slept %v after %d failures, want %s", *sleeps, loginDelayAfter+1, loginDelay(loginDelayAfter+1))
+	}
+}
+
+// clearLoginAttemptsCache makes the throttle read login_attempts again
+func clearLoginAttemptsCache() {
+	loginAttemptsCache.Lock()
+	loginAttemptsCache.entries = map[string]cachedLoginAttempts{}
+	loginAttemptsCache.Unlock()
+}
+
+// TestLoginAttackLoop guesses keys from one IP until the lock engages, then lets it expire
+func TestLoginAttackLoop(t *testing.T) {
+	useTestMongo(t, "login_attempts")
+	clearLoginAttemptsCache()
+	t.Cleanup(clearLoginAttemptsCache)
+	sleeps := recordSleeps(t)
+
+	for i := 1; i <= loginLockAfter; i++ {
+		if rec := sendKey(unauthorizedHandler, "guess-"+strconv.Itoa(i), ""); rec.Code != http.StatusUnauthorized {
+			t.Fatalf("guess %d: status %d, want 401", i, rec.Code)
+		}
+		if want := loginDelay(i - 1); (*sleeps)[i-1] != want {
+			t.Errorf("guess %d: delayed %s, want %s", i, (*sleeps)[i-1], want)
+		}
+	}
+	rec := sendKey(unauthorizedHandler, "guess-locked", "")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("after %d failures: status %d, want 429", loginLockAfter, rec.Code)
+	}
+	if retry, _ := strconv.Atoi(rec.Header().Get("Retry-After")); retry < int(loginLockDuration.Seconds())-5 {
+		t.Errorf("Retry-After %q, want about %s", rec.Header().Get("Retry-After"), loginLockDuration)
+	}
+	clearLoginAttemptsCache() // another instance sees the lock too
+	if rec := sendKey(unauthorizedHandler, "guess-locked", ""); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("locked IP on a fresh instance: status %d, want 429", rec.Code)
+	}
+
+	// loginLockDuration later
+	ctx := context.Background()
+	if _, err := client.Database("MVDB").Collection("login_attempts").UpdateByID(ctx, "ip:"+testClientIP,
+		bson.M{"$set": bson.M{"locked_until": time.Now().Add(-time.Second)}}); err != nil {
+		t.Fatal(err)
+	}
+	clearLoginAttemptsCache()
+	if rec := sendKey(unauthorizedHandler, "guess-after", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("once the lock expired: status %d, want 401", rec.Code)
+	}
+	if err := clearLoginFailures(ctx, "", testClientIP); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := client.Database("MVDB").Collection("login_attempts").CountDocuments(ctx, bson.M{}); err != nil || n != 0 {
+		t.Errorf("%d counters left after a successful login (%v)", n, err)
+	}
+}
+
+// TestThrottleCredentialsHijack: a WebSocket opened with a Bearer token upgrades through the throttle
+func TestThrottleCredentialsHijack(t *testing.T) {
+	cacheTestLoginAttempts(t, loginAttempts{Key: "ip:127.0.0.1"})
+	srv := httptest.NewServer(throttleCredentials(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.WriteMessage(websocket.TextMessage, []byte("hello"))
+	})))
+	defer srv.Close()
+
+	conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), http.Header{"Authorization": {"Bearer abc.def.ghi"}})
+	if err != nil {
+		t.Fatalf("dial: %v (%v)", err, resp)
+	}
+	defer conn.Close()
+	if _, msg, err := conn.ReadMessage(); err != nil || string(msg) != "hello" {
+		t.Errorf("read %q %v", msg, err)
+	}
+}
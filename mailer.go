@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+)
+
+// Mailer sends an HTML email
+type Mailer interface {
+	Send(ctx context.Context, to, subject, html string) error
+}
+
+// logMailer only logs, it is used when SMTP isn't configured
+type logMailer struct{}
+
+func (logMailer) Send(_ context.Context, to, subject, _ string) error {
+	log.Println("SMTP not configured, not sending", fmt.Sprintf("%q", subject), "to", to)
+	return nil
+}
+
+var mailer Mailer = logMailer{}
+
+// smtpMailer sends through SMTP_HOST:SMTP_PORT with PLAIN auth when SMTP_USERNAME is set
+type smtpMailer struct {
+	addr string
+	auth smtp.Auth
+	from string
+}
+
+// setupMailer enables SMTP when SMTP_HOST and MAIL_FROM are set
+func setupMailer() {
+	host, from := os.Getenv("SMTP_HOST"), os.Getenv("MAIL_FROM")
+	if host == "" || from == "" {
+		log.Println("SMTP_HOST or MAIL_FROM not set, emails are only logged")
+		return
+	}
+	port := os.Getenv("SMTP_PORT")
+	if port == "" {
+		port = "587"
+	}
+	m := &smtpMailer{addr: net.JoinHostPort(host, port), from: from}
+	if user := os.Getenv("SMTP_USERNAME"); user != "" {
+		m.auth = smtp.PlainAuth("", user, os.Getenv("SMTP_PASSWORD"), host)
+	}
+	mailer = m
+}
+
+func (m *smtpMailer) Send(ctx context.Context, to, subject, html string) error {
+	if strings.ContainsAny(to, "\r\n") {
+		return fmt.Errorf("invalid recipient %q", to)
+	}
+	msg := strings.Join([]string{
+		"From: " + m.from,
+		"To: " + to,
+		"Subject: " + mime.QEncoding.Encode("utf-8", subject),
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"MIME-Version: 1.0",
+		"Content-Type: text/html; charset=utf-8",
+		"",
+		html,
+	}, "\r\n")
+	// net/smtp has no context support; run it in the background and give up on the context
+	done := make(chan error, 1)
+	go func() { done <- smtp.SendMail(m.addr, m.auth, m.from, []string{to}, []byte(msg)) }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
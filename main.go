@@ -3,12 +3,15 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
 	"time"
 
+	"github.com/LynnT-2003/mv-realty-backend/imagemeta"
 	"github.com/cloudinary/cloudinary-go/v2"
 	"github.com/cloudinary/cloudinary-go/v2/api/uploader"
 	"github.com/gorilla/handlers"
@@ -24,17 +27,29 @@ type Inquiry struct {
 	User_id     string             `bson:"user_id" json:"user_id"`
 	Property_id string             `bson:"property_id" json:"property_id"`
 	Message     string             `bson:"message" json:"message"`
-	CreatedAt   time.Time          `bson:"Created_at" json:"Created_at"`
+	CreatedAt   time.Time          `bson:"created_at" json:"Created_at"`
+	ListingID   string             `bson:"listing_id,omitempty" json:"listing_id,omitempty"` // optional, routes to the listing's agent
+	AgentID     string             `bson:"assigned_agent_id,omitempty" json:"assigned_agent_id,omitempty"`
+	AssignedAt  *time.Time         `bson:"assigned_at,omitempty" json:"assigned_at,omitempty"`
+	RepliedAt   *time.Time         `bson:"first_reply_at,omitempty" json:"first_reply_at,omitempty"`
+	Source      *inquirySource     `bson:"source,omitempty" json:"source,omitempty"` // campaign attribution, see inquiry_sources.go
 }
 
 type Appointment struct {
 	ID              primitive.ObjectID `bson:"_id,omitempty" json:"appointment_id,omitempty"`
-	UserID          string             `bson:"User_id" json:"User_id"`
-	PropertyID      string             `bson:"Property_id" json:"Property_id"`
-	ListingID       string             `bson:"Listing_id" json:"Listing_id"`
-	AppointmentDate time.Time          `bson:"Appointment_date" json:"Appointment_date"`
-	Status          string             `bson:"Status" json:"Status"` // scheduled, completed, cancelled
-	CreatedAt       time.Time          `bson:"Created_at" json:"Created_at"`
+	UserID          string             `bson:"user_id" json:"User_id"`
+	PropertyID      string             `bson:"property_id" json:"Property_id"`
+	ListingID       string             `bson:"listing_id" json:"Listing_id"`
+	AppointmentDate time.Time          `bson:"appointment_date" json:"Appointment_date"`
+	Status          string             `bson:"status" json:"Status"` // scheduled, confirmed, completed, cancelled
+	CreatedAt       time.Time          `bson:"created_at" json:"Created_at"`
+	// CancellationReason is set when the appointment is cancelled by the system, e.g. listing_removed
+	CancellationReason string `bson:"cancellation_reason,omitempty" json:"cancellation_reason,omitempty"`
+	// UsedLinkTokens are the signatures of the confirm and cancel links already used, see appointment_links.go
+	UsedLinkTokens []string `bson:"used_link_tokens,omitempty" json:"-"`
+	// LocalDate and LocalTime are Appointment_date in the response's time zone, see localizeAppointment
+	LocalDate string `bson:"-" json:"local_date,omitempty"`
+	LocalTime string `bson:"-" json:"local_time,omitempty"`
 }
 
 // User represents the structure of a user document
@@ -44,30 +59,62 @@ type User struct {
 	Email     string             `bson:"email" json:"email"`
 	Phone     string             `bson:"phone" json:"phone"`
 	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+	DeletedAt *time.Time         `bson:"deleted_at,omitempty" json:"deleted_at,omitempty"`
 }
 
 type Property struct {
 	ID          primitive.ObjectID `bson:"_id,omitempty" json:"property_id,omitempty"`
-	Title       string             `bson:"Title" json:"Title"`
-	Developer   string             `bson:"Developer" json:"Developer"`
-	Description string             `bson:"Description" json:"Description"`
-	Coordinates [2]float64         `bson:"Coordinates" json:"Coordinates"`
-	MinPrice    int                `bson:"MinPrice" json:"MinPrice"`
-	MaxPrice    int                `bson:"MaxPrice" json:"MaxPrice"`
-	Facilities  []string           `bson:"Facilities" json:"Facilities"`
-	Images      []string           `bson:"Images" json:"Images"`
-	Built       int                `bson:"Built" json:"Built"`
-	CreatedAt   time.Time          `bson:"Created_at" json:"Created_at"`
+	Title       string             `bson:"title" json:"Title"`
+	Slug        string             `bson:"slug,omitempty" json:"Slug,omitempty"`
+	SlugHistory []string           `bson:"slug_history,omitempty" json:"-"` // former slugs, still resolved by GET /properties/{idOrSlug}
+	Developer   string             `bson:"developer" json:"Developer"`
+	DeveloperID string             `bson:"developer_id,omitempty" json:"DeveloperID,omitempty"` // the Developer record, whose name Developer mirrors
+	Description string             `bson:"description" json:"Description"`
+	Coordinates [2]float64         `bson:"coordinates" json:"Coordinates"` // [latitude, longitude]
+	Suggested   *[2]float64        `bson:"suggested_coordinates,omitempty" json:"SuggestedCoordinates,omitempty"`
+	Location    *geoPoint          `bson:"location,omitempty" json:"-"`
+	Transit     []TransitStop      `bson:"transit,omitempty" json:"Transit,omitempty"` // nearest first, see fillTransit
+	MinPrice    int                `bson:"min_price" json:"MinPrice"`
+	MaxPrice    int                `bson:"max_price" json:"MaxPrice"`
+	Facilities  []string           `bson:"facilities" json:"Facilities"`
+	Images      []imagemeta.Image  `bson:"images" json:"Images"`
+	Videos      []Video            `bson:"videos,omitempty" json:"Videos,omitempty"`
+	FloorPlans  []imagemeta.Plan   `bson:"floor_plans,omitempty" json:"FloorPlans,omitempty"` // kept out of Images so the photo carousel only shows photos
+	Documents   []Document         `bson:"documents,omitempty" json:"Documents,omitempty"`    // only with ?include=documents
+	Built       int                `bson:"built" json:"Built"`
+	TotalUnits  int                `bson:"total_units,omitempty" json:"TotalUnits,omitempty"`
+	TotalFloors int                `bson:"total_floors,omitempty" json:"TotalFloors,omitempty"` // every listing floor must be at most this
+	Completed   int                `bson:"year_completed,omitempty" json:"YearCompleted,omitempty"`
+	CommonFee   float64            `bson:"common_fee_per_sqm,omitempty" json:"CommonFeePerSqm,omitempty"` // THB per sqm per month, see listing_fees.go
+	SinkingFund float64            `bson:"sinking_fund_per_sqm,omitempty" json:"SinkingFundPerSqm,omitempty"`
+	Completion  string             `bson:"completion_status,omitempty" json:"CompletionStatus,omitempty"` // completed, under_construction or off_plan
+	CompletesAt *time.Time         `bson:"expected_completion,omitempty" json:"ExpectedCompletion,omitempty"`
+	CreatedAt   time.Time          `bson:"created_at" json:"Created_at"`
+	UpdatedAt   time.Time          `bson:"updated_at" json:"Updated_at"`
+	Views       int                `bson:"views" json:"Views"`
+	Pending     *int64             `bson:"-" json:"PendingImages,omitempty"`
+	DeletedAt   *time.Time         `bson:"deleted_at,omitempty" json:"deleted_at,omitempty"` // same name on every entity, see notDeleted
+
+	// Set with ?include=formatted, see price_formats.go
+	MinPriceFormatted     string `bson:"-" json:"MinPriceFormatted,omitempty"`
+	MinPriceFormattedLong string `bson:"-" json:"MinPriceFormattedLong,omitempty"`
+	MaxPriceFormatted     string `bson:"-" json:"MaxPriceFormatted,omitempty"`
+	MaxPriceFormattedLong string `bson:"-" json:"MaxPriceFormattedLong,omitempty"`
 }
 
 type Listing struct {
 	ID              primitive.ObjectID `bson:"_id,omitempty" json:"listing_id,omitempty"`
 	PropertyID      string             `bson:"property_id" json:"property_id"`
+	AgentID         string             `bson:"agent_id,omitempty" json:"agent_id,omitempty"`
+	Slug            string             `bson:"slug,omitempty" json:"slug,omitempty"`
 	Description     string             `bson:"description" json:"description"`
 	Price           float64            `bson:"price" json:"price"`
+	Currency        string             `bson:"currency" json:"currency"` // THB unless set, see currencies
 	MinimumContract string             `bson:"minimum_contract" json:"minimum_contract"`
 	Floor           int                `bson:"floor" json:"floor"`
-	Size            float64            `bson:"size" json:"size"` // size in square meters
+	Size            float64            `bson:"size" json:"size"`   // size in square meters, sqft in ?units=imperial responses
+	SizeUnit        string             `bson:"-" json:"size_unit"` // sqm or sqft, see listing_units.go
+	Units           string             `bson:"-" json:"-"`         // unit system of the response, set by applyUnits
 	Bedroom         int                `bson:"bedroom" json:"bedroom"`
 	Bathroom        int                `bson:"bathroom" json:"bathroom"`
 	Furniture       string             `bson:"furniture" json:"furniture"`               // fully-fitted or fully furnished
@@ -75,8 +122,44 @@ type Listing struct {
 	ListingType     string             `bson:"listing_type" json:"listing_type"`         // sale or rent
 	FacingDirection string             `bson:"facing_direction" json:"facing_direction"` // N, S, E, W, NE, NW, SE, SW
 	CreatedAt       time.Time          `bson:"created_at" json:"created_at"`
-	Photos          []string           `bson:"photos" json:"photos"`                 // URLs of photos
+	DepositMonths   int                `bson:"deposit_months,omitempty" json:"deposit_months,omitempty"`
+	AdvanceMonths   int                `bson:"advance_months,omitempty" json:"advance_months,omitempty"`
+	Photos          []imagemeta.Image  `bson:"photos" json:"photos"`
+	Videos          []Video            `bson:"videos,omitempty" json:"videos,omitempty"`
+	FloorPlans      []imagemeta.Plan   `bson:"floor_plans,omitempty" json:"floor_plans,omitempty"`
+	Tags            []string           `bson:"tags" json:"tags"`                     // unit amenities, see listingTagVocabulary
 	ListingStatus   string             `bson:"listing_status" json:"listing_status"` // active or inactive
+	DeactivatedAt   *time.Time         `bson:"deactivated_at,omitempty" json:"deactivated_at,omitempty"`
+	InactiveReason  string             `bson:"deactivation_reason,omitempty" json:"deactivation_reason,omitempty"` // sold, rented, withdrawn or expired
+	ExpiresAt       *time.Time         `bson:"expires_at,omitempty" json:"expires_at,omitempty"`                   // defaults to created_at + LISTING_EXPIRY_DAYS
+	AvailableFrom   *time.Time         `bson:"available_from,omitempty" json:"available_from,omitempty"`           // move-in date, unset means available now
+	Publication     string             `bson:"publication_state,omitempty" json:"publication_state,omitempty"`     // draft or published, unset means published
+	PublishedAt     *time.Time         `bson:"published_at,omitempty" json:"published_at,omitempty"`
+	UpdatedAt       time.Time          `bson:"updated_at" json:"updated_at"`
+	Featured        bool               `bson:"featured" json:"featured"` // shown on the home page rail
+	DeletedAt       *time.Time         `bson:"deleted_at,omitempty" json:"deleted_at,omitempty"`
+	PriceHistory    []priceChange      `bson:"price_history,omitempty" json:"-"`  // newest last, see GET /listings/{id}/price-history
+	PricePerSqm     *float64           `bson:"-" json:"price_per_sqm,omitempty"`  // computed on output, see MarshalJSON
+	PricePerSqft    *float64           `bson:"-" json:"price_per_sqft,omitempty"` // instead of price_per_sqm with ?units=imperial
+	PreviousPrice   *float64           `bson:"-" json:"previous_price,omitempty"` // set with ?include=price_drop
+	PriceDropPct    *float64           `bson:"-" json:"price_drop_pct,omitempty"`
+	DisplayPrice    *float64           `bson:"-" json:"display_price,omitempty"` // price converted with ?display_currency=
+	DisplayCurrency string             `bson:"-" json:"display_currency,omitempty"`
+	RatesAsOf       *time.Time         `bson:"-" json:"rates_as_of,omitempty"` // when the rate used for display_price was fetched
+	Availability    string             `bson:"-" json:"availability_label"`    // computed on output, see MarshalJSON
+	Completion      *completionInfo    `bson:"-" json:"property_completion,omitempty"`
+	MonthlyTotal    *float64           `bson:"-" json:"monthly_total_estimate,omitempty"` // rentals only, see applyFeeEstimates
+	MoveInCost      *float64           `bson:"-" json:"move_in_cost,omitempty"`
+	Agent           *agentContact      `bson:"-" json:"agent,omitempty"`                    // listing detail only
+	Ranking         *listingRanking    `bson:"_ranking,omitempty" json:"ranking,omitempty"` // ?sort=relevance&debug=true only, see rankingStages
+
+	// Set with ?include=formatted, see price_formats.go
+	PriceFormatted     string `bson:"-" json:"price_formatted,omitempty"`
+	PriceFormattedLong string `bson:"-" json:"price_formatted_long,omitempty"`
+
+	// Only set by the verification workflow, see listing_verification.go
+	Verified     bool                 `bson:"verified,omitempty" json:"verified"` // the public badge
+	Verification *listingVerification `bson:"verification,omitempty" json:"-"`
 }
 
 var client *mongo.Client
@@ -102,115 +185,131 @@ func connectMongoDB() {
 	// here
 	var err error
 	// Initialize the MongoDB client
-	client, err = mongo.Connect(ctx, options.Client().ApplyURI(mongoURI))
+	client, err = mongo.Connect(ctx, options.Client().ApplyURI(mongoURI).SetMonitor(slowQueries.monitor()).SetPoolMonitor(mongoPool.monitor()))
 	if err != nil {
 		log.Fatal("Error connecting to MongoDB:", err)
 	}
 
 	// Ping the MongoDB server to ensure connection
 	err = client.Ping(ctx, nil)
-	if err != nil {
+	if err != nil && retryMongoDB {
+		awaitMongoDB(err)
+	} else if err != nil {
 		log.Fatal("Error pinging MongoDB:", err)
 	}
 
 	// Print success messages
-	fmt.Println("Connected to MongoDB!")
+	fmt.Fprintln(os.Stderr, "Connected to MongoDB!") // stderr, stdout is the output of `export`
 	log.Println("MongoDB Client Initialized:", client)
 }
 
 func getProperties(w http.ResponseWriter, r *http.Request) {
+	if includesPart(r, "listing_count") {
+		getPropertiesWithListingCount(w, r)
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
 	defer cancel()
 
-	collection := client.Database("MVDB").Collection("properties")
-	cur, err := collection.Find(ctx, bson.M{})
+	filter := bson.M{}
+	if !applyDeletedFilter(w, r, filter) || !applyTransitFilter(w, r, filter) || !applyCompletionFilter(w, r, filter) {
+		return
+	}
+
+	page, ok := parseListPage(w, r)
+	if !ok {
+		return
+	}
+	full, ok := parseListView(w, r)
+	if !ok {
+		return
+	}
+	fp, err := fingerprint(ctx, "properties", filter)
 	if err != nil {
-		http.Error(w, "Failed to retrieve Properties from MongoDB", http.StatusInternalServerError)
+		serverError(w, r, "Failed to retrieve Properties from MongoDB", err)
+		return
+	}
+	loc, formatted := priceLocale(w, r)
+	if notModified(w, r, weakETag(r, fp)) {
 		return
 	}
-	defer cur.Close(ctx)
 
-	var properties []Property
-	for cur.Next(ctx) {
-		var property Property
-		if err := cur.Decode(&property); err != nil {
-			http.Error(w, "Failed to decode retrieved Properties", http.StatusInternalServerError)
-			return
-		}
-		properties = append(properties, property)
+	opts := page.findOptions()
+	switch {
+	case !full:
+		opts.SetProjection(propertySummaryFields())
+	case !includesPart(r, "documents"):
+		opts.SetProjection(bson.M{"documents": 0})
 	}
-	if err := cur.Err(); err != nil {
-		http.Error(w, "Error iterating through cursor", http.StatusInternalServerError)
+	collection := client.Database("MVDB").Collection("properties")
+	cur, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		serverError(w, r, "Failed to retrieve Properties from MongoDB", err)
 		return
 	}
-	json.NewEncoder(w).Encode(properties)
+	var prepare func([]Property) error
+	if formatted {
+		prepare = func(properties []Property) error {
+			for i := range properties {
+				formatPropertyPrices(&properties[i], loc)
+			}
+			return nil
+		}
+	}
+	streamCursor[Property](ctx, w, cur, "Properties", prepare)
 }
 
 func getInquires(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
 	defer cancel()
 
-	collection := client.Database("MVDB").Collection("inquiries")
-	cur, err := collection.Find(ctx, bson.M{})
-	if err != nil {
-		http.Error(w, "Failed to retrieve Inquiries from MongoDB", http.StatusInternalServerError)
+	page, ok := parseListPage(w, r)
+	if !ok {
 		return
 	}
-	defer cur.Close(ctx)
 
-	var inquiries []Inquiry
-	for cur.Next(ctx) {
-		var inquiry Inquiry
-		if err := cur.Decode(&inquiry); err != nil {
-			http.Error(w, "Failed to decode retrieved Inquiries", http.StatusInternalServerError)
-			return
-		}
-		inquiries = append(inquiries, inquiry)
-	}
-	if err := cur.Err(); err != nil {
-		http.Error(w, "Error iterating through cursor", http.StatusInternalServerError)
+	cur, err := findWithArchive(ctx, r, "inquiries", bson.M{}, page)
+	if err != nil {
+		serverError(w, r, "Failed to retrieve Inquiries from MongoDB", err)
 		return
 	}
-	json.NewEncoder(w).Encode(inquiries)
+	streamCursor[Inquiry](ctx, w, cur, "Inquiries", nil)
 }
 
 func getAppointments(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
 	defer cancel()
 
-	collection := client.Database("MVDB").Collection("appointments")
-	cur, err := collection.Find(ctx, bson.M{})
-	if err != nil {
-		http.Error(w, "Failed to retrieve Appointments from MongoDB", http.StatusInternalServerError)
+	page, ok := parseListPage(w, r)
+	if !ok {
 		return
 	}
-	defer cur.Close(ctx)
 
-	var appointments []Appointment
-	for cur.Next(ctx) {
-		var appointment Appointment
-		if err := cur.Decode(&appointment); err != nil {
-			http.Error(w, "Failed to decode retrieved Appointments", http.StatusInternalServerError)
-			return
-		}
-		appointments = append(appointments, appointment)
+	loc, ok := responseLocation(w, r)
+	if !ok {
+		return
 	}
-	if err := cur.Err(); err != nil {
-		http.Error(w, "Error iterating through cursor", http.StatusInternalServerError)
+
+	cur, err := findWithArchive(ctx, r, "appointments", bson.M{}, page)
+	if err != nil {
+		serverError(w, r, "Failed to retrieve Appointments from MongoDB", err)
 		return
 	}
-	json.NewEncoder(w).Encode(appointments)
+	streamCursor(ctx, w, cur, "Appointments", func(batch []Appointment) error {
+		localizeAppointments(batch, loc)
+		return nil
+	})
 }
 
 func getUsers(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
 	defer cancel()
 
 	log.Println("getUsers called") // Log the start of the function
@@ -222,32 +321,23 @@ func getUsers(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	filter := bson.M{}
+	if !applyDeletedFilter(w, r, filter) {
+		return
+	}
+	page, ok := parseListPage(w, r)
+	if !ok {
+		return
+	}
+
 	collection := client.Database("MVDB").Collection("users")
-	cur, err := collection.Find(ctx, bson.M{})
+	cur, err := collection.Find(ctx, filter, page.findOptions())
 	if err != nil {
 		log.Println("Failed to retrieve Users from MongoDB:", err)
 		http.Error(w, "Failed to retrieve Users from MongoDB", http.StatusInternalServerError)
 		return
 	}
-	defer cur.Close(ctx)
-
-	var users []User
-	for cur.Next(ctx) {
-		var user User
-		if err := cur.Decode(&user); err != nil {
-			log.Println("Failed to decode retrieved Users:", err)
-			http.Error(w, "Failed to decode retrieved Users", http.StatusInternalServerError)
-			return
-		}
-		users = append(users, user)
-	}
-	if err := cur.Err(); err != nil {
-		log.Println("Error iterating through cursor:", err)
-		http.Error(w, "Error iterating through cursor", http.StatusInternalServerError)
-		return
-	}
-	log.Println("Successfully retrieved users")
-	json.NewEncoder(w).Encode(users)
+	streamCursor[User](ctx, w, cur, "Users", nil)
 }
 
 func getUserByEmail(w http.ResponseWriter, r *http.Request) {
@@ -260,9 +350,9 @@ func getUserByEmail(w http.ResponseWriter, r *http.Request) {
         return
     }
 
-	filter := bson.M{"email": email}
+	filter := notDeleted(bson.M{"email": email})
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second) 
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second) 
 	defer cancel()
 
     collection := client.Database("MVDB").Collection("users")
@@ -283,7 +373,7 @@ func getUserByEmail(w http.ResponseWriter, r *http.Request) {
 
 // func getUsers(w http.ResponseWriter, r *http.Request) {
 // 	w.Header().Set("Content-Type", "application/json")
-// 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+// 	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
 // 	defer cancel()
 
 // 	log.Println("getUsers called") // Log the start of the function
@@ -325,42 +415,133 @@ func getUserByEmail(w http.ResponseWriter, r *http.Request) {
 
 func getListings(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
 
-	collection := client.Database("MVDB").Collection("listings")
-	cur, err := collection.Find(ctx, bson.M{})
+	filter, err := parseListingFilter(r.URL.Query())
 	if err != nil {
-		http.Error(w, "Failed to retrieve Listings from MongoDB", http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !authorizeListingState(w, r, filter) {
+		return
+	}
+	q := r.URL.Query()
+	sortBy, text := q.Get("sort"), q.Get("q")
+	if sortBy != "" && sortBy != "relevance" {
+		http.Error(w, "sort must be relevance", http.StatusBadRequest)
+		return
+	}
+	debug := q.Get("debug") == "true"
+	if debug && !hasAPIKey(r) {
+		http.Error(w, "debug=true requires the API key", http.StatusUnauthorized)
+		return
+	}
+	page, ok := parseListPage(w, r)
+	if !ok {
+		return
+	}
+	full, ok := parseListView(w, r)
+	if !ok {
 		return
 	}
-	defer cur.Close(ctx)
 
-	var listings []Listing
-	for cur.Next(ctx) {
-		var listing Listing
-		if err := cur.Decode(&listing); err != nil {
-			http.Error(w, "Failed to decode retrieved Listings", http.StatusInternalServerError)
-			return
-		}
-		listings = append(listings, listing)
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	query := filter.toBSON()
+	if !applyDeletedFilter(w, r, query) {
+		return
 	}
-	if err := cur.Err(); err != nil {
-		http.Error(w, "Error iterating through cursor", http.StatusInternalServerError)
+	if text != "" {
+		query["$text"] = bson.M{"$search": text}
+	}
+	var stages []bson.M
+	var weights rankingWeights
+	if sortBy == "relevance" {
+		weights = currentRankingWeights(ctx)
+		stages = rankingStages(weights, text != "", debug, time.Now())
+	}
+	// Fees and completion come from the properties, and prices convert with the current rates
+	fp, err := fingerprint(ctx, "listings", query)
+	if err != nil {
+		serverError(w, r, "Failed to retrieve Listings from MongoDB", err)
+		return
+	}
+	properties, err := fingerprint(ctx, "properties", bson.M{})
+	if err != nil {
+		serverError(w, r, "Failed to retrieve Properties from MongoDB", err)
+		return
+	}
+	loc, formatted := priceLocale(w, r)
+	if notModified(w, r, weakETag(r, fp, properties, weights, ratesVersion())) {
 		return
 	}
-	json.NewEncoder(w).Encode(listings)
+
+	cur, err := findListings(ctx, query, filter, page, !full, stages...)
+	if err != nil {
+		serverError(w, r, "Failed to retrieve Listings from MongoDB", err)
+		return
+	}
+	if (filter.MinPrice != nil || filter.MaxPrice != nil || filter.MaxMonthlyTotal != nil) && usableRates() == nil {
+		warnStaleRates(w)
+	}
+	// The computed fields are filled in per batch; display_currency was validated with the filter
+	priceDrops := includesPart(r, "price_drop")
+	streamCursor(ctx, w, cur, "Listings", func(listings []Listing) error {
+		if priceDrops {
+			now := time.Now()
+			for i := range listings {
+				listings[i].PreviousPrice, listings[i].PriceDropPct = priceDrop(listings[i].PriceHistory, now)
+			}
+		}
+		if err := applyFeeEstimates(ctx, listings); err != nil {
+			return errors.New("Failed to retrieve Property fees")
+		}
+		applyDisplayCurrency(w, r, listings)
+		applyUnits(w, r, listings)
+		if formatted {
+			formatListingPrices(listings, loc)
+		}
+		return nil
+	})
+}
+
+// newCloudinary returns a Cloudinary client for the account in the environment
+func newCloudinary() (*cloudinary.Cloudinary, error) {
+	return cloudinary.NewFromParams(
+		os.Getenv("CLOUDINARY_CLOUD_NAME"),
+		os.Getenv("CLOUDINARY_API_KEY"),
+		os.Getenv("CLOUDINARY_API_SECRET"),
+	)
 }
 
 // Handler to upload an image
 func uploadImage(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
-	params := mux.Vars(r)
-	id, _ := primitive.ObjectIDFromHex(params["id"])
+	id, ok := pathObjectID(w, r, "Property")
+	if !ok {
+		return
+	}
+	watermark, ok := uploadWatermark(w, r)
+	if !ok {
+		return
+	}
+	// The property is checked before anything is uploaded, an upload for a missing property is paid
+	// for and then dropped
+	var property Property
+	err := client.Database("MVDB").Collection("properties").FindOne(r.Context(), notDeleted(bson.M{"_id": id}),
+		options.FindOne().SetProjection(bson.M{"coordinates": 1, "images": 1})).Decode(&property)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Property not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		serverError(w, r, "Failed to retrieve Property", err)
+		return
+	}
 
 	// Parse the form data
-	err := r.ParseMultipartForm(10 << 20) // Max file size: 10 MB
+	err = r.ParseMultipartForm(10 << 20) // Max file size: 10 MB
 	if err != nil {
 		http.Error(w, "Unable to parse form data", http.StatusBadRequest)
 		return
@@ -374,21 +555,44 @@ func uploadImage(w http.ResponseWriter, r *http.Request) {
 	}
 	defer file.Close()
 
+	// The file is read before it goes to Cloudinary: for its perceptual hash and, on a property
+	// without coordinates, the GPS position of the photo as a suggestion
+	data, err := io.ReadAll(file)
+	if err != nil {
+		http.Error(w, "Unable to read the uploaded image", http.StatusBadRequest)
+		return
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		serverError(w, r, "Failed to read the uploaded image", err)
+		return
+	}
+	var suggested *[2]float64
+	if !hasCoordinates(property.Coordinates) {
+		suggested = photoCoordinates(data)
+	}
+	hash := photoHash(data)
+	duplicate, distance := imagemeta.NearDuplicate(property.Images, hash)
+	if duplicate != nil && r.URL.Query().Get("strict") == "true" {
+		http.Error(w, fmt.Sprintf("The property already has this image (public_id %s, distance %d)", duplicate.PublicID, distance), http.StatusConflict)
+		return
+	}
+
 	// Initialize Cloudinary
-	cld, err := cloudinary.NewFromParams(
-		os.Getenv("CLOUDINARY_CLOUD_NAME"),
-		os.Getenv("CLOUDINARY_API_KEY"),
-		os.Getenv("CLOUDINARY_API_SECRET"),
-	)
+	cld, err := newCloudinary()
 	if err != nil {
-		http.Error(w, "Failed to initialize Cloudinary", http.StatusInternalServerError)
+		serverError(w, r, "Failed to initialize Cloudinary", err)
 		return
 	}
 
-	// Upload the file to Cloudinary
-	uploadResult, err := cld.Upload.Upload(context.Background(), file, uploader.UploadParams{})
+	// Upload the file to Cloudinary; a watermark is derived right away rather than on the first view
+	params := uploader.UploadParams{}
+	if watermark != nil {
+		params.Eager = watermark.Transformation()
+	}
+	moderator.request(&params)
+	uploadResult, err := cld.Upload.Upload(r.Context(), file, params)
 	if err != nil {
-		http.Error(w, "Failed to upload image to Cloudinary: "+err.Error(), http.StatusInternalServerError)
+		serverError(w, r, "Failed to upload image to Cloudinary", err)
 		return
 	}
 
@@ -402,20 +606,114 @@ func uploadImage(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Update the property with the image URL
+	image := imagemeta.StripMetadata(imagemeta.Image{URL: uploadResult.SecureURL, PublicID: uploadResult.PublicID, Hash: hash})
+	if watermark != nil {
+		image = watermark.Apply(image)
+	}
+
+	status := http.StatusOK
+	response := bson.M{"message": "Image uploaded successfully", "url": image.URL, "public_id": image.PublicID, "original_url": image.OriginalURL, "hash": image.Hash}
+	switch moderator.verdict(uploadResult) {
+	case moderationRejected:
+		// The caller hears of it right here, there is nobody to notify
+		rejectImage(r.Context(), id, image, "")
+		http.Error(w, "The image was rejected by moderation", http.StatusUnprocessableEntity)
+		return
+	case moderationPending:
+		// Held back until moderation decides; user_id names who to notify if the image is rejected
+		pending := pendingImage{
+			PropertyID: id,
+			Image:      image,
+			Suggested:  suggested,
+			UploadedBy: r.FormValue("user_id"),
+			Status:     moderationPending,
+			CreatedAt:  time.Now(),
+		}
+		result, err := client.Database("MVDB").Collection("pending_images").InsertOne(r.Context(), pending)
+		if err != nil {
+			serverError(w, r, "Failed to hold image for moderation", err)
+			return
+		}
+		invalidateResponses("properties")
+		status = http.StatusAccepted
+		response["message"] = "Image uploaded, it is added to the property once moderation approves it"
+		response["pending_image_id"] = result.InsertedID
+	default:
+		if err := attachImage(r.Context(), auditFromRequest(r), id, image, suggested); err != nil {
+			serverError(w, r, "Failed to update property with image URL", err)
+			return
+		}
+	}
+
+	w.WriteHeader(status)
+	if suggested != nil {
+		response["suggested_coordinates"] = suggested
+	}
+	if duplicate != nil {
+		response["warning"] = fmt.Sprintf("The property already has a near-duplicate of this image (public_id %s, distance %d); repeat with ?strict=true to reject duplicates", duplicate.PublicID, distance)
+		response["duplicate_of"] = duplicate.PublicID
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// attachImage adds an uploaded image to the property, along with the coordinates suggested by the photo
+func attachImage(ctx context.Context, meta auditMeta, id primitive.ObjectID, image imagemeta.Image, suggested *[2]float64) error {
 	collection := client.Database("MVDB").Collection("properties")
 	update := bson.M{
 		"$push": bson.M{
-			"Images": uploadResult.SecureURL,
+			"images": image,
 		},
+		"$set": bson.M{
+			"updated_at": time.Now(),
+		},
+	}
+	if suggested != nil {
+		update["$set"].(bson.M)["suggested_coordinates"] = suggested
+	}
+	before := auditSnapshot(ctx, "properties", id)
+	if _, err := collection.UpdateByID(ctx, id, update); err != nil {
+		return err
 	}
-	_, err = collection.UpdateByID(context.Background(), id, update)
+	recordAudit(meta, "update", "properties", id.Hex(), before, auditSnapshot(ctx, "properties", id), nil)
+	return nil
+}
+
+// insertProperty validates the property, sets server-side defaults and stores it.
+// Validation failures are returned as a *validationError.
+func insertProperty(ctx context.Context, property *Property) (interface{}, error) {
+	problems := validatePropertyFields(property)
+	linkProblems, err := linkDeveloper(ctx, property)
 	if err != nil {
-		http.Error(w, "Failed to update property with image URL", http.StatusInternalServerError)
-		return
+		return nil, err
+	}
+	if problems = append(problems, linkProblems...); len(problems) > 0 {
+		return nil, &validationError{Problems: problems}
 	}
 
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(bson.M{"message": "Image uploaded successfully", "url": uploadResult.SecureURL})
+	// Set CreatedAt timestamp
+	property.CreatedAt = time.Now()
+	property.UpdatedAt = property.CreatedAt
+	property.Images = []imagemeta.Image{}
+	property.Location = propertyLocation(property.Coordinates)
+	fillTransit(property)
+
+	// The unique slug index catches a concurrent create that picked the same slug; try the next free one
+	collection := client.Database("MVDB").Collection("properties")
+	for attempt := 0; ; attempt++ {
+		slug, err := propertySlug(ctx, property.Title, nil)
+		if err != nil {
+			return nil, err
+		}
+		property.Slug = slug
+		result, err := collection.InsertOne(ctx, property)
+		if mongo.IsDuplicateKeyError(err) && attempt < 3 {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return result.InsertedID, nil
+	}
 }
 
 func createProperty(w http.ResponseWriter, r *http.Request) {
@@ -425,25 +723,98 @@ func createProperty(w http.ResponseWriter, r *http.Request) {
 	var property Property
 	err := json.NewDecoder(r.Body).Decode(&property)
 	if err != nil {
-		http.Error(w, "Failed to parse request body", http.StatusInternalServerError)
+		serverError(w, r, "Failed to parse request body", err)
 		return
 	}
 
-	// Set CreatedAt timestamp
-	property.CreatedAt = time.Now()
-	property.Images = []string{}
-
 	// Insert property into MongoDB
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
 	defer cancel()
 
-	collection := client.Database("MVDB").Collection("properties")
-	result, err := collection.InsertOne(ctx, property)
+	// Reject likely duplicates unless the caller confirms the property is a different one
+	if r.URL.Query().Get("allow_duplicate") != "true" {
+		duplicate, err := findDuplicateProperty(ctx, &property)
+		if err != nil {
+			serverError(w, r, "Failed to check for duplicate Properties", err)
+			return
+		}
+		if duplicate != nil {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(bson.M{
+				"error":     "A similar Property already exists; repeat with ?allow_duplicate=true to create it anyway",
+				"duplicate": bson.M{"property_id": duplicate.ID, "Title": duplicate.Title},
+			})
+			return
+		}
+	}
+
+	id, err := insertProperty(ctx, &property)
 	if err != nil {
+		var vErr *validationError
+		if errors.As(err, &vErr) {
+			http.Error(w, vErr.Error(), http.StatusBadRequest)
+			return
+		}
 		http.Error(w, "Failed to create Property", http.StatusInternalServerError)
 		return
 	}
-	json.NewEncoder(w).Encode(bson.M{"property_id": result.InsertedID})
+	auditCreated(auditFromRequest(r), "properties", id, property)
+	property.ID, _ = id.(primitive.ObjectID)
+	writeCreated(w, "/properties/"+property.ID.Hex(), property, nil)
+}
+
+var (
+	errInvalidPropertyID = errors.New("Invalid PropertyID format")
+	errPropertyNotFound  = errors.New("PropertyID does not exist")
+	errPropertyCheck     = errors.New("Failed to check PropertyID")
+)
+
+// insertListing stores the listing if its property exists, see insertWithReferences.
+// Invalid fields are returned as a *validationError, property problems as one of the
+// errInvalidPropertyID / errPropertyNotFound / errPropertyCheck errors, and an assigned
+// agent that can't take listings as one of errInvalidAgentID / errAgentUnavailable / errAgentCheck.
+func insertListing(ctx context.Context, listing *Listing) (interface{}, error) {
+	if listing.ListingStatus == "" {
+		listing.ListingStatus = "active"
+	}
+	if listing.Currency == "" {
+		listing.Currency = defaultCurrency
+	}
+	if listing.Publication == "" {
+		listing.Publication = publicationPublished
+	}
+	listing.Verified, listing.Verification = false, nil
+	listing.Tags = normalizeTags(listing.Tags)
+	if problems := validateListingFields(listing); len(problems) > 0 {
+		return nil, &validationError{Problems: problems}
+	}
+
+	// Set CreatedAt timestamp
+	listing.CreatedAt = time.Now()
+	listing.UpdatedAt = listing.CreatedAt
+	listing.Photos = []imagemeta.Image{}
+	defaultExpiry(listing)
+
+	// The slug embeds the end of the id, so the id is assigned here rather than by the insert
+	listing.ID = primitive.NewObjectID()
+	slugs, err := propertySlugsByID(ctx, []string{listing.PropertyID})
+	if err != nil {
+		return nil, errPropertyCheck
+	}
+	listing.Slug = listingSlug(slugs[listing.PropertyID], listing)
+
+	// Insert listing into MongoDB, checking the property and agent in the same step
+	refs := []reference{{
+		Collection: "properties",
+		ID:         listing.PropertyID,
+		Invalid:    errInvalidPropertyID,
+		Missing:    errPropertyNotFound,
+		Check:      errPropertyCheck,
+	}}
+	if listing.AgentID != "" {
+		refs = append(refs, agentReference(listing.AgentID))
+	}
+	return insertWithReferences(ctx, "listings", listing, refs...)
 }
 
 func createListing(w http.ResponseWriter, r *http.Request) {
@@ -453,44 +824,70 @@ func createListing(w http.ResponseWriter, r *http.Request) {
 	var listing Listing
 	err := json.NewDecoder(r.Body).Decode(&listing)
 	if err != nil {
-		http.Error(w, "Failed to parse request body", http.StatusInternalServerError)
+		serverError(w, r, "Failed to parse request body", err)
 		return
 	}
+	// Drafts stay hidden from public endpoints until POST /listings/{id}/publish
+	if r.URL.Query().Get("draft") == "true" {
+		listing.Publication = publicationDraft
+	}
 
 	// Ctx, cancel
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
 	defer cancel()
 
-	// Validation (check if propertyId exists in Properties Collection)
-	propertiesCollection := client.Database("MVDB").Collection("properties")
-	var property Property
-	propertyID, err := primitive.ObjectIDFromHex(listing.PropertyID)
-	if err != nil {
-		http.Error(w, "Invalid PropertyID format", http.StatusBadRequest)
+	id, err := insertListing(ctx, &listing)
+	var vErr *validationError
+	switch {
+	case err == nil:
+	case errors.As(err, &vErr), err == errInvalidPropertyID, err == errPropertyNotFound, err == errInvalidAgentID, err == errAgentUnavailable:
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
-	}
-	err = propertiesCollection.FindOne(ctx, bson.M{"_id": propertyID}).Decode(&property)
-	if err != nil {
-		if err == mongo.ErrNoDocuments {
-			http.Error(w, "PropertyID does not exist", http.StatusBadRequest)
-		} else {
-			http.Error(w, "Failed to check PropertyID", http.StatusInternalServerError)
-		}
+	case err == errPropertyCheck, err == errAgentCheck:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	default:
+		http.Error(w, "Failed to create Listing", http.StatusInternalServerError)
 		return
 	}
+	auditCreated(auditFromRequest(r), "listings", id, listing)
+	listing.ID, _ = id.(primitive.ObjectID)
+	go matchSavedSearches(listing)
+	// Free-text tags are kept; listing them here lets admins curate the vocabulary
+	writeCreated(w, "/listings/"+listing.ID.Hex(), listing, map[string]interface{}{"unknown_tags": unknownTags(listing.Tags)})
+}
+
+// insertInquiry stores a new inquiry
+func insertInquiry(ctx context.Context, inquiry *Inquiry) (interface{}, error) {
+	// Validation Check
+	// TODO: Complete any validation / verification
+	if problems := validateInquirySource(&inquiry.Source); len(problems) > 0 {
+		return nil, &validationError{Problems: problems}
+	}
 
 	// Set CreatedAt timestamp
-	listing.CreatedAt = time.Now()
-	listing.Photos = []string{}
+	inquiry.CreatedAt = time.Now()
 
-	// Insert listing into MongoDB
-	listingsCollection := client.Database("MVDB").Collection("listings")
-	result, err := listingsCollection.InsertOne(ctx, listing)
+	// An inquiry that can't be routed is still stored, unassigned, for the shared inbox
+	if agentID, err := routeInquiry(ctx, inquiry); err != nil {
+		log.Println("Failed to route inquiry for property", inquiry.Property_id, ":", err)
+	} else if agentID != "" {
+		inquiry.AgentID = agentID
+		inquiry.AssignedAt = &inquiry.CreatedAt
+	}
+
+	// Insert inquiry into MongoDB
+	inquiriesCollection := client.Database("MVDB").Collection("inquiries")
+	result, err := inquiriesCollection.InsertOne(ctx, inquiry)
 	if err != nil {
-		http.Error(w, "Failed to create Listing", http.StatusInternalServerError)
-		return
+		return nil, err
 	}
-	json.NewEncoder(w).Encode(bson.M{"listing_id": result.InsertedID})
+	if inquiry.AgentID != "" {
+		id := result.InsertedID.(primitive.ObjectID).Hex()
+		enqueueJob(ctx, jobInquiryEmail, inquiryEmailJob{InquiryID: id})
+		publishInquiryAssigned(id, inquiry)
+	}
+	return result.InsertedID, nil
 }
 
 func createInquiry(w http.ResponseWriter, r *http.Request) {
@@ -499,29 +896,45 @@ func createInquiry(w http.ResponseWriter, r *http.Request) {
 	// Parse request body for POST
 	var inquiry Inquiry
 	err := json.NewDecoder(r.Body).Decode(&inquiry)
+	var vErr *validationError
+	if errors.As(err, &vErr) {
+		http.Error(w, vErr.Error(), http.StatusBadRequest)
+		return
+	}
 	if err != nil {
-		http.Error(w, "Failed to parse request body", http.StatusInternalServerError)
+		serverError(w, r, "Failed to parse request body", err)
 		return
 	}
 
 	// Ctx, cancel
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
 	defer cancel()
 
-	// Validation Check
-	// TODO: Complete any validation / verification
+	id, err := insertInquiry(ctx, &inquiry)
+	if errors.As(err, &vErr) {
+		http.Error(w, vErr.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		serverError(w, r, "Failed to create Inquiry", err)
+		return
+	}
+	auditCreated(auditFromRequest(r), "inquiries", id, inquiry)
+	inquiry.ID, _ = id.(primitive.ObjectID)
+	writeCreated(w, "/inquiries/"+inquiry.ID.Hex(), inquiry, nil)
+}
 
+// insertUser stores a new user
+func insertUser(ctx context.Context, user *User) (interface{}, error) {
 	// Set CreatedAt timestamp
-	inquiry.CreatedAt = time.Now()
+	user.CreatedAt = time.Now()
 
-	// Insert inquiry into MongoDB
-	inquiriesCollection := client.Database("MVDB").Collection("inquiries")
-	result, err := inquiriesCollection.InsertOne(ctx, inquiry)
+	collection := client.Database("MVDB").Collection("users")
+	result, err := collection.InsertOne(ctx, user)
 	if err != nil {
-		http.Error(w, "Failed to create Inquiry", http.StatusInternalServerError)
-		return
+		return nil, err
 	}
-	json.NewEncoder(w).Encode(bson.M{"inquiry_id": result.InsertedID})
+	return result.InsertedID, nil
 }
 
 func createUser(w http.ResponseWriter, r *http.Request) {
@@ -531,24 +944,26 @@ func createUser(w http.ResponseWriter, r *http.Request) {
 	var user User
 	err := json.NewDecoder(r.Body).Decode(&user)
 	if err != nil {
-		http.Error(w, "Failed to parse request body", http.StatusInternalServerError)
+		serverError(w, r, "Failed to parse request body", err)
 		return
 	}
 
-	// Set CreatedAt timestamp
-	user.CreatedAt = time.Now()
-
 	// Insert User into MongoDB
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
 	defer cancel()
 
-	collection := client.Database("MVDB").Collection("users")
-	result, err := collection.InsertOne(ctx, user)
+	id, err := insertUser(ctx, &user)
+	if mongo.IsDuplicateKeyError(err) {
+		http.Error(w, "A user with this email already exists", http.StatusConflict)
+		return
+	}
 	if err != nil {
-		http.Error(w, "Failed to create User", http.StatusInternalServerError)
+		serverError(w, r, "Failed to create User", err)
 		return
 	}
-	json.NewEncoder(w).Encode(bson.M{"user_id": result.InsertedID})
+	auditCreated(auditFromRequest(r), "users", id, user)
+	user.ID, _ = id.(primitive.ObjectID)
+	writeCreated(w, "/users/"+user.ID.Hex(), user, nil)
 }
 
 func checkUser(w http.ResponseWriter, r *http.Request) {
@@ -560,12 +975,12 @@ func checkUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
 	defer cancel()
 
 	collection := client.Database("MVDB").Collection("users")
 	var user User
-	err := collection.FindOne(ctx, bson.M{"email": email}).Decode(&user)
+	err := collection.FindOne(ctx, notDeleted(bson.M{"email": email})).Decode(&user)
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
 			json.NewEncoder(w).Encode(bson.M{"exists": false})
@@ -613,11 +1028,12 @@ func updateUser(w http.ResponseWriter, r *http.Request) {
     }
 
     // Execute the update operation
-    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
     defer cancel()
 
     collection := client.Database("MVDB").Collection("users")
-    result, err := collection.UpdateByID(ctx, objID, update)
+    before := auditSnapshot(ctx, "users", objID)
+    result, err := collection.UpdateOne(ctx, notDeleted(bson.M{"_id": objID}), update)
     if err != nil {
         http.Error(w, "Failed to update User", http.StatusInternalServerError)
         return
@@ -628,6 +1044,7 @@ func updateUser(w http.ResponseWriter, r *http.Request) {
         http.Error(w, "User not found", http.StatusNotFound)
         return
     }
+    recordAudit(auditFromRequest(r), "update", "users", objID.Hex(), before, auditSnapshot(ctx, "users", objID), nil)
 
     json.NewEncoder(w).Encode(bson.M{"message": "User updated successfully"})
 }
@@ -640,48 +1057,245 @@ func main() {
     //     log.Fatal("Error loading .env file:", err)
     // }
 
-	// uncomment here for localhost testing (actually this is not implemented yet)
-    // apiKey = os.Getenv("API_KEY")
-    // if apiKey == "" {
-    //     log.Fatal("API_KEY environment variable not set")
-    // }
+	apiKey = os.Getenv("API_KEY")
+	if apiKey == "" {
+		log.Println("API_KEY environment variable not set, only stored API keys are accepted")
+	}
 
-	connectMongoDB()
-	r := mux.NewRouter()
+	// serve is the default; migrate, seed, export and import are in commands.go
+	if len(os.Args) > 1 && os.Args[1] != "serve" {
+		runCommand(os.Args[1:])
+		return
+	}
+	// The server listens right away and answers 503 until MongoDB and the indexes are up, see startup.go
+	retryMongoDB = true
+	startup := &startupHandler{}
+	go func() {
+		connectMongoDB()
+		ensureIndexes()
+		ensureValidators()
+		scheduleListingExpiry()
+		scheduleArchive()
+		scheduleRatesRefresh()
+		setupPush()
+		setupMailer()
+		scheduleDigests()
+		setupResponseCache()
+		setupCacheControl()
+		setupAPIKeys()
+		setupTrustedProxies()
+		setupMaintenance()
+		setupAppointmentLinks()
+		setupModeration()
+		startWebhookWorkers()
+		setupJobs()
+		startScheduler()
+		setupEventStream()
+		setupAgentSockets()
+		startSearchAnalytics()
+		setupDebugCapture()
+		setupRequestTimeouts()
+		setupUploads()
+		startup.finish(routes())
+	}()
+	serve(startup)
+	drainJobs()
+}
+
+// routes builds the router of the API, wrapped in its middleware and CORS
+func routes() http.Handler {
+	r := router()
 
 	cors := handlers.CORS(
 		handlers.AllowedOrigins([]string{"*"}), // Allow requests from all origins
-		handlers.AllowedMethods([]string{"GET", "POST", "PUT", "DELETE", "OPTIONS"}),
-		handlers.AllowedHeaders([]string{"Content-Type", "X-API-Key"}),
+		handlers.AllowedMethods([]string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"}),
+		handlers.AllowedHeaders([]string{"Content-Type", "X-API-Key", "Authorization", captureHeader}),
 	)
 
+	// Flag routes that were added without an OpenAPI entry
+	for _, route := range undocumentedRoutes(r) {
+		log.Println("OpenAPI: route missing from apiDocs:", route)
+	}
+
 	// Create a new handler with CORS middleware
-	handler := cors(r)
+	return cors(r)
+}
+
+// router registers the routes of the API and their middleware
+func router() *mux.Router {
+	r := mux.NewRouter()
+	r.Use(withRequestID, throttleCredentials, withAPIKeyIdentity, captureBodies, withPlainQuery, withTimeout, withMaintenance, recordSearches, cacheResponses)
 
 	// Routes
 	r.HandleFunc("/properties", getProperties).Methods("GET")
-	r.HandleFunc("/inquiries", getInquires).Methods("GET")
-	r.HandleFunc("/appointments", getAppointments).Methods("GET")
-	r.HandleFunc("/users", getUsers).Methods("GET")
-	r.HandleFunc("/check/user", checkUser).Methods("GET")
+	r.Handle("/check/user", requireAPIKey(http.HandlerFunc(checkUser))).Methods("GET")
 	r.HandleFunc("/listings", getListings).Methods("GET")
-
-	r.HandleFunc("/users/getUserByEmail", getUserByEmail).Methods("GET")
+	r.HandleFunc("/listings/{id}/similar", getSimilarListings).Methods("GET")
+	r.HandleFunc("/listings/featured", getFeaturedListings).Methods("GET")
+	r.HandleFunc("/listings/batch", getListingsBatch).Methods("GET")
+	r.HandleFunc("/properties/batch", getPropertiesBatch).Methods("GET")
+	r.HandleFunc("/listings/new", getNewListings).Methods("GET")
+	r.HandleFunc("/listings/tags", getListingTags).Methods("GET")
+	r.HandleFunc("/listings/filter-bounds", getFilterBounds).Methods("GET")
+	r.HandleFunc("/listings/{id}/price-history", getListingPriceHistory).Methods("GET")
+	r.HandleFunc("/listings/{id}/booked-times", getListingBookedTimes).Methods("GET")
+	r.Handle("/listings/{id}/waitlist", requireAPIKey(http.HandlerFunc(getListingWaitlist))).Methods("GET")
+	r.HandleFunc("/listings/{id}/available-slots", getListingSlots).Methods("GET")
+	r.HandleFunc("/listings/{id}/qr.png", getListingQR).Methods("GET")
+	r.HandleFunc("/listings/{id}/brochure.pdf", getListingBrochure).Methods("GET")
+
+	r.Handle("/users/getUserByEmail", requireAPIKey(http.HandlerFunc(getUserByEmail))).Methods("GET")
+
+	r.HandleFunc("/stats/listings/price-by-bedroom", getPriceByBedroom).Methods("GET")
+	r.HandleFunc("/stats/listings/price-histogram", getPriceHistogram).Methods("GET")
+	r.HandleFunc("/stats/properties/engagement", getPropertyEngagement).Methods("GET")
+	r.HandleFunc("/stats/timeseries", getTimeseries).Methods("GET")
+
+	r.HandleFunc("/sync/listings", syncListings).Methods("GET")
+	r.HandleFunc("/sync/properties", syncProperties).Methods("GET")
 
 	r.HandleFunc("/add/property", createProperty).Methods("POST")
+	r.HandleFunc("/add/properties", createProperties).Methods("POST")
 	r.HandleFunc("/add/listing", createListing).Methods("POST")
 	r.HandleFunc("/add/inquiry", createInquiry).Methods("POST")
+	r.HandleFunc("/contact", submitContact).Methods("POST")
 	r.HandleFunc("/add/user", createUser).Methods("POST")
-
-	r.HandleFunc("/properties/{id}/images", uploadImage).Methods("POST")
+	r.HandleFunc("/add/appointment", createAppointment).Methods("POST")
+
+	r.Handle("/properties/{id}/images", requireUploads(http.HandlerFunc(uploadImage))).Methods("POST")
+	r.HandleFunc(moderationWebhookPath, moderationWebhook).Methods("POST")
+	r.HandleFunc("/properties/{id}/full", getPropertyFull).Methods("GET")
+	r.HandleFunc("/properties/{id}/activity", getPropertyActivity).Methods("GET")
+	r.HandleFunc("/properties/{id}/map.png", getPropertyMap).Methods("GET")
+	r.HandleFunc("/properties/{id}/stack", getPropertyStack).Methods("GET")
+	r.HandleFunc("/properties/popular", getPopularProperties).Methods("GET")
+	r.HandleFunc("/properties/search/polygon", searchPropertiesInPolygon).Methods("POST")
+	r.HandleFunc("/transit/stations", getTransitStations).Methods("GET")
+	r.Handle("/users/{id}/notifications", requireUserOrAPIKey(http.HandlerFunc(getUserNotifications))).Methods("GET")
+	r.Handle("/users/{id}/notifications/unread-count", requireUserOrAPIKey(http.HandlerFunc(getUnreadNotificationCount))).Methods("GET")
+	r.Handle("/users/{id}/notifications/mark-read", requireUserOrAPIKey(http.HandlerFunc(markNotificationsRead))).Methods("POST")
+	r.Handle("/users/{id}/devices", requireUserOrAPIKey(http.HandlerFunc(registerDevice))).Methods("POST")
+	r.Handle("/users/{id}/saved-searches", requireUserOrAPIKey(http.HandlerFunc(createSavedSearch))).Methods("POST")
+	r.Handle("/users/{id}/saved-searches", requireUserOrAPIKey(http.HandlerFunc(getSavedSearches))).Methods("GET")
+	r.Handle("/users/{id}/saved-searches/{search_id}", requireUserOrAPIKey(http.HandlerFunc(getSavedSearch))).Methods("GET")
+	r.Handle("/users/{id}/saved-searches/{search_id}", requireUserOrAPIKey(http.HandlerFunc(updateSavedSearch))).Methods("PUT")
+	r.Handle("/users/{id}/saved-searches/{search_id}", requireUserOrAPIKey(http.HandlerFunc(deleteSavedSearch))).Methods("DELETE")
+	r.HandleFunc("/saved-searches/unsubscribe", unsubscribeSavedSearch).Methods("GET", "POST")
+	r.Handle("/users/{id}/waitlist/{waitlist_id}", requireUserOrAPIKey(http.HandlerFunc(withdrawWaitlistEntry))).Methods("DELETE")
+	r.HandleFunc("/developers", getDevelopers).Methods("GET")
+	r.HandleFunc("/developers/{id}", getDeveloper).Methods("GET")
+	r.HandleFunc("/developers/{id}/properties", getDeveloperProperties).Methods("GET")
+	r.HandleFunc("/agents", getAgents).Methods("GET")
+	r.HandleFunc("/agents/{id}", getAgent).Methods("GET")
+	r.HandleFunc("/agents/{id}/listings", getAgentListings).Methods("GET")
+	r.HandleFunc("/properties/{id}/view", recordPropertyView).Methods("POST")
+	r.HandleFunc("/properties/{idOrSlug}", getProperty).Methods("GET")
+	r.HandleFunc("/listings/{idOrSlug}", getListing).Methods("GET")
+
+	r.Handle("/admin/listings/import", requireAPIKey(http.HandlerFunc(importListings))).Methods("POST")
+	r.Handle("/admin/stats", requireAPIKey(http.HandlerFunc(getAdminStats))).Methods("GET")
+	r.Handle("/listings/{id}", requireAPIKey(http.HandlerFunc(updateListing))).Methods("PUT")
+	r.Handle("/listings/{id}/deactivate", requireAPIKey(http.HandlerFunc(deactivateListing))).Methods("POST")
+	r.Handle("/listings/{id}/activate", requireAPIKey(http.HandlerFunc(activateListing))).Methods("POST")
+	r.Handle("/listings/{id}/publish", requireAPIKey(http.HandlerFunc(publishListing))).Methods("POST")
+	r.Handle("/listings/{id}/renew", requireAPIKey(http.HandlerFunc(renewListing))).Methods("POST")
+	r.Handle("/listings/{id}", requireAPIKey(http.HandlerFunc(deleteListing))).Methods("DELETE")
+	r.Handle("/properties/{id}", requireAPIKey(http.HandlerFunc(updateProperty))).Methods("PUT")
+	r.Handle("/properties/{id}/suggested-coordinates/confirm", requireAPIKey(http.HandlerFunc(confirmSuggestedCoordinates))).Methods("POST")
+	r.Handle("/properties/{id}/documents", requireAPIKey(requireUploads(http.HandlerFunc(uploadPropertyDocument)))).Methods("POST")
+	r.Handle("/properties/{id}/documents/{public_id:.+}", requireAPIKey(http.HandlerFunc(deletePropertyDocument))).Methods("DELETE")
+	r.Handle("/properties/{id}/floor-plans", requireAPIKey(requireUploads(http.HandlerFunc(uploadPropertyFloorPlan)))).Methods("POST")
+	r.Handle("/properties/{id}/floor-plans/{public_id:.+}", requireAPIKey(http.HandlerFunc(deletePropertyFloorPlan))).Methods("DELETE")
+	r.Handle("/listings/{id}/floor-plans", requireAPIKey(requireUploads(http.HandlerFunc(uploadListingFloorPlan)))).Methods("POST")
+	r.Handle("/listings/{id}/floor-plans/{public_id:.+}", requireAPIKey(http.HandlerFunc(deleteListingFloorPlan))).Methods("DELETE")
+	r.Handle("/properties/{id}/videos", requireAPIKey(http.HandlerFunc(addPropertyVideo))).Methods("POST")
+	r.Handle("/properties/{id}/videos", requireAPIKey(http.HandlerFunc(removePropertyVideo))).Methods("DELETE")
+	r.Handle("/listings/{id}/videos", requireAPIKey(http.HandlerFunc(addListingVideo))).Methods("POST")
+	r.Handle("/listings/{id}/videos", requireAPIKey(http.HandlerFunc(removeListingVideo))).Methods("DELETE")
+	r.Handle("/properties/{id}/images/{public_id:.+}", requireAPIKey(http.HandlerFunc(updatePropertyImage))).Methods("PATCH")
+	r.Handle("/listings/{id}/photos/{public_id:.+}", requireAPIKey(http.HandlerFunc(updateListingPhoto))).Methods("PATCH")
+	r.Handle("/properties/{id}", requireAPIKey(http.HandlerFunc(deleteProperty))).Methods("DELETE")
+	r.Handle("/users/{id}", requireAPIKey(http.HandlerFunc(getUser))).Methods("GET")
+	r.Handle("/users/{id}", requireAPIKey(http.HandlerFunc(deleteUser))).Methods("DELETE")
+	r.Handle("/developers", requireAPIKey(http.HandlerFunc(createDeveloper))).Methods("POST")
+	r.Handle("/developers/{id}", requireAPIKey(http.HandlerFunc(updateDeveloper))).Methods("PUT")
+	r.Handle("/developers/{id}", requireAPIKey(http.HandlerFunc(deleteDeveloper))).Methods("DELETE")
+	r.Handle("/admin/developers/{id}/merge", requireAPIKey(http.HandlerFunc(mergeDevelopers))).Methods("POST")
+	r.Handle("/agents", requireAPIKey(http.HandlerFunc(createAgent))).Methods("POST")
+	r.Handle("/agents/{id}", requireAPIKey(http.HandlerFunc(updateAgent))).Methods("PUT")
+	r.Handle("/agents/{id}", requireAPIKey(http.HandlerFunc(deleteAgent))).Methods("DELETE")
+	r.Handle("/agents/{id}/inquiries", requireAPIKey(http.HandlerFunc(getAgentInquiries))).Methods("GET")
+	r.Handle("/inquiries/{id}/assign", requireAPIKey(http.HandlerFunc(assignInquiry))).Methods("POST")
+	r.Handle("/inquiries/{id}/replied", requireAPIKey(http.HandlerFunc(markInquiryReplied))).Methods("POST")
+	r.Handle("/inquiries", requireAPIKey(http.HandlerFunc(getInquires))).Methods("GET")
+	r.Handle("/appointments", requireAPIKey(http.HandlerFunc(getAppointments))).Methods("GET")
+	r.Handle("/inquiries/{id}", requireAPIKey(http.HandlerFunc(getInquiry))).Methods("GET")
+	r.Handle("/users", requireAPIKey(http.HandlerFunc(getUsers))).Methods("GET")
+	r.Handle("/appointments/{id}/status", requireAPIKey(http.HandlerFunc(setAppointmentStatus))).Methods("POST")
+	r.Handle("/appointments/{id}/reschedule", requireAPIKey(http.HandlerFunc(rescheduleAppointment))).Methods("POST")
+	r.HandleFunc("/appointments/confirm", appointmentLinkHandler(appointmentLinkConfirm)).Methods("GET", "POST")
+	r.HandleFunc("/appointments/cancel", appointmentLinkHandler(appointmentLinkCancel)).Methods("GET", "POST")
+	r.Handle("/appointments/{id}", requireAPIKey(http.HandlerFunc(getAppointment))).Methods("GET")
+	r.Handle("/admin/digest/preview", requireAPIKey(http.HandlerFunc(previewDigest))).Methods("POST")
+	r.Handle("/admin/push/test", requireAPIKey(http.HandlerFunc(sendTestPush))).Methods("POST")
+	r.Handle("/admin/ranking-weights", requireAPIKey(http.HandlerFunc(getRankingWeights))).Methods("GET")
+	r.Handle("/admin/ranking-weights", requireAPIKey(http.HandlerFunc(updateRankingWeights))).Methods("PUT")
+	r.Handle("/admin/slow-queries", requireAPIKey(http.HandlerFunc(getSlowQueries))).Methods("GET")
+	r.Handle("/admin/db-health", requireAPIKey(http.HandlerFunc(getDBHealth))).Methods("GET")
+	r.Handle("/admin/requests/{request_id}", requireAPIKey(http.HandlerFunc(getRequestCapture))).Methods("GET")
+	r.Handle("/admin/analytics/searches", requireAPIKey(http.HandlerFunc(getSearchAnalytics))).Methods("GET")
+	r.Handle("/admin/analytics/inquiry-sources", requireAPIKey(http.HandlerFunc(getInquirySources))).Methods("GET")
+	r.Handle("/admin/archive", requireAPIKey(http.HandlerFunc(runArchive))).Methods("POST")
+	r.Handle("/metrics", requireAPIKey(http.HandlerFunc(getMetrics))).Methods("GET")
+	r.Handle("/admin/maintenance", requireAPIKey(http.HandlerFunc(getMaintenance))).Methods("GET")
+	r.Handle("/admin/maintenance", requireAPIKey(http.HandlerFunc(setMaintenance))).Methods("POST")
+	r.Handle("/admin/api-keys", requireAPIKey(http.HandlerFunc(getAPIKeys))).Methods("GET")
+	r.Handle("/admin/api-keys", requireAPIKey(http.HandlerFunc(createAPIKey))).Methods("POST")
+	r.Handle("/admin/api-keys/{id}", requireAPIKey(http.HandlerFunc(revokeAPIKey))).Methods("DELETE")
+	r.Handle("/admin/api-keys/{id}/usage", requireAPIKey(http.HandlerFunc(getAPIKeyUsage))).Methods("GET")
+	r.Handle("/admin/webhooks", requireAPIKey(http.HandlerFunc(getWebhookSubscriptions))).Methods("GET")
+	r.Handle("/admin/webhooks", requireAPIKey(http.HandlerFunc(createWebhookSubscription))).Methods("POST")
+	r.Handle("/admin/webhooks/dead-letters", requireAPIKey(http.HandlerFunc(getWebhookDeadLetters))).Methods("GET")
+	r.Handle("/admin/webhooks/dead-letters/{id}/redeliver", requireAPIKey(http.HandlerFunc(redeliverWebhook))).Methods("POST")
+	r.Handle("/admin/webhooks/{id}", requireAPIKey(http.HandlerFunc(deleteWebhookSubscription))).Methods("DELETE")
+	r.Handle("/events/stream", requireAPIKey(http.HandlerFunc(getEventStream))).Methods("GET")
+	r.HandleFunc("/ws", serveAgentSocket).Methods("GET")
+	r.Handle("/agents/{id}/token", requireAPIKey(http.HandlerFunc(createAgentToken))).Methods("POST")
+	r.Handle("/users/{id}/token", requireAPIKey(http.HandlerFunc(createUserToken))).Methods("POST")
+	r.Handle("/agents/{id}/availability", requireAgentOrAPIKey(http.HandlerFunc(getAgentAvailability))).Methods("GET")
+	r.Handle("/agents/{id}/availability", requireAgentOrAPIKey(http.HandlerFunc(setAgentAvailability))).Methods("PUT")
+	r.Handle("/admin/scheduler", requireAPIKey(http.HandlerFunc(getScheduler))).Methods("GET")
+	r.Handle("/admin/jobs", requireAPIKey(http.HandlerFunc(getJobs))).Methods("GET")
+	r.Handle("/admin/jobs/{id}/retry", requireAPIKey(http.HandlerFunc(retryJob))).Methods("POST")
+	r.Handle("/admin/shortlinks", requireAPIKey(http.HandlerFunc(createShortLink))).Methods("POST")
+	r.Handle("/admin/shortlinks/{code}/stats", requireAPIKey(http.HandlerFunc(getShortLinkStats))).Methods("GET")
+	r.HandleFunc("/l/{code}", followShortLink).Methods("GET")
+	r.Handle("/admin/agents/stats", requireAPIKey(http.HandlerFunc(getAgentStats))).Methods("GET")
+	r.Handle("/listings/{id}/restore", requireAPIKey(http.HandlerFunc(restoreListing))).Methods("POST")
+	r.Handle("/properties/{id}/restore", requireAPIKey(http.HandlerFunc(restoreProperty))).Methods("POST")
+	r.Handle("/users/{id}/restore", requireAPIKey(http.HandlerFunc(restoreUser))).Methods("POST")
+	r.Handle("/admin/reports/orphaned-listings", requireAPIKey(http.HandlerFunc(getOrphanedListings))).Methods("GET")
+	r.Handle("/admin/reports/inconsistencies", requireAPIKey(http.HandlerFunc(getInconsistencyReport))).Methods("GET")
+	r.Handle("/admin/consistency", requireAPIKey(http.HandlerFunc(getConsistency))).Methods("GET")
+	r.Handle("/admin/consistency/reports/{id}", requireAPIKey(http.HandlerFunc(getConsistencyReport))).Methods("GET")
+	r.Handle("/admin/reports/duplicate-images", requireAPIKey(http.HandlerFunc(getDuplicateImages))).Methods("GET")
+	r.Handle("/admin/audit", requireAPIKey(http.HandlerFunc(getAuditLog))).Methods("GET")
+	r.Handle("/admin/purge", requireAPIKey(http.HandlerFunc(purgeDeleted))).Methods("POST")
+	r.Handle("/admin/images/watermark", requireAPIKey(http.HandlerFunc(rewriteWatermarks))).Methods("POST")
+	r.Handle("/admin/listings/{id}/featured", requireAPIKey(http.HandlerFunc(setListingFeatured))).Methods("PATCH")
+	r.HandleFunc("/listings/{id}/request-verification", requestListingVerification).Methods("POST")
+	r.HandleFunc("/listings/{id}/verification", getListingVerification).Methods("GET")
+	r.Handle("/admin/listings/verification-queue", requireAPIKey(http.HandlerFunc(getVerificationQueue))).Methods("GET")
+	r.Handle("/admin/listings/{id}/verification/approve", requireAPIKey(http.HandlerFunc(approveListingVerification))).Methods("POST")
+	r.Handle("/admin/listings/{id}/verification/reject", requireAPIKey(http.HandlerFunc(rejectListingVerification))).Methods("POST")
 
 	r.HandleFunc("/users", updateUser).Methods("PUT")
 
+	registerGraphQL(r)
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8000" // Default port to 8000 if PORT environment variable is not set
-	}
-	fmt.Println("Server is running on port:", port)
-	log.Fatal(http.ListenAndServe(":"+port, handler))
+	r.HandleFunc("/healthz", healthz).Methods("GET")
+	r.HandleFunc("/openapi.json", openAPIHandler(r)).Methods("GET")
+	r.HandleFunc("/docs", swaggerUI).Methods("GET")
+
+	return r
 }
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// TestCORSPreflightPatch checks browsers may send the PATCH routes cross-origin
+func TestCORSPreflightPatch(t *testing.T) {
+	handler := routes()
+	for _, path := range []string{
+		"/properties/0123456789abcdef01234567/images/mv/abc.jpg",
+		"/listings/0123456789abcdef01234567/photos/mv/abc.jpg",
+		"/admin/listings/0123456789abcdef01234567/featured",
+	} {
+		req := httptest.NewRequest(http.MethodOptions, path, nil)
+		req.Header.Set("Origin", "https://app.example.com")
+		req.Header.Set("Access-Control-Request-Method", http.MethodPatch)
+		req.Header.Set("Access-Control-Request-Headers", "Content-Type")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Errorf("preflight of PATCH %s: status %d", path, rec.Code)
+		}
+		if !strings.Contains(rec.Header().Get("Access-Control-Allow-Methods"), http.MethodPatch) {
+			t.Errorf("preflight of PATCH %s: Access-Control-Allow-Methods %q", path, rec.Header().Get("Access-Control-Allow-Methods"))
+		}
+	}
+}
+
+// useTestKeys configures the shared API_KEY and the token secret for the test
+func useTestKeys(t *testing.T) {
+	t.Helper()
+	prevKey, prevSecret := apiKey, agentJWTSecret
+	apiKey, agentJWTSecret = "test-shared-key", []byte("test-token-secret")
+	t.Cleanup(func() { apiKey, agentJWTSecret = prevKey, prevSecret })
+}
+
+// cacheTestAPIKey makes key a stored partner key with scopes without going to Mongo
+func cacheTestAPIKey(t *testing.T, key string, scopes ...string) {
+	t.Helper()
+	cacheAPIKeyLookup(t, key, &apiKeyIdentity{ID: "test-" + key, Name: key, Scopes: scopes})
+}
+
+// cacheAPIKeyLookup makes lookupAPIKey return identity for key, nil for an unknown key
+func cacheAPIKeyLookup(t *testing.T, key string, identity *apiKeyIdentity) {
+	t.Helper()
+	hash := hashAPIKey(key)
+	apiKeyCache.Lock()
+	apiKeyCache.entries[hash] = cachedAPIKey{identity: identity, expiresAt: time.Now().Add(time.Hour)}
+	apiKeyCache.Unlock()
+	t.Cleanup(func() {
+		apiKeyCache.Lock()
+		delete(apiKeyCache.entries, hash)
+		apiKeyCache.Unlock()
+	})
+}
+
+// stubRouter serves each "METHOD /template" with a handler answering 200, wrapped in middleware
+func stubRouter(middleware func(http.Handler) http.Handler, routes ...string) http.Handler {
+	r := mux.NewRouter()
+	r.Use(withAPIKeyIdentity)
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) })
+	for _, route := range routes {
+		method, template, _ := strings.Cut(route, " ")
+		r.Handle(template, middleware(ok)).Methods(method)
+	}
+	return r
+}
+
+// skipMaintenanceLookup makes withMaintenance use a fresh "off" state instead of reading Mongo
+func skipMaintenanceLookup(t *testing.T) {
+	t.Helper()
+	useMaintenance(t, maintenanceState{})
+}
+
+var testMongo struct {
+	once   sync.Once
+	client *mongo.Client
+	err    error
+}
+
+// useTestMongo points client at TEST_MONGODB_URI for the test, which is skipped when it isn't set.
+// The handlers use the MVDB database, so the URI must be a throwaway server: collections are dropped
+// before the test and after it.
+func useTestMongo(t testing.TB, collections ...string) {
+	t.Helper()
+	uri := os.Getenv("TEST_MONGODB_URI")
+	if uri == "" {
+		t.Skip("TEST_MONGODB_URI not set")
+	}
+	testMongo.once.Do(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if testMongo.client, testMongo.err = mongo.Connect(ctx, options.Client().ApplyURI(uri)); testMongo.err == nil {
+			testMongo.err = testMongo.client.Ping(ctx, nil)
+		}
+	})
+	if testMongo.err != nil {
+		t.Fatal("TEST_MONGODB_URI:", testMongo.err)
+	}
+	prev := client
+	client = testMongo.client
+	drop := func() {
+		for _, name := range collections {
+			if err := client.Database("MVDB").Collection(name).Drop(context.Background()); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+	drop()
+	t.Cleanup(func() {
+		drop()
+		client = prev
+	})
+}
+
+// testClientIP is the RemoteAddr host of httptest.NewRequest
+const testClientIP = "192.0.2.1"
+
+// cacheTestLoginAttempts makes the login throttle see attempts instead of reading login_attempts
+func cacheTestLoginAttempts(t *testing.T, attempts ...loginAttempts) {
+	t.Helper()
+	for _, a := range attempts {
+		cacheLoginAttempts(a)
+	}
+	t.Cleanup(func() {
+		loginAttemptsCache.Lock()
+		for _, a := range attempts {
+			delete(loginAttemptsCache.entries, a.Key)
+		}
+		loginAttemptsCache.Unlock()
+	})
+}
+
+// skipLoginThrottle gives the test client a clean slate with the login throttle
+func skipLoginThrottle(t *testing.T) {
+	t.Helper()
+	cacheTestLoginAttempts(t, loginAttempts{Key: "ip:" + testClientIP})
+}
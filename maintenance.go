@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/99designs/gqlgen/graphql"
+	"github.com/gorilla/mux"
+	"github.com/vektah/gqlparser/v2/ast"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Maintenance mode keeps the API readable but answers every POST, PUT, PATCH and DELETE (and
+// GraphQL mutation) with 503, apart from the read-only POSTs in maintenanceOpenRoutes. It is on when
+// MAINTENANCE_MODE=on at boot, which only affects that instance, or when POST /admin/maintenance
+// turned it on in the settings collection, which every instance picks up within maintenanceMaxAge.
+// POST /admin/maintenance itself always stays writable.
+// Background jobs such as listing expiry keep running.
+const (
+	maintenanceID         = "maintenance"
+	maintenanceMaxAge     = 5 * time.Second
+	defaultMaintenanceMsg = "The API is in maintenance mode and read-only, try again later"
+	defaultRetryAfter     = 300 // seconds
+	maintenancePath       = "/admin/maintenance"
+)
+
+type maintenanceState struct {
+	Enabled    bool      `bson:"enabled" json:"enabled"`
+	Message    string    `bson:"message,omitempty" json:"message,omitempty"`
+	RetryAfter int       `bson:"retry_after_seconds,omitempty" json:"retry_after_seconds,omitempty"`
+	UpdatedAt  time.Time `bson:"updated_at" json:"updated_at"`
+}
+
+var maintenanceFromEnv bool
+
+var maintenanceCache struct {
+	sync.Mutex
+	state    maintenanceState
+	loadedAt time.Time
+	loading  chan struct{} // closed once the read in flight is done, nil when there is none
+}
+
+// loadMaintenance reads the stored state, replaced by the tests
+var loadMaintenance = func(ctx context.Context) (maintenanceState, error) {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	var state maintenanceState
+	err := client.Database("MVDB").Collection("settings").FindOne(ctx, bson.M{"_id": maintenanceID}).Decode(&state)
+	if err == mongo.ErrNoDocuments {
+		return maintenanceState{}, nil
+	}
+	return state, err
+}
+
+func setupMaintenance() {
+	if os.Getenv("MAINTENANCE_MODE") == "on" {
+		maintenanceFromEnv = true
+		log.Println("MAINTENANCE_MODE is on, this instance refuses writes until restarted without it")
+	}
+}
+
+// currentMaintenance returns the stored state, read at most once per maintenanceMaxAge. When it
+// can't be read the previous state is kept, so a Mongo hiccup doesn't flip the mode. One request
+// reads it while the others go on with the previous state, or wait for it before the first read.
+func currentMaintenance(ctx context.Context) maintenanceState {
+	maintenanceCache.Lock()
+	if !maintenanceCache.loadedAt.IsZero() && time.Since(maintenanceCache.loadedAt) < maintenanceMaxAge {
+		defer maintenanceCache.Unlock()
+		return maintenanceCache.state
+	}
+	if loading := maintenanceCache.loading; loading != nil {
+		if !maintenanceCache.loadedAt.IsZero() {
+			defer maintenanceCache.Unlock()
+			return maintenanceCache.state
+		}
+		maintenanceCache.Unlock()
+		select {
+		case <-loading:
+		case <-ctx.Done():
+		}
+		maintenanceCache.Lock()
+		defer maintenanceCache.Unlock()
+		return maintenanceCache.state
+	}
+	loading := make(chan struct{})
+	maintenanceCache.loading = loading
+	maintenanceCache.Unlock()
+
+	state, err := loadMaintenance(ctx)
+
+	maintenanceCache.Lock()
+	defer maintenanceCache.Unlock()
+	close(loading)
+	if maintenanceCache.loading != loading {
+		return maintenanceCache.state // setMaintenance stored a newer state meanwhile
+	}
+	if err != nil {
+		log.Println("Failed to load the maintenance mode, keeping the previous one:", err)
+	} else {
+		maintenanceCache.state = state
+	}
+	maintenanceCache.loadedAt = time.Now() // after a failure, retried after maintenanceMaxAge and not on every request
+	maintenanceCache.loading = nil
+	return maintenanceCache.state
+}
+
+// inMaintenance returns the state writes are refused with, or nil when they are allowed
+func inMaintenance(ctx context.Context) *maintenanceState {
+	state := currentMaintenance(ctx)
+	if !state.Enabled && !maintenanceFromEnv {
+		return nil
+	}
+	if state.Message == "" {
+		state.Message = defaultMaintenanceMsg
+	}
+	if state.RetryAfter <= 0 {
+		state.RetryAfter = defaultRetryAfter
+	}
+	return &state
+}
+
+// maintenanceOpenRoutes are the POSTs withMaintenance lets through, keyed by "METHOD /path/template"
+// as registered on the router: the maintenance switch, GraphQL, whose mutations
+// refuseMutationsInMaintenance turns away, and the searches and previews that only read
+var maintenanceOpenRoutes = map[string]bool{
+	"POST " + maintenancePath:         true,
+	"POST /graphql":                   true,
+	"POST /properties/search/polygon": true,
+	"POST /admin/digest/preview":      true,
+}
+
+// withMaintenance refuses writes during maintenance, except for maintenanceOpenRoutes
+func withMaintenance(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		default:
+			next.ServeHTTP(w, r)
+			return
+		}
+		var route string
+		if current := mux.CurrentRoute(r); current != nil {
+			route, _ = current.GetPathTemplate()
+		}
+		if maintenanceOpenRoutes[r.Method+" "+route] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if state := inMaintenance(r.Context()); state != nil {
+			w.Header().Set("Retry-After", strconv.Itoa(state.RetryAfter))
+			http.Error(w, state.Message, http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// refuseMutationsInMaintenance answers GraphQL mutations with an error during maintenance
+func refuseMutationsInMaintenance(ctx context.Context, next graphql.OperationHandler) graphql.ResponseHandler {
+	op := graphql.GetOperationContext(ctx).Operation
+	if op != nil && op.Operation == ast.Mutation {
+		if state := inMaintenance(ctx); state != nil {
+			return graphql.OneShot(graphql.ErrorResponse(ctx, "%s", state.Message))
+		}
+	}
+	return next(ctx)
+}
+
+func getMaintenance(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	state := currentMaintenance(r.Context())
+	json.NewEncoder(w).Encode(bson.M{"maintenance": state, "instance_env_override": maintenanceFromEnv})
+}
+
+// setMaintenance turns maintenance mode on or off for every instance. Body: {"enabled": true,
+// "message": "...", "retry_after_seconds": 600}; message and retry_after_seconds are optional.
+func setMaintenance(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var state maintenanceState
+	if err := json.NewDecoder(r.Body).Decode(&state); err != nil {
+		http.Error(w, "Failed to parse request body", http.StatusBadRequest)
+		return
+	}
+	if state.RetryAfter < 0 {
+		http.Error(w, "retry_after_seconds must not be negative", http.StatusBadRequest)
+		return
+	}
+	state.UpdatedAt = time.Now()
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	before := currentMaintenance(ctx)
+	_, err := client.Database("MVDB").Collection("settings").ReplaceOne(ctx,
+		bson.M{"_id": maintenanceID}, state, options.Replace().SetUpsert(true))
+	if err != nil {
+		serverError(w, r, "Failed to update maintenance mode", err)
+		return
+	}
+	maintenanceCache.Lock()
+	maintenanceCache.state, maintenanceCache.loadedAt = state, time.Now()
+	maintenanceCache.loading = nil // a read in flight started before the change, see currentMaintenance
+	maintenanceCache.Unlock()
+
+	recordAudit(auditFromRequest(r), "update", "settings", maintenanceID, before, state, nil)
+	json.NewEncoder(w).Encode(bson.M{"maintenance": state, "instance_env_override": maintenanceFromEnv})
+}
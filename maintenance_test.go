@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// blockMaintenanceLoad makes the maintenance reads wait for release and answer state; the returned
+// channel gets a value as each read starts
+func blockMaintenanceLoad(t *testing.T, loadedAt time.Time, cached maintenanceState) (started chan struct{}, release func(maintenanceState), loads *int32) {
+	t.Helper()
+	maintenanceCache.Lock()
+	prevState, prevAt := maintenanceCache.state, maintenanceCache.loadedAt
+	maintenanceCache.state, maintenanceCache.loadedAt, maintenanceCache.loading = cached, loadedAt, nil
+	maintenanceCache.Unlock()
+	prevLoad := loadMaintenance
+
+	started = make(chan struct{}, 10)
+	answer := make(chan maintenanceState, 1)
+	loads = new(int32)
+	loadMaintenance = func(ctx context.Context) (maintenanceState, error) {
+		atomic.AddInt32(loads, 1)
+		started <- struct{}{}
+		return <-answer, nil
+	}
+	t.Cleanup(func() {
+		loadMaintenance = prevLoad
+		maintenanceCache.Lock()
+		maintenanceCache.state, maintenanceCache.loadedAt, maintenanceCache.loading = prevState, prevAt, nil
+		maintenanceCache.Unlock()
+	})
+	return started, func(s maintenanceState) { answer <- s }, loads
+}
+
+// TestCurrentMaintenanceRefreshDoesNotBlock: while one request refreshes the stale state, the others
+// answer from the previous one instead of queueing behind the read
+func TestCurrentMaintenanceRefreshDoesNotBlock(t *testing.T) {
+	started, release, loads := blockMaintenanceLoad(t, time.Now().Add(-time.Minute), maintenanceState{Enabled: true})
+
+	refreshed := make(chan maintenanceState, 1)
+	go func() { refreshed <- currentMaintenance(context.Background()) }()
+	<-started
+
+	for i := 0; i < 5; i++ {
+		done := make(chan maintenanceState, 1)
+		go func() { done <- currentMaintenance(context.Background()) }()
+		select {
+		case state := <-done:
+			if !state.Enabled {
+				t.Error("a request during the refresh didn't get the previous state")
+			}
+		case <-time.After(time.Second):
+			t.Fatal("a request waited for the refresh")
+		}
+	}
+
+	release(maintenanceState{Message: "off again"})
+	if state := <-refreshed; state.Enabled || state.Message != "off again" {
+		t.Errorf("the refreshing request got %+v", state)
+	}
+	if state := currentMaintenance(context.Background()); state.Message != "off again" {
+		t.Errorf("after the refresh: %+v", state)
+	}
+	if n := atomic.LoadInt32(loads); n != 1 {
+		t.Errorf("%d reads, want 1", n)
+	}
+}
+
+// TestCurrentMaintenanceFirstLoadWaits: before the first read there is no previous state to fall back
+// on, so a write mustn't slip through as if maintenance were off
+func TestCurrentMaintenanceFirstLoadWaits(t *testing.T) {
+	started, release, loads := blockMaintenanceLoad(t, time.Time{}, maintenanceState{})
+
+	first := make(chan maintenanceState, 1)
+	go func() { first <- currentMaintenance(context.Background()) }()
+	<-started
+	second := make(chan maintenanceState, 1)
+	go func() { second <- currentMaintenance(context.Background()) }()
+	select {
+	case <-second:
+		t.Fatal("a request didn't wait for the first read")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	release(maintenanceState{Enabled: true})
+	for _, c := range []chan maintenanceState{first, second} {
+		if state := <-c; !state.Enabled {
+			t.Errorf("got %+v, want the state of the first read", state)
+		}
+	}
+	if n := atomic.LoadInt32(loads); n != 1 {
+		t.Errorf("%d reads, want 1", n)
+	}
+
+	// a request whose context ends stops waiting
+	maintenanceCache.Lock()
+	maintenanceCache.loadedAt = time.Time{}
+	maintenanceCache.Unlock()
+	reading := make(chan maintenanceState, 1)
+	go func() { reading <- currentMaintenance(context.Background()) }()
+	<-started
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	currentMaintenance(ctx)
+	release(maintenanceState{})
+	<-reading
+}
+
+// useMaintenance makes withMaintenance see state instead of reading Mongo
+func useMaintenance(t *testing.T, state maintenanceState) {
+	t.Helper()
+	maintenanceCache.Lock()
+	prev, prevAt := maintenanceCache.state, maintenanceCache.loadedAt
+	maintenanceCache.state, maintenanceCache.loadedAt = state, time.Now().Add(time.Hour)
+	maintenanceCache.Unlock()
+	t.Cleanup(func() {
+		maintenanceCache.Lock()
+		maintenanceCache.state, maintenanceCache.loadedAt = prev, prevAt
+		maintenanceCache.Unlock()
+	})
+}
+
+// TestMaintenanceOpenRoutes: during maintenance the read-only POSTs still answer, writes get 503
+func TestMaintenanceOpenRoutes(t *testing.T) {
+	useMaintenance(t, maintenanceState{Enabled: true, Message: "Upgrading", RetryAfter: 60})
+	tests := []struct {
+		route string
+		want  int
+	}{
+		{"POST /properties/search/polygon", http.StatusOK},
+		{"POST /admin/digest/preview", http.StatusOK},
+		{"POST /admin/maintenance", http.StatusOK},
+		{"POST /graphql", http.StatusOK},
+		{"GET /properties", http.StatusOK},
+		{"POST /add/property", http.StatusServiceUnavailable},
+		{"POST /properties/{id}/view", http.StatusServiceUnavailable},
+		{"PUT /listings/{id}", http.StatusServiceUnavailable},
+		{"DELETE /admin/maintenance", http.StatusServiceUnavailable},
+	}
+	var routes []string
+	for _, tt := range tests {
+		routes = append(routes, tt.route)
+	}
+	handler := stubRouter(withMaintenance, routes...)
+	for _, tt := range tests {
+		method, tmpl, _ := strings.Cut(tt.route, " ")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(method, routeVar.ReplaceAllString(tmpl, "0123456789abcdef01234567"), nil))
+		if rec.Code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.route, rec.Code, tt.want)
+		}
+		if tt.want == http.StatusServiceUnavailable && (rec.Header().Get("Retry-After") != "60" || !strings.Contains(rec.Body.String(), "Upgrading")) {
+			t.Errorf("%s: Retry-After %q, body %q", tt.route, rec.Header().Get("Retry-After"), rec.Body)
+		}
+	}
+
+	registered := registeredRoutes(t, router())
+	for route := range maintenanceOpenRoutes {
+		if !slices.Contains(registered, route) {
+			t.Errorf("maintenanceOpenRoutes lists %s, which isn't routed", route)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// GET /metrics exports counters, gauges and histograms in the Prometheus text format (0.0.4).
+// Features register their metrics once, at package init or in their setup, on the metrics registry;
+// there are no labels, a metric that needs one is registered once per value instead.
+type metricsRegistry struct {
+	mu      sync.Mutex
+	metrics []registeredMetric
+}
+
+type registeredMetric struct {
+	name, help, kind string
+	write            func(w *bufio.Writer, name string)
+}
+
+var metrics = &metricsRegistry{}
+
+func (m *metricsRegistry) register(name, help, kind string, write func(w *bufio.Writer, name string)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.metrics = append(m.metrics, registeredMetric{name: name, help: help, kind: kind, write: write})
+}
+
+// metricCounter only goes up
+type metricCounter struct {
+	n atomic.Uint64
+}
+
+func (c *metricCounter) Inc() { c.n.Add(1) }
+
+func (m *metricsRegistry) counter(name, help string) *metricCounter {
+	c := &metricCounter{}
+	m.register(name, help, "counter", func(w *bufio.Writer, name string) {
+		writeSample(w, name, "", float64(c.n.Load()))
+	})
+	return c
+}
+
+// gauge reports the value of f at scrape time
+func (m *metricsRegistry) gauge(name, help string, f func() float64) {
+	m.register(name, help, "gauge", func(w *bufio.Writer, name string) {
+		writeSample(w, name, "", f())
+	})
+}
+
+// metricHistogram counts observations into cumulative buckets, upper bounds in seconds
+type metricHistogram struct {
+	mu      sync.Mutex
+	bounds  []float64
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+func (h *metricHistogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, bound := range h.bounds {
+		if v <= bound {
+			h.buckets[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+func (m *metricsRegistry) histogram(name, help string, bounds []float64) *metricHistogram {
+	h := &metricHistogram{bounds: bounds, buckets: make([]uint64, len(bounds))}
+	m.register(name, help, "histogram", func(w *bufio.Writer, name string) {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		for i, bound := range h.bounds {
+			writeSample(w, name+"_bucket", `le="`+formatMetric(bound)+`"`, float64(h.buckets[i]))
+		}
+		writeSample(w, name+"_bucket", `le="+Inf"`, float64(h.count))
+		writeSample(w, name+"_sum", "", h.sum)
+		writeSample(w, name+"_count", "", float64(h.count))
+	})
+	return h
+}
+
+func writeSample(w *bufio.Writer, name, labels string, v float64) {
+	w.WriteString(name)
+	if labels != "" {
+		w.WriteString("{" + labels + "}")
+	}
+	w.WriteString(" " + formatMetric(v) + "\n")
+}
+
+func formatMetric(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// getMetrics answers GET /metrics
+func getMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+
+	metrics.mu.Lock()
+	list := append([]registeredMetric(nil), metrics.metrics...)
+	metrics.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, m := range list {
+		bw.WriteString("# HELP " + m.name + " " + m.help + "\n")
+		bw.WriteString("# TYPE " + m.name + " " + m.kind + "\n")
+		m.write(bw, m.name)
+	}
+	bw.Flush()
+}
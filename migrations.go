@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// migrations are the steps of `migrate`, each also runnable alone as `migrate <name> [args]`
+var migrations = map[string]func(ctx context.Context, args []string) error{
+	"dedup-users":      dedupUsers,
+	"indexes":          createIndexes,
+	"backfill":         backfillMissingFields,
+	"normalize-fields": normalizeFieldNames,
+	"validators":       applyValidators,
+	"slugs":            backfillSlugs,
+	"locations":        backfillLocations,
+	"developers":       backfillDevelopers,
+}
+
+// migrationOrder is what a bare `migrate` runs, as a deploy step before the new code serves traffic.
+// Duplicate users are merged before the indexes, whose unique email index they would break. Field names
+// are normalized next since every later step queries the new names, and validators are applied once
+// the backfill filled the fields they require.
+var migrationOrder = []string{"dedup-users", "indexes", "normalize-fields", "backfill", "validators", "slugs", "locations", "developers"}
+
+// runMigrate is `migrate [name [args]]`. Every migration is idempotent, so a failed run can simply be
+// repeated.
+func runMigrate(args []string) error {
+	names := migrationOrder
+	if len(args) > 0 {
+		if migrations[args[0]] == nil {
+			return usageError(fmt.Sprintf("usage: %s migrate [%s]", os.Args[0], strings.Join(migrationOrder, "|")))
+		}
+		names = args[:1]
+	}
+
+	connectMongoDB()
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
+	defer cancel()
+	for _, name := range names {
+		var stepArgs []string
+		if len(args) > 0 {
+			stepArgs = args[1:]
+		}
+		log.Println("Running migration", name)
+		if err := migrations[name](ctx, stepArgs); err != nil {
+			return fmt.Errorf("migration %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// legacyFieldNames maps the old mixed-case field names to their snake_case names, per collection.
+// users and listings were already snake_case. JSON names are unchanged, so API clients aren't affected.
+var legacyFieldNames = map[string]map[string]string{
+	"properties": {
+		"Title":       "title",
+		"Developer":   "developer",
+		"Description": "description",
+		"Coordinates": "coordinates",
+		"MinPrice":    "min_price",
+		"MaxPrice":    "max_price",
+		"Facilities":  "facilities",
+		"Images":      "images",
+		"Built":       "built",
+		"Created_at":  "created_at",
+		"Updated_at":  "updated_at",
+		"Views":       "views",
+	},
+	"appointments": {
+		"User_id":          "user_id",
+		"Property_id":      "property_id",
+		"Listing_id":       "listing_id",
+		"Appointment_date": "appointment_date",
+		"Status":           "status",
+		"Created_at":       "created_at",
+	},
+	"inquiries": {
+		"Created_at": "created_at",
+	},
+}
+
+// normalizeFieldNames renames the legacy fields in place with one $rename UpdateMany per collection.
+// It is idempotent; documents that are already migrated don't match the filter.
+// Queries use the new names, so run it as part of the deploy; until then decodeLegacyFields keeps
+// unmigrated documents readable.
+func normalizeFieldNames(ctx context.Context, args []string) error {
+	db := client.Database("MVDB")
+	for collectionName, renames := range legacyFieldNames {
+		exists := bson.A{}
+		for old := range renames {
+			exists = append(exists, bson.M{old: bson.M{"$exists": true}})
+		}
+		res, err := db.Collection(collectionName).UpdateMany(ctx, bson.M{"$or": exists}, bson.M{"$rename": renames})
+		if err != nil {
+			return fmt.Errorf("%s: %w", collectionName, err)
+		}
+		log.Printf("%s: renamed fields on %d documents", collectionName, res.ModifiedCount)
+	}
+	return nil
+}
+
+// decodeLegacyFields decodes a document written before normalize-fields ran, mapping old field names
+// to new ones. When a document has both, the new one wins. Remove once the migration ran everywhere.
+func decodeLegacyFields(data []byte, renames map[string]string, out interface{}) error {
+	raw := bson.Raw(data)
+	elems, err := raw.Elements()
+	if err != nil {
+		return err
+	}
+	legacy := false
+	for _, e := range elems {
+		if _, ok := renames[e.Key()]; ok {
+			legacy = true
+			break
+		}
+	}
+	if !legacy {
+		return bson.Unmarshal(data, out)
+	}
+
+	doc := make(bson.D, 0, len(elems))
+	for _, e := range elems {
+		key := e.Key()
+		if renamed, ok := renames[key]; ok {
+			if _, err := raw.LookupErr(renamed); err == nil {
+				continue
+			}
+			key = renamed
+		}
+		doc = append(doc, bson.E{Key: key, Value: e.Value()})
+	}
+	converted, err := bson.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return bson.Unmarshal(converted, out)
+}
+
+func (p *Property) UnmarshalBSON(data []byte) error {
+	type plain Property
+	return decodeLegacyFields(data, legacyFieldNames["properties"], (*plain)(p))
+}
+
+func (a *Appointment) UnmarshalBSON(data []byte) error {
+	type plain Appointment
+	return decodeLegacyFields(data, legacyFieldNames["appointments"], (*plain)(a))
+}
+
+func (i *Inquiry) UnmarshalBSON(data []byte) error {
+	type plain Inquiry
+	return decodeLegacyFields(data, legacyFieldNames["inquiries"], (*plain)(i))
+}
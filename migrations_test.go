@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestDecodeLegacyFields(t *testing.T) {
+	created := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	later := created.Add(24 * time.Hour)
+	id := primitive.NewObjectID()
+
+	properties := []struct {
+		name string
+		doc  bson.M
+	}{
+		{"legacy", bson.M{"_id": id, "Title": "Noble Ploenchit", "Developer": "Noble", "MinPrice": 5000000, "MaxPrice": 9000000,
+			"Coordinates": bson.A{13.7437, 100.5486}, "Facilities": bson.A{"Pool"}, "Built": 2016, "Created_at": created}},
+		{"new", bson.M{"_id": id, "title": "Noble Ploenchit", "developer": "Noble", "min_price": 5000000, "max_price": 9000000,
+			"coordinates": bson.A{13.7437, 100.5486}, "facilities": bson.A{"Pool"}, "built": 2016, "created_at": created}},
+		{"half migrated", bson.M{"_id": id, "Title": "Noble Ploenchit", "developer": "Noble", "MinPrice": 5000000, "max_price": 9000000,
+			"coordinates": bson.A{13.7437, 100.5486}, "Facilities": bson.A{"Pool"}, "built": 2016, "Created_at": created}},
+		{"both names, the new one wins", bson.M{"_id": id, "Title": "Old title", "title": "Noble Ploenchit", "developer": "Noble",
+			"min_price": 5000000, "MaxPrice": 1, "max_price": 9000000, "coordinates": bson.A{13.7437, 100.5486},
+			"facilities": bson.A{"Pool"}, "built": 2016, "Created_at": later, "created_at": created}},
+	}
+	for _, tt := range properties {
+		data, err := bson.Marshal(tt.doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var p Property
+		if err := bson.Unmarshal(data, &p); err != nil {
+			t.Fatalf("%s property: %v", tt.name, err)
+		}
+		if p.ID != id || p.Title != "Noble Ploenchit" || p.Developer != "Noble" || p.MinPrice != 5000000 || p.MaxPrice != 9000000 ||
+			p.Coordinates != [2]float64{13.7437, 100.5486} || len(p.Facilities) != 1 || p.Built != 2016 || !p.CreatedAt.Equal(created) {
+			t.Errorf("%s property: %+v", tt.name, p)
+		}
+	}
+
+	appointments := []struct {
+		name string
+		doc  bson.M
+	}{
+		{"legacy", bson.M{"User_id": "u1", "Property_id": "p1", "Listing_id": "l1", "Appointment_date": later, "Status": "scheduled", "Created_at": created}},
+		{"new", bson.M{"user_id": "u1", "property_id": "p1", "listing_id": "l1", "appointment_date": later, "status": "scheduled", "created_at": created}},
+	}
+	for _, tt := range appointments {
+		data, _ := bson.Marshal(tt.doc)
+		var a Appointment
+		if err := bson.Unmarshal(data, &a); err != nil {
+			t.Fatalf("%s appointment: %v", tt.name, err)
+		}
+		if a.UserID != "u1" || a.PropertyID != "p1" || a.ListingID != "l1" || !a.AppointmentDate.Equal(later) || a.Status != "scheduled" || !a.CreatedAt.Equal(created) {
+			t.Errorf("%s appointment: %+v", tt.name, a)
+		}
+	}
+
+	for name, doc := range map[string]bson.M{
+		"legacy": {"user_id": "u1", "message": "Is it available?", "Created_at": created},
+		"new":    {"user_id": "u1", "message": "Is it available?", "created_at": created},
+	} {
+		data, _ := bson.Marshal(doc)
+		var i Inquiry
+		if err := bson.Unmarshal(data, &i); err != nil {
+			t.Fatalf("%s inquiry: %v", name, err)
+		}
+		if i.User_id != "u1" || i.Message != "Is it available?" || !i.CreatedAt.Equal(created) {
+			t.Errorf("%s inquiry: %+v", name, i)
+		}
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/LynnT-2003/mv-realty-backend/imagemeta"
+	"github.com/cloudinary/cloudinary-go/v2/api/admin"
+	"github.com/cloudinary/cloudinary-go/v2/api/uploader"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// With IMAGE_MODERATION=cloudinary, uploads ask Cloudinary's moderation add-on
+// (CLOUDINARY_MODERATION_KIND, default aws_rek) for a verdict. An image still pending is kept in
+// pending_images rather than on the property; the moderation webhook, or the moderation_poll task
+// every 5 minutes for setups Cloudinary can't reach, attaches or rejects it. Without
+// IMAGE_MODERATION every upload is attached right away.
+const (
+	moderationApproved    = "approved"
+	moderationPending     = "pending"
+	moderationRejected    = "rejected"
+	moderationWebhookSkew = 2 * time.Hour // older webhook timestamps are refused as replays
+	defaultModerationKind = "aws_rek"
+	moderationWebhookPath = "/webhooks/cloudinary/moderation"
+)
+
+// imageModerator decides whether an uploaded image may be shown
+type imageModerator interface {
+	// request adds the moderation request to the upload
+	request(params *uploader.UploadParams)
+	// verdict is the decision known when the upload returns: approved, pending or rejected
+	verdict(result *uploader.UploadResult) string
+	// poll returns the decisions taken since, by public_id, for some of the pending publicIDs
+	poll(ctx context.Context, publicIDs []string) (map[string]string, error)
+}
+
+// noopModerator approves everything, for development and self-hosted setups without the add-on
+type noopModerator struct{}
+
+func (noopModerator) request(*uploader.UploadParams) {}
+
+func (noopModerator) verdict(*uploader.UploadResult) string { return moderationApproved }
+
+func (noopModerator) poll(context.Context, []string) (map[string]string, error) { return nil, nil }
+
+type cloudinaryModerator struct {
+	kind string
+}
+
+func (m cloudinaryModerator) request(params *uploader.UploadParams) {
+	params.Moderation = m.kind
+	if base := publicBaseURL(); base != "" {
+		params.NotificationURL = base + moderationWebhookPath
+	}
+}
+
+func (m cloudinaryModerator) verdict(result *uploader.UploadResult) string {
+	for _, mod := range result.Moderation {
+		if mod.Kind == m.kind {
+			return string(mod.Status)
+		}
+	}
+	return moderationPending
+}
+
+func (m cloudinaryModerator) poll(ctx context.Context, publicIDs []string) (map[string]string, error) {
+	waiting := map[string]bool{}
+	for _, id := range publicIDs {
+		waiting[id] = true
+	}
+	cld, err := newCloudinary()
+	if err != nil {
+		return nil, err
+	}
+	decided := map[string]string{}
+	for _, status := range []string{moderationApproved, moderationRejected} {
+		res, err := cld.Admin.AssetsByModeration(ctx, admin.AssetsByModerationParams{Kind: m.kind, Status: status, MaxResults: 500})
+		if err != nil {
+			return decided, err
+		}
+		for _, asset := range res.Assets {
+			if waiting[asset.PublicID] {
+				decided[asset.PublicID] = status
+			}
+		}
+	}
+	return decided, nil
+}
+
+var moderator imageModerator = noopModerator{}
+
+// setupModeration enables moderation when IMAGE_MODERATION is cloudinary
+func setupModeration() {
+	switch os.Getenv("IMAGE_MODERATION") {
+	case "", "off":
+		return
+	case "cloudinary":
+		kind := os.Getenv("CLOUDINARY_MODERATION_KIND")
+		if kind == "" {
+			kind = defaultModerationKind
+		}
+		moderator = cloudinaryModerator{kind: kind}
+		if publicBaseURL() == "" {
+			log.Println("PUBLIC_BASE_URL is not set, moderation results are only polled")
+		}
+		scheduleModerationPoll()
+	default:
+		log.Fatal("IMAGE_MODERATION must be cloudinary or off")
+	}
+}
+
+// pendingImage is an upload waiting for moderation. Suggested carries the GPS suggestion of the photo,
+// applied with the image.
+type pendingImage struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty" json:"pending_image_id"`
+	PropertyID primitive.ObjectID `bson:"property_id" json:"property_id"`
+	Image      imagemeta.Image    `bson:"image" json:"image"`
+	Suggested  *[2]float64        `bson:"suggested_coordinates,omitempty" json:"suggested_coordinates,omitempty"`
+	UploadedBy string             `bson:"uploaded_by,omitempty" json:"uploaded_by,omitempty"` // user to notify of a rejection
+	Status     string             `bson:"status" json:"status"`
+	CreatedAt  time.Time          `bson:"created_at" json:"created_at"`
+	DecidedAt  *time.Time         `bson:"decided_at,omitempty" json:"decided_at,omitempty"`
+}
+
+// pendingImageCount is the number of images of the property waiting for moderation
+func pendingImageCount(ctx context.Context, propertyID primitive.ObjectID) (int64, error) {
+	return client.Database("MVDB").Collection("pending_images").CountDocuments(ctx,
+		bson.M{"property_id": propertyID, "status": moderationPending})
+}
+
+// resolveModeration applies a verdict to the pending image with publicID: an approved image is
+// attached to its property, a rejected one is deleted from Cloudinary and its uploader notified. A
+// verdict for an image that is not pending, because the webhook and the poll both saw it, is a no-op.
+func resolveModeration(ctx context.Context, publicID, status string) error {
+	if status != moderationApproved && status != moderationRejected {
+		return nil
+	}
+	now := time.Now()
+	var p pendingImage
+	err := client.Database("MVDB").Collection("pending_images").FindOneAndUpdate(ctx,
+		bson.M{"image.public_id": publicID, "status": moderationPending},
+		bson.M{"$set": bson.M{"status": status, "decided_at": now}}).Decode(&p)
+	if err == mongo.ErrNoDocuments {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	invalidateResponses("properties")
+	meta := auditMeta{Actor: "moderation"}
+	if status == moderationApproved {
+		return attachImage(ctx, meta, p.PropertyID, p.Image, p.Suggested)
+	}
+	rejectImage(ctx, p.PropertyID, p.Image, p.UploadedBy)
+	return nil
+}
+
+// rejectImage deletes a rejected upload from Cloudinary and tells the uploader; both only log failures
+func rejectImage(ctx context.Context, propertyID primitive.ObjectID, image imagemeta.Image, uploadedBy string) {
+	if cld, err := newCloudinary(); err == nil {
+		invalidate := true
+		if _, err := cld.Upload.Destroy(ctx, uploader.DestroyParams{PublicID: image.PublicID, Invalidate: &invalidate}); err != nil {
+			log.Println("Failed to delete rejected image", image.PublicID, ":", err)
+		}
+	}
+	if uploadedBy != "" {
+		createNotification(uploadedBy, notificationImageRejected, map[string]interface{}{
+			"property_id": propertyID.Hex(),
+			"public_id":   image.PublicID,
+		})
+	}
+}
+
+// moderationWebhook answers POST /webhooks/cloudinary/moderation. The X-Cld-Signature header is the
+// hex SHA-1 (or SHA-256) of the body, X-Cld-Timestamp and the API secret.
+func moderationWebhook(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+	timestamp := r.Header.Get("X-Cld-Timestamp")
+	if !validCloudinarySignature(body, timestamp, r.Header.Get("X-Cld-Signature")) {
+		http.Error(w, "Invalid signature", http.StatusUnauthorized)
+		return
+	}
+	var notification struct {
+		Type     string `json:"notification_type"`
+		PublicID string `json:"public_id"`
+		Status   string `json:"moderation_status"`
+	}
+	if err := json.Unmarshal(body, &notification); err != nil {
+		http.Error(w, "Failed to parse request body", http.StatusBadRequest)
+		return
+	}
+	if notification.Type != "moderation" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	if err := resolveModeration(ctx, notification.PublicID, notification.Status); err != nil {
+		serverError(w, r, "Failed to apply moderation result", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func validCloudinarySignature(body []byte, timestamp, signature string) bool {
+	secret := os.Getenv("CLOUDINARY_API_SECRET")
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if secret == "" || err != nil || time.Since(time.Unix(ts, 0)).Abs() > moderationWebhookSkew {
+		return false
+	}
+	var h hash.Hash
+	switch len(signature) {
+	case sha1.Size * 2:
+		h = sha1.New()
+	case sha256.Size * 2:
+		h = sha256.New()
+	default:
+		return false
+	}
+	h.Write(body)
+	h.Write([]byte(timestamp + secret))
+	return hmac.Equal([]byte(hex.EncodeToString(h.Sum(nil))), []byte(signature))
+}
+
+// scheduleModerationPoll asks Cloudinary every 5 minutes (SCHEDULE_MODERATION_POLL) for the verdicts
+// on images pending for over a minute, for webhooks that got lost or can't be delivered
+func scheduleModerationPoll() {
+	registerTask(scheduledTask{
+		Name:    "moderation_poll",
+		Spec:    "*/5 * * * *",
+		Env:     "SCHEDULE_MODERATION_POLL",
+		Timeout: time.Minute,
+		Run:     pollModeration,
+	})
+}
+
+func pollModeration(ctx context.Context) (string, error) {
+	pending, err := findAllWith[pendingImage](ctx, "pending_images",
+		bson.M{"status": moderationPending, "created_at": bson.M{"$lt": time.Now().Add(-time.Minute)}},
+		options.Find().SetProjection(bson.M{"image.public_id": 1}).SetLimit(1000))
+	if err != nil || len(pending) == 0 {
+		return "nothing pending", err
+	}
+	ids := make([]string, len(pending))
+	for i, p := range pending {
+		ids[i] = p.Image.PublicID
+	}
+	decided, err := moderator.poll(ctx, ids)
+	for publicID, status := range decided {
+		if err := resolveModeration(ctx, publicID, status); err != nil {
+			log.Println("Failed to apply the moderation result of", publicID, ":", err)
+		}
+	}
+	return fmt.Sprintf("%d of %d pending images decided", len(decided), len(pending)), err
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Values of Notification.Type
+const (
+	notificationAppointmentCancelled   = "appointment_cancelled"
+	notificationAppointmentRescheduled = "appointment_rescheduled"
+	notificationWaitlistPromoted       = "waitlist_promoted"
+	notificationPriceDropped           = "price_dropped"
+	notificationImageRejected          = "image_rejected"                // to the uploader, when moderation rejects an image
+	notificationVerificationRejected   = "listing_verification_rejected" // to the listing's agent, by agent id
+)
+
+// notificationTypes are the types the notifications schema accepts, see collectionSchemas
+var notificationTypes = []string{
+	notificationAppointmentCancelled,
+	notificationAppointmentRescheduled,
+	notificationWaitlistPromoted,
+	notificationPriceDropped,
+	notificationImageRejected,
+	notificationVerificationRejected,
+	notificationSavedSearchMatch,
+}
+
+// readNotificationTTL is how long read notifications are kept, see collectionIndexes
+const readNotificationTTL = 90 * 24 * time.Hour
+
+// Notification is an in-app message for a user's bell icon. Payload depends on Type and carries the
+// ids the app needs to link to, e.g. appointment_id or listing_id.
+type Notification struct {
+	ID        primitive.ObjectID     `bson:"_id,omitempty" json:"notification_id,omitempty"`
+	UserID    string                 `bson:"user_id" json:"user_id"`
+	Type      string                 `bson:"type" json:"type"`
+	Payload   map[string]interface{} `bson:"payload" json:"payload"`
+	Read      bool                   `bson:"read" json:"read"`
+	ReadAt    *time.Time             `bson:"read_at,omitempty" json:"read_at,omitempty"` // expires the notification
+	CreatedAt time.Time              `bson:"created_at" json:"created_at"`
+}
+
+// createNotification stores a notification for userID. It only logs on failure and uses its own
+// timeout, so a notification can never fail or outlive the operation that triggered it.
+func createNotification(userID, notificationType string, payload map[string]interface{}) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := client.Database("MVDB").Collection("notifications").InsertOne(ctx, Notification{
+		UserID:    userID,
+		Type:      notificationType,
+		Payload:   payload,
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		log.Println("Failed to create", notificationType, "notification for user", userID, ":", err)
+	}
+}
+
+// notifyCancelledAppointments tells the users of the appointments a cascade cancelled, and releases
+// their slots to the waitlist
+func notifyCancelledAppointments(rep *deletionReport) {
+	var ids []primitive.ObjectID
+	for _, t := range rep.Touched {
+		if t.Collection != "appointments" || t.Action != "cancelled" {
+			continue
+		}
+		if oid, err := primitive.ObjectIDFromHex(t.ID); err == nil {
+			ids = append(ids, oid)
+		}
+	}
+	if len(ids) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	appointments, err := findAll[Appointment](ctx, "appointments", bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		log.Println("Failed to load cancelled appointments for notifications:", err)
+		return
+	}
+	for _, a := range appointments {
+		notifyAppointmentChange(a, notificationAppointmentCancelled)
+		notifyAgentOfAppointment(a, agentEventAppointmentCancelled)
+		releaseAppointmentSlot(a.ListingID, a.AppointmentDate, a.ID)
+	}
+}
+
+// notifyAppointmentChange creates the in-app notification and pushes to the user's devices
+func notifyAppointmentChange(a Appointment, notificationType string) {
+	createNotification(a.UserID, notificationType, map[string]interface{}{
+		"appointment_id":   a.ID.Hex(),
+		"listing_id":       a.ListingID,
+		"property_id":      a.PropertyID,
+		"appointment_date": a.AppointmentDate,
+		"reason":           a.CancellationReason,
+	})
+	msg := pushMessage{
+		Title: "Your viewing was cancelled",
+		Body:  "The viewing on " + a.AppointmentDate.In(bangkok).Format("2 Jan 15:04") + " was cancelled.",
+		Data:  map[string]string{"type": notificationType, "appointment_id": a.ID.Hex(), "listing_id": a.ListingID},
+	}
+	switch notificationType {
+	case notificationAppointmentRescheduled:
+		msg.Title = "Your viewing was rescheduled"
+		msg.Body = "Your viewing is now on " + a.AppointmentDate.In(bangkok).Format("2 Jan 15:04") + "."
+	case notificationWaitlistPromoted:
+		msg.Title = "A viewing slot opened up"
+		msg.Body = "You are booked for " + a.AppointmentDate.In(bangkok).Format("2 Jan 15:04") + " from the waitlist."
+	}
+	pushToUser(a.UserID, msg)
+}
+
+// notifyPriceDrop tells the users with a scheduled viewing of the listing that its price went down.
+// There are no favorites yet; an upcoming appointment is the strongest signal of interest we keep.
+func notifyPriceDrop(listing *Listing, previous float64) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	appointments, err := findAllWith[Appointment](ctx, "appointments",
+		bson.M{"listing_id": listing.ID.Hex(), "status": bson.M{"$in": openAppointmentStatuses}, "appointment_date": bson.M{"$gte": time.Now()}},
+		options.Find().SetProjection(bson.M{"user_id": 1}))
+	if err != nil {
+		log.Println("Failed to find users to notify of the price drop on listing", listing.ID.Hex(), ":", err)
+		return
+	}
+	notified := map[string]bool{}
+	for _, a := range appointments {
+		if notified[a.UserID] {
+			continue
+		}
+		notified[a.UserID] = true
+		createNotification(a.UserID, notificationPriceDropped, map[string]interface{}{
+			"listing_id":     listing.ID.Hex(),
+			"slug":           listing.Slug,
+			"price":          listing.Price,
+			"previous_price": previous,
+			"currency":       listingCurrency(listing),
+		})
+	}
+}
+
+// getUserNotifications pages through a user's notifications, newest first; ?unread=true leaves out read ones
+func getUserNotifications(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, ok := pathObjectID(w, r, "User")
+	if !ok {
+		return
+	}
+	q := r.URL.Query()
+	page, limit := 1, 20
+	if raw := q.Get("page"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 {
+			http.Error(w, "page must be a positive whole number", http.StatusBadRequest)
+			return
+		}
+		page = n
+	}
+	if raw := q.Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > 100 {
+			http.Error(w, "limit must be between 1 and 100", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	filter := bson.M{"user_id": userID.Hex()}
+	if q.Get("unread") == "true" {
+		filter["read"] = false
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	collection := client.Database("MVDB").Collection("notifications")
+	total, err := collection.CountDocuments(ctx, filter)
+	if err != nil {
+		serverError(w, r, "Failed to count notifications", err)
+		return
+	}
+	opts := options.Find().
+		SetSort(bson.D{{Key: "created_at", Value: -1}, {Key: "_id", Value: -1}}).
+		SetSkip(int64((page - 1) * limit)).
+		SetLimit(int64(limit))
+	notifications, err := findAllWith[Notification](ctx, collection.Name(), filter, opts)
+	if err != nil {
+		serverError(w, r, "Failed to retrieve notifications", err)
+		return
+	}
+	json.NewEncoder(w).Encode(bson.M{"notifications": notifications, "page": page, "limit": limit, "total": total})
+}
+
+// markNotificationsRead marks the given notification_ids read, or all of the user's notifications
+// when the body has none
+func markNotificationsRead(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, ok := pathObjectID(w, r, "User")
+	if !ok {
+		return
+	}
+	var body struct {
+		NotificationIDs []string `json:"notification_ids"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "Failed to parse request body", http.StatusBadRequest)
+			return
+		}
+	}
+	filter := bson.M{"user_id": userID.Hex(), "read": false}
+	if len(body.NotificationIDs) > 0 {
+		ids := make([]primitive.ObjectID, len(body.NotificationIDs))
+		for i, h := range body.NotificationIDs {
+			var err error
+			if ids[i], err = primitive.ObjectIDFromHex(h); err != nil {
+				http.Error(w, "Invalid notification ID format: "+h, http.StatusBadRequest)
+				return
+			}
+		}
+		filter["_id"] = bson.M{"$in": ids}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	res, err := client.Database("MVDB").Collection("notifications").UpdateMany(ctx, filter,
+		bson.M{"$set": bson.M{"read": true, "read_at": time.Now()}})
+	if err != nil {
+		serverError(w, r, "Failed to update notifications", err)
+		return
+	}
+	json.NewEncoder(w).Encode(bson.M{"marked_read": res.ModifiedCount})
+}
+
+func getUnreadNotificationCount(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, ok := pathObjectID(w, r, "User")
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	n, err := client.Database("MVDB").Collection("notifications").CountDocuments(ctx, bson.M{"user_id": userID.Hex(), "read": false})
+	if err != nil {
+		serverError(w, r, "Failed to count notifications", err)
+		return
+	}
+	json.NewEncoder(w).Encode(bson.M{"unread": n})
+}
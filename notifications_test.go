@@ -0,0 +1,61 @@
+package main
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/fs"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// TestNotificationTypesInSchema fails when a notification type is declared, or passed to
+// createNotification as a literal, without being in notificationTypes: the schema would reject the
+// insert and createNotification only logs that.
+func TestNotificationTypesInSchema(t *testing.T) {
+	pkgs, err := parser.ParseDir(token.NewFileSet(), ".", func(fi fs.FileInfo) bool {
+		return !strings.HasSuffix(fi.Name(), "_test.go")
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range pkgs["main"].Files {
+		ast.Inspect(file, func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.ValueSpec:
+				for i, name := range n.Names {
+					if !strings.HasPrefix(name.Name, "notification") || i >= len(n.Values) {
+						continue
+					}
+					if lit, ok := n.Values[i].(*ast.BasicLit); ok && lit.Kind == token.STRING {
+						value, _ := strconv.Unquote(lit.Value)
+						if !slices.Contains(notificationTypes, value) {
+							t.Errorf("%s (%q) is missing from notificationTypes", name.Name, value)
+						}
+					}
+				}
+			case *ast.CallExpr:
+				if fn, ok := n.Fun.(*ast.Ident); ok && fn.Name == "createNotification" && len(n.Args) > 1 {
+					if lit, ok := n.Args[1].(*ast.BasicLit); ok {
+						t.Errorf("createNotification called with the literal type %s, declare a notification constant", lit.Value)
+					}
+				}
+			}
+			return true
+		})
+	}
+}
+
+func TestNotificationSchemaEnum(t *testing.T) {
+	properties := collectionSchemas["notifications"]["properties"].(bson.M)
+	enum := properties["type"].(bson.M)["enum"].([]string)
+	for _, want := range []string{notificationWaitlistPromoted, notificationVerificationRejected, notificationImageRejected} {
+		if !slices.Contains(enum, want) {
+			t.Errorf("notifications schema rejects type %q", want)
+		}
+	}
+}
@@ -0,0 +1,627 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/LynnT-2003/mv-realty-backend/imagemeta"
+	"github.com/LynnT-2003/mv-realty-backend/jobs"
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// apiParam describes a query parameter accepted by a route
+type apiParam struct {
+	Name        string
+	Description string
+	Required    bool
+}
+
+// apiOperation documents a route for the generated OpenAPI spec.
+// RequestBody and Response hold a zero value of the Go type that is decoded / encoded.
+type apiOperation struct {
+	Summary     string
+	Query       []apiParam
+	RequestBody interface{}
+	Multipart   []string // names of multipart file fields
+	Response    interface{}
+	Created     bool // answered with 201 and a Location header instead of 200
+}
+
+// apiDocs is keyed by "METHOD /path/template" exactly as registered on the router.
+// Routes missing from here still show up in /openapi.json, flagged as undocumented.
+var apiDocs = map[string]apiOperation{
+	"GET /properties":   {Summary: "List all properties; the summary view has Title, Slug, Developer, the cover image, price range, Coordinates and Built", Query: []apiParam{listViewParam, {Name: "include", Description: "comma separated; listing_count adds listing_count and min_listing_price from active listings, documents adds Documents, formatted adds MinPriceFormatted, MaxPriceFormatted and their Long forms"}, localeParam, includeDeletedParam, transitFilterParams[0], transitFilterParams[1], completionFilterParams[0], completionFilterParams[1], listPageParams[0], listPageParams[1]}, Response: []Property{}},
+	"GET /inquiries":    {Summary: "List all inquiries", Query: []apiParam{includeArchivedParam, listPageParams[0], listPageParams[1]}, Response: []Inquiry{}},
+	"GET /appointments": {Summary: "List all appointments", Query: []apiParam{tzParam, includeArchivedParam, listPageParams[0], listPageParams[1]}, Response: []Appointment{}},
+	"GET /users":        {Summary: "List all users", Query: []apiParam{includeDeletedParam, listPageParams[0], listPageParams[1]}, Response: []User{}},
+	"GET /check/user":   {Summary: "Check whether a user exists; needs an admin API key", Query: []apiParam{{Name: "email", Required: true}}, Response: map[string]bool{}},
+	"GET /listings":     {Summary: "List listings (active only unless listing_status is given); the summary view has no description and only the first photo", Query: append(append(listingFilterParams, includeDeletedParam, listViewParam, apiParam{Name: "include", Description: "comma separated; price_drop adds previous_price and price_drop_pct for reductions in the last 30 days, formatted adds price_formatted and price_formatted_long"}, localeParam), append(listingRankingParams, listPageParams...)...), Response: []Listing{}},
+	"GET /listings/{id}/qr.png": {Summary: "QR code of the public listing page under SITE_BASE_URL for brochures, cached as immutable; 503 when SITE_BASE_URL is not set",
+		Query: []apiParam{{Name: "size", Description: "width in pixels, 64 to 1024, default 512"}, {Name: "format", Description: "png (default) or svg"}}},
+	"GET /listings/{id}/brochure.pdf": {Summary: "One-page A4 PDF brochure of a published listing with cover photo, specs, description, agent contact and QR code; BROCHURE_FONT_FILE sets a TrueType font for Thai text"},
+	"GET /listings/{id}/similar": {Summary: "Up to 6 similar active listings",
+		Query: []apiParam{{Name: "debug", Description: "true returns {listing, score} entries"}, displayCurrencyParam, unitsParam, formattedIncludeParam, localeParam}, Response: []Listing{}},
+	"GET /listings/{id}/available-slots": {Summary: "Start times a viewing of the listing can be booked at: within its agent's working hours (the global VIEWING_HOURS without an agent), outside the agent's blackouts and clear of open appointments",
+		Query: []apiParam{{Name: "from", Description: "YYYY-MM-DD, default today"}, {Name: "days", Description: "1-31, default 7"}, tzParam}, Response: map[string]interface{}{}},
+	"GET /listings/{id}/waitlist": {Summary: "Waitlist of a listing, oldest entry first",
+		Query: []apiParam{{Name: "status", Description: "waiting (default), promoted, withdrawn, failed or all"}}, Response: []WaitlistEntry{}},
+	"GET /listings/{id}/booked-times": {Summary: "Dates of the listing's upcoming scheduled viewings, without who booked them",
+		Query: []apiParam{tzParam}, Response: map[string]interface{}{}},
+	"GET /listings/{id}/price-history": {Summary: "Price changes of a listing, newest first", Response: map[string]interface{}{}},
+	"GET /listings/featured":           {Summary: "Active featured listings, newest first (max 24, without description, first photo only)", Query: []apiParam{displayCurrencyParam, unitsParam, formattedIncludeParam, localeParam}, Response: []Listing{}},
+	"GET /listings/tags":               {Summary: "Tags used on active listings with counts; vocabulary is false for free-text tags", Response: []tagCount{}},
+	"GET /listings/batch": {Summary: "Fetch up to 100 listings by id in one call; missing, draft and deleted listings are null",
+		Query: []apiParam{batchIDsParam, displayCurrencyParam, unitsParam, formattedIncludeParam, localeParam}, Response: []*Listing{}},
+	"GET /properties/batch": {Summary: "Fetch up to 100 properties by id in one call; missing and deleted properties are null",
+		Query: []apiParam{batchIDsParam, documentsIncludeParam, localeParam}, Response: []*Property{}},
+	"GET /listings/filter-bounds": {Summary: "Price, size and floor ranges plus bedroom and furniture options of active listings (cached 5 minutes)",
+		Query: []apiParam{{Name: "listing_type", Description: "sale or rent"}, {Name: "display_currency", Description: "currency of the price range, default THB"}, unitsParam}, Response: filterBounds{}},
+	"GET /listings/new": {Summary: "Active listings created in the last days (max 24, without description, first photo only)",
+		Query: []apiParam{{Name: "days", Description: "1-365, default 14"}, displayCurrencyParam, unitsParam, formattedIncludeParam, localeParam}, Response: []Listing{}},
+	"GET /users/getUserByEmail": {Summary: "Get a user by email; needs an admin API key", Query: []apiParam{{Name: "email", Required: true}}, Response: User{}},
+	"GET /stats/listings/price-by-bedroom": {Summary: "Price statistics of active listings per bedroom count",
+		Query: []apiParam{{Name: "listing_type", Description: "sale or rent"}, {Name: "min_sample", Description: "buckets smaller than this are flagged low_confidence (default 5)"}}, Response: []bedroomPriceBucket{}},
+	"GET /stats/listings/price-histogram": {Summary: "Price distribution of listings matching the GET /listings filters",
+		Query: append([]apiParam{{Name: "buckets", Description: "1-100, default 10"}}, listingFilterParams...), Response: priceHistogram{}},
+	"GET /stats/properties/engagement": {Summary: "Inquiries and appointments per property, sorted by total (CSV with ?format=csv or Accept: text/csv)",
+		Query: []apiParam{{Name: "from", Description: "RFC3339 or YYYY-MM-DD (Asia/Bangkok)"}, {Name: "to", Description: "RFC3339 or YYYY-MM-DD, inclusive"}, {Name: "format", Description: "csv"}}, Response: []propertyEngagement{}},
+	"GET /stats/timeseries": {Summary: "Zero-filled counts per day or week (Asia/Bangkok); X-Archives-Included tells whether archived documents were counted",
+		Query: []apiParam{{Name: "metric", Required: true, Description: "appointments, users or inquiries"}, {Name: "interval", Description: "day (default) or week"},
+			{Name: "from", Description: "RFC3339 or YYYY-MM-DD, default 30 days ago"}, {Name: "to", Description: "RFC3339 or YYYY-MM-DD, inclusive; at most 366 days after from"}, includeArchivedParam}, Response: []periodCount{}},
+	"GET /sync/listings": {Summary: "Listings changed since a timestamp plus deletion tombstones",
+		Query: []apiParam{{Name: "updated_since", Description: "RFC3339; use the previous response's server_time"}}, Response: syncResponse[Listing]{}},
+	"GET /sync/properties": {Summary: "Properties changed since a timestamp plus deletion tombstones",
+		Query: []apiParam{{Name: "updated_since", Description: "RFC3339; use the previous response's server_time"}}, Response: syncResponse[Property]{}},
+	"POST /add/property": {Summary: "Create a property; 409 with the suspected duplicate when a similar title or a property within 50 m exists",
+		Query: []apiParam{{Name: "allow_duplicate", Description: "true skips the duplicate check"}}, RequestBody: Property{}, Response: Property{}, Created: true},
+	"POST /contact": {Summary: "Contact form: finds or creates the user by email (case-insensitive) and creates the inquiry, with the optional source attribution of POST /add/inquiry; the email of a deleted user gets a new user",
+		RequestBody: contactRequest{}, Response: map[string]interface{}{}},
+	"POST /add/properties": {Summary: "Create up to 100 properties; results are aligned by index", RequestBody: []Property{}, Response: map[string][]bulkPropertyResult{}},
+	"POST /add/listing": {Summary: "Create a listing; unknown_tags lists tags outside the vocabulary",
+		Query: []apiParam{{Name: "draft", Description: "true keeps the listing hidden until it is published"}}, RequestBody: Listing{}, Response: Listing{}, Created: true},
+	"POST /add/inquiry": {Summary: "Create an inquiry, assigned to the listing's agent or the next agent in rotation. The optional source object takes utm_source, utm_medium, utm_campaign, referrer and landing_page; any other key is a 400",
+		RequestBody: Inquiry{}, Response: Inquiry{}, Created: true},
+	"POST /add/user": {Summary: "Create a user; 409 when a user already has the email (case-insensitive)", RequestBody: User{}, Response: User{}, Created: true},
+	"POST /add/appointment": {Summary: "Schedule an appointment and email the user confirm and cancel links; 422 when Listing_id belongs to a different Property_id or is inactive or a draft; warning is set when the listing's available_from has passed; Appointment_date must carry a UTC offset; 422 outside the agent's working hours or in a blackout; 409 when the listing is already booked at Appointment_date, or 202 with a waitlist entry with waitlist=true",
+		Query: []apiParam{tzParam, {Name: "waitlist", Description: "true joins the waitlist when the slot is taken; the user is booked and notified once it frees up"},
+			{Name: "window_from", Description: "RFC3339 or YYYY-MM-DD, earliest time the waitlist entry accepts, default Appointment_date"},
+			{Name: "window_to", Description: "RFC3339 or YYYY-MM-DD, latest time the waitlist entry accepts, default Appointment_date"}}, RequestBody: Appointment{}, Response: Appointment{}, Created: true},
+	"GET /inquiries/{id}":          {Summary: "Get an inquiry", Response: Inquiry{}},
+	"GET /appointments/{id}":       {Summary: "Get an appointment", Query: []apiParam{tzParam}, Response: Appointment{}},
+	"POST /properties/{id}/images": {Summary: "Upload an image to a property; 503 uploads_unavailable when Cloudinary is misconfigured, as for every upload; 404 without uploading when the property doesn't exist. Watermarked images keep the unwatermarked URL in original_url. For a property without coordinates the GPS of a JPEG or HEIC is returned as suggested_coordinates, nothing is changed until it is confirmed. A near-duplicate of an image already on the property sets warning, or is rejected with 409 with ?strict=true. With IMAGE_MODERATION an image awaiting moderation answers 202 with pending_image_id and is attached once approved; a rejected one answers 422. The optional user_id form field is notified of a later rejection", Query: []apiParam{{Name: "watermark", Description: "true or false, overrides WATERMARK_UPLOADS"}, {Name: "strict", Description: "true rejects near-duplicates with 409"}}, Multipart: []string{"image"}, Response: map[string]string{}},
+	"POST /webhooks/cloudinary/moderation": {
+		Summary: "Cloudinary moderation notifications, signed with X-Cld-Signature; attaches approved images and rejects the others"},
+	"GET /properties/{id}/map.png": {Summary: "600x300 static map of the property for emails and previews; a placeholder PNG when it has no coordinates or the map provider fails"},
+	"POST /properties/{id}/suggested-coordinates/confirm": {Summary: "Apply the coordinates suggested by a photo upload; 409 when the property already has coordinates",
+		Response: Property{}},
+	"GET /properties/{id}/activity": {Summary: "Recent publications, price changes, sales and rentals of the property's listings, newest first; drafts and changes made before a listing was published are left out. Public responses may be cached for 5 minutes",
+		Query: []apiParam{{Name: "types", Description: "comma separated subset of published, price_changed, sold, rented; default all"}, listPageParams[0], listPageParams[1]}, Response: []listingActivity{}},
+	"GET /properties/{id}/full": {Summary: "Property with its active listings, inquiry count, listing price range and upcoming appointments",
+		Query: []apiParam{{Name: "include", Description: "comma separated subset of listings,stats,appointments,documents"}}, Response: propertyFull{}},
+	"GET /transit/stations":      {Summary: "BTS and MRT stations for the near_station filter", Response: []transitStation{}},
+	"GET /properties/{id}/stack": {Summary: "Active listings grouped by floor, top first; every floor is listed when TotalFloors is set", Response: map[string]interface{}{}},
+	"POST /properties/search/polygon": {Summary: "Properties inside a GeoJSON Polygon of at most 100 vertices and 3000 km², paged; self-intersecting polygons are rejected",
+		Query: []apiParam{includeDeletedParam, transitFilterParams[0], transitFilterParams[1], completionFilterParams[0], completionFilterParams[1],
+			listViewParam, documentsIncludeParam, localeParam, {Name: "page", Description: "from 1"}, {Name: "limit", Description: "1-100, default 20"}},
+		RequestBody: geoPolygon{}, Response: map[string]interface{}{}},
+	"GET /properties/popular": {Summary: "Most viewed properties over a window",
+		Query: []apiParam{{Name: "days", Description: "default 7"}, {Name: "limit", Description: "default 10"}}, Response: []popularProperty{}},
+	"GET /properties/{idOrSlug}": {Summary: "Get a property by ObjectID or slug (current or former)", Query: []apiParam{documentsIncludeParam, localeParam}, Response: Property{}},
+	"GET /listings/{idOrSlug}":   {Summary: "Get a listing by ObjectID or slug", Query: []apiParam{displayCurrencyParam, unitsParam, formattedIncludeParam, localeParam}, Response: Listing{}},
+	"PATCH /properties/{id}/images/{public_id:.+}": {Summary: "Set the caption and alt text of a property image; HTML is stripped",
+		RequestBody: imageTextUpdate{}, Response: imagemeta.Image{}},
+	"PATCH /listings/{id}/photos/{public_id:.+}": {Summary: "Set the caption and alt text of a listing photo; HTML is stripped",
+		RequestBody: imageTextUpdate{}, Response: imagemeta.Image{}},
+	"POST /properties/{id}/documents": {Summary: "Attach a PDF document (brochure, EIA report) with an optional name form field; at most DOCUMENT_MAX_MB",
+		Multipart: []string{"document"}, Response: Document{}},
+	"DELETE /properties/{id}/documents/{public_id:.+}": {Summary: "Delete a property document", Response: map[string]string{}},
+	"POST /properties/{id}/floor-plans": {Summary: "Upload a floor plan (image or PDF) with a label form field, kept apart from Images",
+		Multipart: []string{"floor_plan"}, Response: imagemeta.Plan{}},
+	"DELETE /properties/{id}/floor-plans/{public_id:.+}": {Summary: "Delete a property floor plan", Response: map[string]string{}},
+	"POST /listings/{id}/floor-plans": {Summary: "Upload a floor plan (image or PDF) with a label form field, kept apart from photos",
+		Multipart: []string{"floor_plan"}, Response: imagemeta.Plan{}},
+	"DELETE /listings/{id}/floor-plans/{public_id:.+}": {Summary: "Delete a listing floor plan", Response: map[string]string{}},
+	"POST /properties/{id}/videos": {Summary: "Add a YouTube, Vimeo or Cloudinary video to a property; other hosts are rejected",
+		RequestBody: Video{}, Response: Video{}},
+	"DELETE /properties/{id}/videos": {Summary: "Remove a video from a property",
+		Query: []apiParam{videoURLParam}, Response: map[string]string{}},
+	"POST /listings/{id}/videos": {Summary: "Add a YouTube, Vimeo or Cloudinary video to a listing; other hosts are rejected",
+		RequestBody: Video{}, Response: Video{}},
+	"DELETE /listings/{id}/videos": {Summary: "Remove a video from a listing",
+		Query: []apiParam{videoURLParam}, Response: map[string]string{}},
+	"PUT /properties/{id}": {Summary: "Update property fields; a new Title gets a new slug and the old one keeps resolving", RequestBody: propertyUpdate{}, Response: Property{}},
+	"POST /properties/{id}/view": {Summary: "Record a property view (fire-and-forget, 202)", RequestBody: struct {
+		SessionID string `json:"session_id"`
+	}{}},
+	"PUT /users": {Summary: "Update a user's phone number", Query: []apiParam{{Name: "user_id", Required: true}}, RequestBody: struct {
+		Phone string `json:"phone"`
+	}{}, Response: map[string]string{}},
+	"POST /admin/listings/import": {Summary: "Bulk import listings from a CSV file (header: " + strings.Join(listingImportColumns, ",") + ")",
+		Query: []apiParam{{Name: "dry_run", Description: "validate only; 422 with row errors when any row is invalid"}}, Multipart: []string{"file"}, Response: listingImportResult{}},
+	"PUT /listings/{id}": {Summary: "Update listing fields; a price change is added to the price history", RequestBody: listingUpdate{}, Response: Listing{}},
+	"POST /listings/{id}/deactivate": {Summary: "Take a listing off the market and cancel its future appointments; 409 when already inactive",
+		RequestBody: struct {
+			Reason string `json:"reason"`
+		}{}, Response: map[string]interface{}{}},
+	"POST /listings/{id}/publish": {Summary: "Publish a draft; 422 lists what is missing (photo, description, price), 409 when already published", Response: Listing{}},
+	"POST /listings/{id}/renew": {Summary: "Push expires_at forward and reactivate the listing",
+		Query: []apiParam{{Name: "days", Description: "1-365, default LISTING_EXPIRY_DAYS (90)"}}, Response: Listing{}},
+	"POST /listings/{id}/activate":  {Summary: "Put an inactive listing back on the market; 409 when already active", Response: map[string]interface{}{}},
+	"DELETE /listings/{id}":         {Summary: "Soft-delete a listing and cancel its scheduled appointments", Response: deletionReport{}},
+	"DELETE /properties/{id}":       {Summary: "Soft-delete a property with its listings, cancelling appointments and archiving inquiries", Response: deletionReport{}},
+	"GET /users/{id}":               {Summary: "Get a user", Query: []apiParam{includeDeletedParam}, Response: User{}},
+	"DELETE /users/{id}":            {Summary: "Soft-delete a user", Response: deletionReport{}},
+	"POST /listings/{id}/restore":   {Summary: "Restore a soft-deleted listing", Response: map[string]interface{}{}},
+	"POST /properties/{id}/restore": {Summary: "Restore a soft-deleted property and the listings deleted with it", Response: map[string]interface{}{}},
+	"POST /users/{id}/restore":      {Summary: "Restore a soft-deleted user; 409 when a live user has taken its email", Response: map[string]interface{}{}},
+	"GET /admin/audit": {Summary: "Audit log of write operations, newest first",
+		Query: []apiParam{{Name: "collection"}, {Name: "document_id"}, {Name: "page", Description: "from 1"}, {Name: "limit", Description: "1-200, default 50"}}, Response: map[string]interface{}{}},
+	"GET /admin/reports/duplicate-images": {Summary: "Pairs of near-duplicate images on different properties by perceptual hash, closest first, at most 500",
+		Response: map[string]interface{}{}},
+	"GET /admin/reports/orphaned-listings": {Summary: "Active listings whose agent was deactivated or deleted, to reassign with PUT /listings/{id}",
+		Response: []Listing{}},
+	"GET /developers": {Summary: "List developers by name; until the developers migration ran, the distinct Developer names of the properties without ids, flagged by X-Developers-Source: properties",
+		Response: []Developer{}},
+	"GET /developers/{id}": {Summary: "Get a developer",
+		Response: Developer{}},
+	"GET /developers/{id}/properties": {Summary: "The properties linked to a developer by DeveloperID, by title",
+		Query: listPageParams, Response: []Property{}},
+	"GET /agents": {Summary: "List active agents",
+		Query: []apiParam{{Name: "include_inactive", Description: "true adds deactivated agents"}, includeDeletedParam}, Response: []Agent{}},
+	"GET /agents/{id}": {Summary: "Get an agent",
+		Response: Agent{}},
+	"GET /agents/{id}/listings": {Summary: "An agent's listings, newest first; drafts need the API key",
+		Response: []Listing{}},
+	"GET /agents/{id}/inquiries": {Summary: "Inquiries assigned to an agent, newest first",
+		Query: []apiParam{{Name: "include_archived", Description: "true adds inquiries archived with their property and those moved to inquiries_archive"}}, Response: []Inquiry{}},
+	"POST /inquiries/{id}/assign": {Summary: "Reassign an inquiry to an active agent",
+		RequestBody: struct {
+			AgentID string `json:"agent_id"`
+		}{}, Response: Inquiry{}},
+	"POST /inquiries/{id}/replied": {Summary: "Record the first reply to an inquiry; 409 when already recorded",
+		Response: Inquiry{}},
+	"GET /admin/slow-queries": {Summary: "The last 100 Mongo commands slower than SLOW_QUERY_THRESHOLD (default 500ms) with their request id, and a summary by command and collection",
+		Response: map[string]interface{}{}},
+	"GET /admin/db-health": {Summary: "Mongo pool stats, ping latency and per-collection document counts and index names within 800ms; status is degraded when a part timed out or failed",
+		Response: map[string]interface{}{}},
+	"GET /admin/requests/{request_id}": {Summary: "Debug captures of a request by its X-Request-ID, newest first: the request body and, for non-2xx answers, the response body, with email, phone and password fields redacted. Captured with DEBUG_CAPTURE=true (ignored with ENV=production) or per request by an admin sending X-Debug-Capture: true",
+		Response: []requestCapture{}},
+	"GET /admin/analytics/searches": {Summary: "Most common filter combinations (listing_type, price band, bedrooms, area, q) and query terms of visitor searches; emails and phone numbers are removed from q before storage",
+		Query: []apiParam{{Name: "days", Description: "1-90, default 7"}, {Name: "limit", Description: "1-100, default 20"}}, Response: map[string]interface{}{}},
+	"GET /admin/analytics/inquiry-sources": {Summary: "Inquiries per utm_source, utm_medium and utm_campaign with how many converted, i.e. the user booked an appointment for the property afterwards; inquiries without a source are the row with empty utm_ values",
+		Query:    []apiParam{{Name: "from", Description: "RFC3339 or YYYY-MM-DD"}, {Name: "to", Description: "RFC3339 or YYYY-MM-DD, a date is inclusive"}, includeArchivedParam},
+		Response: []inquirySourceStats{}},
+	"POST /admin/archive": {Summary: "Move answered or property-archived inquiries and completed or cancelled appointments older than ARCHIVE_AFTER_DAYS (default 365) to inquiries_archive and appointments_archive; also runs nightly at 03:30",
+		Query: []apiParam{{Name: "cutoff", Description: "RFC3339 or YYYY-MM-DD in the past, replaces ARCHIVE_AFTER_DAYS"}}, Response: archiveResult{}},
+	"GET /metrics": {Summary: "Prometheus text format metrics, among them the Mongo pool checkouts, checkout failures, connections and checkout wait histogram"},
+	"GET /admin/maintenance": {Summary: "Whether maintenance mode is on; instance_env_override is true when this instance was started with MAINTENANCE_MODE=on",
+		Response: map[string]interface{}{}},
+	"POST /admin/maintenance": {Summary: "Turn maintenance mode on or off for every instance within 5s; while on, writes answer 503 with Retry-After and GETs keep working",
+		RequestBody: maintenanceState{}, Response: map[string]interface{}{}},
+	"GET /admin/api-keys": {Summary: "Partner API keys, revoked ones included, newest first; the keys themselves are never shown again",
+		Response: []APIKey{}},
+	"POST /admin/api-keys": {Summary: "Create a partner key with name and scopes (read, write, upload, admin); the response holds the only copy of the key",
+		RequestBody: map[string]interface{}{}, Response: APIKey{}},
+	"DELETE /admin/api-keys/{id}": {Summary: "Revoke a partner key; other instances stop accepting it within API_KEY_CACHE_TTL (default 1m), 204"},
+	"GET /admin/api-keys/{id}/usage": {Summary: "Daily request counts of a key for the last 30 days",
+		Response: map[string]interface{}{}},
+	"GET /admin/webhooks": {Summary: "Active webhook subscriptions, newest first; signing secrets are never shown again",
+		Response: []WebhookSubscription{}},
+	"POST /admin/webhooks": {Summary: "Subscribe a URL to <collection>.<action> events, every event when events is empty; the response holds the only copy of the signing secret",
+		RequestBody: map[string]interface{}{}, Response: WebhookSubscription{}, Created: true},
+	"DELETE /admin/webhooks/{id}": {Summary: "Remove a webhook subscription and drop its queued deliveries; dead letters are kept",
+		Response: map[string]interface{}{}},
+	"GET /admin/webhooks/dead-letters": {Summary: "Deliveries given up after WEBHOOK_MAX_AGE of retries, most recent first",
+		Query: []apiParam{{Name: "webhook_id"}, {Name: "event", Description: "e.g. listings.update"}, listPageParams[0], listPageParams[1]}, Response: []webhookDelivery{}},
+	"POST /admin/webhooks/dead-letters/{id}/redeliver": {Summary: "Queue a dead letter again with a fresh WEBHOOK_MAX_AGE, 202",
+		Response: webhookDelivery{}},
+	"GET /events/stream": {Summary: "Server-Sent Events listing.created, listing.updated and inquiry.created with {id, collection, action, at}; a comment every 25s keeps the connection open",
+		Query: []apiParam{{Name: "last_event_id", Description: "same as the Last-Event-ID header, replays the recent events after it"}}},
+	"GET /ws": {Summary: "WebSocket of the signed-in agent's inquiry.assigned, appointment.booked and appointment.cancelled as {id, type, data}; 401 without a valid token",
+		Query: []apiParam{{Name: "token", Description: "agent token from POST /agents/{id}/token, or send it as Authorization: Bearer"}}},
+	"POST /agents/{id}/token": {Summary: "Issue a 12 hour token for GET /ws to an active agent, as {token, expires_at}; 404 for inactive agents",
+		Response: map[string]interface{}{}},
+	"POST /users/{id}/token": {Summary: "Issue a 12 hour token for the user's notifications, devices, saved searches and waitlist entries, as {token, expires_at}; 404 for unknown users",
+		Response: map[string]interface{}{}},
+	"GET /agents/{id}/availability": {Summary: "The agent's weekly working hours (Asia/Bangkok) and blackouts; default is true while the agent uses the global VIEWING_HOURS. The agent's own token from POST /agents/{id}/token works as Authorization: Bearer instead of the API key",
+		Response: agentAvailability{}},
+	"PUT /agents/{id}/availability": {Summary: "Replace the agent's working hours and blackouts; bookings outside them answer 422 from then on, existing appointments are kept. Takes the agent's Bearer token or the API key",
+		RequestBody: availabilityBody{}, Response: agentAvailability{}},
+	"GET /admin/scheduler": {Summary: "Recurring tasks with their cron expression, next run on this instance and last run and error on any instance",
+		Response: []map[string]interface{}{}},
+	"GET /admin/jobs": {Summary: "Background jobs newest first, such as the inquiry_email sent to the assigned agent",
+		Query: []apiParam{{Name: "status", Description: "queued, running, done or dead"}, {Name: "type"}, listPageParams[0], listPageParams[1]}, Response: []jobs.Job{}},
+	"POST /admin/jobs/{id}/retry": {Summary: "Queue a dead job to run again now with its attempts reset, 202; 404 unless the job is dead",
+		Response: jobs.Job{}},
+	"POST /admin/shortlinks": {Summary: "Mint a /l/<code> short link to the public page of a listing or property with {target_type, target_id, campaign}; 404 for an unknown target",
+		RequestBody: map[string]interface{}{}, Response: ShortLink{}, Created: true},
+	"GET /admin/shortlinks/{code}/stats": {Summary: "A short link with its total and daily click counts, newest day first",
+		Response: map[string]interface{}{}},
+	"GET /l/{code}": {Summary: "302 to the target of a short link, counting the click; 404 for an unknown code"},
+	"GET /admin/ranking-weights": {Summary: "Weights used by GET /listings?sort=relevance",
+		Response: rankingWeights{}},
+	"PUT /admin/ranking-weights": {Summary: "Change relevance weights; every instance picks them up within a minute",
+		RequestBody: rankingWeights{}, Response: rankingWeights{}},
+	"GET /admin/agents/stats": {Summary: "Per-agent listings, inquiries, reply latency, appointments and closed deals, sorted by completed appointments (CSV with ?format=csv); X-Archives-Included tells whether archived documents were counted",
+		Query: []apiParam{{Name: "from", Description: "RFC3339 or YYYY-MM-DD"}, {Name: "to", Description: "RFC3339 or YYYY-MM-DD, inclusive"}, includeArchivedParam}, Response: []agentStats{}},
+	"GET /users/{id}/notifications": {Summary: "A user's notifications, newest first. Takes the user's Bearer token from POST /users/{id}/token or the API key",
+		Query: []apiParam{{Name: "unread", Description: "true for unread only"}, {Name: "page", Description: "from 1"}, {Name: "limit", Description: "1-100, default 20"}}, Response: map[string]interface{}{}},
+	"GET /users/{id}/notifications/unread-count": {Summary: "Number of unread notifications; takes the user's Bearer token or the API key",
+		Response: map[string]int{}},
+	"POST /users/{id}/notifications/mark-read": {Summary: "Mark notification_ids read, or all of the user's notifications without a body; read ones expire after 90 days. Takes the user's Bearer token or the API key",
+		RequestBody: struct {
+			NotificationIDs []string `json:"notification_ids"`
+		}{}, Response: map[string]int{}},
+	"POST /users/{id}/devices": {Summary: "Register an FCM push token for a user, or refresh its last_seen. Takes the user's Bearer token from POST /users/{id}/token or the API key",
+		RequestBody: struct {
+			Token    string `json:"token"`
+			Platform string `json:"platform"` // ios, android or web
+		}{}, Response: Device{}},
+	"POST /users/{id}/saved-searches": {Summary: "Save a listing filter, optionally with a radius; new matching listings notify and email the user. Takes the user's Bearer token from POST /users/{id}/token or the API key",
+		RequestBody: SavedSearch{}, Response: SavedSearch{}},
+	"GET /users/{id}/saved-searches": {Summary: "A user's saved searches; takes the user's Bearer token or the API key",
+		Response: []SavedSearch{}},
+	"GET /users/{id}/saved-searches/{search_id}": {Summary: "One saved search",
+		Response: SavedSearch{}},
+	"PUT /users/{id}/saved-searches/{search_id}": {Summary: "Change the name, filter, near or alerts of a saved search; near with radius_m 0 removes the radius",
+		RequestBody: savedSearchUpdate{}, Response: SavedSearch{}},
+	"DELETE /users/{id}/saved-searches/{search_id}": {Summary: "Delete a saved search"},
+	"DELETE /users/{id}/waitlist/{waitlist_id}": {Summary: "Withdraw a waiting waitlist entry; 409 when it was already promoted, withdrawn or failed. Takes the user's Bearer token from POST /users/{id}/token or the API key",
+		Response: WaitlistEntry{}},
+	"GET /saved-searches/unsubscribe": {Summary: "Confirmation page for the unsubscribe link in alert emails",
+		Query: []apiParam{{Name: "token", Required: true}}},
+	"POST /saved-searches/unsubscribe": {Summary: "Turn off alerts for the saved search of token",
+		Query: []apiParam{{Name: "token", Required: true}}},
+	"GET /appointments/confirm": {Summary: "Confirmation page for the confirm link in booking emails; JSON with format=json",
+		Query: []apiParam{{Name: "token", Required: true}, {Name: "format"}, tzParam}},
+	"POST /appointments/confirm": {Summary: "Confirm the scheduled appointment of token; a token works once",
+		Query: []apiParam{{Name: "token", Required: true}, {Name: "format"}}},
+	"GET /appointments/cancel": {Summary: "Confirmation page for the cancel link in booking emails; JSON with format=json",
+		Query: []apiParam{{Name: "token", Required: true}, {Name: "format"}, tzParam}},
+	"POST /appointments/cancel": {Summary: "Cancel the scheduled or confirmed appointment of token; a token works once",
+		Query: []apiParam{{Name: "token", Required: true}, {Name: "format"}}},
+	"POST /appointments/{id}/status": {Summary: "Confirm, complete or cancel an open appointment; cancellations notify the user",
+		RequestBody: struct {
+			Status string `json:"status"`
+			Reason string `json:"reason"`
+		}{}, Query: []apiParam{tzParam}, Response: Appointment{}},
+	"POST /appointments/{id}/reschedule": {Summary: "Move an open appointment to a new future date and email the user new confirm links; 422 outside the agent's working hours or in a blackout; 409 when the listing is already booked then",
+		RequestBody: struct {
+			AppointmentDate time.Time `json:"Appointment_date"`
+		}{}, Query: []apiParam{tzParam}, Response: Appointment{}},
+	"POST /admin/digest/preview": {Summary: "Render an agent's daily digest email as HTML without sending it",
+		Query: []apiParam{{Name: "agent_id", Required: true}}},
+	"POST /admin/push/test": {Summary: "Push a test message to a user's devices; 503 when FCM_CREDENTIALS_FILE isn't configured",
+		RequestBody: struct {
+			UserID string `json:"user_id"`
+			Title  string `json:"title"`
+			Body   string `json:"body"`
+		}{}, Response: map[string]int{}},
+	"POST /developers": {Summary: "Create a developer; 409 when the name is taken, ignoring case",
+		RequestBody: developerUpdate{}, Response: Developer{}, Created: true},
+	"PUT /developers/{id}": {Summary: "Update developer fields; a new name is copied to the Developer of its properties",
+		RequestBody: developerUpdate{}, Response: Developer{}},
+	"DELETE /developers/{id}": {Summary: "Soft-delete a developer; 409 while properties are linked to it, merge it instead",
+		Response: map[string]string{}},
+	"POST /admin/developers/{id}/merge": {Summary: "Move the properties of a developer to the one in into, with its name, and soft-delete the first; answers {moved, into}",
+		RequestBody: struct {
+			Into string `json:"into"`
+		}{}, Response: map[string]interface{}{}},
+	"POST /agents": {Summary: "Create an agent, active unless active is false; 409 when the email is taken",
+		RequestBody: agentUpdate{}, Response: Agent{}},
+	"PUT /agents/{id}": {Summary: "Update agent fields; deactivating keeps their listings, see the orphaned listings report",
+		RequestBody: agentUpdate{}, Response: Agent{}},
+	"DELETE /agents/{id}": {Summary: "Soft-delete an agent; their listings are kept",
+		Response: map[string]string{}},
+	"GET /admin/reports/inconsistencies": {Summary: "Data errors to fix, such as listings on a floor above their property's TotalFloors", Response: map[string][]dataInconsistency{}},
+	"GET /admin/consistency": {Summary: "Check the references between collections: listings of a missing property, inquiries of a deleted user, appointments whose listing belongs to another property and a sample of property images whose Cloudinary asset is gone. Each check gives its count and up to 10 example ids; a check that failed has error set",
+		Query: []apiParam{{Name: "check", Description: "listing_property_missing, inquiry_user_missing, appointment_property_mismatch or image_asset_missing; every check when empty"},
+			{Name: "image_sample", Description: "images HEADed by image_asset_missing, 1 to 500, default 50"},
+			{Name: "background", Description: "true runs the checks as a job and answers 202 with the report, its Location to poll"}},
+		Response: map[string][]consistencyResult{}},
+	"GET /admin/consistency/reports/{id}": {Summary: "A background consistency report; results grows as checks finish and status is done once all did, reports are kept 30 days", Response: consistencyReport{}},
+	"POST /admin/images/watermark": {Summary: "Rewrite the stored Cloudinary URLs of all property images and listing photos to carry the current WATERMARK_ overlay, without uploading again",
+		Query: []apiParam{{Name: "remove", Description: "true restores the unwatermarked URLs"}}, Response: map[string]interface{}{}},
+	"POST /admin/purge": {Summary: "Permanently remove documents soft-deleted before the cutoff",
+		Query: []apiParam{{Name: "days", Description: "age of the deletion in days, default 30"}}, Response: map[string]interface{}{}},
+	"POST /listings/{id}/request-verification": {Summary: "Submit a listing for ownership review with the public_ids of documents uploaded to its property; 409 unless it is unverified or rejected. Takes the API key or the Bearer token of the listing's agent",
+		RequestBody: struct {
+			Documents []string `json:"documents"`
+		}{}, Response: listingVerification{}},
+	"GET /listings/{id}/verification": {Summary: "The listing's verification state, documents and rejection reason. Takes the API key or the Bearer token of the listing's agent",
+		Response: listingVerification{}},
+	"GET /admin/listings/verification-queue": {Summary: "Listings in a verification state with their verification, longest waiting first",
+		Query: append([]apiParam{{Name: "state", Description: strings.Join(verificationStates, ", ") + "; default pending_review"}}, listPageParams...), Response: []map[string]interface{}{}},
+	"POST /admin/listings/{id}/verification/approve": {Summary: "Verify a listing pending review; it gets the verified badge and a relevance boost",
+		Response: listingVerification{}},
+	"POST /admin/listings/{id}/verification/reject": {Summary: "Reject a listing pending review, or revoke a verified one, with a reason; its agent is notified",
+		RequestBody: struct {
+			Reason string `json:"reason"`
+		}{}, Response: listingVerification{}},
+	"PATCH /admin/listings/{id}/featured": {Summary: "Set or clear a listing's featured flag", RequestBody: struct {
+		Featured bool `json:"featured"`
+	}{}, Response: map[string]interface{}{}},
+	"GET /admin/stats": {Summary: "Dashboard statistics, cached for 60 seconds; archived inquiries and appointments are not counted (X-Archives-Included: false)",
+		Query: []apiParam{{Name: "users_since", Description: "RFC3339 or YYYY-MM-DD, default start of this month"}, {Name: "inquiries_since", Description: "RFC3339 or YYYY-MM-DD, default start of this week"}}, Response: adminStats{}},
+	"GET /graphql":      {Summary: "GraphQL endpoint (query passed as ?query=)"},
+	"POST /graphql":     {Summary: "GraphQL endpoint", RequestBody: map[string]interface{}{}},
+	"GET /playground":   {Summary: "GraphQL playground, only registered when ENV=dev"},
+	"GET /healthz":      {Summary: "Liveness probe, 200 as soon as the process listens; every other route answers 503 starting until MongoDB and the indexes are up"},
+	"GET /openapi.json": {Summary: "This OpenAPI document"},
+	"GET /docs":         {Summary: "Swagger UI"},
+}
+
+var pathParamPattern = regexp.MustCompile(`\{([^}:]+)(:[^}]*)?\}`)
+
+// buildOpenAPISpec walks the router so every registered route ends up in the document
+func buildOpenAPISpec(router *mux.Router) map[string]interface{} {
+	schemas := map[string]interface{}{}
+	paths := map[string]map[string]interface{}{}
+
+	router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		tmpl, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+
+		// OpenAPI paths don't carry mux regex constraints
+		oaPath := pathParamPattern.ReplaceAllString(tmpl, "{$1}")
+		var pathParams []string
+		for _, m := range pathParamPattern.FindAllStringSubmatch(tmpl, -1) {
+			pathParams = append(pathParams, m[1])
+		}
+
+		for _, method := range methods {
+			if method == http.MethodOptions {
+				continue
+			}
+			if paths[oaPath] == nil {
+				paths[oaPath] = map[string]interface{}{}
+			}
+			paths[oaPath][strings.ToLower(method)] = buildOperation(method, tmpl, pathParams, schemas)
+		}
+		return nil
+	})
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "MV Realty API",
+			"version": "1.0.0",
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+		},
+	}
+}
+
+func buildOperation(method, tmpl string, pathParams []string, schemas map[string]interface{}) map[string]interface{} {
+	doc, documented := apiDocs[method+" "+tmpl]
+
+	op := map[string]interface{}{}
+	if documented {
+		op["summary"] = doc.Summary
+	} else {
+		op["summary"] = "Undocumented route"
+		op["x-undocumented"] = true
+	}
+
+	var params []interface{}
+	for _, name := range pathParams {
+		params = append(params, map[string]interface{}{
+			"name": name, "in": "path", "required": true,
+			"schema": map[string]interface{}{"type": "string"},
+		})
+	}
+	for _, q := range doc.Query {
+		params = append(params, map[string]interface{}{
+			"name": q.Name, "in": "query", "required": q.Required, "description": q.Description,
+			"schema": map[string]interface{}{"type": "string"},
+		})
+	}
+	if len(params) > 0 {
+		op["parameters"] = params
+	}
+
+	if doc.RequestBody != nil {
+		op["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content": map[string]interface{}{
+				"application/json": map[string]interface{}{"schema": schemaFor(reflect.TypeOf(doc.RequestBody), schemas)},
+			},
+		}
+	} else if len(doc.Multipart) > 0 {
+		props := map[string]interface{}{}
+		for _, f := range doc.Multipart {
+			props[f] = map[string]interface{}{"type": "string", "format": "binary"}
+		}
+		op["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content": map[string]interface{}{
+				"multipart/form-data": map[string]interface{}{
+					"schema": map[string]interface{}{"type": "object", "properties": props, "required": doc.Multipart},
+				},
+			},
+		}
+	}
+
+	status, success := "200", map[string]interface{}{"description": "OK"}
+	if doc.Created {
+		status, success = "201", map[string]interface{}{
+			"description": "Created",
+			"headers": map[string]interface{}{
+				"Location": map[string]interface{}{"description": "path of the created resource", "schema": map[string]interface{}{"type": "string"}},
+			},
+		}
+	}
+	if doc.Response != nil {
+		success["content"] = map[string]interface{}{
+			"application/json": map[string]interface{}{"schema": schemaFor(reflect.TypeOf(doc.Response), schemas)},
+		}
+	}
+	// Handlers write errors with http.Error, i.e. a plain text message; the API key checks, the
+	// 503s while starting or with uploads disabled and the timeout 504 answer {"error", "code"} with
+	// jsonError
+	errorResponse := map[string]interface{}{
+		"description": "Error message",
+		"content": map[string]interface{}{
+			"text/plain": map[string]interface{}{"schema": map[string]interface{}{"type": "string"}},
+			"application/json": map[string]interface{}{"schema": map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"error": map[string]interface{}{"type": "string"},
+					"code":  map[string]interface{}{"type": "string"},
+				},
+			}},
+		},
+	}
+	op["responses"] = map[string]interface{}{
+		status: success,
+		"4XX":  errorResponse,
+		"5XX":  errorResponse,
+	}
+	return op
+}
+
+var (
+	timeType     = reflect.TypeOf(time.Time{})
+	objectIDType = reflect.TypeOf(primitive.ObjectID{})
+	// Raw JSON is written out as is, any value
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+	rawJSONType    = reflect.TypeOf(rawJSON(""))
+)
+
+// schemaFor converts a Go type to a JSON schema, registering named structs under components
+func schemaFor(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	switch t {
+	case timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case objectIDType:
+		return map[string]interface{}{"type": "string", "pattern": "^[0-9a-f]{24}$"}
+	case rawMessageType, rawJSONType:
+		return map[string]interface{}{}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return schemaFor(t.Elem(), schemas)
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		s := map[string]interface{}{"type": "array", "items": schemaFor(t.Elem(), schemas)}
+		if t.Kind() == reflect.Array {
+			s["minItems"] = t.Len()
+			s["maxItems"] = t.Len()
+		}
+		return s
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaFor(t.Elem(), schemas)}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return structSchema(t, schemas)
+		}
+		name := schemaName(t)
+		if _, ok := schemas[name]; !ok {
+			schemas[name] = map[string]interface{}{} // placeholder guards against recursive types
+			schemas[name] = structSchema(t, schemas)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+	}
+	return map[string]interface{}{}
+}
+
+var typeArgPackage = regexp.MustCompile(`[^\[\],]*\.`)
+
+// schemaName turns generic instantiations like syncResponse[github.com/.../main.Listing] into syncResponse_Listing
+func schemaName(t reflect.Type) string {
+	name := typeArgPackage.ReplaceAllString(t.Name(), "")
+	return strings.NewReplacer("[", "_", "]", "", ",", "_").Replace(name)
+}
+
+func structSchema(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	props := map[string]interface{}{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		props[name] = schemaFor(f.Type, schemas)
+	}
+	return map[string]interface{}{"type": "object", "properties": props}
+}
+
+func openAPIHandler(router *mux.Router) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(buildOpenAPISpec(router))
+	}
+}
+
+// undocumentedRoutes lists registered routes that have no apiDocs entry, sorted
+func undocumentedRoutes(router *mux.Router) []string {
+	var missing []string
+	router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		tmpl, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		methods, _ := route.GetMethods()
+		for _, method := range methods {
+			if _, ok := apiDocs[method+" "+tmpl]; !ok && method != http.MethodOptions {
+				missing = append(missing, method+" "+tmpl)
+			}
+		}
+		return nil
+	})
+	sort.Strings(missing)
+	return missing
+}
+
+const swaggerUIPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8" />
+  <title>MV Realty API</title>
+  <link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css" />
+</head>
+<body>
+  <div id="swagger-ui"></div>
+  <script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js" crossorigin></script>
+  <script>
+    window.onload = () => {
+      window.ui = SwaggerUIBundle({ url: "/openapi.json", dom_id: "#swagger-ui" });
+    };
+  </script>
+</body>
+</html>
+`
+
+func swaggerUI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(swaggerUIPage))
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// TestRoutesDocumented fails for routes added without an apiDocs entry
+func TestRoutesDocumented(t *testing.T) {
+	t.Setenv("ENV", "dev")
+	for _, route := range undocumentedRoutes(router()) {
+		t.Errorf("route %s is missing from apiDocs", route)
+	}
+}
+
+// TestAPIDocsRouted fails for apiDocs entries whose route is gone or was renamed. ENV=dev registers
+// the GraphQL playground too.
+func TestAPIDocsRouted(t *testing.T) {
+	t.Setenv("ENV", "dev")
+	routed := map[string]bool{}
+	router().Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		tmpl, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		methods, _ := route.GetMethods()
+		for _, method := range methods {
+			routed[method+" "+tmpl] = true
+		}
+		return nil
+	})
+	for key := range apiDocs {
+		if method, _, _ := strings.Cut(key, " "); method == http.MethodOptions {
+			continue
+		}
+		if !routed[key] {
+			t.Errorf("apiDocs documents %s, which isn't routed", key)
+		}
+	}
+}
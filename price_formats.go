@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/LynnT-2003/mv-realty-backend/pricefmt"
+)
+
+// ?include=formatted adds display strings next to the prices of listing and property responses,
+// see the pricefmt package. They are left out by default to keep the payloads small.
+var formattedIncludeParam = apiParam{Name: "include", Description: "formatted adds price_formatted (฿8.5M) and price_formatted_long (฿8,500,000)"}
+
+var localeParam = apiParam{Name: "locale", Description: "locale of the formatted prices, en or th; Accept-Language when unset"}
+
+// priceLocale reports whether r asked for formatted prices and in which locale. The locale may come
+// from Accept-Language, so such responses vary by it.
+func priceLocale(w http.ResponseWriter, r *http.Request) (pricefmt.Locale, bool) {
+	if !includesPart(r, "formatted") {
+		return "", false
+	}
+	w.Header().Add("Vary", "Accept-Language")
+	return responseLocale(r), true
+}
+
+// responseLocale is the locale of the formatted prices of r
+func responseLocale(r *http.Request) pricefmt.Locale {
+	return pricefmt.Match(r.URL.Query().Get("locale"), r.Header.Get("Accept-Language"))
+}
+
+// formattedLocaleKey is what the locale adds to the response cache key and the ETags of r: nothing
+// unless it asked for formatted prices
+func formattedLocaleKey(r *http.Request) string {
+	if !includesPart(r, "formatted") {
+		return ""
+	}
+	return "|" + string(responseLocale(r))
+}
+
+func formatListingPrices(listings []Listing, loc pricefmt.Locale) {
+	for i := range listings {
+		currency := listingCurrency(&listings[i])
+		listings[i].PriceFormatted = pricefmt.Compact(listings[i].Price, currency, loc)
+		listings[i].PriceFormattedLong = pricefmt.Long(listings[i].Price, currency, loc)
+	}
+}
+
+// formatPropertyPrices formats the price range of a property, which is always in THB. A bound
+// that isn't set stays unformatted.
+func formatPropertyPrices(property *Property, loc pricefmt.Locale) {
+	if property.MinPrice > 0 {
+		property.MinPriceFormatted = pricefmt.Compact(float64(property.MinPrice), defaultCurrency, loc)
+		property.MinPriceFormattedLong = pricefmt.Long(float64(property.MinPrice), defaultCurrency, loc)
+	}
+	if property.MaxPrice > 0 {
+		property.MaxPriceFormatted = pricefmt.Compact(float64(property.MaxPrice), defaultCurrency, loc)
+		property.MaxPriceFormattedLong = pricefmt.Long(float64(property.MaxPrice), defaultCurrency, loc)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/LynnT-2003/mv-realty-backend/pricefmt"
+)
+
+func TestPriceLocale(t *testing.T) {
+	for _, tt := range []struct {
+		target, acceptLanguage string
+		want                   pricefmt.Locale
+		formatted              bool
+		key                    string
+	}{
+		{"/listings", "th-TH", "", false, ""},
+		{"/listings?include=price_drop", "th-TH", "", false, ""},
+		{"/listings?include=formatted", "", pricefmt.English, true, "|en"},
+		{"/listings?include=price_drop,formatted", "th-TH,th;q=0.9", pricefmt.Thai, true, "|th"},
+		{"/listings?include=formatted&locale=en", "th-TH", pricefmt.English, true, "|en"},
+		{"/listings?include=formatted&locale=th", "", pricefmt.Thai, true, "|th"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, tt.target, nil)
+		if tt.acceptLanguage != "" {
+			r.Header.Set("Accept-Language", tt.acceptLanguage)
+		}
+		rec := httptest.NewRecorder()
+		loc, formatted := priceLocale(rec, r)
+		if loc != tt.want || formatted != tt.formatted || formattedLocaleKey(r) != tt.key {
+			t.Errorf("%s, %q: %q %v, key %q", tt.target, tt.acceptLanguage, loc, formatted, formattedLocaleKey(r))
+		}
+		if varies := rec.Header().Get("Vary") == "Accept-Language"; varies != tt.formatted {
+			t.Errorf("%s: Vary %q", tt.target, rec.Header().Get("Vary"))
+		}
+	}
+}
+
+func TestFormatListingPrices(t *testing.T) {
+	listings := []Listing{{Price: 8500000}, {Price: 1234.5, Currency: "USD"}, {Price: 25000, Currency: "THB"}}
+	formatListingPrices(listings, pricefmt.English)
+	for i, want := range [][2]string{{"฿8.5M", "฿8,500,000"}, {"$1.2K", "$1,234.50"}, {"฿25K", "฿25,000"}} {
+		if listings[i].PriceFormatted != want[0] || listings[i].PriceFormattedLong != want[1] {
+			t.Errorf("listing %d: %q %q, want %q", i, listings[i].PriceFormatted, listings[i].PriceFormattedLong, want)
+		}
+	}
+	formatListingPrices(listings[:1], pricefmt.Thai)
+	if listings[0].PriceFormatted != "฿8.5 ล้าน" {
+		t.Errorf("in Thai: %q", listings[0].PriceFormatted)
+	}
+}
+
+func TestFormatPropertyPrices(t *testing.T) {
+	p := Property{MinPrice: 3500000, MaxPrice: 12000000}
+	formatPropertyPrices(&p, pricefmt.English)
+	if p.MinPriceFormatted != "฿3.5M" || p.MinPriceFormattedLong != "฿3,500,000" || p.MaxPriceFormatted != "฿12M" || p.MaxPriceFormattedLong != "฿12,000,000" {
+		t.Errorf("formatted %+v", p)
+	}
+	unset := Property{MaxPrice: 20000}
+	formatPropertyPrices(&unset, pricefmt.English)
+	if unset.MinPriceFormatted != "" || unset.MinPriceFormattedLong != "" || unset.MaxPriceFormatted != "฿20K" {
+		t.Errorf("an unset bound is formatted: %+v", unset)
+	}
+}
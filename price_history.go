@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// maxPriceHistory caps Listing.PriceHistory; older changes are dropped by $slice
+	maxPriceHistory = 50
+	// priceDropWindow is how long a price reduction is advertised
+	priceDropWindow = 30 * 24 * time.Hour
+)
+
+// priceChange is one entry of a listing's price history
+type priceChange struct {
+	Price         float64   `bson:"price" json:"price"`
+	PreviousPrice float64   `bson:"previous_price" json:"previous_price"`
+	ChangedAt     time.Time `bson:"changed_at" json:"changed_at"`
+	ChangedBy     string    `bson:"changed_by" json:"changed_by"`
+}
+
+// pushPriceChange is the update that appends a change and keeps only the latest maxPriceHistory entries
+func pushPriceChange(change priceChange) bson.M {
+	return bson.M{"price_history": bson.M{"$each": bson.A{change}, "$slice": -maxPriceHistory}}
+}
+
+// priceDrop returns the previous price and the reduction in percent (1 decimal) when the latest
+// change lowered the price within priceDropWindow of now; nil otherwise
+func priceDrop(history []priceChange, now time.Time) (previous, pct *float64) {
+	if len(history) == 0 {
+		return nil, nil
+	}
+	last := history[len(history)-1]
+	if last.PreviousPrice <= 0 || last.Price >= last.PreviousPrice || now.Sub(last.ChangedAt) > priceDropWindow {
+		return nil, nil
+	}
+	prev := last.PreviousPrice
+	drop := math.Round((prev-last.Price)/prev*1000) / 10
+	return &prev, &drop
+}
+
+// getListingPriceHistory returns the price changes of a listing, newest first
+func getListingPriceHistory(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	id, ok := pathObjectID(w, r, "Listing")
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	var listing Listing
+	err := client.Database("MVDB").Collection("listings").FindOne(ctx, publishedListingsFilter(bson.M{"_id": id}),
+		options.FindOne().SetProjection(bson.M{"price": 1, "price_history": 1})).Decode(&listing)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Listing not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		serverError(w, r, "Failed to retrieve Listing", err)
+		return
+	}
+
+	history := make([]priceChange, 0, len(listing.PriceHistory))
+	for i := len(listing.PriceHistory) - 1; i >= 0; i-- {
+		history = append(history, listing.PriceHistory[i])
+	}
+	json.NewEncoder(w).Encode(bson.M{"listing_id": id.Hex(), "price": listing.Price, "history": history})
+}
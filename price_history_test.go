@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPriceDrop(t *testing.T) {
+	now := time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC)
+	change := func(previous, price float64, age time.Duration) priceChange {
+		return priceChange{PreviousPrice: previous, Price: price, ChangedAt: now.Add(-age), ChangedBy: "agent"}
+	}
+	tests := []struct {
+		name     string
+		history  []priceChange
+		previous float64 // 0: no badge
+		pct      float64
+	}{
+		{"no history", nil, 0, 0},
+		{"a rise", []priceChange{change(20000, 22000, time.Hour)}, 0, 0},
+		{"unchanged", []priceChange{change(20000, 20000, time.Hour)}, 0, 0},
+		{"first price", []priceChange{change(0, 20000, time.Hour)}, 0, 0},
+		{"a drop", []priceChange{change(20000, 18000, time.Hour)}, 20000, 10},
+		{"rounded to a decimal", []priceChange{change(30000, 20000, time.Hour)}, 30000, 33.3},
+		{"a drop inside the window", []priceChange{change(20000, 19000, priceDropWindow-time.Second)}, 20000, 5},
+		{"a drop at the end of the window", []priceChange{change(20000, 19000, priceDropWindow)}, 20000, 5},
+		{"a drop past the window", []priceChange{change(20000, 19000, priceDropWindow+time.Second)}, 0, 0},
+		{"a drop then a rise", []priceChange{change(20000, 18000, 2*time.Hour), change(18000, 19000, time.Hour)}, 0, 0},
+		{"a rise then a drop", []priceChange{change(20000, 22000, 2*time.Hour), change(22000, 21000, time.Hour)}, 22000, 4.5},
+	}
+	for _, tt := range tests {
+		previous, pct := priceDrop(tt.history, now)
+		if tt.previous == 0 {
+			if previous != nil || pct != nil {
+				t.Errorf("%s: badge %v %v", tt.name, deref(previous), deref(pct))
+			}
+			continue
+		}
+		if previous == nil || pct == nil || *previous != tt.previous || *pct != tt.pct {
+			t.Errorf("%s: %v %v, want %v %v", tt.name, deref(previous), deref(pct), tt.previous, tt.pct)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+// Package pricefmt formats prices for display, so every client shows the same "฿8.5M" for a
+// listing instead of each one rounding and abbreviating on its own.
+//
+// Long is the full amount with thousands separators, "฿8,500,000", and cents only when there are
+// any. Compact abbreviates amounts of a thousand and more to one decimal below 100 of the unit and
+// none from there, "฿8.5M" and "฿125M", and switches to the next unit once rounding reaches it, so
+// 999,960 is "฿1M" rather than "฿1000K". Thai uses its own units: 350,000 is "฿3.5 แสน".
+package pricefmt
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type Locale string
+
+const (
+	English Locale = "en"
+	Thai    Locale = "th"
+)
+
+// Locales are the supported locales, English being the default
+var Locales = []Locale{English, Thai}
+
+type compactUnit struct {
+	size   float64
+	suffix string
+}
+
+type localeFormat struct {
+	group, decimal string
+	units          []compactUnit // smallest first
+}
+
+var formats = map[Locale]localeFormat{
+	English: {group: ",", decimal: ".", units: []compactUnit{
+		{1e3, "K"}, {1e6, "M"}, {1e9, "B"}, {1e12, "T"},
+	}},
+	Thai: {group: ",", decimal: ".", units: []compactUnit{
+		{1e3, " พัน"}, {1e4, " หมื่น"}, {1e5, " แสน"}, {1e6, " ล้าน"}, {1e9, " พันล้าน"},
+	}},
+}
+
+// symbols are written before the amount; a currency without one is prefixed with its code
+var symbols = map[string]string{
+	"THB": "฿",
+	"USD": "$",
+	"EUR": "€",
+	"GBP": "£",
+	"JPY": "¥",
+	"CNY": "CN¥",
+	"SGD": "S$",
+	"HKD": "HK$",
+	"AUD": "A$",
+}
+
+// minorDigits is the number of decimals of a currency's cents, 2 unless listed
+var minorDigits = map[string]int{
+	"JPY": 0,
+}
+
+// Symbol is the symbol Long and Compact put before amounts in currency
+func Symbol(currency string) string {
+	currency = strings.ToUpper(currency)
+	if s, ok := symbols[currency]; ok {
+		return s
+	}
+	return currency + " "
+}
+
+// Match picks the locale of the first hint naming a supported one. A hint is a locale like "th" or
+// "th-TH", or a whole Accept-Language header, whose languages are tried by their q weight; pass
+// ?locale= before the header so an explicit choice wins. English is the fallback.
+func Match(hints ...string) Locale {
+	for _, hint := range hints {
+		for _, tag := range acceptedLanguages(hint) {
+			base, _, _ := strings.Cut(strings.ReplaceAll(tag, "_", "-"), "-")
+			if _, ok := formats[Locale(strings.ToLower(base))]; ok {
+				return Locale(strings.ToLower(base))
+			}
+		}
+	}
+	return English
+}
+
+// acceptedLanguages are the language tags of an Accept-Language value, highest q first; tags with
+// q=0 are left out
+func acceptedLanguages(header string) []string {
+	type weighted struct {
+		tag string
+		q   float64
+	}
+	var tags []weighted
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(part, ";")
+		tag = strings.TrimSpace(tag)
+		if tag == "" || tag == "*" {
+			continue
+		}
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		if q > 0 {
+			tags = append(tags, weighted{tag, q})
+		}
+	}
+	sort.SliceStable(tags, func(i, j int) bool { return tags[i].q > tags[j].q })
+	out := make([]string, len(tags))
+	for i, t := range tags {
+		out[i] = t.tag
+	}
+	return out
+}
+
+func formatOf(loc Locale) localeFormat {
+	if f, ok := formats[loc]; ok {
+		return f
+	}
+	return formats[English]
+}
+
+// Long formats amount in full, "฿8,500,000" or "$1,234.50"; NaN and infinities give ""
+func Long(amount float64, currency string, loc Locale) string {
+	if math.IsNaN(amount) || math.IsInf(amount, 0) {
+		return ""
+	}
+	digits, ok := minorDigits[strings.ToUpper(currency)]
+	if !ok {
+		digits = 2
+	}
+	scale := math.Pow(10, float64(digits))
+	rounded := math.Round(math.Abs(amount)*scale) / scale
+	if rounded == math.Trunc(rounded) {
+		digits = 0
+	}
+	return sign(amount, rounded) + Symbol(currency) + number(rounded, digits, formatOf(loc))
+}
+
+// Compact formats amount abbreviated, "฿8.5M"; amounts below a thousand are written as by Long
+func Compact(amount float64, currency string, loc Locale) string {
+	if math.IsNaN(amount) || math.IsInf(amount, 0) {
+		return ""
+	}
+	f := formatOf(loc)
+	abs := math.Abs(amount)
+	if abs < f.units[0].size {
+		return Long(amount, currency, loc) // 950 stays "฿950", not "฿1K"
+	}
+	for i := len(f.units) - 1; i >= 0; i-- {
+		unit := f.units[i]
+		digits := 1
+		if abs/unit.size >= 100 {
+			digits = 0
+		}
+		scaled := math.Round(abs/unit.size*math.Pow(10, float64(digits))) / math.Pow(10, float64(digits))
+		if scaled < 1 {
+			continue
+		}
+		if scaled == math.Trunc(scaled) {
+			digits = 0
+		}
+		return sign(amount, scaled) + Symbol(currency) + number(scaled, digits, f) + unit.suffix
+	}
+	return Long(amount, currency, loc)
+}
+
+// sign is "-" for negative amounts that don't round to zero
+func sign(amount, rounded float64) string {
+	if amount < 0 && rounded != 0 {
+		return "-"
+	}
+	return ""
+}
+
+// number writes a non-negative value with digits decimals and the locale's separators
+func number(value float64, digits int, f localeFormat) string {
+	s := strconv.FormatFloat(value, 'f', digits, 64)
+	whole, frac, _ := strings.Cut(s, ".")
+	var b strings.Builder
+	for i, c := range whole {
+		if i > 0 && (len(whole)-i)%3 == 0 {
+			b.WriteString(f.group)
+		}
+		b.WriteRune(c)
+	}
+	if frac != "" {
+		b.WriteString(f.decimal)
+		b.WriteString(frac)
+	}
+	return b.String()
+}
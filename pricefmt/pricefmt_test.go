@@ -0,0 +1,171 @@
+package pricefmt
+
+import (
+	"math"
+	"testing"
+)
+
+func TestLong(t *testing.T) {
+	tests := []struct {
+		amount   float64
+		currency string
+		want     string
+	}{
+		{0, "THB", "฿0"},
+		{7, "THB", "฿7"},
+		{999, "THB", "฿999"},
+		{1000, "THB", "฿1,000"},
+		{25000, "THB", "฿25,000"},
+		{999999, "THB", "฿999,999"},
+		{8500000, "THB", "฿8,500,000"},
+		{1234567890, "THB", "฿1,234,567,890"},
+		{1234.5, "USD", "$1,234.50"},
+		{1234.56, "USD", "$1,234.56"},
+		{1234.565, "USD", "$1,234.57"},
+		{0.5, "USD", "$0.50"},
+		{1999.999, "USD", "$2,000"}, // cents that round away aren't written
+		{1234.6, "JPY", "¥1,235"},
+		{1200, "EUR", "€1,200"},
+		{1200, "GBP", "£1,200"},
+		{1200, "SGD", "S$1,200"},
+		{1200, "usd", "$1,200"},
+		{1200, "VND", "VND 1,200"}, // no symbol, the code
+		{-1500, "THB", "-฿1,500"},
+		{-0.004, "USD", "$0"},
+	}
+	for _, tt := range tests {
+		if got := Long(tt.amount, tt.currency, English); got != tt.want {
+			t.Errorf("Long(%v, %s) = %q, want %q", tt.amount, tt.currency, got, tt.want)
+		}
+	}
+	if got := Long(8500000, "THB", Thai); got != "฿8,500,000" {
+		t.Errorf("Thai: %q", got)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	tests := []struct {
+		amount   float64
+		currency string
+		want     string
+	}{
+		{0, "THB", "฿0"},
+		{950, "THB", "฿950"},
+		{999, "THB", "฿999"},
+		{999.5, "USD", "$999.50"},
+		{1000, "THB", "฿1K"},
+		{1049, "THB", "฿1K"},
+		{1050, "THB", "฿1.1K"},
+		{1500, "THB", "฿1.5K"},
+		{25000, "THB", "฿25K"},
+		{99949, "THB", "฿99.9K"},
+		{99950, "THB", "฿100K"}, // one decimal below 100 of the unit
+		{125000, "THB", "฿125K"},
+		{949999, "THB", "฿950K"},
+		{999499, "THB", "฿1M"}, // 0.9995M is 1.0M at one decimal
+		{999500, "THB", "฿1M"}, // rounded up into the next unit, not "฿1000K"
+		{999960, "THB", "฿1M"},
+		{1000000, "THB", "฿1M"},
+		{8500000, "THB", "฿8.5M"},
+		{8550000, "THB", "฿8.6M"},
+		{12340000, "THB", "฿12.3M"},
+		{125000000, "THB", "฿125M"},
+		{999999999, "THB", "฿1B"},
+		{2500000000, "THB", "฿2.5B"},
+		{3e12, "THB", "฿3T"},
+		{4.5e15, "THB", "฿4,500T"}, // past the largest unit
+		{8500000, "USD", "$8.5M"},
+		{1500, "JPY", "¥1.5K"},
+		{1500, "VND", "VND 1.5K"},
+		{-8500000, "THB", "-฿8.5M"},
+		{-999, "THB", "-฿999"},
+	}
+	for _, tt := range tests {
+		if got := Compact(tt.amount, tt.currency, English); got != tt.want {
+			t.Errorf("Compact(%v, %s) = %q, want %q", tt.amount, tt.currency, got, tt.want)
+		}
+	}
+}
+
+func TestCompactThai(t *testing.T) {
+	tests := []struct {
+		amount float64
+		want   string
+	}{
+		{999, "฿999"},
+		{1000, "฿1 พัน"},
+		{2500, "฿2.5 พัน"},
+		{9449, "฿9.4 พัน"},
+		{9950, "฿1 หมื่น"}, // Thai has a unit for each power of ten up to a million
+		{25000, "฿2.5 หมื่น"},
+		{350000, "฿3.5 แสน"},
+		{940000, "฿9.4 แสน"},
+		{950000, "฿1 ล้าน"},
+		{995000, "฿1 ล้าน"},
+		{8500000, "฿8.5 ล้าน"},
+		{125000000, "฿125 ล้าน"},
+		{2500000000, "฿2.5 พันล้าน"},
+		{2e12, "฿2,000 พันล้าน"},
+	}
+	for _, tt := range tests {
+		if got := Compact(tt.amount, "THB", Thai); got != tt.want {
+			t.Errorf("Compact(%v) in Thai = %q, want %q", tt.amount, got, tt.want)
+		}
+	}
+}
+
+func TestNotANumber(t *testing.T) {
+	for _, amount := range []float64{math.NaN(), math.Inf(1), math.Inf(-1)} {
+		if Long(amount, "THB", English) != "" || Compact(amount, "THB", English) != "" {
+			t.Errorf("%v isn't left unformatted", amount)
+		}
+	}
+}
+
+func TestUnknownLocale(t *testing.T) {
+	if got := Compact(8500000, "THB", Locale("fr")); got != "฿8.5M" {
+		t.Errorf("an unknown locale: %q, want the English format", got)
+	}
+}
+
+func TestSymbol(t *testing.T) {
+	for currency, want := range map[string]string{
+		"THB": "฿", "thb": "฿", "USD": "$", "EUR": "€", "GBP": "£", "JPY": "¥", "CNY": "CN¥",
+		"SGD": "S$", "HKD": "HK$", "AUD": "A$", "CHF": "CHF ",
+	} {
+		if got := Symbol(currency); got != want {
+			t.Errorf("Symbol(%s) = %q, want %q", currency, got, want)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		hints []string
+		want  Locale
+	}{
+		{nil, English},
+		{[]string{""}, English},
+		{[]string{"th"}, Thai},
+		{[]string{"TH"}, Thai},
+		{[]string{"th-TH"}, Thai},
+		{[]string{"th_TH"}, Thai},
+		{[]string{"en-US"}, English},
+		{[]string{"fr"}, English},
+		{[]string{"", "th-TH,th;q=0.9,en;q=0.8"}, Thai},
+		{[]string{"", "en-US,en;q=0.9,th;q=0.8"}, English},
+		{[]string{"", "fr-FR,th;q=0.5,en;q=0.4"}, Thai},      // the first supported one
+		{[]string{"", "en;q=0.3, th;q=0.7"}, Thai},           // by weight, not order
+		{[]string{"", "th;q=0,en;q=0.5"}, English},           // q=0 is "not this one"
+		{[]string{"", "th;q=abc,en"}, English},               // a bad weight is ignored
+		{[]string{"", "*, th;q=0.2"}, Thai},                  // * isn't a locale
+		{[]string{"en", "th-TH,th;q=0.9"}, English},          // ?locale= wins over the header
+		{[]string{"fr", "th-TH,th;q=0.9"}, Thai},             // unless it isn't supported
+		{[]string{"", "de-DE, fr;q=0.9, es;q=0.8"}, English}, // none supported
+	}
+	for _, tt := range tests {
+		if got := Match(tt.hints...); got != tt.want {
+			t.Errorf("Match(%q) = %s, want %s", tt.hints, got, tt.want)
+		}
+	}
+}
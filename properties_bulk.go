@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/LynnT-2003/mv-realty-backend/imagemeta"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const maxBulkProperties = 100
+
+// bulkPropertyResult is aligned by index with the submitted array
+type bulkPropertyResult struct {
+	Index      int         `json:"index"`
+	PropertyID interface{} `json:"property_id,omitempty"`
+	Error      string      `json:"error,omitempty"`
+}
+
+// createProperties inserts an array of properties with one unordered InsertMany,
+// so an invalid or rejected document doesn't block the rest
+func createProperties(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Parse request body for POST
+	var properties []Property
+	err := json.NewDecoder(r.Body).Decode(&properties)
+	if err != nil {
+		http.Error(w, "Failed to parse request body", http.StatusBadRequest)
+		return
+	}
+	if len(properties) == 0 {
+		http.Error(w, "At least one Property is required", http.StatusBadRequest)
+		return
+	}
+	if len(properties) > maxBulkProperties {
+		http.Error(w, "Too many Properties, the maximum per request is 100", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	results := make([]bulkPropertyResult, len(properties))
+	var docs []interface{}
+	var docIndex []int            // position in properties for each entry in docs
+	reserved := map[string]bool{} // slugs taken by earlier entries in this request
+	for i := range properties {
+		results[i].Index = i
+		problems := validatePropertyFields(&properties[i])
+		linkProblems, err := linkDeveloper(ctx, &properties[i])
+		if err != nil {
+			serverError(w, r, "Failed to check the Properties' developers", err)
+			return
+		}
+		if problems = append(problems, linkProblems...); len(problems) > 0 {
+			results[i].Error = (&validationError{Problems: problems}).Error()
+			continue
+		}
+		slug, err := propertySlug(ctx, properties[i].Title, reserved)
+		if err != nil {
+			serverError(w, r, "Failed to generate Property slugs", err)
+			return
+		}
+		reserved[slug] = true
+		properties[i].Slug = slug
+		properties[i].CreatedAt = time.Now()
+		properties[i].UpdatedAt = properties[i].CreatedAt
+		properties[i].Images = []imagemeta.Image{}
+		properties[i].Location = propertyLocation(properties[i].Coordinates)
+		fillTransit(&properties[i])
+		docs = append(docs, properties[i])
+		docIndex = append(docIndex, i)
+	}
+
+	if len(docs) > 0 {
+		collection := client.Database("MVDB").Collection("properties")
+		res, err := collection.InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
+		failed := map[int]bool{}
+		if err != nil {
+			var bulkErr mongo.BulkWriteException
+			if !errors.As(err, &bulkErr) {
+				http.Error(w, "Failed to create Properties", http.StatusInternalServerError)
+				return
+			}
+			for _, we := range bulkErr.WriteErrors {
+				failed[we.Index] = true
+				results[docIndex[we.Index]].Error = "Failed to create Property"
+			}
+		}
+		meta := auditFromRequest(r)
+		for i, id := range res.InsertedIDs {
+			if !failed[i] {
+				results[docIndex[i]].PropertyID = id
+				auditCreated(meta, "properties", id, docs[i])
+			}
+		}
+	}
+
+	json.NewEncoder(w).Encode(bson.M{"results": results})
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// GET /properties/{id}/activity is the feed behind the "recently sold" badges of the property page.
+// Nothing new is written for it: publications come from the listings' published_at (created_at for
+// listings that were never drafts), price changes from their price history and sales and rentals
+// from the audit log of deactivations. Drafts and what happened to a listing before it was
+// published are left out.
+const (
+	activityPublished    = "published"
+	activityPriceChanged = "price_changed"
+	activitySold         = "sold"
+	activityRented       = "rented"
+
+	activityCacheControl = "public, max-age=300"
+)
+
+var activityTypes = []string{activityPublished, activityPriceChanged, activitySold, activityRented}
+
+// listingActivity is one entry of the feed. PreviousPrice is set for price changes; Price is the
+// price after a change and the current price otherwise.
+type listingActivity struct {
+	Type          string    `json:"type"`
+	ListingID     string    `json:"listing_id"`
+	At            time.Time `json:"at"`
+	ListingType   string    `json:"listing_type"`
+	Bedroom       int       `json:"bedroom"`
+	Floor         int       `json:"floor"`
+	Price         float64   `json:"price"`
+	PreviousPrice *float64  `json:"previous_price,omitempty"`
+}
+
+func getPropertyActivity(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	id, ok := pathObjectID(w, r, "Property")
+	if !ok {
+		return
+	}
+	types := activityTypes
+	if raw := r.URL.Query().Get("types"); raw != "" {
+		types = strings.Split(raw, ",")
+		for _, t := range types {
+			if !isOneOf(t, activityTypes) {
+				http.Error(w, fmt.Sprintf("types must be a comma separated subset of %s", strings.Join(activityTypes, ", ")), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	page, ok := parseListPage(w, r)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	db := client.Database("MVDB")
+	if err := db.Collection("properties").FindOne(ctx, notDeleted(bson.M{"_id": id})).Err(); err == mongo.ErrNoDocuments {
+		http.Error(w, "Property not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		serverError(w, r, "Failed to retrieve Property", err)
+		return
+	}
+	listings, err := findAllWith[Listing](ctx, "listings", publishedListingsFilter(bson.M{"property_id": id.Hex()}),
+		options.Find().SetProjection(bson.M{"listing_type": 1, "bedroom": 1, "floor": 1, "price": 1, "created_at": 1, "published_at": 1, "price_history": 1}))
+	if err != nil {
+		serverError(w, r, "Failed to retrieve Listings", err)
+		return
+	}
+
+	entries := []listingActivity{}
+	byID := make(map[string]Listing, len(listings))
+	for _, l := range listings {
+		byID[l.ID.Hex()] = l
+		entry := func(activityType string, at time.Time, price float64) listingActivity {
+			return listingActivity{Type: activityType, ListingID: l.ID.Hex(), At: at, ListingType: l.ListingType, Bedroom: l.Bedroom, Floor: l.Floor, Price: price}
+		}
+		published := l.CreatedAt
+		if l.PublishedAt != nil {
+			published = *l.PublishedAt
+		}
+		if isOneOf(activityPublished, types) {
+			entries = append(entries, entry(activityPublished, published, l.Price))
+		}
+		if isOneOf(activityPriceChanged, types) {
+			for _, c := range l.PriceHistory {
+				if c.ChangedAt.Before(published) {
+					continue
+				}
+				e := entry(activityPriceChanged, c.ChangedAt, c.Price)
+				previous := c.PreviousPrice
+				e.PreviousPrice = &previous
+				entries = append(entries, e)
+			}
+		}
+	}
+
+	var reasons bson.A
+	for _, t := range []string{activitySold, activityRented} {
+		if isOneOf(t, types) {
+			reasons = append(reasons, t)
+		}
+	}
+	if len(reasons) > 0 && len(byID) > 0 {
+		ids := make(bson.A, 0, len(byID))
+		for listingID := range byID {
+			ids = append(ids, listingID)
+		}
+		opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}})
+		if page.Limit > 0 {
+			opts.SetLimit(page.Skip + page.Limit)
+		}
+		audits, err := findAllWith[AuditEntry](ctx, "audit_logs", bson.M{
+			"collection":  "listings",
+			"document_id": bson.M{"$in": ids},
+			"changes":     bson.M{"$elemMatch": bson.M{"field": "deactivation_reason", "after": bson.M{"$in": reasons}}},
+		}, opts)
+		if err != nil {
+			serverError(w, r, "Failed to retrieve listing activity", err)
+			return
+		}
+		for _, a := range audits {
+			l := byID[a.DocumentID]
+			for _, c := range a.Changes {
+				if reason, _ := c.After.(string); c.Field == "deactivation_reason" && isOneOf(reason, types) {
+					entries = append(entries, listingActivity{Type: reason, ListingID: a.DocumentID, At: a.CreatedAt,
+						ListingType: l.ListingType, Bedroom: l.Bedroom, Floor: l.Floor, Price: l.Price})
+				}
+			}
+		}
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		if !entries[i].At.Equal(entries[j].At) {
+			return entries[i].At.After(entries[j].At)
+		}
+		return entries[i].ListingID < entries[j].ListingID
+	})
+	if page.Limit > 0 {
+		start := min(page.Skip, int64(len(entries)))
+		entries = entries[start:min(start+page.Limit, int64(len(entries)))]
+	}
+
+	cc := cacheControl(r)
+	if cc == defaultCacheControl {
+		cc = activityCacheControl
+	}
+	w.Header().Set("Cache-Control", cc)
+	json.NewEncoder(w).Encode(entries)
+}
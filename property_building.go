@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// maxListingFloor returns the highest floor of the property's non-deleted listings, 0 when it has none
+func maxListingFloor(ctx context.Context, propertyID string) (int, error) {
+	var top Listing
+	err := client.Database("MVDB").Collection("listings").FindOne(ctx, notDeleted(bson.M{"property_id": propertyID}),
+		options.FindOne().SetSort(bson.M{"floor": -1}).SetProjection(bson.M{"floor": 1})).Decode(&top)
+	if err == mongo.ErrNoDocuments {
+		return 0, nil
+	}
+	return top.Floor, err
+}
+
+type stackUnit struct {
+	ListingID   string  `bson:"listing_id" json:"listing_id"`
+	Slug        string  `bson:"slug,omitempty" json:"slug,omitempty"`
+	Bedroom     int     `bson:"bedroom" json:"bedroom"`
+	Size        float64 `bson:"size" json:"size"`
+	Price       float64 `bson:"price" json:"price"`
+	Currency    string  `bson:"currency,omitempty" json:"currency,omitempty"`
+	ListingType string  `bson:"listing_type" json:"listing_type"`
+}
+
+type stackFloor struct {
+	Floor    int         `bson:"_id" json:"floor"`
+	Listings []stackUnit `bson:"listings" json:"listings"`
+}
+
+// getPropertyStack returns the property's active listings grouped by floor, top floor first. When the
+// property has total_floors every floor down to 1 is included, empty floors with no listings.
+func getPropertyStack(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	id, ok := pathObjectID(w, r, "Property")
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	db := client.Database("MVDB")
+	var property Property
+	err := db.Collection("properties").FindOne(ctx, notDeleted(bson.M{"_id": id})).Decode(&property)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Property not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		serverError(w, r, "Failed to retrieve Property", err)
+		return
+	}
+
+	cur, err := db.Collection("listings").Aggregate(ctx, []bson.M{
+		{"$match": activeListingsFilter(bson.M{"property_id": id.Hex()})},
+		{"$sort": bson.M{"price": 1}},
+		{"$group": bson.M{"_id": "$floor", "listings": bson.M{"$push": bson.M{
+			"listing_id":   bson.M{"$toString": "$_id"},
+			"slug":         "$slug",
+			"bedroom":      "$bedroom",
+			"size":         "$size",
+			"price":        "$price",
+			"currency":     "$currency",
+			"listing_type": "$listing_type",
+		}}}},
+		{"$sort": bson.M{"_id": -1}},
+	})
+	if err != nil {
+		serverError(w, r, "Failed to aggregate Listings by floor", err)
+		return
+	}
+	var occupied []stackFloor
+	if err := cur.All(ctx, &occupied); err != nil {
+		serverError(w, r, "Failed to decode Listings by floor", err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(bson.M{
+		"property_id":  id.Hex(),
+		"total_floors": property.TotalFloors,
+		"floors":       fillStack(occupied, property.TotalFloors),
+	})
+}
+
+// fillStack adds empty floors from total floors down to 1 around the occupied ones (sorted top first).
+// Floors outside that range, like basements or data errors above the top floor, are kept.
+func fillStack(occupied []stackFloor, totalFloors int) []stackFloor {
+	if totalFloors <= 0 {
+		if occupied == nil {
+			return []stackFloor{}
+		}
+		return occupied
+	}
+	byFloor := map[int]stackFloor{}
+	for _, f := range occupied {
+		byFloor[f.Floor] = f
+	}
+	top, bottom := totalFloors, 1
+	if len(occupied) > 0 {
+		top = max(top, occupied[0].Floor)
+		bottom = min(bottom, occupied[len(occupied)-1].Floor)
+	}
+	stack := make([]stackFloor, 0, top-bottom+1)
+	for floor := top; floor >= bottom; floor-- {
+		f, ok := byFloor[floor]
+		if !ok {
+			f = stackFloor{Floor: floor, Listings: []stackUnit{}}
+		}
+		stack = append(stack, f)
+	}
+	return stack
+}
+
+type dataInconsistency struct {
+	Issue       string `bson:"issue" json:"issue"`
+	ListingID   string `bson:"listing_id" json:"listing_id"`
+	PropertyID  string `bson:"property_id" json:"property_id"`
+	Floor       int    `bson:"floor" json:"floor"`
+	TotalFloors int    `bson:"total_floors" json:"total_floors"`
+}
+
+// getInconsistencyReport lists data errors for admins to fix: currently listings on a floor above
+// their property's total_floors
+func getInconsistencyReport(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	cur, err := client.Database("MVDB").Collection("listings").Aggregate(ctx, []bson.M{
+		{"$match": notDeleted(bson.M{})},
+		{"$lookup": bson.M{
+			"from":     "properties",
+			"let":      bson.M{"pid": bson.M{"$convert": bson.M{"input": "$property_id", "to": "objectId", "onError": nil, "onNull": nil}}},
+			"pipeline": []bson.M{{"$match": bson.M{"$expr": bson.M{"$eq": bson.A{"$_id", "$$pid"}}}}, {"$project": bson.M{"total_floors": 1}}},
+			"as":       "_property",
+		}},
+		{"$addFields": bson.M{"total_floors": bson.M{"$ifNull": bson.A{bson.M{"$first": "$_property.total_floors"}, 0}}}},
+		{"$match": bson.M{"total_floors": bson.M{"$gt": 0}, "$expr": bson.M{"$gt": bson.A{"$floor", "$total_floors"}}}},
+		{"$project": bson.M{
+			"_id":          0,
+			"issue":        bson.M{"$literal": "floor_above_total_floors"},
+			"listing_id":   bson.M{"$toString": "$_id"},
+			"property_id":  1,
+			"floor":        1,
+			"total_floors": 1,
+		}},
+		{"$sort": bson.D{{Key: "property_id", Value: 1}, {Key: "floor", Value: -1}}},
+	})
+	if err != nil {
+		serverError(w, r, "Failed to build inconsistency report", err)
+		return
+	}
+	issues := []dataInconsistency{}
+	if err := cur.All(ctx, &issues); err != nil {
+		serverError(w, r, "Failed to decode inconsistency report", err)
+		return
+	}
+	json.NewEncoder(w).Encode(bson.M{"issues": issues})
+}
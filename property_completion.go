@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Values of Property.Completion
+const (
+	completionCompleted         = "completed"
+	completionUnderConstruction = "under_construction"
+	completionOffPlan           = "off_plan"
+)
+
+var completionStatuses = []string{completionCompleted, completionUnderConstruction, completionOffPlan}
+
+// completionInfo is the property's completion shown on listings of properties not yet completed
+type completionInfo struct {
+	Status             string     `json:"status"`
+	ExpectedCompletion *time.Time `json:"expected_completion"`
+}
+
+// completionProblems checks the completion status against Built and expected_completion.
+// Properties created before the status existed have none and aren't checked.
+func completionProblems(property *Property) []string {
+	switch property.Completion {
+	case "":
+		return nil
+	case completionCompleted:
+		if property.Built == 0 {
+			return []string{"Built is required when CompletionStatus is completed"}
+		}
+	case completionUnderConstruction, completionOffPlan:
+		if property.CompletesAt == nil {
+			return []string{"ExpectedCompletion is required when CompletionStatus is " + property.Completion}
+		}
+	default:
+		return []string{fmt.Sprintf("CompletionStatus must be one of %s", strings.Join(completionStatuses, ", "))}
+	}
+	return nil
+}
+
+// parseCompletedBy reads ?completed_by= as a month (2026-12) or a day, returning the exclusive
+// upper bound: the first day of the next month or the next day, in Bangkok time
+func parseCompletedBy(value string) (time.Time, error) {
+	if month, err := time.ParseInLocation("2006-01", value, bangkok); err == nil {
+		return month.AddDate(0, 1, 0), nil
+	}
+	day, err := time.ParseInLocation("2006-01-02", value, bangkok)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return day.AddDate(0, 0, 1), nil
+}
+
+// applyCompletionFilter adds ?completion_status= and ?completed_by= to a properties filter.
+// completed_by matches completed properties, including older ones that only have Built, and those
+// expected to complete before the bound. It answers 400 and returns false for bad values.
+func applyCompletionFilter(w http.ResponseWriter, r *http.Request, filter bson.M) bool {
+	q := r.URL.Query()
+	if status := q.Get("completion_status"); status != "" {
+		if !isOneOf(status, completionStatuses) {
+			http.Error(w, "completion_status must be one of "+strings.Join(completionStatuses, ", "), http.StatusBadRequest)
+			return false
+		}
+		filter["completion_status"] = status
+	}
+	if v := q.Get("completed_by"); v != "" {
+		before, err := parseCompletedBy(v)
+		if err != nil {
+			http.Error(w, "completed_by must be a month (YYYY-MM) or a date (YYYY-MM-DD)", http.StatusBadRequest)
+			return false
+		}
+		filter["$or"] = bson.A{
+			bson.M{"completion_status": completionCompleted},
+			bson.M{"completion_status": nil, "built": bson.M{"$gt": 0}},
+			bson.M{"completion_status": bson.M{"$ne": completionCompleted}, "expected_completion": bson.M{"$lt": before}},
+		}
+	}
+	return true
+}
+
+var completionFilterParams = []apiParam{
+	{Name: "completion_status", Description: strings.Join(completionStatuses, ", ")},
+	{Name: "completed_by", Description: "YYYY-MM or YYYY-MM-DD; completed properties and those expected to complete by then"},
+}
+
+// listingCompletion looks up the completion of the listing's property, nil once it is completed
+// or when it has no status
+func listingCompletion(ctx context.Context, propertyID string) (*completionInfo, error) {
+	oid, err := primitive.ObjectIDFromHex(propertyID)
+	if err != nil {
+		return nil, nil
+	}
+	var property Property
+	err = client.Database("MVDB").Collection("properties").FindOne(ctx, bson.M{"_id": oid},
+		options.FindOne().SetProjection(bson.M{"completion_status": 1, "expected_completion": 1})).Decode(&property)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if property.Completion == "" || property.Completion == completionCompleted {
+		return nil, nil
+	}
+	return &completionInfo{Status: property.Completion, ExpectedCompletion: property.CompletesAt}, nil
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/LynnT-2003/mv-realty-backend/imagemeta"
+	"github.com/cloudinary/cloudinary-go/v2/api/uploader"
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	documentFolder     = "property_documents"
+	maxDocumentNameLen = 150 // characters
+)
+
+// Document is a file attached to a property, such as a developer brochure or an EIA report.
+// Documents are left out of property responses unless ?include=documents is given.
+type Document struct {
+	Name        string    `bson:"name" json:"name"`
+	URL         string    `bson:"url" json:"url"`
+	PublicID    string    `bson:"public_id" json:"public_id"`
+	ContentType string    `bson:"content_type" json:"content_type"`
+	Size        int64     `bson:"size" json:"size"` // bytes
+	UploadedAt  time.Time `bson:"uploaded_at" json:"uploaded_at"`
+}
+
+// maxDocumentSize is the largest accepted upload, DOCUMENT_MAX_MB (default 20)
+var maxDocumentSize = maxDocumentSizeFromEnv()
+
+func maxDocumentSizeFromEnv() int64 {
+	if raw := os.Getenv("DOCUMENT_MAX_MB"); raw != "" {
+		if mb, err := strconv.Atoi(raw); err == nil && mb > 0 {
+			return int64(mb) << 20
+		}
+		log.Println("Ignoring invalid DOCUMENT_MAX_MB:", raw)
+	}
+	return 20 << 20
+}
+
+var documentsIncludeParam = apiParam{Name: "include", Description: "comma separated; documents adds Documents, formatted adds MinPriceFormatted, MaxPriceFormatted and their Long forms"}
+
+// includesPart reports whether the comma separated ?include= has part
+func includesPart(r *http.Request, part string) bool {
+	for _, p := range strings.Split(r.URL.Query().Get("include"), ",") {
+		if strings.TrimSpace(p) == part {
+			return true
+		}
+	}
+	return false
+}
+
+// uploadPropertyDocument takes a multipart "document" PDF and an optional "name" (the file name
+// by default) and stores it in Cloudinary as a raw resource. The content is sniffed, so a file
+// that only claims to be a PDF is rejected.
+func uploadPropertyDocument(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	id, ok := pathObjectID(w, r, "Property")
+	if !ok {
+		return
+	}
+	// Headroom for the other form fields and the multipart framing
+	r.Body = http.MaxBytesReader(w, r.Body, maxDocumentSize+1<<20)
+	if err := r.ParseMultipartForm(10 << 20); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, fmt.Sprintf("document must be at most %d MB", maxDocumentSize>>20), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "Unable to parse form data", http.StatusBadRequest)
+		return
+	}
+	file, header, err := r.FormFile("document")
+	if err != nil {
+		http.Error(w, "Unable to get the file from form data", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	if header.Size > maxDocumentSize {
+		http.Error(w, fmt.Sprintf("document must be at most %d MB", maxDocumentSize>>20), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(file, head)
+	contentType := http.DetectContentType(head[:n])
+	if contentType != "application/pdf" {
+		http.Error(w, "document must be a PDF", http.StatusUnsupportedMediaType)
+		return
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		serverError(w, r, "Unable to read the file", err)
+		return
+	}
+
+	name := imagemeta.CleanText(r.FormValue("name"))
+	if name == "" {
+		name = strings.TrimSuffix(path.Base(header.Filename), path.Ext(header.Filename))
+	}
+	if name == "" || utf8.RuneCountInString(name) > maxDocumentNameLen {
+		http.Error(w, "name is required and must be at most 150 characters", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 60*time.Second)
+	defer cancel()
+
+	// Checked before uploading so a bad id doesn't leave an orphaned file in Cloudinary
+	collection := client.Database("MVDB").Collection("properties")
+	if err := collection.FindOne(ctx, notDeleted(bson.M{"_id": id})).Err(); err == mongo.ErrNoDocuments {
+		http.Error(w, "Property not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		serverError(w, r, "Failed to retrieve Property", err)
+		return
+	}
+
+	cld, err := newCloudinary()
+	if err != nil {
+		serverError(w, r, "Failed to initialize Cloudinary", err)
+		return
+	}
+	// Raw resources are served as uploaded, without Cloudinary's image processing
+	uploadResult, err := cld.Upload.Upload(ctx, file, uploader.UploadParams{Folder: documentFolder, ResourceType: "raw"})
+	if err != nil {
+		serverError(w, r, "Failed to upload document to Cloudinary: ", err)
+		return
+	}
+	if uploadResult.SecureURL == "" {
+		http.Error(w, "Empty SecureURL returned from Cloudinary", http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	doc := Document{
+		Name:        name,
+		URL:         uploadResult.SecureURL,
+		PublicID:    uploadResult.PublicID,
+		ContentType: contentType,
+		Size:        header.Size,
+		UploadedAt:  now,
+	}
+	before := auditSnapshot(ctx, "properties", id)
+	_, err = collection.UpdateOne(ctx, notDeleted(bson.M{"_id": id}), bson.M{
+		"$push": bson.M{"documents": doc},
+		"$set":  bson.M{"updated_at": now},
+	})
+	if err != nil {
+		serverError(w, r, "Failed to update Property with document", err)
+		return
+	}
+	recordAudit(auditFromRequest(r), "update", "properties", id.Hex(), before, auditSnapshot(ctx, "properties", id), nil)
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(doc)
+}
+
+// deletePropertyDocument removes a document from the property, then deletes the file from
+// Cloudinary. A failed Cloudinary delete is only logged.
+func deletePropertyDocument(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	id, ok := pathObjectID(w, r, "Property")
+	if !ok {
+		return
+	}
+	params := mux.Vars(r)
+	publicID := params["public_id"]
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	collection := client.Database("MVDB").Collection("properties")
+	before := auditSnapshot(ctx, "properties", id)
+	res, err := collection.UpdateOne(ctx, notDeleted(bson.M{"_id": id, "documents.public_id": publicID}), bson.M{
+		"$pull": bson.M{"documents": bson.M{"public_id": publicID}},
+		"$set":  bson.M{"updated_at": time.Now()},
+	})
+	if err != nil {
+		serverError(w, r, "Failed to delete document", err)
+		return
+	}
+	if res.MatchedCount == 0 {
+		http.Error(w, "Document not found", http.StatusNotFound)
+		return
+	}
+	recordAudit(auditFromRequest(r), "update", "properties", id.Hex(), before, auditSnapshot(ctx, "properties", id), nil)
+
+	if cld, err := newCloudinary(); err != nil {
+		log.Println("Failed to initialize Cloudinary to delete document", publicID+":", err)
+	} else if _, err := cld.Upload.Destroy(ctx, uploader.DestroyParams{PublicID: publicID, ResourceType: "raw"}); err != nil {
+		log.Println("Failed to delete document", publicID, "from Cloudinary:", err)
+	}
+
+	json.NewEncoder(w).Encode(bson.M{"message": "Document deleted"})
+}
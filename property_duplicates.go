@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"unicode"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	duplicateNearbyMeters = 50
+	// titleEditDistance is how many single-character edits two normalized titles may differ by
+	// and still count as the same project; short titles must match exactly
+	titleEditDistance   = 2
+	titleFuzzyMinLength = 8
+)
+
+// normalizeTitle lowercases, drops punctuation and collapses whitespace,
+// so "The Line  Sukhumvit-101" and "the line sukhumvit 101" compare equal.
+// Combining marks are kept, Thai vowels and tone marks are written with them.
+func normalizeTitle(title string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(title) {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsMark(r):
+			b.WriteRune(r)
+		default:
+			b.WriteRune(' ')
+		}
+	}
+	return strings.Join(strings.Fields(b.String()), " ")
+}
+
+// levenshtein is the edit distance between a and b, counted in runes
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
+
+// sortedWords is a normalized title with its words in order, so "Ploenchit Noble" equals "Noble Ploenchit"
+func sortedWords(normalized string) string {
+	words := strings.Fields(normalized)
+	sort.Strings(words)
+	return strings.Join(words, " ")
+}
+
+// similarTitles reports whether two titles name the same project after normalization,
+// in any word order or within titleEditDistance edits
+func similarTitles(a, b string) bool {
+	na, nb := normalizeTitle(a), normalizeTitle(b)
+	if na == "" || nb == "" {
+		return false
+	}
+	if na == nb || sortedWords(na) == sortedWords(nb) {
+		return true
+	}
+	if len([]rune(na)) < titleFuzzyMinLength || len([]rune(nb)) < titleFuzzyMinLength {
+		return false
+	}
+	return levenshtein(na, nb) <= titleEditDistance
+}
+
+// findDuplicateProperty returns an existing property with a similar title or within 50 m, or nil.
+// The properties collection holds one document per project, so it is scanned (title and coordinates only).
+func findDuplicateProperty(ctx context.Context, property *Property) (*Property, error) {
+	candidates, err := findAllWith[Property](ctx, "properties", notDeleted(bson.M{}),
+		options.Find().SetProjection(bson.M{"title": 1, "coordinates": 1}))
+	if err != nil {
+		return nil, err
+	}
+	for i := range candidates {
+		c := &candidates[i]
+		if similarTitles(property.Title, c.Title) {
+			return c, nil
+		}
+		if hasCoordinates(property.Coordinates) && hasCoordinates(c.Coordinates) &&
+			haversineMeters(property.Coordinates, c.Coordinates) <= duplicateNearbyMeters {
+			return c, nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import "testing"
+
+func TestSimilarTitles(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"Noble Ploenchit", "noble ploenchit", true},
+		{"Noble Ploenchit", "  Noble   Ploenchit ", true},
+		{"The Line Sukhumvit-101", "the line sukhumvit 101", true},
+		{"Noble Ploenchit", "Ploenchit Noble", true},
+		{"The Line Sukhumvit 101", "Sukhumvit 101 The Line", true},
+		{"Noble Ploenchit", "Noble Ploenchitt", true}, // one edit
+		{"Noble Ploenchit", "Nobel Ploenchit", true},  // two edits
+		{"Ashton Asoke", "Ashton Silom", false},       // same developer, another project
+		{"Noble Ploenchit", "Noble Plonechti", false}, // three edits
+		{"Ideo Q", "Ideo O", false},                   // too short to allow an edit
+		{"Life Asoke", "Life Asoke Hype", false},
+		{"", "", false},
+		{"---", "...", false},
+	}
+	for _, tt := range tests {
+		if got := similarTitles(tt.a, tt.b); got != tt.want {
+			t.Errorf("similarTitles(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+		if got := similarTitles(tt.b, tt.a); got != tt.want {
+			t.Errorf("similarTitles(%q, %q) = %v, want %v", tt.b, tt.a, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizeTitle(t *testing.T) {
+	for in, want := range map[string]string{
+		"The Line  Sukhumvit-101": "the line sukhumvit 101",
+		"  Noble\tPloenchit\n":    "noble ploenchit",
+		"Café Résidence":          "café résidence",
+		"ไอดีโอ คิว สยาม":         "ไอดีโอ คิว สยาม",
+	} {
+		if got := normalizeTitle(in); got != want {
+			t.Errorf("normalizeTitle(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
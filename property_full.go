@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// activeListingsFilter is the default rule for public listing queries: only active, published, non-deleted listings are shown
+func activeListingsFilter(filter bson.M) bson.M {
+	filter["listing_status"] = "active"
+	return publishedListingsFilter(filter)
+}
+
+type listingPriceStats struct {
+	MinPrice           float64  `bson:"min_price" json:"min_price"`
+	MaxPrice           float64  `bson:"max_price" json:"max_price"`
+	Count              int      `bson:"count" json:"count"`
+	AveragePricePerSqm *float64 `bson:"avg_price_per_sqm" json:"avg_price_per_sqm"` // null when no listing has a size
+}
+
+type appointmentSummary struct {
+	Upcoming int        `json:"upcoming"`
+	Next     *time.Time `json:"next,omitempty"`
+}
+
+type propertyFull struct {
+	Property      Property            `json:"property"`
+	Listings      *[]Listing          `json:"listings,omitempty"`
+	InquiryCount  *int64              `json:"inquiry_count,omitempty"`
+	ListingPrices *listingPriceStats  `json:"listing_prices,omitempty"`
+	Appointments  *appointmentSummary `json:"appointments,omitempty"`
+}
+
+// propertyFullParts are the optional sections; ?include= picks a subset, default is all of them
+var propertyFullParts = []string{"listings", "stats", "appointments", "documents"}
+
+// getPropertyFull returns a property with its active listings, inquiry count, listing price range and
+// upcoming appointment summary. The sections are fetched concurrently after the property itself.
+func getPropertyFull(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	id, ok := pathObjectID(w, r, "Property")
+	if !ok {
+		return
+	}
+
+	include := map[string]bool{}
+	if raw := r.URL.Query().Get("include"); raw != "" {
+		for _, part := range strings.Split(raw, ",") {
+			part = strings.TrimSpace(part)
+			if !isOneOf(part, propertyFullParts) {
+				http.Error(w, "include must be a comma separated list of "+strings.Join(propertyFullParts, ", "), http.StatusBadRequest)
+				return
+			}
+			include[part] = true
+		}
+	} else {
+		for _, part := range propertyFullParts {
+			include[part] = true
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	db := client.Database("MVDB")
+	var result propertyFull
+	err := db.Collection("properties").FindOne(ctx, notDeleted(bson.M{"_id": id})).Decode(&result.Property)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			http.Error(w, "Property not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Failed to retrieve Property", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if !include["documents"] {
+		result.Property.Documents = nil
+	}
+
+	propertyID := id.Hex()
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+	run := func(fn func() error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := fn(); err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	if include["listings"] {
+		run(func() error {
+			listings, err := findAll[Listing](ctx, "listings", activeListingsFilter(bson.M{"property_id": propertyID}))
+			result.Listings = &listings
+			return err
+		})
+	}
+	if include["stats"] {
+		run(func() error {
+			count, err := db.Collection("inquiries").CountDocuments(ctx, bson.M{"property_id": propertyID})
+			result.InquiryCount = &count
+			return err
+		})
+		run(func() error {
+			stats, err := activeListingPriceStats(ctx, propertyID)
+			result.ListingPrices = stats
+			return err
+		})
+	}
+	if include["appointments"] {
+		run(func() error {
+			summary, err := upcomingAppointmentSummary(ctx, propertyID)
+			result.Appointments = summary
+			return err
+		})
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		http.Error(w, "Failed to retrieve Property details", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+func activeListingPriceStats(ctx context.Context, propertyID string) (*listingPriceStats, error) {
+	pipeline := []bson.M{
+		{"$match": activeListingsFilter(bson.M{"property_id": propertyID})},
+		{"$group": bson.M{
+			"_id":       nil,
+			"min_price": bson.M{"$min": "$price"},
+			"max_price": bson.M{"$max": "$price"},
+			"count":     bson.M{"$sum": 1},
+			// $avg skips the nulls produced for listings without a usable size
+			"avg_price_per_sqm": bson.M{"$avg": bson.M{"$cond": bson.A{
+				bson.M{"$gt": bson.A{"$size", 0}},
+				bson.M{"$divide": bson.A{"$price", "$size"}},
+				nil,
+			}}},
+		}},
+	}
+	cur, err := client.Database("MVDB").Collection("listings").Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	stats := &listingPriceStats{}
+	if cur.Next(ctx) {
+		if err := cur.Decode(stats); err != nil {
+			return nil, err
+		}
+	}
+	if stats.AveragePricePerSqm != nil {
+		*stats.AveragePricePerSqm = math.Round(*stats.AveragePricePerSqm*100) / 100
+	}
+	return stats, cur.Err()
+}
+
+func upcomingAppointmentSummary(ctx context.Context, propertyID string) (*appointmentSummary, error) {
+	collection := client.Database("MVDB").Collection("appointments")
+	filter := bson.M{
+		"property_id":      propertyID,
+		"status":           bson.M{"$in": openAppointmentStatuses},
+		"appointment_date": bson.M{"$gte": time.Now()},
+	}
+	count, err := collection.CountDocuments(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	summary := &appointmentSummary{Upcoming: int(count)}
+	if count == 0 {
+		return summary, nil
+	}
+	var next Appointment
+	err = collection.FindOne(ctx, filter, options.FindOne().SetSort(bson.M{"appointment_date": 1})).Decode(&next)
+	if err != nil {
+		return nil, err
+	}
+	summary.Next = &next.AppointmentDate
+	return summary, nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// propertyWithListingCount is a Property plus the summary of its active listings
+type propertyWithListingCount struct {
+	Property        `bson:",inline"`
+	ListingCount    int      `bson:"listing_count" json:"listing_count"`
+	MinListingPrice *float64 `bson:"min_listing_price" json:"min_listing_price"`
+}
+
+// getPropertiesWithListingCount serves GET /properties?include=listing_count with a single aggregation.
+// The $lookup joins on listings.property_id (a hex string), so _id is converted first and the join
+// is served by the property_id index (localField + pipeline needs MongoDB 5.0+).
+// Properties without listings keep a count of 0.
+func getPropertiesWithListingCount(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	match := bson.M{}
+	if !applyDeletedFilter(w, r, match) || !applyTransitFilter(w, r, match) || !applyCompletionFilter(w, r, match) {
+		return
+	}
+	page, ok := parseListPage(w, r)
+	if !ok {
+		return
+	}
+	full, ok := parseListView(w, r)
+	if !ok {
+		return
+	}
+	fp, err := fingerprint(ctx, "properties", match)
+	if err != nil {
+		serverError(w, r, "Failed to retrieve Properties from MongoDB", err)
+		return
+	}
+	listings, err := fingerprint(ctx, "listings", activeListingsFilter(bson.M{}))
+	if err != nil {
+		serverError(w, r, "Failed to retrieve Listings from MongoDB", err)
+		return
+	}
+	if notModified(w, r, weakETag(r, fp, listings)) {
+		return
+	}
+
+	// Paged before the $lookup so only the returned properties are joined
+	pipeline := append([]bson.M{{"$match": match}}, page.stages(false)...)
+	pipeline = append(pipeline, []bson.M{
+		{"$addFields": bson.M{"_property_id": bson.M{"$toString": "$_id"}}},
+		{"$lookup": bson.M{
+			"from":         "listings",
+			"localField":   "_property_id",
+			"foreignField": "property_id",
+			"pipeline": []bson.M{
+				{"$match": activeListingsFilter(bson.M{})},
+				{"$group": bson.M{"_id": nil, "count": bson.M{"$sum": 1}, "min_price": bson.M{"$min": "$price"}}},
+			},
+			"as": "_listing_summary",
+		}},
+		{"$addFields": bson.M{
+			"listing_count":     bson.M{"$ifNull": bson.A{bson.M{"$first": "$_listing_summary.count"}, 0}},
+			"min_listing_price": bson.M{"$first": "$_listing_summary.min_price"},
+		}},
+		{"$project": bson.M{"_property_id": 0, "_listing_summary": 0}},
+	}...)
+	switch {
+	case !full:
+		pipeline = append(pipeline, propertySummaryStage("listing_count", "min_listing_price"))
+	case !includesPart(r, "documents"):
+		pipeline = append(pipeline, bson.M{"$project": bson.M{"documents": 0}})
+	}
+
+	collection := client.Database("MVDB").Collection("properties")
+	cur, err := collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		serverError(w, r, "Failed to retrieve Properties from MongoDB", err)
+		return
+	}
+	var prepare func([]propertyWithListingCount) error
+	if loc, ok := priceLocale(w, r); ok {
+		prepare = func(properties []propertyWithListingCount) error {
+			for i := range properties {
+				formatPropertyPrices(&properties[i].Property, loc)
+			}
+			return nil
+		}
+	}
+	streamCursor[propertyWithListingCount](ctx, w, cur, "Properties", prepare)
+}
+
+// UnmarshalBSON decodes both parts; without it the promoted Property.UnmarshalBSON would drop the counts
+func (p *propertyWithListingCount) UnmarshalBSON(data []byte) error {
+	if err := p.Property.UnmarshalBSON(data); err != nil {
+		return err
+	}
+	var summary struct {
+		ListingCount    int      `bson:"listing_count"`
+		MinListingPrice *float64 `bson:"min_listing_price"`
+	}
+	if err := bson.Unmarshal(data, &summary); err != nil {
+		return err
+	}
+	p.ListingCount, p.MinListingPrice = summary.ListingCount, summary.MinListingPrice
+	return nil
+}
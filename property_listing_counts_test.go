@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// seedListingCounts stores properties with 0 to 9 listings each, a fifth of them not active, and
+// the indexes of the server
+func seedListingCounts(tb testing.TB, properties int) {
+	var props, listings []interface{}
+	for i := 0; i < properties; i++ {
+		id := primitive.NewObjectID()
+		props = append(props, Property{ID: id, Title: "Property " + id.Hex()})
+		for j := 0; j < i%10; j++ {
+			status := "active"
+			if j%5 == 4 {
+				status = "rented"
+			}
+			listings = append(listings, Listing{ID: primitive.NewObjectID(), PropertyID: id.Hex(), Price: float64(10000 + 1000*j), ListingStatus: status})
+		}
+	}
+	insertDocs(tb, "properties", props...)
+	insertDocs(tb, "listings", listings...)
+	if err := createIndexes(context.Background(), nil); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+func serveListingCounts(tb testing.TB) []propertyWithListingCount {
+	req := httptest.NewRequest(http.MethodGet, "/properties?include=listing_count", nil)
+	req.Header.Set("X-API-Key", "test-shared-key")
+	rec := httptest.NewRecorder()
+	getPropertiesWithListingCount(rec, req)
+	if rec.Code != http.StatusOK {
+		tb.Fatalf("%d %s", rec.Code, rec.Body)
+	}
+	var properties []propertyWithListingCount
+	if err := json.NewDecoder(rec.Body).Decode(&properties); err != nil {
+		tb.Fatal(err)
+	}
+	return properties
+}
+
+// countListingsLoop is what the pipeline replaces: one CountDocuments and one price query per property
+func countListingsLoop(tb testing.TB) map[primitive.ObjectID]int {
+	ctx := context.Background()
+	properties, err := findAll[Property](ctx, "properties", notDeleted(bson.M{}))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	listings := client.Database("MVDB").Collection("listings")
+	counts := make(map[primitive.ObjectID]int, len(properties))
+	for _, p := range properties {
+		n, err := listings.CountDocuments(ctx, activeListingsFilter(bson.M{"property_id": p.ID.Hex()}))
+		if err != nil {
+			tb.Fatal(err)
+		}
+		if n > 0 {
+			var cheapest Listing
+			if err := listings.FindOne(ctx, activeListingsFilter(bson.M{"property_id": p.ID.Hex()}),
+				options.FindOne().SetSort(bson.M{"price": 1})).Decode(&cheapest); err != nil {
+				tb.Fatal(err)
+			}
+		}
+		counts[p.ID] = int(n)
+	}
+	return counts
+}
+
+func TestPropertyListingCounts(t *testing.T) {
+	useTestMongo(t, "properties", "listings")
+	useTestKeys(t)
+	seedListingCounts(t, 30)
+	want := countListingsLoop(t)
+	got := serveListingCounts(t)
+	if len(got) != 30 {
+		t.Fatalf("%d properties, want 30", len(got))
+	}
+	for _, p := range got {
+		if p.ListingCount != want[p.ID] {
+			t.Errorf("%s: %d listings, want %d", p.Title, p.ListingCount, want[p.ID])
+		}
+		if (p.ListingCount == 0) != (p.MinListingPrice == nil) || (p.MinListingPrice != nil && *p.MinListingPrice != 10000) {
+			t.Errorf("%s: %d listings from %v", p.Title, p.ListingCount, p.MinListingPrice)
+		}
+	}
+}
+
+// BenchmarkPropertyListingCounts compares the $lookup pipeline of ?include=listing_count with the
+// per-property CountDocuments loop it replaces, for 500 properties
+func BenchmarkPropertyListingCounts(b *testing.B) {
+	useTestMongo(b, "properties", "listings")
+	prevKey := apiKey
+	apiKey = "test-shared-key"
+	b.Cleanup(func() { apiKey = prevKey })
+	seedListingCounts(b, 500)
+
+	b.Run("pipeline", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			serveListingCounts(b)
+		}
+	})
+	b.Run("count_loop", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			countListingsLoop(b)
+		}
+	})
+}
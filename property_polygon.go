@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	maxPolygonVertices = 100
+	maxPolygonAreaKm2  = 3000 // about twice Bangkok proper
+)
+
+// geoPolygon is a GeoJSON Polygon drawn on the map. Only the outer ring is supported.
+type geoPolygon struct {
+	Type        string         `json:"type"`
+	Coordinates [][][2]float64 `json:"coordinates"` // rings of [longitude, latitude], first and last position equal
+}
+
+// validate checks the ring before it reaches $geoWithin, so the client gets a clear message instead
+// of Mongo's "Loop is not valid"
+func (p *geoPolygon) validate() error {
+	if p.Type != "Polygon" {
+		return fmt.Errorf("type must be Polygon")
+	}
+	if len(p.Coordinates) == 0 {
+		return fmt.Errorf("coordinates must hold one ring")
+	}
+	if len(p.Coordinates) > 1 {
+		return fmt.Errorf("polygons with holes are not supported")
+	}
+	ring := p.Coordinates[0]
+	if len(ring) < 4 {
+		return fmt.Errorf("a ring needs at least 3 distinct positions plus the closing one")
+	}
+	if ring[0] != ring[len(ring)-1] {
+		return fmt.Errorf("the ring must be closed: the last position must equal the first")
+	}
+	if len(ring)-1 > maxPolygonVertices {
+		return fmt.Errorf("the ring can have at most %d vertices", maxPolygonVertices)
+	}
+	for _, pos := range ring {
+		if pos[0] < -180 || pos[0] > 180 || pos[1] < -90 || pos[1] > 90 {
+			return fmt.Errorf("positions must be [longitude, latitude] within range")
+		}
+	}
+	if ringSelfIntersects(ring) {
+		return fmt.Errorf("the polygon is self-intersecting: its edges must not cross")
+	}
+	area := ringAreaKm2(ring)
+	if area == 0 {
+		return fmt.Errorf("the polygon has no area")
+	}
+	if area > maxPolygonAreaKm2 {
+		return fmt.Errorf("the polygon covers %.0f km², at most %d km² is allowed", area, maxPolygonAreaKm2)
+	}
+	return nil
+}
+
+// ringSelfIntersects checks every pair of edges that don't share a vertex; 100 vertices make at
+// most ~5000 pairs
+func ringSelfIntersects(ring [][2]float64) bool {
+	n := len(ring) - 1 // edges; edge i runs from ring[i] to ring[i+1]
+	for i := 0; i < n; i++ {
+		for j := i + 1; j < n; j++ {
+			if j == i+1 || (i == 0 && j == n-1) {
+				continue // neighbours meet at their shared vertex
+			}
+			if segmentsIntersect(ring[i], ring[i+1], ring[j], ring[j+1]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func segmentsIntersect(a, b, c, d [2]float64) bool {
+	o1, o2 := orientation(a, b, c), orientation(a, b, d)
+	o3, o4 := orientation(c, d, a), orientation(c, d, b)
+	if o1 != o2 && o3 != o4 {
+		return true
+	}
+	// collinear and overlapping
+	return (o1 == 0 && onSegment(a, c, b)) || (o2 == 0 && onSegment(a, d, b)) ||
+		(o3 == 0 && onSegment(c, a, d)) || (o4 == 0 && onSegment(c, b, d))
+}
+
+// orientation is 1 when p, q, r turn counterclockwise, -1 clockwise and 0 when collinear
+func orientation(p, q, r [2]float64) int {
+	v := (q[0]-p[0])*(r[1]-p[1]) - (q[1]-p[1])*(r[0]-p[0])
+	switch {
+	case v > 0:
+		return 1
+	case v < 0:
+		return -1
+	}
+	return 0
+}
+
+// onSegment reports whether q, collinear with p and r, lies between them
+func onSegment(p, q, r [2]float64) bool {
+	return q[0] >= math.Min(p[0], r[0]) && q[0] <= math.Max(p[0], r[0]) &&
+		q[1] >= math.Min(p[1], r[1]) && q[1] <= math.Max(p[1], r[1])
+}
+
+// ringAreaKm2 projects the ring onto a plane at its mean latitude and applies the shoelace formula,
+// close enough at city scale
+func ringAreaKm2(ring [][2]float64) float64 {
+	var lat0 float64
+	for _, pos := range ring[:len(ring)-1] {
+		lat0 += pos[1]
+	}
+	lat0 = lat0 / float64(len(ring)-1) * math.Pi / 180
+	kmPerDegree := earthRadiusM / 1000 * math.Pi / 180
+	var sum float64
+	for i := 0; i < len(ring)-1; i++ {
+		x1, y1 := ring[i][0]*kmPerDegree*math.Cos(lat0), ring[i][1]*kmPerDegree
+		x2, y2 := ring[i+1][0]*kmPerDegree*math.Cos(lat0), ring[i+1][1]*kmPerDegree
+		sum += x1*y2 - x2*y1
+	}
+	return math.Abs(sum) / 2
+}
+
+// searchPropertiesInPolygon answers POST /properties/search/polygon with the properties whose
+// location falls inside the GeoJSON Polygon in the body. The GET /properties filters apply and the
+// results are paged with ?page= and ?limit=.
+func searchPropertiesInPolygon(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var polygon geoPolygon
+	if err := json.NewDecoder(r.Body).Decode(&polygon); err != nil {
+		http.Error(w, "Failed to parse request body", http.StatusBadRequest)
+		return
+	}
+	if err := polygon.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	q := r.URL.Query()
+	page, limit := 1, 20
+	if raw := q.Get("page"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 {
+			http.Error(w, "page must be a positive whole number", http.StatusBadRequest)
+			return
+		}
+		page = n
+	}
+	if raw := q.Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > 100 {
+			http.Error(w, "limit must be between 1 and 100", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	full, ok := parseListView(w, r)
+	if !ok {
+		return
+	}
+
+	filter := bson.M{"location": bson.M{"$geoWithin": bson.M{"$geometry": bson.M{
+		"type":        "Polygon",
+		"coordinates": polygon.Coordinates,
+	}}}}
+	if !applyDeletedFilter(w, r, filter) || !applyTransitFilter(w, r, filter) || !applyCompletionFilter(w, r, filter) {
+		return
+	}
+	recordPropertySearch(r, polygonArea(polygon))
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	collection := client.Database("MVDB").Collection("properties")
+	total, err := collection.CountDocuments(ctx, filter)
+	if err != nil {
+		serverError(w, r, "Failed to count Properties", err)
+		return
+	}
+	opts := options.Find().
+		SetSort(bson.D{{Key: "created_at", Value: -1}, {Key: "_id", Value: 1}}).
+		SetSkip(int64((page - 1) * limit)).
+		SetLimit(int64(limit))
+	switch {
+	case !full:
+		opts.SetProjection(propertySummaryFields())
+	case !includesPart(r, "documents"):
+		opts.SetProjection(bson.M{"documents": 0})
+	}
+	properties, err := findAllWith[Property](ctx, collection.Name(), filter, opts)
+	if err != nil {
+		serverError(w, r, "Failed to retrieve Properties", err)
+		return
+	}
+	if loc, ok := priceLocale(w, r); ok {
+		for i := range properties {
+			formatPropertyPrices(&properties[i], loc)
+		}
+	}
+	json.NewEncoder(w).Encode(bson.M{"properties": properties, "page": page, "limit": limit, "total": total})
+}
+
+// backfillLocations is `migrate locations`: it sets the GeoJSON location, which the polygon search
+// queries, on properties stored before it existed
+func backfillLocations(ctx context.Context, args []string) error {
+	properties, err := findAllWith[Property](ctx, "properties", bson.M{"location": bson.M{"$exists": false}},
+		options.Find().SetProjection(bson.M{"coordinates": 1}))
+	if err != nil {
+		return fmt.Errorf("properties: %w", err)
+	}
+	collection := client.Database("MVDB").Collection("properties")
+	n := 0
+	for _, p := range properties {
+		location := propertyLocation(p.Coordinates)
+		if location == nil {
+			continue
+		}
+		if _, err := collection.UpdateOne(ctx, bson.M{"_id": p.ID, "location": bson.M{"$exists": false}}, bson.M{"$set": bson.M{"location": location}}); err != nil {
+			return fmt.Errorf("properties %s: %w", p.ID.Hex(), err)
+		}
+		n++
+	}
+	log.Printf("properties: %d locations set, %d without usable coordinates", n, len(properties)-n)
+	return nil
+}
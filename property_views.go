@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// viewDedupWindow is how long a session's view of a property is remembered (TTL index on property_view_sessions)
+const viewDedupWindow = 30 * time.Minute
+
+// recordPropertyView is fire-and-forget: it answers 202 straight away and counts the view in the
+// background, so a slow or failing counter can never hold up the property page.
+// Body (optional): {"session_id": "..."}; without it the client address and user agent are used.
+func recordPropertyView(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathObjectID(w, r, "Property")
+	if !ok {
+		return
+	}
+
+	var body struct {
+		SessionID string `json:"session_id"`
+	}
+	json.NewDecoder(r.Body).Decode(&body)
+	session := body.SessionID
+	if session == "" {
+		sum := sha256.Sum256([]byte(clientIP(r) + "|" + r.UserAgent()))
+		session = hex.EncodeToString(sum[:])
+	}
+
+	go countPropertyView(id, session)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func countPropertyView(propertyID primitive.ObjectID, session string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	db := client.Database("MVDB")
+	now := time.Now()
+
+	// The unique (property_id, session_id) index turns repeat views inside the window into duplicate key errors
+	_, err := db.Collection("property_view_sessions").InsertOne(ctx, bson.M{
+		"property_id": propertyID.Hex(),
+		"session_id":  session,
+		"created_at":  now,
+	})
+	if mongo.IsDuplicateKeyError(err) {
+		return
+	}
+	if err != nil {
+		log.Println("Failed to record property view session:", err)
+		return
+	}
+
+	res, err := db.Collection("properties").UpdateByID(ctx, propertyID, bson.M{"$inc": bson.M{"views": 1}})
+	if err != nil {
+		log.Println("Failed to increment property views:", err)
+		return
+	}
+	if res.MatchedCount == 0 {
+		return
+	}
+
+	day := now.In(bangkok).Format("2006-01-02")
+	_, err = db.Collection("property_views").UpdateOne(ctx,
+		bson.M{"property_id": propertyID.Hex(), "day": day},
+		bson.M{"$inc": bson.M{"views": 1}},
+		options.Update().SetUpsert(true))
+	if err != nil {
+		log.Println("Failed to record daily property views:", err)
+	}
+}
+
+type popularProperty struct {
+	PropertyID string `bson:"_id" json:"property_id"`
+	Title      string `bson:"title" json:"Title"`
+	Views      int    `bson:"views" json:"views"`
+}
+
+// getPopularProperties ranks properties by views over the last ?days= (default 7), top ?limit= (default 10)
+func getPopularProperties(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	days, limit := 7, 10
+	q := r.URL.Query()
+	if raw := q.Get("days"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > 365 {
+			http.Error(w, "days must be between 1 and 365", http.StatusBadRequest)
+			return
+		}
+		days = n
+	}
+	if raw := q.Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > 100 {
+			http.Error(w, "limit must be between 1 and 100", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	since := time.Now().In(bangkok).AddDate(0, 0, -(days - 1)).Format("2006-01-02")
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	pipeline := []bson.M{
+		{"$match": bson.M{"day": bson.M{"$gte": since}}},
+		{"$group": bson.M{"_id": "$property_id", "views": bson.M{"$sum": "$views"}}},
+		{"$sort": bson.M{"views": -1}},
+		{"$limit": limit},
+		{"$lookup": bson.M{
+			"from":     "properties",
+			"let":      bson.M{"pid": bson.M{"$toObjectId": "$_id"}},
+			"pipeline": []bson.M{{"$match": bson.M{"$expr": bson.M{"$eq": bson.A{"$_id", "$$pid"}}}}, {"$project": bson.M{"title": 1}}},
+			"as":       "property",
+		}},
+		{"$addFields": bson.M{"title": bson.M{"$first": "$property.title"}}},
+		{"$project": bson.M{"property": 0}},
+	}
+	cur, err := client.Database("MVDB").Collection("property_views").Aggregate(ctx, pipeline)
+	if err != nil {
+		serverError(w, r, "Failed to aggregate property views", err)
+		return
+	}
+	defer cur.Close(ctx)
+
+	popular := []popularProperty{}
+	if err := cur.All(ctx, &popular); err != nil {
+		serverError(w, r, "Failed to decode property views", err)
+		return
+	}
+	json.NewEncoder(w).Encode(popular)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var devicePlatforms = []string{"ios", "android", "web"}
+
+// Device is a push token registered by the mobile or web app. A user can have several; a token
+// belongs to one user at a time, the last one to register it.
+type Device struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"device_id,omitempty"`
+	UserID    string             `bson:"user_id" json:"user_id"`
+	Token     string             `bson:"token" json:"token"`
+	Platform  string             `bson:"platform" json:"platform"`
+	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+	LastSeen  time.Time          `bson:"last_seen" json:"last_seen"`
+}
+
+type pushMessage struct {
+	Title string            `json:"title"`
+	Body  string            `json:"body"`
+	Data  map[string]string `json:"data,omitempty"` // handed to the app, e.g. appointment_id
+}
+
+// errInvalidPushToken is returned by a Notifier for tokens the push service no longer accepts;
+// pushToUser deletes those devices
+var errInvalidPushToken = errors.New("push token is no longer valid")
+
+// Notifier delivers a push message to one device token
+type Notifier interface {
+	Send(ctx context.Context, token string, msg pushMessage) error
+}
+
+// noopNotifier is used when push isn't configured
+type noopNotifier struct{}
+
+func (noopNotifier) Send(context.Context, string, pushMessage) error { return nil }
+
+var notifier Notifier = noopNotifier{}
+
+// setupPush enables FCM when FCM_CREDENTIALS_FILE points at a service account JSON key. Without it,
+// or with an unusable key, pushes are skipped and everything else keeps working.
+func setupPush() {
+	path := os.Getenv("FCM_CREDENTIALS_FILE")
+	if path == "" {
+		log.Println("FCM_CREDENTIALS_FILE not set, push notifications are disabled")
+		return
+	}
+	n, err := newFCMNotifier(path)
+	if err != nil {
+		log.Println("Push notifications are disabled:", err)
+		return
+	}
+	notifier = n
+}
+
+func pushEnabled() bool {
+	_, disabled := notifier.(noopNotifier)
+	return !disabled
+}
+
+// pushToUser sends msg to every device of the user and prunes the tokens reported invalid.
+// Like createNotification it only logs failures.
+func pushToUser(userID string, msg pushMessage) (sent, pruned int) {
+	if !pushEnabled() {
+		return 0, 0
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	devices, err := findAll[Device](ctx, "devices", bson.M{"user_id": userID})
+	if err != nil {
+		log.Println("Failed to load devices of user", userID, ":", err)
+		return 0, 0
+	}
+	collection := client.Database("MVDB").Collection("devices")
+	for _, d := range devices {
+		err := notifier.Send(ctx, d.Token, msg)
+		switch {
+		case err == nil:
+			sent++
+		case errors.Is(err, errInvalidPushToken):
+			if _, err := collection.DeleteOne(ctx, bson.M{"_id": d.ID}); err != nil {
+				log.Println("Failed to prune device", d.ID.Hex(), ":", err)
+				continue
+			}
+			pruned++
+		default:
+			log.Println("Failed to push to device", d.ID.Hex(), "of user", userID, ":", err)
+		}
+	}
+	return sent, pruned
+}
+
+// registerDevice stores or refreshes a push token for the user; registering a known token again
+// only moves it to this user and bumps last_seen
+func registerDevice(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, ok := pathObjectID(w, r, "User")
+	if !ok {
+		return
+	}
+	var body struct {
+		Token    string `json:"token"`
+		Platform string `json:"platform"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Failed to parse request body", http.StatusBadRequest)
+		return
+	}
+	body.Token = strings.TrimSpace(body.Token)
+	if body.Token == "" || len(body.Token) > 4096 {
+		http.Error(w, "token is required", http.StatusBadRequest)
+		return
+	}
+	if !isOneOf(body.Platform, devicePlatforms) {
+		http.Error(w, "platform must be one of "+strings.Join(devicePlatforms, ", "), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	if err := client.Database("MVDB").Collection("users").FindOne(ctx, notDeleted(bson.M{"_id": userID})).Err(); err == mongo.ErrNoDocuments {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		serverError(w, r, "Failed to retrieve User", err)
+		return
+	}
+
+	now := time.Now()
+	var device Device
+	err := client.Database("MVDB").Collection("devices").FindOneAndUpdate(ctx,
+		bson.M{"token": body.Token},
+		bson.M{
+			"$set":         bson.M{"user_id": userID.Hex(), "platform": body.Platform, "last_seen": now},
+			"$setOnInsert": bson.M{"created_at": now},
+		},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&device)
+	if err != nil {
+		serverError(w, r, "Failed to register device", err)
+		return
+	}
+	json.NewEncoder(w).Encode(device)
+}
+
+// sendTestPush pushes a message to all devices of a user, to check the FCM setup
+func sendTestPush(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var body struct {
+		UserID string `json:"user_id"`
+		Title  string `json:"title"`
+		Body   string `json:"body"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Failed to parse request body", http.StatusBadRequest)
+		return
+	}
+	if _, err := primitive.ObjectIDFromHex(body.UserID); err != nil {
+		http.Error(w, "Invalid User ID format", http.StatusBadRequest)
+		return
+	}
+	if !pushEnabled() {
+		http.Error(w, "Push notifications are not configured", http.StatusServiceUnavailable)
+		return
+	}
+	if body.Title == "" {
+		body.Title = "Test notification"
+	}
+	sent, pruned := pushToUser(body.UserID, pushMessage{Title: body.Title, Body: body.Body, Data: map[string]string{"type": "test"}})
+	json.NewEncoder(w).Encode(bson.M{"sent": sent, "pruned": pruned})
+}
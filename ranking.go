@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// rankingWeights tunes ?sort=relevance. They live in the settings collection, so PUT
+// /admin/ranking-weights changes the ranking of every instance within rankingWeightsMaxAge.
+type rankingWeights struct {
+	Recency  float64 `bson:"recency" json:"recency"`
+	Featured float64 `bson:"featured" json:"featured"`
+	Verified float64 `bson:"verified" json:"verified"`
+	Photos   float64 `bson:"photos" json:"photos"`
+	Price    float64 `bson:"price" json:"price"` // price per sqm against the other listings of the property
+	Text     float64 `bson:"text" json:"text"`   // only with ?q=
+
+	RecencyHalfLifeDays float64 `bson:"recency_half_life_days" json:"recency_half_life_days"` // age at which the recency score halves
+	PhotoTarget         int     `bson:"photo_target" json:"photo_target"`                     // photo count that earns the full photo score
+}
+
+var defaultRankingWeights = rankingWeights{
+	Recency:             1,
+	Featured:            0.5,
+	Verified:            0.4,
+	Photos:              0.3,
+	Price:               0.5,
+	Text:                1,
+	RecencyHalfLifeDays: 30,
+	PhotoTarget:         10,
+}
+
+// listingRankingParams documents the GET /listings parameters read next to the listing filters
+var listingRankingParams = []apiParam{
+	{Name: "q", Description: "text search over description and tags"},
+	{Name: "sort", Description: "relevance scores recency, featured, verified, photos, price per sqm against the property and the text match"},
+	{Name: "debug", Description: "with sort=relevance, true adds the score breakdown as ranking (requires the API key)"},
+}
+
+const rankingWeightsID = "ranking_weights"
+
+const rankingWeightsMaxAge = time.Minute
+
+// listingRanking is the score breakdown shown with ?debug=true. Every component is between 0 and 1;
+// Score is their weighted sum.
+type listingRanking struct {
+	Recency  float64 `bson:"recency" json:"recency"`
+	Featured float64 `bson:"featured" json:"featured"`
+	Verified float64 `bson:"verified" json:"verified"`
+	Photos   float64 `bson:"photos" json:"photos"`
+	Price    float64 `bson:"price" json:"price"`
+	Text     float64 `bson:"text" json:"text"`
+	Score    float64 `bson:"score" json:"score"`
+}
+
+var rankingCache struct {
+	sync.Mutex
+	weights  rankingWeights
+	loadedAt time.Time
+}
+
+// currentRankingWeights returns the stored weights, read at most once per rankingWeightsMaxAge.
+// Fields missing from the stored document keep their default, and the defaults are used until
+// anything has been stored.
+func currentRankingWeights(ctx context.Context) rankingWeights {
+	rankingCache.Lock()
+	defer rankingCache.Unlock()
+	if !rankingCache.loadedAt.IsZero() && time.Since(rankingCache.loadedAt) < rankingWeightsMaxAge {
+		return rankingCache.weights
+	}
+	weights := defaultRankingWeights
+	err := client.Database("MVDB").Collection("settings").FindOne(ctx, bson.M{"_id": rankingWeightsID}).Decode(&weights)
+	if err != nil && err != mongo.ErrNoDocuments {
+		log.Println("Failed to load ranking weights, keeping the previous ones:", err)
+		if rankingCache.loadedAt.IsZero() {
+			return defaultRankingWeights
+		}
+		return rankingCache.weights
+	}
+	rankingCache.weights, rankingCache.loadedAt = weights, time.Now()
+	return weights
+}
+
+// rankingStages scores and sorts the listings of a GET /listings pipeline. Components:
+//
+//	recency  = 0.5 ^ (days since published_at, or created_at, / recency_half_life_days)
+//	featured = 1 for featured listings
+//	verified = 1 for listings with the verified badge
+//	photos   = photo count / photo_target, at most 1
+//	price    = 0.5 + (average - own) / average of the price per sqm of the property's active
+//	           listings of the same type and currency, clamped to [0, 1]; 0.5 without a size
+//	text     = textScore / (textScore + 1), only when the query has $text
+//
+// The breakdown is left in _ranking when debug is set and dropped otherwise.
+func rankingStages(w rankingWeights, withText, debug bool, now time.Time) []bson.M {
+	clamp := func(v interface{}) bson.M { return bson.M{"$max": bson.A{0, bson.M{"$min": bson.A{1, v}}}} }
+	ppsm := bson.M{"$divide": bson.A{"$price", "$size"}} // of the listing, or of a peer inside the $lookup
+
+	peers := bson.M{"$lookup": bson.M{
+		"from": "listings",
+		"let": bson.M{
+			"pid":      "$property_id",
+			"type":     "$listing_type",
+			"currency": bson.M{"$ifNull": bson.A{"$currency", defaultCurrency}},
+		},
+		"pipeline": []bson.M{
+			{"$match": activeListingsFilter(bson.M{"$expr": bson.M{"$and": bson.A{
+				bson.M{"$eq": bson.A{"$property_id", "$$pid"}},
+				bson.M{"$eq": bson.A{"$listing_type", "$$type"}},
+				bson.M{"$eq": bson.A{bson.M{"$ifNull": bson.A{"$currency", defaultCurrency}}, "$$currency"}},
+				bson.M{"$gt": bson.A{"$size", 0}},
+			}}})},
+			{"$group": bson.M{"_id": nil, "avg": bson.M{"$avg": ppsm}}},
+		},
+		"as": "_peers",
+	}}
+
+	age := bson.M{"$max": bson.A{0, bson.M{"$divide": bson.A{
+		bson.M{"$subtract": bson.A{now, bson.M{"$ifNull": bson.A{"$published_at", "$created_at"}}}},
+		float64(24 * time.Hour / time.Millisecond),
+	}}}}
+	avg := bson.M{"$ifNull": bson.A{bson.M{"$first": "$_peers.avg"}, 0}}
+	var text interface{} = 0
+	if withText {
+		score := bson.M{"$meta": "textScore"}
+		text = bson.M{"$divide": bson.A{score, bson.M{"$add": bson.A{score, 1}}}}
+	}
+	components := bson.M{"$addFields": bson.M{"_ranking": bson.M{
+		"recency":  bson.M{"$exp": bson.M{"$multiply": bson.A{-math.Ln2 / w.RecencyHalfLifeDays, age}}},
+		"featured": bson.M{"$cond": bson.A{bson.M{"$eq": bson.A{"$featured", true}}, 1, 0}},
+		"verified": bson.M{"$cond": bson.A{bson.M{"$eq": bson.A{"$verified", true}}, 1, 0}},
+		"photos":   clamp(bson.M{"$divide": bson.A{bson.M{"$size": bson.M{"$ifNull": bson.A{"$photos", bson.A{}}}}, w.PhotoTarget}}),
+		"price": bson.M{"$cond": bson.A{
+			bson.M{"$and": bson.A{bson.M{"$gt": bson.A{"$size", 0}}, bson.M{"$gt": bson.A{avg, 0}}}},
+			clamp(bson.M{"$add": bson.A{0.5, bson.M{"$divide": bson.A{bson.M{"$subtract": bson.A{avg, ppsm}}, avg}}}}),
+			0.5,
+		}},
+		"text": text,
+	}}}
+	score := bson.M{"$addFields": bson.M{"_ranking.score": bson.M{"$add": bson.A{
+		bson.M{"$multiply": bson.A{w.Recency, "$_ranking.recency"}},
+		bson.M{"$multiply": bson.A{w.Featured, "$_ranking.featured"}},
+		bson.M{"$multiply": bson.A{w.Verified, "$_ranking.verified"}},
+		bson.M{"$multiply": bson.A{w.Photos, "$_ranking.photos"}},
+		bson.M{"$multiply": bson.A{w.Price, "$_ranking.price"}},
+		bson.M{"$multiply": bson.A{w.Text, "$_ranking.text"}},
+	}}}}
+
+	drop := bson.M{"_peers": 0}
+	if !debug {
+		drop["_ranking"] = 0
+	}
+	return []bson.M{
+		peers,
+		components,
+		score,
+		{"$sort": bson.D{{Key: "_ranking.score", Value: -1}, {Key: "created_at", Value: -1}, {Key: "_id", Value: 1}}},
+		{"$project": drop},
+	}
+}
+
+func validateRankingWeights(w rankingWeights) []string {
+	var problems []string
+	if w.Recency < 0 || w.Featured < 0 || w.Verified < 0 || w.Photos < 0 || w.Price < 0 || w.Text < 0 {
+		problems = append(problems, "weights must not be negative")
+	}
+	if w.RecencyHalfLifeDays <= 0 {
+		problems = append(problems, "recency_half_life_days must be positive")
+	}
+	if w.PhotoTarget <= 0 {
+		problems = append(problems, "photo_target must be positive")
+	}
+	return problems
+}
+
+func getRankingWeights(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	json.NewEncoder(w).Encode(currentRankingWeights(ctx))
+}
+
+// updateRankingWeights changes the given weights; the others keep their current value
+func updateRankingWeights(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	before := currentRankingWeights(ctx)
+	weights := before
+	if err := json.NewDecoder(r.Body).Decode(&weights); err != nil {
+		http.Error(w, "Failed to parse request body", http.StatusBadRequest)
+		return
+	}
+	if problems := validateRankingWeights(weights); len(problems) > 0 {
+		http.Error(w, (&validationError{Problems: problems}).Error(), http.StatusBadRequest)
+		return
+	}
+	_, err := client.Database("MVDB").Collection("settings").ReplaceOne(ctx,
+		bson.M{"_id": rankingWeightsID}, weights, options.Replace().SetUpsert(true))
+	if err != nil {
+		serverError(w, r, "Failed to update ranking weights", err)
+		return
+	}
+	rankingCache.Lock()
+	rankingCache.weights, rankingCache.loadedAt = weights, time.Now()
+	rankingCache.Unlock()
+
+	recordAudit(auditFromRequest(r), "update", "settings", rankingWeightsID, before, weights, nil)
+	json.NewEncoder(w).Encode(weights)
+}
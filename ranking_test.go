@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/LynnT-2003/mv-realty-backend/imagemeta"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// rankListings runs the active listings through rankingStages and returns them in ranked order
+func rankListings(t *testing.T, w rankingWeights, now time.Time) []Listing {
+	t.Helper()
+	ctx := context.Background()
+	pipeline := append([]bson.M{{"$match": activeListingsFilter(bson.M{})}}, rankingStages(w, false, true, now)...)
+	cur, err := client.Database("MVDB").Collection("listings").Aggregate(ctx, pipeline)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var listings []Listing
+	if err := cur.All(ctx, &listings); err != nil {
+		t.Fatal(err)
+	}
+	return listings
+}
+
+// TestRankingOrder pins the relevance order of a crafted set. All listings are rentals of 50 sqm of
+// one property, so the average price per sqm their price score compares against is 440.
+func TestRankingOrder(t *testing.T) {
+	useTestMongo(t, "listings")
+	now := time.Now().Truncate(time.Millisecond)
+	photos := make([]imagemeta.Image, 10)
+	for i := range photos {
+		photos[i] = imagemeta.Image{URL: "https://example.com/unit.jpg"}
+	}
+	ids := map[string]primitive.ObjectID{}
+	listing := func(name string, age time.Duration, price float64, featured, verified bool, photos []imagemeta.Image) Listing {
+		ids[name] = primitive.NewObjectID()
+		return Listing{ID: ids[name], PropertyID: "p1", ListingType: "rent", Currency: defaultCurrency, ListingStatus: "active",
+			Price: price, Size: 50, CreatedAt: now.Add(-age), Featured: featured, Verified: verified, Photos: photos}
+	}
+	day := 24 * time.Hour
+	insertDocs(t, "listings",
+		listing("stale", 90*day, 20000, false, false, nil),       // 0.125 + 0.295
+		listing("featured_old", 30*day, 20000, true, false, nil), // 0.5 + 0.5 + 0.295
+		listing("complete", 0, 20000, true, true, photos),        // 1 + 0.5 + 0.4 + 0.3 + 0.295
+		listing("expensive", 0, 30000, false, false, nil),        // 1 + 0.068
+		listing("photos", 0, 20000, false, false, photos),        // 1 + 0.3 + 0.295
+		Listing{ID: primitive.NewObjectID(), PropertyID: "p1", ListingType: "rent", ListingStatus: "inactive", Price: 1000, Size: 50, CreatedAt: now},
+	)
+	names := func(listings []Listing) []string {
+		var out []string
+		for _, l := range listings {
+			for name, id := range ids {
+				if l.ID == id {
+					out = append(out, name)
+				}
+			}
+		}
+		return out
+	}
+
+	ranked := rankListings(t, defaultRankingWeights, now)
+	if got, want := names(ranked), []string{"complete", "photos", "featured_old", "expensive", "stale"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ranked %v, want %v", got, want)
+	}
+	want := map[string]listingRanking{
+		"complete":     {Recency: 1, Featured: 1, Verified: 1, Photos: 1, Price: 0.5 + 40.0/440, Score: 2.2 + 0.5*(0.5+40.0/440)},
+		"expensive":    {Recency: 1, Price: 0.5 - 160.0/440, Score: 1 + 0.5*(0.5-160.0/440)},
+		"featured_old": {Recency: 0.5, Featured: 1, Price: 0.5 + 40.0/440, Score: 1 + 0.5*(0.5+40.0/440)},
+	}
+	for _, l := range ranked {
+		w, ok := want[names([]Listing{l})[0]]
+		if !ok {
+			continue
+		}
+		got := *l.Ranking
+		for _, pair := range [][2]float64{{got.Recency, w.Recency}, {got.Featured, w.Featured}, {got.Verified, w.Verified},
+			{got.Photos, w.Photos}, {got.Price, w.Price}, {got.Score, w.Score}} {
+			if math.Abs(pair[0]-pair[1]) > 1e-9 {
+				t.Errorf("%s: %+v, want %+v", names([]Listing{l})[0], got, w)
+				break
+			}
+		}
+	}
+
+	// Weighting featured up lifts the old featured listing over the newer ones
+	weights := defaultRankingWeights
+	weights.Featured = 3
+	if got, want := names(rankListings(t, weights, now)), []string{"complete", "featured_old", "photos", "expensive", "stale"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("with featured weighted 3: %v, want %v", got, want)
+	}
+}
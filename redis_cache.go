@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const redisCachePrefix = "mvdb:response:" // keys are <prefix><request key>, tags <prefix>tag:<collection>
+
+// redisCache is the ResponseCache shared by every instance, selected with REDIS_URL. Each entry is a
+// string with a PX expiry; the keys built from a collection are kept in a set per collection so
+// Invalidate can drop them. Redis errors are logged and count as a miss.
+type redisCache struct {
+	addr     string
+	password string
+	db       int
+
+	mu   sync.Mutex
+	idle []*redisConn
+}
+
+const redisMaxIdleConns = 8
+
+// newRedisCache parses redis://[:password@]host[:port][/db]
+func newRedisCache(rawURL string) (*redisCache, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" {
+		return nil, fmt.Errorf("scheme must be redis, got %q", u.Scheme)
+	}
+	c := &redisCache{addr: u.Host}
+	if u.Port() == "" {
+		c.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		c.password, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if c.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("database must be a number, got %q", db)
+		}
+	}
+	return c, nil
+}
+
+func (c *redisCache) Get(ctx context.Context, key string) (*cachedResponse, bool) {
+	reply, err := c.do(ctx, "GET", redisCachePrefix+key)
+	if err != nil {
+		log.Println("Failed to read cached response:", err)
+		return nil, false
+	}
+	raw, ok := reply.(string)
+	if !ok {
+		return nil, false
+	}
+	var resp cachedResponse
+	if err := json.Unmarshal([]byte(raw), &resp); err != nil {
+		return nil, false
+	}
+	return &resp, true
+}
+
+func (c *redisCache) Set(ctx context.Context, key string, resp *cachedResponse, collections []string, ttl time.Duration) {
+	raw, err := json.Marshal(resp)
+	if err != nil {
+		return
+	}
+	if _, err := c.do(ctx, "SET", redisCachePrefix+key, string(raw), "PX", strconv.FormatInt(ttl.Milliseconds(), 10)); err != nil {
+		log.Println("Failed to cache response:", err)
+		return
+	}
+	for _, collection := range collections {
+		if _, err := c.do(ctx, "SADD", redisCachePrefix+"tag:"+collection, redisCachePrefix+key); err != nil {
+			log.Println("Failed to tag cached response:", err)
+		}
+	}
+}
+
+// Invalidate deletes the keys tagged with collection. Keys that already expired are still in the
+// set; DEL ignores them.
+func (c *redisCache) Invalidate(ctx context.Context, collection string) {
+	tag := redisCachePrefix + "tag:" + collection
+	reply, err := c.do(ctx, "SMEMBERS", tag)
+	if err != nil {
+		log.Println("Failed to invalidate cached", collection, "responses:", err)
+		return
+	}
+	keys, _ := reply.([]interface{})
+	args := []string{"DEL", tag}
+	for _, k := range keys {
+		if s, ok := k.(string); ok {
+			args = append(args, s)
+		}
+	}
+	if _, err := c.do(ctx, args...); err != nil {
+		log.Println("Failed to invalidate cached", collection, "responses:", err)
+	}
+}
+
+// do runs one command on a pooled connection. A connection that failed is closed instead of being
+// returned to the pool.
+func (c *redisCache) do(ctx context.Context, args ...string) (interface{}, error) {
+	conn, err := c.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := conn.do(ctx, args...)
+	var redisErr redisError
+	if err != nil && !errors.As(err, &redisErr) {
+		conn.Close()
+		return nil, err
+	}
+	c.mu.Lock()
+	if len(c.idle) < redisMaxIdleConns {
+		c.idle = append(c.idle, conn)
+		conn = nil
+	}
+	c.mu.Unlock()
+	if conn != nil {
+		conn.Close()
+	}
+	return reply, err
+}
+
+func (c *redisCache) conn(ctx context.Context) (*redisConn, error) {
+	c.mu.Lock()
+	if n := len(c.idle); n > 0 {
+		conn := c.idle[n-1]
+		c.idle = c.idle[:n-1]
+		c.mu.Unlock()
+		return conn, nil
+	}
+	c.mu.Unlock()
+
+	var d net.Dialer
+	nc, err := d.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return nil, err
+	}
+	conn := &redisConn{Conn: nc, r: bufio.NewReader(nc)}
+	if c.password != "" {
+		if _, err := conn.do(ctx, "AUTH", c.password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if c.db != 0 {
+		if _, err := conn.do(ctx, "SELECT", strconv.Itoa(c.db)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// redisConn speaks just enough RESP for the commands above
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// redisError is an error reply; the connection is still usable after one
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+func (c *redisConn) do(ctx context.Context, args ...string) (interface{}, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		c.SetDeadline(deadline)
+	} else {
+		c.SetDeadline(time.Time{})
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := c.Write([]byte(b.String())); err != nil {
+		return nil, err
+	}
+	return c.readReply()
+}
+
+// readReply returns a string, an int64, nil or a []interface{} of those
+func (c *redisConn) readReply() (interface{}, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = c.readReply(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// transientTransactionError labels errors after which a transaction may succeed when run again
+const transientTransactionError = "TransientTransactionError"
+
+// reference is a document another document points at, with the errors to return when it can't be used
+type reference struct {
+	Collection string
+	ID         string // hex ObjectID as stored on the referencing document
+	Invalid    error  // ID is not an ObjectID
+	Missing    error  // document doesn't exist or is soft-deleted
+	Check      error  // the lookup itself failed
+	Match      bson.M // extra conditions the document must meet, e.g. an active agent; failing them is Missing
+}
+
+// filter selects the referenced document if it can be used
+func (ref reference) filter(id primitive.ObjectID) bson.M {
+	filter := bson.M{"_id": id}
+	for k, v := range ref.Match {
+		filter[k] = v
+	}
+	return notDeleted(filter)
+}
+
+// insertWithReferences inserts doc only if every reference exists, without racing a concurrent delete.
+//
+// On a replica set the checks and the insert share a transaction. A plain read inside the transaction
+// would not conflict with a delete committed alongside it, so each reference is claimed by bumping its
+// ref_version; a concurrent (soft) delete of the same document then makes one of the two transactions abort.
+// Without transactions the references are checked, doc is inserted, and the references are checked
+// again; if one disappeared in between the insert is rolled back.
+func insertWithReferences(ctx context.Context, collectionName string, doc interface{}, refs ...reference) (interface{}, error) {
+	ids := make([]primitive.ObjectID, len(refs))
+	for i, ref := range refs {
+		oid, err := primitive.ObjectIDFromHex(ref.ID)
+		if err != nil {
+			return nil, ref.Invalid
+		}
+		ids[i] = oid
+	}
+	db := client.Database("MVDB")
+
+	if supportsTransactions(ctx) {
+		session, err := client.StartSession()
+		if err != nil {
+			return nil, err
+		}
+		defer session.EndSession(ctx)
+
+		var check error // Check of the reference whose claim failed in the last attempt
+		id, err := session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+			check = nil
+			for i, ref := range refs {
+				res, err := db.Collection(ref.Collection).UpdateOne(sc, ref.filter(ids[i]), bson.M{"$inc": bson.M{"ref_version": 1}})
+				if err != nil {
+					check = ref.Check
+					return nil, claimError(ref, err)
+				}
+				if res.MatchedCount == 0 {
+					return nil, ref.Missing
+				}
+			}
+			result, err := db.Collection(collectionName).InsertOne(sc, doc)
+			if err != nil {
+				return nil, err
+			}
+			return result.InsertedID, nil
+		})
+		if err != nil && check != nil {
+			return nil, check // retries ran out
+		}
+		return id, err
+	}
+
+	if err := checkReferences(ctx, refs, ids); err != nil {
+		return nil, err
+	}
+	result, err := db.Collection(collectionName).InsertOne(ctx, doc)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkReferences(ctx, refs, ids); err != nil {
+		if _, delErr := db.Collection(collectionName).DeleteOne(ctx, bson.M{"_id": result.InsertedID}); delErr != nil {
+			log.Println("Failed to roll back insert into", collectionName, ":", delErr)
+		}
+		return nil, err
+	}
+	return result.InsertedID, nil
+}
+
+// claimError is what the transaction callback returns for a failed claim of ref. Errors labelled
+// TransientTransactionError, such as the write conflict with a concurrent delete, are returned as
+// they are so WithTransaction retries; the others become ref.Check.
+func claimError(ref reference, err error) error {
+	var labeled mongo.LabeledError
+	if errors.As(err, &labeled) && labeled.HasErrorLabel(transientTransactionError) {
+		return err
+	}
+	return ref.Check
+}
+
+func checkReferences(ctx context.Context, refs []reference, ids []primitive.ObjectID) error {
+	for i, ref := range refs {
+		err := client.Database("MVDB").Collection(ref.Collection).FindOne(ctx, ref.filter(ids[i])).Err()
+		if err == mongo.ErrNoDocuments {
+			return ref.Missing
+		}
+		if err != nil {
+			return ref.Check
+		}
+	}
+	return nil
+}
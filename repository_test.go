@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestClaimErrorKeepsTransientLabel(t *testing.T) {
+	ref := reference{Collection: "users", Check: errUserCheck}
+	conflict := mongo.CommandError{Code: 112, Name: "WriteConflict", Labels: []string{transientTransactionError}}
+
+	err := claimError(ref, conflict)
+	var labeled mongo.LabeledError
+	if !errors.As(err, &labeled) || !labeled.HasErrorLabel(transientTransactionError) {
+		t.Fatalf("write conflict became %v, WithTransaction won't retry it", err)
+	}
+	var cmdErr mongo.CommandError
+	if err := claimError(ref, fmt.Errorf("update: %w", conflict)); !errors.As(err, &cmdErr) || cmdErr.Name != "WriteConflict" {
+		t.Errorf("wrapped write conflict became %v", err)
+	}
+	if err := claimError(ref, mongo.CommandError{Code: 13, Name: "Unauthorized"}); err != errUserCheck {
+		t.Errorf("unlabelled error became %v, want the reference's Check", err)
+	}
+	if err := claimError(ref, errors.New("connection reset")); err != errUserCheck {
+		t.Errorf("plain error became %v, want the reference's Check", err)
+	}
+}
+
+func propertyReference(id primitive.ObjectID) reference {
+	return reference{Collection: "properties", ID: id.Hex(), Invalid: errInvalidPropertyID, Missing: errPropertyNotFound, Check: errPropertyCheck}
+}
+
+// useTransactions skips tests of the transactional path when the test deployment isn't a replica set
+func useTransactions(t *testing.T) {
+	t.Helper()
+	if !supportsTransactions(context.Background()) {
+		t.Skip("the test MongoDB deployment doesn't support transactions")
+	}
+}
+
+// TestConcurrentClaims: inserts claiming the same property conflict on its ref_version, and the
+// transaction that loses is retried instead of failing
+func TestConcurrentClaims(t *testing.T) {
+	useTestMongo(t, "properties", "listings")
+	useTransactions(t)
+	ctx := context.Background()
+	propertyID := primitive.NewObjectID()
+	insertDocs(t, "properties", Property{ID: propertyID, Title: "Claimed"})
+
+	const inserts = 10
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	errs := make([]error, inserts)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			_, errs[i] = insertWithReferences(ctx, "listings", Listing{ID: primitive.NewObjectID(), PropertyID: propertyID.Hex()}, propertyReference(propertyID))
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("insert %d: %v", i, err)
+		}
+	}
+	var property struct {
+		RefVersion int `bson:"ref_version"`
+	}
+	if err := client.Database("MVDB").Collection("properties").FindOne(ctx, bson.M{"_id": propertyID}).Decode(&property); err != nil {
+		t.Fatal(err)
+	}
+	if property.RefVersion != inserts {
+		t.Errorf("ref_version %d after %d claims", property.RefVersion, inserts)
+	}
+}
+
+// TestClaimRacesDelete inserts a listing while its property is deleted. Exactly one of the two
+// transactions goes first: either the listing is stored and the delete removes it with the
+// property, or the insert finds the property gone. A live listing on a deleted property is neither.
+func TestClaimRacesDelete(t *testing.T) {
+	useTestMongo(t, cascadeCollections...)
+	useTransactions(t)
+	ctx := context.Background()
+	listings := client.Database("MVDB").Collection("listings")
+
+	var inserted, refused int
+	for round := 0; round < 20; round++ {
+		propertyID, listingID := primitive.NewObjectID(), primitive.NewObjectID()
+		insertDocs(t, "properties", Property{ID: propertyID, Title: "Contested"})
+
+		var insertErr, deleteErr error
+		var wg sync.WaitGroup
+		start := make(chan struct{})
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			<-start
+			_, insertErr = insertWithReferences(ctx, "listings", Listing{ID: listingID, PropertyID: propertyID.Hex(), ListingStatus: "active"}, propertyReference(propertyID))
+		}()
+		go func() {
+			defer wg.Done()
+			<-start
+			_, deleteErr = deletePropertyCascade(ctx, propertyID)
+		}()
+		close(start)
+		wg.Wait()
+
+		if deleteErr != nil {
+			t.Fatalf("round %d: delete: %v", round, deleteErr)
+		}
+		var stored Listing
+		err := listings.FindOne(ctx, bson.M{"_id": listingID}).Decode(&stored)
+		switch {
+		case insertErr == nil && err == nil && stored.DeletedAt != nil:
+			inserted++
+		case insertErr == errPropertyNotFound && err == mongo.ErrNoDocuments:
+			refused++
+		default:
+			t.Errorf("round %d: insert %v, stored listing %+v (%v)", round, insertErr, stored, err)
+		}
+	}
+	t.Logf("insert first %d times, delete first %d times", inserted, refused)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// trustedProxies are the networks of TRUSTED_PROXIES, comma separated IPs or CIDRs of the load
+// balancers in front of the API. X-Forwarded-For is only believed from them: any caller can send the
+// header, and would otherwise choose the IP the login throttle and the audit log see.
+var trustedProxies []*net.IPNet
+
+func setupTrustedProxies() {
+	trustedProxies = parseTrustedProxies(os.Getenv("TRUSTED_PROXIES"))
+}
+
+func parseTrustedProxies(raw string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if ip := net.ParseIP(entry); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				bits = 8 * net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(entry)
+		if err != nil {
+			log.Println("Ignoring invalid TRUSTED_PROXIES entry:", entry)
+			continue
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+func isTrustedProxy(ip net.IP) bool {
+	for _, n := range trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the caller's address. Behind a trusted proxy that is the last X-Forwarded-For hop
+// a trusted proxy didn't add; the hops before it are whatever the caller sent.
+func clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if !isTrustedProxy(net.ParseIP(ip)) {
+		return ip
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		parsed := net.ParseIP(hop)
+		if parsed == nil {
+			break // not an address a proxy would write, keep the last trusted hop
+		}
+		ip = hop
+		if !isTrustedProxy(parsed) {
+			break
+		}
+	}
+	return ip
+}
+
+type requestIDKey struct{}
+
+// withRequestID gives every request an id, taken from X-Request-ID when the proxy set one, and
+// echoes it in the response. It is in the context, so the slow query log can name the request.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if id == "" || len(id) > 64 {
+			b := make([]byte, 8)
+			rand.Read(b)
+			id = hex.EncodeToString(b)
+		}
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// requestID is the id withRequestID stored in ctx, "" outside a request
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// serverError answers 500 with msg, which must be generic, and logs err with the request id. Driver
+// and Cloudinary errors can name hosts, collections or signed URLs, so they never reach the client.
+func serverError(w http.ResponseWriter, r *http.Request, msg string, err error) {
+	log.Printf("%s (request %s): %v", msg, requestID(r.Context()), err)
+	http.Error(w, msg, http.StatusInternalServerError)
+}
+
+// jsonError answers status with {"error": msg, "code": code}. The middleware errors use it, so
+// clients can tell them from a handler's answer by the code instead of parsing the message.
+func jsonError(w http.ResponseWriter, status int, code, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg, "code": code})
+}
+
+// writeCreated answers 201 with a Location header and the created document, which carries its id
+// field as the old {"xxx_id": ...} answers did. extra fields, such as warnings, are added next to the
+// document's own.
+func writeCreated(w http.ResponseWriter, location string, doc interface{}, extra map[string]interface{}) {
+	body, err := json.Marshal(doc)
+	if err == nil && len(extra) > 0 {
+		var fields map[string]json.RawMessage
+		if err = json.Unmarshal(body, &fields); err == nil {
+			for k, v := range extra {
+				if fields[k], err = json.Marshal(v); err != nil {
+					break
+				}
+			}
+			if err == nil {
+				body, err = json.Marshal(fields)
+			}
+		}
+	}
+	if err != nil {
+		log.Println("Failed to encode the created document at", location, ":", err)
+		http.Error(w, "Failed to encode the created document", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Location", location)
+	w.WriteHeader(http.StatusCreated)
+	w.Write(append(body, '\n'))
+}
+
+// pathObjectID parses the {id} path parameter. It answers 400 with "Invalid <entity> ID format" and
+// returns false when it isn't an ObjectID, so a garbage id never reaches a query or an upload as the
+// zero ObjectID.
+func pathObjectID(w http.ResponseWriter, r *http.Request, entity string) (primitive.ObjectID, bool) {
+	return pathVarObjectID(w, r, "id", entity)
+}
+
+// pathVarObjectID is pathObjectID for another path parameter, like {waitlist_id}
+func pathVarObjectID(w http.ResponseWriter, r *http.Request, name, entity string) (primitive.ObjectID, bool) {
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)[name])
+	if err != nil {
+		http.Error(w, "Invalid "+entity+" ID format", http.StatusBadRequest)
+		return primitive.NilObjectID, false
+	}
+	return id, true
+}
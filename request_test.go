@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/LynnT-2003/mv-realty-backend/jobs"
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// bodyCheckedFirst are the {id} routes that validate their body before the id
+var bodyCheckedFirst = map[string]bool{
+	"POST /admin/listings/{id}/verification/reject": true,
+	"POST /listings/{id}/request-verification":      true,
+}
+
+// TestInvalidPathIDs sends every {id} route a malformed id: each must answer 400 "Invalid <entity> ID
+// format" from pathObjectID before it reaches Mongo
+func TestInvalidPathIDs(t *testing.T) {
+	skipMaintenanceLookup(t)
+	skipLoginThrottle(t)
+	useTestKeys(t)
+	r := router()
+	for _, route := range registeredRoutes(t, r) {
+		method, tmpl, _ := strings.Cut(route, " ")
+		if !strings.Contains(tmpl, "{id}") || bodyCheckedFirst[route] {
+			continue
+		}
+		path := routeVar.ReplaceAllString(strings.Replace(tmpl, "{id}", "not-an-id", 1), "0123456789abcdef01234567")
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		req := httptest.NewRequest(method, path, strings.NewReader("{}")).WithContext(ctx)
+		req.Header.Set("X-API-Key", "test-shared-key")
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		func() {
+			defer func() {
+				if recover() != nil {
+					rec.Code = 0 // reached Mongo
+				}
+			}()
+			r.ServeHTTP(rec, req)
+		}()
+		cancel()
+		body := strings.TrimSpace(rec.Body.String())
+		if rec.Code != http.StatusBadRequest || !strings.HasPrefix(body, "Invalid ") || !strings.HasSuffix(body, " ID format") {
+			t.Errorf("%s with a malformed id: status %d, body %q", route, rec.Code, body)
+		}
+	}
+}
+
+func TestServerErrorHidesCause(t *testing.T) {
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	handler := withRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serverError(w, r, "Failed to retrieve Properties", errors.New("connection() error occurred during connection handshake: auth error: sasl conversation error: mvdb-prod.abc12.mongodb.net"))
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/properties", nil)
+	req.Header.Set("X-Request-ID", "req-42")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusInternalServerError || rec.Body.String() != "Failed to retrieve Properties\n" {
+		t.Errorf("status %d, body %q", rec.Code, rec.Body)
+	}
+	if !strings.Contains(logged.String(), "req-42") || !strings.Contains(logged.String(), "mvdb-prod.abc12.mongodb.net") {
+		t.Errorf("log %q should hold the cause and the request id", logged.String())
+	}
+}
+
+// checkJSONError fails t unless a response is a jsonError answer with code and message
+func checkJSONError(t *testing.T, what string, header http.Header, body, code, message string) {
+	t.Helper()
+	var got struct{ Error, Code string }
+	if err := json.Unmarshal([]byte(body), &got); err != nil {
+		t.Errorf("%s: %v in %q", what, err, body)
+		return
+	}
+	if header.Get("Content-Type") != "application/json" || got.Code != code || got.Error != message {
+		t.Errorf("%s: %s %+v, want code %q and %q", what, header.Get("Content-Type"), got, code, message)
+	}
+}
+
+// unreachableMongo points client at a port nothing listens on, so every query fails with a driver
+// error naming the address
+func unreachableMongo(t *testing.T) string {
+	t.Helper()
+	const address = "127.0.0.1:9"
+	c, err := mongo.Connect(context.Background(), options.Client().ApplyURI("mongodb://"+address+"/?serverSelectionTimeoutMS=20&connectTimeoutMS=20"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := client
+	client = c
+	t.Cleanup(func() {
+		client = prev
+		c.Disconnect(context.Background())
+	})
+	return address
+}
+
+// TestMongoFailuresStayGeneric calls every route with a database that can't be reached: whatever
+// the route answers, the driver's error text must stay in the logs
+func TestMongoFailuresStayGeneric(t *testing.T) {
+	skipMaintenanceLookup(t)
+	skipLoginThrottle(t)
+	useTestKeys(t)
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	address := unreachableMongo(t)
+	prevQueue := jobQueue // not started, the job routes only read it
+	jobQueue = jobs.New(client.Database("MVDB").Collection("jobs"))
+	t.Cleanup(func() { jobQueue = prevQueue })
+	r := router()
+	failed := 0
+	for _, route := range registeredRoutes(t, r) {
+		method, tmpl, _ := strings.Cut(route, " ")
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		req := httptest.NewRequest(method, routeVar.ReplaceAllString(tmpl, "0123456789abcdef01234567"), strings.NewReader("{}")).WithContext(ctx)
+		req.Header.Set("X-API-Key", "test-shared-key")
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		cancel()
+		if rec.Code >= 500 {
+			failed++
+		}
+		body := rec.Body.String()
+		for _, leak := range []string{address, "server selection", "connection refused", "context deadline"} {
+			if strings.Contains(body, leak) {
+				t.Errorf("%s: body %q holds %q", route, body, leak)
+			}
+		}
+	}
+	if failed == 0 {
+		t.Error("no route failed, the database wasn't reached")
+	}
+}
+
+// TestCloudinaryFailureStaysGeneric uploads to an account that doesn't exist: the upload fails with
+// an error naming the cloud, which mustn't reach the client
+func TestCloudinaryFailureStaysGeneric(t *testing.T) {
+	useTestMongo(t, "properties")
+	useTestKeys(t)
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	t.Setenv("CLOUDINARY_CLOUD_NAME", "leaky-cloud-name")
+	t.Setenv("CLOUDINARY_API_KEY", "123456789012345")
+	t.Setenv("CLOUDINARY_API_SECRET", "leaky-api-secret")
+	id := primitive.NewObjectID()
+	if _, err := client.Database("MVDB").Collection("properties").InsertOne(context.Background(), Property{ID: id, Title: "Noble"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, _ := form.CreateFormFile("image", "photo.jpg")
+	part.Write([]byte("\xff\xd8\xff\xe0 not really a jpeg"))
+	form.Close()
+	req := httptest.NewRequest(http.MethodPost, "/properties/"+id.Hex()+"/images", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req = mux.SetURLVars(req, map[string]string{"id": id.Hex()})
+	rec := httptest.NewRecorder()
+	uploadImage(rec, req)
+
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("status %d, want 500", rec.Code)
+	}
+	for _, leak := range []string{"leaky-cloud-name", "leaky-api-secret", "123456789012345", "signature", "api.cloudinary.com"} {
+		if strings.Contains(rec.Body.String(), leak) {
+			t.Errorf("body %q holds %q", rec.Body, leak)
+		}
+	}
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultResponseCacheTTL  = time.Minute
+	defaultResponseCacheSize = 500     // entries kept by the in-process cache
+	maxCachedResponseBytes   = 1 << 20 // larger responses are streamed without being cached
+)
+
+// cacheableRoutes are the GET routes the response cache can serve, with the collections whose
+// writes make their responses stale. RESPONSE_CACHE_ROUTES picks which of them are cached.
+var cacheableRoutes = map[string][]string{
+	"/properties":            {"properties", "listings"},
+	"/properties/{idOrSlug}": {"properties"},
+	"/listings":              {"listings", "properties", "settings"}, // settings holds the ranking weights
+	"/listings/{idOrSlug}":   {"listings", "agents", "properties"},
+	"/listings/featured":     {"listings"},
+	"/listings/new":          {"listings"},
+	"/listings/tags":         {"listings"},
+	// sales and rentals come from the audit log, which is only written along with the listing
+	"/properties/{id}/activity": {"listings", "properties"},
+}
+
+var defaultCachedRoutes = []string{"/properties", "/listings/featured", "/properties/{id}/activity"}
+
+type cachedResponse struct {
+	ContentType string `json:"content_type"`
+	Warning     string `json:"warning,omitempty"`
+	ETag        string `json:"etag,omitempty"`
+	CacheCtl    string `json:"cache_control,omitempty"`
+	Vary        string `json:"vary,omitempty"`
+	Body        []byte `json:"body"`
+}
+
+// ResponseCache stores GET responses by key. Each entry is tagged with the collections it was built
+// from; Invalidate drops every entry tagged with a collection.
+type ResponseCache interface {
+	Get(ctx context.Context, key string) (*cachedResponse, bool)
+	Set(ctx context.Context, key string, resp *cachedResponse, collections []string, ttl time.Duration)
+	Invalidate(ctx context.Context, collection string)
+}
+
+var (
+	responseCache    ResponseCache // nil when caching is off
+	responseCacheTTL = defaultResponseCacheTTL
+	cachedRoutes     = map[string][]string{}
+)
+
+// setupResponseCache reads RESPONSE_CACHE (off disables it), RESPONSE_CACHE_TTL, RESPONSE_CACHE_SIZE
+// and RESPONSE_CACHE_ROUTES (comma separated route templates, default /properties,/listings/featured,
+// /properties/{id}/activity).
+// With REDIS_URL the cache is shared by every instance, otherwise each keeps its own LRU.
+func setupResponseCache() {
+	if os.Getenv("RESPONSE_CACHE") == "off" {
+		return
+	}
+	if raw := os.Getenv("RESPONSE_CACHE_TTL"); raw != "" {
+		if d, err := time.ParseDuration(raw); err == nil && d > 0 {
+			responseCacheTTL = d
+		} else {
+			log.Println("Ignoring invalid RESPONSE_CACHE_TTL, using", defaultResponseCacheTTL, ":", raw)
+		}
+	}
+	routes := defaultCachedRoutes
+	if raw := os.Getenv("RESPONSE_CACHE_ROUTES"); raw != "" {
+		routes = strings.Split(raw, ",")
+	}
+	for _, route := range routes {
+		route = strings.TrimSpace(route)
+		collections, ok := cacheableRoutes[route]
+		if !ok {
+			log.Println("Ignoring RESPONSE_CACHE_ROUTES entry that can't be cached:", route)
+			continue
+		}
+		cachedRoutes[route] = collections
+	}
+
+	if raw := os.Getenv("REDIS_URL"); raw != "" {
+		c, err := newRedisCache(raw)
+		if err != nil {
+			log.Println("Response cache is disabled, invalid REDIS_URL:", err)
+			return
+		}
+		responseCache = c
+		return
+	}
+	size := defaultResponseCacheSize
+	if raw := os.Getenv("RESPONSE_CACHE_SIZE"); raw != "" {
+		if n, err := strconv.Atoi(raw); err == nil && n > 0 {
+			size = n
+		} else {
+			log.Println("Ignoring invalid RESPONSE_CACHE_SIZE, using", defaultResponseCacheSize, ":", raw)
+		}
+	}
+	responseCache = newLRUCache(size)
+}
+
+// invalidateResponses is called for every write, see recordAudit. It uses its own timeout so a slow
+// cache can't hold up the handler.
+func invalidateResponses(collection string) {
+	if responseCache == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	responseCache.Invalidate(ctx, collection)
+}
+
+// responseCacheKey normalizes the request: the query is re-encoded with sorted keys, and callers with
+// the API key get their own entries since they can see more (drafts, deleted documents, no page cap).
+// Formatted prices are kept per locale, which may come from Accept-Language.
+func responseCacheKey(r *http.Request) string {
+	key := r.URL.Path + "?" + r.URL.Query().Encode()
+	if hasAPIKey(r) {
+		key += "|admin"
+	}
+	return key + formattedLocaleKey(r)
+}
+
+// cacheResponses is the router middleware serving the routes in cachedRoutes from responseCache.
+// Responses are still streamed on a miss; a copy is kept and stored when the status is 200 and the
+// body is at most maxCachedResponseBytes.
+func cacheResponses(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if responseCache == nil || r.Method != http.MethodGet {
+			next.ServeHTTP(w, r)
+			return
+		}
+		route := mux.CurrentRoute(r)
+		if route == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		tmpl, err := route.GetPathTemplate()
+		collections, ok := cachedRoutes[tmpl]
+		if err != nil || !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key := responseCacheKey(r)
+		if cached, ok := responseCache.Get(r.Context(), key); ok {
+			w.Header().Set("Content-Type", cached.ContentType)
+			if cached.Warning != "" {
+				w.Header().Set("Warning", cached.Warning)
+			}
+			if cached.Vary != "" {
+				w.Header().Set("Vary", cached.Vary)
+			}
+			w.Header().Set("X-Cache", "HIT")
+			if cached.ETag != "" {
+				w.Header().Set("ETag", cached.ETag)
+				w.Header().Set("Cache-Control", cached.CacheCtl)
+				if etagMatches(r.Header.Get("If-None-Match"), cached.ETag) {
+					w.Header().Del("Content-Type")
+					w.WriteHeader(http.StatusNotModified)
+					return
+				}
+			}
+			w.Write(cached.Body)
+			return
+		}
+		w.Header().Set("X-Cache", "MISS")
+		rec := &cacheRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		if rec.status == http.StatusOK && !rec.overflow && !rec.failed {
+			responseCache.Set(r.Context(), key, &cachedResponse{
+				ContentType: w.Header().Get("Content-Type"),
+				Warning:     w.Header().Get("Warning"),
+				ETag:        w.Header().Get("ETag"),
+				CacheCtl:    w.Header().Get("Cache-Control"),
+				Vary:        w.Header().Get("Vary"),
+				Body:        rec.body.Bytes(),
+			}, collections, responseCacheTTL)
+		}
+	})
+}
+
+// cacheRecorder passes the response through and keeps a copy of the body. A response that could
+// not be written in full, or that its handler broke off, is failed and not stored.
+type cacheRecorder struct {
+	http.ResponseWriter
+	status   int
+	body     bytes.Buffer
+	overflow bool
+	failed   bool
+}
+
+// responseFailer is a writer that wants to know when a response is cut short
+type responseFailer interface {
+	failResponse()
+}
+
+// failResponse tells the writers of w that the response broke off after its status was sent, such
+// as a JSON array left unterminated, so the 200 it went out with isn't cached
+func failResponse(w http.ResponseWriter) {
+	for w != nil {
+		if f, ok := w.(responseFailer); ok {
+			f.failResponse()
+		}
+		u, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return
+		}
+		w = u.Unwrap()
+	}
+}
+
+func (c *cacheRecorder) failResponse() {
+	c.failed = true
+	c.body = bytes.Buffer{}
+}
+
+func (c *cacheRecorder) WriteHeader(status int) {
+	c.status = status
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *cacheRecorder) Write(b []byte) (int, error) {
+	if !c.overflow {
+		if c.body.Len()+len(b) > maxCachedResponseBytes {
+			c.overflow = true
+			c.body = bytes.Buffer{}
+		} else {
+			c.body.Write(b)
+		}
+	}
+	n, err := c.ResponseWriter.Write(b)
+	if err != nil {
+		// timed out (http.ErrHandlerTimeout) or the client is gone
+		c.failResponse()
+	}
+	return n, err
+}
+
+func (c *cacheRecorder) Flush() {
+	if f, ok := c.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// lruCache is the in-process ResponseCache: at most size entries, least recently used evicted first
+type lruCache struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List // front is most recently used
+	entries map[string]*list.Element
+}
+
+type lruEntry struct {
+	key         string
+	resp        *cachedResponse
+	collections []string
+	expiresAt   time.Time
+}
+
+func newLRUCache(size int) *lruCache {
+	return &lruCache{size: size, order: list.New(), entries: map[string]*list.Element{}}
+}
+
+func (c *lruCache) Get(_ context.Context, key string) (*cachedResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := el.Value.(*lruEntry)
+	if time.Now().After(entry.expiresAt) {
+		c.order.Remove(el)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return entry.resp, true
+}
+
+func (c *lruCache) Set(_ context.Context, key string, resp *cachedResponse, collections []string, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry := &lruEntry{key: key, resp: resp, collections: collections, expiresAt: time.Now().Add(ttl)}
+	if el, ok := c.entries[key]; ok {
+		el.Value = entry
+		c.order.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.order.PushFront(entry)
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lruEntry).key)
+	}
+}
+
+func (c *lruCache) Invalidate(_ context.Context, collection string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, el := range c.entries {
+		if isOneOf(collection, el.Value.(*lruEntry).collections) {
+			c.order.Remove(el)
+			delete(c.entries, key)
+		}
+	}
+}
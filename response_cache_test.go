@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// useTestResponseCache turns on an in-process response cache for the routes
+func useTestResponseCache(t *testing.T, routes ...string) {
+	t.Helper()
+	prevCache, prevRoutes := responseCache, cachedRoutes
+	responseCache, cachedRoutes = newLRUCache(10), map[string][]string{}
+	for _, route := range routes {
+		cachedRoutes[route] = cacheableRoutes[route]
+	}
+	t.Cleanup(func() { responseCache, cachedRoutes = prevCache, prevRoutes })
+}
+
+// cachedRouter serves template through cacheResponses with handler, counting the handler's calls
+func cachedRouter(template string, handler http.HandlerFunc) (http.Handler, *int) {
+	calls := 0
+	r := mux.NewRouter()
+	r.Use(cacheResponses)
+	r.HandleFunc(template, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		handler(w, r)
+	}).Methods("GET")
+	return r, &calls
+}
+
+func getCached(t *testing.T, handler http.Handler, path string) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	return rec
+}
+
+func TestLRUCacheInvalidate(t *testing.T) {
+	ctx := context.Background()
+	c := newLRUCache(10)
+	c.Set(ctx, "/properties?", &cachedResponse{Body: []byte("p")}, []string{"properties", "listings"}, time.Minute)
+	c.Set(ctx, "/listings/featured?", &cachedResponse{Body: []byte("f")}, []string{"listings"}, time.Minute)
+	c.Set(ctx, "/properties/x?", &cachedResponse{Body: []byte("x")}, []string{"properties"}, time.Minute)
+
+	c.Invalidate(ctx, "listings")
+	if _, ok := c.Get(ctx, "/properties?"); ok {
+		t.Error("/properties survived a listings write")
+	}
+	if _, ok := c.Get(ctx, "/listings/featured?"); ok {
+		t.Error("/listings/featured survived a listings write")
+	}
+	if resp, ok := c.Get(ctx, "/properties/x?"); !ok || string(resp.Body) != "x" {
+		t.Error("a listings write dropped an entry built from properties only")
+	}
+	c.Invalidate(ctx, "users")
+	if _, ok := c.Get(ctx, "/properties/x?"); !ok {
+		t.Error("a users write dropped an entry built from properties")
+	}
+}
+
+func TestLRUCacheEvictsAndExpires(t *testing.T) {
+	ctx := context.Background()
+	c := newLRUCache(2)
+	c.Set(ctx, "a", &cachedResponse{}, nil, time.Minute)
+	c.Set(ctx, "b", &cachedResponse{}, nil, time.Minute)
+	c.Get(ctx, "a") // b is now the least recently used
+	c.Set(ctx, "c", &cachedResponse{}, nil, time.Minute)
+	if _, ok := c.Get(ctx, "b"); ok {
+		t.Error("the least recently used entry wasn't evicted")
+	}
+	if _, ok := c.Get(ctx, "a"); !ok {
+		t.Error("a recently used entry was evicted")
+	}
+	c.Set(ctx, "d", &cachedResponse{}, nil, -time.Second)
+	if _, ok := c.Get(ctx, "d"); ok {
+		t.Error("an expired entry was served")
+	}
+}
+
+func TestCacheResponsesInvalidatedByWrites(t *testing.T) {
+	useTestResponseCache(t, "/listings/featured")
+	handler, calls := cachedRouter("/listings/featured", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[{"listing_id":"1"}]`))
+	})
+
+	if rec := getCached(t, handler, "/listings/featured"); rec.Header().Get("X-Cache") != "MISS" {
+		t.Fatalf("first request: X-Cache %q", rec.Header().Get("X-Cache"))
+	}
+	rec := getCached(t, handler, "/listings/featured")
+	if rec.Header().Get("X-Cache") != "HIT" || rec.Body.String() != `[{"listing_id":"1"}]` || *calls != 1 {
+		t.Fatalf("second request: X-Cache %q, body %q, %d handler calls", rec.Header().Get("X-Cache"), rec.Body, *calls)
+	}
+
+	invalidateResponses("users")
+	if getCached(t, handler, "/listings/featured"); *calls != 1 {
+		t.Error("a users write invalidated /listings/featured")
+	}
+	invalidateResponses("listings")
+	if rec := getCached(t, handler, "/listings/featured"); rec.Header().Get("X-Cache") != "MISS" || *calls != 2 {
+		t.Errorf("after a listings write: X-Cache %q, %d handler calls", rec.Header().Get("X-Cache"), *calls)
+	}
+}
+
+func TestCacheResponsesSkipsErrorsAndOversizedBodies(t *testing.T) {
+	useTestResponseCache(t, "/listings/featured", "/properties")
+	failing, failingCalls := cachedRouter("/listings/featured", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Failed to retrieve Listings", http.StatusInternalServerError)
+	})
+	getCached(t, failing, "/listings/featured")
+	getCached(t, failing, "/listings/featured")
+	if *failingCalls != 2 {
+		t.Error("a 500 was cached")
+	}
+
+	large, largeCalls := cachedRouter("/properties", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, maxCachedResponseBytes+1))
+	})
+	getCached(t, large, "/properties")
+	getCached(t, large, "/properties")
+	if *largeCalls != 2 {
+		t.Error("a body over maxCachedResponseBytes was cached")
+	}
+}
+
+type streamedDoc struct {
+	N int `bson:"n"`
+}
+
+// streamingHandler streams docs with streamCursor; prepare may be nil
+func streamingHandler(t *testing.T, docs []interface{}, prepare func([]streamedDoc) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cur, err := mongo.NewCursorFromDocuments(docs, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		streamCursor(r.Context(), w, cur, "Listings", prepare)
+	}
+}
+
+func streamedDocs(n int) []interface{} {
+	docs := make([]interface{}, n)
+	for i := range docs {
+		docs[i] = bson.M{"n": i}
+	}
+	return docs
+}
+
+// TestCacheResponsesSkipsBrokenStreams covers the 200s streamCursor can no longer turn into an
+// error: a response cut off mid-array must not be cached and served as if it were complete
+func TestCacheResponsesSkipsBrokenStreams(t *testing.T) {
+	tests := []struct {
+		name    string
+		docs    []interface{}
+		prepare func([]streamedDoc) error
+	}{
+		{"decode error", append(streamedDocs(streamBatchSize+10), bson.M{"n": "not a number"}), nil},
+		{"deadline in the second batch", streamedDocs(2*streamBatchSize + 10), func() func([]streamedDoc) error {
+			batches := 0
+			return func([]streamedDoc) error {
+				if batches++; batches == 2 {
+					return context.DeadlineExceeded
+				}
+				return nil
+			}
+		}()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestResponseCache(t, "/listings")
+			handler, calls := cachedRouter("/listings", streamingHandler(t, tt.docs, tt.prepare))
+			rec := getCached(t, handler, "/listings")
+			if rec.Code != http.StatusOK || rec.Body.Len() == 0 {
+				t.Fatalf("status %d with %d bytes, want a 200 that broke off", rec.Code, rec.Body.Len())
+			}
+			if rec.Body.Bytes()[rec.Body.Len()-1] == ']' {
+				t.Fatal("the array was terminated")
+			}
+			getCached(t, handler, "/listings")
+			if *calls != 2 {
+				t.Error("the truncated response was cached")
+			}
+		})
+	}
+
+	t.Run("complete", func(t *testing.T) {
+		useTestResponseCache(t, "/listings")
+		handler, calls := cachedRouter("/listings", streamingHandler(t, streamedDocs(2*streamBatchSize+10), nil))
+		getCached(t, handler, "/listings")
+		if rec := getCached(t, handler, "/listings"); *calls != 1 || rec.Header().Get("X-Cache") != "HIT" {
+			t.Error("a complete stream wasn't cached")
+		}
+	})
+}
+
+func TestFailResponseUnwraps(t *testing.T) {
+	rec := &cacheRecorder{ResponseWriter: httptest.NewRecorder(), status: http.StatusOK}
+	failResponse(unwrappingWriter{rec})
+	if !rec.failed {
+		t.Error("failResponse didn't reach the recorder under another writer")
+	}
+	failResponse(httptest.NewRecorder()) // writers without a copy are left alone
+}
+
+type unwrappingWriter struct{ http.ResponseWriter }
+
+func (u unwrappingWriter) Unwrap() http.ResponseWriter { return u.ResponseWriter }
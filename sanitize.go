@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+// Filters are built from user input under three rules, which keep query and body values literal:
+//
+//   - input reaches a filter only as a Go string, number or ObjectID: query parameters are read with
+//     URL.Query().Get and bodies decode into typed structs, never into bson.M or interface{}, so a
+//     value like {"$gt": ""} fails to decode instead of becoming an operator
+//   - strings matched as a pattern go through regexp.QuoteMeta, see uniqueSlug
+//   - operators ($where, $expr, $function, ...) and field names are only ever written in code, and
+//     aggregation expressions only take validated values (currencies, numbers), since a string
+//     starting with $ is a field path there
+//
+// withPlainQuery adds the checks those rules can't express in a type.
+
+const maxQueryValueLength = 2048
+
+// withPlainQuery answers 400 for query parameters a browser wouldn't send: NUL bytes, which
+// drivers and logs may truncate at, invalid UTF-8, names starting with $ and very long values
+func withPlainQuery(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for name, values := range r.URL.Query() {
+			if strings.HasPrefix(name, "$") || !plainString(name) {
+				http.Error(w, "Invalid query parameter name", http.StatusBadRequest)
+				return
+			}
+			for _, v := range values {
+				if len(v) > maxQueryValueLength || !plainString(v) {
+					http.Error(w, "Invalid value for query parameter "+name, http.StatusBadRequest)
+					return
+				}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// plainString is false for invalid UTF-8 and strings holding a NUL byte
+func plainString(s string) bool {
+	return utf8.ValidString(s) && !strings.ContainsRune(s, 0)
+}
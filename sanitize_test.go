@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// maliciousQueries are query strings withPlainQuery must turn away
+var maliciousQueries = []string{
+	"$where=sleep(1000)",
+	"$gt=",
+	"email=admin%40example.com%00",
+	"q=%00%24where",
+	"property_id=%ff%fe",
+	"q=" + strings.Repeat("a", maxQueryValueLength+1),
+}
+
+func TestWithPlainQuery(t *testing.T) {
+	handler := withPlainQuery(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for _, query := range maliciousQueries {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/listings?"+query, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("?%.40s: status %d, want 400", query, rec.Code)
+		}
+	}
+	for _, query := range []string{
+		"", "email=a%2Bb%40example.com", "q=%E0%B8%84%E0%B8%AD%E0%B8%99%E0%B9%82%E0%B8%94", "tags=pool,gym",
+		"price=%7B%22%24gt%22%3A%22%22%7D", // {"$gt":""} is just text in a value
+		"q=" + strings.Repeat("a", maxQueryValueLength),
+	} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/listings?"+query, nil))
+		if rec.Code != http.StatusOK {
+			t.Errorf("?%.40s: status %d, want it let through", query, rec.Code)
+		}
+	}
+}
+
+// TestMaliciousQueryEveryRoute sends every route the malicious queries: the router must reject them
+// before any handler, so none can reach a filter
+func TestMaliciousQueryEveryRoute(t *testing.T) {
+	skipMaintenanceLookup(t)
+	useTestKeys(t)
+	r := router()
+	for _, route := range registeredRoutes(t, r) {
+		method, tmpl, _ := strings.Cut(route, " ")
+		path := routeVar.ReplaceAllString(tmpl, "0123456789abcdef01234567")
+		for _, query := range maliciousQueries {
+			rec := httptest.NewRecorder()
+			func() {
+				defer func() {
+					if recover() != nil {
+						rec.Code = 0 // reached Mongo
+					}
+				}()
+				r.ServeHTTP(rec, httptest.NewRequest(method, path+"?"+query, nil))
+			}()
+			if rec.Code != http.StatusBadRequest || !strings.HasPrefix(rec.Body.String(), "Invalid ") {
+				t.Errorf("%s?%.40s: status %d, body %q", route, query, rec.Code, rec.Body)
+			}
+		}
+	}
+}
+
+// filterKeys lists every key of a filter, nested ones included
+func filterKeys(v interface{}, keys *[]string) {
+	switch v := v.(type) {
+	case bson.M:
+		for k, nested := range v {
+			*keys = append(*keys, k)
+			filterKeys(nested, keys)
+		}
+	case bson.A:
+		for _, nested := range v {
+			filterKeys(nested, keys)
+		}
+	}
+}
+
+// TestListingFilterLiteral puts operator-like values in every string parameter of GET /listings:
+// each is rejected, or gives a filter without keys a plain value doesn't produce, so it can only
+// have changed a value (tags are slugified, so ".*" is no tag at all)
+func TestListingFilterLiteral(t *testing.T) {
+	keysFor := func(q url.Values) ([]string, error) {
+		f, err := parseListingFilter(q)
+		if err != nil {
+			return nil, err
+		}
+		var keys []string
+		filterKeys(f.toBSON(), &keys)
+		sort.Strings(keys)
+		return keys, nil
+	}
+	for _, param := range []string{"property_id", "listing_type", "listing_status", "furniture", "facing_direction", "tags", "state", "tags_match", "display_currency", "units", "bedroom", "min_price", "max_ppsm"} {
+		plain, plainErr := keysFor(url.Values{param: {"plain"}})
+		for _, value := range []string{`{"$gt":""}`, "$where", "$size", `.*`, "^a|b$", "a\x00b"} {
+			keys, err := keysFor(url.Values{param: {value}})
+			if err != nil {
+				continue
+			}
+			if plainErr != nil || !subset(keys, plain) {
+				t.Errorf("%s=%q: filter keys %v, with a plain value %v", param, value, keys, plain)
+			}
+		}
+	}
+}
+
+// subset reports whether every key of keys is in of
+func subset(keys, of []string) bool {
+	known := map[string]bool{}
+	for _, k := range of {
+		known[k] = true
+	}
+	for _, k := range keys {
+		if !known[k] {
+			return false
+		}
+	}
+	return true
+}
+
+// TestBodiesStayTyped decodes operator objects where handlers expect strings: typed structs refuse
+// them, so they can't become part of a filter
+func TestBodiesStayTyped(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		body   string
+		target interface{}
+	}{
+		{"user email", `{"email": {"$gt": ""}}`, &User{}},
+		{"user email regex", `{"email": {"$regex": ".*"}}`, &User{}},
+		{"inquiry property", `{"property_id": {"$ne": null}}`, &Inquiry{}},
+		{"appointment listing", `{"Listing_id": {"$in": ["a"]}}`, &Appointment{}},
+		{"listing status", `{"listing_status": {"$exists": true}}`, &Listing{}},
+		{"inquiry source", `{"source": {"utm_source": {"$where": "1"}}}`, &Inquiry{}},
+	} {
+		if err := json.Unmarshal([]byte(tt.body), tt.target); err == nil {
+			t.Errorf("%s: %s decoded", tt.name, tt.body)
+		}
+	}
+}
+
+// TestUniqueSlugEscapesPattern: regex characters in a slug base are matched literally
+func TestUniqueSlugEscapesPattern(t *testing.T) {
+	useTestMongo(t, "properties")
+	ctx := context.Background()
+	if _, err := client.Database("MVDB").Collection("properties").InsertMany(ctx, []interface{}{
+		Property{Title: "x", Slug: "noblexone"},
+		Property{Title: "x", Slug: "anything"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for base, want := range map[string]string{"noble.one": "noble.one", ".*": ".*", "noblexone": "noblexone-2"} {
+		got, err := uniqueSlug(ctx, "properties", base, map[string]bool{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("uniqueSlug(%q) = %q, want %q", base, got, want)
+		}
+	}
+}
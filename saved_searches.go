@@ -0,0 +1,589 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const notificationSavedSearchMatch = "saved_search_match"
+
+// maxSavedSearches is how many saved searches one user can keep
+const maxSavedSearches = 20
+
+// SavedSearch is a buyer's stored listing filter. While Alerts is on, every listing that goes live
+// and matches it creates a notification and an email, see matchSavedSearches.
+type SavedSearch struct {
+	ID               primitive.ObjectID `bson:"_id,omitempty" json:"saved_search_id,omitempty"`
+	UserID           string             `bson:"user_id" json:"user_id"`
+	Name             string             `bson:"name" json:"name"`
+	Filter           ListingFilter      `bson:"filter" json:"filter"`
+	Near             *geoRadius         `bson:"near,omitempty" json:"near,omitempty"`
+	Alerts           bool               `bson:"alerts" json:"alerts"`
+	UnsubscribeToken string             `bson:"unsubscribe_token" json:"-"` // in the link of every alert email
+	LastMatchedAt    *time.Time         `bson:"last_matched_at,omitempty" json:"last_matched_at,omitempty"`
+	CreatedAt        time.Time          `bson:"created_at" json:"created_at"`
+	UpdatedAt        time.Time          `bson:"updated_at" json:"updated_at"`
+}
+
+// geoRadius matches listings whose property is within RadiusM meters of Coordinates
+type geoRadius struct {
+	Coordinates [2]float64 `bson:"coordinates" json:"coordinates"` // [latitude, longitude]
+	RadiusM     float64    `bson:"radius_m" json:"radius_m"`
+}
+
+// savedSearchUpdate holds the fields PUT may change; a near with radius_m 0 removes the radius
+type savedSearchUpdate struct {
+	Name   *string        `json:"name"`
+	Filter *ListingFilter `json:"filter"`
+	Near   *geoRadius     `json:"near"`
+	Alerts *bool          `json:"alerts"`
+}
+
+// validateSavedSearch checks the fields a client can set. The filters that only make sense at query
+// time, listing_status, state and expiring_within_days, are refused: alerts are only ever sent for
+// active, published listings.
+func validateSavedSearch(s *SavedSearch) []string {
+	var problems []string
+	s.Name = strings.TrimSpace(s.Name)
+	if s.Name == "" || len(s.Name) > 100 {
+		problems = append(problems, "name is required and at most 100 characters")
+	}
+	f := &s.Filter
+	f.DisplayCurrency = strings.ToUpper(f.DisplayCurrency)
+	f.Tags = normalizeTags(f.Tags)
+	if f.ListingType != "" && !isOneOf(f.ListingType, listingTypes) {
+		problems = append(problems, "filter.listing_type must be sale or rent")
+	}
+	if f.FacingDirection != "" && !isOneOf(f.FacingDirection, facingDirections) {
+		problems = append(problems, "filter.facing_direction is not a valid direction")
+	}
+	if f.TagsMatch != "" && f.TagsMatch != "any" && f.TagsMatch != "all" {
+		problems = append(problems, "filter.tags_match must be any or all")
+	}
+	if f.DisplayCurrency != "" && !isOneOf(f.DisplayCurrency, currencies) {
+		problems = append(problems, "filter.display_currency must be one of "+strings.Join(currencies, ", "))
+	}
+	if f.ListingStatus != "" || f.State != "" || f.ExpiringWithin != nil {
+		problems = append(problems, "filter.listing_status, filter.state and filter.expiring_within_days can't be saved")
+	}
+	if s.Near != nil {
+		if !hasCoordinates(s.Near.Coordinates) || s.Near.Coordinates[0] < -90 || s.Near.Coordinates[0] > 90 ||
+			s.Near.Coordinates[1] < -180 || s.Near.Coordinates[1] > 180 {
+			problems = append(problems, "near.coordinates must be a [latitude, longitude] pair")
+		}
+		if s.Near.RadiusM <= 0 || s.Near.RadiusM > 50000 {
+			problems = append(problems, "near.radius_m must be more than 0 and at most 50000")
+		}
+	}
+	return problems
+}
+
+// matches evaluates the filter against a single listing in Go, the same way toBSON does in Mongo.
+// property is the listing's property and may be nil, in which case max_monthly_total never matches.
+func (f ListingFilter) matches(l *Listing, property *Property) bool {
+	if l.DeletedAt != nil || l.Publication == publicationDraft || l.ListingStatus != "active" {
+		return false
+	}
+	if f.PropertyID != "" && l.PropertyID != f.PropertyID {
+		return false
+	}
+	if f.ListingType != "" && l.ListingType != f.ListingType {
+		return false
+	}
+	if f.Furniture != "" && l.Furniture != f.Furniture {
+		return false
+	}
+	if f.FacingDirection != "" && l.FacingDirection != f.FacingDirection {
+		return false
+	}
+	if f.Bedroom != nil && l.Bedroom != *f.Bedroom {
+		return false
+	}
+	if f.Featured != nil && l.Featured != *f.Featured {
+		return false
+	}
+	if f.Verified != nil && l.Verified != *f.Verified {
+		return false
+	}
+	if len(f.Tags) > 0 && !tagsMatch(l.Tags, f.Tags, f.TagsMatch == "all") {
+		return false
+	}
+	if f.AvailableBy != nil && l.AvailableFrom != nil && !l.AvailableFrom.Before(*f.AvailableBy) {
+		return false
+	}
+	if !inRange(l.Size, f.MinSize, f.MaxSize) {
+		return false
+	}
+	if f.MinPPSM != nil || f.MaxPPSM != nil {
+		if l.Size <= 0 || !inRange(l.Price/l.Size, f.MinPPSM, f.MaxPPSM) {
+			return false
+		}
+	}
+
+	currency := f.DisplayCurrency
+	if currency == "" {
+		currency = defaultCurrency
+	}
+	if f.MinPrice != nil || f.MaxPrice != nil {
+		price, ok := convertedPrice(l.Price, listingCurrency(l), currency)
+		if !ok || !inRange(price, f.MinPrice, f.MaxPrice) {
+			return false
+		}
+	}
+	if f.MaxMonthlyTotal != nil {
+		if l.ListingType != "rent" || property == nil {
+			return false
+		}
+		// The common fee is in THB, like in applyFeeEstimates
+		fee, ok := convertedPrice(property.CommonFee*l.Size, defaultCurrency, currency)
+		if !ok {
+			return false
+		}
+		price, ok := convertedPrice(l.Price, listingCurrency(l), currency)
+		if !ok || price+fee > *f.MaxMonthlyTotal {
+			return false
+		}
+	}
+	return true
+}
+
+// matches adds the radius to the filter; listings of properties without coordinates never match one
+func (s *SavedSearch) matches(l *Listing, property *Property) bool {
+	if !s.Filter.matches(l, property) {
+		return false
+	}
+	if s.Near == nil {
+		return true
+	}
+	return property != nil && hasCoordinates(property.Coordinates) &&
+		haversineMeters(s.Near.Coordinates, property.Coordinates) <= s.Near.RadiusM
+}
+
+func inRange(v float64, min, max *float64) bool {
+	return (min == nil || v >= *min) && (max == nil || v <= *max)
+}
+
+func tagsMatch(have, want []string, all bool) bool {
+	for _, t := range want {
+		found := isOneOf(t, have)
+		if found && !all {
+			return true
+		}
+		if !found && all {
+			return false
+		}
+	}
+	return all
+}
+
+// convertedPrice converts with the current rates; without usable rates only same-currency prices
+// convert, as in priceFilter
+func convertedPrice(v float64, from, to string) (float64, bool) {
+	if from == to {
+		return v, true
+	}
+	rates := usableRates()
+	if rates == nil {
+		return 0, false
+	}
+	return rates.convert(v, from, to)
+}
+
+var savedSearchEmail = template.Must(template.New("saved-search").Parse(`<!DOCTYPE html>
+<html>
+<body style="font-family: sans-serif">
+<h2>A new listing matches "{{.Search.Name}}"</h2>
+<p><b>{{.Property}}</b><br>
+{{.Listing.Bedroom}} bedroom, {{.Listing.Size}} sqm, {{.Listing.ListingType}}<br>
+{{printf "%.0f" .Listing.Price}} {{.Currency}}</p>
+{{if .ListingURL}}<p><a href="{{.ListingURL}}">View the listing</a></p>{{end}}
+<p style="font-size: small; color: #666">You get this email because you saved this search.
+<a href="{{.UnsubscribeURL}}">Stop alerts for this search</a></p>
+</body>
+</html>
+`))
+
+// publicBaseURL is where the API is reachable from an email, from PUBLIC_BASE_URL. Links are left
+// relative without it.
+func publicBaseURL() string {
+	return strings.TrimRight(os.Getenv("PUBLIC_BASE_URL"), "/")
+}
+
+// matchSavedSearches runs when a listing goes live, on create or on publish. The active saved
+// searches are loaded in one query and evaluated against the listing in Go; each match gets an in-app
+// notification and an email. Like createNotification it only logs failures.
+func matchSavedSearches(listing Listing) {
+	if listing.Publication == publicationDraft || listing.ListingStatus != "active" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	var property *Property
+	if oid, err := primitive.ObjectIDFromHex(listing.PropertyID); err == nil {
+		var p Property
+		if err := client.Database("MVDB").Collection("properties").FindOne(ctx, bson.M{"_id": oid}).Decode(&p); err == nil {
+			property = &p
+		}
+	}
+	searches, err := findAll[SavedSearch](ctx, "saved_searches", bson.M{
+		"alerts":              true,
+		"filter.listing_type": bson.M{"$in": bson.A{listing.ListingType, nil}},
+	})
+	if err != nil {
+		log.Println("Failed to load saved searches for listing", listing.ID.Hex(), ":", err)
+		return
+	}
+	var matched []SavedSearch
+	for i := range searches {
+		if searches[i].matches(&listing, property) {
+			matched = append(matched, searches[i])
+		}
+	}
+	if len(matched) == 0 {
+		return
+	}
+
+	var userIDs []primitive.ObjectID
+	searchIDs := make([]primitive.ObjectID, len(matched))
+	for i, s := range matched {
+		searchIDs[i] = s.ID
+		if oid, err := primitive.ObjectIDFromHex(s.UserID); err == nil {
+			userIDs = append(userIDs, oid)
+		}
+	}
+	users, err := findAll[User](ctx, "users", notDeleted(bson.M{"_id": bson.M{"$in": userIDs}}))
+	if err != nil {
+		log.Println("Failed to load saved search owners for listing", listing.ID.Hex(), ":", err)
+		return
+	}
+	emails := map[string]string{}
+	for _, u := range users {
+		emails[u.ID.Hex()] = u.Email
+	}
+
+	title := ""
+	if property != nil {
+		title = property.Title
+	}
+	for _, s := range matched {
+		email, ok := emails[s.UserID]
+		if !ok {
+			continue // the owner was deleted
+		}
+		createNotification(s.UserID, notificationSavedSearchMatch, map[string]interface{}{
+			"saved_search_id": s.ID.Hex(),
+			"listing_id":      listing.ID.Hex(),
+			"slug":            listing.Slug,
+			"property_id":     listing.PropertyID,
+		})
+		if email == "" {
+			continue
+		}
+		html, err := renderSavedSearchEmail(&s, &listing, title)
+		if err != nil {
+			log.Println("Failed to render alert for saved search", s.ID.Hex(), ":", err)
+			continue
+		}
+		if err := mailer.Send(ctx, email, "New listing for "+s.Name, html); err != nil {
+			log.Println("Failed to email alert for saved search", s.ID.Hex(), ":", err)
+		}
+	}
+	if _, err := client.Database("MVDB").Collection("saved_searches").UpdateMany(ctx,
+		bson.M{"_id": bson.M{"$in": searchIDs}}, bson.M{"$set": bson.M{"last_matched_at": time.Now()}}); err != nil {
+		log.Println("Failed to update last_matched_at of saved searches:", err)
+	}
+}
+
+func renderSavedSearchEmail(s *SavedSearch, listing *Listing, property string) (string, error) {
+	base := publicBaseURL()
+	data := struct {
+		Search         *SavedSearch
+		Listing        *Listing
+		Property       string
+		Currency       string
+		ListingURL     string
+		UnsubscribeURL string
+	}{
+		Search:         s,
+		Listing:        listing,
+		Property:       property,
+		Currency:       listingCurrency(listing),
+		UnsubscribeURL: base + "/saved-searches/unsubscribe?token=" + url.QueryEscape(s.UnsubscribeToken),
+	}
+	if listing.Slug != "" {
+		data.ListingURL = base + "/listings/" + url.PathEscape(listing.Slug)
+	}
+	var buf bytes.Buffer
+	if err := savedSearchEmail.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+func newUnsubscribeToken() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func createSavedSearch(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, ok := pathObjectID(w, r, "User")
+	if !ok {
+		return
+	}
+	var search SavedSearch
+	if err := json.NewDecoder(r.Body).Decode(&search); err != nil {
+		http.Error(w, "Failed to parse request body", http.StatusBadRequest)
+		return
+	}
+	if problems := validateSavedSearch(&search); len(problems) > 0 {
+		http.Error(w, (&validationError{Problems: problems}).Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	if err := client.Database("MVDB").Collection("users").FindOne(ctx, notDeleted(bson.M{"_id": userID})).Err(); err == mongo.ErrNoDocuments {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		serverError(w, r, "Failed to retrieve User", err)
+		return
+	}
+	collection := client.Database("MVDB").Collection("saved_searches")
+	n, err := collection.CountDocuments(ctx, bson.M{"user_id": userID.Hex()})
+	if err != nil {
+		serverError(w, r, "Failed to count saved searches", err)
+		return
+	}
+	if n >= maxSavedSearches {
+		http.Error(w, fmt.Sprintf("A user can keep at most %d saved searches", maxSavedSearches), http.StatusConflict)
+		return
+	}
+
+	token, err := newUnsubscribeToken()
+	if err != nil {
+		serverError(w, r, "Failed to create saved search", err)
+		return
+	}
+	now := time.Now()
+	search.ID = primitive.NilObjectID
+	search.UserID = userID.Hex()
+	search.Alerts = true
+	search.UnsubscribeToken = token
+	search.LastMatchedAt = nil
+	search.CreatedAt, search.UpdatedAt = now, now
+	res, err := collection.InsertOne(ctx, search)
+	if err != nil {
+		serverError(w, r, "Failed to create saved search", err)
+		return
+	}
+	search.ID = res.InsertedID.(primitive.ObjectID)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(search)
+}
+
+func getSavedSearches(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, ok := pathObjectID(w, r, "User")
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	searches, err := findAll[SavedSearch](ctx, "saved_searches", bson.M{"user_id": userID.Hex()})
+	if err != nil {
+		serverError(w, r, "Failed to retrieve saved searches", err)
+		return
+	}
+	json.NewEncoder(w).Encode(searches)
+}
+
+// savedSearchFilter is the filter for {search_id} of user {id}, so a search is only reachable
+// through its owner. It answers 400 and returns false when either isn't an ObjectID.
+func savedSearchFilter(w http.ResponseWriter, r *http.Request) (bson.M, bool) {
+	userID, ok := pathObjectID(w, r, "User")
+	if !ok {
+		return nil, false
+	}
+	id, ok := pathVarObjectID(w, r, "search_id", "Saved Search")
+	if !ok {
+		return nil, false
+	}
+	return bson.M{"_id": id, "user_id": userID.Hex()}, true
+}
+
+func getSavedSearch(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	filter, ok := savedSearchFilter(w, r)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	var search SavedSearch
+	err := client.Database("MVDB").Collection("saved_searches").FindOne(ctx, filter).Decode(&search)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Saved search not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		serverError(w, r, "Failed to retrieve saved search", err)
+		return
+	}
+	json.NewEncoder(w).Encode(search)
+}
+
+func updateSavedSearch(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	filter, ok := savedSearchFilter(w, r)
+	if !ok {
+		return
+	}
+	var update savedSearchUpdate
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		http.Error(w, "Failed to parse request body", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	collection := client.Database("MVDB").Collection("saved_searches")
+	var search SavedSearch
+	err := collection.FindOne(ctx, filter).Decode(&search)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Saved search not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		serverError(w, r, "Failed to retrieve saved search", err)
+		return
+	}
+	if update.Name != nil {
+		search.Name = *update.Name
+	}
+	if update.Filter != nil {
+		search.Filter = *update.Filter
+	}
+	if update.Near != nil {
+		search.Near = update.Near
+		if update.Near.RadiusM == 0 {
+			search.Near = nil
+		}
+	}
+	if update.Alerts != nil {
+		search.Alerts = *update.Alerts
+	}
+	if problems := validateSavedSearch(&search); len(problems) > 0 {
+		http.Error(w, (&validationError{Problems: problems}).Error(), http.StatusBadRequest)
+		return
+	}
+	search.UpdatedAt = time.Now()
+	if _, err := collection.ReplaceOne(ctx, filter, search); err != nil {
+		serverError(w, r, "Failed to update saved search", err)
+		return
+	}
+	json.NewEncoder(w).Encode(search)
+}
+
+func deleteSavedSearch(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	filter, ok := savedSearchFilter(w, r)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	res, err := client.Database("MVDB").Collection("saved_searches").DeleteOne(ctx, filter)
+	if err != nil {
+		serverError(w, r, "Failed to delete saved search", err)
+		return
+	}
+	if res.DeletedCount == 0 {
+		http.Error(w, "Saved search not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+var unsubscribePage = template.Must(template.New("unsubscribe").Parse(`<!DOCTYPE html>
+<html>
+<body style="font-family: sans-serif">
+{{if .Done}}<p>You will no longer get emails for "{{.Name}}". You can turn alerts back on from your saved searches.</p>
+{{else}}<p>Stop alerts for your saved search "{{.Name}}"?</p>
+<form method="POST"><input type="hidden" name="token" value="{{.Token}}"><button type="submit">Unsubscribe</button></form>
+{{end}}</body>
+</html>
+`))
+
+// unsubscribeSavedSearch is the target of the link in alert emails. GET only shows a confirmation
+// form, since mail scanners follow links; POST turns the search's alerts off. The token is the
+// credential, so the flow works without the user signing in.
+func unsubscribeSavedSearch(w http.ResponseWriter, r *http.Request) {
+	token := r.FormValue("token")
+	if token == "" {
+		http.Error(w, "token is required", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	collection := client.Database("MVDB").Collection("saved_searches")
+	var search SavedSearch
+	err := collection.FindOne(ctx, bson.M{"unsubscribe_token": token}).Decode(&search)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Saved search not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		serverError(w, r, "Failed to retrieve saved search", err)
+		return
+	}
+	done := r.Method == http.MethodPost
+	if done {
+		if _, err := collection.UpdateOne(ctx, bson.M{"_id": search.ID},
+			bson.M{"$set": bson.M{"alerts": false, "updated_at": time.Now()}}); err != nil {
+			http.Error(w, "Failed to update saved search", http.StatusInternalServerError)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	unsubscribePage.Execute(w, struct {
+		Done  bool
+		Name  string
+		Token string
+	}{done, search.Name, token})
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Recurring work runs on one cron scheduler. Features register their task in their setup and
+// startScheduler, called after every setup, starts them. A task that changes shared data runs on
+// one instance per scheduled time: it takes a lease on its document in scheduled_tasks first, and
+// the instances that lose the race skip that run. Local tasks, which refresh per-process state, run
+// everywhere.
+
+// scheduledTask is a recurring task. Run returns a short summary of what it did, for the log.
+type scheduledTask struct {
+	Name       string
+	Spec       string // standard 5-field cron expression in Bangkok time
+	Env        string // environment variable overriding Spec, "off" disables the task
+	Timeout    time.Duration
+	Local      bool // runs on every instance, without the lease
+	RunAtStart bool // also runs once when the process starts
+	Run        func(ctx context.Context) (string, error)
+}
+
+// taskState is the document of a task in scheduled_tasks: its lease and its last run on any instance
+type taskState struct {
+	Name           string     `bson:"_id" json:"name"`
+	LeaseUntil     *time.Time `bson:"lease_until,omitempty" json:"-"`
+	LeaseOwner     string     `bson:"lease_owner,omitempty" json:"-"`
+	LastSlot       *time.Time `bson:"last_slot,omitempty" json:"-"` // scheduled time of the last run, one run per slot
+	LastStartedAt  *time.Time `bson:"last_started_at,omitempty" json:"last_started_at,omitempty"`
+	LastFinishedAt *time.Time `bson:"last_finished_at,omitempty" json:"last_finished_at,omitempty"`
+	LastDurationMs int64      `bson:"last_duration_ms,omitempty" json:"last_duration_ms,omitempty"`
+	LastResult     string     `bson:"last_result,omitempty" json:"last_result,omitempty"`
+	LastError      string     `bson:"last_error,omitempty" json:"last_error,omitempty"`
+	LastInstance   string     `bson:"last_instance,omitempty" json:"last_instance,omitempty"`
+	Runs           int64      `bson:"runs" json:"runs"`
+}
+
+// errTaskHeld is returned by runTask when another instance holds the lease or already ran the slot
+var errTaskHeld = errors.New("task is running or already ran elsewhere")
+
+type taskScheduler struct {
+	mu      sync.Mutex
+	cron    *cron.Cron
+	tasks   []*scheduledTask
+	specs   map[string]string       // effective expression, "off" for disabled tasks
+	entries map[string]cron.EntryID // of the enabled tasks
+}
+
+var scheduler = &taskScheduler{specs: map[string]string{}, entries: map[string]cron.EntryID{}}
+
+// instanceName tells instances apart in leases and run records
+var instanceName = func() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}()
+
+// registerTask adds a task; tasks registered after startScheduler are ignored
+func registerTask(t scheduledTask) {
+	scheduler.mu.Lock()
+	defer scheduler.mu.Unlock()
+	if scheduler.cron != nil {
+		log.Println("Scheduler already started, ignoring task", t.Name)
+		return
+	}
+	scheduler.tasks = append(scheduler.tasks, &t)
+}
+
+// startScheduler starts the registered tasks. A task with an invalid expression is disabled with a
+// log line rather than stopping the process.
+func startScheduler() {
+	scheduler.mu.Lock()
+	defer scheduler.mu.Unlock()
+	scheduler.cron = cron.New(cron.WithLocation(bangkok), cron.WithChain(cron.SkipIfStillRunning(cron.DiscardLogger)))
+	for _, t := range scheduler.tasks {
+		t := t
+		spec := t.Spec
+		if t.Env != "" && os.Getenv(t.Env) != "" {
+			spec = os.Getenv(t.Env)
+		}
+		scheduler.specs[t.Name] = spec
+		if spec == "off" {
+			continue
+		}
+		id, err := scheduler.cron.AddFunc(spec, func() {
+			runTask(context.Background(), t.Name, time.Now().Truncate(time.Minute))
+		})
+		if err != nil {
+			log.Println("Ignoring invalid", t.Env, "the task", t.Name, "is disabled:", spec)
+			scheduler.specs[t.Name] = "off"
+			continue
+		}
+		scheduler.entries[t.Name] = id
+		if t.RunAtStart {
+			go runTask(context.Background(), t.Name, time.Now().Truncate(time.Minute))
+		}
+	}
+	scheduler.cron.Start()
+}
+
+func findTask(name string) *scheduledTask {
+	scheduler.mu.Lock()
+	defer scheduler.mu.Unlock()
+	for _, t := range scheduler.tasks {
+		if t.Name == name {
+			return t
+		}
+	}
+	return nil
+}
+
+// runTask runs a task now and waits for it. slot is the scheduled time the run is for; the zero
+// time runs it regardless of earlier runs, as long as nobody holds the lease. It returns
+// errTaskHeld when another run has the task.
+func runTask(ctx context.Context, name string, slot time.Time) (string, error) {
+	t := findTask(name)
+	if t == nil {
+		return "", fmt.Errorf("unknown task %q", name)
+	}
+
+	collection := client.Database("MVDB").Collection("scheduled_tasks")
+	started := time.Now()
+	if !t.Local {
+		filter := bson.M{"_id": name, "lease_until": bson.M{"$not": bson.M{"$gt": started}}}
+		set := bson.M{"lease_until": started.Add(t.Timeout), "lease_owner": instanceName}
+		if !slot.IsZero() {
+			filter["last_slot"] = bson.M{"$not": bson.M{"$gte": slot}}
+			set["last_slot"] = slot
+		}
+		// A held lease or a run slot taken leaves nothing to match, and the upsert then collides on _id
+		_, err := collection.UpdateOne(ctx, filter, bson.M{"$set": set}, options.Update().SetUpsert(true))
+		if mongo.IsDuplicateKeyError(err) {
+			return "", errTaskHeld
+		}
+		if err != nil {
+			slog.Error("scheduled task not started", "task", name, "error", err)
+			return "", err
+		}
+	}
+
+	runCtx, cancel := context.WithTimeout(ctx, t.Timeout)
+	result, err := t.Run(runCtx)
+	cancel()
+	finished := time.Now()
+	duration := finished.Sub(started)
+
+	set := bson.M{
+		"last_started_at":  started,
+		"last_finished_at": finished,
+		"last_duration_ms": duration.Milliseconds(),
+		"last_result":      result,
+		"last_instance":    instanceName,
+	}
+	update := bson.M{"$set": set, "$inc": bson.M{"runs": 1}}
+	if err != nil {
+		set["last_error"] = err.Error()
+		slog.Error("scheduled task failed", "task", name, "duration_ms", duration.Milliseconds(), "error", err)
+	} else {
+		update["$unset"] = bson.M{"last_error": ""}
+		slog.Info("scheduled task finished", "task", name, "duration_ms", duration.Milliseconds(), "result", result)
+	}
+	filter := bson.M{"_id": name}
+	if !t.Local {
+		set["lease_until"] = finished
+		filter["lease_owner"] = instanceName
+	}
+	opts := options.Update().SetUpsert(t.Local)
+	if _, uerr := collection.UpdateOne(context.Background(), filter, update, opts); uerr != nil {
+		log.Println("Failed to record the run of task", name, ":", uerr)
+	}
+	return result, err
+}
+
+// getScheduler answers GET /admin/scheduler: every task with its expression, next run here and last
+// run on any instance
+func getScheduler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	states, err := findAllWith[taskState](ctx, "scheduled_tasks", bson.M{}, nil)
+	if err != nil {
+		serverError(w, r, "Failed to retrieve scheduled tasks", err)
+		return
+	}
+	byName := map[string]taskState{}
+	for _, s := range states {
+		byName[s.Name] = s
+	}
+
+	type taskStatus struct {
+		taskState
+		Spec    string     `json:"spec"`
+		Enabled bool       `json:"enabled"`
+		Local   bool       `json:"local"`
+		Running bool       `json:"running"`
+		NextRun *time.Time `json:"next_run,omitempty"`
+	}
+	scheduler.mu.Lock()
+	defer scheduler.mu.Unlock()
+	now := time.Now()
+	list := []taskStatus{}
+	for _, t := range scheduler.tasks {
+		state, ok := byName[t.Name]
+		if !ok {
+			state.Name = t.Name
+		}
+		status := taskStatus{
+			taskState: state,
+			Spec:      scheduler.specs[t.Name],
+			Local:     t.Local,
+			Running:   state.LeaseUntil != nil && state.LeaseUntil.After(now),
+		}
+		if id, ok := scheduler.entries[t.Name]; ok && scheduler.cron != nil {
+			status.Enabled = true
+			if next := scheduler.cron.Entry(id).Next; !next.IsZero() {
+				status.NextRun = &next
+			}
+		}
+		list = append(list, status)
+	}
+	json.NewEncoder(w).Encode(list)
+}
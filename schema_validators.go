@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/LynnT-2003/mv-realty-backend/imagemeta"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Shorthands for the $jsonSchema validators below
+var (
+	schemaString    = bson.M{"bsonType": "string"}
+	schemaDate      = bson.M{"bsonType": "date"}
+	schemaNullDate  = bson.M{"bsonType": bson.A{"date", "null"}}
+	schemaStrings   = bson.M{"bsonType": "array", "items": schemaString}
+	schemaNonNegNum = bson.M{"bsonType": "number", "minimum": 0}
+)
+
+// schemaImages accepts image documents and the URL strings stored before captions existed
+var schemaImages = bson.M{"bsonType": "array", "items": bson.M{"bsonType": bson.A{"string", "object"}}}
+
+// schemaVideos is Property.Videos and Listing.Videos
+var schemaVideos = bson.M{"bsonType": "array", "items": bson.M{
+	"bsonType": "object",
+	"required": bson.A{"url", "provider"},
+	"properties": bson.M{
+		"url":      bson.M{"bsonType": "string", "pattern": "^https://"},
+		"provider": schemaEnum(videoProviders),
+		"title":    schemaString,
+	},
+}}
+
+// schemaFloorPlans is Property.FloorPlans and Listing.FloorPlans
+var schemaFloorPlans = bson.M{"bsonType": "array", "items": bson.M{
+	"bsonType": "object",
+	"required": bson.A{"url", "public_id", "resource_type"},
+	"properties": bson.M{
+		"url":           schemaString,
+		"public_id":     schemaString,
+		"label":         schemaString,
+		"resource_type": schemaEnum([]string{imagemeta.ResourceImage, imagemeta.ResourcePDF}),
+	},
+}}
+
+// schemaDocuments is Property.Documents
+var schemaDocuments = bson.M{"bsonType": "array", "items": bson.M{
+	"bsonType": "object",
+	"required": bson.A{"url", "public_id", "content_type"},
+	"properties": bson.M{
+		"name":         schemaString,
+		"url":          schemaString,
+		"public_id":    schemaString,
+		"content_type": bson.M{"enum": bson.A{"application/pdf"}},
+		"size":         schemaNonNegNum,
+		"uploaded_at":  schemaDate,
+	},
+}}
+
+// schemaTransit is Property.Transit
+var schemaTransit = bson.M{"bsonType": "array", "items": bson.M{
+	"bsonType": "object",
+	"required": bson.A{"station", "distance_m"},
+	"properties": bson.M{
+		"station":    bson.M{"bsonType": "string", "minLength": 1},
+		"line":       schemaString,
+		"distance_m": schemaNonNegNum,
+	},
+}}
+
+// schemaInquirySource is Inquiry.Source, closed so it only ever holds the attribution fields
+var schemaInquirySource = bson.M{
+	"bsonType":             "object",
+	"additionalProperties": false,
+	"properties": bson.M{
+		"utm_source":   schemaString,
+		"utm_medium":   schemaString,
+		"utm_campaign": schemaString,
+		"referrer":     schemaString,
+		"landing_page": schemaString,
+	},
+}
+
+func schemaEnum(values []string) bson.M {
+	return bson.M{"bsonType": "string", "enum": values}
+}
+
+// collectionSchemas mirror the Go structs. Only what the API itself guarantees is required, and
+// extra fields are allowed, so older documents and additive changes keep working.
+var collectionSchemas = map[string]bson.M{
+	"properties": {
+		"bsonType": "object",
+		"required": bson.A{"title", "created_at"},
+		"properties": bson.M{
+			"title":          bson.M{"bsonType": "string", "minLength": 1},
+			"developer":      schemaString,
+			"developer_id":   schemaString,
+			"description":    schemaString,
+			"coordinates":    bson.M{"bsonType": "array", "minItems": 2, "maxItems": 2, "items": bson.M{"bsonType": "number"}},
+			"location":       bson.M{"bsonType": bson.A{"object", "null"}},
+			"min_price":      schemaNonNegNum,
+			"max_price":      schemaNonNegNum,
+			"transit":        schemaTransit,
+			"facilities":     schemaStrings,
+			"images":         schemaImages,
+			"videos":         schemaVideos,
+			"floor_plans":    schemaFloorPlans,
+			"documents":      schemaDocuments,
+			"built":          bson.M{"bsonType": "number"},
+			"total_units":    schemaNonNegNum,
+			"total_floors":   schemaNonNegNum,
+			"year_completed": bson.M{"bsonType": "number"},
+			"created_at":     schemaDate,
+			"updated_at":     schemaDate,
+			"views":          schemaNonNegNum,
+			"deleted_at":     schemaNullDate,
+
+			"common_fee_per_sqm":   schemaNonNegNum,
+			"sinking_fund_per_sqm": schemaNonNegNum,
+
+			// From the GPS of an uploaded photo, see photoCoordinates
+			"suggested_coordinates": bson.M{"bsonType": "array", "minItems": 2, "maxItems": 2, "items": bson.M{"bsonType": "number"}},
+
+			// Checked together with built by completionProblems
+			"completion_status":   schemaEnum(completionStatuses),
+			"expected_completion": schemaDate,
+		},
+	},
+	"listings": {
+		"bsonType": "object",
+		"required": bson.A{"property_id", "price", "listing_type", "listing_status", "created_at"},
+		"properties": bson.M{
+			"property_id":         schemaString,
+			"description":         schemaString,
+			"price":               schemaNonNegNum,
+			"currency":            schemaEnum(currencies),
+			"size":                schemaNonNegNum,
+			"floor":               bson.M{"bsonType": "number"},
+			"bedroom":             schemaNonNegNum,
+			"bathroom":            schemaNonNegNum,
+			"listing_type":        schemaEnum(listingTypes),
+			"listing_status":      schemaEnum(listingStatuses),
+			"deactivated_at":      schemaDate,
+			"deactivation_reason": schemaString,
+			"expires_at":          schemaDate,
+			"available_from":      schemaDate,
+			"publication_state":   schemaEnum(publicationStates),
+			"published_at":        schemaDate,
+			"facing_direction":    schemaEnum(append([]string{""}, facingDirections...)),
+			"photos":              schemaImages,
+			"videos":              schemaVideos,
+			"floor_plans":         schemaFloorPlans,
+			"tags":                schemaStrings,
+			"featured":            bson.M{"bsonType": "bool"},
+			"verified":            bson.M{"bsonType": "bool"},
+			"verification":        bson.M{"bsonType": "object", "properties": bson.M{"state": schemaEnum(verificationStates)}},
+			"created_at":          schemaDate,
+			"updated_at":          schemaDate,
+			"deleted_at":          schemaNullDate,
+			"deposit_months":      schemaNonNegNum,
+			"advance_months":      schemaNonNegNum,
+			"agent_id":            schemaString,
+		},
+	},
+	"notifications": {
+		"bsonType": "object",
+		"required": bson.A{"user_id", "type", "read", "created_at"},
+		"properties": bson.M{
+			"user_id":    schemaString,
+			"type":       schemaEnum(notificationTypes),
+			"payload":    bson.M{"bsonType": "object"},
+			"read":       bson.M{"bsonType": "bool"},
+			"read_at":    schemaDate,
+			"created_at": schemaDate,
+		},
+	},
+	"saved_searches": {
+		"bsonType": "object",
+		"required": bson.A{"user_id", "name", "filter", "alerts", "unsubscribe_token", "created_at"},
+		"properties": bson.M{
+			"user_id":         schemaString,
+			"name":            bson.M{"bsonType": "string", "minLength": 1},
+			"filter":          bson.M{"bsonType": "object"},
+			"near":            bson.M{"bsonType": "object", "required": bson.A{"coordinates", "radius_m"}},
+			"alerts":          bson.M{"bsonType": "bool"},
+			"last_matched_at": schemaDate,
+			"created_at":      schemaDate,
+			"updated_at":      schemaDate,
+
+			"unsubscribe_token": bson.M{"bsonType": "string", "minLength": 1},
+		},
+	},
+	"devices": {
+		"bsonType": "object",
+		"required": bson.A{"user_id", "token", "platform", "last_seen"},
+		"properties": bson.M{
+			"user_id":    schemaString,
+			"token":      bson.M{"bsonType": "string", "minLength": 1},
+			"platform":   schemaEnum(devicePlatforms),
+			"created_at": schemaDate,
+			"last_seen":  schemaDate,
+		},
+	},
+	"agents": {
+		"bsonType": "object",
+		"required": bson.A{"name", "email", "active", "created_at"},
+		"properties": bson.M{
+			"name":         bson.M{"bsonType": "string", "minLength": 1},
+			"email":        bson.M{"bsonType": "string", "minLength": 3},
+			"phone":        schemaString,
+			"photo":        schemaString,
+			"line_id":      schemaString,
+			"active":       bson.M{"bsonType": "bool"},
+			"availability": bson.M{"bsonType": "object"},
+			"created_at":   schemaDate,
+			"updated_at":   schemaDate,
+			"deleted_at":   schemaNullDate,
+
+			// Set by sendDigests
+			"digest_sent_at": schemaDate,
+		},
+	},
+	"developers": {
+		"bsonType": "object",
+		"required": bson.A{"name", "created_at"},
+		"properties": bson.M{
+			"name":         bson.M{"bsonType": "string", "minLength": 1},
+			"logo":         schemaString,
+			"website":      schemaString,
+			"description":  schemaString,
+			"founded_year": schemaNonNegNum,
+			"created_at":   schemaDate,
+			"updated_at":   schemaDate,
+			"deleted_at":   schemaNullDate,
+		},
+	},
+	"users": {
+		"bsonType": "object",
+		"required": bson.A{"email", "created_at"},
+		"properties": bson.M{
+			"name":       schemaString,
+			"email":      bson.M{"bsonType": "string", "minLength": 3},
+			"phone":      schemaString,
+			"created_at": schemaDate,
+			"deleted_at": schemaNullDate,
+		},
+	},
+	"inquiries": {
+		"bsonType": "object",
+		"required": bson.A{"user_id", "property_id", "created_at"},
+		"properties": bson.M{
+			"user_id":     schemaString,
+			"property_id": schemaString,
+			"message":     schemaString,
+			"created_at":  schemaDate,
+			"listing_id":  schemaString,
+
+			// Set by routeInquiry and POST /inquiries/{id}/assign
+			"assigned_agent_id": schemaString,
+			"assigned_at":       schemaDate,
+			"first_reply_at":    schemaDate,
+
+			// Campaign attribution, see inquiry_sources.go
+			"source": schemaInquirySource,
+		},
+	},
+	"appointments": {
+		"bsonType": "object",
+		"required": bson.A{"user_id", "property_id", "listing_id", "appointment_date", "status"},
+		"properties": bson.M{
+			"user_id":             schemaString,
+			"property_id":         schemaString,
+			"listing_id":          schemaString,
+			"appointment_date":    schemaDate,
+			"status":              schemaEnum(appointmentStatuses),
+			"cancellation_reason": schemaString,
+			"created_at":          schemaDate,
+			"used_link_tokens":    schemaStrings,
+		},
+	},
+}
+
+// Server error codes handled by applyValidators and setupDebugCapture
+const (
+	codeUnauthorized      = 13
+	codeNamespaceNotFound = 26
+	codeNamespaceExists   = 48
+)
+
+// ensureValidators applies the $jsonSchema validators with validationLevel "moderate": inserts and
+// updates of valid documents are checked, while legacy invalid documents can still be read and updated.
+// Like ensureIndexes it never stops the server; a user without collMod privileges only gets a warning.
+func ensureValidators() {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := applyValidators(ctx, nil); err != nil {
+		log.Println("Warning: schema validators not applied:", err)
+	}
+}
+
+// applyValidators is also available as `migrate validators`
+func applyValidators(ctx context.Context, args []string) error {
+	db := client.Database("MVDB")
+	var failed []string
+	for collectionName, schema := range collectionSchemas {
+		validator := bson.M{"$jsonSchema": schema}
+		err := db.RunCommand(ctx, bson.D{
+			{Key: "collMod", Value: collectionName},
+			{Key: "validator", Value: validator},
+			{Key: "validationLevel", Value: "moderate"},
+			{Key: "validationAction", Value: "error"},
+		}).Err()
+
+		var cmdErr mongo.CommandError
+		if errors.As(err, &cmdErr) && cmdErr.Code == codeNamespaceNotFound {
+			err = db.CreateCollection(ctx, collectionName, options.CreateCollection().
+				SetValidator(validator).
+				SetValidationLevel("moderate").
+				SetValidationAction("error"))
+		}
+		if errors.As(err, &cmdErr) && cmdErr.Code == codeUnauthorized {
+			log.Println("Warning: not allowed to set the schema validator on", collectionName, ", skipping")
+			continue
+		}
+		if err != nil {
+			log.Println("Failed to set the schema validator on", collectionName, ":", err)
+			failed = append(failed, collectionName)
+		}
+	}
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		return fmt.Errorf("failed on %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Searches on GET /listings, GET /properties and POST /properties/search/polygon are recorded in
+// search_events, kept 90 days, for GET /admin/analytics/searches. Recording never holds up the response: events go
+// through a buffered channel to one writer that inserts them in batches, and are dropped, and
+// counted on /metrics, when the buffer is full. Only first pages with at least one filter count,
+// and not those with the API key, which are the admin and partner tools rather than visitors.
+const (
+	searchEventTTL     = 90 * 24 * time.Hour
+	searchEventBuffer  = 1024
+	searchEventBatch   = 100
+	searchEventFlush   = 5 * time.Second
+	maxSearchTextRunes = 100
+	maxSearchTerms     = 10
+)
+
+// searchEvent is one recorded search. Combo is the filters in a fixed order, for grouping.
+type searchEvent struct {
+	Source      string    `bson:"source" json:"source"` // listings or properties
+	ListingType string    `bson:"listing_type,omitempty" json:"listing_type,omitempty"`
+	PriceBand   string    `bson:"price_band,omitempty" json:"price_band,omitempty"`
+	Bedrooms    *int      `bson:"bedrooms,omitempty" json:"bedrooms,omitempty"`
+	Area        string    `bson:"area,omitempty" json:"area,omitempty"` // station name, or the centre of a polygon on a 0.01° grid
+	Query       string    `bson:"query,omitempty" json:"query,omitempty"`
+	Terms       []string  `bson:"terms,omitempty" json:"-"`
+	Combo       string    `bson:"combo" json:"combo"`
+	At          time.Time `bson:"at" json:"at"`
+}
+
+// Upper bounds in THB of the price bands, monthly rent and sale price
+var (
+	rentPriceBands = []float64{10_000, 20_000, 40_000, 80_000}
+	salePriceBands = []float64{2_000_000, 5_000_000, 10_000_000, 20_000_000}
+)
+
+var (
+	searchEvents        = make(chan searchEvent, searchEventBuffer)
+	searchEventsDropped = metrics.counter("search_events_dropped_total", "Search events not recorded because the buffer was full.")
+)
+
+var (
+	emailLike  = regexp.MustCompile(`[^\s@]+@[^\s@]+`)
+	phoneLike  = regexp.MustCompile(`\+?\d[\d\s().-]{6,}\d`)
+	priceRange = regexp.MustCompile(`^[1-9]\d*\s?-\s?[1-9]\d*$`)
+)
+
+// scrubSearchText removes what looks like an email address or a phone number from free text, then
+// lowercases it, collapses spaces and cuts it to maxSearchTextRunes. A digit run counts as a phone
+// number from 9 digits, so prices and years are kept, as are price ranges such as 10000-20000:
+// Thai numbers written in two parts start with 0.
+func scrubSearchText(text string) string {
+	text = emailLike.ReplaceAllString(text, " ")
+	text = phoneLike.ReplaceAllStringFunc(text, func(s string) string {
+		digits := 0
+		for _, c := range s {
+			if c >= '0' && c <= '9' {
+				digits++
+			}
+		}
+		if digits >= 9 && !priceRange.MatchString(s) {
+			return " "
+		}
+		return s
+	})
+	text = strings.Join(strings.Fields(strings.ToLower(text)), " ")
+	if runes := []rune(text); len(runes) > maxSearchTextRunes {
+		text = strings.TrimSpace(string(runes[:maxSearchTextRunes]))
+	}
+	return text
+}
+
+// searchTerms splits scrubbed text into its distinct words of two characters or more
+func searchTerms(text string) []string {
+	var terms []string
+	for _, word := range strings.Fields(text) {
+		word = strings.Trim(word, `.,;:!?"'()[]`)
+		if len([]rune(word)) < 2 || isOneOf(word, terms) {
+			continue
+		}
+		terms = append(terms, word)
+		if len(terms) == maxSearchTerms {
+			break
+		}
+	}
+	return terms
+}
+
+// priceBand names the band of a THB price range by its upper end, or its lower end when open
+// above, e.g. "2M-5M" or "80k+". Searches without a listing type or in another currency get no band.
+func priceBand(listingType, currency string, min, max *float64) string {
+	if listingType == "" || (currency != "" && currency != "THB") {
+		return ""
+	}
+	price := max
+	if price == nil {
+		price = min
+	}
+	if price == nil {
+		return ""
+	}
+	bands := salePriceBands
+	if listingType == "rent" {
+		bands = rentPriceBands
+	}
+	lower := 0.0
+	for _, upper := range bands {
+		if *price <= upper {
+			return formatBandPrice(lower) + "-" + formatBandPrice(upper)
+		}
+		lower = upper
+	}
+	return formatBandPrice(lower) + "+"
+}
+
+func formatBandPrice(v float64) string {
+	switch {
+	case v >= 1_000_000:
+		return strconv.FormatFloat(v/1_000_000, 'f', -1, 64) + "M"
+	case v >= 1_000:
+		return strconv.FormatFloat(v/1_000, 'f', -1, 64) + "k"
+	}
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// recordSearch queues a search unless it is a later page, has no filters or comes with the API key
+func recordSearch(r *http.Request, e searchEvent) {
+	if callerKey(r) != nil {
+		return
+	}
+	if raw := r.URL.Query().Get("page"); raw != "" && raw != "1" {
+		return
+	}
+	e.Query = scrubSearchText(e.Query)
+	e.Terms = searchTerms(e.Query)
+	var combo []string
+	for _, part := range []struct{ name, value string }{
+		{"listing_type", e.ListingType},
+		{"price", e.PriceBand},
+		{"bedrooms", optionalInt(e.Bedrooms)},
+		{"area", e.Area},
+		{"q", e.Query},
+	} {
+		if part.value != "" {
+			combo = append(combo, part.name+"="+part.value)
+		}
+	}
+	if len(combo) == 0 {
+		return
+	}
+	e.Combo = strings.Join(combo, " ")
+	e.At = time.Now()
+	select {
+	case searchEvents <- e:
+	default:
+		searchEventsDropped.Inc()
+	}
+}
+
+func optionalInt(n *int) string {
+	if n == nil {
+		return ""
+	}
+	return strconv.Itoa(*n)
+}
+
+// recordSearches records the searches of GET /listings and GET /properties ahead of the response
+// cache, which answers repeated searches before the handlers see them
+func recordSearches(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if route := mux.CurrentRoute(r); route != nil && r.Method == http.MethodGet {
+			switch tmpl, _ := route.GetPathTemplate(); tmpl {
+			case "/listings":
+				recordListingSearch(r)
+			case "/properties":
+				recordPropertySearch(r, "")
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// recordListingSearch records a GET /listings search; invalid filters are left to the handler
+func recordListingSearch(r *http.Request) {
+	q := r.URL.Query()
+	f, err := parseListingFilter(q)
+	if err != nil {
+		return
+	}
+	recordSearch(r, searchEvent{
+		Source:      "listings",
+		ListingType: f.ListingType,
+		PriceBand:   priceBand(f.ListingType, f.DisplayCurrency, f.MinPrice, f.MaxPrice),
+		Bedrooms:    f.Bedroom,
+		Query:       q.Get("q"),
+	})
+}
+
+// recordPropertySearch records a property search; area is the station or polygon searched
+func recordPropertySearch(r *http.Request, area string) {
+	if area == "" {
+		if station, ok := canonicalStation(r.URL.Query().Get("near_station")); ok {
+			area = station
+		}
+	}
+	recordSearch(r, searchEvent{Source: "properties", Area: area})
+}
+
+// polygonArea is the centre of a polygon's outer ring on a 0.01° grid (about 1km), "lat,lng"
+func polygonArea(p geoPolygon) string {
+	if len(p.Coordinates) == 0 || len(p.Coordinates[0]) < 2 {
+		return ""
+	}
+	ring := p.Coordinates[0][:len(p.Coordinates[0])-1] // the last position repeats the first
+	var lng, lat float64
+	for _, pos := range ring {
+		lng += pos[0]
+		lat += pos[1]
+	}
+	n := float64(len(ring))
+	return strconv.FormatFloat(lat/n, 'f', 2, 64) + "," + strconv.FormatFloat(lng/n, 'f', 2, 64)
+}
+
+// startSearchAnalytics runs the writer of search_events. A failed batch is logged and dropped.
+func startSearchAnalytics() {
+	go func() {
+		ticker := time.NewTicker(searchEventFlush)
+		defer ticker.Stop()
+		batch := make([]interface{}, 0, searchEventBatch)
+		flush := func() {
+			if len(batch) == 0 {
+				return
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if _, err := client.Database("MVDB").Collection("search_events").InsertMany(ctx, batch); err != nil {
+				log.Println("Failed to record", len(batch), "search events:", err)
+			}
+			batch = batch[:0]
+		}
+		for {
+			select {
+			case e := <-searchEvents:
+				batch = append(batch, e)
+				if len(batch) == searchEventBatch {
+					flush()
+				}
+			case <-ticker.C:
+				flush()
+			}
+		}
+	}()
+}
+
+type searchCombo struct {
+	Combo       string `bson:"_id" json:"combo"`
+	Count       int    `bson:"count" json:"count"`
+	Source      string `bson:"source" json:"source"`
+	ListingType string `bson:"listing_type,omitempty" json:"listing_type,omitempty"`
+	PriceBand   string `bson:"price_band,omitempty" json:"price_band,omitempty"`
+	Bedrooms    *int   `bson:"bedrooms,omitempty" json:"bedrooms,omitempty"`
+	Area        string `bson:"area,omitempty" json:"area,omitempty"`
+	Query       string `bson:"query,omitempty" json:"query,omitempty"`
+}
+
+type searchTermCount struct {
+	Term  string `bson:"_id" json:"term"`
+	Count int    `bson:"count" json:"count"`
+}
+
+// getSearchAnalytics answers GET /admin/analytics/searches with the most common filter combinations
+// and query terms of the last ?days= (default 7, at most 90), top ?limit= (default 20) of each
+func getSearchAnalytics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	days, limit := 7, 20
+	q := r.URL.Query()
+	if raw := q.Get("days"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > 90 {
+			http.Error(w, "days must be between 1 and 90", http.StatusBadRequest)
+			return
+		}
+		days = n
+	}
+	if raw := q.Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > 100 {
+			http.Error(w, "limit must be between 1 and 100", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	match := bson.M{"$match": bson.M{"at": bson.M{"$gte": time.Now().AddDate(0, 0, -days)}}}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	collection := client.Database("MVDB").Collection("search_events")
+	var facets []struct {
+		Total []struct {
+			N int `bson:"n"`
+		} `bson:"total"`
+		Combos []searchCombo     `bson:"combos"`
+		Terms  []searchTermCount `bson:"terms"`
+	}
+	cur, err := collection.Aggregate(ctx, []bson.M{match, {"$facet": bson.M{
+		"total": []bson.M{{"$count": "n"}},
+		"combos": []bson.M{
+			{"$group": bson.M{
+				"_id":          "$combo",
+				"count":        bson.M{"$sum": 1},
+				"source":       bson.M{"$first": "$source"},
+				"listing_type": bson.M{"$first": "$listing_type"},
+				"price_band":   bson.M{"$first": "$price_band"},
+				"bedrooms":     bson.M{"$first": "$bedrooms"},
+				"area":         bson.M{"$first": "$area"},
+				"query":        bson.M{"$first": "$query"},
+			}},
+			{"$sort": bson.D{{Key: "count", Value: -1}, {Key: "_id", Value: 1}}},
+			{"$limit": limit},
+		},
+		"terms": []bson.M{
+			{"$unwind": "$terms"},
+			{"$group": bson.M{"_id": "$terms", "count": bson.M{"$sum": 1}}},
+			{"$sort": bson.D{{Key: "count", Value: -1}, {Key: "_id", Value: 1}}},
+			{"$limit": limit},
+		},
+	}}})
+	if err != nil {
+		serverError(w, r, "Failed to aggregate search events", err)
+		return
+	}
+	if err := cur.All(ctx, &facets); err != nil {
+		serverError(w, r, "Failed to decode search events", err)
+		return
+	}
+
+	response := struct {
+		Days     int               `json:"days"`
+		Searches int               `json:"searches"`
+		Combos   []searchCombo     `json:"top_filter_combinations"`
+		Terms    []searchTermCount `json:"top_query_terms"`
+	}{Days: days, Combos: []searchCombo{}, Terms: []searchTermCount{}}
+	if len(facets) > 0 {
+		if len(facets[0].Total) > 0 {
+			response.Searches = facets[0].Total[0].N
+		}
+		if facets[0].Combos != nil {
+			response.Combos = facets[0].Combos
+		}
+		if facets[0].Terms != nil {
+			response.Terms = facets[0].Terms
+		}
+	}
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScrubSearchText(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"Condo near BTS Asok", "condo near bts asok"},
+		{"contact me at somchai.k@example.co.th please", "contact me at please"},
+		{"call 081-234-5678 about the pool", "call about the pool"},
+		{"call 0812345678", "call"},
+		{"+66 81 234 5678 line me", "line me"},
+		{"02 123 4567 office", "office"},
+		{"tel: 02-1234567", "tel:"},
+		{"whatsapp 6681-234-5678", "whatsapp"},
+		{"2 bed under 25000 built 2019", "2 bed under 25000 built 2019"},
+		{"sale 8500000 baht", "sale 8500000 baht"},
+		{"rent 10000-20000 near mrt", "rent 10000-20000 near mrt"},
+		{"budget 15,000,000", "budget 15,000,000"},
+		{"  Pool \t  GYM  ", "pool gym"},
+		{"me@x.io 0899999999", ""},
+	}
+	for _, tt := range tests {
+		if got := scrubSearchText(tt.in); got != tt.want {
+			t.Errorf("scrubSearchText(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+	long := strings.Repeat("คอนโด ", 30)
+	if got := []rune(scrubSearchText(long)); len(got) > maxSearchTextRunes || got[len(got)-1] == ' ' {
+		t.Errorf("long text cut to %d runes: %q", len(got), string(got))
+	}
+}
+
+func TestSearchTerms(t *testing.T) {
+	got := searchTerms(`condo, "condo" near a bts (asok)!`)
+	if want := []string{"condo", "near", "bts", "asok"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("terms %q, want %q", got, want)
+	}
+	if got := searchTerms(strings.Repeat("a1 b2 c3 d4 e5 f6 g7 h8 i9 j10 k11 ", 2)); len(got) != maxSearchTerms {
+		t.Errorf("%d terms, want %d", len(got), maxSearchTerms)
+	}
+}
+
+func TestPriceBand(t *testing.T) {
+	tests := []struct {
+		listingType, currency string
+		min, max              *float64
+		want                  string
+	}{
+		{"rent", "", nil, floatPtr(15000), "10k-20k"},
+		{"rent", "THB", nil, floatPtr(20000), "10k-20k"},
+		{"rent", "", floatPtr(5000), nil, "0-10k"},
+		{"rent", "", floatPtr(90000), nil, "80k+"},
+		{"rent", "", floatPtr(5000), floatPtr(30000), "20k-40k"}, // by the upper end
+		{"sale", "", nil, floatPtr(3_000_000), "2M-5M"},
+		{"sale", "", floatPtr(25_000_000), nil, "20M+"},
+		{"sale", "USD", nil, floatPtr(100_000), ""},
+		{"", "", nil, floatPtr(15000), ""},
+		{"rent", "", nil, nil, ""},
+	}
+	for _, tt := range tests {
+		if got := priceBand(tt.listingType, tt.currency, tt.min, tt.max); got != tt.want {
+			t.Errorf("%s %s %v-%v: %q, want %q", tt.listingType, tt.currency, deref(tt.min), deref(tt.max), got, tt.want)
+		}
+	}
+}
+
+func TestPolygonArea(t *testing.T) {
+	square := geoPolygon{Coordinates: [][][2]float64{{{100.55, 13.73}, {100.57, 13.73}, {100.57, 13.75}, {100.55, 13.75}, {100.55, 13.73}}}}
+	if got := polygonArea(square); got != "13.74,100.56" {
+		t.Errorf("area %q", got)
+	}
+	if got := polygonArea(geoPolygon{}); got != "" {
+		t.Errorf("no ring: %q", got)
+	}
+}
+
+// drainSearchEvents empties the queue of the writer, which doesn't run in tests
+func drainSearchEvents() []searchEvent {
+	var queued []searchEvent
+	for {
+		select {
+		case e := <-searchEvents:
+			queued = append(queued, e)
+		default:
+			return queued
+		}
+	}
+}
+
+func TestRecordListingSearch(t *testing.T) {
+	useTestKeys(t)
+	drainSearchEvents()
+	t.Cleanup(func() { drainSearchEvents() })
+	for _, target := range []string{
+		"/listings?listing_type=rent&max_price=18000&bedroom=2&q=Condo+near+BTS+call+081-234-5678",
+		"/listings?listing_type=rent&max_price=18000&bedroom=2&q=condo+near+bts&page=2", // a later page
+		"/listings",                      // no filters
+		"/listings?bedroom=two",          // invalid, the handler answers 400
+		"/listings?q=jane%40example.com", // nothing left once scrubbed
+	} {
+		recordListingSearch(httptest.NewRequest(http.MethodGet, target, nil))
+	}
+	withKey := httptest.NewRequest(http.MethodGet, "/listings?listing_type=sale", nil)
+	withKey.Header.Set("X-API-Key", "test-shared-key")
+	recordListingSearch(withKey)
+
+	queued := drainSearchEvents()
+	if len(queued) != 1 {
+		t.Fatalf("queued %+v, want only the first search", queued)
+	}
+	e := queued[0]
+	if e.Source != "listings" || e.Query != "condo near bts call" || e.Combo != "listing_type=rent price=10k-20k bedrooms=2 q=condo near bts call" ||
+		!reflect.DeepEqual(e.Terms, []string{"condo", "near", "bts", "call"}) || e.At.IsZero() {
+		t.Errorf("event %+v", e)
+	}
+}
+
+// TestRecordSearchNeverBlocks fills the queue: the next search is dropped and counted, not waited on
+func TestRecordSearchNeverBlocks(t *testing.T) {
+	drainSearchEvents()
+	t.Cleanup(func() { drainSearchEvents() })
+	for i := 0; i < searchEventBuffer; i++ {
+		searchEvents <- searchEvent{}
+	}
+	dropped := searchEventsDropped.n.Load()
+	done := make(chan struct{})
+	go func() {
+		recordPropertySearch(httptest.NewRequest(http.MethodGet, "/properties?near_station=asok", nil), "13.74,100.56")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("recording a search waited for the full queue")
+	}
+	if searchEventsDropped.n.Load() != dropped+1 {
+		t.Error("the dropped search wasn't counted")
+	}
+}
+
+func TestSearchAnalyticsValidation(t *testing.T) {
+	for query, want := range map[string]string{
+		"?days=0":    "days must be between 1 and 90",
+		"?days=91":   "days must be between 1 and 90",
+		"?limit=abc": "limit must be between 1 and 100",
+	} {
+		rec := httptest.NewRecorder()
+		getSearchAnalytics(rec, httptest.NewRequest(http.MethodGet, "/admin/analytics/searches"+query, nil))
+		if rec.Code != http.StatusBadRequest || strings.TrimSpace(rec.Body.String()) != want {
+			t.Errorf("%s: %d %q", query, rec.Code, rec.Body)
+		}
+	}
+}
+
+func TestSearchAnalytics(t *testing.T) {
+	useTestMongo(t, "search_events")
+	two := 2
+	now := time.Now()
+	var docs []interface{}
+	add := func(n int, e searchEvent) {
+		for i := 0; i < n; i++ {
+			docs = append(docs, e)
+		}
+	}
+	add(3, searchEvent{Source: "listings", ListingType: "rent", Bedrooms: &two, Query: "condo near bts", Terms: []string{"condo", "near", "bts"},
+		Combo: "listing_type=rent bedrooms=2 q=condo near bts", At: now.Add(-time.Hour)})
+	add(2, searchEvent{Source: "properties", Area: "Asok", Combo: "area=Asok", At: now.AddDate(0, 0, -3)})
+	add(1, searchEvent{Source: "listings", Query: "pet friendly condo", Terms: []string{"pet", "friendly", "condo"}, Combo: "q=pet friendly condo", At: now.AddDate(0, 0, -6)})
+	add(5, searchEvent{Source: "listings", Query: "penthouse", Terms: []string{"penthouse"}, Combo: "q=penthouse", At: now.AddDate(0, 0, -10)})
+	insertDocs(t, "search_events", docs...)
+
+	rec := httptest.NewRecorder()
+	getSearchAnalytics(rec, httptest.NewRequest(http.MethodGet, "/admin/analytics/searches?limit=2", nil))
+	var report struct {
+		Days     int               `json:"days"`
+		Searches int               `json:"searches"`
+		Combos   []searchCombo     `json:"top_filter_combinations"`
+		Terms    []searchTermCount `json:"top_query_terms"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Days != 7 || report.Searches != 6 || len(report.Combos) != 2 || len(report.Terms) != 2 {
+		t.Fatalf("report %+v, want 6 searches of the last 7 days, top 2 of each", report)
+	}
+	if c := report.Combos[0]; c.Combo != "listing_type=rent bedrooms=2 q=condo near bts" || c.Count != 3 || c.Bedrooms == nil || *c.Bedrooms != 2 {
+		t.Errorf("top combination %+v", c)
+	}
+	if c := report.Combos[1]; c.Area != "Asok" || c.Count != 2 {
+		t.Errorf("second combination %+v", c)
+	}
+	if want := []searchTermCount{{"condo", 4}, {"bts", 3}}; !reflect.DeepEqual(report.Terms, want) {
+		t.Errorf("terms %+v, want %+v", report.Terms, want)
+	}
+
+	rec = httptest.NewRecorder()
+	getSearchAnalytics(rec, httptest.NewRequest(http.MethodGet, "/admin/analytics/searches?days=30", nil))
+	if !strings.Contains(rec.Body.String(), `"searches":11`) || !strings.Contains(rec.Body.String(), `{"term":"penthouse","count":5}`) {
+		t.Errorf("30 days: %s", rec.Body)
+	}
+}
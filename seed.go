@@ -0,0 +1,416 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/LynnT-2003/mv-realty-backend/imagemeta"
+)
+
+// seedOptions sizes a generated data set. The same options give the same data, ids included.
+type seedOptions struct {
+	Seed                int64
+	Now                 time.Time // created_at and appointment dates are spread around it
+	Agents              int
+	Users               int
+	Properties          int
+	ListingsPerProperty int
+	Inquiries           int
+	Appointments        int
+}
+
+var defaultSeedOptions = seedOptions{
+	Seed:                1,
+	Agents:              5,
+	Users:               20,
+	Properties:          25,
+	ListingsPerProperty: 3,
+	Inquiries:           40,
+	Appointments:        30,
+}
+
+// seedData is a generated data set; every reference in it points at a document of the same set
+type seedData struct {
+	Agents       []Agent
+	Users        []User
+	Properties   []Property
+	Listings     []Listing
+	Inquiries    []Inquiry
+	Appointments []Appointment
+}
+
+// seedAreas are Bangkok neighbourhoods; generated properties are scattered up to ~1km around them
+var seedAreas = []struct {
+	name   string
+	center [2]float64 // [latitude, longitude]
+}{
+	{"Asoke", [2]float64{13.7370, 100.5603}},
+	{"Thonglor", [2]float64{13.7325, 100.5830}},
+	{"Phrom Phong", [2]float64{13.7305, 100.5697}},
+	{"Ploenchit", [2]float64{13.7430, 100.5487}},
+	{"Silom", [2]float64{13.7262, 100.5300}},
+	{"Sathorn", [2]float64{13.7190, 100.5290}},
+	{"Ari", [2]float64{13.7797, 100.5446}},
+	{"Ratchada", [2]float64{13.7660, 100.5740}},
+	{"Riverside", [2]float64{13.7210, 100.5140}},
+	{"Bang Na", [2]float64{13.6680, 100.6050}},
+}
+
+var (
+	seedBrands      = []string{"Noble", "The Line", "Ashton", "Life", "Rhythm", "Ideo", "Quattro", "Hyde", "Celes", "Park Origin"}
+	seedDevelopers  = []string{"Ananda Development", "AP Thailand", "Sansiri", "Noble Development", "Origin Property", "Supalai", "Land and Houses"}
+	seedFacilities  = []string{"pool", "gym", "sauna", "garden", "co-working space", "kids club", "parking", "rooftop lounge", "library", "shuttle"}
+	seedFirstNames  = []string{"Anong", "Somchai", "Niran", "Ploy", "Kittipong", "Malee", "James", "Emma", "Hiro", "Mei", "Lukas", "Sara"}
+	seedLastNames   = []string{"Srisuk", "Wongsawat", "Chaiyaporn", "Boonmee", "Smith", "Tanaka", "Chen", "Muller", "Jensen", "Rattanakul"}
+	seedMessages    = []string{"Is this unit still available?", "Can I view it this weekend?", "Is the price negotiable?", "Are pets allowed?", "What is the monthly common fee?"}
+	seedContracts   = []string{"6 months", "1 year", "2 years"}
+	seedFurnishings = []string{"fully furnished", "fully-fitted"}
+)
+
+// seedImages are Cloudinary demo assets, so generated data shows pictures without uploads. They
+// have no public_id, which keeps the image delete endpoints away from the demo account.
+var seedImages = []string{
+	"https://res.cloudinary.com/demo/image/upload/sample.jpg",
+	"https://res.cloudinary.com/demo/image/upload/balloons.jpg",
+	"https://res.cloudinary.com/demo/image/upload/horses.jpg",
+	"https://res.cloudinary.com/demo/image/upload/bike.jpg",
+	"https://res.cloudinary.com/demo/image/upload/yellow_tulip.jpg",
+	"https://res.cloudinary.com/demo/image/upload/couple.jpg",
+}
+
+// seedDoc is one generated document and the collection it goes to
+type seedDoc struct {
+	collection string
+	id         primitive.ObjectID
+	doc        interface{}
+}
+
+// seedObjectID is the n-th id of a kind of document. The ids don't depend on the clock, so seeding
+// again replaces the documents instead of adding copies.
+func seedObjectID(kind byte, n int) primitive.ObjectID {
+	var id primitive.ObjectID
+	copy(id[:], []byte{0x5e, 0xed, 0x00, 0x00, 0x5e, 0xed, kind})
+	binary.BigEndian.PutUint32(id[8:], uint32(n))
+	return id
+}
+
+func pick[T any](rng *rand.Rand, values []T) T {
+	return values[rng.Intn(len(values))]
+}
+
+// pickSome returns between min and max distinct values, in the order of values
+func pickSome(rng *rand.Rand, values []string, min, max int) []string {
+	n := min + rng.Intn(max-min+1)
+	chosen := map[int]bool{}
+	for _, i := range rng.Perm(len(values))[:n] {
+		chosen[i] = true
+	}
+	var out []string
+	for i, v := range values {
+		if chosen[i] {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// between is a random time in [from, to)
+func between(rng *rand.Rand, from, to time.Time) time.Time {
+	if !to.After(from) {
+		return from
+	}
+	return from.Add(time.Duration(rng.Int63n(int64(to.Sub(from)))))
+}
+
+func roundTo(v, step float64) float64 {
+	return math.Round(v/step) * step
+}
+
+// generateSeedData builds a data set with the defaults the create handlers set and checks it with
+// the same validators. It doesn't touch the database; writeSeedData stores it.
+func generateSeedData(opts seedOptions) (*seedData, error) {
+	if opts.Agents < 1 || opts.Users < 1 || opts.Properties < 1 || opts.ListingsPerProperty < 1 {
+		return nil, fmt.Errorf("agents, users, properties and listings per property must be at least 1")
+	}
+	now := opts.Now
+	if now.IsZero() {
+		now = time.Now()
+	}
+	rng := rand.New(rand.NewSource(opts.Seed))
+	data := &seedData{}
+
+	for i := 0; i < opts.Agents; i++ {
+		created := now.AddDate(0, 0, -365-rng.Intn(365))
+		data.Agents = append(data.Agents, Agent{
+			ID:        seedObjectID('a', i),
+			Name:      pick(rng, seedFirstNames) + " " + pick(rng, seedLastNames),
+			Email:     fmt.Sprintf("agent%d@example.com", i+1),
+			Phone:     fmt.Sprintf("+668%08d", rng.Intn(100000000)),
+			Active:    true,
+			CreatedAt: created,
+			UpdatedAt: created,
+		})
+	}
+	for i := 0; i < opts.Users; i++ {
+		data.Users = append(data.Users, User{
+			ID:        seedObjectID('u', i),
+			Name:      pick(rng, seedFirstNames) + " " + pick(rng, seedLastNames),
+			Email:     fmt.Sprintf("user%d@example.com", i+1),
+			Phone:     fmt.Sprintf("+668%08d", rng.Intn(100000000)),
+			CreatedAt: now.AddDate(0, 0, -rng.Intn(365)),
+		})
+	}
+
+	titles := map[string]int{}
+	pricePerSqm := map[string]float64{} // by property id, so listings are priced like their building
+	for i := 0; i < opts.Properties; i++ {
+		area := pick(rng, seedAreas)
+		title := pick(rng, seedBrands) + " " + area.name
+		if titles[title]++; titles[title] > 1 {
+			title = fmt.Sprintf("%s %d", title, titles[title])
+		}
+		perSqm := roundTo(80000+rng.Float64()*220000, 1000)
+		created := now.AddDate(0, 0, -30-rng.Intn(300))
+		p := Property{
+			ID:          seedObjectID('p', i),
+			Title:       title,
+			Slug:        slugify(title),
+			Developer:   pick(rng, seedDevelopers),
+			Description: fmt.Sprintf("Condominium in %s, a short walk from shops and transit.", area.name),
+			Coordinates: [2]float64{
+				area.center[0] + (rng.Float64()-0.5)*0.016,
+				area.center[1] + (rng.Float64()-0.5)*0.016,
+			},
+			MinPrice:    int(roundTo(perSqm*28, 10000)),
+			MaxPrice:    int(roundTo(perSqm*140, 10000)),
+			Facilities:  pickSome(rng, seedFacilities, 3, 6),
+			TotalFloors: 8 + rng.Intn(53),
+			TotalUnits:  100 + rng.Intn(1100),
+			CommonFee:   float64(40 + rng.Intn(51)),
+			SinkingFund: float64(400 + 100*rng.Intn(7)),
+			CreatedAt:   created,
+			UpdatedAt:   created,
+			Views:       rng.Intn(5000),
+		}
+		switch roll := rng.Intn(10); {
+		case roll < 7:
+			p.Completion = completionCompleted
+			p.Built = 2005 + rng.Intn(20)
+			p.Completed = p.Built
+		case roll < 9:
+			p.Completion = completionUnderConstruction
+		default:
+			p.Completion = completionOffPlan
+		}
+		if p.Completion != completionCompleted {
+			completes := now.AddDate(0, 6+rng.Intn(30), 0).Truncate(24 * time.Hour)
+			p.CompletesAt = &completes
+		}
+		p.Images = []imagemeta.Image{}
+		for j, url := range pickSome(rng, seedImages, 2, 4) {
+			p.Images = append(p.Images, imagemeta.Image{URL: url, Caption: fmt.Sprintf("%s, photo %d", title, j+1), Alt: title})
+		}
+		p.Location = propertyLocation(p.Coordinates)
+		fillTransit(&p)
+		if problems := validatePropertyFields(&p); len(problems) > 0 {
+			return nil, fmt.Errorf("generated property %s: %w", p.Title, &validationError{Problems: problems})
+		}
+		pricePerSqm[p.ID.Hex()] = perSqm
+		data.Properties = append(data.Properties, p)
+	}
+
+	for _, p := range data.Properties {
+		for j := 0; j < opts.ListingsPerProperty; j++ {
+			bedroom := rng.Intn(4)
+			size := float64(24 + bedroom*25 + rng.Intn(16))
+			l := Listing{
+				ID:              seedObjectID('l', len(data.Listings)),
+				PropertyID:      p.ID.Hex(),
+				AgentID:         pick(rng, data.Agents).ID.Hex(),
+				Floor:           2 + rng.Intn(p.TotalFloors-1),
+				Size:            size,
+				Bedroom:         bedroom,
+				Bathroom:        max(1, bedroom),
+				Furniture:       pick(rng, seedFurnishings),
+				Status:          "ready to move in",
+				FacingDirection: pick(rng, facingDirections),
+				Currency:        defaultCurrency,
+				ListingStatus:   "active",
+				Publication:     publicationPublished,
+				Tags:            normalizeTags(pickSome(rng, listingTagVocabulary, 1, 4)),
+				Featured:        rng.Intn(10) == 0,
+			}
+			if p.CompletesAt != nil {
+				l.Status = fmt.Sprintf("finishing in %d", p.CompletesAt.Year())
+			}
+			if rng.Intn(2) == 0 {
+				l.ListingType = "sale"
+				l.Price = roundTo(size*pricePerSqm[l.PropertyID], 10000)
+				l.MinimumContract = "-"
+			} else {
+				l.ListingType = "rent"
+				l.Price = roundTo(size*pricePerSqm[l.PropertyID]/250, 1000)
+				l.MinimumContract = pick(rng, seedContracts)
+				l.DepositMonths, l.AdvanceMonths = 2, 1
+			}
+			l.Description = fmt.Sprintf("%d bedroom, %.0f sqm on floor %d of %s", bedroom, size, l.Floor, p.Title)
+			l.CreatedAt = between(rng, p.CreatedAt, now)
+			l.UpdatedAt = l.CreatedAt
+			expires := now.Add(listingLifetime) // from now rather than created_at, so the expiry job leaves them active
+			l.ExpiresAt = &expires
+			if rng.Intn(10) == 0 {
+				deactivated := between(rng, l.CreatedAt, now)
+				l.ListingStatus, l.DeactivatedAt = "inactive", &deactivated
+				l.InactiveReason = map[string]string{"sale": "sold", "rent": "rented"}[l.ListingType]
+			}
+			l.Photos = []imagemeta.Image{}
+			for k, url := range pickSome(rng, seedImages, 1, 3) {
+				l.Photos = append(l.Photos, imagemeta.Image{URL: url, Caption: fmt.Sprintf("Unit photo %d", k+1)})
+			}
+			l.Slug = listingSlug(p.Slug, &l)
+			if problems := validateListingFields(&l); len(problems) > 0 {
+				return nil, fmt.Errorf("generated listing %s: %w", l.Slug, &validationError{Problems: problems})
+			}
+			data.Listings = append(data.Listings, l)
+		}
+	}
+
+	for i := 0; i < opts.Inquiries; i++ {
+		l := pick(rng, data.Listings)
+		created := between(rng, l.CreatedAt, now)
+		inquiry := Inquiry{
+			ID:          seedObjectID('i', i),
+			User_id:     pick(rng, data.Users).ID.Hex(),
+			Property_id: l.PropertyID,
+			ListingID:   l.ID.Hex(),
+			Message:     pick(rng, seedMessages),
+			CreatedAt:   created,
+			AgentID:     l.AgentID,
+			AssignedAt:  &created,
+		}
+		if replied := created.Add(time.Duration(1+rng.Intn(48)) * time.Hour); rng.Intn(10) < 6 && replied.Before(now) {
+			inquiry.RepliedAt = &replied
+		}
+		data.Inquiries = append(data.Inquiries, inquiry)
+	}
+
+	var active []Listing
+	for _, l := range data.Listings {
+		if l.ListingStatus == "active" {
+			active = append(active, l)
+		}
+	}
+	if len(active) == 0 {
+		active = data.Listings
+	}
+	// Viewings are on the hour from 9:00 to 17:00 Bangkok time within 30 days of now, at most one
+	// per listing and slot; past ones are completed or cancelled
+	booked := map[string]bool{}
+	for tries := 0; len(data.Appointments) < opts.Appointments && tries < opts.Appointments*10; tries++ {
+		l := pick(rng, active)
+		day := now.In(bangkok).AddDate(0, 0, rng.Intn(60)-30)
+		date := time.Date(day.Year(), day.Month(), day.Day(), 9+rng.Intn(9), 0, 0, 0, bangkok)
+		slot := l.ID.Hex() + date.String()
+		if booked[slot] {
+			continue
+		}
+		booked[slot] = true
+		a := Appointment{
+			ID:              seedObjectID('v', len(data.Appointments)),
+			UserID:          pick(rng, data.Users).ID.Hex(),
+			PropertyID:      l.PropertyID,
+			ListingID:       l.ID.Hex(),
+			AppointmentDate: date,
+			Status:          "scheduled",
+			CreatedAt:       date.AddDate(0, 0, -1-rng.Intn(7)),
+		}
+		if date.Before(now) {
+			a.Status = pick(rng, []string{"completed", "completed", "cancelled"})
+		}
+		if a.CreatedAt.After(now) {
+			a.CreatedAt = now
+		}
+		data.Appointments = append(data.Appointments, a)
+	}
+	return data, nil
+}
+
+// writeSeedData upserts a data set by id, referenced documents first, and leaves every other
+// document alone. It returns the number of documents written per collection.
+func writeSeedData(ctx context.Context, data *seedData) (map[string]int, error) {
+	var docs []seedDoc
+	for _, a := range data.Agents {
+		docs = append(docs, seedDoc{"agents", a.ID, a})
+	}
+	for _, u := range data.Users {
+		docs = append(docs, seedDoc{"users", u.ID, u})
+	}
+	for _, p := range data.Properties {
+		docs = append(docs, seedDoc{"properties", p.ID, p})
+	}
+	for _, l := range data.Listings {
+		docs = append(docs, seedDoc{"listings", l.ID, l})
+	}
+	for _, i := range data.Inquiries {
+		docs = append(docs, seedDoc{"inquiries", i.ID, i})
+	}
+	for _, a := range data.Appointments {
+		docs = append(docs, seedDoc{"appointments", a.ID, a})
+	}
+
+	db := client.Database("MVDB")
+	counts := map[string]int{}
+	for _, d := range docs {
+		_, err := db.Collection(d.collection).ReplaceOne(ctx, bson.M{"_id": d.id}, d.doc, options.Replace().SetUpsert(true))
+		if err != nil {
+			return counts, fmt.Errorf("%s %s: %w", d.collection, d.id.Hex(), err)
+		}
+		counts[d.collection]++
+	}
+	return counts, nil
+}
+
+// runSeed is `seed [flags]`: it generates a data set (see generateSeedData) and upserts it. Dates
+// are relative to today, so the same flags give the same data on the same day. It refuses to run
+// with ENV=production.
+func runSeed(args []string) error {
+	opts := defaultSeedOptions
+	flags := flag.NewFlagSet("seed", flag.ContinueOnError)
+	flags.Int64Var(&opts.Seed, "seed", opts.Seed, "random seed; the same seed and counts give the same data")
+	flags.IntVar(&opts.Agents, "agents", opts.Agents, "number of agents")
+	flags.IntVar(&opts.Users, "users", opts.Users, "number of users")
+	flags.IntVar(&opts.Properties, "properties", opts.Properties, "number of properties")
+	flags.IntVar(&opts.ListingsPerProperty, "listings-per-property", opts.ListingsPerProperty, "listings of each property")
+	flags.IntVar(&opts.Inquiries, "inquiries", opts.Inquiries, "number of inquiries")
+	flags.IntVar(&opts.Appointments, "appointments", opts.Appointments, "number of appointments")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if os.Getenv("ENV") == "production" {
+		return usageError("seed refuses to run with ENV=production")
+	}
+	opts.Now = time.Now().UTC().Truncate(24 * time.Hour)
+
+	data, err := generateSeedData(opts)
+	if err != nil {
+		return usageError(err.Error())
+	}
+
+	connectMongoDB()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	counts, err := writeSeedData(ctx, data)
+	log.Println("Seeded", counts)
+	return err
+}
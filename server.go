@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const shutdownTimeout = 15 * time.Second // in-flight requests get this long to finish on SIGINT/SIGTERM
+
+// serve runs the API until SIGINT or SIGTERM, then shuts every listener down gracefully.
+//
+//   - AUTOCERT_DOMAINS (comma separated): HTTPS with Let's Encrypt certificates cached in
+//     AUTOCERT_CACHE_DIR (default ./autocert-cache), plus :80 for the challenges and redirects
+//   - TLS_CERT_FILE and TLS_KEY_FILE: HTTPS with the given certificate
+//   - neither: plain HTTP, for deployments behind a TLS-terminating proxy
+//
+// PORT is the API port, 8000 by default and 443 with TLS.
+func serve(handler http.Handler) {
+	domains := os.Getenv("AUTOCERT_DOMAINS")
+	certFile, keyFile := os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE")
+	if (certFile == "") != (keyFile == "") {
+		log.Fatal("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	useTLS := domains != "" || certFile != ""
+
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8000" // Default port to 8000 if PORT environment variable is not set
+		if useTLS {
+			port = "443"
+		}
+	}
+	api := &http.Server{Addr: ":" + port, Handler: handler}
+	api.RegisterOnShutdown(agentSockets.closeAll)
+	servers := []*http.Server{api}
+	errs := make(chan error, 2)
+
+	switch {
+	case domains != "":
+		cacheDir := os.Getenv("AUTOCERT_CACHE_DIR")
+		if cacheDir == "" {
+			cacheDir = "autocert-cache"
+		}
+		var hosts []string
+		for _, d := range strings.Split(domains, ",") {
+			if d = strings.TrimSpace(d); d != "" {
+				hosts = append(hosts, d)
+			}
+		}
+		tlsConfig, challenges := autocertSetup(hosts, cacheDir)
+		api.TLSConfig = tlsConfig
+		redirect := &http.Server{Addr: ":80", Handler: challenges}
+		servers = append(servers, redirect)
+		go func() { errs <- redirect.ListenAndServe() }()
+		go func() { errs <- api.ListenAndServeTLS("", "") }()
+		fmt.Println("Server is running with HTTPS for", strings.Join(hosts, ", "), "on port:", port)
+	case certFile != "":
+		go func() { errs <- api.ListenAndServeTLS(certFile, keyFile) }()
+		fmt.Println("Server is running with HTTPS on port:", port)
+	default:
+		go func() { errs <- api.ListenAndServe() }()
+		fmt.Println("Server is running on port:", port)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	select {
+	case err := <-errs:
+		if !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	case <-ctx.Done():
+		log.Println("Shutting down")
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	for _, srv := range servers {
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			log.Println("Failed to shut down", srv.Addr, "cleanly:", err)
+		}
+	}
+}
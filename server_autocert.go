@@ -0,0 +1,21 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// autocertSetup returns the TLS config serving the Let's Encrypt certificates of domains, cached in
+// cacheDir, and the handler for :80, which answers HTTP-01 challenges and redirects everything else
+// to HTTPS
+func autocertSetup(domains []string, cacheDir string) (*tls.Config, http.Handler) {
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(domains...),
+		Cache:      autocert.DirCache(cacheDir),
+	}
+	// A nil fallback redirects every non-challenge request to https
+	return m.TLSConfig(), m.HTTPHandler(nil)
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Short links are /l/<code> URLs for marketing campaigns. The public URL of the target is resolved
+// when the link is minted, so GET /l/{code} is a single FindOneAndUpdate on the unique code index that
+// both reads the target and counts the click.
+const (
+	shortLinkCodeLength   = 6
+	shortLinkCodeAlphabet = "abcdefghijkmnpqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ23456789" // no 0/O, 1/l/I
+	shortLinkMintAttempts = 5
+)
+
+var shortLinkTargetTypes = []string{"listing", "property"}
+
+// ShortLink is one /l/<code> link. DailyClicks holds the clicks per UTC day, 2006-01-02 keyed.
+type ShortLink struct {
+	ID          primitive.ObjectID `bson:"_id,omitempty" json:"shortlink_id"`
+	Code        string             `bson:"code" json:"code"`
+	TargetType  string             `bson:"target_type" json:"target_type"`
+	TargetID    string             `bson:"target_id" json:"target_id"`
+	TargetURL   string             `bson:"target_url" json:"target_url"`
+	Campaign    string             `bson:"campaign,omitempty" json:"campaign,omitempty"`
+	CreatedBy   string             `bson:"created_by" json:"created_by"`
+	CreatedAt   time.Time          `bson:"created_at" json:"created_at"`
+	ClickCount  int64              `bson:"click_count" json:"click_count"`
+	DailyClicks map[string]int64   `bson:"daily_clicks,omitempty" json:"-"`
+}
+
+func newShortLinkCode() (string, error) {
+	code := make([]byte, shortLinkCodeLength)
+	max := big.NewInt(int64(len(shortLinkCodeAlphabet)))
+	for i := range code {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		code[i] = shortLinkCodeAlphabet[n.Int64()]
+	}
+	return string(code), nil
+}
+
+var errShortLinkTargetNotFound = errors.New("target not found")
+
+// shortLinkTargetURL is the public page of the listing or property on SITE_BASE_URL
+func shortLinkTargetURL(ctx context.Context, targetType string, id primitive.ObjectID) (string, error) {
+	base := siteBaseURL()
+	opts := options.FindOne().SetProjection(bson.M{"slug": 1})
+	var err error
+	if targetType == "listing" {
+		var listing Listing
+		err = client.Database("MVDB").Collection("listings").FindOne(ctx, notDeleted(bson.M{"_id": id}), opts).Decode(&listing)
+		if err == nil {
+			return listingPageURL(base, &listing), nil
+		}
+	} else {
+		var property Property
+		err = client.Database("MVDB").Collection("properties").FindOne(ctx, notDeleted(bson.M{"_id": id}), opts).Decode(&property)
+		if err == nil {
+			if property.Slug != "" {
+				return base + "/properties/" + url.PathEscape(property.Slug), nil
+			}
+			return base + "/properties/" + id.Hex(), nil
+		}
+	}
+	if err == mongo.ErrNoDocuments {
+		return "", errShortLinkTargetNotFound
+	}
+	return "", err
+}
+
+// createShortLink answers POST /admin/shortlinks with {target_type, target_id, campaign}. A code
+// that is already taken fails on the unique index and another one is drawn.
+func createShortLink(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var body struct {
+		TargetType string `json:"target_type"`
+		TargetID   string `json:"target_id"`
+		Campaign   string `json:"campaign"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Failed to parse request body", http.StatusBadRequest)
+		return
+	}
+	var problems []string
+	if !isOneOf(body.TargetType, shortLinkTargetTypes) {
+		problems = append(problems, "target_type must be listing or property")
+	}
+	targetID, err := primitive.ObjectIDFromHex(body.TargetID)
+	if err != nil {
+		problems = append(problems, "target_id must be an ObjectID")
+	}
+	if len(problems) > 0 {
+		http.Error(w, (&validationError{Problems: problems}).Error(), http.StatusBadRequest)
+		return
+	}
+	if siteBaseURL() == "" {
+		http.Error(w, "Short links are not configured, SITE_BASE_URL is not set", http.StatusServiceUnavailable)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	targetURL, err := shortLinkTargetURL(ctx, body.TargetType, targetID)
+	if err == errShortLinkTargetNotFound {
+		http.Error(w, "Target "+body.TargetType+" not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		serverError(w, r, "Failed to retrieve the short link target", err)
+		return
+	}
+
+	meta := auditFromRequest(r)
+	link := ShortLink{
+		TargetType: body.TargetType,
+		TargetID:   targetID.Hex(),
+		TargetURL:  targetURL,
+		Campaign:   body.Campaign,
+		CreatedBy:  meta.Actor,
+		CreatedAt:  time.Now(),
+	}
+	collection := client.Database("MVDB").Collection("shortlinks")
+	for attempt := 1; ; attempt++ {
+		if link.Code, err = newShortLinkCode(); err != nil {
+			serverError(w, r, "Failed to create short link", err)
+			return
+		}
+		result, err := collection.InsertOne(ctx, link)
+		if mongo.IsDuplicateKeyError(err) && attempt < shortLinkMintAttempts {
+			continue
+		}
+		if err != nil {
+			serverError(w, r, "Failed to create short link", err)
+			return
+		}
+		link.ID = result.InsertedID.(primitive.ObjectID)
+		break
+	}
+	auditCreated(meta, "shortlinks", link.ID, link)
+
+	writeCreated(w, "/admin/shortlinks/"+link.Code+"/stats", link,
+		map[string]interface{}{"short_url": publicBaseURL() + "/l/" + link.Code})
+}
+
+// followShortLink answers GET /l/{code} with a 302 to the target. The click is counted in the same
+// update that reads the target, and the answer is not cacheable so every click reaches here.
+func followShortLink(w http.ResponseWriter, r *http.Request) {
+	code := mux.Vars(r)["code"]
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	var link ShortLink
+	err := client.Database("MVDB").Collection("shortlinks").FindOneAndUpdate(ctx, bson.M{"code": code},
+		bson.M{"$inc": bson.M{"click_count": 1, "daily_clicks." + time.Now().UTC().Format("2006-01-02"): 1}},
+		options.FindOneAndUpdate().SetProjection(bson.M{"target_url": 1})).Decode(&link)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Short link not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		serverError(w, r, "Failed to follow short link", err)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, link.TargetURL, http.StatusFound)
+}
+
+// getShortLinkStats answers GET /admin/shortlinks/{code}/stats with the link and its clicks per day,
+// newest first
+func getShortLinkStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	var link ShortLink
+	err := client.Database("MVDB").Collection("shortlinks").FindOne(ctx, bson.M{"code": mux.Vars(r)["code"]}).Decode(&link)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Short link not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		serverError(w, r, "Failed to retrieve short link", err)
+		return
+	}
+	type day struct {
+		Date  string `json:"date"`
+		Count int64  `json:"count"`
+	}
+	days := make([]day, 0, len(link.DailyClicks))
+	for date, count := range link.DailyClicks {
+		days = append(days, day{date, count})
+	}
+	sort.Slice(days, func(i, j int) bool { return days[i].Date > days[j].Date })
+	json.NewEncoder(w).Encode(bson.M{"shortlink": link, "short_url": publicBaseURL() + "/l/" + link.Code, "days": days})
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	maxSimilarListings    = 6
+	similarNearbyMeters   = 2000
+	similarPriceTolerance = 0.2
+)
+
+// Similarity weights, highest first
+const (
+	weightSameLocation = 4.0 // same property or within similarNearbyMeters
+	weightListingType  = 3.0
+	weightPrice        = 2.0
+	weightBedroom      = 1.0
+)
+
+// similarCandidate is a listing together with the coordinates of its property
+type similarCandidate struct {
+	Listing     `bson:",inline"`
+	Coordinates [2]float64 `bson:"_coordinates"`
+}
+
+type similarityScore struct {
+	Total       float64 `json:"total"`
+	Location    float64 `json:"location"`
+	ListingType float64 `json:"listing_type"`
+	Price       float64 `json:"price"`
+	Bedroom     float64 `json:"bedroom"`
+}
+
+type scoredListing struct {
+	Listing Listing         `json:"listing"`
+	Score   similarityScore `json:"score"`
+}
+
+// scoreSimilarity compares a candidate with the target listing
+func scoreSimilarity(target, candidate similarCandidate) similarityScore {
+	var s similarityScore
+	if candidate.PropertyID == target.PropertyID ||
+		(hasCoordinates(target.Coordinates) && hasCoordinates(candidate.Coordinates) &&
+			haversineMeters(target.Coordinates, candidate.Coordinates) <= similarNearbyMeters) {
+		s.Location = weightSameLocation
+	}
+	if candidate.ListingType == target.ListingType {
+		s.ListingType = weightListingType
+	}
+	if target.Price > 0 && math.Abs(candidate.Price-target.Price) <= target.Price*similarPriceTolerance {
+		s.Price = weightPrice
+	}
+	if candidate.Bedroom == target.Bedroom {
+		s.Bedroom = weightBedroom
+	}
+	s.Total = s.Location + s.ListingType + s.Price + s.Bedroom
+	return s
+}
+
+// rankSimilar scores candidates, drops the target and non-matching ones, and returns the best limit.
+// Ties go to the candidate closest in price.
+func rankSimilar(target similarCandidate, candidates []similarCandidate, limit int) []scoredListing {
+	var ranked []scoredListing
+	for _, c := range candidates {
+		if c.ID == target.ID {
+			continue
+		}
+		if score := scoreSimilarity(target, c); score.Total > 0 {
+			ranked = append(ranked, scoredListing{Listing: c.Listing, Score: score})
+		}
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		if ranked[i].Score.Total != ranked[j].Score.Total {
+			return ranked[i].Score.Total > ranked[j].Score.Total
+		}
+		return math.Abs(ranked[i].Listing.Price-target.Price) < math.Abs(ranked[j].Listing.Price-target.Price)
+	})
+	if len(ranked) > limit {
+		ranked = ranked[:limit]
+	}
+	return ranked
+}
+
+// withPropertyCoordinates joins each listing's property coordinates as _coordinates
+var withPropertyCoordinates = []bson.M{
+	{"$lookup": bson.M{
+		"from":     "properties",
+		"let":      bson.M{"pid": bson.M{"$convert": bson.M{"input": "$property_id", "to": "objectId", "onError": nil}}},
+		"pipeline": []bson.M{{"$match": bson.M{"$expr": bson.M{"$eq": bson.A{"$_id", "$$pid"}}}}, {"$project": bson.M{"coordinates": 1}}},
+		"as":       "_property",
+	}},
+	{"$addFields": bson.M{"_coordinates": bson.M{"$ifNull": bson.A{bson.M{"$first": "$_property.coordinates"}, bson.A{0, 0}}}}},
+	{"$project": bson.M{"_property": 0}},
+}
+
+// getSimilarListings returns up to 6 active listings like the given one; ?debug=true includes the scores
+func getSimilarListings(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	id, ok := pathObjectID(w, r, "Listing")
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	collection := client.Database("MVDB").Collection("listings")
+	var targets []similarCandidate
+	cur, err := collection.Aggregate(ctx, append([]bson.M{{"$match": publishedListingsFilter(bson.M{"_id": id})}}, withPropertyCoordinates...))
+	if err == nil {
+		err = cur.All(ctx, &targets)
+	}
+	if err != nil {
+		serverError(w, r, "Failed to retrieve Listing", err)
+		return
+	}
+	if len(targets) == 0 {
+		http.Error(w, "Listing not found", http.StatusNotFound)
+		return
+	}
+	target := targets[0]
+
+	// One pre-filtered candidate query; the ranking itself happens in Go
+	match := activeListingsFilter(bson.M{
+		"_id": bson.M{"$ne": id},
+		"$or": bson.A{
+			bson.M{"property_id": target.PropertyID},
+			bson.M{"listing_type": target.ListingType},
+			bson.M{"bedroom": target.Bedroom},
+			bson.M{"price": bson.M{"$gte": target.Price * (1 - similarPriceTolerance), "$lte": target.Price * (1 + similarPriceTolerance)}},
+		},
+	})
+	pipeline := append([]bson.M{{"$match": match}, {"$limit": 500}}, withPropertyCoordinates...)
+	var candidates []similarCandidate
+	cur, err = collection.Aggregate(ctx, pipeline)
+	if err == nil {
+		err = cur.All(ctx, &candidates)
+	}
+	if err != nil {
+		serverError(w, r, "Failed to retrieve similar Listings", err)
+		return
+	}
+
+	ranked := rankSimilar(target, candidates, maxSimilarListings)
+	if r.URL.Query().Get("debug") == "true" {
+		if ranked == nil {
+			ranked = []scoredListing{}
+		}
+		json.NewEncoder(w).Encode(ranked)
+		return
+	}
+	listings := make([]Listing, len(ranked))
+	for i := range ranked {
+		listings[i] = ranked[i].Listing
+	}
+	if !applyDisplayCurrency(w, r, listings) || !applyUnits(w, r, listings) {
+		return
+	}
+	if loc, ok := priceLocale(w, r); ok {
+		formatListingPrices(listings, loc)
+	}
+	json.NewEncoder(w).Encode(listings)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var (
+	asok      = [2]float64{13.7437, 100.5486}
+	nearAsok  = [2]float64{13.7527, 100.5486} // 1 km north
+	chiangMai = [2]float64{18.7883, 98.9853}
+)
+
+func similarFixture(name, propertyID string, coordinates [2]float64, listingType string, price float64, bedroom int) similarCandidate {
+	return similarCandidate{
+		Listing:     Listing{ID: fixtureID(name), PropertyID: propertyID, ListingType: listingType, Price: price, Bedroom: bedroom},
+		Coordinates: coordinates,
+	}
+}
+
+// fixtureID is a stable ObjectID for a fixture name, so positions can be compared by name
+func fixtureID(name string) primitive.ObjectID {
+	var id primitive.ObjectID
+	copy(id[:], name)
+	return id
+}
+
+func TestScoreSimilarity(t *testing.T) {
+	target := similarFixture("target", "p1", asok, "rent", 20000, 2)
+	tests := []struct {
+		name      string
+		candidate similarCandidate
+		want      similarityScore
+	}{
+		{"everything", similarFixture("a", "p1", asok, "rent", 21000, 2), similarityScore{10, 4, 3, 2, 1}},
+		{"nearby, no coordinates needed for the same property", similarFixture("b", "p1", [2]float64{}, "sale", 5e6, 1), similarityScore{4, 4, 0, 0, 0}},
+		{"within 2 km", similarFixture("c", "p2", nearAsok, "sale", 5e6, 1), similarityScore{4, 4, 0, 0, 0}},
+		{"far", similarFixture("d", "p3", chiangMai, "rent", 20000, 2), similarityScore{6, 0, 3, 2, 1}},
+		{"price at +20%", similarFixture("e", "p3", chiangMai, "sale", 24000, 1), similarityScore{2, 0, 0, 2, 0}},
+		{"price at -20%", similarFixture("f", "p3", chiangMai, "sale", 16000, 1), similarityScore{2, 0, 0, 2, 0}},
+		{"price past +20%", similarFixture("g", "p3", chiangMai, "sale", 24001, 1), similarityScore{}},
+		{"far without coordinates", similarFixture("h", "p3", [2]float64{}, "sale", 1e6, 3), similarityScore{}},
+	}
+	for _, tt := range tests {
+		if got := scoreSimilarity(target, tt.candidate); got != tt.want {
+			t.Errorf("%s: %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+	unpriced := similarFixture("target", "p1", asok, "rent", 0, 2)
+	if got := scoreSimilarity(unpriced, similarFixture("a", "p9", chiangMai, "sale", 0, 1)); got.Price != 0 {
+		t.Errorf("a target without a price matched on price: %+v", got)
+	}
+}
+
+// TestRankSimilar ranks a small set: by total score, ties to the closest price, the target and
+// listings with nothing in common left out, at most limit returned
+func TestRankSimilar(t *testing.T) {
+	target := similarFixture("target", "p1", asok, "rent", 20000, 2)
+	candidates := []similarCandidate{
+		similarFixture("far_cheap", "p3", chiangMai, "rent", 30000, 2), // 3 + 1
+		similarFixture("same_all", "p1", asok, "rent", 21000, 2),       // 10, 1000 off
+		target,
+		similarFixture("unrelated", "p4", chiangMai, "sale", 100000, 3),  // 0
+		similarFixture("near_all", "p2", nearAsok, "rent", 18500, 2),     // 10, 1500 off
+		similarFixture("near_big", "p2", nearAsok, "rent", 30000, 3),     // 4 + 3, 10000 off
+		similarFixture("far_match", "p3", chiangMai, "rent", 20500, 2),   // 3 + 2 + 1
+		similarFixture("same_sale", "p1", asok, "sale", 20000, 2),        // 4 + 2 + 1, 0 off
+		similarFixture("far_one_bed", "p3", chiangMai, "rent", 25000, 1), // 3
+	}
+	names := func(ranked []scoredListing) []string {
+		var out []string
+		for _, s := range ranked {
+			out = append(out, string(bytes.TrimRight(s.Listing.ID[:], "\x00")))
+		}
+		return out
+	}
+
+	ranked := rankSimilar(target, candidates, maxSimilarListings)
+	want := []string{"same_all", "near_all", "same_sale", "near_big", "far_match", "far_cheap"}
+	if got := names(ranked); !reflect.DeepEqual(got, want) {
+		t.Errorf("ranked %v, want %v", got, want)
+	}
+	wantTotals := []float64{10, 10, 7, 7, 6, 4}
+	for i, s := range ranked {
+		if s.Score.Total != wantTotals[i] {
+			t.Errorf("%s scored %v, want %v", names(ranked)[i], s.Score.Total, wantTotals[i])
+		}
+	}
+
+	if got := names(rankSimilar(target, candidates, 20)); len(got) != 7 || got[6] != "far_one_bed" {
+		t.Errorf("without the limit: %v", got)
+	}
+	if got := rankSimilar(target, []similarCandidate{target, candidates[3]}, maxSimilarListings); len(got) != 0 {
+		t.Errorf("only the target and an unrelated listing: %v", names(got))
+	}
+}
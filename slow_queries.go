@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/event"
+)
+
+const (
+	defaultSlowQueryThreshold = 500 * time.Millisecond
+	slowQueryHistory          = 100  // slow commands kept for GET /admin/slow-queries
+	maxLoggedFilterBytes      = 2048 // of the filter kept in dev
+)
+
+// slowQuery is one command that took longer than the threshold
+type slowQuery struct {
+	Command    string    `json:"command"`
+	Collection string    `json:"collection,omitempty"`
+	DurationMs int64     `json:"duration_ms"`
+	RequestID  string    `json:"request_id,omitempty"`
+	Filter     string    `json:"filter,omitempty"` // ENV=dev only, since filters hold user data
+	Failed     bool      `json:"failed,omitempty"`
+	At         time.Time `json:"at"`
+}
+
+// slowQuerySummary groups the kept slow commands by command and collection
+type slowQuerySummary struct {
+	Command    string `json:"command"`
+	Collection string `json:"collection,omitempty"`
+	Count      int    `json:"count"`
+	MaxMs      int64  `json:"max_ms"`
+	AvgMs      int64  `json:"avg_ms"`
+}
+
+// startedCommand is what Started knows that Succeeded and Failed need
+type startedCommand struct {
+	collection string
+	requestID  string
+	filter     string
+}
+
+// slowQueryLog is the command monitor attached in connectMongoDB. Commands are matched to their
+// Started event by the driver's request id; only slow ones are kept, newest overwriting the oldest.
+type slowQueryLog struct {
+	threshold time.Duration
+	dev       bool
+
+	started sync.Map // driver request id -> startedCommand
+
+	mu   sync.Mutex
+	ring [slowQueryHistory]slowQuery
+	next int
+	full bool
+}
+
+var slowQueries = newSlowQueryLog()
+
+// newSlowQueryLog reads SLOW_QUERY_THRESHOLD, a duration such as 250ms
+func newSlowQueryLog() *slowQueryLog {
+	l := &slowQueryLog{threshold: defaultSlowQueryThreshold, dev: os.Getenv("ENV") == "dev"}
+	if raw := os.Getenv("SLOW_QUERY_THRESHOLD"); raw != "" {
+		if d, err := time.ParseDuration(raw); err == nil && d > 0 {
+			l.threshold = d
+		} else {
+			log.Println("Ignoring invalid SLOW_QUERY_THRESHOLD, using", defaultSlowQueryThreshold, ":", raw)
+		}
+	}
+	return l
+}
+
+func (l *slowQueryLog) monitor() *event.CommandMonitor {
+	return &event.CommandMonitor{
+		Started: func(ctx context.Context, e *event.CommandStartedEvent) {
+			c := startedCommand{requestID: requestID(ctx)}
+			c.collection, _ = e.Command.Lookup(e.CommandName).StringValueOK()
+			if l.dev {
+				for _, field := range []string{"filter", "pipeline", "q"} {
+					if v, err := e.Command.LookupErr(field); err == nil {
+						c.filter = v.String()
+						break
+					}
+				}
+				if len(c.filter) > maxLoggedFilterBytes {
+					c.filter = c.filter[:maxLoggedFilterBytes] + "..."
+				}
+			}
+			l.started.Store(e.RequestID, c)
+		},
+		Succeeded: func(_ context.Context, e *event.CommandSucceededEvent) {
+			l.finished(e.CommandFinishedEvent, false)
+		},
+		Failed: func(_ context.Context, e *event.CommandFailedEvent) {
+			l.finished(e.CommandFinishedEvent, true)
+		},
+	}
+}
+
+func (l *slowQueryLog) finished(e event.CommandFinishedEvent, failed bool) {
+	v, ok := l.started.LoadAndDelete(e.RequestID)
+	if !ok || e.Duration < l.threshold {
+		return
+	}
+	c := v.(startedCommand)
+	q := slowQuery{
+		Command:    e.CommandName,
+		Collection: c.collection,
+		DurationMs: e.Duration.Milliseconds(),
+		RequestID:  c.requestID,
+		Filter:     c.filter,
+		Failed:     failed,
+		At:         time.Now(),
+	}
+	log.Printf("Slow query: %s %s took %dms (request %q) %s", q.Command, q.Collection, q.DurationMs, q.RequestID, q.Filter)
+
+	l.mu.Lock()
+	l.ring[l.next] = q
+	l.next = (l.next + 1) % slowQueryHistory
+	l.full = l.full || l.next == 0
+	l.mu.Unlock()
+}
+
+// recent returns the kept slow commands, newest first
+func (l *slowQueryLog) recent() []slowQuery {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := l.next
+	if l.full {
+		n = slowQueryHistory
+	}
+	queries := make([]slowQuery, 0, n)
+	for i := 1; i <= n; i++ {
+		queries = append(queries, l.ring[(l.next-i+slowQueryHistory)%slowQueryHistory])
+	}
+	return queries
+}
+
+// getSlowQueries answers GET /admin/slow-queries with the last slow commands and a summary by
+// command and collection, slowest first
+func getSlowQueries(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	queries := slowQueries.recent()
+	groups := map[[2]string]*slowQuerySummary{}
+	totals := map[[2]string]int64{}
+	for _, q := range queries {
+		key := [2]string{q.Command, q.Collection}
+		s, ok := groups[key]
+		if !ok {
+			s = &slowQuerySummary{Command: q.Command, Collection: q.Collection}
+			groups[key] = s
+		}
+		s.Count++
+		totals[key] += q.DurationMs
+		if q.DurationMs > s.MaxMs {
+			s.MaxMs = q.DurationMs
+		}
+	}
+	summary := []slowQuerySummary{}
+	for key, s := range groups {
+		s.AvgMs = totals[key] / int64(s.Count)
+		summary = append(summary, *s)
+	}
+	sort.Slice(summary, func(i, j int) bool { return summary[i].MaxMs > summary[j].MaxMs })
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"threshold_ms": slowQueries.threshold.Milliseconds(),
+		"summary":      summary,
+		"queries":      queries,
+	})
+}
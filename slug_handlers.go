@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// getProperty returns one property by ObjectID or slug; former slugs keep resolving after a title change
+func getProperty(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	opts := options.FindOne()
+	if !includesPart(r, "documents") {
+		opts.SetProjection(bson.M{"documents": 0})
+	}
+	var property Property
+	err := client.Database("MVDB").Collection("properties").FindOne(ctx, notDeleted(idOrSlugFilter(mux.Vars(r)["idOrSlug"])), opts).Decode(&property)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Property not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		serverError(w, r, "Failed to retrieve Property", err)
+		return
+	}
+	// Admins see how many uploads are still waiting for moderation
+	etagParts := []interface{}{property.ID.Hex(), property.UpdatedAt.UnixNano()}
+	if hasAPIKey(r) {
+		pending, err := pendingImageCount(ctx, property.ID)
+		if err != nil {
+			serverError(w, r, "Failed to count pending images", err)
+			return
+		}
+		property.Pending = &pending
+		etagParts = append(etagParts, pending)
+	}
+	loc, formatted := priceLocale(w, r)
+	if notModified(w, r, strongETag(r, etagParts...)) {
+		return
+	}
+	if formatted {
+		formatPropertyPrices(&property, loc)
+	}
+	json.NewEncoder(w).Encode(property)
+}
+
+// getListing returns one listing by ObjectID or slug
+func getListing(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	// Agents can open their drafts with the API key
+	filter := idOrSlugFilter(mux.Vars(r)["idOrSlug"])
+	if hasAPIKey(r) {
+		filter = notDeleted(filter)
+	} else {
+		filter = publishedListingsFilter(filter)
+	}
+	var listing Listing
+	err := client.Database("MVDB").Collection("listings").FindOne(ctx, filter).Decode(&listing)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Listing not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		serverError(w, r, "Failed to retrieve Listing", err)
+		return
+	}
+	// Buyers of off-plan units care when they can move in
+	listing.Completion, err = listingCompletion(ctx, listing.PropertyID)
+	if err != nil {
+		serverError(w, r, "Failed to retrieve Property", err)
+		return
+	}
+	listing.Agent, err = listingAgent(ctx, listing.AgentID)
+	if err != nil {
+		serverError(w, r, "Failed to retrieve Agent", err)
+		return
+	}
+	list := []Listing{listing}
+	if err := applyFeeEstimates(ctx, list); err != nil {
+		serverError(w, r, "Failed to retrieve Property fees", err)
+		return
+	}
+	if !applyDisplayCurrency(w, r, list) || !applyUnits(w, r, list) {
+		return
+	}
+	if loc, ok := priceLocale(w, r); ok {
+		formatListingPrices(list, loc)
+	}
+	// The agent, completion and fees come from other documents, so the tag is taken from the body
+	body, err := json.Marshal(list[0])
+	if err != nil {
+		serverError(w, r, "Failed to encode Listing", err)
+		return
+	}
+	if notModified(w, r, strongETag(r, string(body))) {
+		return
+	}
+	w.Write(append(body, '\n'))
+}
+
+// propertyUpdate is the body of PUT /properties/{id}; absent fields are left unchanged.
+// Images have their own upload and caption endpoints.
+type propertyUpdate struct {
+	Title       *string        `json:"Title"`
+	Developer   *string        `json:"Developer"`
+	DeveloperID *string        `json:"DeveloperID"` // "" unlinks the developer
+	Description *string        `json:"Description"`
+	Coordinates *[2]float64    `json:"Coordinates"`
+	MinPrice    *int           `json:"MinPrice"`
+	MaxPrice    *int           `json:"MaxPrice"`
+	Facilities  *[]string      `json:"Facilities"`
+	Built       *int           `json:"Built"`
+	TotalUnits  *int           `json:"TotalUnits"`
+	TotalFloors *int           `json:"TotalFloors"`
+	Completed   *int           `json:"YearCompleted"`
+	Transit     *[]TransitStop `json:"Transit"`
+	CommonFee   *float64       `json:"CommonFeePerSqm"`
+	SinkingFund *float64       `json:"SinkingFundPerSqm"`
+	Completion  *string        `json:"CompletionStatus"`
+	CompletesAt *time.Time     `json:"ExpectedCompletion"`
+}
+
+// apply copies the given fields onto property and returns them as a $set document
+func (u propertyUpdate) apply(property *Property) bson.M {
+	set := bson.M{}
+	if u.Title != nil {
+		property.Title = *u.Title
+		set["title"] = *u.Title
+	}
+	if u.Developer != nil {
+		property.Developer = *u.Developer
+		set["developer"] = *u.Developer
+	}
+	if u.DeveloperID != nil {
+		property.DeveloperID = *u.DeveloperID
+		set["developer_id"] = *u.DeveloperID
+	}
+	if u.Description != nil {
+		property.Description = *u.Description
+		set["description"] = *u.Description
+	}
+	if u.Coordinates != nil {
+		property.Coordinates = *u.Coordinates
+		set["coordinates"] = *u.Coordinates
+		property.Location = propertyLocation(property.Coordinates)
+		set["location"] = property.Location
+	}
+	if u.MinPrice != nil {
+		property.MinPrice = *u.MinPrice
+		set["min_price"] = *u.MinPrice
+	}
+	if u.MaxPrice != nil {
+		property.MaxPrice = *u.MaxPrice
+		set["max_price"] = *u.MaxPrice
+	}
+	if u.Facilities != nil {
+		property.Facilities = *u.Facilities
+		set["facilities"] = *u.Facilities
+	}
+	if u.Built != nil {
+		property.Built = *u.Built
+		set["built"] = *u.Built
+	}
+	if u.TotalUnits != nil {
+		property.TotalUnits = *u.TotalUnits
+		set["total_units"] = *u.TotalUnits
+	}
+	if u.TotalFloors != nil {
+		property.TotalFloors = *u.TotalFloors
+		set["total_floors"] = *u.TotalFloors
+	}
+	if u.Completed != nil {
+		property.Completed = *u.Completed
+		set["year_completed"] = *u.Completed
+	}
+	if u.CommonFee != nil {
+		property.CommonFee = *u.CommonFee
+		set["common_fee_per_sqm"] = *u.CommonFee
+	}
+	if u.SinkingFund != nil {
+		property.SinkingFund = *u.SinkingFund
+		set["sinking_fund_per_sqm"] = *u.SinkingFund
+	}
+	if u.Completion != nil {
+		property.Completion = *u.Completion
+		set["completion_status"] = *u.Completion
+	}
+	if u.CompletesAt != nil {
+		property.CompletesAt = u.CompletesAt
+		set["expected_completion"] = *u.CompletesAt
+	}
+	// New coordinates without new transit replace the stations with the ones near the new location
+	if u.Transit != nil || u.Coordinates != nil {
+		property.Transit = nil
+		if u.Transit != nil {
+			property.Transit = *u.Transit
+		}
+		fillTransit(property)
+		set["transit"] = property.Transit
+	}
+	return set
+}
+
+// updateProperty applies a partial update. A new Title gets a new slug and the old one moves to
+// slug_history, so links already shared keep working. Listing slugs are left as they were.
+func updateProperty(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	id, ok := pathObjectID(w, r, "Property")
+	if !ok {
+		return
+	}
+	var body propertyUpdate
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Failed to parse request body", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	collection := client.Database("MVDB").Collection("properties")
+	var property Property
+	err := collection.FindOne(ctx, notDeleted(bson.M{"_id": id})).Decode(&property)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Property not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		serverError(w, r, "Failed to retrieve Property", err)
+		return
+	}
+
+	before := property
+	set := body.apply(&property)
+	problems := validatePropertyFields(&property)
+	// A linked property keeps its developer's name, whichever of the two was changed
+	if body.DeveloperID != nil || body.Developer != nil {
+		linkProblems, err := linkDeveloper(ctx, &property)
+		if err != nil {
+			serverError(w, r, "Failed to check the Property's developer", err)
+			return
+		}
+		problems = append(problems, linkProblems...)
+		if property.DeveloperID != "" {
+			set["developer"] = property.Developer
+		}
+	}
+	if len(problems) > 0 {
+		http.Error(w, (&validationError{Problems: problems}).Error(), http.StatusBadRequest)
+		return
+	}
+	if len(set) == 0 {
+		json.NewEncoder(w).Encode(property)
+		return
+	}
+	if body.TotalFloors != nil && property.TotalFloors > 0 {
+		top, err := maxListingFloor(ctx, id.Hex())
+		if err != nil {
+			serverError(w, r, "Failed to check Listing floors", err)
+			return
+		}
+		if top > property.TotalFloors {
+			http.Error(w, fmt.Sprintf("TotalFloors must be at least %d, the highest floor of this Property's Listings", top), http.StatusBadRequest)
+			return
+		}
+	}
+
+	now := time.Now()
+	set["updated_at"] = now
+	update := bson.M{"$set": set}
+	// Only a title that slugifies differently needs a new slug
+	if slugify(property.Title) != slugify(before.Title) {
+		slug, err := propertySlug(ctx, property.Title, nil)
+		if err != nil {
+			serverError(w, r, "Failed to generate Property slug", err)
+			return
+		}
+		// Changing back to an earlier title reclaims that title's slug rather than getting a -2
+		for _, old := range before.SlugHistory {
+			if old == slugify(property.Title) {
+				slug = old
+			}
+		}
+		set["slug"] = slug
+		property.Slug = slug
+		if before.Slug != "" {
+			update["$addToSet"] = bson.M{"slug_history": before.Slug}
+			property.SlugHistory = append(property.SlugHistory, before.Slug)
+		}
+	}
+	_, err = collection.UpdateOne(ctx, notDeleted(bson.M{"_id": id}), update)
+	if mongo.IsDuplicateKeyError(err) {
+		http.Error(w, "The new slug was taken concurrently, retry the update", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		serverError(w, r, "Failed to update Property", err)
+		return
+	}
+	property.UpdatedAt = now
+
+	recordAudit(auditFromRequest(r), "update", "properties", id.Hex(), before, property, nil)
+	json.NewEncoder(w).Encode(property)
+}
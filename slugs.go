@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/text/unicode/norm"
+)
+
+const maxSlugLength = 80
+
+// latinFolds covers the Latin letters that don't decompose into a base letter plus accent
+var latinFolds = map[rune]string{
+	'ß': "ss", 'æ': "ae", 'œ': "oe", 'ø': "o", 'đ': "d", 'ð': "d", 'ł': "l", 'þ': "th", 'ı': "i",
+}
+
+// slugify turns a title into a URL slug: lowercase, accents removed, anything else becomes a hyphen.
+// Thai has no reliable automatic romanization, so Thai letters and their vowel and tone marks are kept
+// as they are (they're valid in URLs once percent-encoded).
+func slugify(title string) string {
+	var b strings.Builder
+	hyphen := false
+	for _, r := range norm.NFD.String(strings.ToLower(title)) {
+		switch {
+		case unicode.Is(unicode.Thai, r):
+			b.WriteRune(r)
+		case unicode.Is(unicode.Mn, r):
+			continue // an accent NFD split off a Latin letter
+		case latinFolds[r] != "":
+			b.WriteString(latinFolds[r])
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			b.WriteRune(r)
+		default:
+			if !hyphen {
+				b.WriteRune('-')
+			}
+			hyphen = true
+			continue
+		}
+		hyphen = false
+	}
+	slug := strings.Trim(b.String(), "-")
+	if runes := []rune(slug); len(runes) > maxSlugLength {
+		slug = strings.TrimRight(string(runes[:maxSlugLength]), "-")
+	}
+	return norm.NFC.String(slug)
+}
+
+// uniqueSlug returns base, or base-2, base-3, ... when base is taken in the collection (as a current or
+// former slug) or in reserved, which holds slugs handed out earlier in the same batch
+func uniqueSlug(ctx context.Context, collectionName, base string, reserved map[string]bool) (string, error) {
+	pattern := primitive.Regex{Pattern: "^" + regexp.QuoteMeta(base) + "(-[0-9]+)?$"}
+	cur, err := client.Database("MVDB").Collection(collectionName).Find(ctx,
+		bson.M{"$or": bson.A{bson.M{"slug": pattern}, bson.M{"slug_history": pattern}}},
+		options.Find().SetProjection(bson.M{"slug": 1, "slug_history": 1}))
+	if err != nil {
+		return "", err
+	}
+	var docs []struct {
+		Slug        string   `bson:"slug"`
+		SlugHistory []string `bson:"slug_history"`
+	}
+	if err := cur.All(ctx, &docs); err != nil {
+		return "", err
+	}
+	taken := map[string]bool{}
+	for s := range reserved {
+		taken[s] = true
+	}
+	for _, d := range docs {
+		taken[d.Slug] = true
+		for _, s := range d.SlugHistory {
+			taken[s] = true
+		}
+	}
+	slug := base
+	for n := 2; taken[slug]; n++ {
+		slug = fmt.Sprintf("%s-%d", base, n)
+	}
+	return slug, nil
+}
+
+// propertySlug generates a free slug for a new property title
+func propertySlug(ctx context.Context, title string, reserved map[string]bool) (string, error) {
+	base := slugify(title)
+	if base == "" {
+		base = "property"
+	}
+	return uniqueSlug(ctx, "properties", base, reserved)
+}
+
+// listingSlug is the property's slug plus the unit and the end of the listing id,
+// e.g. noble-ploenchit-2br-rent-4f1c2a, which is unique without a lookup. listing.ID must be set.
+func listingSlug(propertySlug string, listing *Listing) string {
+	hex := listing.ID.Hex()
+	return slugify(fmt.Sprintf("%s %dbr %s %s", propertySlug, listing.Bedroom, listing.ListingType, hex[len(hex)-6:]))
+}
+
+// propertySlugsByID returns the slug of each property, falling back to its slugified title for
+// properties created before slugs existed
+func propertySlugsByID(ctx context.Context, hexIDs []string) (map[string]string, error) {
+	var ids []primitive.ObjectID
+	for _, h := range hexIDs {
+		if id, err := primitive.ObjectIDFromHex(h); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	properties, err := findAllWith[Property](ctx, "properties", bson.M{"_id": bson.M{"$in": ids}},
+		options.Find().SetProjection(bson.M{"slug": 1, "title": 1}))
+	if err != nil {
+		return nil, err
+	}
+	slugs := make(map[string]string, len(properties))
+	for _, p := range properties {
+		slugs[p.ID.Hex()] = p.Slug
+		if p.Slug == "" {
+			slugs[p.ID.Hex()] = slugify(p.Title)
+		}
+	}
+	return slugs, nil
+}
+
+// idOrSlugFilter matches a document by ObjectID, or else by its current or a former slug
+func idOrSlugFilter(key string) bson.M {
+	if id, err := primitive.ObjectIDFromHex(key); err == nil {
+		return bson.M{"_id": id}
+	}
+	return bson.M{"$or": bson.A{bson.M{"slug": key}, bson.M{"slug_history": key}}}
+}
+
+// backfillSlugs is `migrate slugs`: it gives properties, then listings, created before slugs existed
+// their slug. Properties are done first so listing slugs can build on them.
+func backfillSlugs(ctx context.Context, args []string) error {
+	db := client.Database("MVDB")
+	missing := bson.M{"slug": bson.M{"$exists": false}}
+
+	properties, err := findAll[Property](ctx, "properties", missing)
+	if err != nil {
+		return fmt.Errorf("properties: %w", err)
+	}
+	reserved := map[string]bool{}
+	for _, p := range properties {
+		slug, err := propertySlug(ctx, p.Title, reserved)
+		if err != nil {
+			return fmt.Errorf("properties: %w", err)
+		}
+		reserved[slug] = true
+		if _, err := db.Collection("properties").UpdateOne(ctx, bson.M{"_id": p.ID, "slug": bson.M{"$exists": false}}, bson.M{"$set": bson.M{"slug": slug}}); err != nil {
+			return fmt.Errorf("properties %s: %w", p.ID.Hex(), err)
+		}
+	}
+	log.Printf("properties: %d slugs generated", len(properties))
+
+	listings, err := findAll[Listing](ctx, "listings", missing)
+	if err != nil {
+		return fmt.Errorf("listings: %w", err)
+	}
+	propertyIDs := make([]string, len(listings))
+	for i := range listings {
+		propertyIDs[i] = listings[i].PropertyID
+	}
+	slugs, err := propertySlugsByID(ctx, propertyIDs)
+	if err != nil {
+		return fmt.Errorf("listings: %w", err)
+	}
+	for i := range listings {
+		slug := listingSlug(slugs[listings[i].PropertyID], &listings[i])
+		if _, err := db.Collection("listings").UpdateOne(ctx, bson.M{"_id": listings[i].ID, "slug": bson.M{"$exists": false}}, bson.M{"$set": bson.M{"slug": slug}}); err != nil {
+			return fmt.Errorf("listings %s: %w", listings[i].ID.Hex(), err)
+		}
+	}
+	log.Printf("listings: %d slugs generated", len(listings))
+	return nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestSlugify(t *testing.T) {
+	tests := []struct {
+		title, want string
+	}{
+		{"Noble Ploenchit", "noble-ploenchit"},
+		{"  The Line -- Sukhumvit 101! ", "the-line-sukhumvit-101"},
+		{"Café Résidence", "cafe-residence"},
+		{"Crème Brûlée Tower", "creme-brulee-tower"},
+		{"Ñandú Señorío", "nandu-senorio"},
+		{"Straße Œuvre Ærø Łódź", "strasse-oeuvre-aero-lodz"},
+		{"ไอดีโอ คิว สยาม", "ไอดีโอ-คิว-สยาม"},
+		{"โนเบิล เพลินจิต (Noble Ploenchit)", "โนเบิล-เพลินจิต-noble-ploenchit"},
+		{"ศุภาลัย ปาร์ค แยกติวานนท์ 2", "ศุภาลัย-ปาร์ค-แยกติวานนท์-2"},
+		{"!!!", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := slugify(tt.title); got != tt.want {
+			t.Errorf("slugify(%q) = %q, want %q", tt.title, got, tt.want)
+		}
+	}
+
+	long := slugify(strings.Repeat("ab ", 40))
+	if len([]rune(long)) > maxSlugLength || strings.HasSuffix(long, "-") {
+		t.Errorf("long title: %q", long)
+	}
+}
+
+func TestListingSlug(t *testing.T) {
+	id, _ := primitive.ObjectIDFromHex("65a1b2c3d4e5f60718293a4b")
+	for _, tt := range []struct {
+		propertySlug string
+		listing      Listing
+		want         string
+	}{
+		{"noble-ploenchit", Listing{ID: id, Bedroom: 2, ListingType: "rent"}, "noble-ploenchit-2br-rent-293a4b"},
+		{"ไอดีโอ-คิว-สยาม", Listing{ID: id, Bedroom: 1, ListingType: "sale"}, "ไอดีโอ-คิว-สยาม-1br-sale-293a4b"},
+		{"cafe-residence", Listing{ID: id, ListingType: "rent"}, "cafe-residence-0br-rent-293a4b"},
+	} {
+		if got := listingSlug(tt.propertySlug, &tt.listing); got != tt.want {
+			t.Errorf("listingSlug(%q) = %q, want %q", tt.propertySlug, got, tt.want)
+		}
+	}
+}
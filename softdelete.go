@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// softDeletable lists the collections with a deleted_at field and the name of their updated-at field, if any
+var softDeletable = map[string]string{
+	"properties": "updated_at",
+	"listings":   "updated_at",
+	"users":      "",
+	"developers": "updated_at",
+}
+
+// notDeleted is the shared base filter: soft-deleted documents are hidden from every read.
+// {deleted_at: null} also matches documents written before the field existed.
+func notDeleted(filter bson.M) bson.M {
+	filter["deleted_at"] = nil
+	return filter
+}
+
+// applyDeletedFilter adds the notDeleted rule unless an admin asked for ?include_deleted=true.
+// It answers 401 and returns false when a caller without the API key asks for deleted documents.
+func applyDeletedFilter(w http.ResponseWriter, r *http.Request, filter bson.M) bool {
+	if r.URL.Query().Get("include_deleted") != "true" {
+		notDeleted(filter)
+		return true
+	}
+	if !hasAPIKey(r) {
+		http.Error(w, "include_deleted requires an API key", http.StatusUnauthorized)
+		return false
+	}
+	delete(filter, "deleted_at")
+	return true
+}
+
+var includeDeletedParam = apiParam{Name: "include_deleted", Description: "true also returns soft-deleted documents (requires the API key)"}
+
+// softDelete stamps deleted_at (and the updated-at field, so sync clients see the change)
+func softDelete(ctx context.Context, collectionName string, filter bson.M, at time.Time) (*mongo.UpdateResult, error) {
+	set := bson.M{"deleted_at": at}
+	if field := softDeletable[collectionName]; field != "" {
+		set[field] = at
+	}
+	return client.Database("MVDB").Collection(collectionName).UpdateMany(ctx, notDeleted(filter), bson.M{"$set": set})
+}
+
+func restoreProperty(w http.ResponseWriter, r *http.Request) {
+	restoreSoftDeleted(w, r, "properties", "Property")
+}
+
+func restoreListing(w http.ResponseWriter, r *http.Request) {
+	restoreSoftDeleted(w, r, "listings", "Listing")
+}
+
+func restoreUser(w http.ResponseWriter, r *http.Request) {
+	restoreSoftDeleted(w, r, "users", "User")
+}
+
+// restoreSoftDeleted clears deleted_at and drops the sync tombstone. Restoring a property also restores
+// the listings removed together with it, recognised by the identical deleted_at timestamp.
+// Appointments cancelled by the delete stay cancelled.
+func restoreSoftDeleted(w http.ResponseWriter, r *http.Request, collectionName, entity string) {
+	w.Header().Set("Content-Type", "application/json")
+
+	id, ok := pathObjectID(w, r, entity)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	db := client.Database("MVDB")
+	var doc struct {
+		DeletedAt *time.Time `bson:"deleted_at"`
+	}
+	err := db.Collection(collectionName).FindOne(ctx, bson.M{"_id": id, "deleted_at": bson.M{"$ne": nil}}).Decode(&doc)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Deleted "+entity+" not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to retrieve "+entity, http.StatusInternalServerError)
+		return
+	}
+
+	before := auditSnapshot(ctx, collectionName, id)
+	now := time.Now()
+	restore := bson.M{"$unset": bson.M{"deleted_at": ""}}
+	if field := softDeletable[collectionName]; field != "" {
+		restore["$set"] = bson.M{field: now}
+	}
+	_, err = db.Collection(collectionName).UpdateByID(ctx, id, restore)
+	if mongo.IsDuplicateKeyError(err) {
+		// a user whose email signed up again while it was deleted
+		http.Error(w, "A live "+entity+" already uses this email", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to restore "+entity, http.StatusInternalServerError)
+		return
+	}
+	restored := []string{id.Hex()}
+
+	if collectionName == "properties" {
+		listingIDs, err := findIDs(ctx, "listings", bson.M{"property_id": id.Hex(), "deleted_at": doc.DeletedAt})
+		if err == nil && len(listingIDs) > 0 {
+			_, err = db.Collection("listings").UpdateMany(ctx, bson.M{"_id": bson.M{"$in": listingIDs}},
+				bson.M{"$unset": bson.M{"deleted_at": ""}, "$set": bson.M{"updated_at": now}})
+		}
+		if err != nil {
+			serverError(w, r, "Property restored but its listings could not be", err)
+			return
+		}
+		for _, lid := range listingIDs {
+			restored = append(restored, lid.Hex())
+		}
+	}
+
+	// Without this the next sync would report the document as both changed and deleted
+	db.Collection("deletions").DeleteMany(ctx, bson.M{"document_id": bson.M{"$in": restored}})
+
+	recordAudit(auditFromRequest(r), "restore", collectionName, id.Hex(), before, auditSnapshot(ctx, collectionName, id), bson.M{"restored": restored})
+	json.NewEncoder(w).Encode(bson.M{"message": entity + " restored successfully", "restored": restored})
+}
+
+// purgeDeleted permanently removes documents soft-deleted more than ?days= (default 30) ago
+func purgeDeleted(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	days := 30
+	if raw := r.URL.Query().Get("days"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			http.Error(w, "days must be a non-negative whole number", http.StatusBadRequest)
+			return
+		}
+		days = n
+	}
+	cutoff := time.Now().AddDate(0, 0, -days)
+
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+
+	purged := map[string]int64{}
+	for collectionName := range softDeletable {
+		res, err := client.Database("MVDB").Collection(collectionName).DeleteMany(ctx, bson.M{"deleted_at": bson.M{"$lt": cutoff}})
+		if err != nil {
+			http.Error(w, "Failed to purge "+collectionName, http.StatusInternalServerError)
+			return
+		}
+		purged[collectionName] = res.DeletedCount
+	}
+	recordAudit(auditFromRequest(r), "purge", "", "", nil, nil, bson.M{"cutoff": cutoff, "purged": purged})
+	json.NewEncoder(w).Encode(bson.M{"cutoff": cutoff.UTC(), "purged": purged})
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// The server listens before MongoDB is reached, so a database outage at startup leaves the process
+// up and retrying instead of crash looping. Until the connection, the indexes and the rest of the
+// setup are done, startupHandler answers GET /healthz with 200 and everything else with a JSON 503
+// with the starting code; then it swaps the full router in.
+const (
+	startupRetryAfter  = 5 // seconds, the Retry-After of the 503s while starting
+	mongoRetryFirst    = time.Second
+	mongoRetryMax      = 30 * time.Second
+	startingCode       = "starting"
+	uploadsUnavailable = "uploads_unavailable"
+)
+
+// retryMongoDB makes connectMongoDB wait out an unreachable MongoDB rather than exit. Only the
+// server sets it; commands like migrate and export still fail right away.
+var retryMongoDB bool
+
+// startupHandler serves the router once finish was called, and the startup answers until then
+type startupHandler struct {
+	router atomic.Pointer[http.Handler]
+}
+
+func (s *startupHandler) finish(router http.Handler) {
+	s.router.Store(&router)
+	log.Println("Startup done, serving every route")
+}
+
+func (s *startupHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if router := s.router.Load(); router != nil {
+		(*router).ServeHTTP(w, r)
+		return
+	}
+	if r.URL.Path == "/healthz" && r.Method == http.MethodGet {
+		healthz(w, r)
+		return
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(startupRetryAfter))
+	jsonError(w, http.StatusServiceUnavailable, startingCode, "the server is starting, retry in "+strconv.Itoa(startupRetryAfter)+" seconds")
+}
+
+// healthz answers GET /healthz, the liveness probe: 200 as long as the process serves requests,
+// whether or not it is done starting
+func healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write([]byte("ok\n"))
+}
+
+// awaitMongoDB pings MongoDB until it answers, waiting mongoRetryFirst after err and doubling the
+// wait up to mongoRetryMax
+func awaitMongoDB(err error) {
+	wait := mongoRetryFirst
+	for err != nil {
+		log.Printf("MongoDB is unreachable, retrying in %s: %v", wait, err)
+		time.Sleep(wait)
+		wait = min(2*wait, mongoRetryMax)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err = client.Ping(ctx, nil)
+		cancel()
+	}
+}
+
+// uploadsDisabled is why the upload routes answer 503, a Cloudinary configuration newCloudinary
+// refused at startup; nil when uploads work
+var uploadsDisabled error
+
+// setupUploads checks the CLOUDINARY_ settings. A misconfigured Cloudinary only disables the
+// upload routes, the rest of the API is served as usual. newCloudinary accepts empty settings, so
+// the missing ones are checked here.
+func setupUploads() {
+	var missing []string
+	for _, name := range []string{"CLOUDINARY_CLOUD_NAME", "CLOUDINARY_API_KEY", "CLOUDINARY_API_SECRET"} {
+		if os.Getenv(name) == "" {
+			missing = append(missing, name)
+		}
+	}
+	var err error
+	if len(missing) > 0 {
+		err = fmt.Errorf("%s not set", strings.Join(missing, ", "))
+	} else {
+		_, err = newCloudinary()
+	}
+	if err != nil {
+		uploadsDisabled = err
+		log.Println("Uploads are disabled, Cloudinary is misconfigured:", err)
+	}
+}
+
+// requireUploads answers 503 with the uploads_unavailable code when uploads are disabled
+func requireUploads(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if uploadsDisabled != nil {
+			jsonError(w, http.StatusServiceUnavailable, uploadsUnavailable, "uploads are disabled, check CLOUDINARY_CLOUD_NAME, CLOUDINARY_API_KEY and CLOUDINARY_API_SECRET")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// delayedStore stands in for MongoDB at startup: connect blocks until up is closed
+type delayedStore struct {
+	up        chan struct{}
+	connected chan struct{}
+}
+
+func newDelayedStore() *delayedStore {
+	return &delayedStore{up: make(chan struct{}), connected: make(chan struct{})}
+}
+
+func (s *delayedStore) connect() {
+	<-s.up
+	close(s.connected)
+}
+
+// bootWith starts the server the way main does, with store in place of connectMongoDB and the
+// rest of the setup, and returns its URL
+func bootWith(t *testing.T, store *delayedStore, router http.Handler) string {
+	startup := &startupHandler{}
+	srv := httptest.NewServer(startup)
+	t.Cleanup(srv.Close)
+	go func() {
+		store.connect()
+		startup.finish(router)
+	}()
+	return srv.URL
+}
+
+func get(t *testing.T, method, url string) (int, string, http.Header) {
+	t.Helper()
+	req, _ := http.NewRequest(method, url, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(body), resp.Header
+}
+
+// TestStartupThenReady: while the store is down /healthz answers 200 and every other route a JSON
+// 503 with the starting code; once it is up the full router answers
+func TestStartupThenReady(t *testing.T) {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	store := newDelayedStore()
+	url := bootWith(t, store, stubRouter(func(next http.Handler) http.Handler { return next }, "GET /listings", "GET /healthz", "POST /add/inquiry"))
+
+	for i := 0; i < 3; i++ { // and stays so while the store is down
+		if status, body, _ := get(t, http.MethodGet, url+"/healthz"); status != http.StatusOK || body != "ok\n" {
+			t.Fatalf("/healthz while starting: %d %q", status, body)
+		}
+		for _, route := range []string{"GET /listings", "POST /add/inquiry", "POST /healthz", "GET /no-such-route"} {
+			method, path, _ := strings.Cut(route, " ")
+			status, body, header := get(t, method, url+path)
+			if status != http.StatusServiceUnavailable || header.Get("Retry-After") != "5" {
+				t.Errorf("%s while starting: %d %q, Retry-After %q", route, status, body, header.Get("Retry-After"))
+			}
+			checkJSONError(t, route, header, body, startingCode, "the server is starting, retry in 5 seconds")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	close(store.up)
+	<-store.connected
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		status, _, _ := get(t, http.MethodGet, url+"/listings")
+		if status == http.StatusOK {
+			break
+		}
+		if status != http.StatusServiceUnavailable || time.Now().After(deadline) {
+			t.Fatalf("GET /listings after the store came up: %d", status)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for _, route := range []string{"GET /healthz", "POST /add/inquiry"} {
+		method, path, _ := strings.Cut(route, " ")
+		if status, _, _ := get(t, method, url+path); status != http.StatusOK {
+			t.Errorf("%s when ready: %d", route, status)
+		}
+	}
+	if status, _, _ := get(t, http.MethodGet, url+"/no-such-route"); status != http.StatusNotFound {
+		t.Errorf("an unknown route when ready: %d", status)
+	}
+}
+
+// TestStartupSwapUnderLoad sends requests while the router is swapped in: each one gets either
+// the startup answer or the router's, never anything else, and none after the swap gets 503. Run
+// it with -race.
+func TestStartupSwapUnderLoad(t *testing.T) {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	store := newDelayedStore()
+	url := bootWith(t, store, stubRouter(func(next http.Handler) http.Handler { return next }, "GET /listings"))
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for c := 0; c < 8; c++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ready := false
+			for i := 0; i < 200; i++ {
+				resp, err := http.Get(url + "/listings")
+				if err != nil {
+					errs <- err
+					return
+				}
+				resp.Body.Close()
+				switch {
+				case resp.StatusCode == http.StatusOK:
+					ready = true
+				case resp.StatusCode != http.StatusServiceUnavailable || ready:
+					errs <- errors.New("got " + resp.Status + " after the swap")
+					return
+				}
+			}
+		}()
+	}
+	time.Sleep(5 * time.Millisecond)
+	close(store.up)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestSetupUploads(t *testing.T) {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	prev := uploadsDisabled
+	t.Cleanup(func() { uploadsDisabled = prev })
+
+	t.Setenv("CLOUDINARY_CLOUD_NAME", "")
+	t.Setenv("CLOUDINARY_API_KEY", "")
+	t.Setenv("CLOUDINARY_API_SECRET", "")
+	uploadsDisabled = nil
+	setupUploads()
+	if uploadsDisabled == nil {
+		t.Error("uploads are on without Cloudinary settings")
+	}
+
+	t.Setenv("CLOUDINARY_CLOUD_NAME", "mv-realty")
+	t.Setenv("CLOUDINARY_API_KEY", "123456789")
+	t.Setenv("CLOUDINARY_API_SECRET", "secret")
+	uploadsDisabled = nil
+	setupUploads()
+	if uploadsDisabled != nil {
+		t.Errorf("uploads are off with Cloudinary configured: %v", uploadsDisabled)
+	}
+}
+
+// TestUploadsUnavailable: with Cloudinary misconfigured only the upload routes answer 503
+func TestUploadsUnavailable(t *testing.T) {
+	skipMaintenanceLookup(t)
+	skipLoginThrottle(t)
+	useTestKeys(t)
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	unreachableMongo(t)
+	prev := uploadsDisabled
+	uploadsDisabled = errors.New("cloud name is required")
+	t.Cleanup(func() { uploadsDisabled = prev })
+
+	handler := routes()
+	const id = "0123456789abcdef01234567"
+	for _, path := range []string{"/properties/" + id + "/images", "/properties/" + id + "/documents", "/properties/" + id + "/floor-plans", "/listings/" + id + "/floor-plans"} {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader("--x--"))
+		req.Header.Set("Content-Type", "multipart/form-data; boundary=x")
+		req.Header.Set("X-API-Key", "test-shared-key")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusServiceUnavailable {
+			t.Errorf("POST %s: %d %q", path, rec.Code, rec.Body)
+		}
+		checkJSONError(t, "POST "+path, rec.Header(), rec.Body.String(), uploadsUnavailable,
+			"uploads are disabled, check CLOUDINARY_CLOUD_NAME, CLOUDINARY_API_KEY and CLOUDINARY_API_SECRET")
+	}
+	for _, path := range []string{"/healthz", "/openapi.json", "/properties/" + id} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code == http.StatusServiceUnavailable {
+			t.Errorf("GET %s: 503 %q", path, rec.Body)
+		}
+	}
+}
+
+// TestAwaitMongoDB retries the ping of a database that is up by the time it looks again
+func TestAwaitMongoDB(t *testing.T) {
+	useTestMongo(t)
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	started := time.Now()
+	awaitMongoDB(errors.New("server selection error"))
+	if waited := time.Since(started); waited < mongoRetryFirst || waited > mongoRetryFirst+10*time.Second {
+		t.Errorf("waited %s", waited)
+	}
+	awaitMongoDB(nil) // up from the start, no wait
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// GET /properties/{id}/map.png serves a static map thumbnail of the property for emails and link
+// previews. The image comes from the provider in STATIC_MAP_PROVIDER (google or mapbox) with the key in
+// STATIC_MAP_KEY, which never leaves the server. Images are kept in an in-process LRU keyed by the
+// coordinates, so moving a property fetches a new one.
+const (
+	staticMapWidth      = 600
+	staticMapHeight     = 300
+	staticMapZoom       = 15
+	staticMapCacheSize  = 1000
+	staticMapTTL        = 7 * 24 * time.Hour
+	maxStaticMapBytes   = 2 << 20
+	staticMapCacheCtl   = "public, max-age=86400"
+	placeholderCacheCtl = "public, max-age=300" // short, the coordinates or the provider may be fixed soon
+)
+
+var (
+	staticMapCache  = newLRUCache(staticMapCacheSize)
+	staticMapClient = &http.Client{Timeout: 5 * time.Second}
+
+	placeholderOnce sync.Once
+	placeholderPNG  []byte
+)
+
+// staticMapURL is the provider URL of a map centered on lat, lng with a marker, "" when no provider is
+// configured
+func staticMapURL(lat, lng float64) string {
+	key := os.Getenv("STATIC_MAP_KEY")
+	if key == "" {
+		return ""
+	}
+	switch os.Getenv("STATIC_MAP_PROVIDER") {
+	case "mapbox":
+		return fmt.Sprintf("https://api.mapbox.com/styles/v1/mapbox/streets-v12/static/pin-s+d32f2f(%[2]f,%[1]f)/%[2]f,%[1]f,%[3]d,0/%[4]dx%[5]d?access_token=%[6]s",
+			lat, lng, staticMapZoom, staticMapWidth, staticMapHeight, url.QueryEscape(key))
+	case "", "google":
+		center := fmt.Sprintf("%f,%f", lat, lng)
+		q := url.Values{
+			"center":  {center},
+			"markers": {center},
+			"zoom":    {fmt.Sprint(staticMapZoom)},
+			"size":    {fmt.Sprintf("%dx%d", staticMapWidth, staticMapHeight)},
+			"key":     {key},
+		}
+		return "https://maps.googleapis.com/maps/api/staticmap?" + q.Encode()
+	}
+	return ""
+}
+
+// fetchStaticMap downloads the map image. The URL holds the key, so errors only name the status.
+func fetchStaticMap(ctx context.Context, mapURL string) ([]byte, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, mapURL, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	resp, err := staticMapClient.Do(req)
+	if err != nil {
+		return nil, "", fmt.Errorf("static map request failed")
+	}
+	defer resp.Body.Close()
+	contentType := resp.Header.Get("Content-Type")
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(contentType, "image/") {
+		return nil, "", fmt.Errorf("static map provider answered %s with %s", resp.Status, contentType)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxStaticMapBytes+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if len(body) > maxStaticMapBytes {
+		return nil, "", fmt.Errorf("static map is larger than %d bytes", maxStaticMapBytes)
+	}
+	return body, contentType, nil
+}
+
+// mapPlaceholder is a light grey PNG with a pin in the middle, drawn once
+func mapPlaceholder() []byte {
+	placeholderOnce.Do(func() {
+		img := image.NewRGBA(image.Rect(0, 0, staticMapWidth, staticMapHeight))
+		background := color.RGBA{R: 0xe8, G: 0xea, B: 0xed, A: 0xff}
+		pin := color.RGBA{R: 0x9a, G: 0xa0, B: 0xa6, A: 0xff}
+		cx, cy := staticMapWidth/2, staticMapHeight/2-10
+		for y := 0; y < staticMapHeight; y++ {
+			for x := 0; x < staticMapWidth; x++ {
+				dx, dy := x-cx, y-cy
+				switch {
+				case dx*dx+dy*dy <= 14*14 && dx*dx+dy*dy >= 6*6: // the head, with a hole
+					img.Set(x, y, pin)
+				case dy > 0 && dy <= 28 && absInt(dx)*28 <= (28-dy)*12 && dx*dx+dy*dy > 14*14: // the point
+					img.Set(x, y, pin)
+				default:
+					img.Set(x, y, background)
+				}
+			}
+		}
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, img); err != nil {
+			log.Println("Failed to encode the map placeholder:", err)
+		}
+		placeholderPNG = buf.Bytes()
+	})
+	return placeholderPNG
+}
+
+func absInt(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+func writeMapImage(w http.ResponseWriter, contentType, cacheControl string, body []byte) {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", cacheControl)
+	w.Write(body)
+}
+
+// getPropertyMap answers GET /properties/{id}/map.png. A property without coordinates, an unconfigured
+// provider or a failing one all get the placeholder rather than an error, the image is decoration.
+func getPropertyMap(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathObjectID(w, r, "Property")
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	var property Property
+	err := client.Database("MVDB").Collection("properties").FindOne(ctx, notDeleted(bson.M{"_id": id}),
+		options.FindOne().SetProjection(bson.M{"coordinates": 1})).Decode(&property)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Property not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		serverError(w, r, "Failed to retrieve Property", err)
+		return
+	}
+	if propertyLocation(property.Coordinates) == nil {
+		writeMapImage(w, "image/png", placeholderCacheCtl, mapPlaceholder())
+		return
+	}
+
+	lat, lng := property.Coordinates[0], property.Coordinates[1]
+	key := fmt.Sprintf("%f,%f", lat, lng)
+	if cached, ok := staticMapCache.Get(ctx, key); ok {
+		writeMapImage(w, cached.ContentType, staticMapCacheCtl, cached.Body)
+		return
+	}
+	mapURL := staticMapURL(lat, lng)
+	if mapURL == "" {
+		writeMapImage(w, "image/png", placeholderCacheCtl, mapPlaceholder())
+		return
+	}
+	body, contentType, err := fetchStaticMap(ctx, mapURL)
+	if err != nil {
+		log.Printf("Failed to fetch the map of property %s (request %s): %v", id.Hex(), requestID(ctx), err)
+		writeMapImage(w, "image/png", placeholderCacheCtl, mapPlaceholder())
+		return
+	}
+	staticMapCache.Set(ctx, key, &cachedResponse{ContentType: contentType, Body: body}, nil, staticMapTTL)
+	writeMapImage(w, contentType, staticMapCacheCtl, body)
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	defaultListLimit = 100 // page size of the list endpoints for callers without the API key
+	maxListLimit     = 500
+	streamBatchSize  = 100 // documents decoded, prepared and flushed together by streamCursor
+)
+
+// listPage is the ?page= and ?limit= of a list endpoint. Public callers always get a page, at most
+// maxListLimit long; callers with the API key get everything unless they ask for a limit, which is
+// what internal exports rely on.
+type listPage struct {
+	Skip  int64
+	Limit int64 // 0 means unbounded
+}
+
+// listPageParams documents the query parameters read by parseListPage
+var listPageParams = []apiParam{
+	{Name: "page", Description: "from 1"},
+	{Name: "limit", Description: "default 100, at most 500; unbounded by default with the API key"},
+}
+
+// parseListPage answers 400 and returns false for a bad ?page= or ?limit=
+func parseListPage(w http.ResponseWriter, r *http.Request) (listPage, bool) {
+	q := r.URL.Query()
+	page, limit := int64(1), int64(0)
+	if !hasAPIKey(r) {
+		limit = defaultListLimit
+	}
+	if raw := q.Get("page"); raw != "" {
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || n < 1 {
+			http.Error(w, "page must be a positive whole number", http.StatusBadRequest)
+			return listPage{}, false
+		}
+		page = n
+	}
+	if raw := q.Get("limit"); raw != "" {
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || n < 1 || (n > maxListLimit && !hasAPIKey(r)) {
+			http.Error(w, "limit must be between 1 and "+strconv.Itoa(maxListLimit), http.StatusBadRequest)
+			return listPage{}, false
+		}
+		limit = n
+	}
+	if limit == 0 {
+		return listPage{}, true
+	}
+	return listPage{Skip: (page - 1) * limit, Limit: limit}, true
+}
+
+// findOptions pages a Find; pages are sorted by _id so they don't overlap
+func (p listPage) findOptions() *options.FindOptions {
+	opts := options.Find()
+	if p.Limit > 0 {
+		opts.SetSort(bson.D{{Key: "_id", Value: 1}}).SetSkip(p.Skip).SetLimit(p.Limit)
+	}
+	return opts
+}
+
+// stages pages an aggregation; sorted is false when the pipeline has no $sort of its own yet
+func (p listPage) stages(sorted bool) []bson.M {
+	if p.Limit == 0 {
+		return nil
+	}
+	var stages []bson.M
+	if !sorted {
+		stages = append(stages, bson.M{"$sort": bson.D{{Key: "_id", Value: 1}}})
+	}
+	return append(stages, bson.M{"$skip": p.Skip}, bson.M{"$limit": p.Limit})
+}
+
+// jsonArrayWriter encodes a JSON array one element at a time, so a list response never has to
+// be held in memory whole
+type jsonArrayWriter struct {
+	w   io.Writer
+	enc *json.Encoder
+	n   int
+}
+
+func newJSONArrayWriter(w io.Writer) *jsonArrayWriter {
+	return &jsonArrayWriter{w: w, enc: json.NewEncoder(w)}
+}
+
+func (a *jsonArrayWriter) Write(v interface{}) error {
+	sep := ","
+	if a.n == 0 {
+		sep = "["
+	}
+	if _, err := io.WriteString(a.w, sep); err != nil {
+		return err
+	}
+	a.n++
+	return a.enc.Encode(v)
+}
+
+// Close ends the array; an empty array is written as []
+func (a *jsonArrayWriter) Close() error {
+	end := "]\n"
+	if a.n == 0 {
+		end = "[]\n"
+	}
+	_, err := io.WriteString(a.w, end)
+	return err
+}
+
+// streamCursor writes the documents of cur as a JSON array, streamBatchSize at a time. prepare, when
+// set, fills in computed fields of a batch before it is written; its error is sent as a 500 when
+// nothing was written yet. Once the array has started a failure can no longer change the status,
+// so it is logged, the array is left unterminated for the client to notice and the response is
+// failed so it isn't cached, see failResponse.
+func streamCursor[T any](ctx context.Context, w http.ResponseWriter, cur *mongo.Cursor, name string, prepare func([]T) error) {
+	defer cur.Close(ctx)
+	flusher, _ := w.(http.Flusher)
+	out := newJSONArrayWriter(w)
+	fail := func(msg string, err error) {
+		if out.n == 0 {
+			http.Error(w, msg, http.StatusInternalServerError)
+			return
+		}
+		log.Println(msg, "after", out.n, "documents:", err)
+		failResponse(w)
+	}
+
+	batch := make([]T, 0, streamBatchSize)
+	flush := func() bool {
+		if prepare != nil && len(batch) > 0 {
+			if err := prepare(batch); err != nil {
+				fail(err.Error(), err)
+				return false
+			}
+		}
+		for i := range batch {
+			if err := out.Write(batch[i]); err != nil {
+				log.Println("Failed to write", name, ":", err)
+				failResponse(w)
+				return false
+			}
+		}
+		if flusher != nil && len(batch) > 0 {
+			flusher.Flush()
+		}
+		batch = batch[:0]
+		return true
+	}
+
+	for cur.Next(ctx) {
+		var doc T
+		if err := cur.Decode(&doc); err != nil {
+			fail("Failed to decode retrieved "+name, err)
+			return
+		}
+		batch = append(batch, doc)
+		if len(batch) == streamBatchSize && !flush() {
+			return
+		}
+	}
+	if err := cur.Err(); err != nil {
+		fail("Error iterating through cursor", err)
+		return
+	}
+	if !flush() {
+		return
+	}
+	if err := out.Close(); err != nil {
+		log.Println("Failed to write", name, ":", err)
+		failResponse(w)
+	}
+}
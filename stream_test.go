@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// seedSyntheticListings stores n listings shaped like the ones the site serves
+func seedSyntheticListings(tb testing.TB, n int) {
+	listings := make([]interface{}, n)
+	created := time.Now().Add(-time.Hour)
+	for i := range listings {
+		listings[i] = Listing{
+			ID:          primitive.NewObjectID(),
+			PropertyID:  primitive.NewObjectID().Hex(),
+			Description: fmt.Sprintf("Fully furnished %d bedroom unit on floor %d, walking distance to the BTS", 1+i%3, 1+i%40),
+			Price:       float64(15000 + 100*(i%200)),
+			Currency:    defaultCurrency,
+			Floor:       1 + i%40,
+			Size:        float64(30 + i%60),
+			Bedroom:     1 + i%3,
+			Bathroom:    1 + i%2,
+			ListingType: "rent",
+			Tags:        []string{"pet-friendly", "near-bts"},
+			CreatedAt:   created,
+			UpdatedAt:   created,
+		}
+	}
+	insertDocs(tb, "listings", listings...)
+}
+
+// BenchmarkListingsEncoding compares streamCursor with what the list handlers did before it:
+// decode every listing into one slice and encode the slice, for 10k listings
+func BenchmarkListingsEncoding(b *testing.B) {
+	useTestMongo(b, "listings")
+	seedSyntheticListings(b, 10000)
+	ctx := context.Background()
+	collection := client.Database("MVDB").Collection("listings")
+
+	b.Run("stream", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			cur, err := collection.Find(ctx, bson.M{})
+			if err != nil {
+				b.Fatal(err)
+			}
+			rec := httptest.NewRecorder()
+			streamCursor[Listing](ctx, rec, cur, "Listings", nil)
+			if rec.Code != http.StatusOK {
+				b.Fatalf("%d %s", rec.Code, rec.Body)
+			}
+		}
+	})
+	b.Run("slice", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			cur, err := collection.Find(ctx, bson.M{})
+			if err != nil {
+				b.Fatal(err)
+			}
+			var listings []Listing
+			if err := cur.All(ctx, &listings); err != nil {
+				b.Fatal(err)
+			}
+			if err := json.NewEncoder(httptest.NewRecorder()).Encode(listings); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
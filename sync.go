@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Deletion is a tombstone kept so sync clients learn about removed documents
+type Deletion struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty" json:"-"`
+	Collection string             `bson:"collection" json:"collection"`
+	DocumentID string             `bson:"document_id" json:"document_id"`
+	DeletedAt  time.Time          `bson:"deleted_at" json:"deleted_at"`
+}
+
+// recordDeletion writes a tombstone for a removed document. Delete handlers must call it
+// after a successful delete; a failure is logged rather than failing the delete.
+func recordDeletion(ctx context.Context, collectionName string, documentID primitive.ObjectID) {
+	_, err := client.Database("MVDB").Collection("deletions").InsertOne(ctx, Deletion{
+		Collection: collectionName,
+		DocumentID: documentID.Hex(),
+		DeletedAt:  time.Now(),
+	})
+	if err != nil {
+		log.Println("Failed to record deletion of", collectionName, documentID.Hex(), ":", err)
+	}
+}
+
+type syncResponse[T any] struct {
+	// ServerTime is the cursor to send as updated_since on the next call
+	ServerTime time.Time  `json:"server_time"`
+	Documents  []T        `json:"documents"`
+	Deleted    []Deletion `json:"deleted"`
+}
+
+func syncListings(w http.ResponseWriter, r *http.Request) {
+	syncCollection[Listing](w, r, "listings", "updated_at", publishedListingsFilter(bson.M{}))
+}
+
+func syncProperties(w http.ResponseWriter, r *http.Request) {
+	syncCollection[Property](w, r, "properties", "updated_at", notDeleted(bson.M{}))
+}
+
+// syncCollection returns documents matching filter changed after ?updated_since= (RFC3339) plus
+// tombstones for deletions in the same window. Without updated_since every document is returned.
+// Soft-deleted documents reach clients as tombstones only, so filter must exclude them.
+func syncCollection[T any](w http.ResponseWriter, r *http.Request, collectionName, updatedField string, filter bson.M) {
+	w.Header().Set("Content-Type", "application/json")
+
+	deletionsFilter := bson.M{"collection": collectionName}
+	if raw := r.URL.Query().Get("updated_since"); raw != "" {
+		since, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			http.Error(w, "updated_since must be an RFC3339 timestamp", http.StatusBadRequest)
+			return
+		}
+		filter[updatedField] = bson.M{"$gt": since}
+		deletionsFilter["deleted_at"] = bson.M{"$gt": since}
+	}
+
+	// Taken before querying so writes that land during the query are picked up next time
+	serverTime := time.Now().UTC()
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	db := client.Database("MVDB")
+	cur, err := db.Collection(collectionName).Find(ctx, filter, options.Find().SetSort(bson.M{updatedField: 1}))
+	if err != nil {
+		serverError(w, r, "Failed to retrieve changes from MongoDB", err)
+		return
+	}
+	defer cur.Close(ctx)
+
+	resp := syncResponse[T]{ServerTime: serverTime, Documents: []T{}, Deleted: []Deletion{}}
+	if err := cur.All(ctx, &resp.Documents); err != nil {
+		serverError(w, r, "Failed to decode retrieved changes", err)
+		return
+	}
+
+	delCur, err := db.Collection("deletions").Find(ctx, deletionsFilter, options.Find().SetSort(bson.M{"deleted_at": 1}))
+	if err != nil {
+		serverError(w, r, "Failed to retrieve deletions from MongoDB", err)
+		return
+	}
+	defer delCur.Close(ctx)
+	if err := delCur.All(ctx, &resp.Deleted); err != nil {
+		serverError(w, r, "Failed to decode retrieved deletions", err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Every request gets a deadline, its route's budget: REQUEST_TIMEOUT_READ for GETs (default 3s),
+// REQUEST_TIMEOUT_WRITE for the other methods (10s), and REQUEST_TIMEOUT_UPLOAD and
+// REQUEST_TIMEOUT_EXPORT (60s) for the routes of routeTimeoutClasses. REQUEST_TIMEOUTS overrides
+// single routes, as "METHOD /path/template=duration" separated by commas; 0 leaves a route without a
+// deadline. The deadline is that of the request context, so the Mongo and Cloudinary calls made
+// with it are cancelled too. A request that runs out of time before anything was written answers
+// a JSON 504 with the timeout code; one already streaming its response is cut off.
+const (
+	timeoutRead   = "read"
+	timeoutWrite  = "write"
+	timeoutUpload = "upload"
+	timeoutExport = "export"
+
+	timeoutCode = "timeout"
+)
+
+var timeoutBudgets = map[string]time.Duration{
+	timeoutRead:   3 * time.Second,
+	timeoutWrite:  10 * time.Second,
+	timeoutUpload: time.Minute,
+	timeoutExport: time.Minute,
+}
+
+// routeTimeoutClasses are the routes that don't fit the budget of their method: uploads, and the
+// exports and reports that read whole collections
+var routeTimeoutClasses = map[string]string{
+	"POST /properties/{id}/images":         timeoutUpload,
+	"POST /properties/{id}/documents":      timeoutUpload,
+	"POST /properties/{id}/floor-plans":    timeoutUpload,
+	"POST /listings/{id}/floor-plans":      timeoutUpload,
+	"POST /admin/listings/import":          timeoutUpload,
+	"GET /listings/{id}/brochure.pdf":      timeoutExport,
+	"GET /sync/listings":                   timeoutExport,
+	"GET /sync/properties":                 timeoutExport,
+	"GET /stats/timeseries":                timeoutExport,
+	"GET /stats/properties/engagement":     timeoutExport,
+	"GET /admin/agents/stats":              timeoutExport,
+	"GET /admin/analytics/inquiry-sources": timeoutExport,
+	"GET /admin/consistency":               timeoutExport,
+	"GET /admin/db-health":                 timeoutExport,
+	"GET /admin/reports/duplicate-images":  timeoutExport,
+	"GET /admin/reports/inconsistencies":   timeoutExport,
+	"GET /admin/reports/orphaned-listings": timeoutExport,
+	"POST /admin/purge":                    timeoutExport,
+	"POST /add/properties":                 timeoutExport,
+}
+
+// routeTimeouts are the budgets of single routes. The streams have none, and the admin tasks that
+// set their own longer deadline keep it.
+var routeTimeouts = map[string]time.Duration{
+	"GET /events/stream":           0,
+	"GET /ws":                      0,
+	"POST /admin/archive":          0,
+	"POST /admin/images/watermark": 0,
+	// fetched from the static maps provider, see staticMapClient
+	"GET /properties/{id}/map.png": 10 * time.Second,
+}
+
+// setupRequestTimeouts reads the REQUEST_TIMEOUT_ settings
+func setupRequestTimeouts() {
+	for class := range timeoutBudgets {
+		env := "REQUEST_TIMEOUT_" + strings.ToUpper(class)
+		if raw := os.Getenv(env); raw != "" {
+			d, err := time.ParseDuration(raw)
+			if err != nil || d < 0 {
+				log.Fatal(env + " must be a duration like 5s")
+			}
+			timeoutBudgets[class] = d
+		}
+	}
+	raw := os.Getenv("REQUEST_TIMEOUTS")
+	if raw == "" {
+		return
+	}
+	for _, entry := range strings.Split(raw, ",") {
+		route, value, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		d, err := time.ParseDuration(strings.TrimSpace(value))
+		if !ok || err != nil || d < 0 || len(strings.Fields(route)) != 2 {
+			log.Fatalf("REQUEST_TIMEOUTS entries must look like GET /listings=5s, not %q", entry)
+		}
+		routeTimeouts[strings.Join(strings.Fields(route), " ")] = d
+	}
+}
+
+// routeTimeout is the budget of the route r matched
+func routeTimeout(r *http.Request) time.Duration {
+	key := r.Method + " " + r.URL.Path
+	if route := mux.CurrentRoute(r); route != nil {
+		if tpl, err := route.GetPathTemplate(); err == nil {
+			key = r.Method + " " + tpl
+		}
+	}
+	if d, ok := routeTimeouts[key]; ok {
+		return d
+	}
+	if class, ok := routeTimeoutClasses[key]; ok {
+		return timeoutBudgets[class]
+	}
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return timeoutBudgets[timeoutRead]
+	}
+	return timeoutBudgets[timeoutWrite]
+}
+
+// withTimeout is the request deadline middleware. Like http.TimeoutHandler it runs the handler on
+// its own goroutine, but without buffering the response, so streamed responses and Flush still work.
+func withTimeout(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		budget := routeTimeout(r)
+		if budget <= 0 || r.Header.Get("Upgrade") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), budget)
+		defer cancel()
+
+		tw := &timeoutWriter{w: w, h: w.Header().Clone()}
+		done := make(chan struct{})
+		panicked := make(chan interface{}, 1)
+		go func() {
+			defer func() {
+				if p := recover(); p != nil {
+					panicked <- p
+					return
+				}
+				close(done)
+			}()
+			next.ServeHTTP(tw, r.WithContext(ctx))
+		}()
+
+		select {
+		case p := <-panicked:
+			panic(p)
+		case <-done:
+			return
+		case <-ctx.Done():
+		}
+		if ctx.Err() == context.DeadlineExceeded {
+			log.Printf("Request %s %s %s ran out of its %s", requestID(r.Context()), r.Method, r.URL.Path, budget)
+			tw.mu.Lock()
+			if !tw.wrote {
+				tw.timedOut = true
+				tw.mu.Unlock()
+				jsonError(w, http.StatusGatewayTimeout, timeoutCode, "the request took longer than "+budget.String())
+				return
+			}
+			tw.mu.Unlock()
+		}
+		// The response is under way or the client is gone; the handler sees its context cancelled and
+		// ends, after which w is no longer used
+		select {
+		case p := <-panicked:
+			panic(p)
+		case <-done:
+		}
+	})
+}
+
+// timeoutWriter keeps the handler's headers apart until it writes, so a 504 can still be sent
+// instead; from then on the response goes through as it is written
+type timeoutWriter struct {
+	w        http.ResponseWriter
+	h        http.Header
+	mu       sync.Mutex
+	wrote    bool
+	timedOut bool
+}
+
+func (tw *timeoutWriter) Header() http.Header { return tw.h }
+
+// start sends the status with the headers; tw.mu is held
+func (tw *timeoutWriter) start(status int) {
+	for k, v := range tw.h {
+		tw.w.Header()[k] = v
+	}
+	tw.w.WriteHeader(status)
+	tw.wrote = true
+}
+
+func (tw *timeoutWriter) WriteHeader(status int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if !tw.timedOut && !tw.wrote {
+		tw.start(status)
+	}
+}
+
+func (tw *timeoutWriter) Write(b []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	if !tw.wrote {
+		tw.start(http.StatusOK)
+	}
+	return tw.w.Write(b)
+}
+
+func (tw *timeoutWriter) Flush() {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return
+	}
+	if !tw.wrote {
+		tw.start(http.StatusOK)
+	}
+	if f, ok := tw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
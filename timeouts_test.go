@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// useRouteTimeout gives route ("METHOD /template") a budget for the test
+func useRouteTimeout(t *testing.T, route string, budget time.Duration) {
+	t.Helper()
+	prev, had := routeTimeouts[route]
+	routeTimeouts[route] = budget
+	t.Cleanup(func() {
+		if had {
+			routeTimeouts[route] = prev
+		} else {
+			delete(routeTimeouts, route)
+		}
+	})
+}
+
+// timedRouter serves GET template with handler behind withTimeout and cacheResponses, in the order
+// of router()
+func timedRouter(template string, handler http.HandlerFunc) http.Handler {
+	r := mux.NewRouter()
+	r.Use(withTimeout, cacheResponses)
+	r.HandleFunc(template, handler).Methods("GET")
+	return r
+}
+
+func TestWithTimeoutAnswers504AndCancels(t *testing.T) {
+	useRouteTimeout(t, "GET /listings/featured", 20*time.Millisecond)
+	cancelled := make(chan error, 1)
+	handler := timedRouter("/listings/featured", func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		cancelled <- r.Context().Err()
+	})
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/listings/featured", nil))
+	if rec.Code != http.StatusGatewayTimeout {
+		t.Errorf("status %d, want 504", rec.Code)
+	}
+	checkJSONError(t, "GET /listings/featured", rec.Header(), rec.Body.String(), timeoutCode, "the request took longer than 20ms")
+	select {
+	case err := <-cancelled:
+		if err != context.DeadlineExceeded {
+			t.Errorf("handler context ended with %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the handler's context wasn't cancelled")
+	}
+}
+
+func TestWithTimeoutLetsFastHandlersThrough(t *testing.T) {
+	useRouteTimeout(t, "GET /listings/featured", time.Second)
+	handler := timedRouter("/listings/featured", func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := r.Context().Deadline(); !ok {
+			t.Error("handler has no deadline")
+		}
+		w.Header().Set("X-Handler", "yes")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("done"))
+	})
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/listings/featured", nil))
+	if rec.Code != http.StatusCreated || rec.Body.String() != "done" || rec.Header().Get("X-Handler") != "yes" {
+		t.Errorf("status %d, body %q, headers %v", rec.Code, rec.Body, rec.Header())
+	}
+}
+
+func TestWithTimeoutZeroBudget(t *testing.T) {
+	useRouteTimeout(t, "GET /listings/featured", 0)
+	handler := timedRouter("/listings/featured", func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := r.Context().Deadline(); ok {
+			t.Error("a route without a budget got a deadline")
+		}
+	})
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/listings/featured", nil))
+}
+
+// TestTimedOutResponsesNotCached: neither a late 200 written after the 504 nor a stream the deadline
+// cut off may end up in the response cache
+func TestTimedOutResponsesNotCached(t *testing.T) {
+	t.Run("late write", func(t *testing.T) {
+		useTestResponseCache(t, "/listings/featured")
+		useRouteTimeout(t, "GET /listings/featured", 20*time.Millisecond)
+		finished := make(chan struct{}) // closed once cacheResponses is done with the late write
+		handler := mux.NewRouter()
+		handler.Use(withTimeout, func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				defer close(finished)
+				next.ServeHTTP(w, r)
+			})
+		}, cacheResponses)
+		handler.HandleFunc("/listings/featured", func(w http.ResponseWriter, r *http.Request) {
+			<-r.Context().Done()
+			time.Sleep(20 * time.Millisecond) // past the 504
+			w.Write([]byte("[]"))             // a handler that ignores its context
+		}).Methods("GET")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/listings/featured", nil))
+		<-finished
+		if rec.Code != http.StatusGatewayTimeout {
+			t.Fatalf("status %d, want 504", rec.Code)
+		}
+		if _, ok := responseCache.Get(context.Background(), "/listings/featured?"); ok {
+			t.Error("the write after the timeout was cached")
+		}
+	})
+
+	t.Run("stream cut off", func(t *testing.T) {
+		useTestResponseCache(t, "/listings")
+		useRouteTimeout(t, "GET /listings", 50*time.Millisecond)
+		batches := 0
+		handler := timedRouter("/listings", streamingHandler(t, streamedDocs(2*streamBatchSize+10), func([]streamedDoc) error {
+			batches++
+			if batches == 2 {
+				time.Sleep(100 * time.Millisecond) // the second batch runs past the deadline
+				return context.DeadlineExceeded
+			}
+			return nil
+		}))
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/listings", nil))
+		if rec.Code != http.StatusOK || strings.HasSuffix(rec.Body.String(), "]") {
+			t.Fatalf("status %d, body ending %q; want a 200 that broke off", rec.Code, rec.Body.String()[max(0, rec.Body.Len()-10):])
+		}
+		if _, ok := responseCache.Get(context.Background(), "/listings?"); ok {
+			t.Error("the stream the deadline cut off was cached")
+		}
+	})
+}
+
+func TestRouteTimeout(t *testing.T) {
+	tests := []struct {
+		method, template string
+		want             time.Duration
+	}{
+		{"GET", "/listings", timeoutBudgets[timeoutRead]},
+		{"PUT", "/listings/{id}", timeoutBudgets[timeoutWrite]},
+		{"POST", "/properties/{id}/images", timeoutBudgets[timeoutUpload]},
+		{"GET", "/sync/listings", timeoutBudgets[timeoutExport]},
+		{"GET", "/events/stream", 0},
+		{"GET", "/properties/{id}/map.png", 10 * time.Second},
+	}
+	for _, tt := range tests {
+		r := mux.NewRouter()
+		var got time.Duration
+		r.HandleFunc(tt.template, func(w http.ResponseWriter, r *http.Request) { got = routeTimeout(r) }).Methods(tt.method)
+		path := routeVar.ReplaceAllString(tt.template, "0123456789abcdef01234567")
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(tt.method, path, nil))
+		if got != tt.want {
+			t.Errorf("%s %s: budget %s, want %s", tt.method, tt.template, got, tt.want)
+		}
+	}
+}
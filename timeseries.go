@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const maxTimeseriesRange = 366 * 24 * time.Hour
+
+// timeseriesMetrics maps ?metric= to its collection and timestamp field, and whether the
+// collection has an archive
+var timeseriesMetrics = map[string]struct {
+	collection string
+	field      string
+	archived   bool
+}{
+	"appointments": {"appointments", "appointment_date", true},
+	"users":        {"users", "created_at", false},
+	"inquiries":    {"inquiries", "created_at", true},
+}
+
+type periodCount struct {
+	Period string `json:"period"`
+	Count  int    `json:"count"`
+}
+
+// truncatePeriod returns the start of the day or ISO week (Monday) containing t, in loc
+func truncatePeriod(t time.Time, interval string, loc *time.Location) time.Time {
+	t = t.In(loc)
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+	if interval == "week" {
+		return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+	}
+	return day
+}
+
+// zeroFillPeriods returns one entry per period from the period containing from up to the one
+// containing the last instant before to, taking counts from counts (keyed by period start date)
+func zeroFillPeriods(from, to time.Time, interval string, loc *time.Location, counts map[string]int) []periodCount {
+	step := 1
+	if interval == "week" {
+		step = 7
+	}
+	series := []periodCount{}
+	last := truncatePeriod(to.Add(-time.Nanosecond), interval, loc)
+	for p := truncatePeriod(from, interval, loc); !p.After(last); p = p.AddDate(0, 0, step) {
+		key := p.Format("2006-01-02")
+		series = append(series, periodCount{Period: key, Count: counts[key]})
+	}
+	return series
+}
+
+// getTimeseries buckets a metric per day or week with $dateTrunc in Bangkok time and zero-fills gaps.
+// Defaults: interval=day, the last 30 days. ?include_archived=true counts archived appointments
+// and inquiries too.
+func getTimeseries(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	q := r.URL.Query()
+	metric, ok := timeseriesMetrics[q.Get("metric")]
+	if !ok {
+		http.Error(w, "metric must be appointments, users or inquiries", http.StatusBadRequest)
+		return
+	}
+	interval := q.Get("interval")
+	if interval == "" {
+		interval = "day"
+	}
+	if interval != "day" && interval != "week" {
+		http.Error(w, "interval must be day or week", http.StatusBadRequest)
+		return
+	}
+	from, to, err := parseDateRange(q)
+	if err != nil {
+		http.Error(w, "from and to must be RFC3339 or YYYY-MM-DD", http.StatusBadRequest)
+		return
+	}
+	if to.IsZero() {
+		to = time.Now()
+	}
+	if from.IsZero() {
+		from = truncatePeriod(to, "day", bangkok).AddDate(0, 0, -29)
+	}
+	if !from.Before(to) {
+		http.Error(w, "from must be before to", http.StatusBadRequest)
+		return
+	}
+	if to.Sub(from) > maxTimeseriesRange {
+		http.Error(w, "The range must not exceed 366 days", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	trunc := bson.M{"date": "$" + metric.field, "unit": interval, "timezone": bangkok.String()}
+	if interval == "week" {
+		trunc["startOfWeek"] = "monday"
+	}
+	match := bson.M{metric.field: bson.M{"$gte": from, "$lt": to}}
+	pipeline := []bson.M{{"$match": match}}
+	archived := metric.archived && includeArchived(r)
+	if archived {
+		pipeline = append(pipeline, archiveUnion(metric.collection, match))
+	}
+	pipeline = append(pipeline,
+		bson.M{"$group": bson.M{
+			"_id":   bson.M{"$dateToString": bson.M{"date": bson.M{"$dateTrunc": trunc}, "format": "%Y-%m-%d", "timezone": bangkok.String()}},
+			"count": bson.M{"$sum": 1},
+		}},
+	)
+	cur, err := client.Database("MVDB").Collection(metric.collection).Aggregate(ctx, pipeline)
+	if err != nil {
+		serverError(w, r, "Failed to aggregate time series", err)
+		return
+	}
+	var rows []struct {
+		Period string `bson:"_id"`
+		Count  int    `bson:"count"`
+	}
+	if err := cur.All(ctx, &rows); err != nil {
+		serverError(w, r, "Failed to decode time series", err)
+		return
+	}
+
+	counts := make(map[string]int, len(rows))
+	for _, row := range rows {
+		counts[row.Period] = row.Count
+	}
+	setArchivesIncluded(w, archived)
+	json.NewEncoder(w).Encode(zeroFillPeriods(from, to, interval, bangkok, counts))
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func bangkokTime(value string) time.Time {
+	t, err := time.ParseInLocation("2006-01-02 15:04", value, bangkok)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func TestTruncatePeriod(t *testing.T) {
+	tests := []struct {
+		at, interval, want string
+	}{
+		{"2024-03-13 15:30", "day", "2024-03-13"},
+		{"2024-03-13 15:30", "week", "2024-03-11"}, // Wednesday
+		{"2024-03-11 00:00", "week", "2024-03-11"}, // Monday
+		{"2024-03-17 23:59", "week", "2024-03-11"}, // Sunday ends the ISO week
+		{"2024-01-02 09:00", "week", "2024-01-01"},
+		{"2023-01-01 12:00", "week", "2022-12-26"}, // the week starts in the previous year
+	}
+	for _, tt := range tests {
+		if got := truncatePeriod(bangkokTime(tt.at), tt.interval, bangkok).Format("2006-01-02"); got != tt.want {
+			t.Errorf("%s %s: %s, want %s", tt.interval, tt.at, got, tt.want)
+		}
+	}
+
+	// 20:00 UTC is already the next day in Bangkok
+	utc := time.Date(2024, 3, 13, 20, 0, 0, 0, time.UTC)
+	if got := truncatePeriod(utc, "day", bangkok); !got.Equal(bangkokTime("2024-03-14 00:00")) {
+		t.Errorf("20:00 UTC: %s, want the start of the 14th in Bangkok", got)
+	}
+}
+
+func TestZeroFillPeriods(t *testing.T) {
+	series := zeroFillPeriods(bangkokTime("2024-02-27 00:00"), bangkokTime("2024-03-02 00:00"), "day", bangkok,
+		map[string]int{"2024-02-28": 3, "2024-03-01": 1, "2024-03-02": 9})
+	want := []periodCount{{"2024-02-27", 0}, {"2024-02-28", 3}, {"2024-02-29", 0}, {"2024-03-01", 1}}
+	if !reflect.DeepEqual(series, want) {
+		t.Errorf("days: %v, want %v (to is exclusive)", series, want)
+	}
+
+	// a from in the middle of a week starts at its Monday, a to just past midnight reaches its week
+	series = zeroFillPeriods(bangkokTime("2024-03-13 10:00"), bangkokTime("2024-03-25 00:01"), "week", bangkok,
+		map[string]int{"2024-03-18": 2})
+	want = []periodCount{{"2024-03-11", 0}, {"2024-03-18", 2}, {"2024-03-25", 0}}
+	if !reflect.DeepEqual(series, want) {
+		t.Errorf("weeks: %v, want %v", series, want)
+	}
+
+	series = zeroFillPeriods(bangkokTime("2024-03-13 10:00"), bangkokTime("2024-03-13 11:00"), "day", bangkok, nil)
+	if want := []periodCount{{"2024-03-13", 0}}; !reflect.DeepEqual(series, want) {
+		t.Errorf("within a day without counts: %v, want %v", series, want)
+	}
+
+	series = zeroFillPeriods(bangkokTime("2024-01-01 00:00"), bangkokTime("2025-01-01 00:00"), "day", bangkok, nil)
+	if len(series) != 366 || series[365].Period != "2024-12-31" {
+		t.Errorf("a leap year has %d days ending %v", len(series), series[len(series)-1])
+	}
+}
+
+func TestTimeseriesValidation(t *testing.T) {
+	for query, want := range map[string]string{
+		"":                             "metric must be appointments, users or inquiries",
+		"?metric=listings":             "metric must be appointments, users or inquiries",
+		"?metric=users&interval=month": "interval must be day or week",
+		"?metric=users&from=yesterday": "from and to must be RFC3339 or YYYY-MM-DD",
+		"?metric=users&from=2024-03-02&to=2024-03-01": "from must be before to",
+		"?metric=users&from=2024-01-01&to=2025-01-01": "The range must not exceed 366 days",
+	} {
+		rec := httptest.NewRecorder()
+		getTimeseries(rec, httptest.NewRequest(http.MethodGet, "/stats/timeseries"+query, nil))
+		if body := rec.Body.String(); rec.Code != http.StatusBadRequest || body != want+"\n" {
+			t.Errorf("%q: status %d, body %q, want 400 %q", query, rec.Code, body, want)
+		}
+	}
+}
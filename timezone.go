@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+	_ "time/tzdata" // the container image has no zoneinfo
+)
+
+// bangkok is the business time zone; date-only inputs and calendar windows are interpreted in it
+var bangkok = mustLoadLocation("Asia/Bangkok")
+
+func mustLoadLocation(name string) *time.Location {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		panic(err)
+	}
+	return loc
+}
+
+// parseDateOrTime accepts RFC3339 or a date-only YYYY-MM-DD value, the latter taken as midnight in bangkok
+func parseDateOrTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02", value, bangkok)
+}
+
+var errAppointmentDateFormat = errors.New("Appointment_date must be RFC3339 with a UTC offset, e.g. 2024-05-01T14:00:00+07:00")
+
+// appointmentDecodeError turns the error of decoding a request body with an Appointment_date into the message
+// for the client. A date without an offset fails in time.Time itself, so it is named rather than
+// reported as an unparseable body: guessing the zone is what put viewings 7 hours off.
+func appointmentDecodeError(err error) string {
+	var parseErr *time.ParseError
+	if errors.As(err, &parseErr) {
+		return errAppointmentDateFormat.Error()
+	}
+	return "Failed to parse request body"
+}
+
+var tzParam = apiParam{Name: "tz", Description: "IANA time zone of Appointment_date, local_date and local_time, default Asia/Bangkok"}
+
+// responseLocation is the ?tz= time zone that appointment responses are rendered in, bangkok by
+// default. It answers 400 and returns false for an unknown zone.
+func responseLocation(w http.ResponseWriter, r *http.Request) (*time.Location, bool) {
+	name := r.URL.Query().Get("tz")
+	if name == "" {
+		return bangkok, true
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil || name == "Local" {
+		http.Error(w, "tz must be an IANA time zone such as Asia/Bangkok", http.StatusBadRequest)
+		return nil, false
+	}
+	return loc, true
+}
+
+// localizeAppointment renders Appointment_date in loc and fills local_date and local_time. The
+// instant is unchanged; Mongo keeps it in UTC.
+func localizeAppointment(a *Appointment, loc *time.Location) {
+	a.AppointmentDate = a.AppointmentDate.In(loc)
+	a.LocalDate = a.AppointmentDate.Format("2006-01-02")
+	a.LocalTime = a.AppointmentDate.Format("15:04")
+}
+
+func localizeAppointments(appointments []Appointment, loc *time.Location) {
+	for i := range appointments {
+		localizeAppointment(&appointments[i], loc)
+	}
+}
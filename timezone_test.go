@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestAppointmentDecodeError(t *testing.T) {
+	var a Appointment
+	err := json.Unmarshal([]byte(`{"Appointment_date": "2024-05-01T14:00:00"}`), &a)
+	if err == nil || appointmentDecodeError(err) != errAppointmentDateFormat.Error() {
+		t.Errorf("a date without an offset: %v", err)
+	}
+	if err := json.Unmarshal([]byte(`{"Appointment_date": "2024-05-01T14:00:00+07:00"}`), &a); err != nil {
+		t.Fatal(err)
+	}
+	if utc := a.AppointmentDate.UTC(); utc != time.Date(2024, 5, 1, 7, 0, 0, 0, time.UTC) {
+		t.Errorf("14:00+07:00 is %s in UTC", utc)
+	}
+	err = json.Unmarshal([]byte(`{"Appointment_date": 5`), &a)
+	if msg := appointmentDecodeError(err); msg != "Failed to parse request body" {
+		t.Errorf("a broken body: %q", msg)
+	}
+}
+
+func TestResponseLocation(t *testing.T) {
+	for query, want := range map[string]string{"": "Asia/Bangkok", "?tz=Europe/London": "Europe/London", "?tz=UTC": "UTC"} {
+		rec := httptest.NewRecorder()
+		loc, ok := responseLocation(rec, httptest.NewRequest(http.MethodGet, "/appointments"+query, nil))
+		if !ok || loc.String() != want {
+			t.Errorf("%q: %v %v, want %s", query, loc, ok, want)
+		}
+	}
+	for _, query := range []string{"?tz=Local", "?tz=Mars/Base", "?tz=%2B07:00"} {
+		rec := httptest.NewRecorder()
+		if _, ok := responseLocation(rec, httptest.NewRequest(http.MethodGet, "/appointments"+query, nil)); ok || rec.Code != http.StatusBadRequest {
+			t.Errorf("%q: accepted with %d", query, rec.Code)
+		}
+	}
+}
+
+// TestLocalizeAppointment: Bangkok is +07:00 the whole year, London moves between GMT and BST, and
+// the instant stays the same either way
+func TestLocalizeAppointment(t *testing.T) {
+	london := mustLoadLocation("Europe/London")
+	tests := []struct {
+		instant    time.Time
+		loc        *time.Location
+		date, time string
+	}{
+		{time.Date(2024, 1, 15, 7, 0, 0, 0, time.UTC), bangkok, "2024-01-15", "14:00"},
+		{time.Date(2024, 7, 1, 7, 0, 0, 0, time.UTC), bangkok, "2024-07-01", "14:00"},
+		{time.Date(2024, 1, 15, 7, 0, 0, 0, time.UTC), london, "2024-01-15", "07:00"},
+		{time.Date(2024, 7, 1, 7, 0, 0, 0, time.UTC), london, "2024-07-01", "08:00"},
+		{time.Date(2024, 3, 31, 18, 30, 0, 0, time.UTC), bangkok, "2024-04-01", "01:30"}, // the next day in Bangkok
+		{time.Date(2024, 3, 31, 0, 30, 0, 0, time.UTC), london, "2024-03-31", "00:30"},   // just before BST starts
+		{time.Date(2024, 3, 31, 1, 30, 0, 0, time.UTC), london, "2024-03-31", "02:30"},   // just after
+	}
+	for _, tt := range tests {
+		a := Appointment{AppointmentDate: tt.instant}
+		localizeAppointment(&a, tt.loc)
+		if a.LocalDate != tt.date || a.LocalTime != tt.time {
+			t.Errorf("%s in %s: %s %s, want %s %s", tt.instant, tt.loc, a.LocalDate, a.LocalTime, tt.date, tt.time)
+		}
+		if !a.AppointmentDate.Equal(tt.instant) || a.AppointmentDate.Location() != tt.loc {
+			t.Errorf("%s in %s became %s", tt.instant, tt.loc, a.AppointmentDate)
+		}
+	}
+}
+
+// TestSlotsIgnoreInputZone: the same instant given in another zone is the same slot and the same
+// viewing hours check, both done in Bangkok
+func TestSlotsIgnoreInputZone(t *testing.T) {
+	london := mustLoadLocation("Europe/London")
+	inBangkok := time.Date(2024, 7, 1, 9, 0, 0, 0, bangkok)
+	inLondon := time.Date(2024, 7, 1, 3, 0, 0, 0, london)
+	if slotKey("l1", inBangkok) != slotKey("l1", inLondon) || slotKey("l1", inBangkok) != "l1@2024-07-01T02:00:00Z" {
+		t.Errorf("slot keys %s and %s", slotKey("l1", inBangkok), slotKey("l1", inLondon))
+	}
+
+	hours := &agentAvailability{}
+	for _, day := range weekdays {
+		hours.Weekly = append(hours.Weekly, workingHours{Day: day, Start: "09:00", End: "18:00"})
+	}
+	if err := hours.check(inLondon); err != nil {
+		t.Errorf("03:00 in London is 09:00 in Bangkok: %v", err)
+	}
+	err := hours.check(inLondon.Add(-time.Hour))
+	if err == nil || err.Error() != "Monday 08:00 is outside the viewing hours" {
+		t.Errorf("an hour earlier: %v", err)
+	}
+	// 11:00 on Sunday in London is 17:00 in Bangkok, the last viewing of the day; 11:30 is too late
+	if err := hours.check(time.Date(2024, 6, 30, 11, 0, 0, 0, london)); err != nil {
+		t.Errorf("17:00 in Bangkok: %v", err)
+	}
+	if err := hours.check(time.Date(2024, 6, 30, 11, 30, 0, 0, london)); err == nil || !strings.HasPrefix(err.Error(), "Sunday 17:30") {
+		t.Errorf("17:30 in Bangkok: %v", err)
+	}
+}
+
+// TestAppointmentResponseZone reads an appointment back as a client in London would
+func TestAppointmentResponseZone(t *testing.T) {
+	useTestMongo(t, appointmentCollections...)
+	appointment, _ := seedBookableListing(t, Listing{ListingStatus: "active"})
+	appointment.AppointmentDate = viewingDay(1)
+	if _, err := insertAppointment(context.Background(), &appointment); err != nil {
+		t.Fatal(err)
+	}
+	var stored Appointment
+	if err := client.Database("MVDB").Collection("appointments").FindOne(context.Background(),
+		bson.M{"_id": appointment.ID}).Decode(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored.AppointmentDate.Location() != time.UTC || !stored.AppointmentDate.Equal(appointment.AppointmentDate) {
+		t.Errorf("stored %s for %s", stored.AppointmentDate, appointment.AppointmentDate)
+	}
+
+	london := mustLoadLocation("Europe/London")
+	for query, loc := range map[string]*time.Location{"": bangkok, "?tz=Europe/London": london} {
+		req := httptest.NewRequest(http.MethodGet, "/appointments/"+appointment.ID.Hex()+query, nil)
+		rec := httptest.NewRecorder()
+		getAppointment(rec, mux.SetURLVars(req, map[string]string{"id": appointment.ID.Hex()}))
+		var got struct {
+			Date      string `json:"Appointment_date"`
+			LocalDate string `json:"local_date"`
+			LocalTime string `json:"local_time"`
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+			t.Fatalf("%q: %d %v", query, rec.Code, err)
+		}
+		local := appointment.AppointmentDate.In(loc)
+		if got.Date != local.Format(time.RFC3339) || got.LocalDate != local.Format("2006-01-02") || got.LocalTime != local.Format("15:04") {
+			t.Errorf("%q: %+v, want %s", query, got, local.Format(time.RFC3339))
+		}
+	}
+}
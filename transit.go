@@ -0,0 +1,144 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// maxTransitDistance is how far from a property stations are picked up automatically
+const maxTransitDistance = 1500 // meters
+
+// TransitStop is a station near a property; DistanceM is the straight-line distance
+type TransitStop struct {
+	Station   string `bson:"station" json:"station"`
+	Line      string `bson:"line" json:"line"`
+	DistanceM int    `bson:"distance_m" json:"distance_m"`
+}
+
+type transitStation struct {
+	Station     string     `json:"station"`
+	Line        string     `json:"line"`
+	Coordinates [2]float64 `json:"coordinates"` // [latitude, longitude]
+	Aliases     []string   `json:"aliases,omitempty"`
+}
+
+// transitStationsJSON is a small hand-kept list of BTS and MRT stations with approximate coordinates
+//
+//go:embed data/transit_stations.json
+var transitStationsJSON []byte
+
+var transitStations = loadTransitStations()
+
+func loadTransitStations() []transitStation {
+	var stations []transitStation
+	if err := json.Unmarshal(transitStationsJSON, &stations); err != nil {
+		panic("data/transit_stations.json: " + err.Error())
+	}
+	return stations
+}
+
+// stationKey makes station names comparable regardless of case, spaces and punctuation ("Thong Lo" = "thonglo")
+func stationKey(name string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(name) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// canonicalStation returns the dataset spelling of a station name or alias, false when it isn't known
+func canonicalStation(name string) (string, bool) {
+	key := stationKey(name)
+	if key == "" {
+		return "", false
+	}
+	for _, s := range transitStations {
+		if stationKey(s.Station) == key {
+			return s.Station, true
+		}
+		for _, alias := range s.Aliases {
+			if stationKey(alias) == key {
+				return s.Station, true
+			}
+		}
+	}
+	return "", false
+}
+
+// nearbyTransit lists the stations within maxTransitDistance of the coordinates, nearest first.
+// Properties without coordinates get none.
+func nearbyTransit(coordinates [2]float64) []TransitStop {
+	stops := []TransitStop{}
+	if !hasCoordinates(coordinates) {
+		return stops
+	}
+	for _, s := range transitStations {
+		d := haversineMeters(coordinates, s.Coordinates)
+		if d <= maxTransitDistance {
+			stops = append(stops, TransitStop{Station: s.Station, Line: s.Line, DistanceM: int(math.Round(d))})
+		}
+	}
+	sort.SliceStable(stops, func(i, j int) bool { return stops[i].DistanceM < stops[j].DistanceM })
+	return stops
+}
+
+// fillTransit keeps transit entered by hand, spelling known stations the dataset's way, and otherwise
+// derives it from the property's coordinates
+func fillTransit(property *Property) {
+	if len(property.Transit) == 0 {
+		property.Transit = nearbyTransit(property.Coordinates)
+		return
+	}
+	for i := range property.Transit {
+		if name, ok := canonicalStation(property.Transit[i].Station); ok {
+			property.Transit[i].Station = name
+		}
+	}
+}
+
+// applyTransitFilter adds ?near_station= (with ?max_walk_m=, default 1000) to a properties filter.
+// It answers 400 and returns false for an unknown station or a bad distance.
+func applyTransitFilter(w http.ResponseWriter, r *http.Request, filter bson.M) bool {
+	q := r.URL.Query()
+	raw := q.Get("near_station")
+	if raw == "" {
+		return true
+	}
+	station, ok := canonicalStation(raw)
+	if !ok {
+		http.Error(w, "Unknown station, see GET /transit/stations", http.StatusBadRequest)
+		return false
+	}
+	maxWalk := 1000
+	if v := q.Get("max_walk_m"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, "max_walk_m must be a positive whole number", http.StatusBadRequest)
+			return false
+		}
+		maxWalk = n
+	}
+	filter["transit"] = bson.M{"$elemMatch": bson.M{"station": station, "distance_m": bson.M{"$lte": maxWalk}}}
+	return true
+}
+
+var transitFilterParams = []apiParam{
+	{Name: "near_station", Description: "station name, case and spaces ignored, e.g. asok"},
+	{Name: "max_walk_m", Description: "with near_station, default 1000"},
+}
+
+// getTransitStations returns the station list for the frontend dropdown
+func getTransitStations(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(transitStations)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Routes under /users/{id} that hold a user's own data (notifications, devices, saved searches and
+// waitlist entries) take that user's token as an Authorization: Bearer header, or the API key for
+// servers acting on their behalf. The app's backend signs the user in and gets the token from
+// POST /users/{id}/token, the same way agents get theirs for GET /ws.
+const userTokenLifetime = 12 * time.Hour
+
+var (
+	errInvalidUserToken = errors.New("Invalid user token")
+	errUserTokenExpired = errors.New("User token has expired")
+)
+
+var userTokens = tokenKind{name: "user", invalid: errInvalidUserToken, expired: errUserTokenExpired}
+
+// requireUserOrAPIKey lets the user {id} in with their token from POST /users/{id}/token, and
+// everyone else with an API key of the request's scope
+func requireUserOrAPIKey(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") {
+			requireAPIKey(next).ServeHTTP(w, r)
+			return
+		}
+		userID, err := userTokens.verify(strings.TrimPrefix(auth, "Bearer "))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if userID != mux.Vars(r)["id"] {
+			http.Error(w, "The user token is for another user", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// createUserToken answers POST /users/{id}/token with a token for the user's own routes, valid for
+// 12 hours; 404 for unknown and deleted users
+func createUserToken(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	id, ok := pathObjectID(w, r, "User")
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	err := client.Database("MVDB").Collection("users").FindOne(ctx, notDeleted(bson.M{"_id": id})).Err()
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		serverError(w, r, "Failed to retrieve User", err)
+		return
+	}
+	expiry := time.Now().Add(userTokenLifetime)
+	recordAudit(auditFromRequest(r), "token", "users", id.Hex(), nil, nil, nil)
+	json.NewEncoder(w).Encode(map[string]interface{}{"token": userTokens.sign(id.Hex(), expiry), "expires_at": expiry})
+}
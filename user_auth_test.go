@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const (
+	testUserID  = "0123456789abcdef01234567"
+	otherUserID = "76543210fedcba9876543210"
+)
+
+func TestRequireUserOrAPIKey(t *testing.T) {
+	useTestKeys(t)
+	cacheTestAPIKey(t, "partner-read", scopeRead)
+	handler := stubRouter(requireUserOrAPIKey,
+		"GET /users/{id}/notifications",
+		"POST /users/{id}/notifications/mark-read",
+		"POST /users/{id}/devices",
+		"PUT /users/{id}/saved-searches/{search_id}",
+		"DELETE /users/{id}/waitlist/{waitlist_id}",
+	)
+
+	tests := []struct {
+		name, method, path string
+		header, value      string
+		want               int
+	}{
+		{"anonymous", "GET", "/users/" + testUserID + "/notifications", "", "", http.StatusUnauthorized},
+		{"own token", "GET", "/users/" + testUserID + "/notifications", "Authorization", "Bearer " + userTokens.sign(testUserID, time.Now().Add(time.Hour)), http.StatusOK},
+		{"own token marking read", "POST", "/users/" + testUserID + "/notifications/mark-read", "Authorization", "Bearer " + userTokens.sign(testUserID, time.Now().Add(time.Hour)), http.StatusOK},
+		{"another user's token", "GET", "/users/" + otherUserID + "/notifications", "Authorization", "Bearer " + userTokens.sign(testUserID, time.Now().Add(time.Hour)), http.StatusForbidden},
+		{"expired token", "GET", "/users/" + testUserID + "/notifications", "Authorization", "Bearer " + userTokens.sign(testUserID, time.Now().Add(-time.Minute)), http.StatusUnauthorized},
+		{"agent token", "GET", "/users/" + testUserID + "/notifications", "Authorization", "Bearer " + signAgentToken(testUserID, time.Now().Add(time.Hour)), http.StatusUnauthorized},
+		{"forged token", "GET", "/users/" + testUserID + "/notifications", "Authorization", "Bearer " + userTokens.sign(testUserID, time.Now().Add(time.Hour)) + "x", http.StatusUnauthorized},
+		{"device of the token's user", "POST", "/users/" + testUserID + "/devices", "Authorization", "Bearer " + userTokens.sign(testUserID, time.Now().Add(time.Hour)), http.StatusOK},
+		{"device of another user", "POST", "/users/" + otherUserID + "/devices", "Authorization", "Bearer " + userTokens.sign(testUserID, time.Now().Add(time.Hour)), http.StatusForbidden},
+		{"anonymous device", "POST", "/users/" + testUserID + "/devices", "", "", http.StatusUnauthorized},
+		{"saved search of the token's user", "PUT", "/users/" + testUserID + "/saved-searches/" + otherUserID, "Authorization", "Bearer " + userTokens.sign(testUserID, time.Now().Add(time.Hour)), http.StatusOK},
+		{"saved search of another user", "PUT", "/users/" + otherUserID + "/saved-searches/" + testUserID, "Authorization", "Bearer " + userTokens.sign(testUserID, time.Now().Add(time.Hour)), http.StatusForbidden},
+		{"waitlist entry of the token's user", "DELETE", "/users/" + testUserID + "/waitlist/" + otherUserID, "Authorization", "Bearer " + userTokens.sign(testUserID, time.Now().Add(time.Hour)), http.StatusOK},
+		{"waitlist entry of another user", "DELETE", "/users/" + otherUserID + "/waitlist/" + testUserID, "Authorization", "Bearer " + userTokens.sign(testUserID, time.Now().Add(time.Hour)), http.StatusForbidden},
+		{"anonymous withdrawal", "DELETE", "/users/" + testUserID + "/waitlist/" + otherUserID, "", "", http.StatusUnauthorized},
+		{"shared key", "POST", "/users/" + testUserID + "/notifications/mark-read", "X-API-Key", "test-shared-key", http.StatusOK},
+		{"read key reading", "GET", "/users/" + testUserID + "/notifications", "X-API-Key", "partner-read", http.StatusOK},
+		{"read key writing", "POST", "/users/" + testUserID + "/notifications/mark-read", "X-API-Key", "partner-read", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.header != "" {
+				req.Header.Set(tt.header, tt.value)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("status %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+		})
+	}
+}
+
+func TestTokenKindsAreSeparate(t *testing.T) {
+	useTestKeys(t)
+	expiry := time.Now().Add(time.Hour)
+	if _, err := verifyAgentToken(userTokens.sign(testUserID, expiry)); err != errInvalidAgentToken {
+		t.Errorf("user token as agent token: %v", err)
+	}
+	if id, err := verifyAgentToken(signAgentToken(testUserID, expiry)); err != nil || id != testUserID {
+		t.Errorf("agent token: %q, %v", id, err)
+	}
+	if id, err := userTokens.verify(userTokens.sign(testUserID, expiry)); err != nil || id != testUserID {
+		t.Errorf("user token: %q, %v", id, err)
+	}
+}
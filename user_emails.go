@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// legacyUserEmailIndex was the unique index on email alone, which also counted soft-deleted users
+const legacyUserEmailIndex = "email_1"
+
+// userReferences are the collections that point at a user with its hex id in user_id
+var userReferences = []string{"appointments", "inquiries", "notifications", "devices", "saved_searches", "waitlist"}
+
+// dedupUsers is `migrate dedup-users`, run before `migrate indexes`: live users sharing an email,
+// compared with emailCollation, are merged into the oldest of them. The references of the others move
+// to it and they are soft-deleted, so they stay restorable by id. It also drops legacyUserEmailIndex.
+func dedupUsers(ctx context.Context, args []string) error {
+	db := client.Database("MVDB")
+	users := db.Collection("users")
+	var cmdErr mongo.CommandError
+	if _, err := users.Indexes().DropOne(ctx, legacyUserEmailIndex); err != nil && !(errors.As(err, &cmdErr) && cmdErr.Name == "IndexNotFound") {
+		return fmt.Errorf("users index %s: %w", legacyUserEmailIndex, err)
+	}
+
+	cur, err := users.Aggregate(ctx, []bson.M{
+		{"$match": notDeleted(bson.M{"email": bson.M{"$type": "string"}})},
+		{"$sort": bson.M{"_id": 1}},
+		{"$group": bson.M{"_id": "$email", "ids": bson.M{"$push": "$_id"}}},
+		{"$match": bson.M{"ids.1": bson.M{"$exists": true}}},
+	}, options.Aggregate().SetCollation(emailCollation))
+	if err != nil {
+		return fmt.Errorf("users: %w", err)
+	}
+	var groups []struct {
+		Email string               `bson:"_id"`
+		IDs   []primitive.ObjectID `bson:"ids"`
+	}
+	if err := cur.All(ctx, &groups); err != nil {
+		return fmt.Errorf("users: %w", err)
+	}
+
+	now := time.Now()
+	merged := 0
+	for _, g := range groups {
+		keep, duplicates := g.IDs[0], g.IDs[1:]
+		hexes := make(bson.A, len(duplicates))
+		for i, id := range duplicates {
+			hexes[i] = id.Hex()
+		}
+		for _, collectionName := range userReferences {
+			if _, err := db.Collection(collectionName).UpdateMany(ctx, bson.M{"user_id": bson.M{"$in": hexes}},
+				bson.M{"$set": bson.M{"user_id": keep.Hex()}}); err != nil {
+				return fmt.Errorf("%s of %q: %w", collectionName, g.Email, err)
+			}
+		}
+		if _, err := softDelete(ctx, "users", bson.M{"_id": bson.M{"$in": duplicates}}, now); err != nil {
+			return fmt.Errorf("users %q: %w", g.Email, err)
+		}
+		merged += len(duplicates)
+	}
+	log.Printf("dedup-users: %d users merged into %d", merged, len(groups))
+	return nil
+}
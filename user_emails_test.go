@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestDedupUsersRunsBeforeIndexes(t *testing.T) {
+	if slices.Index(migrationOrder, "dedup-users") > slices.Index(migrationOrder, "indexes") {
+		t.Errorf("migrationOrder %v builds the unique email index before merging duplicates", migrationOrder)
+	}
+}
+
+func postUser(t *testing.T, email string) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	createUser(rec, httptest.NewRequest(http.MethodPost, "/add/user", strings.NewReader(`{"name":"Test","email":"`+email+`"}`)))
+	return rec
+}
+
+// TestUserEmailUnique: a live user's email, in any case, can't sign up again, a deleted user's can,
+// and the deleted user can't be restored over the new one
+func TestUserEmailUnique(t *testing.T) {
+	useTestMongo(t, "users", "audit_logs")
+	ctx := context.Background()
+	if _, err := client.Database("MVDB").Collection("users").Indexes().CreateMany(ctx, collectionIndexes["users"]); err != nil {
+		t.Fatal(err)
+	}
+
+	first := postUser(t, "buyer@example.com")
+	if first.Code != http.StatusCreated {
+		t.Fatalf("first sign-up: status %d, %s", first.Code, first.Body)
+	}
+	if rec := postUser(t, "Buyer@Example.com"); rec.Code != http.StatusConflict {
+		t.Fatalf("same email in another case: status %d, want 409", rec.Code)
+	}
+
+	var user User
+	if err := client.Database("MVDB").Collection("users").FindOne(ctx, bson.M{"email": "buyer@example.com"}).Decode(&user); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := softDelete(ctx, "users", bson.M{"_id": user.ID}, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if rec := postUser(t, "buyer@example.com"); rec.Code != http.StatusCreated {
+		t.Fatalf("email of a deleted user: status %d, want 201", rec.Code)
+	}
+
+	rec := httptest.NewRecorder()
+	restoreUser(rec, mux.SetURLVars(httptest.NewRequest(http.MethodPost, "/users/"+user.ID.Hex()+"/restore", nil), map[string]string{"id": user.ID.Hex()}))
+	if rec.Code != http.StatusConflict {
+		t.Errorf("restore over a live user with the email: status %d, want 409", rec.Code)
+	}
+}
+
+func TestDedupUsers(t *testing.T) {
+	useTestMongo(t, "users", "appointments")
+	ctx := context.Background()
+	db := client.Database("MVDB")
+	oldest, newer, other := primitive.NewObjectID(), primitive.NewObjectID(), primitive.NewObjectID()
+	if _, err := db.Collection("users").InsertMany(ctx, []interface{}{
+		User{ID: oldest, Email: "buyer@example.com"},
+		User{ID: newer, Email: "BUYER@example.com"},
+		User{ID: other, Email: "other@example.com"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Collection("appointments").InsertOne(ctx, Appointment{UserID: newer.Hex()}); err != nil {
+		t.Fatal(err)
+	}
+
+	for run := 0; run < 2; run++ { // idempotent
+		if err := dedupUsers(ctx, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	live, err := findIDs(ctx, "users", notDeleted(bson.M{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(live) != 2 || !slices.Contains(live, oldest) || !slices.Contains(live, other) {
+		t.Errorf("live users %v, want %s and %s", live, oldest.Hex(), other.Hex())
+	}
+	if n, err := db.Collection("appointments").CountDocuments(ctx, bson.M{"user_id": oldest.Hex()}); err != nil || n != 1 {
+		t.Errorf("%d appointments moved to the kept user (%v)", n, err)
+	}
+	if _, err := db.Collection("users").Indexes().CreateMany(ctx, collectionIndexes["users"]); err != nil {
+		t.Errorf("the unique index after the merge: %v", err)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/LynnT-2003/mv-realty-backend/imagemeta"
+)
+
+// Allowed values for the enum-like Listing fields
+var (
+	listingTypes     = []string{"sale", "rent"}
+	facingDirections = []string{"N", "S", "E", "W", "NE", "NW", "SE", "SW"}
+	listingStatuses  = []string{"active", "inactive"}
+)
+
+// appointmentStatuses are the values of Appointment.Status. A scheduled appointment becomes
+// confirmed when the user follows the link in the booking email, see appointment_links.go.
+var appointmentStatuses = []string{"scheduled", "confirmed", "completed", "cancelled"}
+
+// openAppointmentStatuses are the appointments that still take place
+var openAppointmentStatuses = []string{"scheduled", "confirmed"}
+
+func isOneOf(value string, allowed []string) bool {
+	for _, a := range allowed {
+		if value == a {
+			return true
+		}
+	}
+	return false
+}
+
+// validateListingFields checks the listing's own fields (not its references) and returns every problem found
+func validateListingFields(listing *Listing) []string {
+	var problems []string
+	switch {
+	case listing.Price < 0:
+		problems = append(problems, "price must not be negative")
+	case listing.Price == 0 && listing.ListingType == "rent":
+		problems = append(problems, "price, the monthly rent, is required for rent listings")
+	case listing.Price == 0 && listing.ListingType == "sale":
+		problems = append(problems, "price is required for sale listings")
+	}
+	if listing.Size < 0 {
+		problems = append(problems, "size must not be negative")
+	}
+	if listing.Bedroom < 0 || listing.Bathroom < 0 {
+		problems = append(problems, "bedroom and bathroom must not be negative")
+	}
+	if !isOneOf(listing.ListingType, listingTypes) {
+		problems = append(problems, fmt.Sprintf("listing_type must be one of %s", strings.Join(listingTypes, ", ")))
+	}
+	if listing.FacingDirection != "" && !isOneOf(listing.FacingDirection, facingDirections) {
+		problems = append(problems, fmt.Sprintf("facing_direction must be one of %s", strings.Join(facingDirections, ", ")))
+	}
+	if listing.Currency != "" && !isOneOf(listing.Currency, currencies) {
+		problems = append(problems, fmt.Sprintf("currency must be one of %s", strings.Join(currencies, ", ")))
+	}
+	if listing.AvailableFrom != nil && listing.AvailableFrom.After(time.Now().AddDate(maxAvailableFromAhead, 0, 0)) {
+		problems = append(problems, "available_from must not be more than 2 years ahead")
+	}
+	if listing.Publication != "" && !isOneOf(listing.Publication, publicationStates) {
+		problems = append(problems, fmt.Sprintf("publication_state must be one of %s", strings.Join(publicationStates, ", ")))
+	}
+	if !isOneOf(listing.ListingStatus, listingStatuses) {
+		problems = append(problems, fmt.Sprintf("listing_status must be one of %s", strings.Join(listingStatuses, ", ")))
+	}
+	problems = append(problems, feeProblems(listing)...)
+	problems = append(problems, imagemeta.Problems("photos", listing.Photos)...)
+	return problems
+}
+
+// validationError carries every problem found with a submitted document
+type validationError struct {
+	Problems []string
+}
+
+func (e *validationError) Error() string {
+	return strings.Join(e.Problems, "; ")
+}
+
+// validatePropertyFields checks a submitted property and returns every problem found
+func validatePropertyFields(property *Property) []string {
+	var problems []string
+	if strings.TrimSpace(property.Title) == "" {
+		problems = append(problems, "Title is required")
+	}
+	if property.MinPrice < 0 || property.MaxPrice < 0 {
+		problems = append(problems, "MinPrice and MaxPrice must not be negative")
+	}
+	if property.MaxPrice != 0 && property.MinPrice > property.MaxPrice {
+		problems = append(problems, "MinPrice must not exceed MaxPrice")
+	}
+	if property.CommonFee < 0 || property.SinkingFund < 0 {
+		problems = append(problems, "CommonFeePerSqm and SinkingFundPerSqm must not be negative")
+	}
+	if property.TotalUnits < 0 || property.TotalFloors < 0 {
+		problems = append(problems, "TotalUnits and TotalFloors must not be negative")
+	}
+	if property.Completed != 0 && (property.Completed < 1900 || property.Completed > time.Now().Year()+10) {
+		problems = append(problems, "YearCompleted must be a year between 1900 and ten years from now")
+	}
+	problems = append(problems, completionProblems(property)...)
+	problems = append(problems, imagemeta.Problems("Images", property.Images)...)
+	return problems
+}
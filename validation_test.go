@@ -0,0 +1,39 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// TestValidateListingByType: what a listing needs depends on whether it is for sale or for rent
+func TestValidateListingByType(t *testing.T) {
+	tests := []struct {
+		name    string
+		listing Listing
+		want    []string
+	}{
+		{"a valid sale", Listing{ListingType: "sale", ListingStatus: "active", Price: 8500000}, nil},
+		{"a valid rent", Listing{ListingType: "rent", ListingStatus: "active", Price: 25000, DepositMonths: 2, AdvanceMonths: 1}, nil},
+		{"a sale without a price", Listing{ListingType: "sale", ListingStatus: "active"},
+			[]string{"price is required for sale listings"}},
+		{"a rent without a monthly rent", Listing{ListingType: "rent", ListingStatus: "active", DepositMonths: 2},
+			[]string{"price, the monthly rent, is required for rent listings"}},
+		{"a sale with a deposit", Listing{ListingType: "sale", ListingStatus: "active", Price: 8500000, DepositMonths: 2},
+			[]string{"deposit_months and advance_months only apply to rent listings"}},
+		{"a sale with advance rent", Listing{ListingType: "sale", ListingStatus: "active", Price: 8500000, AdvanceMonths: 1},
+			[]string{"deposit_months and advance_months only apply to rent listings"}},
+		{"a rent with a negative deposit", Listing{ListingType: "rent", ListingStatus: "active", Price: 25000, DepositMonths: -1},
+			[]string{"deposit_months and advance_months must not be negative"}},
+		{"a rent with too much advance rent", Listing{ListingType: "rent", ListingStatus: "active", Price: 25000, AdvanceMonths: 13},
+			[]string{"deposit_months and advance_months must be at most 12"}},
+		{"a negative price", Listing{ListingType: "rent", ListingStatus: "active", Price: -1},
+			[]string{"price must not be negative"}},
+		{"no listing type", Listing{ListingStatus: "active", DepositMonths: 1},
+			[]string{"listing_type must be one of sale, rent", "deposit_months and advance_months only apply to rent listings"}},
+	}
+	for _, tt := range tests {
+		if got := validateListingFields(&tt.listing); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/LynnT-2003/mv-realty-backend/imagemeta"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	maxVideos           = 10
+	maxVideoTitleLength = 200 // characters
+)
+
+var videoProviders = []string{"youtube", "vimeo", "cloudinary"}
+
+// Video is a tour video on a property or listing. Provider is inferred from the URL host when the
+// video is added; only hosts from videoProviders are accepted since the URL ends up in an iframe.
+type Video struct {
+	URL      string `bson:"url" json:"url"`
+	Provider string `bson:"provider" json:"provider"`
+	Title    string `bson:"title,omitempty" json:"title,omitempty"`
+}
+
+// MarshalJSON adds embeddable_url, the iframe src for the video
+func (v Video) MarshalJSON() ([]byte, error) {
+	type video Video
+	embed, _ := embeddableVideoURL(v.URL)
+	return json.Marshal(struct {
+		video
+		EmbeddableURL string `json:"embeddable_url"`
+	}{video(v), embed})
+}
+
+var (
+	youtubeID = regexp.MustCompile(`^[A-Za-z0-9_-]{11}$`)
+	vimeoID   = regexp.MustCompile(`^[0-9]+$`)
+	vimeoHash = regexp.MustCompile(`^[0-9a-f]+$`)
+
+	errVideoHost = errors.New("url must be a YouTube, Vimeo or Cloudinary video")
+)
+
+// parseVideoURL returns the provider of a video URL and its embeddable form. Anything that isn't a
+// recognisable https video URL on a known host is rejected.
+func parseVideoURL(raw string) (provider, embed string, err error) {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil || u.Scheme != "https" || u.User != nil {
+		return "", "", errVideoHost
+	}
+	host := strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+	segments := strings.Split(strings.Trim(u.Path, "/"), "/")
+	switch host {
+	case "youtu.be":
+		return youtubeEmbed(segments[0])
+	case "youtube.com", "m.youtube.com", "youtube-nocookie.com":
+		if segments[0] == "watch" {
+			return youtubeEmbed(u.Query().Get("v"))
+		}
+		if len(segments) == 2 && (segments[0] == "embed" || segments[0] == "shorts" || segments[0] == "live") {
+			return youtubeEmbed(segments[1])
+		}
+	case "vimeo.com":
+		// vimeo.com/<id> or vimeo.com/<id>/<hash> for unlisted videos
+		if vimeoID.MatchString(segments[0]) {
+			return vimeoEmbed(segments[0], segments[1:])
+		}
+	case "player.vimeo.com":
+		if len(segments) == 2 && segments[0] == "video" && vimeoID.MatchString(segments[1]) {
+			return "vimeo", "https://player.vimeo.com/video/" + segments[1] + hashQuery(u.Query().Get("h")), nil
+		}
+	case "res.cloudinary.com":
+		// res.cloudinary.com/<cloud>/video/upload/.../<public_id>.<ext>
+		if len(segments) > 3 && segments[1] == "video" && segments[2] == "upload" {
+			if publicID := imagemeta.PublicIDFromURL(u.String()); publicID != "" {
+				return "cloudinary", "https://player.cloudinary.com/embed/?" + url.Values{
+					"cloud_name": {segments[0]},
+					"public_id":  {publicID},
+				}.Encode(), nil
+			}
+		}
+	}
+	return "", "", errVideoHost
+}
+
+func youtubeEmbed(id string) (string, string, error) {
+	if !youtubeID.MatchString(id) {
+		return "", "", errVideoHost
+	}
+	return "youtube", "https://www.youtube-nocookie.com/embed/" + id, nil
+}
+
+func vimeoEmbed(id string, rest []string) (string, string, error) {
+	hash := ""
+	if len(rest) == 1 {
+		hash = rest[0]
+	}
+	return "vimeo", "https://player.vimeo.com/video/" + id + hashQuery(hash), nil
+}
+
+func hashQuery(hash string) string {
+	if hash == "" || !vimeoHash.MatchString(hash) {
+		return ""
+	}
+	return "?h=" + hash
+}
+
+func embeddableVideoURL(raw string) (string, bool) {
+	_, embed, err := parseVideoURL(raw)
+	return embed, err == nil
+}
+
+// addPropertyVideo adds a video to a property
+func addPropertyVideo(w http.ResponseWriter, r *http.Request) {
+	addVideo(w, r, "properties", "Property")
+}
+
+// addListingVideo adds a video to a listing
+func addListingVideo(w http.ResponseWriter, r *http.Request) {
+	addVideo(w, r, "listings", "Listing")
+}
+
+// removePropertyVideo removes the video with ?url= from a property
+func removePropertyVideo(w http.ResponseWriter, r *http.Request) {
+	removeVideo(w, r, "properties", "Property")
+}
+
+// removeListingVideo removes the video with ?url= from a listing
+func removeListingVideo(w http.ResponseWriter, r *http.Request) {
+	removeVideo(w, r, "listings", "Listing")
+}
+
+// addVideo validates the body, infers the provider and appends the video. The same video under a
+// different URL (a youtu.be link for a watch link) counts as a duplicate.
+func addVideo(w http.ResponseWriter, r *http.Request, collectionName, entity string) {
+	w.Header().Set("Content-Type", "application/json")
+
+	id, ok := pathObjectID(w, r, entity)
+	if !ok {
+		return
+	}
+	var video Video
+	if err := json.NewDecoder(r.Body).Decode(&video); err != nil {
+		http.Error(w, "Failed to parse request body", http.StatusBadRequest)
+		return
+	}
+	video.URL = strings.TrimSpace(video.URL)
+	provider, embed, err := parseVideoURL(video.URL)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	video.Provider = provider
+	video.Title = imagemeta.CleanText(video.Title)
+	if utf8.RuneCountInString(video.Title) > maxVideoTitleLength {
+		http.Error(w, "title must be at most 200 characters", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	collection := client.Database("MVDB").Collection(collectionName)
+	var doc struct {
+		Videos    []Video   `bson:"videos"`
+		UpdatedAt time.Time `bson:"updated_at"`
+	}
+	err = collection.FindOne(ctx, notDeleted(bson.M{"_id": id})).Decode(&doc)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, entity+" not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to retrieve "+entity, http.StatusInternalServerError)
+		return
+	}
+	for _, existing := range doc.Videos {
+		if e, _ := embeddableVideoURL(existing.URL); e == embed {
+			http.Error(w, entity+" already has this video", http.StatusConflict)
+			return
+		}
+	}
+	if len(doc.Videos) >= maxVideos {
+		http.Error(w, entity+" already has the maximum of 10 videos", http.StatusBadRequest)
+		return
+	}
+
+	before := auditSnapshot(ctx, collectionName, id)
+	// Pinned to updated_at so two concurrent adds can't both pass the checks above
+	res, err := collection.UpdateOne(ctx, notDeleted(bson.M{"_id": id, "updated_at": doc.UpdatedAt}), bson.M{
+		"$push": bson.M{"videos": video},
+		"$set":  bson.M{"updated_at": time.Now()},
+	})
+	if err != nil {
+		serverError(w, r, "Failed to add video", err)
+		return
+	}
+	if res.MatchedCount == 0 {
+		http.Error(w, entity+" was modified concurrently, try again", http.StatusConflict)
+		return
+	}
+	recordAudit(auditFromRequest(r), "update", collectionName, id.Hex(), before, auditSnapshot(ctx, collectionName, id), nil)
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(video)
+}
+
+func removeVideo(w http.ResponseWriter, r *http.Request, collectionName, entity string) {
+	w.Header().Set("Content-Type", "application/json")
+
+	id, ok := pathObjectID(w, r, entity)
+	if !ok {
+		return
+	}
+	videoURL := strings.TrimSpace(r.URL.Query().Get("url"))
+	if videoURL == "" {
+		http.Error(w, "url is required", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	collection := client.Database("MVDB").Collection(collectionName)
+	before := auditSnapshot(ctx, collectionName, id)
+	res, err := collection.UpdateOne(ctx, notDeleted(bson.M{"_id": id, "videos.url": videoURL}), bson.M{
+		"$pull": bson.M{"videos": bson.M{"url": videoURL}},
+		"$set":  bson.M{"updated_at": time.Now()},
+	})
+	if err != nil {
+		serverError(w, r, "Failed to remove video", err)
+		return
+	}
+	if res.MatchedCount == 0 {
+		http.Error(w, "Video not found", http.StatusNotFound)
+		return
+	}
+	recordAudit(auditFromRequest(r), "update", collectionName, id.Hex(), before, auditSnapshot(ctx, collectionName, id), nil)
+
+	json.NewEncoder(w).Encode(bson.M{"message": "Video removed"})
+}
+
+var videoURLParam = apiParam{Name: "url", Description: "URL of the video as it was added", Required: true}
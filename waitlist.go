@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// An open appointment holds its slot, the listing at its Appointment_date, as a document of
+// appointment_slots keyed by both. The unique _id is what keeps two bookings off one slot:
+// whoever inserts the slot first gets it, a direct booking and a waitlist promotion alike. When an
+// appointment is cancelled, completed or moved, it releases the slot and the earliest matching
+// waitlist entry is booked into it; a direct booking arriving in between may still win, in which
+// case the entry keeps waiting.
+var errSlotTaken = errors.New("This time is already booked for the listing")
+
+// Values of WaitlistEntry.Status
+const (
+	waitlistWaiting   = "waiting"
+	waitlistPromoted  = "promoted"
+	waitlistWithdrawn = "withdrawn"
+	waitlistFailed    = "failed" // the slot opened but the appointment could not be created, see FailureReason
+)
+
+type appointmentSlot struct {
+	Key             string             `bson:"_id"`
+	AppointmentID   primitive.ObjectID `bson:"appointment_id"`
+	ListingID       string             `bson:"listing_id"`
+	AppointmentDate time.Time          `bson:"appointment_date"` // expires the slot, see collectionIndexes
+}
+
+// WaitlistEntry is a user waiting for a slot of a listing between WindowFrom and WindowTo
+type WaitlistEntry struct {
+	ID            primitive.ObjectID  `bson:"_id,omitempty" json:"waitlist_id,omitempty"`
+	UserID        string              `bson:"user_id" json:"User_id"`
+	PropertyID    string              `bson:"property_id" json:"Property_id"`
+	ListingID     string              `bson:"listing_id" json:"Listing_id"`
+	WindowFrom    time.Time           `bson:"window_from" json:"window_from"`
+	WindowTo      time.Time           `bson:"window_to" json:"window_to"`
+	Status        string              `bson:"status" json:"status"`
+	AppointmentID *primitive.ObjectID `bson:"appointment_id,omitempty" json:"appointment_id,omitempty"`
+	FailureReason string              `bson:"failure_reason,omitempty" json:"failure_reason,omitempty"`
+	CreatedAt     time.Time           `bson:"created_at" json:"created_at"`
+	UpdatedAt     *time.Time          `bson:"updated_at,omitempty" json:"updated_at,omitempty"`
+}
+
+func slotKey(listingID string, date time.Time) string {
+	return listingID + "@" + date.UTC().Format(time.RFC3339)
+}
+
+// claimAppointmentSlot takes the slot of a, whose ID must be set, or returns errSlotTaken. A slot
+// still held by an appointment that is no longer open was not released, e.g. because the instance
+// stopped in between; it is released here, which may hand it to the waitlist first.
+func claimAppointmentSlot(ctx context.Context, a *Appointment) error {
+	db := client.Database("MVDB")
+	slots := db.Collection("appointment_slots")
+	key := slotKey(a.ListingID, a.AppointmentDate)
+	for attempt := 0; ; attempt++ {
+		_, err := slots.InsertOne(ctx, appointmentSlot{Key: key, AppointmentID: a.ID, ListingID: a.ListingID, AppointmentDate: a.AppointmentDate})
+		if err == nil {
+			break
+		}
+		if !mongo.IsDuplicateKeyError(err) {
+			return err
+		}
+		var held appointmentSlot
+		err = slots.FindOne(ctx, bson.M{"_id": key}).Decode(&held)
+		if err == mongo.ErrNoDocuments && attempt == 0 {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if held.AppointmentID == a.ID {
+			return nil
+		}
+		if attempt > 0 {
+			return errSlotTaken
+		}
+		n, err := db.Collection("appointments").CountDocuments(ctx, bson.M{"_id": held.AppointmentID, "status": bson.M{"$in": openAppointmentStatuses}})
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			return errSlotTaken
+		}
+		releaseSlot(ctx, a.ListingID, a.AppointmentDate, held.AppointmentID)
+	}
+
+	// Appointments booked before slots were introduced hold none
+	n, err := db.Collection("appointments").CountDocuments(ctx, bson.M{
+		"_id":              bson.M{"$ne": a.ID},
+		"listing_id":       a.ListingID,
+		"appointment_date": a.AppointmentDate,
+		"status":           bson.M{"$in": openAppointmentStatuses},
+	})
+	if err == nil && n > 0 {
+		err = errSlotTaken
+	}
+	if err != nil {
+		freeAppointmentSlot(ctx, a.ListingID, a.AppointmentDate, a.ID)
+		return err
+	}
+	return nil
+}
+
+// freeAppointmentSlot gives up a slot claimed by an appointment that was then not stored. It does
+// not promote the waitlist; nobody got to see the slot taken.
+func freeAppointmentSlot(ctx context.Context, listingID string, date time.Time, holder primitive.ObjectID) {
+	_, err := client.Database("MVDB").Collection("appointment_slots").DeleteOne(ctx, bson.M{"_id": slotKey(listingID, date), "appointment_id": holder})
+	if err != nil {
+		log.Println("Failed to free the slot of appointment", holder.Hex(), ":", err)
+	}
+}
+
+// releaseAppointmentSlot releases the slot of an appointment that was cancelled, completed or moved
+// away from date, and books the first waiting user into it. Like createNotification it has its own
+// timeout and only logs, so it runs after the response.
+func releaseAppointmentSlot(listingID string, date time.Time, holder primitive.ObjectID) {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	releaseSlot(ctx, listingID, date, holder)
+}
+
+func releaseSlot(ctx context.Context, listingID string, date time.Time, holder primitive.ObjectID) {
+	res, err := client.Database("MVDB").Collection("appointment_slots").DeleteOne(ctx, bson.M{"_id": slotKey(listingID, date), "appointment_id": holder})
+	if err != nil {
+		log.Println("Failed to release the slot of appointment", holder.Hex(), ":", err)
+		return
+	}
+	// Nothing to promote when the slot was already released or held by another appointment
+	if res.DeletedCount > 0 {
+		promoteWaitlist(ctx, listingID, date)
+	}
+}
+
+// promoteWaitlist books the earliest waiting entry whose window contains date into the free slot.
+// Entries that can no longer be booked, e.g. because the listing or the user was deleted, are
+// marked failed and the next one is tried.
+func promoteWaitlist(ctx context.Context, listingID string, date time.Time) {
+	if !date.After(time.Now()) {
+		return
+	}
+	waitlist := client.Database("MVDB").Collection("waitlist")
+	for {
+		appointmentID := primitive.NewObjectID()
+		now := time.Now()
+		var entry WaitlistEntry
+		err := waitlist.FindOneAndUpdate(ctx, bson.M{
+			"listing_id":  listingID,
+			"status":      waitlistWaiting,
+			"window_from": bson.M{"$lte": date},
+			"window_to":   bson.M{"$gte": date},
+		}, bson.M{"$set": bson.M{"status": waitlistPromoted, "appointment_id": appointmentID, "updated_at": now}},
+			options.FindOneAndUpdate().SetSort(bson.D{{Key: "created_at", Value: 1}}).SetReturnDocument(options.After)).Decode(&entry)
+		if err == mongo.ErrNoDocuments {
+			return
+		}
+		if err != nil {
+			log.Println("Failed to find a waitlist entry for listing", listingID, ":", err)
+			return
+		}
+
+		appointment := Appointment{ID: appointmentID, UserID: entry.UserID, PropertyID: entry.PropertyID, ListingID: listingID, AppointmentDate: date}
+		_, err = insertAppointment(ctx, &appointment)
+		if err == errSlotTaken {
+			// A direct booking got the slot first
+			_, err = waitlist.UpdateOne(ctx, bson.M{"_id": entry.ID},
+				bson.M{"$set": bson.M{"status": waitlistWaiting, "updated_at": time.Now()}, "$unset": bson.M{"appointment_id": ""}})
+			if err != nil {
+				log.Println("Failed to put waitlist entry", entry.ID.Hex(), "back to waiting:", err)
+			}
+			return
+		}
+		if err != nil {
+			log.Println("Failed to book waitlist entry", entry.ID.Hex(), ":", err)
+			_, err = waitlist.UpdateOne(ctx, bson.M{"_id": entry.ID},
+				bson.M{"$set": bson.M{"status": waitlistFailed, "failure_reason": err.Error(), "updated_at": time.Now()}, "$unset": bson.M{"appointment_id": ""}})
+			if err != nil {
+				log.Println("Failed to mark waitlist entry", entry.ID.Hex(), "failed:", err)
+			}
+			continue
+		}
+		auditCreated(auditMeta{Actor: "waitlist"}, "appointments", appointmentID, appointment)
+		go notifyAppointmentChange(appointment, notificationWaitlistPromoted)
+		go emailAppointmentLinks(appointment)
+		go notifyAgentOfAppointment(appointment, agentEventAppointmentBooked)
+		return
+	}
+}
+
+// parseWaitlistWindow reads ?window_from= and ?window_to= (RFC3339 or YYYY-MM-DD) of a booking
+// with ?waitlist=true. Both default to the requested Appointment_date, which the window must contain.
+func parseWaitlistWindow(r *http.Request, date time.Time) (time.Time, time.Time, error) {
+	from, to := date, date
+	q := r.URL.Query()
+	var err error
+	if raw := q.Get("window_from"); raw != "" {
+		if from, err = parseDateOrTime(raw); err != nil {
+			return from, to, errors.New("window_from must be RFC3339 or YYYY-MM-DD")
+		}
+	}
+	if raw := q.Get("window_to"); raw != "" {
+		if to, err = parseDateOrTime(raw); err != nil {
+			return from, to, errors.New("window_to must be RFC3339 or YYYY-MM-DD")
+		}
+	}
+	if from.After(date) || to.Before(date) {
+		return from, to, errors.New("The waitlist window must contain Appointment_date")
+	}
+	return from.UTC(), to.UTC(), nil
+}
+
+// joinWaitlist answers a booking of a taken slot made with ?waitlist=true with 202 and the stored
+// entry instead of 409. The appointment was already validated by insertAppointment.
+func joinWaitlist(ctx context.Context, w http.ResponseWriter, r *http.Request, appointment Appointment, from, to time.Time) {
+	entry := WaitlistEntry{
+		UserID:     appointment.UserID,
+		PropertyID: appointment.PropertyID,
+		ListingID:  appointment.ListingID,
+		WindowFrom: from,
+		WindowTo:   to,
+		Status:     waitlistWaiting,
+		CreatedAt:  time.Now(),
+	}
+	id, err := insertWithReferences(ctx, "waitlist", entry,
+		reference{Collection: "users", ID: entry.UserID, Invalid: errInvalidUserID, Missing: errUserNotFound, Check: errUserCheck})
+	switch {
+	case err == nil:
+	case err == errInvalidUserID, err == errUserNotFound:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	default:
+		serverError(w, r, "Failed to join the waitlist", err)
+		return
+	}
+	entry.ID, _ = id.(primitive.ObjectID)
+	auditCreated(auditFromRequest(r), "waitlist", id, entry)
+	// The slot may have been released while the entry was stored
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+		defer cancel()
+		if n, err := client.Database("MVDB").Collection("appointment_slots").CountDocuments(ctx,
+			bson.M{"_id": slotKey(appointment.ListingID, appointment.AppointmentDate)}); err == nil && n == 0 {
+			promoteWaitlist(ctx, appointment.ListingID, appointment.AppointmentDate)
+		}
+	}()
+
+	w.Header().Set("Location", "/users/"+entry.UserID+"/waitlist/"+entry.ID.Hex())
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(entry)
+}
+
+// getListingWaitlist answers GET /listings/{id}/waitlist for the listing's agent, oldest entry
+// first. ?status= is waiting by default; all returns every entry.
+func getListingWaitlist(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	id, ok := pathObjectID(w, r, "Listing")
+	if !ok {
+		return
+	}
+	filter := bson.M{"listing_id": id.Hex()}
+	switch status := r.URL.Query().Get("status"); status {
+	case "":
+		filter["status"] = waitlistWaiting
+	case "all":
+	case waitlistWaiting, waitlistPromoted, waitlistWithdrawn, waitlistFailed:
+		filter["status"] = status
+	default:
+		http.Error(w, "status must be waiting, promoted, withdrawn, failed or all", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	entries, err := findAllWith[WaitlistEntry](ctx, "waitlist", filter, options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}}))
+	if err != nil {
+		serverError(w, r, "Failed to retrieve the waitlist", err)
+		return
+	}
+	json.NewEncoder(w).Encode(entries)
+}
+
+// withdrawWaitlistEntry answers DELETE /users/{id}/waitlist/{waitlist_id}. Like saved searches an
+// entry is only reachable through its user; only waiting entries can be withdrawn.
+func withdrawWaitlistEntry(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, ok := pathObjectID(w, r, "User")
+	if !ok {
+		return
+	}
+	id, ok := pathVarObjectID(w, r, "waitlist_id", "Waitlist")
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	collection := client.Database("MVDB").Collection("waitlist")
+	filter := bson.M{"_id": id, "user_id": userID.Hex()}
+	before := auditSnapshot(ctx, "waitlist", id)
+	var entry WaitlistEntry
+	err := collection.FindOneAndUpdate(ctx, bson.M{"_id": id, "user_id": userID.Hex(), "status": waitlistWaiting},
+		bson.M{"$set": bson.M{"status": waitlistWithdrawn, "updated_at": time.Now()}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&entry)
+	if err == mongo.ErrNoDocuments {
+		if n, err := collection.CountDocuments(ctx, filter); err == nil && n > 0 {
+			http.Error(w, "Only waiting entries can be withdrawn", http.StatusConflict)
+			return
+		}
+		http.Error(w, "Waitlist entry not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		serverError(w, r, "Failed to withdraw the waitlist entry", err)
+		return
+	}
+	recordAudit(auditFromRequest(r), "update", "waitlist", id.Hex(), before, entry, nil)
+	json.NewEncoder(w).Encode(entry)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/LynnT-2003/mv-realty-backend/imagemeta"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Uploaded images can carry the logo in WATERMARK_LOGO (a Cloudinary public_id) as an overlay,
+// WATERMARK_OPACITY percent opaque (default 50) at WATERMARK_GRAVITY (default south_east) and
+// WATERMARK_WIDTH of the image wide (default 0.2). WATERMARK_UPLOADS=true watermarks every upload;
+// ?watermark=true or false on an upload overrides it.
+const (
+	defaultWatermarkOpacity = 50
+	defaultWatermarkGravity = "south_east"
+	defaultWatermarkWidth   = 0.2
+)
+
+// watermarkedImageFields are the image lists POST /admin/images/watermark rewrites
+var watermarkedImageFields = map[string]string{"properties": "images", "listings": "photos"}
+
+// watermarkSettings reads the watermark from the environment, nil when WATERMARK_LOGO is not set
+func watermarkSettings() (*imagemeta.Watermark, []string) {
+	logo := os.Getenv("WATERMARK_LOGO")
+	if logo == "" {
+		return nil, nil
+	}
+	wm := imagemeta.Watermark{
+		LogoPublicID: logo,
+		Opacity:      defaultWatermarkOpacity,
+		Gravity:      defaultWatermarkGravity,
+		Width:        defaultWatermarkWidth,
+	}
+	var problems []string
+	if raw := os.Getenv("WATERMARK_OPACITY"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			problems = append(problems, "WATERMARK_OPACITY must be a whole number")
+		}
+		wm.Opacity = n
+	}
+	if raw := os.Getenv("WATERMARK_GRAVITY"); raw != "" {
+		wm.Gravity = raw
+	}
+	if raw := os.Getenv("WATERMARK_WIDTH"); raw != "" {
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			problems = append(problems, "WATERMARK_WIDTH must be a number")
+		}
+		wm.Width = f
+	}
+	if len(problems) == 0 {
+		problems = wm.Problems()
+	}
+	return &wm, problems
+}
+
+// uploadWatermark is the watermark for an upload request, nil for none. It answers 400 for a bad
+// ?watermark= and 503 when one is asked for but not configured, and returns false.
+func uploadWatermark(w http.ResponseWriter, r *http.Request) (*imagemeta.Watermark, bool) {
+	want := os.Getenv("WATERMARK_UPLOADS") == "true"
+	if raw := r.URL.Query().Get("watermark"); raw != "" {
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			http.Error(w, "watermark must be true or false", http.StatusBadRequest)
+			return nil, false
+		}
+		want = b
+	}
+	if !want {
+		return nil, true
+	}
+	wm, problems := watermarkSettings()
+	if wm == nil || len(problems) > 0 {
+		http.Error(w, "Watermarking is not configured, check WATERMARK_LOGO and the WATERMARK_ settings", http.StatusServiceUnavailable)
+		return nil, false
+	}
+	return wm, true
+}
+
+// rewriteWatermarks answers POST /admin/images/watermark: the stored URLs of every property image and
+// listing photo on Cloudinary get the current watermark, or lose it with ?remove=true. Nothing is
+// uploaded again; the overlay is only part of the delivery URL.
+func rewriteWatermarks(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	remove := r.URL.Query().Get("remove") == "true"
+	var wm *imagemeta.Watermark
+	if !remove {
+		var problems []string
+		wm, problems = watermarkSettings()
+		if wm == nil {
+			http.Error(w, "Watermarking is not configured, WATERMARK_LOGO is not set", http.StatusServiceUnavailable)
+			return
+		}
+		if len(problems) > 0 {
+			http.Error(w, "Watermarking is misconfigured: "+(&validationError{Problems: problems}).Error(), http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Minute)
+	defer cancel()
+
+	updated := map[string]int64{}
+	for collectionName, field := range watermarkedImageFields {
+		n, err := rewriteCollectionWatermarks(ctx, collectionName, field, wm)
+		if err != nil {
+			serverError(w, r, "Failed to rewrite the images of "+collectionName, err)
+			return
+		}
+		updated[collectionName] = n
+		invalidateResponses(collectionName)
+	}
+	details := bson.M{"remove": remove, "updated": updated}
+	if wm != nil {
+		details["transformation"] = wm.Transformation()
+	}
+	recordAudit(auditFromRequest(r), "watermark", "", "", nil, nil, details)
+	json.NewEncoder(w).Encode(details)
+}
+
+// rewriteCollectionWatermarks applies wm, or removes the watermark when nil, to the images in field of
+// every document with a Cloudinary image and returns how many documents changed
+func rewriteCollectionWatermarks(ctx context.Context, collectionName, field string, wm *imagemeta.Watermark) (int64, error) {
+	collection := client.Database("MVDB").Collection(collectionName)
+	// Legacy images are bare URL strings, they match the second branch and are stored as documents after
+	cloudinaryURL := bson.M{"$regex": `cloudinary\.com/`}
+	cursor, err := collection.Find(ctx, bson.M{"$or": bson.A{bson.M{field + ".url": cloudinaryURL}, bson.M{field: cloudinaryURL}}},
+		options.Find().SetProjection(bson.M{field: 1}))
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	var updated int64
+	for cursor.Next(ctx) {
+		var doc struct {
+			ID primitive.ObjectID `bson:"_id"`
+		}
+		var images []imagemeta.Image
+		if err := cursor.Decode(&doc); err != nil {
+			return updated, err
+		}
+		if err := cursor.Current.Lookup(field).Unmarshal(&images); err != nil {
+			return updated, err
+		}
+		changed := false
+		for i, img := range images {
+			next := imagemeta.RemoveWatermark(img)
+			if wm != nil {
+				next = wm.Apply(img)
+			}
+			changed = changed || next != img
+			images[i] = next
+		}
+		if !changed {
+			continue
+		}
+		if _, err := collection.UpdateByID(ctx, doc.ID, bson.M{"$set": bson.M{field: images, "updated_at": time.Now()}}); err != nil {
+			return updated, err
+		}
+		updated++
+	}
+	return updated, cursor.Err()
+}
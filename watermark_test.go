@@ -0,0 +1,37 @@
+package main
+
+import "testing"
+
+func TestWatermarkSettings(t *testing.T) {
+	for _, tt := range []struct {
+		env            map[string]string
+		transformation string
+		problems       int
+	}{
+		{map[string]string{}, "", 0},
+		{map[string]string{"WATERMARK_LOGO": "brand/logo"}, "l_brand:logo,o_50,g_south_east,x_20,y_20,w_0.2,fl_relative", 0},
+		{map[string]string{"WATERMARK_LOGO": "logo", "WATERMARK_OPACITY": "80", "WATERMARK_GRAVITY": "center", "WATERMARK_WIDTH": "0.35"},
+			"l_logo,o_80,g_center,x_0,y_0,w_0.35,fl_relative", 0},
+		{map[string]string{"WATERMARK_LOGO": "logo", "WATERMARK_OPACITY": "half"}, "", 1},
+		{map[string]string{"WATERMARK_LOGO": "logo", "WATERMARK_WIDTH": "wide"}, "", 1},
+		{map[string]string{"WATERMARK_LOGO": "logo", "WATERMARK_OPACITY": "0", "WATERMARK_GRAVITY": "top"}, "", 2},
+	} {
+		for _, name := range []string{"WATERMARK_LOGO", "WATERMARK_OPACITY", "WATERMARK_GRAVITY", "WATERMARK_WIDTH"} {
+			t.Setenv(name, tt.env[name])
+		}
+		wm, problems := watermarkSettings()
+		if len(problems) != tt.problems {
+			t.Errorf("%v: problems %q", tt.env, problems)
+			continue
+		}
+		if tt.env["WATERMARK_LOGO"] == "" {
+			if wm != nil {
+				t.Errorf("no logo: %+v", wm)
+			}
+			continue
+		}
+		if tt.transformation != "" && wm.Transformation() != tt.transformation {
+			t.Errorf("%v: %q, want %q", tt.env, wm.Transformation(), tt.transformation)
+		}
+	}
+}
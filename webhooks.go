@@ -0,0 +1,471 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	mathrand "math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Webhooks go out through an outbox in Mongo. recordAudit, which every write calls right after
+// the change, stores one webhook_deliveries document per matching subscription; workers claim
+// deliveries with findAndModify and a lease, so any number of instances can share the queue and a
+// delivery claimed by a process that died is picked up again once its lease runs out. Failed
+// deliveries are retried with exponential backoff until WEBHOOK_MAX_AGE (default 24h) after they
+// were queued, then kept as dead letters for GET /admin/webhooks/dead-letters.
+const (
+	deliveryPending   = "pending"
+	deliveryDelivered = "delivered"
+	deliveryDead      = "dead"
+
+	defaultWebhookWorkers = 2
+	defaultWebhookMaxAge  = 24 * time.Hour
+	webhookLease          = time.Minute // longer than a delivery can take, see webhookClient
+	webhookIdlePoll       = 5 * time.Second
+	webhookRetryBase      = 30 * time.Second
+	webhookRetryMax       = time.Hour
+	webhookFIFODelay      = 5 * time.Second // wait of a delivery queued behind an older one of its subscriber
+	deliveredWebhookTTL   = 7 * 24 * time.Hour
+	webhookSecretPrefix   = "whsec_"
+)
+
+// webhookCollections are the collections whose writes are sent, as "<collection>.<action>" events
+// such as listings.update. Users and API keys hold credentials and are left out.
+var webhookCollections = []string{"properties", "listings", "appointments", "inquiries", "agents"}
+
+var webhookActions = []string{"create", "update", "delete", "restore", "publish", "import"}
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// webhookMaxAge is WEBHOOK_MAX_AGE, a Go duration such as 24h
+var webhookMaxAge = webhookMaxAgeFromEnv()
+
+func webhookMaxAgeFromEnv() time.Duration {
+	if raw := os.Getenv("WEBHOOK_MAX_AGE"); raw != "" {
+		if d, err := time.ParseDuration(raw); err == nil && d > 0 {
+			return d
+		}
+		log.Println("Ignoring invalid WEBHOOK_MAX_AGE:", raw)
+	}
+	return defaultWebhookMaxAge
+}
+
+// WebhookSubscription receives the events it lists, or every event when Events is empty. Each delivery
+// is signed with Secret: X-Webhook-Signature is sha256= and the hex HMAC-SHA256 of the body.
+type WebhookSubscription struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"webhook_id"`
+	URL       string             `bson:"url" json:"url"`
+	Events    []string           `bson:"events" json:"events"`
+	Secret    string             `bson:"secret" json:"-"`
+	Active    bool               `bson:"active" json:"active"`
+	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+}
+
+// webhookEvent is the body of a delivery
+type webhookEvent struct {
+	Event      string      `json:"event"`
+	Collection string      `json:"collection"`
+	DocumentID string      `json:"document_id,omitempty"`
+	Actor      string      `json:"actor"`
+	Data       interface{} `json:"data,omitempty"` // the document after the change, before it for a delete
+	OccurredAt time.Time   `json:"occurred_at"`
+}
+
+// rawJSON is JSON kept as a string in Mongo and written out as is
+type rawJSON string
+
+func (j rawJSON) MarshalJSON() ([]byte, error) { return []byte(j), nil }
+
+// webhookDelivery is one event on its way to one subscription. The body is encoded once, when the
+// event is queued, so every retry sends and signs the same bytes. Deliveries of a subscription go out
+// in _id order as far as retries allow.
+type webhookDelivery struct {
+	ID             primitive.ObjectID `bson:"_id,omitempty" json:"delivery_id"`
+	SubscriptionID primitive.ObjectID `bson:"subscription_id" json:"webhook_id"`
+	Event          string             `bson:"event" json:"event"`
+	Body           rawJSON            `bson:"body" json:"payload"`
+	Status         string             `bson:"status" json:"status"`
+	Attempts       int                `bson:"attempts" json:"attempts"`
+	NextAttemptAt  time.Time          `bson:"next_attempt_at" json:"next_attempt_at"`
+	GiveUpAt       time.Time          `bson:"give_up_at" json:"give_up_at"`
+	LeaseUntil     *time.Time         `bson:"lease_until,omitempty" json:"-"`
+	LastError      string             `bson:"last_error,omitempty" json:"last_error,omitempty"`
+	LastStatusCode int                `bson:"last_status_code,omitempty" json:"last_status_code,omitempty"`
+	CreatedAt      time.Time          `bson:"created_at" json:"created_at"`
+	DeliveredAt    *time.Time         `bson:"delivered_at,omitempty" json:"delivered_at,omitempty"`
+	DeadAt         *time.Time         `bson:"dead_at,omitempty" json:"dead_at,omitempty"`
+}
+
+// enqueueWebhooks queues the event of a write for every active subscription that wants it. Like the
+// audit entry it only logs on failure.
+func enqueueWebhooks(ctx context.Context, meta auditMeta, action, collectionName, documentID string, before, after interface{}) {
+	if !isOneOf(collectionName, webhookCollections) || !isOneOf(action, webhookActions) {
+		return
+	}
+	event := collectionName + "." + action
+	subscriptions, err := findAllWith[WebhookSubscription](ctx, "webhook_subscriptions",
+		bson.M{"active": true, "$or": bson.A{bson.M{"events": event}, bson.M{"events": bson.M{"$size": 0}}}},
+		options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		log.Println("Failed to load webhook subscriptions for", event, ":", err)
+		return
+	}
+	if len(subscriptions) == 0 {
+		return
+	}
+	data := after
+	if data == nil {
+		data = before
+	}
+	now := time.Now()
+	body, err := json.Marshal(webhookEvent{Event: event, Collection: collectionName, DocumentID: documentID, Actor: meta.Actor, Data: data, OccurredAt: now})
+	if err != nil {
+		log.Println("Failed to encode webhook event", event, documentID, ":", err)
+		return
+	}
+	deliveries := make([]interface{}, len(subscriptions))
+	for i, s := range subscriptions {
+		deliveries[i] = webhookDelivery{
+			SubscriptionID: s.ID,
+			Event:          event,
+			Body:           rawJSON(body),
+			Status:         deliveryPending,
+			NextAttemptAt:  now,
+			GiveUpAt:       now.Add(webhookMaxAge),
+			CreatedAt:      now,
+		}
+	}
+	if _, err := client.Database("MVDB").Collection("webhook_deliveries").InsertMany(ctx, deliveries); err != nil {
+		log.Println("Failed to queue webhooks for", event, documentID, ":", err)
+	}
+}
+
+// startWebhookWorkers starts WEBHOOK_WORKERS (default 2) delivery workers, none with 0
+func startWebhookWorkers() {
+	workers := defaultWebhookWorkers
+	if raw := os.Getenv("WEBHOOK_WORKERS"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			log.Fatal("WEBHOOK_WORKERS must be a whole number")
+		}
+		workers = n
+	}
+	for i := 0; i < workers; i++ {
+		go func() {
+			for {
+				if !deliverNextWebhook() {
+					time.Sleep(webhookIdlePoll)
+				}
+			}
+		}()
+	}
+}
+
+// deliverNextWebhook claims the due delivery queued first and sends it; false when there was nothing
+// to claim or the queue could not be read
+func deliverNextWebhook() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), webhookLease)
+	defer cancel()
+
+	collection := client.Database("MVDB").Collection("webhook_deliveries")
+	now := time.Now()
+	var d webhookDelivery
+	err := collection.FindOneAndUpdate(ctx,
+		bson.M{"status": deliveryPending, "next_attempt_at": bson.M{"$lte": now}, "lease_until": bson.M{"$not": bson.M{"$gt": now}}},
+		bson.M{"$set": bson.M{"lease_until": now.Add(webhookLease)}},
+		options.FindOneAndUpdate().SetSort(bson.D{{Key: "next_attempt_at", Value: 1}, {Key: "_id", Value: 1}}).
+			SetReturnDocument(options.After)).Decode(&d)
+	if err == mongo.ErrNoDocuments {
+		return false
+	}
+	if err != nil {
+		log.Println("Failed to claim webhook delivery:", err)
+		return false
+	}
+
+	// An older delivery of the same subscriber still waiting for a retry goes first
+	var older webhookDelivery
+	err = collection.FindOne(ctx,
+		bson.M{"subscription_id": d.SubscriptionID, "status": deliveryPending, "_id": bson.M{"$lt": d.ID}},
+		options.FindOne().SetSort(bson.D{{Key: "_id", Value: 1}}).SetProjection(bson.M{"next_attempt_at": 1})).Decode(&older)
+	if err == nil {
+		next := older.NextAttemptAt
+		if next.Before(now) {
+			next = now
+		}
+		updateWebhookDelivery(ctx, d.ID, bson.M{"$set": bson.M{"next_attempt_at": next.Add(webhookFIFODelay)}, "$unset": bson.M{"lease_until": ""}})
+		return true
+	}
+	if err != mongo.ErrNoDocuments {
+		log.Println("Failed to check the webhook queue order:", err)
+	}
+
+	var subscription WebhookSubscription
+	err = client.Database("MVDB").Collection("webhook_subscriptions").FindOne(ctx, bson.M{"_id": d.SubscriptionID, "active": true}).Decode(&subscription)
+	var statusCode int
+	if err == nil {
+		statusCode, err = sendWebhook(ctx, subscription, d)
+	} else if err == mongo.ErrNoDocuments {
+		err = fmt.Errorf("webhook subscription was removed")
+	}
+
+	now = time.Now()
+	update := bson.M{"$inc": bson.M{"attempts": 1}, "$unset": bson.M{"lease_until": ""}}
+	switch {
+	case err == nil:
+		update["$set"] = bson.M{"status": deliveryDelivered, "delivered_at": now, "last_status_code": statusCode}
+	case now.After(d.GiveUpAt):
+		update["$set"] = bson.M{"status": deliveryDead, "dead_at": now, "last_error": err.Error(), "last_status_code": statusCode}
+	default:
+		update["$set"] = bson.M{"next_attempt_at": now.Add(webhookBackoff(d.Attempts)), "last_error": err.Error(), "last_status_code": statusCode}
+	}
+	updateWebhookDelivery(ctx, d.ID, update)
+	return true
+}
+
+func updateWebhookDelivery(ctx context.Context, id primitive.ObjectID, update bson.M) {
+	if _, err := client.Database("MVDB").Collection("webhook_deliveries").UpdateByID(ctx, id, update); err != nil {
+		log.Println("Failed to update webhook delivery", id.Hex(), ":", err)
+	}
+}
+
+// webhookBackoff is the wait after the attempts+1st failure: 30s doubling up to an hour, plus up to
+// 10% jitter so a recovering subscriber isn't hit by every retry at once
+func webhookBackoff(attempts int) time.Duration {
+	wait := webhookRetryMax
+	if attempts < 20 {
+		wait = time.Duration(math.Min(float64(webhookRetryBase)*math.Pow(2, float64(attempts)), float64(webhookRetryMax)))
+	}
+	return wait + time.Duration(mathrand.Int63n(int64(wait/10)+1))
+}
+
+// sendWebhook posts the delivery; any answer but a 2xx is an error
+func sendWebhook(ctx context.Context, subscription WebhookSubscription, d webhookDelivery) (int, error) {
+	body := []byte(d.Body)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, subscription.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	mac := hmac.New(sha256.New, []byte(subscription.Secret))
+	mac.Write(body)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Event", d.Event)
+	req.Header.Set("X-Webhook-Delivery", d.ID.Hex()) // the same on every retry, for deduplication
+	req.Header.Set("X-Webhook-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("subscriber answered %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+func validateWebhookSubscription(s *WebhookSubscription) []string {
+	var problems []string
+	u, err := url.Parse(s.URL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		problems = append(problems, "url must be an absolute http or https URL")
+	}
+	for _, event := range s.Events {
+		collectionName, action, _ := strings.Cut(event, ".")
+		if !isOneOf(collectionName, webhookCollections) || !isOneOf(action, webhookActions) {
+			problems = append(problems, "unknown event "+event+", events are <collection>.<action> with a collection of "+
+				strings.Join(webhookCollections, ", ")+" and an action of "+strings.Join(webhookActions, ", "))
+		}
+	}
+	return problems
+}
+
+// createWebhookSubscription answers POST /admin/webhooks. The response is the only place the signing
+// secret appears.
+func createWebhookSubscription(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var body struct {
+		URL    string   `json:"url"`
+		Events []string `json:"events"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Failed to parse request body", http.StatusBadRequest)
+		return
+	}
+	subscription := WebhookSubscription{URL: body.URL, Events: body.Events, Active: true}
+	if subscription.Events == nil {
+		subscription.Events = []string{}
+	}
+	if problems := validateWebhookSubscription(&subscription); len(problems) > 0 {
+		http.Error(w, (&validationError{Problems: problems}).Error(), http.StatusBadRequest)
+		return
+	}
+	secret := make([]byte, 24)
+	if _, err := rand.Read(secret); err != nil {
+		serverError(w, r, "Failed to create webhook", err)
+		return
+	}
+	subscription.Secret = webhookSecretPrefix + hex.EncodeToString(secret)
+	subscription.CreatedAt = time.Now()
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	result, err := client.Database("MVDB").Collection("webhook_subscriptions").InsertOne(ctx, subscription)
+	if err != nil {
+		serverError(w, r, "Failed to create webhook", err)
+		return
+	}
+	subscription.ID = result.InsertedID.(primitive.ObjectID)
+	logged := subscription
+	logged.Secret = ""
+	auditCreated(auditFromRequest(r), "webhook_subscriptions", subscription.ID, logged)
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(struct {
+		WebhookSubscription
+		Secret string `json:"secret"`
+	}{subscription, subscription.Secret})
+}
+
+// getWebhookSubscriptions lists the active subscriptions, newest first
+func getWebhookSubscriptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	subscriptions, err := findAllWith[WebhookSubscription](ctx, "webhook_subscriptions", bson.M{"active": true},
+		options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}))
+	if err != nil {
+		serverError(w, r, "Failed to retrieve webhooks", err)
+		return
+	}
+	json.NewEncoder(w).Encode(subscriptions)
+}
+
+// deleteWebhookSubscription answers DELETE /admin/webhooks/{id}. Deliveries still queued for it are
+// dropped; dead letters stay for the record.
+func deleteWebhookSubscription(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	id, ok := pathObjectID(w, r, "webhook")
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	var before WebhookSubscription
+	err := client.Database("MVDB").Collection("webhook_subscriptions").FindOneAndUpdate(ctx,
+		bson.M{"_id": id, "active": true}, bson.M{"$set": bson.M{"active": false}}).Decode(&before)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		serverError(w, r, "Failed to delete webhook", err)
+		return
+	}
+	dropped, err := client.Database("MVDB").Collection("webhook_deliveries").DeleteMany(ctx,
+		bson.M{"subscription_id": id, "status": deliveryPending})
+	if err != nil {
+		serverError(w, r, "Failed to drop queued webhook deliveries", err)
+		return
+	}
+	before.Secret = ""
+	after := before
+	after.Active = false
+	recordAudit(auditFromRequest(r), "delete", "webhook_subscriptions", id.Hex(), before, after, bson.M{"dropped_deliveries": dropped.DeletedCount})
+	json.NewEncoder(w).Encode(bson.M{"message": "Webhook deleted", "dropped_deliveries": dropped.DeletedCount})
+}
+
+// getWebhookDeadLetters answers GET /admin/webhooks/dead-letters, newest first, optionally for one
+// webhook_id or event
+func getWebhookDeadLetters(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	page, ok := parseListPage(w, r)
+	if !ok {
+		return
+	}
+	filter := bson.M{"status": deliveryDead}
+	if raw := r.URL.Query().Get("webhook_id"); raw != "" {
+		id, err := primitive.ObjectIDFromHex(raw)
+		if err != nil {
+			http.Error(w, "Invalid webhook ID format", http.StatusBadRequest)
+			return
+		}
+		filter["subscription_id"] = id
+	}
+	if event := r.URL.Query().Get("event"); event != "" {
+		filter["event"] = event
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	deliveries, err := findAllWith[webhookDelivery](ctx, "webhook_deliveries", filter,
+		page.findOptions().SetSort(bson.D{{Key: "dead_at", Value: -1}}))
+	if err != nil {
+		serverError(w, r, "Failed to retrieve dead letters", err)
+		return
+	}
+	json.NewEncoder(w).Encode(deliveries)
+}
+
+// redeliverWebhook answers POST /admin/webhooks/dead-letters/{id}/redeliver, queueing a dead letter
+// again with a fresh WEBHOOK_MAX_AGE
+func redeliverWebhook(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	id, ok := pathObjectID(w, r, "delivery")
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	var delivery webhookDelivery
+	err := client.Database("MVDB").Collection("webhook_deliveries").FindOneAndUpdate(ctx,
+		bson.M{"_id": id, "status": deliveryDead},
+		bson.M{
+			"$set":   bson.M{"status": deliveryPending, "attempts": 0, "next_attempt_at": now, "give_up_at": now.Add(webhookMaxAge)},
+			"$unset": bson.M{"dead_at": "", "lease_until": ""},
+		},
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&delivery)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Dead letter not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		serverError(w, r, "Failed to queue the delivery again", err)
+		return
+	}
+	recordAudit(auditFromRequest(r), "redeliver", "webhook_deliveries", id.Hex(), nil, nil, nil)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(delivery)
+}
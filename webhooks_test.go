@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func TestWebhookBackoff(t *testing.T) {
+	for attempts, base := range map[int]time.Duration{0: 30 * time.Second, 1: time.Minute, 3: 4 * time.Minute, 7: time.Hour, 25: time.Hour} {
+		for i := 0; i < 20; i++ {
+			if wait := webhookBackoff(attempts); wait < base || wait > base+base/10 {
+				t.Errorf("after %d attempts: %s, want %s plus up to 10%%", attempts, wait, base)
+			}
+		}
+	}
+}
+
+func TestWebhookMaxAgeFromEnv(t *testing.T) {
+	for raw, want := range map[string]time.Duration{"": defaultWebhookMaxAge, "2h": 2 * time.Hour, "0s": defaultWebhookMaxAge, "a day": defaultWebhookMaxAge} {
+		t.Setenv("WEBHOOK_MAX_AGE", raw)
+		if got := webhookMaxAgeFromEnv(); got != want {
+			t.Errorf("WEBHOOK_MAX_AGE=%q: %s, want %s", raw, got, want)
+		}
+	}
+}
+
+func TestValidateWebhookSubscription(t *testing.T) {
+	valid := WebhookSubscription{URL: "https://crm.example.com/hooks", Events: []string{"listings.update", "appointments.create"}}
+	if problems := validateWebhookSubscription(&valid); len(problems) != 0 {
+		t.Errorf("valid subscription: %v", problems)
+	}
+	problems := validateWebhookSubscription(&WebhookSubscription{URL: "ftp://crm.example.com", Events: []string{"users.create", "listings.explode", "listings"}})
+	if len(problems) != 4 || problems[0] != "url must be an absolute http or https URL" || !strings.HasPrefix(problems[1], "unknown event users.create") {
+		t.Errorf("problems %q", problems)
+	}
+}
+
+// webhookReceiver answers deliveries with statuses in turn, then 200, and records them
+type webhookReceiver struct {
+	*httptest.Server
+	mu       sync.Mutex
+	statuses []int
+	received []*http.Request
+	bodies   []webhookEvent
+}
+
+func newWebhookReceiver(t *testing.T, statuses ...int) *webhookReceiver {
+	rv := &webhookReceiver{statuses: statuses}
+	rv.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mac := hmac.New(sha256.New, []byte("whsec_test"))
+		mac.Write(body)
+		if r.Header.Get("X-Webhook-Signature") != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+			t.Errorf("bad signature %q", r.Header.Get("X-Webhook-Signature"))
+		}
+		var event webhookEvent
+		json.Unmarshal(body, &event)
+		rv.mu.Lock()
+		defer rv.mu.Unlock()
+		rv.received = append(rv.received, r)
+		rv.bodies = append(rv.bodies, event)
+		status := http.StatusOK
+		if len(rv.statuses) > 0 {
+			status, rv.statuses = rv.statuses[0], rv.statuses[1:]
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(rv.Close)
+	return rv
+}
+
+func (rv *webhookReceiver) documentIDs() []string {
+	rv.mu.Lock()
+	defer rv.mu.Unlock()
+	ids := make([]string, len(rv.bodies))
+	for i, b := range rv.bodies {
+		ids[i] = b.DocumentID
+	}
+	return ids
+}
+
+func TestSendWebhook(t *testing.T) {
+	rv := newWebhookReceiver(t, http.StatusServiceUnavailable)
+	subscription := WebhookSubscription{URL: rv.URL, Secret: "whsec_test"}
+	d := webhookDelivery{ID: primitive.NewObjectID(), Event: "listings.update", Body: rawJSON(`{"event":"listings.update","document_id":"l1"}`)}
+	if code, err := sendWebhook(context.Background(), subscription, d); code != http.StatusServiceUnavailable || err == nil {
+		t.Errorf("a 503: %d %v", code, err)
+	}
+	if code, err := sendWebhook(context.Background(), subscription, d); code != http.StatusOK || err != nil {
+		t.Errorf("a 200: %d %v", code, err)
+	}
+	for _, r := range rv.received {
+		if r.Header.Get("X-Webhook-Delivery") != d.ID.Hex() || r.Header.Get("X-Webhook-Event") != "listings.update" {
+			t.Errorf("headers %v", r.Header)
+		}
+	}
+}
+
+// subscribeWebhook stores an active subscription to every event for the receiver
+func subscribeWebhook(t *testing.T, rv *webhookReceiver) primitive.ObjectID {
+	t.Helper()
+	id := primitive.NewObjectID()
+	if _, err := client.Database("MVDB").Collection("webhook_subscriptions").InsertOne(context.Background(),
+		WebhookSubscription{ID: id, URL: rv.URL, Events: []string{}, Secret: "whsec_test", Active: true}); err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func queuedDeliveries(t *testing.T) []webhookDelivery {
+	t.Helper()
+	deliveries, err := findAllWith[webhookDelivery](context.Background(), "webhook_deliveries", bson.M{},
+		options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return deliveries
+}
+
+// TestWebhookCrashRecovery: a worker claims the first delivery and dies before sending it. The
+// restarted workers leave it alone until its lease runs out, hold the newer deliveries of the
+// subscriber back behind it, and then send all three once, in order.
+func TestWebhookCrashRecovery(t *testing.T) {
+	useTestMongo(t, "webhook_subscriptions", "webhook_deliveries")
+	ctx := context.Background()
+	rv := newWebhookReceiver(t)
+	subscribeWebhook(t, rv)
+	for _, id := range []string{"l1", "l2", "l3"} {
+		enqueueWebhooks(ctx, auditMeta{Actor: "api_key"}, "update", "listings", id, nil, bson.M{"title": id})
+	}
+	enqueueWebhooks(ctx, auditMeta{}, "update", "users", "u1", nil, bson.M{}) // not a webhook collection
+	deliveries := queuedDeliveries(t)
+	if len(deliveries) != 3 {
+		t.Fatalf("%d deliveries queued, want 3", len(deliveries))
+	}
+	collection := client.Database("MVDB").Collection("webhook_deliveries")
+	if _, err := collection.UpdateByID(ctx, deliveries[0].ID, bson.M{"$set": bson.M{"lease_until": time.Now().Add(webhookLease)}}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if !deliverNextWebhook() {
+			t.Fatal("the newer deliveries weren't claimed")
+		}
+	}
+	if deliverNextWebhook() {
+		t.Error("a delivery was claimed while the first is leased and the others wait behind it")
+	}
+	if got := rv.documentIDs(); len(got) != 0 {
+		t.Fatalf("sent %v ahead of the delivery of the dead worker", got)
+	}
+
+	// the lease runs out, and the held back deliveries come due
+	if _, err := collection.UpdateByID(ctx, deliveries[0].ID, bson.M{"$set": bson.M{"lease_until": time.Now().Add(-time.Second)}}); err != nil {
+		t.Fatal(err)
+	}
+	if !deliverNextWebhook() {
+		t.Fatal("the expired lease wasn't claimed again")
+	}
+	if _, err := collection.UpdateMany(ctx, bson.M{"status": deliveryPending}, bson.M{"$set": bson.M{"next_attempt_at": time.Now()}}); err != nil {
+		t.Fatal(err)
+	}
+	for deliverNextWebhook() {
+	}
+	if got := strings.Join(rv.documentIDs(), ","); got != "l1,l2,l3" {
+		t.Errorf("delivered %s, want l1,l2,l3 once each", got)
+	}
+	for _, d := range queuedDeliveries(t) {
+		if d.Status != deliveryDelivered || d.Attempts != 1 || d.LeaseUntil != nil || d.DeliveredAt == nil {
+			t.Errorf("delivery %+v", d)
+		}
+	}
+	if rv.bodies[0].Actor != "api_key" || rv.bodies[0].Event != "listings.update" {
+		t.Errorf("body %+v", rv.bodies[0])
+	}
+}
+
+// TestWebhookRetryAndDeadLetter: a failure is retried later with the same delivery id; past the max
+// age it becomes a dead letter that can be queued again by hand
+func TestWebhookRetryAndDeadLetter(t *testing.T) {
+	useTestMongo(t, "webhook_subscriptions", "webhook_deliveries", "audit_logs")
+	ctx := context.Background()
+	rv := newWebhookReceiver(t, http.StatusInternalServerError, http.StatusBadGateway)
+	subscriptionID := subscribeWebhook(t, rv)
+	enqueueWebhooks(ctx, auditMeta{}, "create", "inquiries", "i1", nil, bson.M{"message": "Hi"})
+
+	started := time.Now()
+	if !deliverNextWebhook() {
+		t.Fatal("nothing claimed")
+	}
+	d := queuedDeliveries(t)[0]
+	if d.Status != deliveryPending || d.Attempts != 1 || d.LastStatusCode != 500 || d.NextAttemptAt.Before(started.Add(webhookRetryBase)) {
+		t.Fatalf("after a 500: %+v", d)
+	}
+	if deliverNextWebhook() {
+		t.Error("the retry went out before its backoff")
+	}
+
+	// the retry comes due past the max age
+	collection := client.Database("MVDB").Collection("webhook_deliveries")
+	past := time.Now().Add(-time.Second)
+	if _, err := collection.UpdateByID(ctx, d.ID, bson.M{"$set": bson.M{"next_attempt_at": past, "give_up_at": past}}); err != nil {
+		t.Fatal(err)
+	}
+	deliverNextWebhook()
+	d = queuedDeliveries(t)[0]
+	if d.Status != deliveryDead || d.DeadAt == nil || d.Attempts != 2 || d.LastError != "subscriber answered 502 Bad Gateway" {
+		t.Fatalf("after the max age: %+v", d)
+	}
+	if a, b := rv.received[0].Header.Get("X-Webhook-Delivery"), rv.received[1].Header.Get("X-Webhook-Delivery"); a != b || a != d.ID.Hex() {
+		t.Errorf("delivery ids %s and %s", a, b)
+	}
+
+	rec := httptest.NewRecorder()
+	getWebhookDeadLetters(rec, httptest.NewRequest(http.MethodGet, "/admin/webhooks/dead-letters?webhook_id="+subscriptionID.Hex(), nil))
+	var dead []webhookDelivery
+	if err := json.NewDecoder(rec.Body).Decode(&dead); err != nil {
+		t.Fatal(err)
+	}
+	if len(dead) != 1 || dead[0].ID != d.ID || !strings.Contains(string(dead[0].Body), `"document_id":"i1"`) {
+		t.Errorf("dead letters %+v", dead)
+	}
+
+	redeliver := func() int {
+		req := httptest.NewRequest(http.MethodPost, "/admin/webhooks/dead-letters/"+d.ID.Hex()+"/redeliver", nil)
+		rec := httptest.NewRecorder()
+		redeliverWebhook(rec, mux.SetURLVars(req, map[string]string{"id": d.ID.Hex()}))
+		return rec.Code
+	}
+	if code := redeliver(); code != http.StatusAccepted {
+		t.Fatalf("redeliver: %d", code)
+	}
+	if code := redeliver(); code != http.StatusNotFound {
+		t.Errorf("redelivering a queued delivery: %d", code)
+	}
+	if !deliverNextWebhook() {
+		t.Fatal("the redelivery wasn't claimed")
+	}
+	if d := queuedDeliveries(t)[0]; d.Status != deliveryDelivered || d.Attempts != 1 {
+		t.Errorf("after the redelivery: %+v", d)
+	}
+}
+
+// TestWebhookRemovedSubscription: deleting a subscription drops its queued deliveries, and one
+// claimed meanwhile fails without being sent
+func TestWebhookRemovedSubscription(t *testing.T) {
+	useTestMongo(t, "webhook_subscriptions", "webhook_deliveries", "audit_logs")
+	ctx := context.Background()
+	rv := newWebhookReceiver(t)
+	id := subscribeWebhook(t, rv)
+	enqueueWebhooks(ctx, auditMeta{}, "delete", "properties", "p1", bson.M{"title": "Noble"}, nil)
+	enqueueWebhooks(ctx, auditMeta{}, "delete", "properties", "p2", bson.M{"title": "Ashton"}, nil)
+
+	if _, err := client.Database("MVDB").Collection("webhook_subscriptions").UpdateByID(ctx, id, bson.M{"$set": bson.M{"active": false}}); err != nil {
+		t.Fatal(err)
+	}
+	deliverNextWebhook()
+	if d := queuedDeliveries(t)[0]; d.LastError != "webhook subscription was removed" || len(rv.documentIDs()) != 0 {
+		t.Errorf("a delivery of an inactive subscription: %+v, sent %v", d, rv.documentIDs())
+	}
+
+	if _, err := client.Database("MVDB").Collection("webhook_subscriptions").UpdateByID(ctx, id, bson.M{"$set": bson.M{"active": true}}); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodDelete, "/admin/webhooks/"+id.Hex(), nil)
+	rec := httptest.NewRecorder()
+	deleteWebhookSubscription(rec, mux.SetURLVars(req, map[string]string{"id": id.Hex()}))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"dropped_deliveries":2`) {
+		t.Errorf("delete: %d %s", rec.Code, rec.Body)
+	}
+	if left := queuedDeliveries(t); len(left) != 0 {
+		t.Errorf("%d deliveries left", len(left))
+	}
+}